@@ -38,6 +38,7 @@ type AgreementWorker struct {
 	containerSyncUpEvent     bool
 	containerSyncUpSucessful bool
 	producerPH               map[string]producer.ProducerProtocolHandler
+	heartbeat                *exchange.HeartbeatState
 }
 
 func NewAgreementWorker(name string, cfg *config.HorizonConfig, db *bolt.DB, pm *policy.PolicyManager) *AgreementWorker {
@@ -61,6 +62,7 @@ func NewAgreementWorker(name string, cfg *config.HorizonConfig, db *bolt.DB, pm
 		deviceToken:   token,
 		devicePattern: pattern,
 		producerPH:    make(map[string]producer.ProducerProtocolHandler),
+		heartbeat:     exchange.NewHeartbeatState(cfg.Edge.ExchangeHeartbeat),
 	}
 
 	glog.Info("Starting Agreement worker")
@@ -140,6 +142,7 @@ func (w *AgreementWorker) NewEvent(incoming events.Message) {
 		switch msg.Event().Id {
 		case events.START_UNCONFIGURE:
 			w.Commands <- worker.NewBeginShutdownCommand()
+			w.Commands <- NewDrainCommand(w.Config.Edge.ShutdownDrainTimeout())
 		}
 
 	case *events.NodeShutdownCompleteMessage:
@@ -289,6 +292,21 @@ func (w *AgreementWorker) CommandHandler(command worker.Command) bool {
 			pph.SetBlockchainWritable(cmd)
 		}
 
+	case *DrainCommand:
+		cmd, _ := command.(*DrainCommand)
+		// Commands queued behind the drain command have to be handled before the worker is drained, so defer
+		// the drain until the queue is empty. The queue might never empty, so give up waiting at the deadline.
+		if len(w.Commands) != 0 && time.Now().Before(cmd.Deadline) {
+			glog.V(5).Infof(logString(fmt.Sprintf("waiting for %v queued commands before draining", len(w.Commands))))
+			w.AddDeferredCommand(command)
+		} else {
+			if len(w.Commands) != 0 {
+				glog.Warningf(logString(fmt.Sprintf("timed out waiting for %v queued commands, draining anyway", len(w.Commands))))
+			}
+			glog.V(3).Infof(logString(fmt.Sprintf("drained")))
+			w.Messages() <- events.NewWorkerDrainedMessage(events.WORKER_DRAINED, w.GetName())
+		}
+
 	case *EdgeConfigCompleteCommand:
 		if w.deviceToken == "" {
 			glog.Warningf(logString(fmt.Sprintf("ignoring config complete, device not registered: %v and %v", w.deviceId, w.deviceToken)))
@@ -333,8 +351,12 @@ func (w *AgreementWorker) handleDeviceRegistered(cmd *DeviceRegisteredCommand) {
 
 // Heartbeat to the exchange. This function is called by the heartbeat subworker.
 func (w *AgreementWorker) heartBeat() int {
-	targetURL := w.Manager.Config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/heartbeat"
+	targetURL := w.Manager.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)) + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/heartbeat"
 	err := exchange.Heartbeat(w.httpClient, targetURL, w.deviceId, w.deviceToken)
+	w.heartbeat.Record(err)
+	if status := w.heartbeat.Status(); !status.Healthy {
+		glog.Warningf(logString(fmt.Sprintf("exchange heartbeat is unhealthy: %v", status)))
+	}
 
 	// If the heartbeat fails because the node entry is gone then initiate a full node quiesce
 	if err != nil && strings.Contains(err.Error(), "status: 401") {
@@ -344,6 +366,11 @@ func (w *AgreementWorker) heartBeat() int {
 	return 0
 }
 
+// Returns the state of the heartbeats to the exchange, for monitoring exchange connectivity.
+func (w *AgreementWorker) HeartbeatStatus() *exchange.HeartbeatStatus {
+	return w.heartbeat.Status()
+}
+
 // This function is only called when anax device side initializes. The agbot has it's own initialization checking.
 // This function is responsible for reconciling the agreements in our local DB with the agreements recorded in the exchange
 // and the blockchain, as well as looking for agreements that need to change based on changes to policy files. This function
@@ -372,7 +399,7 @@ func (w *AgreementWorker) syncOnInit() error {
 			} else if len(agreements) == 0 {
 				glog.V(3).Infof(logString(fmt.Sprintf("found agreement %v in the exchange that is not in our DB.", exchangeAg)))
 				// Delete the agreement from the exchange.
-				if err := deleteProducerAgreement(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), w.Config.Edge.ExchangeURL, w.deviceId, w.deviceToken, exchangeAg); err != nil {
+				if err := deleteProducerAgreement(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), w.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)), w.deviceId, w.deviceToken, exchangeAg); err != nil {
 					glog.Errorf(logString(fmt.Sprintf("error deleting agreement %v in exchange: %v", exchangeAg, err)))
 				}
 			}
@@ -473,7 +500,7 @@ func (w *AgreementWorker) syncOnInit() error {
 		for org, typeMap := range neededBCInstances {
 			for typeName, instMap := range typeMap {
 				for instName, _ := range instMap {
-					w.Messages() <- events.NewNewBCContainerMessage(events.NEW_BC_CLIENT, typeName, instName, org, w.Config.Edge.ExchangeURL, w.deviceId, w.deviceToken)
+					w.Messages() <- events.NewNewBCContainerMessage(events.NEW_BC_CLIENT, typeName, instName, org, w.Config.Edge.GetExchangeURL(org), w.deviceId, w.deviceToken)
 				}
 			}
 		}
@@ -523,7 +550,7 @@ func (w *AgreementWorker) getAllAgreements() (map[string]exchange.DeviceAgreemen
 	var resp interface{}
 	resp = new(exchange.AllDeviceAgreementsResponse)
 
-	targetURL := w.BaseWorker.Manager.Config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/agreements"
+	targetURL := w.BaseWorker.Manager.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)) + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/agreements"
 	for {
 		if err, tpErr := exchange.InvokeExchange(w.httpClient, "GET", targetURL, w.deviceId, w.deviceToken, nil, &resp); err != nil {
 			glog.Errorf(err.Error())
@@ -558,7 +585,7 @@ func (w *AgreementWorker) registerNode(dev *persistence.ExchangeDevice, ms *[]ex
 
 	var resp interface{}
 	resp = new(exchange.PutDeviceResponse)
-	targetURL := w.Manager.Config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId)
+	targetURL := w.Manager.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)) + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId)
 
 	glog.V(3).Infof("AgreementWorker Registering microservices: %v at %v", pdr.ShortString(), targetURL)
 
@@ -582,7 +609,7 @@ func (w *AgreementWorker) patchNodeKey() error {
 
 	var resp interface{}
 	resp = new(exchange.PutDeviceResponse)
-	targetURL := w.Manager.Config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId)
+	targetURL := w.Manager.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)) + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId)
 
 	glog.V(3).Infof(logString(fmt.Sprintf("patching messaging key to node entry: %v at %v", pdr, targetURL)))
 
@@ -714,7 +741,7 @@ func (w *AgreementWorker) recordAgreementState(agreementId string, pol *policy.P
 	as.State = state
 	var resp interface{}
 	resp = new(exchange.PostDeviceResponse)
-	targetURL := w.Manager.Config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/agreements/" + agreementId
+	targetURL := w.Manager.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)) + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/agreements/" + agreementId
 	for {
 		if err, tpErr := exchange.InvokeExchange(w.httpClient, "PUT", targetURL, w.deviceId, w.deviceToken, as, &resp); err != nil {
 			glog.Errorf(err.Error())
@@ -757,7 +784,7 @@ func deleteProducerAgreement(httpClient *http.Client, url string, deviceId strin
 func (w *AgreementWorker) deleteMessage(msg *exchange.DeviceMessage) error {
 	var resp interface{}
 	resp = new(exchange.PostDeviceResponse)
-	targetURL := w.Manager.Config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/msgs/" + strconv.Itoa(msg.MsgId)
+	targetURL := w.Manager.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)) + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/msgs/" + strconv.Itoa(msg.MsgId)
 	for {
 		if err, tpErr := exchange.InvokeExchange(w.httpClient, "DELETE", targetURL, w.deviceId, w.deviceToken, nil, &resp); err != nil {
 			glog.Errorf(err.Error())
@@ -776,7 +803,7 @@ func (w *AgreementWorker) deleteMessage(msg *exchange.DeviceMessage) error {
 func (w *AgreementWorker) messageInExchange(msgId int) (bool, error) {
 	var resp interface{}
 	resp = new(exchange.GetDeviceMessageResponse)
-	targetURL := w.Manager.Config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/msgs"
+	targetURL := w.Manager.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)) + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/msgs"
 	for {
 		if err, tpErr := exchange.InvokeExchange(w.httpClient, "GET", targetURL, w.deviceId, w.deviceToken, nil, &resp); err != nil {
 			glog.Errorf(err.Error())
@@ -3,6 +3,7 @@ package agreement
 import (
 	"fmt"
 	"github.com/open-horizon/anax/events"
+	"time"
 )
 
 // ===============================================================================================
@@ -51,3 +52,18 @@ func NewEdgeConfigCompleteCommand(msg *events.EdgeConfigCompleteMessage) *EdgeCo
 		Msg: msg,
 	}
 }
+
+// ==============================================================================================================
+type DrainCommand struct {
+	Deadline time.Time // The time after which the worker drains even if commands are still queued
+}
+
+func (d DrainCommand) ShortString() string {
+	return fmt.Sprintf("DrainCommand")
+}
+
+func NewDrainCommand(timeout time.Duration) *DrainCommand {
+	return &DrainCommand{
+		Deadline: time.Now().Add(timeout),
+	}
+}
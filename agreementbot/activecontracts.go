@@ -7,8 +7,11 @@ import (
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/cutil"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -29,10 +32,9 @@ type DeviceEntry struct {
 	Agreements []AgreementEntry `json:"contracts"`
 }
 
-func GetActiveAgreements(in_devices map[string][]string, agreement Agreement, hConfig *config.HorizonConfig) ([]string, error) {
+func GetActiveAgreements(httpClient *http.Client, in_devices map[string][]string, agreement Agreement, hConfig *config.HorizonConfig) ([]string, error) {
 	err := error(nil)
 
-	httpClient := hConfig.Collaborators.HTTPClientFactory.NewHTTPClient(nil)
 	config := hConfig.AgreementBot
 
 	// If the agreement record was created with the ActiveContractsURL field, then it means that the policy which created the
@@ -45,20 +47,9 @@ func GetActiveAgreements(in_devices map[string][]string, agreement Agreement, hC
 		return res, err
 	}
 
-	activeAgreementsURL := agreement.DataVerificationURL
-	if activeAgreementsURL == "" {
-		activeAgreementsURL = config.ActiveAgreementsURL
-	}
+	activeAgreementsURL := activeAgreementsURL(agreement, &config)
 
-	activeAgreementsUser := agreement.DataVerificationUser
-	if activeAgreementsUser == "" {
-		activeAgreementsUser = config.ActiveAgreementsUser
-	}
-
-	activeAgreementsPW := agreement.DataVerificationPW
-	if activeAgreementsPW == "" {
-		activeAgreementsPW = config.ActiveAgreementsPW
-	}
+	auth := DataVerificationAuth(agreement, &config)
 
 	if _, ok := in_devices[activeAgreementsURL]; !ok {
 		devices := make([]string, 0, 10)
@@ -68,7 +59,7 @@ func GetActiveAgreements(in_devices map[string][]string, agreement Agreement, hC
 		// error to the caller.
 		retries := 0
 		for {
-			if err = Invoke_rest(httpClient, "GET", activeAgreementsURL, activeAgreementsUser, activeAgreementsPW, nil, &response); err != nil {
+			if err = Invoke_rest(httpClient, "GET", activeAgreementsURL, auth, nil, &response); err != nil {
 				glog.Errorf("Error getting active agreements: %v", err)
 				if retries == 2 {
 					break
@@ -95,6 +86,88 @@ func GetActiveAgreements(in_devices map[string][]string, agreement Agreement, hC
 	}
 }
 
+// Returns the data verification URL of the agreement, or the default data verification URL from the config when the
+// agreement's policy didn't specify one.
+func activeAgreementsURL(agreement Agreement, config *config.AGConfig) string {
+	if agreement.DataVerificationURL != "" {
+		return agreement.DataVerificationURL
+	}
+	return config.ActiveAgreementsURL
+}
+
+// The credentials used to call a REST API. If a token is set it is sent in the token header, otherwise the user and
+// password are sent with basic auth, if they are set.
+type RestAuth struct {
+	User        string
+	PW          string
+	Token       string
+	TokenHeader string // The header to send the token in, empty means "Authorization: Bearer <token>"
+}
+
+func (a RestAuth) String() string {
+	return fmt.Sprintf("User: %v, Token set: %v, TokenHeader: %v", a.User, a.Token != "", a.TokenHeader)
+}
+
+func (a RestAuth) apply(req *http.Request) {
+	if a.Token != "" {
+		if a.TokenHeader == "" {
+			req.Header.Set("Authorization", "Bearer "+a.Token)
+		} else {
+			req.Header.Set(a.TokenHeader, a.Token)
+		}
+	} else if a.User != "" && a.PW != "" {
+		req.SetBasicAuth(a.User, a.PW)
+	}
+}
+
+// Returns the credentials for the data verification API of an agreement. In order of precedence, these are the user
+// and password from the agreement's policy, the ActiveAgreementsToken from the config, and the ActiveAgreementsUser
+// and ActiveAgreementsPW from the config.
+func DataVerificationAuth(agreement Agreement, config *config.AGConfig) RestAuth {
+	if agreement.DataVerificationUser != "" {
+		pw := agreement.DataVerificationPW
+		if pw == "" {
+			pw = config.ActiveAgreementsPW
+		}
+		return RestAuth{User: agreement.DataVerificationUser, PW: pw}
+	} else if config.ActiveAgreementsToken != "" {
+		return RestAuth{Token: config.ActiveAgreementsToken, TokenHeader: config.ActiveAgreementsTokenHeader}
+	}
+
+	pw := agreement.DataVerificationPW
+	if pw == "" {
+		pw = config.ActiveAgreementsPW
+	}
+	return RestAuth{User: config.ActiveAgreementsUser, PW: pw}
+}
+
+// The agreements whose DVPrefix mismatch has been logged. The data verification API is checked for the whole life of
+// an agreement, so a mismatch is logged on the first check only. An agreement is forgotten when it is purged.
+var dvPrefixWarnings = &dvPrefixWarned{agreements: make(map[string]bool)}
+
+type dvPrefixWarned struct {
+	lock       sync.Mutex
+	agreements map[string]bool
+}
+
+// Returns true the first time it is called for an agreement, until the agreement is forgotten.
+func (d *dvPrefixWarned) first(agreementId string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.agreements[agreementId] {
+		return false
+	}
+	d.agreements[agreementId] = true
+	return true
+}
+
+func (d *dvPrefixWarned) forget(agreementId string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.agreements, agreementId)
+}
+
 func ActiveAgreementsContains(activeAgreements []string, agreement Agreement, prefix string) bool {
 
 	inttest_mode := os.Getenv("mtn_integration_test")
@@ -103,22 +176,23 @@ func ActiveAgreementsContains(activeAgreements []string, agreement Agreement, pr
 	}
 
 	for _, dev := range activeAgreements {
-		if dev == agreement.CurrentAgreementId || dev == prefix+agreement.CurrentAgreementId {
+		if id, prefixed := cutil.StripDVPrefix(prefix, dev); id == agreement.CurrentAgreementId {
+			if !prefixed && cutil.NormalizeDVPrefix(prefix) != "" && dvPrefixWarnings.first(agreement.CurrentAgreementId) {
+				glog.Warningf(AWlogString(fmt.Sprintf("agreement %v is reported by the data verification API without the DVPrefix %v, the edge and agbot DVPrefix settings should agree", agreement.CurrentAgreementId, prefix)))
+			}
 			return true
+		} else if cutil.NormalizeDVPrefix(prefix) == "" && strings.HasSuffix(dev, agreement.CurrentAgreementId) && dvPrefixWarnings.first(agreement.CurrentAgreementId) {
+			glog.Warningf(AWlogString(fmt.Sprintf("agreement %v is reported by the data verification API as %v, the agbot needs a DVPrefix that matches the edge DVPrefix to recognize it", agreement.CurrentAgreementId, dev)))
 		}
 	}
 
 	return false
 }
 
-func Invoke_rest(client *http.Client, method string, url string, user string, pw string, body []byte, outstruct interface{}) error {
+func Invoke_rest(client *http.Client, method string, url string, auth RestAuth, body []byte, outstruct interface{}) error {
 	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
 	req.Header.Set("Content-Type", "application/json")
-	if user != "" && pw != "" {
-		req.SetBasicAuth(user, pw)
-	}
-
-	req.Close = true // work around to ensure that Go doesn't get connections confused. Supposed to be fixed in Go 1.6.
+	auth.apply(req)
 
 	rawresp, err := client.Do(req)
 	if err != nil {
@@ -0,0 +1,109 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"github.com/open-horizon/anax/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_DataVerificationAuth_precedence(t *testing.T) {
+
+	cfg := &config.AGConfig{ActiveAgreementsUser: "cfguser", ActiveAgreementsPW: "cfgpw"}
+
+	// Basic auth from the config.
+	if auth := DataVerificationAuth(Agreement{}, cfg); auth.User != "cfguser" || auth.PW != "cfgpw" || auth.Token != "" {
+		t.Errorf("expected config user and password, got %v", auth)
+	}
+
+	// A token in the config takes precedence over the config user and password.
+	cfg.ActiveAgreementsToken = "tok"
+	cfg.ActiveAgreementsTokenHeader = "X-API-Key"
+	if auth := DataVerificationAuth(Agreement{}, cfg); auth.Token != "tok" || auth.TokenHeader != "X-API-Key" || auth.User != "" {
+		t.Errorf("expected config token, got %v", auth)
+	}
+
+	// A user and password in the policy take precedence over everything in the config.
+	if auth := DataVerificationAuth(Agreement{DataVerificationUser: "poluser", DataVerificationPW: "polpw"}, cfg); auth.User != "poluser" || auth.PW != "polpw" || auth.Token != "" {
+		t.Errorf("expected policy user and password, got %v", auth)
+	}
+}
+
+func Test_Invoke_rest_auth(t *testing.T) {
+
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	var response []DeviceEntry
+
+	if err := Invoke_rest(&http.Client{}, "GET", server.URL, RestAuth{Token: "tok"}, nil, &response); err != nil {
+		t.Errorf("unexpected error %v", err)
+	} else if got.Header.Get("Authorization") != "Bearer tok" {
+		t.Errorf("expected bearer token, got %v", got.Header.Get("Authorization"))
+	}
+
+	if err := Invoke_rest(&http.Client{}, "GET", server.URL, RestAuth{Token: "tok", TokenHeader: "X-API-Key"}, nil, &response); err != nil {
+		t.Errorf("unexpected error %v", err)
+	} else if got.Header.Get("X-API-Key") != "tok" || got.Header.Get("Authorization") != "" {
+		t.Errorf("expected token in X-API-Key header, got %v", got.Header)
+	}
+
+	if err := Invoke_rest(&http.Client{}, "GET", server.URL, RestAuth{User: "u", PW: "p"}, nil, &response); err != nil {
+		t.Errorf("unexpected error %v", err)
+	} else if user, pw, ok := got.BasicAuth(); !ok || user != "u" || pw != "p" {
+		t.Errorf("expected basic auth, got %v %v %v", user, pw, ok)
+	}
+}
+
+func Test_ActiveAgreementsContains_prefix(t *testing.T) {
+
+	ag := Agreement{CurrentAgreementId: "0123abcd"}
+
+	if !ActiveAgreementsContains([]string{"other", "0123abcd"}, ag, "") {
+		t.Errorf("expected the agreement id to be found without a prefix")
+	} else if !ActiveAgreementsContains([]string{"dv-0123abcd"}, ag, " dv-") {
+		t.Errorf("expected the prefixed agreement id to be found with a normalized prefix")
+	} else if !ActiveAgreementsContains([]string{"0123abcd"}, ag, "dv-") {
+		t.Errorf("expected the agreement id to be found without the configured prefix")
+	} else if ActiveAgreementsContains([]string{"dv-0123abcd"}, ag, "") {
+		t.Errorf("expected a prefixed agreement id not to be found without a configured prefix")
+	} else if ActiveAgreementsContains([]string{"xx-0123abcd"}, ag, "dv-") {
+		t.Errorf("expected an agreement id with another prefix not to be found")
+	}
+}
+
+// A DVPrefix mismatch is logged on the first data verification check of an agreement only, until the agreement is purged.
+func Test_ActiveAgreementsContains_warn_once(t *testing.T) {
+
+	saved := dvPrefixWarnings
+	defer func() { dvPrefixWarnings = saved }()
+	dvPrefixWarnings = &dvPrefixWarned{agreements: make(map[string]bool)}
+
+	for _, ag := range []Agreement{{CurrentAgreementId: "unprefixed"}, {CurrentAgreementId: "noprefix"}} {
+		prefix, reported := "dv-", ag.CurrentAgreementId
+		if ag.CurrentAgreementId == "noprefix" {
+			prefix, reported = "", "dv-"+ag.CurrentAgreementId
+		}
+		ActiveAgreementsContains([]string{reported}, ag, prefix)
+		if dvPrefixWarnings.first(ag.CurrentAgreementId) {
+			t.Errorf("expected the mismatch of agreement %v to be recorded as logged", ag.CurrentAgreementId)
+		}
+		dvPrefixWarnings.forget(ag.CurrentAgreementId)
+		if !dvPrefixWarnings.first(ag.CurrentAgreementId) {
+			t.Errorf("expected the mismatch of agreement %v to be logged again after it is forgotten", ag.CurrentAgreementId)
+		}
+	}
+
+	// An agreement whose prefix matches is not recorded.
+	ActiveAgreementsContains([]string{"dv-matched"}, Agreement{CurrentAgreementId: "matched"}, "dv-")
+	if !dvPrefixWarnings.first("matched") {
+		t.Errorf("expected no mismatch to be recorded for a matching prefix")
+	}
+}
@@ -0,0 +1,180 @@
+package agreementbot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An agreement query is an expression of terms combined with and, or, not and parentheses, e.g.
+//
+//	org=myorg and (pattern=netspeed or workload_url=https://bluehorizon.network/workloads/cpu) and not paused and age>24h
+//
+// and binds tighter than or. The terms are:
+//
+//	field=value           the field of the agreement has the value, the fields are listed in agreementQueryFields
+//	metadata.key=value    the agreement metadata has the key with the value, an empty value matches any value
+//	age>time, age<time    the time since the agreement was started, in seconds or as a duration such as 90m or 24h
+//	paused                the governance of the agreement is paused
+//	finalized             the agreement is finalized
+//
+// Values cannot contain spaces or parentheses, and only the metadata terms can have an empty value.
+
+// The filters for the fields that agreement query terms can match, by field name. Each returns the filter for the
+// agreements whose field has the input value.
+var agreementQueryFields = map[string]func(value string) AFilter{
+	"id":               IdAFilter,
+	"org":              func(value string) AFilter { return func(a Agreement) bool { return a.Org == value } },
+	"device":           DeviceAFilter,
+	"policy":           func(value string) AFilter { return func(a Agreement) bool { return a.PolicyName == value } },
+	"pattern":          func(value string) AFilter { return func(a Agreement) bool { return a.Pattern == value } },
+	"protocol":         func(value string) AFilter { return func(a Agreement) bool { return a.AgreementProtocol == value } },
+	"workload_url":     func(value string) AFilter { return WorkloadAFilter(value, "", "") },
+	"workload_version": func(value string) AFilter { return WorkloadAFilter("", value, "") },
+	"workload_arch":    func(value string) AFilter { return WorkloadAFilter("", "", value) },
+}
+
+type agreementQueryParser struct {
+	tokens []string
+	pos    int
+	now    uint64
+}
+
+// Parse an agreement query into a filter. The age terms are relative to now.
+func ParseAgreementQuery(query string, now uint64) (AFilter, error) {
+	query = strings.Replace(strings.Replace(query, "(", " ( ", -1), ")", " ) ", -1)
+	p := &agreementQueryParser{tokens: strings.Fields(query), now: now}
+	if len(p.tokens) == 0 {
+		return nil, errors.New("the query is empty")
+	}
+
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	} else if p.pos != len(p.tokens) {
+		return nil, errors.New(fmt.Sprintf("unexpected %v after the end of the expression", p.tokens[p.pos]))
+	}
+	return filter, nil
+}
+
+// Returns the next token, with the operators in lower case, or the empty string at the end of the query.
+func (p *agreementQueryParser) peek() string {
+	if p.pos == len(p.tokens) {
+		return ""
+	} else if tok := strings.ToLower(p.tokens[p.pos]); tok == "and" || tok == "or" || tok == "not" {
+		return tok
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *agreementQueryParser) parseOr() (AFilter, error) {
+	filters := make([]AFilter, 0, 2)
+	for {
+		if f, err := p.parseAnd(); err != nil {
+			return nil, err
+		} else {
+			filters = append(filters, f)
+		}
+		if p.peek() != "or" {
+			break
+		}
+		p.pos += 1
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return OrAFilter(filters...), nil
+}
+
+func (p *agreementQueryParser) parseAnd() (AFilter, error) {
+	filters := make([]AFilter, 0, 2)
+	for {
+		if f, err := p.parseNot(); err != nil {
+			return nil, err
+		} else {
+			filters = append(filters, f)
+		}
+		if p.peek() != "and" {
+			break
+		}
+		p.pos += 1
+	}
+
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return AndAFilter(filters...), nil
+}
+
+func (p *agreementQueryParser) parseNot() (AFilter, error) {
+	switch tok := p.peek(); tok {
+	case "":
+		return nil, errors.New("the query ends where a term is expected")
+	case "and", "or", ")":
+		return nil, errors.New(fmt.Sprintf("unexpected %v where a term is expected", tok))
+	case "not":
+		p.pos += 1
+		if f, err := p.parseNot(); err != nil {
+			return nil, err
+		} else {
+			return NotAFilter(f), nil
+		}
+	case "(":
+		p.pos += 1
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		} else if p.peek() != ")" {
+			return nil, errors.New("missing ) at the end of a parenthesized expression")
+		}
+		p.pos += 1
+		return f, nil
+	default:
+		p.pos += 1
+		return p.term(tok)
+	}
+}
+
+func (p *agreementQueryParser) term(t string) (AFilter, error) {
+	now := p.now
+
+	if t == "paused" {
+		return PausedAFilter(), nil
+	} else if t == "finalized" {
+		return func(a Agreement) bool { return a.AgreementFinalizedTime != 0 }, nil
+	} else if strings.HasPrefix(t, "age>") || strings.HasPrefix(t, "age<") {
+		secs, err := agreementQuerySeconds(t[4:])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("term %v has an invalid age, %v", t, err))
+		} else if t[3] == '>' {
+			return func(a Agreement) bool { return a.AgreementInceptionTime+secs < now }, nil
+		}
+		return func(a Agreement) bool { return a.AgreementInceptionTime+secs > now }, nil
+	}
+
+	pieces := strings.SplitN(t, "=", 2)
+	if len(pieces) != 2 {
+		return nil, errors.New(fmt.Sprintf("term %v must be of the form field=value, age>time, age<time, paused or finalized", t))
+	} else if strings.HasPrefix(pieces[0], "metadata.") && len(pieces[0]) > len("metadata.") {
+		return MetadataAFilter(strings.TrimPrefix(pieces[0], "metadata."), pieces[1]), nil
+	} else if field, ok := agreementQueryFields[pieces[0]]; !ok {
+		return nil, errors.New(fmt.Sprintf("term %v has an unknown field %v", t, pieces[0]))
+	} else if pieces[1] == "" {
+		return nil, errors.New(fmt.Sprintf("term %v has no value", t))
+	} else {
+		return field(pieces[1]), nil
+	}
+}
+
+// Returns the number of seconds in the input, which is a number of seconds or a duration such as 24h.
+func agreementQuerySeconds(s string) (uint64, error) {
+	if secs, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return secs, nil
+	} else if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return uint64(d / time.Second), nil
+	}
+	return 0, errors.New(fmt.Sprintf("%v is not a number of seconds or a duration", s))
+}
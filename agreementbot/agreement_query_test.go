@@ -0,0 +1,83 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"strings"
+	"testing"
+)
+
+func queryAgreements() []Agreement {
+	return []Agreement{
+		Agreement{CurrentAgreementId: "old", Org: "myorg", Pattern: "netspeed", AgreementInceptionTime: 1000},
+		Agreement{CurrentAgreementId: "new", Org: "myorg", Pattern: "netspeed", AgreementInceptionTime: 100000},
+		Agreement{CurrentAgreementId: "paused", Org: "myorg", Pattern: "netspeed", AgreementInceptionTime: 1000, Paused: true},
+		Agreement{CurrentAgreementId: "cpu", Org: "myorg", WorkloadURL: "https://bluehorizon.network/workloads/cpu", WorkloadVersion: "1.0.0", WorkloadArch: "amd64", AgreementInceptionTime: 1000, AgreementFinalizedTime: 2000},
+		Agreement{CurrentAgreementId: "other", Org: "otherorg", Pattern: "netspeed", AgreementInceptionTime: 1000, Metadata: map[string]string{"batch": "2017-11"}},
+	}
+}
+
+// Returns the ids of the agreements that the filter matches.
+func matchedIds(filter AFilter) string {
+	ids := make([]string, 0, 5)
+	for _, ag := range queryAgreements() {
+		if filter(ag) {
+			ids = append(ids, ag.CurrentAgreementId)
+		}
+	}
+	return strings.Join(ids, ",")
+}
+
+func Test_AFilter_combinators(t *testing.T) {
+
+	myorg := func(a Agreement) bool { return a.Org == "myorg" }
+
+	if ids := matchedIds(AndAFilter(myorg, NotAFilter(PausedAFilter()))); ids != "old,new,cpu" {
+		t.Errorf("expected the unpaused agreements of myorg, got %v", ids)
+	} else if ids := matchedIds(OrAFilter(PausedAFilter(), IdAFilter("other"))); ids != "paused,other" {
+		t.Errorf("expected the paused agreement and agreement other, got %v", ids)
+	} else if ids := matchedIds(AndAFilter()); ids != "old,new,paused,cpu,other" {
+		t.Errorf("expected an empty and to match every agreement, got %v", ids)
+	} else if ids := matchedIds(OrAFilter()); ids != "" {
+		t.Errorf("expected an empty or to match no agreement, got %v", ids)
+	}
+}
+
+func Test_ParseAgreementQuery_compound(t *testing.T) {
+
+	now := uint64(1000 + 86400 + 1)
+
+	for query, expected := range map[string]string{
+		"org=myorg and not paused and age>24h":                                                    "old,cpu",
+		"org=myorg AND NOT paused AND age>86400":                                                  "old,cpu",
+		"(pattern=netspeed or workload_url=https://bluehorizon.network/workloads/cpu) and age<1h": "new",
+		"org=otherorg or finalized":                                                               "cpu,other",
+		"not (org=myorg or metadata.batch=)":                                                      "",
+		"metadata.batch=2017-11 or (paused)":                                                      "paused,other",
+		"id=new":                                                                                  "new",
+		"workload_version=1.0.0 and workload_arch=amd64":                                          "cpu",
+		"workload_arch=arm":                                                                       "",
+	} {
+		if filter, err := ParseAgreementQuery(query, now); err != nil {
+			t.Errorf("unexpected error parsing %v: %v", query, err)
+		} else if ids := matchedIds(filter); ids != expected {
+			t.Errorf("expected query %v to match %v, got %v", query, expected, ids)
+		}
+	}
+
+	// and binds tighter than or.
+	if filter, err := ParseAgreementQuery("org=otherorg or finalized and age>24h", now); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if ids := matchedIds(filter); ids != "cpu,other" {
+		t.Errorf("expected and to bind tighter than or, got %v", ids)
+	}
+}
+
+func Test_ParseAgreementQuery_errors(t *testing.T) {
+
+	for _, query := range []string{"", "  ", "org=myorg and", "or org=myorg", "(org=myorg", "org=myorg)", "not", "org", "color=blue", "age>soon", "age<-1h", "org=myorg paused", "org=", "workload_url="} {
+		if _, err := ParseAgreementQuery(query, 0); err == nil {
+			t.Errorf("expected an error for query %q", query)
+		}
+	}
+}
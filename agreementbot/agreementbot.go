@@ -17,6 +17,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,6 +28,9 @@ const GOVERN_ARCHIVED_AGREEMENTS = "AgBotGovernArchivedAgreements"
 const GOVERN_BC_NEEDS = "AgBotGovernBlockchain"
 const POLICY_WATCHER = "AgBotPolicyWatcher"
 const GENERATE_POLICY = "AgBotPolicyGenerator"
+const GOVERN_DB_INTEGRITY = "AgBotGovernDBIntegrity"
+const RECONCILE_AGREEMENTS = "AgBotReconcileAgreements"
+const RECONCILE_REQUESTS = "AgBotReconcileRequests"
 
 // Agreement governance timing state. Used in the GovernAgreements subworker.
 type DVState struct {
@@ -47,24 +51,34 @@ type AgreementBotWorker struct {
 	PatternManager    *PatternManager
 	NHManager         *NodeHealthManager
 	GovTiming         DVState
+	heartbeat         *exchange.HeartbeatState
+	credentials       *ExchangeCredentialState
+	searchBackoff     *SearchBackoff
+	reconcileLock     sync.Mutex // serializes the on demand and periodic reconciliations with the exchange
+	reconcileRequests chan bool  // the pending on demand reconciliation, at most one
 }
 
 func NewAgreementBotWorker(name string, cfg *config.HorizonConfig, db *bolt.DB) *AgreementBotWorker {
 
 	worker := &AgreementBotWorker{
-		BaseWorker:     worker.NewBaseWorker(name, cfg),
-		db:             db,
-		httpClient:     cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
-		agbotId:        cfg.AgreementBot.ExchangeId,
-		token:          cfg.AgreementBot.ExchangeToken,
-		consumerPH:     make(map[string]ConsumerProtocolHandler),
-		ready:          false,
-		PatternManager: NewPatternManager(),
-		NHManager:      NewNodeHealthManager(),
-		GovTiming:      DVState{},
+		BaseWorker:        worker.NewBaseWorker(name, cfg),
+		db:                db,
+		httpClient:        cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+		agbotId:           cfg.AgreementBot.ExchangeId,
+		token:             cfg.AgreementBot.ExchangeToken,
+		consumerPH:        make(map[string]ConsumerProtocolHandler),
+		ready:             false,
+		PatternManager:    NewPatternManager(),
+		NHManager:         NewNodeHealthManager(),
+		GovTiming:         DVState{},
+		heartbeat:         exchange.NewHeartbeatState(cfg.AgreementBot.ExchangeHeartbeat),
+		credentials:       ExchangeCredentials,
+		searchBackoff:     NewSearchBackoff(cfg.AgreementBot.NewContractIntervalS, cfg.AgreementBot.NewContractMaxIntervalS),
+		reconcileRequests: make(chan bool, 1),
 	}
 
 	glog.Info("Starting AgreementBot worker")
+	worker.SetJitter(cfg.AgreementBot.IntervalJitterPercent)
 	worker.Start(worker, int(cfg.AgreementBot.NewContractIntervalS))
 	return worker
 }
@@ -119,7 +133,7 @@ func (w *AgreementBotWorker) NewEvent(incoming events.Message) {
 			msg, _ := incoming.(*events.ABApiAgreementCancelationMessage)
 			switch msg.Event().Id {
 			case events.AGREEMENT_ENDED:
-				agCmd := NewAgreementTimeoutCommand(msg.AgreementId, msg.AgreementProtocol, w.consumerPH[msg.AgreementProtocol].GetTerminationCode(TERM_REASON_USER_REQUESTED))
+				agCmd := NewAgreementTimeoutCommand(msg.AgreementId, msg.AgreementProtocol, w.consumerPH[msg.AgreementProtocol].GetTerminationCode(TERM_REASON_USER_REQUESTED), msg.OperatorReason)
 				w.Commands <- agCmd
 			}
 		}
@@ -154,10 +168,34 @@ func (w *AgreementBotWorker) NewEvent(incoming events.Message) {
 			}
 		}
 
+	case *events.ABApiReconcileAgreementsMessage:
+		if w.ready {
+			msg, _ := incoming.(*events.ABApiReconcileAgreementsMessage)
+			switch msg.Event().Id {
+			case events.RECONCILE_AGREEMENTS:
+				rcCmd := NewReconcileAgreementsCommand(*msg)
+				w.Commands <- rcCmd
+			}
+		}
+
+	case *events.ABApiDeviceCancelationMessage:
+		if w.ready {
+			msg, _ := incoming.(*events.ABApiDeviceCancelationMessage)
+			switch msg.Event().Id {
+			case events.DEVICE_AGREEMENTS_CANCEL:
+				dcCmd := NewCancelDeviceAgreementsCommand(*msg)
+				w.Commands <- dcCmd
+			}
+		}
+
 	case *events.NodeShutdownCompleteMessage:
 		msg, _ := incoming.(*events.NodeShutdownCompleteMessage)
 		switch msg.Event().Id {
 		case events.UNCONFIGURE_COMPLETE:
+			// Stop agreement initiations in progress so that they dont hold up the shutdown.
+			for _, cph := range w.consumerPH {
+				cph.Shutdown()
+			}
 			w.Commands <- worker.NewBeginShutdownCommand()
 			w.Commands <- worker.NewTerminateCommand("shutdown")
 		}
@@ -182,6 +220,19 @@ func (w *AgreementBotWorker) Initialize() bool {
 		return false
 	}
 
+	// Start tracing the configured agreements.
+	for _, id := range strings.Split(w.Config.AgreementBot.TraceAgreementIds, ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		} else if err := TraceAgreement(w.db, id); err != nil {
+			glog.Errorf(AWlogString(fmt.Sprintf("unable to start tracing agreement %v, error: %v", id, err)))
+		}
+	}
+
+	if w.Config.AgreementBot.ObserverMode {
+		glog.Warningf("AgreementBot worker is in observer mode, agreements will not be proposed")
+	}
+
 	// Make sure the policy directory is in place
 	if err := os.MkdirAll(w.BaseWorker.Manager.Config.AgreementBot.PolicyPath, 0644); err != nil {
 		glog.Errorf("AgreementBotWorker cannot create agreement bot policy file path %v, terminating.", w.BaseWorker.Manager.Config.AgreementBot.PolicyPath)
@@ -204,7 +255,7 @@ func (w *AgreementBotWorker) Initialize() bool {
 			break
 		}
 		glog.V(3).Infof("AgreementBotWorker waiting for policies to appear")
-		time.Sleep(time.Duration(w.BaseWorker.Manager.Config.AgreementBot.CheckUpdatedPolicyS) * time.Second)
+		time.Sleep(w.JitteredInterval(w.BaseWorker.Manager.Config.AgreementBot.CheckUpdatedPolicyS))
 	}
 
 	glog.Info("AgreementBot worker started")
@@ -247,6 +298,16 @@ func (w *AgreementBotWorker) Initialize() bool {
 	w.DispatchSubworker(GOVERN_AGREEMENTS, w.GovernAgreements, int(w.BaseWorker.Manager.Config.AgreementBot.ProcessGovernanceIntervalS))
 	w.DispatchSubworker(GOVERN_ARCHIVED_AGREEMENTS, w.GovernArchivedAgreements, 1800)
 	w.DispatchSubworker(GOVERN_BC_NEEDS, w.GovernBlockchainNeeds, 60)
+	if w.Config.AgreementBot.DBIntegrityCheckS != 0 {
+		w.DispatchSubworker(GOVERN_DB_INTEGRITY, w.GovernDBIntegrity, w.Config.AgreementBot.DBIntegrityCheckS)
+	}
+	if w.Config.AgreementBot.ReconcileAgreementsS != 0 {
+		w.DispatchSubworker(RECONCILE_AGREEMENTS, w.GovernReconciliation, w.Config.AgreementBot.ReconcileAgreementsS)
+	}
+
+	// Use custom subworker APIs for the on demand reconciliations because they are run when requested, not periodically.
+	rc := w.AddSubworker(RECONCILE_REQUESTS)
+	go w.reconcileOnRequest(RECONCILE_REQUESTS, rc)
 	if w.Config.AgreementBot.CheckUpdatedPolicyS != 0 {
 		// Use custom subworker APIs for the policy watcher because it is stateful and already does its own time management.
 		ch := w.AddSubworker(POLICY_WATCHER)
@@ -288,6 +349,7 @@ func (w *AgreementBotWorker) CommandHandler(command worker.Command) bool {
 			// Update the policy in the policy manager.
 			w.pm.UpdatePolicy(cmd.Msg.Org(), pol)
 			glog.V(5).Infof("AgreementBotWorker updated policy in PM.")
+			w.searchBackoff.Reset()
 
 			for _, agp := range pol.AgreementProtocols {
 				// Update the protocol handler map and make sure there are workers available if the policy has a new protocol in it.
@@ -337,6 +399,7 @@ func (w *AgreementBotWorker) CommandHandler(command worker.Command) bool {
 
 	case *AgreementTimeoutCommand:
 		cmd, _ := command.(*AgreementTimeoutCommand)
+		w.searchBackoff.Reset()
 		if _, ok := w.consumerPH[cmd.Protocol]; !ok {
 			glog.Errorf(fmt.Sprintf("AgreementBotWorker unable to process agreement timeout command %v due to unknown agreement protocol", cmd))
 		} else {
@@ -355,6 +418,16 @@ func (w *AgreementBotWorker) CommandHandler(command worker.Command) bool {
 			}
 		}
 
+	case *ReconcileAgreementsCommand:
+		w.requestReconciliation()
+
+	case *CancelDeviceAgreementsCommand:
+		cmd, _ := command.(*CancelDeviceAgreementsCommand)
+		w.searchBackoff.Reset()
+		if cancelled, err := w.CancelDeviceAgreements(cmd.Msg.DeviceId, TERM_REASON_USER_REQUESTED, cmd.Msg.OperatorReason); err != nil {
+			glog.Errorf(AWlogString(fmt.Sprintf("unable to cancel all agreements with device %v, cancelled %v, error: %v", cmd.Msg.DeviceId, cancelled, err)))
+		}
+
 	case *AccountFundedCommand:
 		cmd, _ := command.(*AccountFundedCommand)
 		for _, cph := range w.consumerPH {
@@ -383,6 +456,11 @@ func (w *AgreementBotWorker) CommandHandler(command worker.Command) bool {
 
 func (w *AgreementBotWorker) NoWorkHandler() {
 
+	// While the exchange is rejecting our credentials, don't initiate any work.
+	if w.paused() {
+		return
+	}
+
 	glog.V(4).Infof("AgreementBotWorker queueing deferred commands")
 	for _, cph := range w.consumerPH {
 		cph.HandleDeferredCommands()
@@ -391,7 +469,9 @@ func (w *AgreementBotWorker) NoWorkHandler() {
 
 	glog.V(5).Infof(fmt.Sprintf("AgreementBotWorker retrieving messages from the exchange"))
 
-	if msgs, err := w.getMessages(); err != nil {
+	if msgs, err := w.getMessages(); w.credentials.Check(err) {
+		return
+	} else if err != nil {
 		glog.Errorf(fmt.Sprintf("AgreementBotWorker unable to retrieve exchange messages, error: %v", err))
 	} else {
 		// Loop through all the returned messages and process them
@@ -412,29 +492,38 @@ func (w *AgreementBotWorker) NoWorkHandler() {
 				glog.Errorf(fmt.Sprintf("AgreementBotWorker unable to extract agreement protocol name from message %v", protocolMessage))
 			} else if _, ok := w.consumerPH[msgProtocol]; !ok {
 				glog.Infof(fmt.Sprintf("AgreementBotWorker unable to direct exchange message %v to a protocol handler, deleting it.", protocolMessage))
-				DeleteMessage(msg.MsgId, w.agbotId, w.token, w.Config.AgreementBot.ExchangeURL, w.httpClient)
+				DeleteMessage(msg.MsgId, w.agbotId, w.token, w.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(w.agbotId)), w.httpClient)
 			} else {
 				cmd := NewNewProtocolMessageCommand(protocolMessage, msg.MsgId, msg.DeviceId, msg.DevicePubKey)
 				if !w.consumerPH[msgProtocol].AcceptCommand(cmd) {
 					glog.Infof(fmt.Sprintf("AgreementBotWorker protocol handler for %v not accepting exchange messages, deleting msg.", msgProtocol))
-					DeleteMessage(msg.MsgId, w.agbotId, w.token, w.Config.AgreementBot.ExchangeURL, w.httpClient)
+					DeleteMessage(msg.MsgId, w.agbotId, w.token, w.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(w.agbotId)), w.httpClient)
 				} else if err := w.consumerPH[msgProtocol].DispatchProtocolMessage(cmd, w.consumerPH[msgProtocol]); err != nil {
-					DeleteMessage(msg.MsgId, w.agbotId, w.token, w.Config.AgreementBot.ExchangeURL, w.httpClient)
+					DeleteMessage(msg.MsgId, w.agbotId, w.token, w.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(w.agbotId)), w.httpClient)
 				}
 			}
 		}
 	}
 	glog.V(5).Infof(fmt.Sprintf("AgreementBotWorker done processing messages"))
 
+	if !w.searchBackoff.SearchDue() {
+		glog.V(5).Infof(fmt.Sprintf("AgreementBotWorker skipping exchange search, searches are backed off: %v", w.searchBackoff))
+		return
+	}
+
 	glog.V(4).Infof("AgreementBotWorker Polling Exchange.")
-	w.findAndMakeAgreements()
+	if attempts := w.findAndMakeAgreements(); w.searchBackoff.Searched(attempts) {
+		glog.V(3).Infof(fmt.Sprintf("AgreementBotWorker found no device to make an agreement with, backing off searches: %v", w.searchBackoff))
+	}
 	glog.V(4).Infof("AgreementBotWorker Done Polling Exchange.")
 
 }
 
 // Search the exchange and make agreements with any device that is eligible based on the policies we have and
-// agreement protocols that we support.
-func (w *AgreementBotWorker) findAndMakeAgreements() {
+// agreement protocols that we support. Returns the number of agreement attempts started.
+func (w *AgreementBotWorker) findAndMakeAgreements() int {
+
+	attempts := 0
 
 	// Get a list of all the orgs we are serving
 	allOrgs := w.pm.GetAllPolicyOrgs()
@@ -444,11 +533,14 @@ func (w *AgreementBotWorker) findAndMakeAgreements() {
 		policies := w.pm.GetAllAvailablePolicies(org)
 		for _, consumerPolicy := range policies {
 
-			if devices, err := w.searchExchange(&consumerPolicy, org); err != nil {
+			if devices, err := w.searchExchange(&consumerPolicy, org); w.credentials.Check(err) {
+				return attempts
+			} else if err != nil {
 				glog.Errorf("AgreementBotWorker received error searching for %v, error: %v", &consumerPolicy, err)
 			} else {
 
-				for _, dev := range *devices {
+				// Put the preferred devices at the front of the list, or drop the others when configured to do so.
+				for _, dev := range preferDevices(*devices, &w.Config.AgreementBot) {
 
 					glog.V(3).Infof("AgreementBotWorker picked up %v", dev.ShortString())
 					glog.V(5).Infof("AgreementBotWorker picked up %v", dev)
@@ -510,13 +602,14 @@ func (w *AgreementBotWorker) findAndMakeAgreements() {
 					} else if bcType != "" && !w.consumerPH[protocol].IsBlockchainWritable(bcType, bcName, bcOrg) {
 						// Get that blockchain running if it isn't up.
 						glog.V(5).Infof("AgreementBotWorker skipping device id %v, requires blockchain %v %v %v that isnt ready yet.", dev.Id, bcType, bcName, bcOrg)
-						w.BaseWorker.Manager.Messages <- events.NewNewBCContainerMessage(events.NEW_BC_CLIENT, bcType, bcName, bcOrg, w.Manager.Config.AgreementBot.ExchangeURL, w.agbotId, w.token)
+						w.BaseWorker.Manager.Messages <- events.NewNewBCContainerMessage(events.NEW_BC_CLIENT, bcType, bcName, bcOrg, w.Manager.Config.AgreementBot.GetExchangeURL(bcOrg), w.agbotId, w.token)
 						continue
 					} else if !w.consumerPH[protocol].AcceptCommand(cmd) {
 						glog.Errorf("AgreementBotWorker protocol handler for %v not accepting new agreement commands.", protocol)
 					} else {
 						w.consumerPH[protocol].HandleMakeAgreement(cmd, w.consumerPH[protocol])
 						glog.V(5).Infof("AgreementBoWorker queued agreement attempt for policy %v and protocol %v", consumerPolicy.Header.Name, protocol)
+						attempts += 1
 					}
 
 				}
@@ -524,6 +617,7 @@ func (w *AgreementBotWorker) findAndMakeAgreements() {
 			}
 		}
 	}
+	return attempts
 }
 
 // Check all agreement protocol buckets to see if there are any agreements with this device.
@@ -588,7 +682,7 @@ func (w *AgreementBotWorker) policyWatcher(name string, quit chan bool) {
 			glog.V(3).Infof(fmt.Sprintf("AgreementBotWorker %v exiting the subworker", name))
 			return
 
-		case <-time.After(time.Duration(w.Config.AgreementBot.CheckUpdatedPolicyS) * time.Second):
+		case <-time.After(w.JitteredInterval(w.Config.AgreementBot.CheckUpdatedPolicyS)):
 			contents, _ = policy.PolicyFileChangeWatcher(w.Config.AgreementBot.PolicyPath, contents, w.changedPolicy, w.deletedPolicy, w.errorPolicy, w.workloadResolver, 0)
 		}
 	}
@@ -621,10 +715,13 @@ func (w *AgreementBotWorker) errorPolicy(org string, fileName string, err error)
 func (w *AgreementBotWorker) getMessages() ([]exchange.AgbotMessage, error) {
 	var resp interface{}
 	resp = new(exchange.GetAgbotMessageResponse)
-	targetURL := w.Manager.Config.AgreementBot.ExchangeURL + "orgs/" + exchange.GetOrg(w.agbotId) + "/agbots/" + exchange.GetId(w.agbotId) + "/msgs"
+	targetURL := w.Manager.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(w.agbotId)) + "orgs/" + exchange.GetOrg(w.agbotId) + "/agbots/" + exchange.GetId(w.agbotId) + "/msgs"
 	for {
 		if err, tpErr := exchange.InvokeExchange(w.httpClient, "GET", targetURL, w.agbotId, w.token, nil, &resp); err != nil {
-			glog.Errorf(err.Error())
+			// Credential errors are reported once by the caller, not on every poll.
+			if !exchange.IsAuthError(err) {
+				glog.Errorf(err.Error())
+			}
 			return nil, err
 		} else if tpErr != nil {
 			glog.Warningf(tpErr.Error())
@@ -673,6 +770,7 @@ func DeleteConsumerAgreement(httpClient *http.Client, url string, agbotId string
 	for {
 		if err, tpErr := exchange.InvokeExchange(httpClient, "DELETE", targetURL, agbotId, token, nil, &resp); err != nil && !strings.Contains(err.Error(), "not found") {
 			glog.Errorf(logString(fmt.Sprintf(err.Error())))
+			ExchangeCredentials.Check(err)
 			return err
 		} else if tpErr != nil {
 			glog.Warningf(tpErr.Error())
@@ -693,6 +791,7 @@ func DeleteMessage(msgId int, agbotId, agbotToken, exchangeURL string, httpClien
 	for {
 		if err, tpErr := exchange.InvokeExchange(httpClient, "DELETE", targetURL, agbotId, agbotToken, nil, &resp); err != nil {
 			glog.Errorf(err.Error())
+			ExchangeCredentials.Check(err)
 			return err
 		} else if tpErr != nil {
 			glog.Warningf(tpErr.Error())
@@ -727,7 +826,7 @@ func (w *AgreementBotWorker) searchExchange(pol *policy.Policy, searchOrg string
 		// Invoke the exchange
 		var resp interface{}
 		resp = new(exchange.SearchExchangePatternResponse)
-		targetURL := w.BaseWorker.Manager.Config.AgreementBot.ExchangeURL + "orgs/" + searchOrg + "/patterns/" + exchange.GetId(pol.PatternId) + "/search"
+		targetURL := w.BaseWorker.Manager.Config.AgreementBot.GetExchangeURL(searchOrg) + "orgs/" + searchOrg + "/patterns/" + exchange.GetId(pol.PatternId) + "/search"
 		for {
 			if err, tpErr := exchange.InvokeExchange(w.httpClient, "POST", targetURL, w.agbotId, w.token, ser, &resp); err != nil {
 				if !strings.Contains(err.Error(), "status: 404") {
@@ -758,7 +857,7 @@ func (w *AgreementBotWorker) searchExchange(pol *policy.Policy, searchOrg string
 		// can't satisfy all the workloads then workload rollback cant work so we shouldnt make an agreement with this
 		// device.
 		for _, workload := range pol.Workloads {
-			if e_workload, err := exchange.GetWorkload(w.Config.Collaborators.HTTPClientFactory, workload.WorkloadURL, workload.Org, workload.Version, workload.Arch, w.Config.AgreementBot.ExchangeURL, w.agbotId, w.token); err != nil {
+			if e_workload, err := exchange.GetWorkload(w.Config.Collaborators.HTTPClientFactory, workload.WorkloadURL, workload.Org, workload.Version, workload.Arch, w.Config.AgreementBot.GetExchangeURL(workload.Org), w.agbotId, w.token); err != nil {
 				return nil, errors.New(fmt.Sprintf("AgreementBotWorker received error retrieving workload definition for %v, error: %v", workload, err))
 			} else if e_workload == nil {
 				return nil, errors.New(fmt.Sprintf("AgreementBotWorker could not find workload definition for %v", workload))
@@ -787,7 +886,7 @@ func (w *AgreementBotWorker) searchExchange(pol *policy.Policy, searchOrg string
 		// Invoke the exchange
 		var resp interface{}
 		resp = new(exchange.SearchExchangeMSResponse)
-		targetURL := w.BaseWorker.Manager.Config.AgreementBot.ExchangeURL + "orgs/" + searchOrg + "/search/nodes"
+		targetURL := w.BaseWorker.Manager.Config.AgreementBot.GetExchangeURL(searchOrg) + "orgs/" + searchOrg + "/search/nodes"
 		for {
 			if err, tpErr := exchange.InvokeExchange(w.httpClient, "POST", targetURL, w.agbotId, w.token, ser, &resp); err != nil {
 				if !strings.Contains(err.Error(), "status: 404") {
@@ -862,18 +961,18 @@ func (w *AgreementBotWorker) syncOnInit() error {
 					} else if existingPol := w.pm.GetPolicy(ag.Org, pol.Header.Name); existingPol == nil {
 						glog.Errorf(AWlogString(fmt.Sprintf("agreement %v has a policy %v that doesn't exist anymore", ag.CurrentAgreementId, pol.Header.Name)))
 						// Update state in exchange
-						if err := DeleteConsumerAgreement(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), w.Config.AgreementBot.ExchangeURL, w.agbotId, w.token, ag.CurrentAgreementId); err != nil {
+						if err := DeleteConsumerAgreement(w.httpClient, w.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(w.agbotId)), w.agbotId, w.token, ag.CurrentAgreementId); err != nil {
 							glog.Errorf(AWlogString(fmt.Sprintf("error deleting agreement %v in exchange: %v", ag.CurrentAgreementId, err)))
 						}
 						// Remove any workload usage records so that a new agreement will be made starting from the highest priority workload
-						if err := DeleteWorkloadUsage(w.db, ag.DeviceId, ag.PolicyName); err != nil {
+						if err := DeleteWorkloadUsage(w.db, ag.DeviceId, ag.PolicyName, WU_REASON_POLICY_DELETED); err != nil {
 							glog.Warningf(AWlogString(fmt.Sprintf("error deleting workload usage for %v using policy %v, error: %v", ag.DeviceId, ag.PolicyName, err)))
 						}
 						// Indicate that the agreement is timed out
 						if _, err := AgreementTimedout(w.db, ag.CurrentAgreementId, agp); err != nil {
 							glog.Errorf(AWlogString(fmt.Sprintf("error marking agreement %v terminated: %v", ag.CurrentAgreementId, err)))
 						}
-						w.consumerPH[agp].HandleAgreementTimeout(NewAgreementTimeoutCommand(ag.CurrentAgreementId, ag.AgreementProtocol, w.consumerPH[agp].GetTerminationCode(TERM_REASON_POLICY_CHANGED)), w.consumerPH[agp])
+						w.consumerPH[agp].HandleAgreementTimeout(NewAgreementTimeoutCommand(ag.CurrentAgreementId, ag.AgreementProtocol, w.consumerPH[agp].GetTerminationCode(TERM_REASON_POLICY_CHANGED), ""), w.consumerPH[agp])
 					} else if err := w.pm.MatchesMine(ag.Org, pol); err != nil {
 						glog.Warningf(AWlogString(fmt.Sprintf("agreement %v has a policy %v that has changed: %v", ag.CurrentAgreementId, pol.Header.Name, err)))
 
@@ -907,7 +1006,7 @@ func (w *AgreementBotWorker) syncOnInit() error {
 						var exchangeAgreement map[string]exchange.AgbotAgreement
 						var resp interface{}
 						resp = new(exchange.AllAgbotAgreementsResponse)
-						targetURL := w.BaseWorker.Manager.Config.AgreementBot.ExchangeURL + "orgs/" + exchange.GetOrg(w.agbotId) + "/agbots/" + exchange.GetId(w.agbotId) + "/agreements/" + ag.CurrentAgreementId
+						targetURL := w.BaseWorker.Manager.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(w.agbotId)) + "orgs/" + exchange.GetOrg(w.agbotId) + "/agbots/" + exchange.GetId(w.agbotId) + "/agreements/" + ag.CurrentAgreementId
 
 						if err, tpErr := exchange.InvokeExchange(w.httpClient, "GET", targetURL, w.agbotId, w.token, nil, &resp); err != nil || tpErr != nil {
 							glog.Errorf(AWlogString(fmt.Sprintf("encountered error getting agbot info from exchange, error %v, transport error %v", err, tpErr)))
@@ -918,17 +1017,7 @@ func (w *AgreementBotWorker) syncOnInit() error {
 
 							if _, there := exchangeAgreement[ag.CurrentAgreementId]; !there {
 								glog.V(3).Infof(AWlogString(fmt.Sprintf("agreement %v missing from exchange, adding it back in.", ag.CurrentAgreementId)))
-								state := ""
-								if ag.AgreementFinalizedTime != 0 {
-									state = "Finalized Agreement"
-								} else if ag.CounterPartyAddress != "" {
-									state = "Producer Agreed"
-								} else if ag.AgreementCreationTime != 0 {
-									state = "Formed Proposal"
-								} else {
-									state = "unknown"
-								}
-								w.recordConsumerAgreementState(ag.CurrentAgreementId, pol, ag.Org, state)
+								w.recordConsumerAgreementState(ag.CurrentAgreementId, pol, ag.Org, exchangeAgreementState(&ag))
 							}
 						}
 						glog.V(3).Infof(AWlogString(fmt.Sprintf("added agreement %v to policy agreement counter.", ag.CurrentAgreementId)))
@@ -952,7 +1041,7 @@ func (w *AgreementBotWorker) syncOnInit() error {
 			for org, typeMap := range neededBCInstances {
 				for typeName, instMap := range typeMap {
 					for instName, _ := range instMap {
-						w.Messages() <- events.NewNewBCContainerMessage(events.NEW_BC_CLIENT, typeName, instName, org, w.Config.AgreementBot.ExchangeURL, w.agbotId, w.token)
+						w.Messages() <- events.NewNewBCContainerMessage(events.NEW_BC_CLIENT, typeName, instName, org, w.Config.AgreementBot.GetExchangeURL(org), w.agbotId, w.token)
 					}
 				}
 			}
@@ -968,12 +1057,12 @@ func (w *AgreementBotWorker) syncOnInit() error {
 
 func (w *AgreementBotWorker) cleanupAgreement(ag *Agreement) {
 	// Update state in exchange
-	if err := DeleteConsumerAgreement(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), w.Config.AgreementBot.ExchangeURL, w.agbotId, w.token, ag.CurrentAgreementId); err != nil {
+	if err := DeleteConsumerAgreement(w.httpClient, w.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(w.agbotId)), w.agbotId, w.token, ag.CurrentAgreementId); err != nil {
 		glog.Errorf(AWlogString(fmt.Sprintf("error deleting agreement %v in exchange: %v", ag.CurrentAgreementId, err)))
 	}
 
 	// Delete this workload usage record so that a new agreement will be made starting from the highest priority workload
-	if err := DeleteWorkloadUsage(w.db, ag.DeviceId, ag.PolicyName); err != nil {
+	if err := DeleteWorkloadUsage(w.db, ag.DeviceId, ag.PolicyName, WU_REASON_POLICY_CHANGED); err != nil {
 		glog.Warningf(AWlogString(fmt.Sprintf("error deleting workload usage for %v using policy %v, error: %v", ag.DeviceId, ag.PolicyName, err)))
 	}
 
@@ -982,7 +1071,7 @@ func (w *AgreementBotWorker) cleanupAgreement(ag *Agreement) {
 		glog.Errorf(AWlogString(fmt.Sprintf("error marking agreement %v terminated: %v", ag.CurrentAgreementId, err)))
 	}
 
-	w.consumerPH[ag.AgreementProtocol].HandleAgreementTimeout(NewAgreementTimeoutCommand(ag.CurrentAgreementId, ag.AgreementProtocol, w.consumerPH[ag.AgreementProtocol].GetTerminationCode(TERM_REASON_POLICY_CHANGED)), w.consumerPH[ag.AgreementProtocol])
+	w.consumerPH[ag.AgreementProtocol].HandleAgreementTimeout(NewAgreementTimeoutCommand(ag.CurrentAgreementId, ag.AgreementProtocol, w.consumerPH[ag.AgreementProtocol].GetTerminationCode(TERM_REASON_POLICY_CHANGED), ""), w.consumerPH[ag.AgreementProtocol])
 }
 
 func (w *AgreementBotWorker) recordConsumerAgreementState(agreementId string, pol *policy.Policy, org string, state string) error {
@@ -1000,7 +1089,7 @@ func (w *AgreementBotWorker) recordConsumerAgreementState(agreementId string, po
 	as.State = state
 	var resp interface{}
 	resp = new(exchange.PostDeviceResponse)
-	targetURL := w.Config.AgreementBot.ExchangeURL + "orgs/" + exchange.GetOrg(w.agbotId) + "/agbots/" + exchange.GetId(w.agbotId) + "/agreements/" + agreementId
+	targetURL := w.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(w.agbotId)) + "orgs/" + exchange.GetOrg(w.agbotId) + "/agbots/" + exchange.GetId(w.agbotId) + "/agreements/" + agreementId
 	for {
 		if err, tpErr := exchange.InvokeExchange(w.httpClient, "PUT", targetURL, w.agbotId, w.token, &as, &resp); err != nil {
 			glog.Errorf(err.Error())
@@ -1017,14 +1106,27 @@ func (w *AgreementBotWorker) recordConsumerAgreementState(agreementId string, po
 
 }
 
+// Returns true if the comma separated list contains the target. Whitespace around the entries and case are ignored.
 func listContains(list string, target string) bool {
-	ignoreAttribs := strings.Split(list, ",")
-	for _, propName := range ignoreAttribs {
-		if propName == target {
-			return true
+	return newListSet(list).contains(target)
+}
+
+// The entries of a comma separated list, trimmed and lower cased so that lookups ignore whitespace and case. Parse a
+// list into a set once when it is checked often.
+type listSet map[string]bool
+
+func newListSet(list string) listSet {
+	s := make(listSet)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			s[entry] = true
 		}
 	}
-	return false
+	return s
+}
+
+func (s listSet) contains(target string) bool {
+	return s[strings.ToLower(strings.TrimSpace(target))]
 }
 
 func (w *AgreementBotWorker) registerPublicKey() error {
@@ -1033,7 +1135,7 @@ func (w *AgreementBotWorker) registerPublicKey() error {
 	as := exchange.CreateAgbotPublicKeyPatch(w.Config.AgreementBot.MessageKeyPath)
 	var resp interface{}
 	resp = new(exchange.PostDeviceResponse)
-	targetURL := w.Config.AgreementBot.ExchangeURL + "orgs/" + exchange.GetOrg(w.agbotId) + "/agbots/" + exchange.GetId(w.agbotId)
+	targetURL := w.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(w.agbotId)) + "orgs/" + exchange.GetOrg(w.agbotId) + "/agbots/" + exchange.GetId(w.agbotId)
 	for {
 		if err, tpErr := exchange.InvokeExchange(w.httpClient, "PATCH", targetURL, w.agbotId, w.token, &as, &resp); err != nil {
 			glog.Errorf(err.Error())
@@ -1052,7 +1154,7 @@ func (w *AgreementBotWorker) registerPublicKey() error {
 func (w *AgreementBotWorker) workloadResolver(wURL string, wOrg string, wVersion string, wArch string) (*policy.APISpecList, error) {
 
 	// TODO: do we need a dedicated HTTP client instance here or can we use the shared one?
-	asl, _, err := exchange.WorkloadResolver(w.Config.Collaborators.HTTPClientFactory, wURL, wOrg, wVersion, wArch, w.Config.AgreementBot.ExchangeURL, w.Config.AgreementBot.ExchangeId, w.Config.AgreementBot.ExchangeToken)
+	asl, _, err := exchange.WorkloadResolver(w.Config.Collaborators.HTTPClientFactory, wURL, wOrg, wVersion, wArch, w.Config.AgreementBot.GetExchangeURL(wOrg), w.Config.AgreementBot.ExchangeId, w.Config.AgreementBot.ExchangeToken)
 	if err != nil {
 		glog.Errorf(AWlogString(fmt.Sprintf("unable to resolve workload, error %v", err)))
 	}
@@ -1094,7 +1196,7 @@ func (w *AgreementBotWorker) internalGeneratePolicyFromPatterns() error {
 	for org, _ := range w.PatternManager.OrgPatterns {
 
 		// Query exchange for all patterns in the org
-		if exchangePatternMetadata, err := exchange.GetPatterns(w.Config.Collaborators.HTTPClientFactory, org, "", w.Config.AgreementBot.ExchangeURL, w.agbotId, w.token); err != nil {
+		if exchangePatternMetadata, err := exchange.GetPatterns(w.Config.Collaborators.HTTPClientFactory, org, "", w.Config.AgreementBot.GetExchangeURL(org), w.agbotId, w.token); err != nil {
 			return errors.New(fmt.Sprintf("unable to get patterns for org %v, error %v", org, err))
 
 			// Check for pattern metadata changes and update policy files accordingly
@@ -1111,7 +1213,7 @@ func (w *AgreementBotWorker) getAgbotPatterns() (map[string]exchange.ServedPatte
 
 	var resp interface{}
 	resp = new(exchange.GetAgbotsPatternsResponse)
-	targetURL := w.Config.AgreementBot.ExchangeURL + "orgs/" + exchange.GetOrg(w.agbotId) + "/agbots/" + exchange.GetId(w.agbotId) + "/patterns"
+	targetURL := w.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(w.agbotId)) + "orgs/" + exchange.GetOrg(w.agbotId) + "/agbots/" + exchange.GetId(w.agbotId) + "/patterns"
 	for {
 		if err, tpErr := exchange.InvokeExchange(w.httpClient, "GET", targetURL, w.agbotId, w.token, nil, &resp); err != nil {
 			glog.Errorf(AWlogString(err.Error()))
@@ -1131,11 +1233,40 @@ func (w *AgreementBotWorker) getAgbotPatterns() (map[string]exchange.ServedPatte
 
 // Heartbeat to the exchange. This function is called by the heartbeat subworker.
 func (w *AgreementBotWorker) heartBeat() int {
-	targetURL := w.Manager.Config.AgreementBot.ExchangeURL + "orgs/" + exchange.GetOrg(w.agbotId) + "/agbots/" + exchange.GetId(w.agbotId) + "/heartbeat"
-	exchange.Heartbeat(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), targetURL, w.agbotId, w.token)
+	targetURL := w.Manager.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(w.agbotId)) + "orgs/" + exchange.GetOrg(w.agbotId) + "/agbots/" + exchange.GetId(w.agbotId) + "/heartbeat"
+	err := exchange.Heartbeat(w.httpClient, targetURL, w.agbotId, w.token)
+	w.heartbeat.Record(err)
+	w.credentials.Check(err)
+	if status := w.heartbeat.Status(); !status.Healthy {
+		glog.Warningf(AWlogString(fmt.Sprintf("exchange heartbeat is unhealthy: %v", status)))
+	}
 	return 0
 }
 
+// Returns true if the agbot is paused because the exchange is rejecting its credentials. While paused, each call checks
+// whether the exchange accepts the credentials again, and the agbot resumes when it does.
+func (w *AgreementBotWorker) paused() bool {
+	if !w.credentials.IsInvalid() {
+		return false
+	} else if _, err := w.getMessages(); w.credentials.Check(err) {
+		glog.V(3).Infof(AWlogString(fmt.Sprintf("paused, exchange credentials are invalid: %v", w.credentials)))
+		return true
+	} else if err != nil {
+		glog.Errorf(AWlogString(fmt.Sprintf("unable to check exchange credentials, error: %v", err)))
+		return true
+	}
+
+	if w.credentials.Validate() {
+		glog.Infof(AWlogString(fmt.Sprintf("exchange accepted the credentials of agbot %v, resuming", w.agbotId)))
+	}
+	return false
+}
+
+// Returns the state of the heartbeats to the exchange, for monitoring exchange connectivity.
+func (w *AgreementBotWorker) HeartbeatStatus() *exchange.HeartbeatStatus {
+	return w.heartbeat.Status()
+}
+
 // ==========================================================================================================
 // Utility functions
 
@@ -1,6 +1,7 @@
 package agreementbot
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"github.com/open-horizon/anax/policy"
 	"math/rand"
 	"net/http"
+	"time"
 )
 
 // These structs are the event bodies that flow from the processor to the agreement workers
@@ -22,6 +24,13 @@ const CANCEL = "AGREEMENT_CANCEL"
 const DATARECEIVEDACK = "AGREEMENT_DATARECEIVED_ACK"
 const WORKLOAD_UPGRADE = "WORKLOAD_UPGRADE"
 const ASYNC_CANCEL = "ASYNC_CANCEL"
+const ASYNC_ARCHIVE = "ASYNC_ARCHIVE"
+const REEVALUATE_PROPOSAL = "REEVALUATE_PROPOSAL"
+
+// The database writes that terminate and archive a cancelled agreement are retried this many times when they fail,
+// waiting DB_WRITE_RETRY_BACKOFF_MS before the first retry and twice as long before each one after it.
+const DB_WRITE_RETRIES = 2
+const DB_WRITE_RETRY_BACKOFF_MS = 100
 
 type AgreementWork interface {
 	Type() string
@@ -34,6 +43,7 @@ type InitiateAgreement struct {
 	ConsumerPolicy         policy.Policy               // the consumer policy we're matched up with - this is a copy so that we can modify/augment it
 	Org                    string                      // the org from which the consumer policy originated
 	Device                 exchange.SearchResultDevice // the device entry in the exchange
+	observedUsage          *WorkloadUsage              // in observer mode, the workload usage record the selection loop would have persisted
 }
 
 func (c InitiateAgreement) String() string {
@@ -84,10 +94,11 @@ func (c HandleDataReceivedAck) Type() string {
 }
 
 type CancelAgreement struct {
-	workType    string
-	AgreementId string
-	Protocol    string
-	Reason      uint
+	workType       string
+	AgreementId    string
+	Protocol       string
+	Reason         uint
+	OperatorReason string // the reason given by the operator who cancelled the agreement, empty for automated cancels
 }
 
 func (c CancelAgreement) Type() string {
@@ -107,13 +118,37 @@ func (c HandleWorkloadUpgrade) Type() string {
 }
 
 type AsyncCancelAgreement struct {
+	workType     string
+	AgreementId  string
+	Protocol     string
+	Reason       uint
+	DeferredTime uint64 // time when the cancel was first deferred, set by DeferCommand
+	Force        bool   // attempt the cancel even if the blockchain is not known to be writable
+}
+
+func (c AsyncCancelAgreement) Type() string {
+	return c.workType
+}
+
+type AsyncArchiveAgreement struct {
+	workType       string
+	AgreementId    string
+	Protocol       string
+	Reason         uint
+	OperatorReason string
+}
+
+func (c AsyncArchiveAgreement) Type() string {
+	return c.workType
+}
+
+type ReevaluateProposal struct {
 	workType    string
 	AgreementId string
 	Protocol    string
-	Reason      uint
 }
 
-func (c AsyncCancelAgreement) Type() string {
+func (c ReevaluateProposal) Type() string {
 	return c.workType
 }
 
@@ -122,19 +157,65 @@ type AgreementWorker interface {
 }
 
 type BaseAgreementWorker struct {
-	pm         *policy.PolicyManager
-	db         *bolt.DB
-	config     *config.HorizonConfig
-	alm        *AgreementLockManager
-	workerID   string
-	httpClient *http.Client
+	pm              *policy.PolicyManager
+	db              *bolt.DB
+	config          *config.HorizonConfig
+	alm             *AgreementLockManager
+	workerID        string
+	httpClient      *http.Client
+	pool            *AgreementWorkerPool // nil when the worker is part of a fixed size pool
+	webhook         *AgreementWebhook    // nil when no webhook is configured
+	ignoreAttribs   listSet              // the IgnoreContractWithAttribs property names, parsed when the worker is created
+	cancelCooldowns map[string]int       // the CancelCooldownS seconds by termination reason, parsed when the worker is created
+	ctx             context.Context      // cancelled when the agbot shuts down, nil means never cancelled
+	working         bool                 // true while the worker handles an item it received from its work queue
 }
 
 func (b *BaseAgreementWorker) AgreementLockManager() *AgreementLockManager {
 	return b.alm
 }
 
+// Block waiting for the next work item. The second return value is false when the worker should exit because
+// its pool has shrunk. The previous work item is recorded as done and the next one as received in WQMetrics.
+func (b *BaseAgreementWorker) waitForWork(protocol string, work chan AgreementWork) (AgreementWork, bool) {
+	if b.working {
+		WQMetrics.Done(protocol)
+		b.working = false
+	}
+
+	var workItem AgreementWork
+	if b.pool == nil {
+		workItem = <-work
+	} else if wi, ok := b.pool.NextWork(); !ok {
+		return nil, false
+	} else {
+		workItem = wi
+	}
+
+	WQMetrics.Received(protocol)
+	b.working = true
+	return workItem, true
+}
+
 func (b *BaseAgreementWorker) InitiateNewAgreement(cph ConsumerProtocolHandler, wi *InitiateAgreement, random *rand.Rand, workerId string) {
+	ctx := b.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	b.InitiateNewAgreementWithContext(ctx, cph, wi, random, workerId)
+}
+
+// Same as InitiateNewAgreement, except that the initiation is abandoned when the input context is cancelled, e.g. because
+// the agbot is shutting down. The pending agreement and workload usage records created by an abandoned initiation are
+// removed so that they are not orphaned.
+func (b *BaseAgreementWorker) InitiateNewAgreementWithContext(ctx context.Context, cph ConsumerProtocolHandler, wi *InitiateAgreement, random *rand.Rand, workerId string) {
+
+	// While the exchange is rejecting the agbot's credentials, work queued before the agbot paused is dropped. The
+	// device will be found again by the next search once the agbot resumes.
+	if ExchangeCredentials.IsInvalid() {
+		glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("skipping device %v with policy %v, the agbot is paused because the exchange is rejecting its credentials", wi.Device.Id, wi.ConsumerPolicy.Header.Name)))
+		return
+	}
 
 	// Generate an agreement ID
 	agreementIdString, aerr := cutil.GenerateAgreementId()
@@ -144,6 +225,33 @@ func (b *BaseAgreementWorker) InitiateNewAgreement(cph ConsumerProtocolHandler,
 	}
 	glog.V(5).Infof(BAWlogstring(workerId, fmt.Sprintf("using AgreementId %v", agreementIdString)))
 
+	// If a previous agreement with this device and policy was cancelled recently, and the cancel reason has a cooldown
+	// configured, then skip this device until the cooldown expires.
+	if cc, err := FindActiveCancelCooldown(b.db, wi.Device.Id, wi.ConsumerPolicy.Header.Name); err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error searching for cancel cooldown for device %v with policy %v, error: %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, err)))
+		return
+	} else if cc != nil {
+		glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("skipping device %v with policy %v, cancel cooldown is active until %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, cc.ExpiryTime)))
+		return
+	}
+
+	// If the device has been blacklisted for sending invalid replies, skip it until the blacklist expires.
+	if bl, err := FindActiveDeviceBlacklist(b.db, wi.Device.Id); err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error searching for blacklist of device %v, error: %v", wi.Device.Id, err)))
+		return
+	} else if bl != nil {
+		glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("skipping device %v, blacklisted for invalid replies until %v", wi.Device.Id, bl.BlacklistedUntil)))
+		return
+	}
+
+	// If the agreement would use a protocol version below the configured floor, skip the device.
+	if floor := b.config.AgreementBot.MinAgreementProtocolVersion; floor > 0 {
+		if pv := cph.NegotiatedProtocolVersion(&wi.ProducerPolicy, &wi.ConsumerPolicy); pv < floor {
+			glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("skipping device %v with policy %v, it would negotiate %v protocol version %v, which is below the minimum version %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, cph.Name(), pv, floor)))
+			return
+		}
+	}
+
 	bcType, bcName, bcOrg := (&wi.ProducerPolicy).RequiresKnownBC(cph.Name())
 
 	// Use the blockchain name to choose the handler
@@ -163,7 +271,7 @@ func (b *BaseAgreementWorker) InitiateNewAgreement(cph ConsumerProtocolHandler,
 	// policies so we can merge them.
 	var exchangeDev *exchange.Device
 	if wi.ConsumerPolicy.PatternId != "" {
-		if theDev, err := GetDevice(b.config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), wi.Device.Id, b.config.AgreementBot.ExchangeURL, cph.ExchangeId(), cph.ExchangeToken()); err != nil {
+		if theDev, err := GetDeviceWithContext(ctx, b.httpClient, wi.Device.Id, b.config.AgreementBot.GetExchangeURL(exchange.GetOrg(wi.Device.Id)), cph.ExchangeId(), cph.ExchangeToken()); err != nil {
 			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error getting device %v policies, error: %v", wi.Device.Id, err)))
 			return
 		} else {
@@ -177,10 +285,51 @@ func (b *BaseAgreementWorker) InitiateNewAgreement(cph ConsumerProtocolHandler,
 	// a workload entry that turns out to be unsupportable by the device.
 	foundWorkload := false
 	var workload, lastWorkload *policy.Workload
+	rejections := make([]WorkloadRejection, 0, 5)
 
+	// Remember whether there was already a workload usage record so that a record created by this loop can be removed when
+	// the deadline for choosing a workload passes, the agreement is not proposed or the initiation is abandoned.
+	var deadline time.Time
+	if b.config.AgreementBot.InitiateDeadlineS > 0 {
+		deadline = time.Now().Add(time.Duration(b.config.AgreementBot.InitiateDeadlineS) * time.Second)
+	}
+	existingWLU := false
+	if wlUsage, err := FindSingleWorkloadUsageByDeviceAndPolicyName(b.db, wi.Device.Id, wi.ConsumerPolicy.Header.Name); err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error searching for persistent workload usage records for device %v with policy %v, error: %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, err)))
+		return
+	} else if wlUsage != nil && wlUsage.Exhausted {
+		glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("not making an agreement with device %v for policy %v, %v agreements have failed, reset the workload usage to try again", wi.Device.Id, wi.ConsumerPolicy.Header.Name, wlUsage.FailureCount)))
+		return
+	} else {
+		existingWLU = wlUsage != nil
+		if b.config.AgreementBot.ObserverMode {
+			wi.observedUsage = wlUsage
+		}
+	}
+
+	// If the device advertises cached images, let it break ties between workloads of the same priority.
+	if b.config.AgreementBot.PreferCachedImages && !existingWLU {
+		b.preferCachedWorkloads(ctx, cph, wi, exchangeDev, workerId)
+	}
+
+	tried := 0
 	for !foundWorkload {
 
-		if wlUsage, err := FindSingleWorkloadUsageByDeviceAndPolicyName(b.db, wi.Device.Id, wi.ConsumerPolicy.Header.Name); err != nil {
+		if ctx.Err() != nil {
+			b.abandonInitiate(cph, wi, agreementIdString, existingWLU, false, workerId)
+			return
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("timed out after %v seconds choosing a workload for %v with policy %v", b.config.AgreementBot.InitiateDeadlineS, wi.Device.Id, wi.ConsumerPolicy.Header.Name)))
+
+			if !existingWLU {
+				b.deleteSelectionUsage(wi, WU_REASON_INITIATE_FAILED, workerId)
+			}
+			return
+		}
+
+		if wlUsage, err := b.selectionUsage(wi); err != nil {
 			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error searching for persistent workload usage records for device %v with policy %v, error: %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, err)))
 			return
 		} else if wlUsage == nil {
@@ -193,21 +342,61 @@ func (b *BaseAgreementWorker) InitiateNewAgreement(cph ConsumerProtocolHandler,
 
 		// If we chose the same workload 2 times in a row through this loop, then we need to exit out of here
 		if lastWorkload == workload {
-			glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("unable to find supported workload for %v within %v", wi.Device.Id, wi.ConsumerPolicy.Workloads)))
+			glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("unable to find supported workload for %v within %v, rejections: %v", wi.Device.Id, wi.ConsumerPolicy.Workloads, rejections)))
+
+			// Let upstream tooling know that this device cannot run any workload in the policy or pattern.
+			b.webhook.Notify(AgreementEvent{
+				Event:       WEBHOOK_WORKLOAD_UNSUPPORTED,
+				AgreementId: agreementIdString,
+				Protocol:    cph.Name(),
+				DeviceId:    wi.Device.Id,
+				PolicyName:  wi.ConsumerPolicy.Header.Name,
+				PatternId:   wi.ConsumerPolicy.PatternId,
+				Rejections:  rejections,
+			})
+			b.recordSelection(wi, SELECTION_NO_WORKLOAD, rejections, workerId)
 
 			// If we created a workload usage record during this process, get rid of it.
-			if err := DeleteWorkloadUsage(b.db, wi.Device.Id, wi.ConsumerPolicy.Header.Name); err != nil {
-				glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("unable to delete workload usage record for %v with %v because %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, err)))
+			b.deleteSelectionUsage(wi, WU_REASON_WORKLOAD_REJECTED, workerId)
+			return
+		}
+
+		// Give up if the configured number of workload priorities have been tried without finding a supported workload.
+		if limit := b.config.AgreementBot.MaxWorkloadPrioritiesTried; limit > 0 && tried >= limit {
+			glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("tried the maximum of %v workload priorities for %v with policy %v without finding a supported workload, rejections: %v", limit, wi.Device.Id, wi.ConsumerPolicy.Header.Name, rejections)))
+			b.recordSelection(wi, SELECTION_MAX_PRIORITIES, rejections, workerId)
+
+			if !existingWLU {
+				b.deleteSelectionUsage(wi, WU_REASON_WORKLOAD_REJECTED, workerId)
 			}
 			return
 		}
+		tried += 1
+
+		// If this agbot is not configured to handle the workload's arch or org, or the operator has denied this workload version,
+		// e.g. because it is a known bad build, skip it like a workload the device cannot support and try the next workload.
+		if reason := b.config.AgreementBot.WorkloadExclusion(workload.WorkloadURL, workloadOrg(workload, wi.Org), workload.Version, workload.Arch); reason != "" {
+			glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("skipping workload %v version %v arch %v because %v", workload.WorkloadURL, workload.Version, workload.Arch, reason)))
+			rejections = append(rejections, NewWorkloadRejection(workload, reason))
+			if err := b.skipWorkload(wi, workload, lastWorkload, agreementIdString); err != nil {
+				glog.Errorf(BAWlogstring(workerId, err.Error()))
+				return
+			}
+			lastWorkload = workload
+			continue
+		}
 
 		// The workload in the consumer policy has a reference to the workload details. We need to get the details so that we
 		// can verify that the device has the right version API specs to run this workload. Then, we can store the workload details
 		// into the consumer policy file. We have a copy of the consumer policy file that we can modify. If the device doesnt have the right
 		// version API specs, then we will try the next workload.
 
-		if workloadDetails, err := exchange.GetWorkload(b.config.Collaborators.HTTPClientFactory, workload.WorkloadURL, workload.Org, workload.Version, workload.Arch, b.config.AgreementBot.ExchangeURL, cph.ExchangeId(), cph.ExchangeToken()); err != nil {
+		if workloadDetails, err := exchange.GetWorkloadWithContext(ctx, b.config.Collaborators.HTTPClientFactory, workload.WorkloadURL, workload.Org, workload.Version, workload.Arch, b.config.AgreementBot.GetExchangeURL(workload.Org), cph.ExchangeId(), cph.ExchangeToken()); err != nil {
+			if ctx.Err() != nil {
+				b.abandonInitiate(cph, wi, agreementIdString, existingWLU, false, workerId)
+				return
+			}
+			ExchangeCredentials.Check(err)
 			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error searching for workload details %v, error: %v", workload, err)))
 			return
 		} else if workloadDetails == nil {
@@ -217,13 +406,16 @@ func (b *BaseAgreementWorker) InitiateNewAgreement(cph ConsumerProtocolHandler,
 
 			// Convert the workload details APISpec list to policy types, and merge the device side microservice policies if necessary.
 			var mergedProducer *policy.Policy
+			missingSpecs := make([]string, 0, 2)
 			asl := new(policy.APISpecList)
 			for _, apiSpec := range workloadDetails.APISpecs {
 				(*asl) = append((*asl), (*policy.APISpecification_Factory(apiSpec.SpecRef, apiSpec.Org, apiSpec.Version, apiSpec.Arch)))
 				if wi.ConsumerPolicy.PatternId != "" {
+					registered := false
 					for _, devMS := range exchangeDev.RegisteredMicroservices {
 						// Find the device's microservice definition based on the microservices needed by the workload.
 						if devMS.Url == apiSpec.SpecRef {
+							registered = true
 							if pol, err := policy.DemarshalPolicy(devMS.Policy); err != nil {
 								glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error demarshalling device %v policy, error: %v", wi.Device.Id, err)))
 								return
@@ -238,6 +430,35 @@ func (b *BaseAgreementWorker) InitiateNewAgreement(cph ConsumerProtocolHandler,
 							break
 						}
 					}
+					if !registered {
+						missingSpecs = append(missingSpecs, apiSpec.SpecRef)
+					}
+				}
+			}
+
+			// The device has not registered some of the microservices the workload requires, so the merged producer policy
+			// cannot describe them.
+			if len(missingSpecs) != 0 {
+				switch b.config.AgreementBot.MissingMicroserviceAction {
+				case config.MissingMicroserviceSkip:
+					glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("skipping workload %v because device %v has not registered required microservices %v", workload, wi.Device.Id, missingSpecs)))
+					rejections = append(rejections, NewWorkloadRejection(workload, fmt.Sprintf("device has not registered required microservices %v", missingSpecs)))
+					if err := b.skipWorkload(wi, workload, lastWorkload, agreementIdString); err != nil {
+						glog.Errorf(BAWlogstring(workerId, err.Error()))
+						return
+					}
+					lastWorkload = workload
+					continue
+				case config.MissingMicroserviceFail:
+					glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("unable to make an agreement with device %v for workload %v, the device has not registered required microservices %v", wi.Device.Id, workload, missingSpecs)))
+					rejections = append(rejections, NewWorkloadRejection(workload, fmt.Sprintf("device has not registered required microservices %v", missingSpecs)))
+					b.recordSelection(wi, SELECTION_MISSING_MICROSERVICE, rejections, workerId)
+					if !existingWLU {
+						b.deleteSelectionUsage(wi, WU_REASON_WORKLOAD_REJECTED, workerId)
+					}
+					return
+				default:
+					glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("device %v has not registered microservices %v required by workload %v", wi.Device.Id, missingSpecs, workload)))
 				}
 			}
 
@@ -251,24 +472,11 @@ func (b *BaseAgreementWorker) InitiateNewAgreement(cph ConsumerProtocolHandler,
 			// even if retries have been disabled.
 			if err := wi.ProducerPolicy.APISpecs.Supports(*asl); err != nil {
 				glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("skipping workload %v because device %v cant support it: %v", workload, wi.Device.Id, err)))
+				rejections = append(rejections, NewWorkloadRejection(workload, err.Error()))
 
-				if !workload.HasEmptyPriority() {
-					// If this is not the first time through the loop, update the workload usage record, otherwise create it.
-					if lastWorkload != nil {
-						if _, err := UpdatePriority(b.db, wi.Device.Id, wi.ConsumerPolicy.Header.Name, workload.Priority.PriorityValue, workload.Priority.RetryDurationS, workload.Priority.VerifiedDurationS, agreementIdString); err != nil {
-							glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error updating priority in persistent workload usage records for device %v with policy %v, error: %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, err)))
-							return
-						}
-					} else if err := NewWorkloadUsage(b.db, wi.Device.Id, wi.ProducerPolicy.HAGroup.Partners, "", wi.ConsumerPolicy.Header.Name, workload.Priority.PriorityValue, workload.Priority.RetryDurationS, workload.Priority.VerifiedDurationS, true, agreementIdString); err != nil {
-						glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error creating persistent workload usage records for device %v with policy %v, error: %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, err)))
-						return
-					}
-
-					// Artificially bump up the retry count so that the loop will choose the next workload
-					if _, err := UpdateRetryCount(b.db, wi.Device.Id, wi.ConsumerPolicy.Header.Name, workload.Priority.Retries+1, agreementIdString); err != nil {
-						glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error updating retry count persistent workload usage records for device %v with policy %v, error: %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, err)))
-						return
-					}
+				if err := b.skipWorkload(wi, workload, lastWorkload, agreementIdString); err != nil {
+					glog.Errorf(BAWlogstring(workerId, err.Error()))
+					return
 				}
 			} else {
 
@@ -300,7 +508,11 @@ func (b *BaseAgreementWorker) InitiateNewAgreement(cph ConsumerProtocolHandler,
 
 	// Call the exchange to make sure that all partners are registered in the exchange. We can do this check now that we know
 	// exactly what the merged producer policy looks like.
-	if err := b.incompleteHAGroup(cph, &wi.ProducerPolicy); err != nil {
+	if err := b.incompleteHAGroup(ctx, cph, &wi.ProducerPolicy); err != nil {
+		if ctx.Err() != nil {
+			b.abandonInitiate(cph, wi, agreementIdString, existingWLU, false, workerId)
+			return
+		}
 		glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("received error checking HA group %v completeness for device %v, error: %v", wi.ProducerPolicy.HAGroup, wi.Device.Id, err)))
 		return
 	}
@@ -311,17 +523,81 @@ func (b *BaseAgreementWorker) InitiateNewAgreement(cph ConsumerProtocolHandler,
 		return
 	} else if ignore {
 		glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("skipping device %v, advertises ignored property", wi.Device.Id)))
+		b.recordSelection(wi, SELECTION_IGNORED, rejections, workerId)
+		return
+	}
+
+	// In observer mode, report the agreement that would have been proposed instead of proposing it. The agbot finds the
+	// same devices on every search, so the agreement is only reported when the chosen workload changes. Nothing is
+	// written to the database.
+	if b.config.AgreementBot.ObserverMode {
+		if !Observations.Observe(wi.Device.Id, wi.ConsumerPolicy.Header.Name, workload) {
+			glog.V(5).Infof(BAWlogstring(workerId, fmt.Sprintf("observer mode, already reported the agreement with device %v for policy %v with workload %v version %v arch %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, workload.WorkloadURL, workload.Version, workload.Arch)))
+			return
+		}
+		glog.Infof(BAWlogstring(workerId, fmt.Sprintf("observer mode, would have proposed agreement %v to device %v for policy %v with workload %v version %v arch %v", agreementIdString, wi.Device.Id, wi.ConsumerPolicy.Header.Name, workload.WorkloadURL, workload.Version, workload.Arch)))
+		b.webhook.Notify(AgreementEvent{
+			Event:           WEBHOOK_AGREEMENT_OBSERVED,
+			AgreementId:     agreementIdString,
+			Protocol:        cph.Name(),
+			DeviceId:        wi.Device.Id,
+			PolicyName:      wi.ConsumerPolicy.Header.Name,
+			PatternId:       wi.ConsumerPolicy.PatternId,
+			Rejections:      rejections,
+			WorkloadURL:     workload.WorkloadURL,
+			WorkloadVersion: workload.Version,
+			WorkloadArch:    workload.Arch,
+		})
 		return
 	}
 
-	// Create pending agreement in database
-	if err := AgreementAttempt(b.db, agreementIdString, wi.Org, wi.Device.Id, wi.ConsumerPolicy.Header.Name, bcType, bcName, bcOrg, cph.Name(), wi.ConsumerPolicy.PatternId, wi.ConsumerPolicy.NodeH); err != nil {
+	// Apply the deployment overrides configured for the device's group, if there are any.
+	workload, overrideGroup, err := b.applyDeploymentOverrides(workload, wi.Device.Id, &wi.ProducerPolicy)
+	if err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error applying deployment overrides for device %v, error: %v", wi.Device.Id, err)))
+		return
+	}
+
+	b.recordSelection(wi, SELECTION_CHOSEN, rejections, workerId)
+	b.trace(agreementIdString, TRACE_WORKLOAD_CHOSEN, workloadChosenDetail(workload.WorkloadURL, workload.Version, workload.Arch, wi.Device.Id, wi.ConsumerPolicy.Header.Name, overrideGroup))
+
+	if ctx.Err() != nil {
+		b.abandonInitiate(cph, wi, agreementIdString, existingWLU, false, workerId)
+		return
+	}
+
+	// Create pending agreement in database, annotated with the operator's metadata
+	if metadata, err := b.config.AgreementBot.AgreementMetadataMap(); err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error reading agreement metadata: %v", err)))
+	} else if err := AgreementAttempt(b.db, agreementIdString, wi.Org, wi.Device.Id, wi.ConsumerPolicy.Header.Name, bcType, bcName, bcOrg, cph.Name(), wi.ConsumerPolicy.PatternId, wi.ConsumerPolicy.NodeH, workload, metadata); err != nil {
 		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error persisting agreement attempt: %v", err)))
 
+		// Record the merged producer policy so that the result of the merge can be inspected later
+	} else if err := b.persistProducerPolicy(cph, agreementIdString, &wi.ProducerPolicy); err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error persisting producer policy: %v", err)))
+
+		// Remove pending agreement from database, no proposal will be sent for it
+		if err := DeleteAgreement(b.db, agreementIdString, cph.Name()); err != nil {
+			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error deleting pending agreement: %v, error %v", agreementIdString, err)))
+		}
+
+		// Record which device group's deployment overrides were applied
+	} else if err := b.persistDeploymentOverridesGroup(cph, agreementIdString, overrideGroup); err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error persisting deployment overrides group: %v", err)))
+
+		// Remove pending agreement from database, no proposal will be sent for it
+		if err := DeleteAgreement(b.db, agreementIdString, cph.Name()); err != nil {
+			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error deleting pending agreement: %v, error %v", agreementIdString, err)))
+		}
+
 		// Create message target for protocol message
 	} else if mt, err := exchange.CreateMessageTarget(wi.Device.Id, nil, wi.Device.PublicKey, wi.Device.MsgEndPoint); err != nil {
 		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error creating message target: %v", err)))
 
+		// Dont send the proposal if the initiation has been abandoned in the meantime
+	} else if ctx.Err() != nil {
+		b.abandonInitiate(cph, wi, agreementIdString, existingWLU, true, workerId)
+
 		// Initiate the protocol
 	} else if proposal, err := protocolHandler.InitiateAgreement(agreementIdString, &wi.ProducerPolicy, &wi.ConsumerPolicy, wi.Org, cph.ExchangeId(), mt, workload, b.config.AgreementBot.DefaultWorkloadPW, b.config.AgreementBot.NoDataIntervalS, cph.GetSendMessage()); err != nil {
 		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error initiating agreement: %v", err)))
@@ -336,6 +612,14 @@ func (b *BaseAgreementWorker) InitiateNewAgreement(cph ConsumerProtocolHandler,
 		// Update the agreement in the DB with the proposal and policy
 	} else if err := cph.PersistAgreement(wi, proposal, workerId); err != nil {
 		glog.Errorf(err.Error())
+	} else {
+		b.webhook.Notify(AgreementEvent{
+			Event:       WEBHOOK_AGREEMENT_INITIATED,
+			AgreementId: agreementIdString,
+			Protocol:    cph.Name(),
+			DeviceId:    wi.Device.Id,
+			PolicyName:  wi.ConsumerPolicy.Header.Name,
+		})
 	}
 
 }
@@ -360,26 +644,42 @@ func (b *BaseAgreementWorker) HandleAgreementReply(cph ConsumerProtocolHandler,
 	ackReplyAsValid := false
 	sendReply := true
 
+	// A reply that is valid can still be rejected when it can't be recorded on the blockchain, which is not the device's fault.
+	bcWriteFailed := false
+
+	// A reply can also be rejected because of a failure in the agbot, e.g. a database or exchange error, or because the
+	// policy changed. Only the rejections caused by the device are counted against it.
+	deviceFault := false
+
 	if reply.ProposalAccepted() {
 
 		// Find the saved agreement in the database
 		if agreement, err := FindSingleAgreementByAgreementId(b.db, reply.AgreementId(), cph.Name(), []AFilter{UnarchivedAFilter()}); err != nil {
 			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error querying pending agreement %v, error: %v", reply.AgreementId(), err)))
 		} else if agreement == nil {
+			// A late reply to an agreement that was archived or purged in the meantime is not the device's fault.
 			glog.V(5).Infof(BAWlogstring(workerId, fmt.Sprintf("discarding reply, agreement id %v not in our database", reply.AgreementId())))
+		} else if agreement.DeviceId != wi.SenderId {
+			glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("discarding reply for agreement %v from %v, the agreement is with %v", reply.AgreementId(), wi.SenderId, agreement.DeviceId)))
+			b.trace(reply.AgreementId(), TRACE_REPLY, fmt.Sprintf("reply is invalid, it came from %v", wi.SenderId))
+			deviceFault = true
 		} else if cph.AlreadyReceivedReply(agreement) {
 			glog.V(5).Infof(BAWlogstring(workerId, fmt.Sprintf("discarding reply, agreement id %v already received a reply", agreement.CurrentAgreementId)))
+			b.trace(agreement.CurrentAgreementId, TRACE_REPLY, "discarded duplicate reply")
 			// this will cause us to not send a reply ack, which is what we want in this case
 			sendReply = false
 
 			// Now we need to write the info to the exchange and the database
 		} else if proposal, err := protocolHandler.DemarshalProposal(agreement.Proposal); err != nil {
 			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error validating proposal from pending agreement %v, error: %v", reply.AgreementId(), err)))
+			b.trace(reply.AgreementId(), TRACE_REPLY, fmt.Sprintf("reply is invalid, unable to validate the proposal, error: %v", err))
 		} else if pol, err := policy.DemarshalPolicy(proposal.TsAndCs()); err != nil {
 			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error demarshalling tsandcs policy from pending agreement %v, error: %v", reply.AgreementId(), err)))
+			b.trace(reply.AgreementId(), TRACE_REPLY, fmt.Sprintf("reply is invalid, unable to demarshal the tsandcs policy, error: %v", err))
 
 		} else if err := cph.PersistReply(reply, pol, workerId); err != nil {
 			glog.Errorf(err.Error())
+			b.trace(reply.AgreementId(), TRACE_REPLY, fmt.Sprintf("reply is invalid, unable to persist it, error: %v", err))
 
 		} else if err := cph.RecordConsumerAgreementState(reply.AgreementId(), pol, agreement.Org, "Producer agreed", b.workerID); err != nil {
 			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error setting agreement state for %v", reply.AgreementId())))
@@ -390,6 +690,7 @@ func (b *BaseAgreementWorker) HandleAgreementReply(cph ConsumerProtocolHandler,
 		} else {
 			// Done handling the response successfully
 			ackReplyAsValid = true
+			b.trace(reply.AgreementId(), TRACE_REPLY, fmt.Sprintf("device %v accepted the proposal", wi.SenderId))
 
 			// If we dont have a workload usage record for this device, then we need to create one. If there is already a
 			// workload usage record and workload rollback retry counting is enabled, then check to see if the workload priority
@@ -405,8 +706,9 @@ func (b *BaseAgreementWorker) HandleAgreementReply(cph ConsumerProtocolHandler,
 				if !workload.Priority.IsSame(pol.Workloads[0].Priority) {
 					// Need a new workload usage record but not the same as the highest priority. That can't be right.
 					ackReplyAsValid = false
+					b.trace(reply.AgreementId(), TRACE_COMPATIBILITY, fmt.Sprintf("workload priority %v is no longer the highest priority %v, reply is not valid", pol.Workloads[0].Priority, workload.Priority))
 				} else if !pol.Workloads[0].HasEmptyPriority() {
-					if err := NewWorkloadUsage(b.db, wi.SenderId, pol.HAGroup.Partners, agreement.Policy, consumerPolicy.Header.Name, pol.Workloads[0].Priority.PriorityValue, pol.Workloads[0].Priority.RetryDurationS, pol.Workloads[0].Priority.VerifiedDurationS, false, reply.AgreementId()); err != nil {
+					if err := NewWorkloadUsage(b.db, wi.SenderId, pol.HAGroup.Partners, agreement.Policy, consumerPolicy.Header.Name, pol.Workloads[0].Priority.PriorityValue, pol.Workloads[0].Priority.RetryDurationS, MinVerifiedDuration(wi.SenderId, consumerPolicy.Header.Name, pol.Workloads[0].Priority.VerifiedDurationS, b.config.AgreementBot.MinVerifiedDurationS), false, reply.AgreementId()); err != nil {
 						glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error creating persistent workload usage records for device %v with policy %v, error: %v", wi.SenderId, consumerPolicy.Header.Name, err)))
 					}
 				}
@@ -419,10 +721,10 @@ func (b *BaseAgreementWorker) HandleAgreementReply(cph ConsumerProtocolHandler,
 
 				if !wlUsage.DisableRetry {
 					if pol.Workloads[0].Priority.PriorityValue != wlUsage.Priority {
-						if _, err := UpdatePriority(b.db, wi.SenderId, consumerPolicy.Header.Name, pol.Workloads[0].Priority.PriorityValue, pol.Workloads[0].Priority.RetryDurationS, pol.Workloads[0].Priority.VerifiedDurationS, reply.AgreementId()); err != nil {
+						if _, err := UpdatePriority(b.db, wi.SenderId, consumerPolicy.Header.Name, pol.Workloads[0].Priority.PriorityValue, pol.Workloads[0].Priority.RetryDurationS, MinVerifiedDuration(wi.SenderId, consumerPolicy.Header.Name, pol.Workloads[0].Priority.VerifiedDurationS, b.config.AgreementBot.MinVerifiedDurationS), reply.AgreementId()); err != nil {
 							glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error updating workload usage prioroty for device %v with policy %v, error: %v", wi.SenderId, consumerPolicy.Header.Name, err)))
 						}
-					} else if _, err := UpdateRetryCount(b.db, wi.SenderId, consumerPolicy.Header.Name, wlUsage.RetryCount+1, reply.AgreementId()); err != nil {
+					} else if _, err := UpdateRetryCount(b.db, wi.SenderId, consumerPolicy.Header.Name, wlUsage.NextRetryCount(wlUsage.NextRetryCause()), wlUsage.NextRetryCause(), reply.AgreementId()); err != nil {
 						glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error updating workload usage retry count for device %v with policy %v, error: %v", wi.SenderId, consumerPolicy.Header.Name, err)))
 					}
 				} else if _, err := UpdateWUAgreementId(b.db, wi.SenderId, consumerPolicy.Header.Name, reply.AgreementId()); err != nil {
@@ -451,13 +753,29 @@ func (b *BaseAgreementWorker) HandleAgreementReply(cph ConsumerProtocolHandler,
 
 				if err := cph.PostReply(reply.AgreementId(), proposal, reply, consumerPolicy, agreement.Org, workerId); err != nil {
 					glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error trying to record agreement in blockchain, %v", err)))
-					b.CancelAgreementWithLock(cph, reply.AgreementId(), cph.GetTerminationCode(TERM_REASON_CANCEL_BC_WRITE_FAILED), workerId)
+					b.CancelAgreementWithLock(cph, reply.AgreementId(), cph.GetTerminationCode(TERM_REASON_CANCEL_BC_WRITE_FAILED), "", workerId)
 					ackReplyAsValid = false
+					bcWriteFailed = true
+				} else {
+					b.webhook.Notify(AgreementEvent{
+						Event:       WEBHOOK_AGREEMENT_ACCEPTED,
+						AgreementId: reply.AgreementId(),
+						Protocol:    cph.Name(),
+						DeviceId:    agreement.DeviceId,
+						PolicyName:  agreement.PolicyName,
+					})
 				}
 
 			}
 		}
 
+		// Keep track of the devices that repeatedly send invalid replies.
+		if sendReply && (ackReplyAsValid || bcWriteFailed) {
+			b.countReply(wi.SenderId, true, workerId)
+		} else if sendReply && deviceFault {
+			b.countReply(wi.SenderId, false, workerId)
+		}
+
 		// Always send an ack for a reply with a positive decision in it
 		if !ackReplyAsValid && sendReply {
 			if mt, err := exchange.CreateMessageTarget(wi.SenderId, nil, wi.SenderPubKey, wi.From); err != nil {
@@ -469,8 +787,9 @@ func (b *BaseAgreementWorker) HandleAgreementReply(cph ConsumerProtocolHandler,
 
 	} else {
 		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("received rejection from producer %v", reply)))
+		b.trace(reply.AgreementId(), TRACE_REPLY, fmt.Sprintf("device %v rejected the proposal", wi.SenderId))
 
-		b.CancelAgreement(cph, reply.AgreementId(), cph.GetTerminationCode(TERM_REASON_NEGATIVE_REPLY), workerId)
+		b.CancelAgreement(cph, reply.AgreementId(), cph.GetTerminationCode(TERM_REASON_NEGATIVE_REPLY), "", workerId)
 	}
 
 	// Get rid of the lock
@@ -507,8 +826,18 @@ func (b *BaseAgreementWorker) HandleDataReceivedAck(cph ConsumerProtocolHandler,
 			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error querying timed out agreement %v, error: %v", drAck.AgreementId(), err)))
 		} else if ag == nil {
 			glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("nothing to terminate for agreement %v, no database record.", drAck.AgreementId())))
+		} else if ag.DisableDataVerificationChecks && b.config.AgreementBot.UnexpectedDataAckAction == config.UnexpectedDataAckIgnore {
+			glog.V(5).Infof(BAWlogstring(workerId, fmt.Sprintf("ignoring data received ack for agreement %v, its policy disabled data verification", ag.CurrentAgreementId)))
+		} else if ag.DisableDataVerificationChecks && b.config.AgreementBot.UnexpectedDataAckAction == config.UnexpectedDataAckFlag {
+			glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("unexpected data received ack from device %v for agreement %v, its policy disabled data verification", ag.DeviceId, ag.CurrentAgreementId)))
+			if _, err := UnexpectedDataAck(b.db, ag.CurrentAgreementId, cph.Name()); err != nil {
+				glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("unable to record unexpected data received ack, error: %v", err)))
+			}
+			b.trace(ag.CurrentAgreementId, TRACE_DATA_RECEIVED, "device acknowledged that data was received, unexpected because the policy disabled data verification")
 		} else if _, err := DataNotification(b.db, ag.CurrentAgreementId, cph.Name()); err != nil {
 			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("unable to record data notification, error: %v", err)))
+		} else {
+			b.trace(ag.CurrentAgreementId, TRACE_DATA_RECEIVED, "device acknowledged that data was received")
 		}
 
 		// Drop the lock. The code block above must always flow through this point.
@@ -549,69 +878,94 @@ func (b *BaseAgreementWorker) HandleWorkloadUpgrade(cph ConsumerProtocolHandler,
 			// Cancel all agreements
 			for _, ag := range ags {
 				// Terminate the agreement
-				b.CancelAgreementWithLock(cph, ag.CurrentAgreementId, cph.GetTerminationCode(TERM_REASON_CANCEL_FORCED_UPGRADE), workerId)
+				b.CancelAgreementWithLock(cph, ag.CurrentAgreementId, cph.GetTerminationCode(TERM_REASON_CANCEL_FORCED_UPGRADE), "", workerId)
 			}
 		}
 	} else {
 		// Terminate the agreement
-		b.CancelAgreementWithLock(cph, wi.AgreementId, cph.GetTerminationCode(TERM_REASON_CANCEL_FORCED_UPGRADE), workerId)
+		b.CancelAgreementWithLock(cph, wi.AgreementId, cph.GetTerminationCode(TERM_REASON_CANCEL_FORCED_UPGRADE), "", workerId)
 	}
 
 	// Find the workload usage record and delete it. This will cause any new agreement negotiations to start with the highest priority
 	// workload.
-	if err := DeleteWorkloadUsage(b.db, wi.Device, wi.PolicyName); err != nil {
+	if err := DeleteWorkloadUsage(b.db, wi.Device, wi.PolicyName, WU_REASON_WORKLOAD_UPGRADE); err != nil {
 		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error deleting workload usage record for device %v and policyName %v, error: %v", wi.Device, wi.PolicyName, err)))
 	}
 
 }
 
-func (b *BaseAgreementWorker) CancelAgreementWithLock(cph ConsumerProtocolHandler, agreementId string, reason uint, workerId string) {
+// Cancel an agreement while holding its agreement lock. The operatorReason is the free text reason given by an operator who
+// cancelled the agreement, it is empty for automated cancels.
+func (b *BaseAgreementWorker) CancelAgreementWithLock(cph ConsumerProtocolHandler, agreementId string, reason uint, operatorReason string, workerId string) {
 	// Get the agreement id lock to prevent any other thread from processing this same agreement.
 	lock := b.AgreementLockManager().getAgreementLock(agreementId)
 	lock.Lock()
 
 	// Terminate the agreement
-	b.CancelAgreement(cph, agreementId, reason, workerId)
+	b.CancelAgreement(cph, agreementId, reason, operatorReason, workerId)
 
 	lock.Unlock()
-
-	// Don't need the agreement lock anymore
-	b.AgreementLockManager().deleteAgreementLock(agreementId)
 }
 
-func (b *BaseAgreementWorker) CancelAgreement(cph ConsumerProtocolHandler, agreementId string, reason uint, workerId string) {
+func (b *BaseAgreementWorker) CancelAgreement(cph ConsumerProtocolHandler, agreementId string, reason uint, operatorReason string, workerId string) {
 
 	// Start timing out the agreement
 	glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("terminating agreement %v.", agreementId)))
+	if operatorReason != "" {
+		b.trace(agreementId, TRACE_CANCELLED, fmt.Sprintf("reason %v: %v, operator reason: %v", reason, cph.GetTerminationReason(reason), operatorReason))
+	} else {
+		b.trace(agreementId, TRACE_CANCELLED, fmt.Sprintf("reason %v: %v", reason, cph.GetTerminationReason(reason)))
+	}
 
-	// Update the database
-	if _, err := AgreementTimedout(b.db, agreementId, cph.Name()); err != nil {
+	// Update the database. If the agreement cant be marked terminated, its archival is completed later.
+	archived := true
+	if err := b.timeoutAgreement(cph, agreementId, workerId); err != nil {
 		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error marking agreement %v terminated: %v", agreementId, err)))
+		archived = false
 	}
 
 	// Update state in exchange
-	if err := DeleteConsumerAgreement(b.config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), b.config.AgreementBot.ExchangeURL, cph.ExchangeId(), cph.ExchangeToken(), agreementId); err != nil {
+	if err := DeleteConsumerAgreement(b.httpClient, b.config.AgreementBot.GetExchangeURL(exchange.GetOrg(cph.ExchangeId())), cph.ExchangeId(), cph.ExchangeToken(), agreementId); err != nil {
 		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error deleting agreement %v in exchange: %v", agreementId, err)))
 	}
 
 	// Find the agreement record
 	if ag, err := FindSingleAgreementByAgreementId(b.db, agreementId, cph.Name(), []AFilter{UnarchivedAFilter()}); err != nil {
 		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error querying agreement %v from database, error: %v", agreementId, err)))
+		if !archived {
+			b.deferArchive(cph, agreementId, reason, operatorReason, workerId)
+		}
 	} else if ag == nil {
 		glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("nothing to terminate for agreement %v, no database record.", agreementId)))
 	} else {
 
 		// Update the workload usage record to clear the agreement. There might not be a workload usage record if there is no workload priority
 		// specified in the workload section of the policy.
-		if wlUsage, err := UpdateWUAgreementId(b.db, ag.DeviceId, ag.PolicyName, ""); err != nil {
+		cause := retryCause(cph, reason)
+		if wlUsage, err := EndWUAgreement(b.db, ag.DeviceId, ag.PolicyName, cause); err != nil {
 			glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("warning updating agreement id in workload usage for %v for policy %v, error: %v", ag.DeviceId, ag.PolicyName, err)))
 
-		} else if wlUsage != nil && wlUsage.ReqsNotMet {
+		} else if wlUsage != nil {
+			// An agreement cancelled by the device before it was finalized counts against the device's maximum agreement failures.
+			if ag.AgreementFinalizedTime == 0 && cause == WU_RETRY_DEVICE {
+				if failed, err := RecordWUFailure(b.db, ag.DeviceId, ag.PolicyName, b.config.AgreementBot.MaxAgreementFailures); err != nil {
+					glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error counting failed agreement %v in workload usage for %v for policy %v, error: %v", agreementId, ag.DeviceId, ag.PolicyName, err)))
+				} else {
+					wlUsage = failed
+					if wlUsage.Exhausted {
+						glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("%v agreements with device %v for policy %v have failed, no more agreements will be made until the workload usage is reset", wlUsage.FailureCount, ag.DeviceId, ag.PolicyName)))
+					}
+				}
+			}
+
 			// If the workload usage record indicates that it is not at the highest priority workload because the device cant meet the
 			// requirements of the higher priority workload, then when an agreement gets cancelled, we will remove the record so that the
-			// agbot always tries the next agreement starting with the highest priority workload again.
-			if err := DeleteWorkloadUsage(b.db, ag.DeviceId, ag.PolicyName); err != nil {
-				glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error deleting workload usage record for device %v and policyName %v, error: %v", ag.DeviceId, ag.PolicyName, err)))
+			// agbot always tries the next agreement starting with the highest priority workload again. An exhausted record is kept so
+			// that it continues to block new agreements.
+			if wlUsage.ReqsNotMet && !wlUsage.Exhausted {
+				if err := DeleteWorkloadUsage(b.db, ag.DeviceId, ag.PolicyName, WU_REASON_AGREEMENT_CANCELLED); err != nil {
+					glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error deleting workload usage record for device %v and policyName %v, error: %v", ag.DeviceId, ag.PolicyName, err)))
+				}
 			}
 		}
 
@@ -634,16 +988,106 @@ func (b *BaseAgreementWorker) CancelAgreement(cph ConsumerProtocolHandler, agree
 			})
 		}
 
-		// Archive the record
-		if _, err := ArchiveAgreement(b.db, ag.CurrentAgreementId, cph.Name(), reason, cph.GetTerminationReason(reason)); err != nil {
+		// If the cancel reason has a cooldown configured, prevent a new agreement with this device and policy until it expires.
+		if cooldown := b.cancelCooldownS(cph, reason); cooldown > 0 {
+			if err := NewCancelCooldown(b.db, ag.DeviceId, ag.PolicyName, reason, cooldown); err != nil {
+				glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error creating cancel cooldown for device %v with policy %v, error: %v", ag.DeviceId, ag.PolicyName, err)))
+			}
+		}
+
+		// Archive the record. The archival is completed later if either database write failed, so that the record does not
+		// stay half cancelled.
+		if err := b.retryDBWrite(workerId, fmt.Sprintf("archiving agreement %v", ag.CurrentAgreementId), func() error {
+			_, err := ArchiveAgreement(b.db, ag.CurrentAgreementId, cph.Name(), reason, cph.GetTerminationReason(reason), operatorReason)
+			return err
+		}); err != nil {
 			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error archiving terminated agreement: %v, error: %v", ag.CurrentAgreementId, err)))
+			archived = false
+		}
+		if !archived {
+			b.deferArchive(cph, ag.CurrentAgreementId, reason, operatorReason, workerId)
+		}
+
+		b.webhook.Notify(AgreementEvent{
+			Event:             WEBHOOK_AGREEMENT_CANCELLED,
+			AgreementId:       ag.CurrentAgreementId,
+			Protocol:          cph.Name(),
+			DeviceId:          ag.DeviceId,
+			PolicyName:        ag.PolicyName,
+			Reason:            reason,
+			ReasonDescription: cph.GetTerminationReason(reason),
+			OperatorReason:    operatorReason,
+		})
+
+	}
+}
+
+// Mark an agreement terminated, retrying the database write if it fails. An agreement without a database record has
+// nothing to mark.
+func (b *BaseAgreementWorker) timeoutAgreement(cph ConsumerProtocolHandler, agreementId string, workerId string) error {
+	return b.retryDBWrite(workerId, fmt.Sprintf("marking agreement %v terminated", agreementId), func() error {
+		if ag, err := FindSingleAgreementByAgreementId(b.db, agreementId, cph.Name(), []AFilter{}); err != nil {
+			return err
+		} else if ag == nil || ag.AgreementTimedout != 0 {
+			return nil
 		}
+		_, err := AgreementTimedout(b.db, agreementId, cph.Name())
+		return err
+	})
+}
 
+// Call a database write until it succeeds, at most DB_WRITE_RETRIES more times after the first failure, backing off
+// between the attempts. Returns the error of the last attempt.
+func (b *BaseAgreementWorker) retryDBWrite(workerId string, desc string, write func() error) error {
+	backoff := DB_WRITE_RETRY_BACKOFF_MS * time.Millisecond
+	err := write()
+	for retry := 1; err != nil && retry <= DB_WRITE_RETRIES; retry++ {
+		glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("retrying %v in %v, attempt %v failed, error: %v", desc, backoff, retry, err)))
+		time.Sleep(backoff)
+		backoff *= 2
+		err = write()
 	}
+	return err
+}
+
+// Queue a deferred command to complete the archival of a cancelled agreement whose database writes failed.
+func (b *BaseAgreementWorker) deferArchive(cph ConsumerProtocolHandler, agreementId string, reason uint, operatorReason string, workerId string) {
+	glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("agreement %v is cancelled but its database record could not be archived after %v attempts, deferring the archival", agreementId, DB_WRITE_RETRIES+1)))
+	cph.DeferCommand(AsyncArchiveAgreement{
+		workType:       ASYNC_ARCHIVE,
+		AgreementId:    agreementId,
+		Protocol:       cph.Name(),
+		Reason:         reason,
+		OperatorReason: operatorReason,
+	})
 }
 
-func (b *BaseAgreementWorker) ExternalCancel(cph ConsumerProtocolHandler, agreementId string, reason uint, workerId string) {
+// Complete the archival of a cancelled agreement whose database writes failed when it was cancelled. The archival is
+// deferred again if the writes still fail.
+func (b *BaseAgreementWorker) ExternalArchive(cph ConsumerProtocolHandler, agreementId string, reason uint, operatorReason string, workerId string) {
 
+	glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("starting deferred archival of %v", agreementId)))
+
+	if err := b.timeoutAgreement(cph, agreementId, workerId); err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error marking agreement %v terminated: %v", agreementId, err)))
+		b.deferArchive(cph, agreementId, reason, operatorReason, workerId)
+	} else if err := b.retryDBWrite(workerId, fmt.Sprintf("archiving agreement %v", agreementId), func() error {
+		if ag, err := FindSingleAgreementByAgreementId(b.db, agreementId, cph.Name(), []AFilter{UnarchivedAFilter()}); err != nil || ag == nil {
+			return err
+		}
+		_, err := ArchiveAgreement(b.db, agreementId, cph.Name(), reason, cph.GetTerminationReason(reason), operatorReason)
+		return err
+	}); err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error archiving terminated agreement: %v, error: %v", agreementId, err)))
+		b.deferArchive(cph, agreementId, reason, operatorReason, workerId)
+	} else {
+		glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("completed deferred archival of %v", agreementId)))
+	}
+}
+
+func (b *BaseAgreementWorker) ExternalCancel(cph ConsumerProtocolHandler, cancel AsyncCancelAgreement, workerId string) {
+
+	agreementId := cancel.AgreementId
 	glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("starting deferred cancel for %v", agreementId)))
 
 	// Find the agreement record
@@ -653,17 +1097,13 @@ func (b *BaseAgreementWorker) ExternalCancel(cph ConsumerProtocolHandler, agreem
 		glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("nothing to terminate for agreement %v, no database record.", agreementId)))
 	} else {
 		bcType, bcName, bcOrg := cph.GetKnownBlockchain(ag)
-		if cph.IsBlockchainWritable(bcType, bcName, bcOrg) {
-			b.DoAsyncCancel(cph, ag, reason, workerId)
+		if cancel.Force || cph.IsBlockchainWritable(bcType, bcName, bcOrg) {
+			b.DoAsyncCancel(cph, ag, cancel.Reason, workerId)
 
 		} else {
+			// Defer the same command again, so that it keeps the time it was first deferred.
 			glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("deferring blockchain cancel for %v", agreementId)))
-			cph.DeferCommand(AsyncCancelAgreement{
-				workType:    ASYNC_CANCEL,
-				AgreementId: agreementId,
-				Protocol:    cph.Name(),
-				Reason:      reason,
-			})
+			cph.DeferCommand(cancel)
 		}
 	}
 }
@@ -680,36 +1120,257 @@ var BAWlogstring = func(workerID string, v interface{}) string {
 	return fmt.Sprintf("Base Agreement Worker (%v): %v", workerID, v)
 }
 
+// Record a step in the agreement's trace, if the agreement is being traced.
+func (b *BaseAgreementWorker) trace(agreementId string, step string, detail string) {
+	if err := RecordAgreementTrace(b.db, agreementId, step, detail); err != nil {
+		glog.Warningf(BAWlogstring(b.workerID, fmt.Sprintf("unable to record %v in the trace of agreement %v, error: %v", step, agreementId, err)))
+	}
+}
+
+// Count a reply from the device. Devices that send InvalidReplyThreshold consecutive invalid replies are blacklisted
+// from new agreements for a while. Only replies that are invalid because of the device are counted as invalid.
+func (b *BaseAgreementWorker) countReply(deviceId string, valid bool, workerId string) {
+	threshold := b.config.AgreementBot.InvalidReplyThreshold
+	if threshold <= 0 {
+		return
+	}
+
+	if valid {
+		if err := ResetInvalidReplies(b.db, deviceId); err != nil {
+			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error resetting invalid replies of device %v, error: %v", deviceId, err)))
+		}
+		return
+	}
+
+	durationS := b.config.AgreementBot.InvalidReplyBlacklistS
+	if durationS <= 0 {
+		durationS = config.DefaultInvalidReplyBlacklistS
+	}
+	if bl, blacklisted, err := RecordInvalidReply(b.db, deviceId, threshold, durationS); err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error recording invalid reply of device %v, error: %v", deviceId, err)))
+	} else if blacklisted {
+		glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("blacklisting device %v from new agreements until %v, it sent %v invalid replies in a row", deviceId, bl.BlacklistedUntil, threshold)))
+	} else {
+		glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("device %v has sent %v invalid replies in a row", deviceId, bl.InvalidReplies)))
+	}
+}
+
 // This function checks the Exchange for every declared HA partner to verify that the partner is registered in the
-// exchange. As long as all partners are registered, agreements can be made. The partners dont have to be up and heart
-// beating, they just have to be registered. If not all partners are registered then no agreements will be attempted
-// with any of the registered partners.
-func (b *BaseAgreementWorker) incompleteHAGroup(cph ConsumerProtocolHandler, producerPolicy *policy.Policy) error {
+// exchange. As long as a quorum of the partners is registered, agreements can be made. The quorum is set by
+// HAPartnerQuorumPercent in the agbot configuration and is all of the partners by default. The partners dont have to be
+// up and heart beating, they just have to be registered. If fewer partners than the quorum are registered then no
+// agreements will be attempted with any of the registered partners, otherwise the missing partners are logged.
+func (b *BaseAgreementWorker) incompleteHAGroup(ctx context.Context, cph ConsumerProtocolHandler, producerPolicy *policy.Policy) error {
 
 	// If the HA group specification is empty, there is nothing to check.
 	if len(producerPolicy.HAGroup.Partners) == 0 {
 		return nil
 	} else {
 
-		// Make sure all partners are in the exchange
-		for _, partnerId := range producerPolicy.HAGroup.Partners {
+		// Make sure enough partners to meet the configured quorum are in the exchange, all of them by default.
+		partners := producerPolicy.HAGroup.Partners
+		required := b.config.AgreementBot.HAPartnersRequired(len(partners))
+		missing := make([]string, 0, len(partners))
+		for _, partnerId := range partners {
 
-			if _, err := GetDevice(b.config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), partnerId, b.config.AgreementBot.ExchangeURL, cph.ExchangeId(), cph.ExchangeToken()); err != nil {
-				return errors.New(fmt.Sprintf("could not obtain device %v from the exchange: %v", partnerId, err))
+			if _, err := GetDeviceWithContext(ctx, b.httpClient, partnerId, b.config.AgreementBot.GetExchangeURL(exchange.GetOrg(partnerId)), cph.ExchangeId(), cph.ExchangeToken()); err != nil {
+				if ctx.Err() != nil || len(partners)-len(missing)-1 < required {
+					return errors.New(fmt.Sprintf("could not obtain device %v from the exchange: %v", partnerId, err))
+				}
+				missing = append(missing, partnerId)
 			}
 		}
+		if len(missing) != 0 {
+			glog.Warningf(BAWlogstring(b.workerID, fmt.Sprintf("HA partners %v are not registered in the exchange, proceeding with %v of %v partners registered", missing, len(partners)-len(missing), len(partners))))
+		}
 		return nil
 
 	}
 }
 
+// Clean up after an agreement initiation that was abandoned because its context was cancelled. The workload usage record
+// is removed unless it existed before the initiation started, and the pending agreement is removed if it was created.
+func (b *BaseAgreementWorker) abandonInitiate(cph ConsumerProtocolHandler, wi *InitiateAgreement, agreementId string, existingWLU bool, pending bool, workerId string) {
+
+	glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("abandoning agreement %v with %v for policy %v, shutting down", agreementId, wi.Device.Id, wi.ConsumerPolicy.Header.Name)))
+
+	if pending {
+		if err := DeleteAgreement(b.db, agreementId, cph.Name()); err != nil {
+			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error deleting pending agreement: %v, error %v", agreementId, err)))
+		}
+	}
+	if !existingWLU {
+		b.deleteSelectionUsage(wi, WU_REASON_INITIATE_FAILED, workerId)
+	}
+}
+
+// Returns the org in which the workload is defined. A workload without an org is defined in the org of its policy.
+func workloadOrg(workload *policy.Workload, policyOrg string) string {
+	if workload.Org == "" {
+		return policyOrg
+	}
+	return workload.Org
+}
+
+// Returns the workload retry cause of an agreement cancelled with the input reason code. Cancellations the agbot makes
+// for its own reasons, such as a failed blockchain write, are not held against the device. A reason the protocol has no
+// code for can't be told apart from the other unmapped reasons, so its cause is unknown.
+func retryCause(cph ConsumerProtocolHandler, reason uint) string {
+	if reason == TERM_CODE_UNMAPPED {
+		return WU_RETRY_UNKNOWN
+	}
+	for _, r := range []string{TERM_REASON_CANCEL_BC_WRITE_FAILED, TERM_REASON_POLICY_CHANGED, TERM_REASON_USER_REQUESTED, TERM_REASON_CANCEL_FORCED_UPGRADE} {
+		if code := cph.GetTerminationCode(r); code != TERM_CODE_UNMAPPED && reason == code {
+			return WU_RETRY_AGBOT
+		}
+	}
+	return WU_RETRY_DEVICE
+}
+
+// Remember the outcome of choosing a workload for the device and policy, so that it can be diagnosed later. An agbot in
+// observer mode doesn't write to its database, so nothing is recorded.
+func (b *BaseAgreementWorker) recordSelection(wi *InitiateAgreement, outcome string, rejections []WorkloadRejection, workerId string) {
+	if b.config.AgreementBot.ObserverMode {
+		return
+	}
+	if err := RecordWorkloadSelection(b.db, wi.Device.Id, wi.ConsumerPolicy.Header.Name, outcome, rejections); err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error recording workload selection for device %v with policy %v, error: %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, err)))
+	}
+}
+
+// Update the workload usage record for the device and policy so that the next pass through the workload selection loop
+// in InitiateNewAgreement chooses the next workload. Workloads without a priority have no usage record, so there is
+// nothing to do for them. In observer mode the record is updated in memory only.
+func (b *BaseAgreementWorker) skipWorkload(wi *InitiateAgreement, workload *policy.Workload, lastWorkload *policy.Workload, agreementId string) error {
+
+	if workload.HasEmptyPriority() {
+		return nil
+	}
+
+	verifiedDurationS := MinVerifiedDuration(wi.Device.Id, wi.ConsumerPolicy.Header.Name, workload.Priority.VerifiedDurationS, b.config.AgreementBot.MinVerifiedDurationS)
+	if b.config.AgreementBot.ObserverMode {
+		if wi.observedUsage != nil {
+			wi.observedUsage.setPriority(workload.Priority.PriorityValue, workload.Priority.RetryDurationS, verifiedDurationS, agreementId)
+		} else if wlUsage, err := workloadUsage(wi.Device.Id, wi.ProducerPolicy.HAGroup.Partners, "", wi.ConsumerPolicy.Header.Name, workload.Priority.PriorityValue, workload.Priority.RetryDurationS, verifiedDurationS, true, agreementId); err != nil {
+			return errors.New(fmt.Sprintf("error creating workload usage for device %v with policy %v, error: %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, err))
+		} else {
+			wi.observedUsage = wlUsage
+		}
+		wi.observedUsage.setRetryCount(workload.Priority.Retries+1, WU_RETRY_REQS_NOT_MET, agreementId)
+		return nil
+	}
+
+	// If this is not the first time through the loop, update the workload usage record, otherwise create it.
+	if lastWorkload != nil {
+		if _, err := UpdatePriority(b.db, wi.Device.Id, wi.ConsumerPolicy.Header.Name, workload.Priority.PriorityValue, workload.Priority.RetryDurationS, verifiedDurationS, agreementId); err != nil {
+			return errors.New(fmt.Sprintf("error updating priority in persistent workload usage records for device %v with policy %v, error: %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, err))
+		}
+	} else if err := NewWorkloadUsage(b.db, wi.Device.Id, wi.ProducerPolicy.HAGroup.Partners, "", wi.ConsumerPolicy.Header.Name, workload.Priority.PriorityValue, workload.Priority.RetryDurationS, verifiedDurationS, true, agreementId); err != nil {
+		return errors.New(fmt.Sprintf("error creating persistent workload usage records for device %v with policy %v, error: %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, err))
+	}
+
+	// Artificially bump up the retry count so that the loop will choose the next workload
+	if _, err := UpdateRetryCount(b.db, wi.Device.Id, wi.ConsumerPolicy.Header.Name, workload.Priority.Retries+1, WU_RETRY_REQS_NOT_MET, agreementId); err != nil {
+		return errors.New(fmt.Sprintf("error updating retry count persistent workload usage records for device %v with policy %v, error: %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, err))
+	}
+	return nil
+}
+
+// Returns the workload usage record the workload selection loop in InitiateNewAgreement works from. In observer mode the
+// loop doesn't write the record, so it works from the copy in memory.
+func (b *BaseAgreementWorker) selectionUsage(wi *InitiateAgreement) (*WorkloadUsage, error) {
+	if b.config.AgreementBot.ObserverMode {
+		return wi.observedUsage, nil
+	}
+	return FindSingleWorkloadUsageByDeviceAndPolicyName(b.db, wi.Device.Id, wi.ConsumerPolicy.Header.Name)
+}
+
+// Remove the workload usage record of the device and policy, when the workload selection loop gives up. An agbot in
+// observer mode never writes the record, so there is nothing to remove.
+func (b *BaseAgreementWorker) deleteSelectionUsage(wi *InitiateAgreement, reason string, workerId string) {
+	if b.config.AgreementBot.ObserverMode {
+		return
+	}
+	if err := DeleteWorkloadUsage(b.db, wi.Device.Id, wi.ConsumerPolicy.Header.Name, reason); err != nil {
+		glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("unable to delete workload usage record for %v with %v because %v", wi.Device.Id, wi.ConsumerPolicy.Header.Name, err)))
+	}
+}
+
+// Returns the workload with its deployment overrides replaced by the overrides configured for the device's group, and
+// the name of that group. The input workload is shared with the consumer policy, so the overrides are applied to a copy
+// of it. If no overrides are configured for the device, the input workload and the empty string are returned.
+func (b *BaseAgreementWorker) applyDeploymentOverrides(workload *policy.Workload, deviceId string, producerPolicy *policy.Policy) (*policy.Workload, string, error) {
+
+	if b.config.AgreementBot.DeploymentOverridesFile == "" {
+		return workload, "", nil
+	}
+
+	overrides, err := LoadDeploymentOverrides(b.config.AgreementBot.DeploymentOverridesFile)
+	if err != nil {
+		return workload, "", err
+	}
+
+	if o := MatchDeploymentOverride(overrides, deviceId, producerPolicy); o != nil {
+		glog.V(3).Infof(BAWlogstring(b.workerID, fmt.Sprintf("applying deployment overrides for group %v to workload %v for device %v", o.Group(), workload.WorkloadURL, deviceId)))
+		wl := *workload
+		wl.DeploymentOverrides = o.DeploymentOverrides
+		wl.DeploymentOverridesSignature = o.DeploymentOverridesSignature
+		return &wl, o.Group(), nil
+	}
+	return workload, "", nil
+}
+
+// Record the device group whose deployment overrides were applied on the agreement record.
+func (b *BaseAgreementWorker) persistDeploymentOverridesGroup(cph ConsumerProtocolHandler, agreementId string, group string) error {
+	if group == "" {
+		return nil
+	}
+	_, err := AgreementDeploymentOverrides(b.db, agreementId, group, cph.Name())
+	return err
+}
+
+// Save a redacted copy of the merged producer policy on the agreement record.
+func (b *BaseAgreementWorker) persistProducerPolicy(cph ConsumerProtocolHandler, agreementId string, producerPolicy *policy.Policy) error {
+	if redacted, err := producerPolicy.Redact(); err != nil {
+		return err
+	} else if polBytes, err := json.Marshal(redacted); err != nil {
+		return errors.New(fmt.Sprintf("unable to marshal producer policy %v, error: %v", redacted, err))
+	} else if _, err := AgreementProducerPolicy(b.db, agreementId, string(polBytes), cph.Name()); err != nil {
+		return err
+	}
+	return nil
+}
+
 // Legacy function. Ignore devices that export specificly known configured properties.
 func (b *BaseAgreementWorker) ignoreDevice(pol *policy.Policy) (bool, error) {
 
 	for _, prop := range pol.Properties {
-		if listContains(b.config.AgreementBot.IgnoreContractWithAttribs, prop.Name) {
+		if b.ignoreAttribs.contains(prop.Name) {
 			return true, nil
 		}
 	}
 	return false, nil
 }
+
+// Returns the number of seconds of cooldown configured for the input protocol specific termination reason code. Zero means
+// there is no cooldown for this reason.
+func (b *BaseAgreementWorker) cancelCooldownS(cph ConsumerProtocolHandler, reason uint) int {
+
+	for termReason, seconds := range b.cancelCooldowns {
+		if cph.GetTerminationCode(termReason) == reason {
+			return seconds
+		}
+	}
+	return 0
+}
+
+// Returns the cancel cooldowns configured in CancelCooldownS. The configuration is validated when it is read, so an
+// invalid configuration only occurs when the config is constructed directly, and means no cooldowns.
+func newCancelCooldowns(cfg *config.HorizonConfig) map[string]int {
+	cooldowns, err := cfg.AgreementBot.CancelCooldowns()
+	if err != nil {
+		glog.Errorf(fmt.Sprintf("unable to use cancel cooldown configuration, error: %v", err))
+		return map[string]int{}
+	}
+	return cooldowns
+}
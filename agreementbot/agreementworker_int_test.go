@@ -0,0 +1,784 @@
+// +build integration
+
+package agreementbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/open-horizon/anax/abstractprotocol"
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/events"
+	"github.com/open-horizon/anax/exchange"
+	"github.com/open-horizon/anax/policy"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_InitiateNewAgreement_cancelled(t *testing.T) {
+
+	deviceid := "myorg/an-cancelled"
+	pName := "cancelled policy"
+
+	// The exchange returns a workload the device cant support for the first workload, so that a workload usage record is
+	// created, and shuts down the protocol handler while it is being asked for the second workload.
+	var cph *BasicProtocolHandler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wURL := r.URL.Query().Get("workloadUrl"); wURL == "gps" {
+			json.NewEncoder(w).Encode(unsupportedWorkloadResponse(wURL))
+			return
+		}
+		cph.Shutdown()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	cfg := testInitiateConfig(server.URL)
+	cph = NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+
+	agw := &BaseAgreementWorker{
+		db:         testDb,
+		config:     cfg,
+		alm:        NewAgreementLockManager(),
+		workerID:   "w1",
+		httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+		ctx:        cph.ctx,
+	}
+
+	wi := &InitiateAgreement{
+		ConsumerPolicy: policy.Policy{
+			Header: policy.PolicyHeader{Name: pName},
+			Workloads: []policy.Workload{
+				policy.Workload{WorkloadURL: "gps", Org: "myorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 1, RetryDurationS: 3600}},
+				policy.Workload{WorkloadURL: "cpu", Org: "myorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 2, RetryDurationS: 3600}},
+			},
+		},
+		Org:    "myorg",
+		Device: exchange.SearchResultDevice{Id: deviceid},
+	}
+
+	done := make(chan bool)
+	go func() {
+		agw.InitiateNewAgreement(cph, wi, nil, "w1")
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatalf("InitiateNewAgreement did not return after the protocol handler was shut down")
+	}
+
+	// Neither the workload usage record created for the first workload nor a pending agreement are left behind.
+	if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(testDb, deviceid, pName); err != nil {
+		t.Errorf("Received error finding workload usage: %v", err)
+	} else if wlu != nil {
+		t.Errorf("Workload usage %v should have been removed", wlu)
+	}
+
+	deviceFilter := func(a Agreement) bool { return a.DeviceId == deviceid }
+	if ags, err := FindAgreements(testDb, []AFilter{deviceFilter}, "Basic"); err != nil {
+		t.Errorf("Received error finding agreements: %v", err)
+	} else if len(ags) != 0 {
+		t.Errorf("Agreements %v should not have been created", ags)
+	}
+
+}
+
+func Test_InitiateNewAgreement_max_priorities(t *testing.T) {
+
+	deviceid := "myorg/an-maxprio"
+	pName := "max priorities policy"
+
+	// Every workload requires a microservice that the device doesnt have.
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		json.NewEncoder(w).Encode(unsupportedWorkloadResponse(r.URL.Query().Get("workloadUrl")))
+	}))
+	defer server.Close()
+
+	cfg := testInitiateConfig(server.URL)
+	cfg.AgreementBot.MaxWorkloadPrioritiesTried = 2
+	cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+
+	agw := testInitiateWorker(cfg)
+	wi := testInitiateRequest(deviceid, pName, "wl1", "wl2", "wl3", "wl4")
+
+	agw.InitiateNewAgreement(cph, wi, nil, "w1")
+
+	// Only the first 2 priorities are tried, and the workload usage record created while trying them is removed.
+	if requests != 2 {
+		t.Errorf("expected 2 workload priorities to be tried, got %v", requests)
+	}
+	if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(testDb, deviceid, pName); err != nil {
+		t.Errorf("Received error finding workload usage: %v", err)
+	} else if wlu != nil {
+		t.Errorf("Workload usage %v should have been removed", wlu)
+	}
+
+}
+
+func Test_InitiateNewAgreement_workload_arches(t *testing.T) {
+
+	deviceid := "myorg/an-arches"
+	pName := "workload arches policy"
+
+	// Record the arch of every workload looked up in the exchange.
+	requested := make([]string, 0, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Query().Get("arch"))
+		json.NewEncoder(w).Encode(unsupportedWorkloadResponse(r.URL.Query().Get("workloadUrl")))
+	}))
+	defer server.Close()
+
+	cfg := testInitiateConfig(server.URL)
+	cfg.AgreementBot.WorkloadArches = "amd64"
+	cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+
+	agw := &BaseAgreementWorker{
+		db:         testDb,
+		config:     cfg,
+		alm:        NewAgreementLockManager(),
+		workerID:   "w1",
+		httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+	}
+
+	wi := &InitiateAgreement{
+		ConsumerPolicy: policy.Policy{
+			Header: policy.PolicyHeader{Name: pName},
+			Workloads: []policy.Workload{
+				policy.Workload{WorkloadURL: "gps", Org: "myorg", Version: "1.0.0", Arch: "arm", Priority: policy.WorkloadPriority{PriorityValue: 1, RetryDurationS: 3600}},
+				policy.Workload{WorkloadURL: "gps", Org: "myorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 2, RetryDurationS: 3600}},
+			},
+		},
+		Org:    "myorg",
+		Device: exchange.SearchResultDevice{Id: deviceid},
+	}
+
+	agw.InitiateNewAgreement(cph, wi, nil, "w1")
+
+	// The arm workload is skipped without looking it up, and the next priority is tried.
+	if len(requested) != 1 || requested[0] != "amd64" {
+		t.Errorf("expected only the amd64 workload to be tried, got arches %v", requested)
+	}
+
+}
+
+func Test_InitiateNewAgreement_workload_orgs(t *testing.T) {
+
+	deviceid := "myorg/an-orgs"
+	pName := "workload orgs policy"
+
+	// Record the path of every workload looked up in the exchange, it contains the org of the workload.
+	requested := make([]string, 0, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		json.NewEncoder(w).Encode(unsupportedWorkloadResponse(r.URL.Query().Get("workloadUrl")))
+	}))
+	defer server.Close()
+
+	cfg := testInitiateConfig(server.URL)
+	cfg.AgreementBot.WorkloadOrgs = "myorg"
+	cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+
+	agw := &BaseAgreementWorker{
+		db:         testDb,
+		config:     cfg,
+		alm:        NewAgreementLockManager(),
+		workerID:   "w1",
+		httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+	}
+
+	wi := &InitiateAgreement{
+		ConsumerPolicy: policy.Policy{
+			Header: policy.PolicyHeader{Name: pName},
+			Workloads: []policy.Workload{
+				policy.Workload{WorkloadURL: "gps", Org: "otherorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 1, RetryDurationS: 3600}},
+				policy.Workload{WorkloadURL: "gps", Org: "myorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 2, RetryDurationS: 3600}},
+			},
+		},
+		Org:    "myorg",
+		Device: exchange.SearchResultDevice{Id: deviceid},
+	}
+
+	agw.InitiateNewAgreement(cph, wi, nil, "w1")
+
+	// The otherorg workload is skipped without looking it up, and the next priority is tried.
+	if len(requested) != 1 || requested[0] != "/orgs/myorg/workloads" {
+		t.Errorf("expected only the myorg workload to be tried, got %v", requested)
+	}
+
+}
+
+func Test_InitiateNewAgreement_denied_version(t *testing.T) {
+
+	deviceid := "myorg/an-denied"
+	pName := "denied version policy"
+
+	// Record the version of every workload looked up in the exchange.
+	requested := make([]string, 0, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Query().Get("version"))
+		json.NewEncoder(w).Encode(unsupportedWorkloadResponse(r.URL.Query().Get("workloadUrl")))
+	}))
+	defer server.Close()
+
+	cfg := testInitiateConfig(server.URL)
+	cfg.AgreementBot.DeniedWorkloadVersions = "gps@2.0.0"
+	cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+
+	agw := &BaseAgreementWorker{
+		db:         testDb,
+		config:     cfg,
+		alm:        NewAgreementLockManager(),
+		workerID:   "w1",
+		httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+	}
+
+	wi := &InitiateAgreement{
+		ConsumerPolicy: policy.Policy{
+			Header: policy.PolicyHeader{Name: pName},
+			Workloads: []policy.Workload{
+				policy.Workload{WorkloadURL: "gps", Org: "myorg", Version: "2.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 1, RetryDurationS: 3600}},
+				policy.Workload{WorkloadURL: "gps", Org: "myorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 2, RetryDurationS: 3600}},
+			},
+		},
+		Org:    "myorg",
+		Device: exchange.SearchResultDevice{Id: deviceid},
+	}
+
+	agw.InitiateNewAgreement(cph, wi, nil, "w1")
+
+	// The denied version is skipped without looking it up, and the next priority is tried.
+	if len(requested) != 1 || !strings.HasPrefix(requested[0], "1.0.0") {
+		t.Errorf("expected only version 1.0.0 to be tried, got versions %v", requested)
+	}
+
+}
+
+func Test_InitiateNewAgreement_deadline(t *testing.T) {
+
+	deviceid := "myorg/an-deadline"
+	pName := "deadline policy"
+
+	// A slow exchange, every workload lookup takes longer than the deadline.
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		time.Sleep(1200 * time.Millisecond)
+		json.NewEncoder(w).Encode(unsupportedWorkloadResponse(r.URL.Query().Get("workloadUrl")))
+	}))
+	defer server.Close()
+
+	cfg := testInitiateConfig(server.URL)
+	cfg.AgreementBot.InitiateDeadlineS = 1
+	cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+
+	agw := &BaseAgreementWorker{
+		db:         testDb,
+		config:     cfg,
+		alm:        NewAgreementLockManager(),
+		workerID:   "w1",
+		httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+	}
+
+	workloads := make([]policy.Workload, 0, 3)
+	for _, p := range []int{1, 2, 3} {
+		workloads = append(workloads, policy.Workload{WorkloadURL: fmt.Sprintf("wl%v", p), Org: "myorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: p, RetryDurationS: 3600}})
+	}
+	wi := &InitiateAgreement{
+		ConsumerPolicy: policy.Policy{Header: policy.PolicyHeader{Name: pName}, Workloads: workloads},
+		Org:            "myorg",
+		Device:         exchange.SearchResultDevice{Id: deviceid},
+	}
+
+	agw.InitiateNewAgreement(cph, wi, nil, "w1")
+
+	// Selection is abandoned once the deadline passes, and the workload usage record created while trying is removed.
+	if requests != 1 {
+		t.Errorf("expected 1 workload to be tried before the deadline, got %v", requests)
+	}
+	if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(testDb, deviceid, pName); err != nil {
+		t.Errorf("Received error finding workload usage: %v", err)
+	} else if wlu != nil {
+		t.Errorf("Workload usage %v should have been removed", wlu)
+	}
+
+}
+
+func Test_InitiateNewAgreement_missing_microservice(t *testing.T) {
+
+	// The device has not registered the microservices that any of the workloads require.
+	for action, expected := range map[string]int{config.MissingMicroserviceSkip: 2, config.MissingMicroserviceFail: 1} {
+		deviceid := "myorg/an-missingms-" + action
+		pName := "missing microservice policy " + action
+
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/nodes/") {
+				json.NewEncoder(w).Encode(exchange.GetDevicesResponse{Devices: map[string]exchange.Device{deviceid: exchange.Device{}}})
+				return
+			}
+			requests += 1
+			json.NewEncoder(w).Encode(unsupportedWorkloadResponse(r.URL.Query().Get("workloadUrl")))
+		}))
+
+		cfg := testInitiateConfig(server.URL)
+		cfg.AgreementBot.MissingMicroserviceAction = action
+		cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+
+		agw := testInitiateWorker(cfg)
+		wi := testInitiateRequest(deviceid, pName, "gps", "cpu")
+		wi.ConsumerPolicy.PatternId = "myorg/mypattern"
+
+		agw.InitiateNewAgreement(cph, wi, nil, "w1")
+		server.Close()
+
+		// Skipping tries the next workload, failing gives up after the first one.
+		if requests != expected {
+			t.Errorf("expected %v workloads to be tried with action %v, got %v", expected, action, requests)
+		}
+		if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(testDb, deviceid, pName); err != nil {
+			t.Errorf("Received error finding workload usage: %v", err)
+		} else if wlu != nil {
+			t.Errorf("Workload usage %v should have been removed with action %v", wlu, action)
+		}
+	}
+
+}
+
+func Test_InitiateNewAgreement_cancel_cooldown(t *testing.T) {
+
+	deviceid := "myorg/an-cooldown"
+	pName := "cooldown initiate policy"
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests += 1
+		json.NewEncoder(w).Encode(unsupportedWorkloadResponse(r.URL.Query().Get("workloadUrl")))
+	}))
+	defer server.Close()
+
+	cfg := testInitiateConfig(server.URL)
+	cfg.AgreementBot.CancelCooldownS = TERM_REASON_NEGATIVE_REPLY + ":600"
+	cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+
+	agw := &BaseAgreementWorker{
+		db:              testDb,
+		config:          cfg,
+		alm:             NewAgreementLockManager(),
+		workerID:        "w1",
+		httpClient:      cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+		cancelCooldowns: newCancelCooldowns(cfg),
+	}
+
+	// The cooldown configured for the cancel reason is used when the agreement is cancelled.
+	reason := cph.GetTerminationCode(TERM_REASON_NEGATIVE_REPLY)
+	cooldown := agw.cancelCooldownS(cph, reason)
+	if cooldown != 600 {
+		t.Errorf("expected a cooldown of 600 seconds, got %v", cooldown)
+	} else if err := NewCancelCooldown(testDb, deviceid, pName, reason, cooldown); err != nil {
+		t.Fatalf("Received error creating cooldown: %v", err)
+	}
+
+	wi := &InitiateAgreement{
+		ConsumerPolicy: policy.Policy{
+			Header:    policy.PolicyHeader{Name: pName},
+			Workloads: []policy.Workload{policy.Workload{WorkloadURL: "gps", Org: "myorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 1, RetryDurationS: 3600}}},
+		},
+		Org:    "myorg",
+		Device: exchange.SearchResultDevice{Id: deviceid},
+	}
+
+	agw.InitiateNewAgreement(cph, wi, nil, "w1")
+
+	// The device is skipped before any workload is tried.
+	if requests != 0 {
+		t.Errorf("expected the device in cooldown to be skipped, got %v exchange requests", requests)
+	}
+	if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(testDb, deviceid, pName); err != nil {
+		t.Errorf("Received error finding workload usage: %v", err)
+	} else if wlu != nil {
+		t.Errorf("Workload usage %v should not have been created", wlu)
+	}
+
+	deviceFilter := func(a Agreement) bool { return a.DeviceId == deviceid }
+	if ags, err := FindAgreements(testDb, []AFilter{deviceFilter}, "Basic"); err != nil {
+		t.Errorf("Received error finding agreements: %v", err)
+	} else if len(ags) != 0 {
+		t.Errorf("Agreements %v should not have been created", ags)
+	}
+
+}
+
+func Test_InitiateNewAgreement_blacklist(t *testing.T) {
+
+	blacklisted := "myorg/an-blacklisted"
+	counted := "myorg/an-invalid-reply"
+	pName := "blacklist initiate policy"
+
+	requested := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested[r.URL.Query().Get("workloadUrl")] += 1
+		json.NewEncoder(w).Encode(unsupportedWorkloadResponse(r.URL.Query().Get("workloadUrl")))
+	}))
+	defer server.Close()
+
+	cfg := testInitiateConfig(server.URL)
+	cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+
+	agw := &BaseAgreementWorker{
+		db:         testDb,
+		config:     cfg,
+		alm:        NewAgreementLockManager(),
+		workerID:   "w1",
+		httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+	}
+
+	// Other tests list the blacklisted devices, so dont leave these behind.
+	defer testDb.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(DEVICE_BLACKLIST)); b != nil {
+			b.Delete([]byte(blacklisted))
+			b.Delete([]byte(counted))
+		}
+		return nil
+	})
+
+	// One device reached the threshold of invalid replies, the other has sent an invalid reply but is below it.
+	if _, ok, err := RecordInvalidReply(testDb, blacklisted, 1, 600); err != nil || !ok {
+		t.Fatalf("expected device %v to be blacklisted, blacklisted %v, error: %v", blacklisted, ok, err)
+	} else if _, ok, err := RecordInvalidReply(testDb, counted, 2, 600); err != nil || ok {
+		t.Fatalf("expected device %v not to be blacklisted, blacklisted %v, error: %v", counted, ok, err)
+	}
+
+	for deviceid, wURL := range map[string]string{blacklisted: "blwl", counted: "countedwl"} {
+		wi := &InitiateAgreement{
+			ConsumerPolicy: policy.Policy{
+				Header:    policy.PolicyHeader{Name: pName},
+				Workloads: []policy.Workload{policy.Workload{WorkloadURL: wURL, Org: "myorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 1, RetryDurationS: 3600}}},
+			},
+			Org:    "myorg",
+			Device: exchange.SearchResultDevice{Id: deviceid},
+		}
+		agw.InitiateNewAgreement(cph, wi, nil, "w1")
+	}
+
+	// The blacklisted device is skipped before any workload is tried, the other device is not.
+	if requested["blwl"] != 0 {
+		t.Errorf("expected the blacklisted device to be skipped, got %v exchange requests", requested["blwl"])
+	} else if requested["countedwl"] == 0 {
+		t.Errorf("expected a workload to be tried for the device below the threshold")
+	}
+
+	deviceFilter := func(a Agreement) bool { return a.DeviceId == blacklisted }
+	if ags, err := FindAgreements(testDb, []AFilter{deviceFilter}, "Basic"); err != nil {
+		t.Errorf("Received error finding agreements: %v", err)
+	} else if len(ags) != 0 {
+		t.Errorf("Agreements %v should not have been created", ags)
+	}
+
+}
+
+func Test_InitiateNewAgreement_deployment_overrides(t *testing.T) {
+
+	pName := "deployment overrides policy"
+
+	// The exchange returns a workload that every device supports.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wURL := r.URL.Query().Get("workloadUrl")
+		json.NewEncoder(w).Encode(exchange.GetWorkloadsResponse{Workloads: map[string]exchange.WorkloadDefinition{
+			"myorg/" + wURL: exchange.WorkloadDefinition{WorkloadURL: wURL, Version: "1.0.0", Arch: "amd64", Workloads: []exchange.WorkloadDeployment{exchange.WorkloadDeployment{}}},
+		}})
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "overrides-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "overrides.json")
+	if err := ioutil.WriteFile(path, []byte(`[{"org":"org1","deployment_overrides":"overrides1","deployment_overrides_signature":"sig1"},{"org":"org2","deployment_overrides":"overrides2","deployment_overrides_signature":"sig2"}]`), 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testInitiateConfig(server.URL)
+	cfg.AgreementBot.DeploymentOverridesFile = path
+	cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+
+	agw := &BaseAgreementWorker{
+		db:         testDb,
+		config:     cfg,
+		alm:        NewAgreementLockManager(),
+		workerID:   "w1",
+		httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+	}
+
+	// The work items of all the devices share the workloads of the consumer policy, as they do when they are made from
+	// the policy manager's policies.
+	workloads := []policy.Workload{
+		policy.Workload{WorkloadURL: "cpu", Org: "myorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 1, RetryDurationS: 3600}},
+	}
+
+	for deviceid, group := range map[string]string{"org1/an-overrides": "org1", "org2/an-overrides": "org2", "org3/an-overrides": ""} {
+		wi := &InitiateAgreement{
+			ConsumerPolicy: policy.Policy{Header: policy.PolicyHeader{Name: pName}, Workloads: workloads},
+			Org:            exchange.GetOrg(deviceid),
+			Device:         exchange.SearchResultDevice{Id: deviceid},
+		}
+
+		agw.InitiateNewAgreement(cph, wi, nil, "w1")
+
+		// Each device gets the overrides of its own group, and the shared workload is not changed.
+		deviceFilter := func(a Agreement) bool { return a.DeviceId == deviceid }
+		if ags, err := FindAgreements(testDb, []AFilter{deviceFilter}, "Basic"); err != nil {
+			t.Errorf("Received error finding agreements: %v", err)
+		} else if len(ags) != 1 || ags[0].DeploymentOverridesGroup != group {
+			t.Errorf("expected 1 agreement with device %v using the overrides of group %q, got %v", deviceid, group, ags)
+		}
+		if workloads[0].DeploymentOverrides != "" || workloads[0].DeploymentOverridesSignature != "" {
+			t.Errorf("deployment overrides for device %v were applied to the shared workload %v", deviceid, workloads[0])
+		}
+	}
+
+}
+
+func Test_InitiateNewAgreement_observer_mode(t *testing.T) {
+
+	pName := "observer policy"
+	existing := "myorg/an-observed-wlu"
+	fresh := "myorg/an-observed"
+
+	// The device doesnt support the first workload, and supports the second.
+	requested := make([]string, 0, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wURL := r.URL.Query().Get("workloadUrl")
+		requested = append(requested, wURL)
+		if wURL == "gps" {
+			json.NewEncoder(w).Encode(unsupportedWorkloadResponse(wURL))
+			return
+		}
+		json.NewEncoder(w).Encode(exchange.GetWorkloadsResponse{Workloads: map[string]exchange.WorkloadDefinition{
+			"myorg/" + wURL: exchange.WorkloadDefinition{WorkloadURL: wURL, Version: "1.0.0", Arch: "amd64", Workloads: []exchange.WorkloadDeployment{exchange.WorkloadDeployment{}}},
+		}})
+	}))
+	defer server.Close()
+
+	cfg := testInitiateConfig(server.URL)
+	cfg.AgreementBot.ObserverMode = true
+	cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+
+	agw := &BaseAgreementWorker{
+		db:         testDb,
+		config:     cfg,
+		alm:        NewAgreementLockManager(),
+		workerID:   "w1",
+		httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+	}
+
+	if err := NewWorkloadUsage(testDb, existing, nil, "", pName, 1, 3600, 0, false, "an-observed-agid"); err != nil {
+		t.Fatalf("Received error creating workload usage: %v", err)
+	}
+	before, err := FindSingleWorkloadUsageByDeviceAndPolicyName(testDb, existing, pName)
+	if err != nil {
+		t.Fatalf("Received error finding workload usage: %v", err)
+	}
+
+	for _, deviceid := range []string{existing, fresh} {
+		requested = requested[:0]
+		wi := &InitiateAgreement{
+			ConsumerPolicy: policy.Policy{
+				Header: policy.PolicyHeader{Name: pName},
+				Workloads: []policy.Workload{
+					policy.Workload{WorkloadURL: "gps", Org: "myorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 1, Retries: 2, RetryDurationS: 3600}},
+					policy.Workload{WorkloadURL: "cpu", Org: "myorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 2, Retries: 2, RetryDurationS: 3600}},
+				},
+			},
+			Org:    "myorg",
+			Device: exchange.SearchResultDevice{Id: deviceid},
+		}
+
+		agw.InitiateNewAgreement(cph, wi, nil, "w1")
+
+		// The unsupported workload is skipped in memory and the next priority is chosen.
+		if strings.Join(requested, ",") != "gps,cpu" {
+			t.Errorf("expected workloads gps and cpu to be tried for device %v, got %v", deviceid, requested)
+		} else if Observations.Observe(deviceid, pName, &policy.Workload{WorkloadURL: "cpu", Version: "1.0.0", Arch: "amd64"}) {
+			t.Errorf("expected the agreement with device %v for workload cpu to have been observed", deviceid)
+		}
+
+		// Nothing is written to the database.
+		deviceFilter := func(a Agreement) bool { return a.DeviceId == deviceid }
+		if ags, err := FindAgreements(testDb, []AFilter{deviceFilter}, "Basic"); err != nil {
+			t.Errorf("Received error finding agreements: %v", err)
+		} else if len(ags) != 0 {
+			t.Errorf("Agreements %v should not have been created", ags)
+		}
+		if sel, err := FindWorkloadSelection(testDb, deviceid, pName); err != nil {
+			t.Errorf("Received error finding workload selection: %v", err)
+		} else if sel != nil {
+			t.Errorf("Workload selection %v should not have been recorded", sel)
+		}
+	}
+
+	if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(testDb, existing, pName); err != nil {
+		t.Errorf("Received error finding workload usage: %v", err)
+	} else if !reflect.DeepEqual(wlu, before) {
+		t.Errorf("expected workload usage %v to be unchanged, got %v", before, wlu)
+	}
+	if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(testDb, fresh, pName); err != nil {
+		t.Errorf("Received error finding workload usage: %v", err)
+	} else if wlu != nil {
+		t.Errorf("Workload usage %v should not have been created", wlu)
+	}
+
+}
+
+func Test_HandleDataReceivedAck_data_verification(t *testing.T) {
+
+	cfg := testInitiateConfig("http://localhost")
+	cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+
+	// For each action, the expected data notification and unexpected ack count of an agreement with data verification
+	// enabled, then disabled.
+	for action, expected := range map[string][2]bool{
+		"":                             [2]bool{true, true},
+		config.UnexpectedDataAckIgnore: [2]bool{true, false},
+		config.UnexpectedDataAckFlag:   [2]bool{true, false},
+	} {
+		cfg.AgreementBot.UnexpectedDataAckAction = action
+		agw := &BaseAgreementWorker{db: testDb, config: cfg, alm: NewAgreementLockManager(), workerID: "w1"}
+
+		for i, dvEnabled := range []bool{true, false} {
+			agid := fmt.Sprintf("dataack-%v-%v", action, dvEnabled)
+			if err := AgreementAttempt(testDb, agid, "myorg", "myorg/dataackdev", "dataack policy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+				t.Fatalf("Received error creating agreement: %v", err)
+			} else if _, err := AgreementUpdate(testDb, agid, "", "", policy.DataVerification{Enabled: dvEnabled}, 0, "", "", "Basic", 1); err != nil {
+				t.Fatalf("Received error updating agreement: %v", err)
+			}
+
+			ack, _ := json.Marshal(abstractprotocol.NewDataReceivedAck("Basic", 1, agid))
+			agw.HandleDataReceivedAck(cph, &HandleDataReceivedAck{workType: DATARECEIVEDACK, Ack: string(ack)}, "w1")
+
+			ag, err := FindSingleAgreementByAgreementId(testDb, agid, "Basic", []AFilter{})
+			if err != nil || ag == nil {
+				t.Fatalf("Received error finding agreement %v: %v", agid, err)
+			} else if recorded := ag.DataNotificationSent != 0; recorded != expected[i] {
+				t.Errorf("Expected data notification recorded %v for action %q with data verification %v, got %v", expected[i], action, dvEnabled, recorded)
+			}
+
+			flagged := uint64(0)
+			if action == config.UnexpectedDataAckFlag && !dvEnabled {
+				flagged = 1
+			}
+			if ag.UnexpectedDataAcks != flagged {
+				t.Errorf("Expected %v unexpected data acks for action %q with data verification %v, got %v", flagged, action, dvEnabled, ag.UnexpectedDataAcks)
+			}
+		}
+	}
+
+}
+
+func Test_HandleAgreementReply_invalid_replies(t *testing.T) {
+
+	late := "myorg/late-reply"
+	wrong := "myorg/wrong-sender"
+
+	cfg := testInitiateConfig("http://localhost")
+	cfg.AgreementBot.InvalidReplyThreshold = 1
+	cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+	agw := &BaseAgreementWorker{db: testDb, config: cfg, alm: NewAgreementLockManager(), workerID: "w1"}
+
+	// Other tests list the blacklisted devices, so dont leave these behind.
+	defer testDb.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(DEVICE_BLACKLIST)); b != nil {
+			b.Delete([]byte(late))
+			b.Delete([]byte(wrong))
+		}
+		return nil
+	})
+
+	// The device replies after its agreement was archived, e.g. because the proposal timed out.
+	if err := AgreementAttempt(testDb, "latereply", "myorg", late, "reply policy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+		t.Fatalf("Received error creating agreement: %v", err)
+	} else if _, err := ArchiveAgreement(testDb, "latereply", "Basic", 0, "", ""); err != nil {
+		t.Fatalf("Received error archiving agreement: %v", err)
+	}
+
+	// The other device replies to an agreement made with another device.
+	if err := AgreementAttempt(testDb, "wrongsender", "myorg", "myorg/other-device", "reply policy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+		t.Fatalf("Received error creating agreement: %v", err)
+	}
+
+	for agid, deviceid := range map[string]string{"latereply": late, "wrongsender": wrong} {
+		reply := abstractprotocol.NewProposalReply("Basic", 1, agid, deviceid)
+		reply.AcceptProposal()
+		agw.HandleAgreementReply(cph, &HandleReply{workType: REPLY, Reply: reply, SenderId: deviceid}, "w1")
+	}
+
+	// Only the reply that is invalid because of the device is counted against it.
+	if bl, err := FindActiveDeviceBlacklist(testDb, late); err != nil || bl != nil {
+		t.Errorf("expected the late reply not to be counted, blacklist %v, error: %v", bl, err)
+	} else if bl, err := FindActiveDeviceBlacklist(testDb, wrong); err != nil || bl == nil {
+		t.Errorf("expected the reply from the wrong device to be counted, blacklist %v, error: %v", bl, err)
+	}
+
+}
+
+// An agbot config for workers that use the exchange at the input URL.
+func testInitiateConfig(exchangeURL string) *config.HorizonConfig {
+	return &config.HorizonConfig{
+		AgreementBot: config.AGConfig{ExchangeURL: exchangeURL + "/", AgreementWorkers: 1},
+		Collaborators: config.Collaborators{
+			HTTPClientFactory: &config.HTTPClientFactory{
+				NewHTTPClient: func(overrideTimeoutS *uint) *http.Client { return &http.Client{Timeout: 30 * time.Second} },
+			},
+		},
+	}
+}
+
+// A worker that chooses workloads with the input config.
+func testInitiateWorker(cfg *config.HorizonConfig) *BaseAgreementWorker {
+	return &BaseAgreementWorker{
+		db:         testDb,
+		config:     cfg,
+		alm:        NewAgreementLockManager(),
+		workerID:   "w1",
+		httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+	}
+}
+
+// A request to make an agreement with the device for a policy with the input amd64 workloads, highest priority first.
+func testInitiateRequest(deviceid string, pName string, workloadURLs ...string) *InitiateAgreement {
+	workloads := make([]policy.Workload, 0, len(workloadURLs))
+	for i, wURL := range workloadURLs {
+		workloads = append(workloads, policy.Workload{WorkloadURL: wURL, Org: "myorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: i + 1, RetryDurationS: 3600}})
+	}
+	return &InitiateAgreement{
+		ConsumerPolicy: policy.Policy{Header: policy.PolicyHeader{Name: pName}, Workloads: workloads},
+		Org:            "myorg",
+		Device:         exchange.SearchResultDevice{Id: deviceid},
+	}
+}
+
+// An exchange response for a workload that requires a microservice that the test devices dont have.
+func unsupportedWorkloadResponse(wURL string) exchange.GetWorkloadsResponse {
+	return exchange.GetWorkloadsResponse{Workloads: map[string]exchange.WorkloadDefinition{
+		"myorg/" + wURL: exchange.WorkloadDefinition{
+			WorkloadURL: wURL,
+			Version:     "1.0.0",
+			Arch:        "amd64",
+			APISpecs:    []exchange.APISpec{exchange.APISpec{SpecRef: wURL + "ms", Org: "myorg", Version: "1.0.0", Arch: "amd64"}},
+			Workloads:   []exchange.WorkloadDeployment{exchange.WorkloadDeployment{}},
+		},
+	}}
+}
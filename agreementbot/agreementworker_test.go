@@ -0,0 +1,132 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/events"
+	"github.com/open-horizon/anax/exchange"
+	"github.com/open-horizon/anax/policy"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_listContains_normalized(t *testing.T) {
+
+	for _, list := range []string{"ethereum_account", "ethereum_account ", " Ethereum_Account", "other, ETHEREUM_ACCOUNT ,more"} {
+		if !listContains(list, "ethereum_account") {
+			t.Errorf("expected list %q to contain ethereum_account", list)
+		} else if !listContains(list, " ethereum_account") {
+			t.Errorf("expected list %q to contain the untrimmed target", list)
+		}
+	}
+
+	for _, list := range []string{"", " ", "ethereum", "ethereum_account_2", ","} {
+		if listContains(list, "ethereum_account") {
+			t.Errorf("expected list %q not to contain ethereum_account", list)
+		}
+	}
+
+	if listContains("a,,b", "") {
+		t.Errorf("an empty entry should not match an empty target")
+	}
+}
+
+func Test_ignoreDevice(t *testing.T) {
+
+	b := &BaseAgreementWorker{ignoreAttribs: newListSet(" Ethereum_Account , other")}
+
+	pol := &policy.Policy{Properties: policy.PropertyList{{Name: "ram", Value: 1024}, {Name: "ethereum_account", Value: "0x1"}}}
+	if ignore, err := b.ignoreDevice(pol); err != nil || !ignore {
+		t.Errorf("expected the device to be ignored, got %v %v", ignore, err)
+	}
+
+	pol = &policy.Policy{Properties: policy.PropertyList{{Name: "ram", Value: 1024}}}
+	if ignore, err := b.ignoreDevice(pol); err != nil || ignore {
+		t.Errorf("expected the device not to be ignored, got %v %v", ignore, err)
+	}
+
+	// A worker without the config ignores nothing.
+	b = &BaseAgreementWorker{}
+	pol = &policy.Policy{Properties: policy.PropertyList{{Name: "ethereum_account", Value: "0x1"}}}
+	if ignore, err := b.ignoreDevice(pol); err != nil || ignore {
+		t.Errorf("expected the device not to be ignored, got %v %v", ignore, err)
+	}
+}
+
+func Test_retryDBWrite(t *testing.T) {
+
+	b := &BaseAgreementWorker{}
+
+	// A write that fails once is retried until it succeeds.
+	calls := 0
+	if err := b.retryDBWrite("w1", "test write", func() error {
+		calls += 1
+		if calls == 1 {
+			return errors.New("transient")
+		}
+		return nil
+	}); err != nil || calls != 2 {
+		t.Errorf("expected success after 2 calls, got %v calls and error %v", calls, err)
+	}
+
+	// A write that keeps failing is given up on after the configured retries, returning the last error.
+	calls = 0
+	if err := b.retryDBWrite("w1", "test write", func() error {
+		calls += 1
+		return errors.New("persistent")
+	}); err == nil || err.Error() != "persistent" || calls != DB_WRITE_RETRIES+1 {
+		t.Errorf("expected %v calls and the persistent error, got %v calls and error %v", DB_WRITE_RETRIES+1, calls, err)
+	}
+}
+
+func Test_incompleteHAGroup_quorum(t *testing.T) {
+
+	// Partners p1 and p2 are registered in the exchange, p3 and p4 are not.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		devs := exchange.GetDevicesResponse{Devices: map[string]exchange.Device{}}
+		for _, id := range []string{"p1", "p2"} {
+			if strings.HasSuffix(r.URL.Path, "/nodes/"+id) {
+				devs.Devices["myorg/"+id] = exchange.Device{}
+			}
+		}
+		json.NewEncoder(w).Encode(devs)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		partners []string
+		quorum   int
+		ok       bool
+	}{
+		{"full", []string{"myorg/p1", "myorg/p2"}, 0, true},
+		{"full with a missing partner", []string{"myorg/p1", "myorg/p3"}, 0, false},
+		{"quorum met", []string{"myorg/p1", "myorg/p2", "myorg/p3"}, 60, true},
+		{"quorum not met", []string{"myorg/p1", "myorg/p3", "myorg/p4"}, 60, false},
+	}
+
+	for _, test := range tests {
+		cfg := &config.HorizonConfig{
+			AgreementBot: config.AGConfig{ExchangeURL: server.URL + "/", HAPartnerQuorumPercent: test.quorum},
+			Collaborators: config.Collaborators{
+				HTTPClientFactory: &config.HTTPClientFactory{
+					NewHTTPClient: func(overrideTimeoutS *uint) *http.Client { return &http.Client{Timeout: 30 * time.Second} },
+				},
+			},
+		}
+		cph := NewBasicProtocolHandler("Basic", cfg, nil, nil, make(chan events.Message, 10))
+		agw := &BaseAgreementWorker{config: cfg, workerID: "w1", httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil)}
+
+		pol := &policy.Policy{HAGroup: policy.HighAvailabilityGroup{Partners: test.partners}}
+		if err := agw.incompleteHAGroup(context.Background(), cph, pol); (err == nil) != test.ok {
+			t.Errorf("%v: expected the HA group to be complete %v, got error %v", test.name, test.ok, err)
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"sort"
+	"time"
 )
 
 type API struct {
@@ -93,10 +94,21 @@ func (a *API) listen(apiListen string) {
 	go func() {
 		router := mux.NewRouter()
 
-		router.HandleFunc("/agreement", a.agreement).Methods("GET", "OPTIONS")
+		router.HandleFunc("/agreement", a.agreement).Methods("GET", "DELETE", "OPTIONS")
+		router.HandleFunc("/agreement/reconcile", a.agreementReconcile).Methods("POST", "OPTIONS")
 		router.HandleFunc("/agreement/{id}", a.agreement).Methods("GET", "DELETE", "OPTIONS")
+		router.HandleFunc("/agreement/{id}/trace", a.agreementTrace).Methods("GET", "POST", "DELETE", "OPTIONS")
+		router.HandleFunc("/agreement/{id}/pause", a.agreementPause).Methods("POST", "DELETE", "OPTIONS")
+		router.HandleFunc("/device/{org}/{id}/agreements", a.deviceAgreements).Methods("DELETE", "OPTIONS")
 		router.HandleFunc("/policy/{name}/upgrade", a.policyUpgrade).Methods("POST", "OPTIONS")
 		router.HandleFunc("/workloadusage", a.workloadusage).Methods("GET", "OPTIONS")
+		router.HandleFunc("/workloadusage/reset", a.workloadusageReset).Methods("POST", "OPTIONS")
+		router.HandleFunc("/workloadusage/churn", a.workloadusageChurn).Methods("GET", "OPTIONS")
+		router.HandleFunc("/blacklist", a.blacklist).Methods("GET", "OPTIONS")
+		router.HandleFunc("/diagnosis", a.diagnosis).Methods("GET", "OPTIONS")
+		router.HandleFunc("/health", a.health).Methods("GET", "OPTIONS")
+		router.HandleFunc("/deferredcancels", a.deferredCancels).Methods("GET", "OPTIONS")
+		router.HandleFunc("/deferredcancels/flush", a.deferredCancelsFlush).Methods("POST", "OPTIONS")
 
 		http.ListenAndServe(apiListen, nocache(router))
 	}()
@@ -140,8 +152,24 @@ func (a *API) agreement(w http.ResponseWriter, r *http.Request) {
 			wrap[agreementsKey][archivedKey] = []Agreement{}
 			wrap[agreementsKey][activeKey] = []Agreement{}
 
+			// The paused query parameter restricts the output to the agreements whose governance is paused, and the query
+			// parameter to the agreements a bulk cancel with the same agreement query would cancel, so that it can be
+			// previewed.
+			filters := []AFilter{}
+			if r.URL.Query().Get("paused") == "true" {
+				filters = append(filters, PausedAFilter())
+			}
+			if query := r.URL.Query().Get("query"); query != "" {
+				if filter, err := ParseAgreementQuery(query, uint64(time.Now().Unix())); err != nil {
+					writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "query", Error: err.Error()})
+					return
+				} else {
+					filters = append(filters, CancellableAFilter(), filter)
+				}
+			}
+
 			for _, agp := range policy.AllAgreementProtocols() {
-				if ags, err := FindAgreements(a.db, []AFilter{}, agp); err != nil {
+				if ags, err := FindAgreements(a.db, filters, agp); err != nil {
 					glog.Error(APIlogString(fmt.Sprintf("error finding all agreements, error: %v", err)))
 					http.Error(w, "Internal server error", http.StatusInternalServerError)
 					return
@@ -182,8 +210,9 @@ func (a *API) agreement(w http.ResponseWriter, r *http.Request) {
 		pathVars := mux.Vars(r)
 		id := pathVars["id"]
 
+		// Without an agreement id, cancel all agreements matched by the query parameters, on all devices.
 		if id == "" {
-			w.WriteHeader(http.StatusBadRequest)
+			a.cancelMatchingAgreements(w, r)
 			return
 		}
 		glog.V(3).Infof(APIlogString(fmt.Sprintf("handling DELETE of agreement: %v", r)))
@@ -199,7 +228,7 @@ func (a *API) agreement(w http.ResponseWriter, r *http.Request) {
 				if _, err := AgreementTimedout(a.db, ag.CurrentAgreementId, ag.AgreementProtocol); err != nil {
 					glog.Errorf(APIlogString(fmt.Sprintf("error marking agreement %v terminated: %v", ag.CurrentAgreementId, err)))
 				}
-				a.Messages() <- events.NewABApiAgreementCancelationMessage(events.AGREEMENT_ENDED, ag.AgreementProtocol, ag.CurrentAgreementId)
+				a.Messages() <- events.NewABApiAgreementCancelationMessage(events.AGREEMENT_ENDED, ag.AgreementProtocol, ag.CurrentAgreementId, r.URL.Query().Get("reason"))
 			} else {
 				glog.V(3).Infof(APIlogString(fmt.Sprintf("agreement %v not deleted, already timed out at %v", id, ag.AgreementTimedout)))
 			}
@@ -214,6 +243,200 @@ func (a *API) agreement(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Cancel the agreements matched by the agreement query in the query parameter, or else the agreements for the workload
+// identified by the workload_url query parameter, and the optional version and arch query parameters. The optional reason
+// query parameter is recorded on the cancelled agreements. The response is the list of ids of the agreements being cancelled.
+func (a *API) cancelMatchingAgreements(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("query")
+	url := r.URL.Query().Get("workload_url")
+	version := r.URL.Query().Get("version")
+	arch := r.URL.Query().Get("arch")
+	reason := r.URL.Query().Get("reason")
+
+	var filter AFilter
+	matching := ""
+	if query != "" && (url != "" || version != "" || arch != "") {
+		writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "query", Error: "query cannot be combined with workload_url, version or arch"})
+		return
+	} else if query != "" {
+		if f, err := ParseAgreementQuery(query, uint64(time.Now().Unix())); err != nil {
+			writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "query", Error: err.Error()})
+			return
+		} else {
+			filter = f
+			matching = fmt.Sprintf("query %v", query)
+		}
+	} else if url != "" {
+		filter = WorkloadAFilter(url, version, arch)
+		matching = fmt.Sprintf("workload %v version %v arch %v", url, version, arch)
+	} else {
+		writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "workload_url", Error: "agreement id, workload_url or query must be specified"})
+		return
+	}
+	glog.V(3).Infof(APIlogString(fmt.Sprintf("handling DELETE of agreements for %v", matching)))
+
+	ids := make([]string, 0, 10)
+	cancelled, err := CancelAgreements(a.db, filter, func(ag Agreement) {
+		a.Messages() <- events.NewABApiAgreementCancelationMessage(events.AGREEMENT_ENDED, ag.AgreementProtocol, ag.CurrentAgreementId, reason)
+	})
+	for _, ag := range cancelled {
+		ids = append(ids, ag.CurrentAgreementId)
+	}
+	if err != nil {
+		glog.Errorf(APIlogString(fmt.Sprintf("error cancelling agreements for %v, cancelled %v, error: %v", matching, ids, err)))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	glog.V(3).Infof(APIlogString(fmt.Sprintf("cancelling agreements %v for %v", ids, matching)))
+
+	if serial, err := json.Marshal(ids); err != nil {
+		glog.Errorf(APIlogString(fmt.Sprintf("error serializing cancelled agreements %v, error: %v", ids, err)))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(serial); err != nil {
+			glog.Infof(APIlogString(fmt.Sprintf("error writing response %v, error: %v", serial, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+	}
+}
+
+// Start, return or stop the trace of the decisions made for an agreement.
+func (a *API) agreementTrace(w http.ResponseWriter, r *http.Request) {
+	pathVars := mux.Vars(r)
+	id := pathVars["id"]
+
+	switch r.Method {
+	case "GET":
+		if trace, err := FindAgreementTrace(a.db, id); err != nil {
+			glog.Error(APIlogString(fmt.Sprintf("error finding trace of agreement %v, error: %v", id, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else if trace == nil {
+			writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "id", Error: "agreement is not being traced"})
+		} else if serial, err := json.Marshal(*trace); err != nil {
+			glog.Errorf(APIlogString(fmt.Sprintf("error serializing agreement trace output %v, error: %v", *trace, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write(serial); err != nil {
+				glog.Infof(APIlogString(fmt.Sprintf("error writing response %v, error: %v", serial, err)))
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}
+
+	case "POST":
+		glog.V(3).Infof(APIlogString(fmt.Sprintf("starting trace of agreement %v", id)))
+		if ag, err := FindSingleAgreementByAgreementIdAllProtocols(a.db, id, policy.AllAgreementProtocols(), []AFilter{}); err != nil {
+			glog.Error(APIlogString(fmt.Sprintf("error finding agreement %v, error: %v", id, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else if ag == nil {
+			writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "id", Error: "agreement id not found"})
+		} else if err := TraceAgreement(a.db, id); err != nil {
+			glog.Error(APIlogString(fmt.Sprintf("error starting trace of agreement %v, error: %v", id, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+
+	case "DELETE":
+		glog.V(3).Infof(APIlogString(fmt.Sprintf("stopping trace of agreement %v", id)))
+		if err := DeleteAgreementTrace(a.db, id); err != nil {
+			glog.Error(APIlogString(fmt.Sprintf("error deleting trace of agreement %v, error: %v", id, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+
+	case "OPTIONS":
+		w.Header().Set("Allow", "GET, POST, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Pause or resume governance of an active agreement.
+func (a *API) agreementPause(w http.ResponseWriter, r *http.Request) {
+	pathVars := mux.Vars(r)
+	id := pathVars["id"]
+
+	switch r.Method {
+	case "POST", "DELETE":
+		paused := r.Method == "POST"
+		glog.V(3).Infof(APIlogString(fmt.Sprintf("setting paused to %v for agreement %v", paused, id)))
+		ag, err := FindSingleAgreementByAgreementIdAllProtocols(a.db, id, policy.AllAgreementProtocols(), []AFilter{UnarchivedAFilter()})
+		if err == nil && ag != nil {
+			// Hold the agreement lock while checking and changing the agreement, so that the change is serialized with
+			// the agreement workers and governance, and check the agreement again under the lock.
+			if alm := WQMetrics.AgreementLocks(ag.AgreementProtocol); alm != nil {
+				lock := alm.getAgreementLock(id)
+				lock.Lock()
+				defer lock.Unlock()
+			}
+			ag, err = FindSingleAgreementByAgreementId(a.db, id, ag.AgreementProtocol, []AFilter{UnarchivedAFilter()})
+		}
+
+		if err != nil {
+			glog.Error(APIlogString(fmt.Sprintf("error finding agreement %v, error: %v", id, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else if ag == nil {
+			writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "id", Error: "agreement id not found"})
+		} else if ag.AgreementFinalizedTime == 0 || ag.AgreementTimedout != 0 {
+			writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "id", Error: "agreement is not active"})
+		} else if _, err := PauseAgreement(a.db, id, ag.AgreementProtocol, paused); err != nil {
+			glog.Error(APIlogString(fmt.Sprintf("error setting paused to %v for agreement %v, error: %v", paused, id, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+
+	case "OPTIONS":
+		w.Header().Set("Allow", "POST, DELETE, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Cancel all agreements with a device, in all agreement protocols. The agreements are cancelled by the agbot worker after
+// the response is sent, the number cancelled in each protocol is logged. The optional reason query parameter is recorded
+// on the cancelled agreements.
+func (a *API) deviceAgreements(w http.ResponseWriter, r *http.Request) {
+	pathVars := mux.Vars(r)
+	id := fmt.Sprintf("%v/%v", pathVars["org"], pathVars["id"])
+
+	switch r.Method {
+	case "DELETE":
+		glog.V(3).Infof(APIlogString(fmt.Sprintf("handling DELETE of agreements with device %v", id)))
+		a.Messages() <- events.NewABApiDeviceCancelationMessage(events.DEVICE_AGREEMENTS_CANCEL, id, r.URL.Query().Get("reason"))
+		w.WriteHeader(http.StatusOK)
+
+	case "OPTIONS":
+		w.Header().Set("Allow", "DELETE, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Reconcile the agreements with the agbot's agreement records in the exchange. The reconciliation is done by the agbot
+// worker after the response is sent, its repairs are logged.
+func (a *API) agreementReconcile(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case "POST":
+		glog.V(3).Infof(APIlogString(fmt.Sprintf("requesting reconciliation of agreements with the exchange")))
+		a.Messages() <- events.NewABApiReconcileAgreementsMessage(events.RECONCILE_AGREEMENTS)
+		w.WriteHeader(http.StatusOK)
+
+	case "OPTIONS":
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
 func (a *API) policyUpgrade(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
@@ -238,7 +461,7 @@ func (a *API) policyUpgrade(w http.ResponseWriter, r *http.Request) {
 		}
 
 		workloadResolver := func(wURL string, wOrg string, wVersion string, wArch string) (*policy.APISpecList, error) {
-			asl, _, err := exchange.WorkloadResolver(a.Config.Collaborators.HTTPClientFactory, wURL, wOrg, wVersion, wArch, a.Config.AgreementBot.ExchangeURL, a.Config.AgreementBot.ExchangeId, a.Config.AgreementBot.ExchangeToken)
+			asl, _, err := exchange.WorkloadResolver(a.Config.Collaborators.HTTPClientFactory, wURL, wOrg, wVersion, wArch, a.Config.AgreementBot.GetExchangeURL(wOrg), a.Config.AgreementBot.ExchangeId, a.Config.AgreementBot.ExchangeToken)
 			if err != nil {
 				glog.Errorf(APIlogString(fmt.Sprintf("unable to resolve workload, error %v", err)))
 			}
@@ -322,13 +545,42 @@ func (a *API) workloadusage(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "GET":
-		if wlusages, err := FindWorkloadUsages(a.db, []WUFilter{}); err != nil {
-			glog.Error(APIlogString(fmt.Sprintf("error finding all workload usages, error: %v", err)))
+		// The device and policy query parameters restrict the output to a single device, and optionally one of its policies.
+		device := r.URL.Query().Get("device")
+		policyName := r.URL.Query().Get("policy")
+		if device == "" && policyName != "" {
+			writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "policy", Error: "policy can only be specified with device"})
+			return
+		}
+
+		var wlusages []WorkloadUsage
+		var err error
+		if device != "" {
+			wlusages, err = FindWorkloadUsagesForDevice(a.db, device, policyName)
+		} else {
+			wlusages, err = FindWorkloadUsages(a.db, []WUFilter{})
+		}
+
+		if err != nil {
+			glog.Error(APIlogString(fmt.Sprintf("error finding workload usages, error: %v", err)))
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 		} else {
 
+			// The exhausted query parameter restricts the output to the records that block new agreements.
+			if r.URL.Query().Get("exhausted") == "true" {
+				exhausted := make([]WorkloadUsage, 0, len(wlusages))
+				for _, wlu := range wlusages {
+					if ExhaustedWUFilter()(wlu) {
+						exhausted = append(exhausted, wlu)
+					}
+				}
+				wlusages = exhausted
+			}
+
 			// do sort
-			sort.Sort(WorkloadUsagesByDeviceId(wlusages))
+			if device == "" {
+				sort.Sort(WorkloadUsagesByDeviceId(wlusages))
+			}
 
 			serial, err := json.Marshal(wlusages)
 			if err != nil {
@@ -353,6 +605,92 @@ func (a *API) workloadusage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (a *API) workloadusageReset(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case "POST":
+		device := r.URL.Query().Get("device")
+		policyName := r.URL.Query().Get("policy")
+		if device == "" {
+			writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "device", Error: "device must be specified"})
+			return
+		} else if policyName == "" {
+			writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "policy", Error: "policy must be specified"})
+			return
+		}
+
+		glog.V(3).Infof(APIlogString(fmt.Sprintf("resetting workload usage for device %v with policy %v", device, policyName)))
+		if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(a.db, device, policyName); err != nil {
+			glog.Error(APIlogString(fmt.Sprintf("error finding workload usage for device %v with policy %v, error: %v", device, policyName, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else if wlu == nil {
+			writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "device", Error: "workload usage not found"})
+		} else if _, err := ResetWUExhausted(a.db, device, policyName); err != nil {
+			glog.Error(APIlogString(fmt.Sprintf("error resetting workload usage for device %v with policy %v, error: %v", device, policyName, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+
+	case "OPTIONS":
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Return the counts of the creates, updates and deletes of the workload usage records since the agbot started.
+func (a *API) workloadusageChurn(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case "GET":
+		churn := WUMetrics.Snapshot()
+		if serial, err := json.Marshal(churn); err != nil {
+			glog.Errorf(APIlogString(fmt.Sprintf("error serializing workload usage churn output %v, error: %v", churn, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write(serial); err != nil {
+				glog.Infof(APIlogString(fmt.Sprintf("error writing response %v, error: %v", serial, err)))
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}
+
+	case "OPTIONS":
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *API) blacklist(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case "GET":
+		if devices, err := FindBlacklistedDevices(a.db); err != nil {
+			glog.Error(APIlogString(fmt.Sprintf("error finding blacklisted devices, error: %v", err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else if serial, err := json.Marshal(devices); err != nil {
+			glog.Errorf(APIlogString(fmt.Sprintf("error serializing blacklist output %v, error: %v", devices, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write(serial); err != nil {
+				glog.Infof(APIlogString(fmt.Sprintf("error writing response %v, error: %v", serial, err)))
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}
+
+	case "OPTIONS":
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
 // ==========================================================================================
 // Utility functions used by many of the API endpoints.
 //
@@ -436,3 +774,124 @@ func (b *UpgradeDevice) IsValid() (bool, string) {
 	}
 	return true, ""
 }
+
+func (a *API) diagnosis(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case "GET":
+		device := r.URL.Query().Get("device")
+		policyName := r.URL.Query().Get("policy")
+		if device == "" {
+			writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "device", Error: "device must be specified"})
+			return
+		} else if policyName == "" {
+			writeInputErr(w, http.StatusBadRequest, &APIUserInputError{Input: "policy", Error: "policy must be specified"})
+			return
+		}
+
+		if d, err := DiagnoseDevice(a.db, &a.Config.AgreementBot, device, policyName); err != nil {
+			glog.Error(APIlogString(fmt.Sprintf("error diagnosing device %v with policy %v, error: %v", device, policyName, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else if serial, err := json.Marshal(d); err != nil {
+			glog.Errorf(APIlogString(fmt.Sprintf("error serializing diagnosis output %v, error: %v", d, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write(serial); err != nil {
+				glog.Infof(APIlogString(fmt.Sprintf("error writing response %v, error: %v", serial, err)))
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}
+
+	case "OPTIONS":
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Return the depth and lag of the agreement work queues. The response is always 200, the status in the body says whether
+// the agreement workers are degraded, so that a probe can tell a slow agbot from one that does not respond at all.
+func (a *API) health(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case "GET":
+		health := WQMetrics.Health(a.Config.AgreementBot.WorkQueueDegradedDepth, a.Config.AgreementBot.WorkQueueDegradedAgeS, time.Now())
+		health.ExchangeCredentials = ExchangeCredentials.Status()
+		if health.ExchangeCredentials.Paused {
+			health.Status = WORK_HEALTH_DEGRADED
+		}
+		if serial, err := json.Marshal(health); err != nil {
+			glog.Errorf(APIlogString(fmt.Sprintf("error serializing health output %v, error: %v", health, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write(serial); err != nil {
+				glog.Infof(APIlogString(fmt.Sprintf("error writing response %v, error: %v", serial, err)))
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}
+
+	case "OPTIONS":
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *API) deferredCancels(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case "GET":
+		cancels := make(map[string][]DeferredCancel)
+		for protocol, q := range DeferredCancelQueues.Queues() {
+			cancels[protocol] = q.DeferredCancels()
+		}
+		if serial, err := json.Marshal(cancels); err != nil {
+			glog.Errorf(APIlogString(fmt.Sprintf("error serializing deferred cancels output %v, error: %v", cancels, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write(serial); err != nil {
+				glog.Infof(APIlogString(fmt.Sprintf("error writing response %v, error: %v", serial, err)))
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}
+
+	case "OPTIONS":
+		w.Header().Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *API) deferredCancelsFlush(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case "POST":
+		flushed := make(map[string]int)
+		for protocol, q := range DeferredCancelQueues.Queues() {
+			flushed[protocol] = q.FlushDeferredCancels()
+		}
+		glog.V(3).Infof(APIlogString(fmt.Sprintf("flushed deferred cancels %v", flushed)))
+		if serial, err := json.Marshal(flushed); err != nil {
+			glog.Errorf(APIlogString(fmt.Sprintf("error serializing flushed deferred cancels output %v, error: %v", flushed, err)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write(serial); err != nil {
+				glog.Infof(APIlogString(fmt.Sprintf("error writing response %v, error: %v", serial, err)))
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+		}
+
+	case "OPTIONS":
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
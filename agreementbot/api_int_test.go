@@ -0,0 +1,58 @@
+// +build integration
+
+package agreementbot
+
+import (
+	"encoding/json"
+	"github.com/open-horizon/anax/events"
+	"github.com/open-horizon/anax/policy"
+	"github.com/open-horizon/anax/worker"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// The agreements listed for a query are the ones a delete with the same query cancels.
+func Test_agreement_query_preview(t *testing.T) {
+
+	for _, agid := range []string{"preview1", "preview2", "preview3"} {
+		if err := AgreementAttempt(testDb, agid, "previeworg", "previeworg/"+agid, "preview policy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+			t.Fatalf("Received error creating agreement: %v", err)
+		}
+	}
+
+	// One agreement is being terminated, another one is archived already.
+	if _, err := AgreementTimedout(testDb, "preview2", "Basic"); err != nil {
+		t.Fatalf("Received error timing out agreement: %v", err)
+	} else if _, err := ArchiveAgreement(testDb, "preview3", "Basic", 0, "", ""); err != nil {
+		t.Fatalf("Received error archiving agreement: %v", err)
+	}
+
+	a := &API{Manager: worker.Manager{Messages: make(chan events.Message, 10)}, db: testDb}
+	params := "?query=" + url.QueryEscape("org=previeworg")
+
+	w := httptest.NewRecorder()
+	a.agreement(w, httptest.NewRequest("GET", "/agreement"+params, nil))
+
+	var listed map[string]map[string][]Agreement
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %v, was %v", http.StatusOK, w.Code)
+	} else if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("error demarshalling the agreements: %v", err)
+	} else if active, archived := listed["agreements"]["active"], listed["agreements"]["archived"]; len(active) != 1 || active[0].CurrentAgreementId != "preview1" || len(archived) != 0 {
+		t.Errorf("expected only agreement preview1 to be listed, got %v", listed)
+	}
+
+	w = httptest.NewRecorder()
+	a.agreement(w, httptest.NewRequest("DELETE", "/agreement"+params, nil))
+
+	var cancelled []string
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %v, was %v", http.StatusOK, w.Code)
+	} else if err := json.Unmarshal(w.Body.Bytes(), &cancelled); err != nil {
+		t.Fatalf("error demarshalling the cancelled agreements: %v", err)
+	} else if len(cancelled) != 1 || cancelled[0] != "preview1" {
+		t.Errorf("expected only agreement preview1 to be cancelled, got %v", cancelled)
+	}
+}
@@ -0,0 +1,94 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The agreements to cancel are matched either by a query or by a workload, never by both, and nothing is cancelled
+// when the request is rejected.
+func Test_cancelMatchingAgreements_input(t *testing.T) {
+
+	a := &API{}
+	for params, input := range map[string]string{
+		"":                                    "workload_url",
+		"?version=1.0.0":                      "workload_url",
+		"?query=org%3Dmyorg%20and":            "query",
+		"?query=org%3Dmyorg&workload_url=cpu": "query",
+		"?query=org%3Dmyorg&version=1.0.0":    "query",
+		"?query=org%3Dmyorg&arch=amd64":       "query",
+	} {
+		w := httptest.NewRecorder()
+		a.cancelMatchingAgreements(w, httptest.NewRequest("DELETE", "/agreement"+params, nil))
+
+		var inputErr APIUserInputError
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %v for %v, was %v", http.StatusBadRequest, params, w.Code)
+		} else if err := json.Unmarshal(w.Body.Bytes(), &inputErr); err != nil {
+			t.Errorf("error demarshalling the response to %v: %v", params, err)
+		} else if inputErr.Input != input {
+			t.Errorf("expected %v to be rejected for input %v, was %v", params, input, inputErr)
+		}
+	}
+}
+
+// A deferred cancel queue that records the flushes.
+type testDeferredCancels struct {
+	cancels []DeferredCancel
+}
+
+func (q *testDeferredCancels) DeferredCancels() []DeferredCancel {
+	return q.cancels
+}
+
+func (q *testDeferredCancels) FlushDeferredCancels() int {
+	flushed := len(q.cancels)
+	q.cancels = nil
+	return flushed
+}
+
+// The deferred cancels of every protocol are listed, and flushing them reports the number of cancels flushed.
+func Test_deferredCancels(t *testing.T) {
+
+	saved := DeferredCancelQueues
+	defer func() { DeferredCancelQueues = saved }()
+	DeferredCancelQueues = NewDeferredCancelRegistry()
+
+	q := &testDeferredCancels{cancels: []DeferredCancel{{AgreementId: "a1", Reason: 200, AgeS: 30}}}
+	DeferredCancelQueues.Track("Citizen Scientist", q)
+
+	a := &API{}
+	w := httptest.NewRecorder()
+	a.deferredCancels(w, httptest.NewRequest("GET", "/deferredcancels", nil))
+
+	var cancels map[string][]DeferredCancel
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %v, was %v", http.StatusOK, w.Code)
+	} else if err := json.Unmarshal(w.Body.Bytes(), &cancels); err != nil {
+		t.Errorf("error demarshalling the deferred cancels: %v", err)
+	} else if l := cancels["Citizen Scientist"]; len(l) != 1 || l[0].AgreementId != "a1" || l[0].Reason != 200 {
+		t.Errorf("expected the deferred cancel of agreement a1, got %v", cancels)
+	}
+
+	w = httptest.NewRecorder()
+	a.deferredCancelsFlush(w, httptest.NewRequest("POST", "/deferredcancels/flush", nil))
+
+	var flushed map[string]int
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %v, was %v", http.StatusOK, w.Code)
+	} else if err := json.Unmarshal(w.Body.Bytes(), &flushed); err != nil {
+		t.Errorf("error demarshalling the flushed deferred cancels: %v", err)
+	} else if flushed["Citizen Scientist"] != 1 || len(q.cancels) != 0 {
+		t.Errorf("expected one deferred cancel to be flushed, got %v", flushed)
+	}
+
+	w = httptest.NewRecorder()
+	a.deferredCancelsFlush(w, httptest.NewRequest("GET", "/deferredcancels/flush", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %v, was %v", http.StatusMethodNotAllowed, w.Code)
+	}
+}
@@ -22,12 +22,14 @@ func NewBasicAgreementWorker(c *BasicProtocolHandler, cfg *config.HorizonConfig,
 
 	p := &BasicAgreementWorker{
 		BaseAgreementWorker: &BaseAgreementWorker{
-			pm:         pm,
-			db:         db,
-			config:     cfg,
-			alm:        alm,
-			workerID:   uuid.NewV4().String(),
-			httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+			pm:              pm,
+			db:              db,
+			config:          cfg,
+			alm:             alm,
+			workerID:        uuid.NewV4().String(),
+			httpClient:      cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+			ignoreAttribs:   newListSet(cfg.AgreementBot.IgnoreContractWithAttribs),
+			cancelCooldowns: newCancelCooldowns(cfg),
 		},
 		protocolHandler: c,
 	}
@@ -69,9 +71,16 @@ func (b BAgreementVerification) String() string {
 // to actually work through the agreement protocol.
 func (a *BasicAgreementWorker) start(work chan AgreementWork, random *rand.Rand) {
 
+	WQMetrics.WorkerStarted(a.protocolHandler.Name())
+	defer WQMetrics.WorkerStopped(a.protocolHandler.Name())
+
 	for {
 		glog.V(5).Infof(bwlogstring(a.workerID, fmt.Sprintf("blocking for work")))
-		workItem := <-work // block waiting for work
+		workItem, ok := a.waitForWork(a.protocolHandler.Name(), work) // block waiting for work
+		if !ok {
+			glog.V(3).Infof(bwlogstring(a.workerID, fmt.Sprintf("exiting, worker pool is shrinking")))
+			return
+		}
 		glog.V(2).Infof(bwlogstring(a.workerID, fmt.Sprintf("received work: %v", workItem)))
 
 		if workItem.Type() == INITIATE {
@@ -99,7 +108,7 @@ func (a *BasicAgreementWorker) start(work chan AgreementWork, random *rand.Rand)
 
 		} else if workItem.Type() == CANCEL {
 			wi := workItem.(CancelAgreement)
-			a.CancelAgreementWithLock(a.protocolHandler, wi.AgreementId, wi.Reason, a.workerID)
+			a.CancelAgreementWithLock(a.protocolHandler, wi.AgreementId, wi.Reason, wi.OperatorReason, a.workerID)
 
 		} else if workItem.Type() == WORKLOAD_UPGRADE {
 			// upgrade a workload on a device
@@ -108,7 +117,15 @@ func (a *BasicAgreementWorker) start(work chan AgreementWork, random *rand.Rand)
 
 		} else if workItem.Type() == ASYNC_CANCEL {
 			wi := workItem.(AsyncCancelAgreement)
-			a.ExternalCancel(a.protocolHandler, wi.AgreementId, wi.Reason, a.workerID)
+			a.ExternalCancel(a.protocolHandler, wi, a.workerID)
+
+		} else if workItem.Type() == ASYNC_ARCHIVE {
+			wi := workItem.(AsyncArchiveAgreement)
+			a.ExternalArchive(a.protocolHandler, wi.AgreementId, wi.Reason, wi.OperatorReason, a.workerID)
+
+		} else if workItem.Type() == REEVALUATE_PROPOSAL {
+			wi := workItem.(ReevaluateProposal)
+			a.ReevaluateProposalWithLock(a.protocolHandler, wi.AgreementId, a.workerID)
 
 		} else if workItem.Type() == AGREEMENT_VERIFICATION {
 			wi := workItem.(BAgreementVerification)
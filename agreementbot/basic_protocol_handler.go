@@ -1,6 +1,7 @@
 package agreementbot
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
@@ -25,20 +26,25 @@ type BasicProtocolHandler struct {
 
 func NewBasicProtocolHandler(name string, cfg *config.HorizonConfig, db *bolt.DB, pm *policy.PolicyManager, messages chan events.Message) *BasicProtocolHandler {
 	if name == basicprotocol.PROTOCOL_NAME {
+		ctx, cancel := context.WithCancel(context.Background())
+		httpClient := cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil)
 		return &BasicProtocolHandler{
 			BaseConsumerProtocolHandler: &BaseConsumerProtocolHandler{
 				name:             name,
 				pm:               pm,
 				db:               db,
 				config:           cfg,
-				httpClient:       cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+				httpClient:       httpClient,
 				agbotId:          cfg.AgreementBot.ExchangeId,
 				token:            cfg.AgreementBot.ExchangeToken,
+				alm:              NewAgreementLockManager(),
 				deferredCommands: nil,
 				messages:         messages,
+				ctx:              ctx,
+				cancel:           cancel,
 			},
-			agreementPH: basicprotocol.NewProtocolHandler(cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil), pm),
-			Work:        make(chan AgreementWork),
+			agreementPH: basicprotocol.NewProtocolHandler(httpClient, pm),
+			Work:        NewAgreementWorkQueue(cfg),
 		}
 	} else {
 		return nil
@@ -59,13 +65,32 @@ func (c *BasicProtocolHandler) Initialize() {
 	// Set up random number gen. This is used to generate agreement id strings.
 	random := rand.New(rand.NewSource(int64(time.Now().Nanosecond())))
 
-	// Setup a lock to protect concurrent agreement processing
-	agreementLockMgr := NewAgreementLockManager()
-
-	// Set up agreement worker pool based on the current technical config.
-	for ix := 0; ix < c.config.AgreementBot.AgreementWorkers; ix++ {
-		agw := NewBasicAgreementWorker(c, c.config, c.db, c.pm, agreementLockMgr)
-		go agw.start(c.Work, random)
+	// Report the agreement locks in use with the state of the work queue, and let the API list and flush the deferred cancels.
+	WQMetrics.TrackLocks(c.Name(), c.alm)
+	DeferredCancelQueues.Track(c.Name(), c)
+
+	// All the workers of this protocol share one webhook for agreement lifecycle notifications, if one is configured.
+	webhook := NewAgreementWebhook(c.config)
+
+	// Set up agreement worker pool based on the current technical config. All the workers share the agreement lock manager
+	// of the protocol handler, so that agreement locking is unaffected by workers coming and going, and by governance.
+	if DynamicAgreementWorkers(c.config) {
+		var pool *AgreementWorkerPool
+		pool = NewAgreementWorkerPool(c.Name(), c.config.AgreementBot.AgreementWorkers, c.config.AgreementBot.MaxAgreementWorkers, c.Work, func() {
+			agw := NewBasicAgreementWorker(c, c.config, c.db, c.pm, c.alm)
+			agw.pool = pool
+			agw.webhook = webhook
+			agw.ctx = c.ctx
+			go agw.start(c.Work, random)
+		})
+		pool.Start(c.ctx.Done())
+	} else {
+		for ix := 0; ix < c.config.AgreementBot.AgreementWorkers; ix++ {
+			agw := NewBasicAgreementWorker(c, c.config, c.db, c.pm, c.alm)
+			agw.webhook = webhook
+			agw.ctx = c.ctx
+			go agw.start(c.Work, random)
+		}
 	}
 
 }
@@ -154,8 +179,10 @@ func (c *BasicProtocolHandler) GetTerminationCode(reason string) uint {
 		return basicprotocol.AB_CANCEL_NODE_HEARTBEAT
 	case TERM_REASON_AG_MISSING:
 		return basicprotocol.AB_CANCEL_AG_MISSING
+	case TERM_REASON_PROPOSAL_TIMEOUT:
+		return basicprotocol.AB_CANCEL_PROPOSAL_TIMEOUT
 	default:
-		return 999
+		return TERM_CODE_UNMAPPED
 	}
 }
 
@@ -163,6 +190,11 @@ func (c *BasicProtocolHandler) GetTerminationReason(code uint) string {
 	return basicprotocol.DecodeReasonCode(uint64(code))
 }
 
+// The basic protocol has a single version.
+func (c *BasicProtocolHandler) NegotiatedProtocolVersion(producerPolicy *policy.Policy, consumerPolicy *policy.Policy) int {
+	return basicprotocol.PROTOCOL_CURRENT_VERSION
+}
+
 func (c *BasicProtocolHandler) SetBlockchainWritable(ev *events.AccountFundedMessage) {
 	return
 }
@@ -175,8 +207,25 @@ func (c *BasicProtocolHandler) CanCancelNow(ag *Agreement) bool {
 	return true
 }
 
+// The basic protocol cancels agreements without a blockchain, so the deferred blockchain cancels are discarded. The other
+// deferred commands are queued for the workers.
 func (c *BasicProtocolHandler) HandleDeferredCommands() {
-	return
+	cmds := c.BaseConsumerProtocolHandler.GetDeferredCommands()
+	for _, aw := range cmds {
+		if aw.Type() == ASYNC_CANCEL {
+			continue
+		}
+		queueWork(c, aw)
+		glog.V(5).Infof(BsCPHlogString(fmt.Sprintf("queued deferred agreement work %v for a basic worker", aw)))
+	}
+}
+
+// The basic protocol has no blockchain to cancel on, so the deferred blockchain cancels are discarded as they would be
+// by HandleDeferredCommands. Returns the number of cancels discarded.
+func (c *BasicProtocolHandler) FlushDeferredCancels() int {
+	cancels := c.BaseConsumerProtocolHandler.takeDeferredCancels()
+	glog.V(3).Infof(BsCPHlogString(fmt.Sprintf("discarded %v deferred cancels", len(cancels))))
+	return len(cancels)
 }
 
 func (b *BasicProtocolHandler) PostReply(agreementId string, proposal abstractprotocol.Proposal, reply abstractprotocol.ProposalReply, consumerPolicy *policy.Policy, org string, workerId string) error {
@@ -202,7 +251,7 @@ func (b *BasicProtocolHandler) HandleExtensionMessage(cmd *NewProtocolMessageCom
 			SenderPubKey: cmd.PubKey,
 			MessageId:    cmd.MessageId,
 		}
-		b.WorkQueue() <- agreementWork
+		queueWork(b, agreementWork)
 		glog.V(5).Infof(BsCPHlogString(fmt.Sprintf("queued agreement verify message")))
 
 	} else {
@@ -0,0 +1,152 @@
+package agreementbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+	"time"
+)
+
+const DEVICE_BLACKLIST = "device_blacklist"
+
+// A device blacklist record counts the consecutive invalid agreement replies received from a device. When the count
+// reaches the configured threshold, the device is blacklisted and is not offered new agreements until the blacklist
+// expires. A valid reply resets the count.
+type DeviceBlacklist struct {
+	DeviceId         string `json:"device_id"`         // the device id that sent the invalid replies
+	InvalidReplies   int    `json:"invalid_replies"`   // the number of consecutive invalid replies since the last valid reply or blacklisting
+	LastInvalidTime  uint64 `json:"last_invalid_time"` // time when the last invalid reply was received
+	BlacklistedTime  uint64 `json:"blacklisted_time"`  // time when the device was last blacklisted, zero if it never was
+	BlacklistedUntil uint64 `json:"blacklisted_until"` // time when the blacklist expires, zero if the device was never blacklisted
+}
+
+func (d DeviceBlacklist) String() string {
+	return fmt.Sprintf("DeviceId: %v, "+
+		"InvalidReplies: %v, "+
+		"LastInvalidTime: %v, "+
+		"BlacklistedTime: %v, "+
+		"BlacklistedUntil: %v",
+		d.DeviceId, d.InvalidReplies, d.LastInvalidTime, d.BlacklistedTime, d.BlacklistedUntil)
+}
+
+func (d *DeviceBlacklist) Blacklisted() bool {
+	return d.BlacklistedUntil > uint64(time.Now().Unix())
+}
+
+// Count an invalid reply from the device. When the count reaches the threshold, the device is blacklisted for durationS
+// seconds and the count starts over. Returns the updated record and true if the device was blacklisted by this reply.
+func RecordInvalidReply(db *bolt.DB, deviceId string, threshold int, durationS int) (*DeviceBlacklist, bool, error) {
+	if deviceId == "" || threshold <= 0 || durationS <= 0 {
+		return nil, false, errors.New("Illegal input: one of deviceId, threshold or durationS is empty")
+	}
+
+	var record *DeviceBlacklist
+	blacklisted := false
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(DEVICE_BLACKLIST))
+		if err != nil {
+			return err
+		}
+
+		d := DeviceBlacklist{DeviceId: deviceId}
+		if v := b.Get([]byte(deviceId)); v != nil {
+			if err := json.Unmarshal(v, &d); err != nil {
+				return fmt.Errorf("Unable to deserialize device blacklist db record: %v", v)
+			}
+		}
+
+		now := uint64(time.Now().Unix())
+		d.InvalidReplies += 1
+		d.LastInvalidTime = now
+		if d.InvalidReplies >= threshold {
+			d.InvalidReplies = 0
+			d.BlacklistedTime = now
+			d.BlacklistedUntil = now + uint64(durationS)
+			blacklisted = true
+		}
+		record = &d
+		return putDeviceBlacklist(b, &d)
+	})
+
+	if err != nil {
+		return nil, false, err
+	}
+	return record, blacklisted, nil
+}
+
+// Reset the count of invalid replies from the device, because it sent a valid reply. An active blacklist is not lifted.
+func ResetInvalidReplies(db *bolt.DB, deviceId string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(DEVICE_BLACKLIST)); b == nil {
+			return nil
+		} else if v := b.Get([]byte(deviceId)); v == nil {
+			return nil
+		} else {
+			var d DeviceBlacklist
+			if err := json.Unmarshal(v, &d); err != nil {
+				return fmt.Errorf("Unable to deserialize device blacklist db record: %v", v)
+			} else if d.Blacklisted() {
+				if d.InvalidReplies == 0 {
+					return nil
+				}
+				d.InvalidReplies = 0
+				return putDeviceBlacklist(b, &d)
+			} else {
+				return b.Delete([]byte(deviceId))
+			}
+		}
+	})
+}
+
+// Returns the device's blacklist record if the device is currently blacklisted, or nil if it is not.
+func FindActiveDeviceBlacklist(db *bolt.DB, deviceId string) (*DeviceBlacklist, error) {
+	var active *DeviceBlacklist
+	readErr := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(DEVICE_BLACKLIST)); b != nil {
+			if v := b.Get([]byte(deviceId)); v != nil {
+				var d DeviceBlacklist
+				if err := json.Unmarshal(v, &d); err != nil {
+					glog.Errorf("Unable to deserialize device blacklist db record: %v", v)
+				} else if d.Blacklisted() {
+					active = &d
+				}
+			}
+		}
+		return nil // end the transaction
+	})
+	return active, readErr
+}
+
+// Returns the records of all the devices that are currently blacklisted.
+func FindBlacklistedDevices(db *bolt.DB) ([]DeviceBlacklist, error) {
+	devices := make([]DeviceBlacklist, 0, 5)
+	readErr := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(DEVICE_BLACKLIST)); b != nil {
+			b.ForEach(func(k, v []byte) error {
+				var d DeviceBlacklist
+				if err := json.Unmarshal(v, &d); err != nil {
+					glog.Errorf("Unable to deserialize device blacklist db record: %v", v)
+				} else if d.Blacklisted() {
+					devices = append(devices, d)
+				}
+				return nil
+			})
+		}
+		return nil // end the transaction
+	})
+	return devices, readErr
+}
+
+func putDeviceBlacklist(b *bolt.Bucket, d *DeviceBlacklist) error {
+	if bytes, err := json.Marshal(d); err != nil {
+		return fmt.Errorf("Unable to serialize device blacklist record %v. Error: %v", d, err)
+	} else if err := b.Put([]byte(d.DeviceId), bytes); err != nil {
+		return fmt.Errorf("Unable to write device blacklist record %v to bucket %v", d, DEVICE_BLACKLIST)
+	} else {
+		glog.V(3).Infof("Succeeded writing device blacklist record %v", d)
+		return nil
+	}
+}
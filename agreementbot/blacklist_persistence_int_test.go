@@ -0,0 +1,45 @@
+// +build integration
+
+package agreementbot
+
+import (
+	"testing"
+)
+
+func Test_DeviceBlacklist_lifecycle(t *testing.T) {
+
+	deviceid := "myorg/blacklisted"
+
+	// The count is reset by a valid reply.
+	if _, blacklisted, err := RecordInvalidReply(testDb, deviceid, 2, 60); err != nil || blacklisted {
+		t.Errorf("Expected first invalid reply to not blacklist, blacklisted %v, error: %v", blacklisted, err)
+	} else if err := ResetInvalidReplies(testDb, deviceid); err != nil {
+		t.Errorf("Received error resetting invalid replies: %v", err)
+	} else if bl, blacklisted, err := RecordInvalidReply(testDb, deviceid, 2, 60); err != nil || blacklisted || bl.InvalidReplies != 1 {
+		t.Errorf("Expected the count to start over, got %v, blacklisted %v, error: %v", bl, blacklisted, err)
+	}
+
+	// The threshold blacklists the device.
+	if bl, blacklisted, err := RecordInvalidReply(testDb, deviceid, 2, 60); err != nil || !blacklisted {
+		t.Errorf("Expected the device to be blacklisted, got %v, error: %v", bl, err)
+	} else if bl.InvalidReplies != 0 || !bl.Blacklisted() {
+		t.Errorf("Unexpected blacklist record %v", bl)
+	}
+
+	// A valid reply does not lift the blacklist.
+	if err := ResetInvalidReplies(testDb, deviceid); err != nil {
+		t.Errorf("Received error resetting invalid replies: %v", err)
+	} else if bl, err := FindActiveDeviceBlacklist(testDb, deviceid); err != nil || bl == nil {
+		t.Errorf("Expected an active blacklist, got %v, error: %v", bl, err)
+	} else if devices, err := FindBlacklistedDevices(testDb); err != nil || len(devices) != 1 || devices[0].DeviceId != deviceid {
+		t.Errorf("Expected only %v to be blacklisted, got %v, error: %v", deviceid, devices, err)
+	}
+
+	if bl, err := FindActiveDeviceBlacklist(testDb, "myorg/other"); err != nil || bl != nil {
+		t.Errorf("Expected no blacklist, got %v, error: %v", bl, err)
+	}
+
+	if _, _, err := RecordInvalidReply(testDb, deviceid, 0, 60); err == nil {
+		t.Errorf("Expected error for a zero threshold")
+	}
+}
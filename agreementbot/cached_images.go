@@ -0,0 +1,119 @@
+package agreementbot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/containermessage"
+	"github.com/open-horizon/anax/exchange"
+	"github.com/open-horizon/anax/policy"
+	"sort"
+	"strings"
+)
+
+// The property a device can advertise on its microservices to tell agbots which workload images it already has. The
+// value is a comma separated list of image digests, e.g. "sha256:aaaa,sha256:bbbb".
+const CACHED_IMAGES_PROPERTY = "cachedImageDigests"
+
+// Returns the set of image digests that the device advertises as cached, either in its producer policy or on the
+// microservices registered in the exchange. The exchange device is nil when it was not retrieved.
+func cachedImageDigests(producerPolicy *policy.Policy, exchangeDev *exchange.Device) map[string]bool {
+
+	values := make([]string, 0, 5)
+	for _, prop := range producerPolicy.Properties {
+		if prop.Name == CACHED_IMAGES_PROPERTY {
+			values = append(values, fmt.Sprintf("%v", prop.Value))
+		}
+	}
+	if exchangeDev != nil {
+		for _, ms := range exchangeDev.RegisteredMicroservices {
+			for _, prop := range ms.Properties {
+				if prop.Name == CACHED_IMAGES_PROPERTY {
+					values = append(values, prop.Value)
+				}
+			}
+		}
+	}
+
+	digests := make(map[string]bool)
+	for _, v := range values {
+		for _, d := range strings.Split(v, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				digests[d] = true
+			}
+		}
+	}
+	return digests
+}
+
+// Returns true if the deployment has at least one image and every image is pinned to a digest that is in the cached set.
+// Images that are not pinned to a digest are never considered cached, because the device cannot know which digest the tag
+// resolves to when the workload is started.
+func imagesCached(deployment string, cached map[string]bool) bool {
+
+	var dd containermessage.DeploymentDescription
+	if deployment == "" || json.Unmarshal([]byte(deployment), &dd) != nil || len(dd.Services) == 0 {
+		return false
+	}
+
+	for _, service := range dd.Services {
+		pieces := strings.SplitN(service.Image, "@", 2)
+		if len(pieces) != 2 || !cached[pieces[1]] {
+			return false
+		}
+	}
+	return true
+}
+
+// Reorder the workloads in the consumer policy so that, among workloads with the same priority, the workloads whose images
+// the device has already cached come first. The workload selection loop in InitiateNewAgreement picks the first of several
+// workloads with the same priority, so this is only a tie breaker. It never changes which priority is tried next.
+func (b *BaseAgreementWorker) preferCachedWorkloads(ctx context.Context, cph ConsumerProtocolHandler, wi *InitiateAgreement, exchangeDev *exchange.Device, workerId string) {
+
+	if len(wi.ConsumerPolicy.Workloads) < 2 {
+		return
+	}
+
+	cached := cachedImageDigests(&wi.ProducerPolicy, exchangeDev)
+	if len(cached) == 0 {
+		return
+	}
+
+	// Errors getting the workload details are ignored, the workload is simply not preferred. The selection loop will
+	// report them if the workload is chosen anyway.
+	preferred := make(map[string]bool)
+	for _, workload := range wi.ConsumerPolicy.Workloads {
+		if details, err := exchange.GetWorkloadWithContext(ctx, b.config.Collaborators.HTTPClientFactory, workload.WorkloadURL, workload.Org, workload.Version, workload.Arch, b.config.AgreementBot.GetExchangeURL(workload.Org), cph.ExchangeId(), cph.ExchangeToken()); err != nil || details == nil || len(details.Workloads) == 0 {
+			continue
+		} else if imagesCached(details.Workloads[0].Deployment, cached) {
+			preferred[cachedWorkloadKey(&workload)] = true
+		}
+	}
+
+	if len(preferred) == 0 {
+		return
+	}
+
+	glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("device %v has cached the images of workloads %v, preferring them", wi.Device.Id, preferred)))
+	wi.ConsumerPolicy.Workloads = sortCachedWorkloads(wi.ConsumerPolicy.Workloads, preferred)
+}
+
+// Returns a copy of the workloads stable sorted by priority, with the preferred workloads first within each priority. The
+// input slice is shared with the consumer policy that other workers are matching devices against, so it is not modified.
+func sortCachedWorkloads(input []policy.Workload, preferred map[string]bool) []policy.Workload {
+	workloads := make([]policy.Workload, len(input))
+	copy(workloads, input)
+	sort.SliceStable(workloads, func(i, j int) bool {
+		if workloads[i].Priority.PriorityValue != workloads[j].Priority.PriorityValue {
+			return workloads[i].Priority.PriorityValue < workloads[j].Priority.PriorityValue
+		}
+		return preferred[cachedWorkloadKey(&workloads[i])] && !preferred[cachedWorkloadKey(&workloads[j])]
+	})
+	return workloads
+}
+
+// Identifies a workload of a consumer policy for the purposes of preferring cached workloads.
+func cachedWorkloadKey(w *policy.Workload) string {
+	return fmt.Sprintf("%v/%v/%v/%v", w.Org, w.WorkloadURL, w.Version, w.Arch)
+}
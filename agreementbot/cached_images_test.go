@@ -0,0 +1,65 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"github.com/open-horizon/anax/exchange"
+	"github.com/open-horizon/anax/policy"
+	"testing"
+)
+
+func Test_cachedImageDigests(t *testing.T) {
+
+	pol := &policy.Policy{Properties: policy.PropertyList{{Name: CACHED_IMAGES_PROPERTY, Value: "sha256:aaaa, sha256:bbbb"}}}
+	dev := &exchange.Device{RegisteredMicroservices: []exchange.Microservice{{Properties: []exchange.MSProp{{Name: CACHED_IMAGES_PROPERTY, Value: "sha256:cccc"}}}}}
+
+	if digests := cachedImageDigests(pol, dev); len(digests) != 3 || !digests["sha256:aaaa"] || !digests["sha256:bbbb"] || !digests["sha256:cccc"] {
+		t.Errorf("expected 3 cached digests, got %v", digests)
+	} else if digests := cachedImageDigests(&policy.Policy{}, nil); len(digests) != 0 {
+		t.Errorf("expected no cached digests, got %v", digests)
+	}
+}
+
+func Test_imagesCached(t *testing.T) {
+
+	cached := map[string]bool{"sha256:aaaa": true, "sha256:bbbb": true}
+
+	if !imagesCached(`{"services":{"cpu":{"image":"myorg/cpu@sha256:aaaa"},"gps":{"image":"myorg/gps@sha256:bbbb"}}}`, cached) {
+		t.Errorf("all images are cached")
+	} else if imagesCached(`{"services":{"cpu":{"image":"myorg/cpu@sha256:aaaa"},"gps":{"image":"myorg/gps@sha256:dddd"}}}`, cached) {
+		t.Errorf("the gps image is not cached")
+	} else if imagesCached(`{"services":{"cpu":{"image":"myorg/cpu:1.0"}}}`, cached) {
+		t.Errorf("an image that is not pinned to a digest is not cached")
+	} else if imagesCached("", cached) || imagesCached(`{"services":{}}`, cached) {
+		t.Errorf("a deployment without images is not cached")
+	}
+}
+
+func Test_sortCachedWorkloads(t *testing.T) {
+
+	workloads := []policy.Workload{
+		{WorkloadURL: "a", Priority: policy.WorkloadPriority{PriorityValue: 2}},
+		{WorkloadURL: "b", Priority: policy.WorkloadPriority{PriorityValue: 1}},
+		{WorkloadURL: "c", Priority: policy.WorkloadPriority{PriorityValue: 1}},
+		{WorkloadURL: "d", Priority: policy.WorkloadPriority{PriorityValue: 2}},
+	}
+
+	// A cached lower priority workload is not moved ahead of a higher priority one.
+	sorted := sortCachedWorkloads(workloads, map[string]bool{cachedWorkloadKey(&workloads[2]): true, cachedWorkloadKey(&workloads[3]): true})
+
+	order := func(ws []policy.Workload) string {
+		res := ""
+		for _, w := range ws {
+			res += w.WorkloadURL
+		}
+		return res
+	}
+	if o := order(sorted); o != "cbda" {
+		t.Errorf("expected workload order cbda, got %v", o)
+	}
+
+	// The workloads of the consumer policy are shared by the workers, they are not reordered.
+	if o := order(workloads); o != "abcd" {
+		t.Errorf("expected the input workloads to keep order abcd, got %v", o)
+	}
+}
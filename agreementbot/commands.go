@@ -9,20 +9,22 @@ import (
 
 // ==============================================================================================================
 type AgreementTimeoutCommand struct {
-	AgreementId string
-	Protocol    string
-	Reason      uint
+	AgreementId    string
+	Protocol       string
+	Reason         uint
+	OperatorReason string
 }
 
 func (a AgreementTimeoutCommand) ShortString() string {
 	return fmt.Sprintf("%v", a)
 }
 
-func NewAgreementTimeoutCommand(agreementId string, protocol string, reason uint) *AgreementTimeoutCommand {
+func NewAgreementTimeoutCommand(agreementId string, protocol string, reason uint, operatorReason string) *AgreementTimeoutCommand {
 	return &AgreementTimeoutCommand{
-		AgreementId: agreementId,
-		Protocol:    protocol,
-		Reason:      reason,
+		AgreementId:    agreementId,
+		Protocol:       protocol,
+		Reason:         reason,
+		OperatorReason: operatorReason,
 	}
 }
 
@@ -107,6 +109,36 @@ func NewWorkloadUpgradeCommand(msg events.ABApiWorkloadUpgradeMessage) *Workload
 	}
 }
 
+// ==============================================================================================================
+type ReconcileAgreementsCommand struct {
+	Msg events.ABApiReconcileAgreementsMessage
+}
+
+func (e ReconcileAgreementsCommand) ShortString() string {
+	return e.Msg.ShortString()
+}
+
+func NewReconcileAgreementsCommand(msg events.ABApiReconcileAgreementsMessage) *ReconcileAgreementsCommand {
+	return &ReconcileAgreementsCommand{
+		Msg: msg,
+	}
+}
+
+// ==============================================================================================================
+type CancelDeviceAgreementsCommand struct {
+	Msg events.ABApiDeviceCancelationMessage
+}
+
+func (e CancelDeviceAgreementsCommand) ShortString() string {
+	return e.Msg.ShortString()
+}
+
+func NewCancelDeviceAgreementsCommand(msg events.ABApiDeviceCancelationMessage) *CancelDeviceAgreementsCommand {
+	return &CancelDeviceAgreementsCommand{
+		Msg: msg,
+	}
+}
+
 // ==============================================================================================================
 type MakeAgreementCommand struct {
 	ProducerPolicy policy.Policy               // the producer policy received from the exchange
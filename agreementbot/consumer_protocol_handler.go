@@ -1,6 +1,7 @@
 package agreementbot
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 	"github.com/open-horizon/anax/policy"
 	"github.com/open-horizon/anax/worker"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -34,6 +36,7 @@ type ConsumerProtocolHandler interface {
 	AcceptCommand(cmd worker.Command) bool
 	AgreementProtocolHandler(typeName string, name string, org string) abstractprotocol.ProtocolHandler
 	WorkQueue() chan AgreementWork
+	AgreementLockManager() *AgreementLockManager
 	DispatchProtocolMessage(cmd *NewProtocolMessageCommand, cph ConsumerProtocolHandler) error
 	PersistAgreement(wi *InitiateAgreement, proposal abstractprotocol.Proposal, workerID string) error
 	PersistReply(reply abstractprotocol.ProposalReply, pol *policy.Policy, workerID string) error
@@ -58,12 +61,16 @@ type ConsumerProtocolHandler interface {
 	CanCancelNow(agreement *Agreement) bool
 	DeferCommand(cmd AgreementWork)
 	HandleDeferredCommands()
+	DeferredCancels() []DeferredCancel
+	FlushDeferredCancels() int
 	PostReply(agreementId string, proposal abstractprotocol.Proposal, reply abstractprotocol.ProposalReply, consumerPolicy *policy.Policy, org string, workerId string) error
 	UpdateProducer(ag *Agreement)
 	HandleExtensionMessage(cmd *NewProtocolMessageCommand) error
 	AlreadyReceivedReply(ag *Agreement) bool
 	GetKnownBlockchain(ag *Agreement) (string, string, string)
 	CanSendMeterRecord(ag *Agreement) bool
+	NegotiatedProtocolVersion(producerPolicy *policy.Policy, consumerPolicy *policy.Policy) int
+	Shutdown()
 }
 
 type BaseConsumerProtocolHandler struct {
@@ -75,7 +82,12 @@ type BaseConsumerProtocolHandler struct {
 	agbotId          string
 	token            string
 	deferredCommands []AgreementWork // The agreement related work that has to be deferred and retried
+	deferredLock     sync.Mutex      // protects deferredCommands, which workers append to while the agbot drains them
 	messages         chan events.Message
+	ctx              context.Context    // cancelled when the agbot shuts down, so that agreement workers abandon in-flight work
+	cancel           context.CancelFunc // cancels ctx
+
+	alm *AgreementLockManager // the agreement locks shared by the agreement workers and the governance of this protocol
 }
 
 func (b *BaseConsumerProtocolHandler) GetSendMessage() func(mt interface{}, pay []byte) error {
@@ -94,6 +106,18 @@ func (b *BaseConsumerProtocolHandler) ExchangeToken() string {
 	return b.token
 }
 
+func (b *BaseConsumerProtocolHandler) AgreementLockManager() *AgreementLockManager {
+	return b.alm
+}
+
+// Cancel the context shared by the agreement workers of this protocol, so that agreement initiations in progress return
+// promptly instead of holding up the shutdown of the agbot.
+func (b *BaseConsumerProtocolHandler) Shutdown() {
+	if b.cancel != nil {
+		b.cancel()
+	}
+}
+
 func (w *BaseConsumerProtocolHandler) sendMessage(mt interface{}, pay []byte) error {
 	// The mt parameter is an abstract message target object that is passed to this routine
 	// by the agreement protocol. It's an interface{} type so that we can avoid the protocol knowing
@@ -133,9 +157,10 @@ func (w *BaseConsumerProtocolHandler) sendMessage(mt interface{}, pay []byte) er
 		pm := exchange.CreatePostMessage(msgBody, w.config.AgreementBot.ExchangeMessageTTL)
 		var resp interface{}
 		resp = new(exchange.PostDeviceResponse)
-		targetURL := w.config.AgreementBot.ExchangeURL + "orgs/" + exchange.GetOrg(messageTarget.ReceiverExchangeId) + "/nodes/" + exchange.GetId(messageTarget.ReceiverExchangeId) + "/msgs"
+		targetURL := w.config.AgreementBot.GetExchangeURL(exchange.GetOrg(messageTarget.ReceiverExchangeId)) + "orgs/" + exchange.GetOrg(messageTarget.ReceiverExchangeId) + "/nodes/" + exchange.GetId(messageTarget.ReceiverExchangeId) + "/msgs"
 		for {
 			if err, tpErr := exchange.InvokeExchange(w.httpClient, "POST", targetURL, w.agbotId, w.token, pm, &resp); err != nil {
+				ExchangeCredentials.Check(err)
 				return err
 			} else if tpErr != nil {
 				glog.Warningf(tpErr.Error())
@@ -162,7 +187,7 @@ func (b *BaseConsumerProtocolHandler) DispatchProtocolMessage(cmd *NewProtocolMe
 			SenderPubKey: cmd.PubKey,
 			MessageId:    cmd.MessageId,
 		}
-		cph.WorkQueue() <- agreementWork
+		queueWork(cph, agreementWork)
 		glog.V(5).Infof(BCPHlogstring(b.Name(), fmt.Sprintf("queued reply message")))
 	} else if _, aerr := cph.AgreementProtocolHandler("", "", "").ValidateDataReceivedAck(string(cmd.Message)); aerr == nil {
 		agreementWork := HandleDataReceivedAck{
@@ -172,7 +197,7 @@ func (b *BaseConsumerProtocolHandler) DispatchProtocolMessage(cmd *NewProtocolMe
 			SenderPubKey: cmd.PubKey,
 			MessageId:    cmd.MessageId,
 		}
-		cph.WorkQueue() <- agreementWork
+		queueWork(cph, agreementWork)
 		glog.V(5).Infof(BCPHlogstring(b.Name(), fmt.Sprintf("queued data received ack message")))
 	} else if can, cerr := cph.AgreementProtocolHandler("", "", "").ValidateCancel(string(cmd.Message)); cerr == nil {
 		// Before dispatching the cancel to a worker thread, make sure it's a valid cancel
@@ -189,7 +214,7 @@ func (b *BaseConsumerProtocolHandler) DispatchProtocolMessage(cmd *NewProtocolMe
 				Protocol:    can.Protocol(),
 				Reason:      can.Reason(),
 			}
-			cph.WorkQueue() <- agreementWork
+			queueWork(cph, agreementWork)
 			glog.V(5).Infof(BCPHlogstring(b.Name(), fmt.Sprintf("queued cancel message")))
 		}
 	} else if exerr := cph.HandleExtensionMessage(cmd); exerr == nil {
@@ -206,12 +231,13 @@ func (b *BaseConsumerProtocolHandler) HandleAgreementTimeout(cmd *AgreementTimeo
 
 	glog.V(5).Infof(BCPHlogstring(b.Name(), "received agreement cancellation."))
 	agreementWork := CancelAgreement{
-		workType:    CANCEL,
-		AgreementId: cmd.AgreementId,
-		Protocol:    cmd.Protocol,
-		Reason:      cmd.Reason,
+		workType:       CANCEL,
+		AgreementId:    cmd.AgreementId,
+		Protocol:       cmd.Protocol,
+		Reason:         cmd.Reason,
+		OperatorReason: cmd.OperatorReason,
 	}
-	cph.WorkQueue() <- agreementWork
+	queueWork(cph, agreementWork)
 	glog.V(5).Infof(BCPHlogstring(b.Name(), "queued agreement cancellation"))
 
 }
@@ -256,7 +282,7 @@ func (b *BaseConsumerProtocolHandler) HandlePolicyChanged(cmd *PolicyChangedComm
 						}
 						// Choose this device's agreement within the HA group to start upgrading.
 						// Delete this workload usage record so that a new agreement will be made starting from the highest priority workload
-						if err := DeleteWorkloadUsage(b.db, ag.DeviceId, ag.PolicyName); err != nil {
+						if err := DeleteWorkloadUsage(b.db, ag.DeviceId, ag.PolicyName, WU_REASON_POLICY_CHANGED); err != nil {
 							glog.Warningf(BCPHlogstring(b.Name(), fmt.Sprintf("error deleting workload usage for %v using policy %v, error: %v", ag.DeviceId, ag.PolicyName, err)))
 						}
 						agreementWork := CancelAgreement{
@@ -265,11 +291,19 @@ func (b *BaseConsumerProtocolHandler) HandlePolicyChanged(cmd *PolicyChangedComm
 							Protocol:    ag.AgreementProtocol,
 							Reason:      cph.GetTerminationCode(TERM_REASON_POLICY_CHANGED),
 						}
-						cph.WorkQueue() <- agreementWork
+						queueWork(cph, agreementWork)
+					} else if b.config.AgreementBot.ReevaluateProposals && ag.AgreementFinalizedTime == 0 {
+						// The proposal might still be good under the changed policy, a worker decides whether to re-make it.
+						agreementWork := ReevaluateProposal{
+							workType:    REEVALUATE_PROPOSAL,
+							AgreementId: ag.CurrentAgreementId,
+							Protocol:    ag.AgreementProtocol,
+						}
+						queueWork(cph, agreementWork)
 					} else {
 						// Non-HA device or agrement without workload priority in the policy, re-make the agreement
 						// Delete this workload usage record so that a new agreement will be made starting from the highest priority workload
-						if err := DeleteWorkloadUsage(b.db, ag.DeviceId, ag.PolicyName); err != nil {
+						if err := DeleteWorkloadUsage(b.db, ag.DeviceId, ag.PolicyName, WU_REASON_POLICY_CHANGED); err != nil {
 							glog.Warningf(BCPHlogstring(b.Name(), fmt.Sprintf("error deleting workload usage for %v using policy %v, error: %v", ag.DeviceId, ag.PolicyName, err)))
 						}
 						agreementWork := CancelAgreement{
@@ -278,7 +312,7 @@ func (b *BaseConsumerProtocolHandler) HandlePolicyChanged(cmd *PolicyChangedComm
 							Protocol:    ag.AgreementProtocol,
 							Reason:      cph.GetTerminationCode(TERM_REASON_POLICY_CHANGED),
 						}
-						cph.WorkQueue() <- agreementWork
+						queueWork(cph, agreementWork)
 					}
 				} else {
 					glog.V(5).Infof(BCPHlogstring(b.Name(), fmt.Sprintf("for agreement %v, no policy content differences detected", ag.CurrentAgreementId)))
@@ -307,7 +341,7 @@ func (b *BaseConsumerProtocolHandler) HandlePolicyDeleted(cmd *PolicyDeletedComm
 				glog.Errorf(BCPHlogstring(b.Name(), fmt.Sprintf("agreement %v has a policy %v that doesn't exist anymore", ag.CurrentAgreementId, pol.Header.Name)))
 
 				// Remove any workload usage records so that a new agreement will be made starting from the highest priority workload.
-				if err := DeleteWorkloadUsage(b.db, ag.DeviceId, ag.PolicyName); err != nil {
+				if err := DeleteWorkloadUsage(b.db, ag.DeviceId, ag.PolicyName, WU_REASON_POLICY_DELETED); err != nil {
 					glog.Warningf(BCPHlogstring(b.Name(), fmt.Sprintf("error deleting workload usage for %v using policy %v, error: %v", ag.DeviceId, ag.PolicyName, err)))
 				}
 
@@ -318,7 +352,7 @@ func (b *BaseConsumerProtocolHandler) HandlePolicyDeleted(cmd *PolicyDeletedComm
 					Protocol:    ag.AgreementProtocol,
 					Reason:      cph.GetTerminationCode(TERM_REASON_POLICY_CHANGED),
 				}
-				cph.WorkQueue() <- agreementWork
+				queueWork(cph, agreementWork)
 
 			}
 
@@ -337,7 +371,7 @@ func (b *BaseConsumerProtocolHandler) HandleWorkloadUpgrade(cmd *WorkloadUpgrade
 		Protocol:    cmd.Msg.AgreementProtocol,
 		PolicyName:  cmd.Msg.PolicyName,
 	}
-	cph.WorkQueue() <- upgradeWork
+	queueWork(cph, upgradeWork)
 	glog.V(5).Infof(BCPHlogstring(b.Name(), fmt.Sprintf("queued workload upgrade command.")))
 }
 
@@ -350,7 +384,7 @@ func (b *BaseConsumerProtocolHandler) HandleMakeAgreement(cmd *MakeAgreementComm
 		Org:            cmd.Org,
 		Device:         cmd.Device,
 	}
-	cph.WorkQueue() <- agreementWork
+	queueWork(cph, agreementWork)
 	glog.V(5).Infof(BCPHlogstring(b.Name(), fmt.Sprintf("queued make agreement command.")))
 }
 
@@ -397,10 +431,11 @@ func (b *BaseConsumerProtocolHandler) RecordConsumerAgreementState(agreementId s
 	as.State = state
 	var resp interface{}
 	resp = new(exchange.PostDeviceResponse)
-	targetURL := b.config.AgreementBot.ExchangeURL + "orgs/" + exchange.GetOrg(b.agbotId) + "/agbots/" + exchange.GetId(b.agbotId) + "/agreements/" + agreementId
+	targetURL := b.config.AgreementBot.GetExchangeURL(exchange.GetOrg(b.agbotId)) + "orgs/" + exchange.GetOrg(b.agbotId) + "/agbots/" + exchange.GetId(b.agbotId) + "/agreements/" + agreementId
 	for {
 		if err, tpErr := exchange.InvokeExchange(b.httpClient, "PUT", targetURL, b.agbotId, b.token, &as, &resp); err != nil {
 			glog.Errorf(err.Error())
+			ExchangeCredentials.Check(err)
 			return err
 		} else if tpErr != nil {
 			glog.Warningf(tpErr.Error())
@@ -416,7 +451,7 @@ func (b *BaseConsumerProtocolHandler) RecordConsumerAgreementState(agreementId s
 
 func (b *BaseConsumerProtocolHandler) DeleteMessage(msgId int) error {
 
-	return DeleteMessage(msgId, b.agbotId, b.token, b.config.AgreementBot.ExchangeURL, b.httpClient)
+	return DeleteMessage(msgId, b.agbotId, b.token, b.config.AgreementBot.GetExchangeURL(exchange.GetOrg(b.agbotId)), b.httpClient)
 
 }
 
@@ -452,10 +487,11 @@ func (b *BaseConsumerProtocolHandler) getDevice(deviceId string, workerId string
 
 	var resp interface{}
 	resp = new(exchange.GetDevicesResponse)
-	targetURL := b.config.AgreementBot.ExchangeURL + "orgs/" + exchange.GetOrg(deviceId) + "/nodes/" + exchange.GetId(deviceId)
+	targetURL := b.config.AgreementBot.GetExchangeURL(exchange.GetOrg(deviceId)) + "orgs/" + exchange.GetOrg(deviceId) + "/nodes/" + exchange.GetId(deviceId)
 	for {
-		if err, tpErr := exchange.InvokeExchange(b.config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), "GET", targetURL, b.agbotId, b.token, nil, &resp); err != nil {
+		if err, tpErr := exchange.InvokeExchange(b.httpClient, "GET", targetURL, b.agbotId, b.token, nil, &resp); err != nil {
 			glog.Errorf(BCPHlogstring2(workerId, fmt.Sprintf(err.Error())))
+			ExchangeCredentials.Check(err)
 			return nil, err
 		} else if tpErr != nil {
 			glog.Warningf(BCPHlogstring2(workerId, tpErr.Error()))
@@ -474,15 +510,109 @@ func (b *BaseConsumerProtocolHandler) getDevice(deviceId string, workerId string
 }
 
 func (b *BaseConsumerProtocolHandler) DeferCommand(cmd AgreementWork) {
+	if cancel, ok := cmd.(AsyncCancelAgreement); ok && cancel.DeferredTime == 0 {
+		cancel.DeferredTime = uint64(time.Now().Unix())
+		cmd = cancel
+	}
+	b.deferredLock.Lock()
+	defer b.deferredLock.Unlock()
 	b.deferredCommands = append(b.deferredCommands, cmd)
 }
 
 func (b *BaseConsumerProtocolHandler) GetDeferredCommands() []AgreementWork {
+	b.deferredLock.Lock()
+	defer b.deferredLock.Unlock()
 	res := b.deferredCommands
 	b.deferredCommands = make([]AgreementWork, 0, 10)
 	return res
 }
 
+// A blockchain cancel that is deferred until the blockchain of the agreement is writable.
+type DeferredCancel struct {
+	AgreementId string `json:"agreement_id"`
+	Reason      uint   `json:"reason"`
+	AgeS        uint64 `json:"age_s"` // seconds since the cancel was first deferred
+}
+
+// Returns the blockchain cancels that are currently deferred, oldest first.
+func (b *BaseConsumerProtocolHandler) DeferredCancels() []DeferredCancel {
+	b.deferredLock.Lock()
+	defer b.deferredLock.Unlock()
+
+	now := uint64(time.Now().Unix())
+	res := make([]DeferredCancel, 0, 10)
+	for _, cmd := range b.deferredCommands {
+		if cancel, ok := cmd.(AsyncCancelAgreement); ok {
+			age := uint64(0)
+			if now > cancel.DeferredTime {
+				age = now - cancel.DeferredTime
+			}
+			res = append(res, DeferredCancel{AgreementId: cancel.AgreementId, Reason: cancel.Reason, AgeS: age})
+		}
+	}
+	return res
+}
+
+// Removes the deferred blockchain cancels and returns them, marked to be attempted even if the blockchain is not known to
+// be writable. The other deferred commands are left in place.
+func (b *BaseConsumerProtocolHandler) takeDeferredCancels() []AsyncCancelAgreement {
+	b.deferredLock.Lock()
+	defer b.deferredLock.Unlock()
+
+	cancels := make([]AsyncCancelAgreement, 0, 10)
+	remaining := make([]AgreementWork, 0, 10)
+	for _, cmd := range b.deferredCommands {
+		if cancel, ok := cmd.(AsyncCancelAgreement); ok {
+			cancel.Force = true
+			cancels = append(cancels, cancel)
+		} else {
+			remaining = append(remaining, cmd)
+		}
+	}
+	b.deferredCommands = remaining
+	return cancels
+}
+
+// The blockchain cancels a protocol handler has deferred until the blockchain of the agreement is writable.
+type DeferredCancelQueue interface {
+	DeferredCancels() []DeferredCancel
+	FlushDeferredCancels() int
+}
+
+// Tracks the deferred cancels of each protocol handler, so that they can be listed and flushed by the API. It is safe
+// for concurrent use.
+type DeferredCancelRegistry struct {
+	lock   sync.Mutex
+	queues map[string]DeferredCancelQueue
+}
+
+func NewDeferredCancelRegistry() *DeferredCancelRegistry {
+	return &DeferredCancelRegistry{
+		queues: make(map[string]DeferredCancelQueue),
+	}
+}
+
+// The deferred cancels of the protocol handlers of this agbot.
+var DeferredCancelQueues = NewDeferredCancelRegistry()
+
+// Track the deferred cancels of the protocol's handler.
+func (r *DeferredCancelRegistry) Track(protocol string, cancels DeferredCancelQueue) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.queues[protocol] = cancels
+}
+
+// Returns the deferred cancels tracked for each protocol, keyed by protocol.
+func (r *DeferredCancelRegistry) Queues() map[string]DeferredCancelQueue {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	res := make(map[string]DeferredCancelQueue)
+	for protocol, q := range r.queues {
+		res[protocol] = q
+	}
+	return res
+}
+
 func (b *BaseConsumerProtocolHandler) UpdateProducer(ag *Agreement) {
 	return
 }
@@ -528,6 +658,10 @@ const TERM_REASON_CANCEL_FORCED_UPGRADE = "ForceUpgrade"
 const TERM_REASON_CANCEL_BC_WRITE_FAILED = "WriteFailed"
 const TERM_REASON_NODE_HEARTBEAT = "NodeHeartbeat"
 const TERM_REASON_AG_MISSING = "AgreementMissing"
+const TERM_REASON_PROPOSAL_TIMEOUT = "ProposalTimeout"
+
+// The termination code GetTerminationCode returns for a reason the agreement protocol has no code for.
+const TERM_CODE_UNMAPPED = 999
 
 var BCPHlogstring = func(p string, v interface{}) string {
 	return fmt.Sprintf("Base Consumer Protocol Handler (%v) %v", p, v)
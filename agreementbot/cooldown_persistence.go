@@ -0,0 +1,121 @@
+package agreementbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+	"time"
+)
+
+const CANCEL_COOLDOWN = "cancel_cooldown"
+
+// A cancel cooldown record prevents the agbot from initiating a new agreement with a device, for a given policy,
+// until the cooldown has expired. These records are created when an agreement is cancelled for a reason that
+// has a cooldown configured.
+type CancelCooldown struct {
+	DeviceId   string `json:"device_id"`   // the device id that is cooling down
+	PolicyName string `json:"policy_name"` // the name of the policy that was used in the cancelled agreement
+	Reason     uint   `json:"reason"`      // the protocol specific termination reason code of the cancelled agreement
+	StartTime  uint64 `json:"start_time"`  // time when the cooldown started
+	ExpiryTime uint64 `json:"expiry_time"` // time when the cooldown ends
+}
+
+func (c CancelCooldown) String() string {
+	return fmt.Sprintf("DeviceId: %v, "+
+		"PolicyName: %v, "+
+		"Reason: %v, "+
+		"StartTime: %v, "+
+		"ExpiryTime: %v",
+		c.DeviceId, c.PolicyName, c.Reason, c.StartTime, c.ExpiryTime)
+}
+
+func (c *CancelCooldown) Expired() bool {
+	return c.ExpiryTime <= uint64(time.Now().Unix())
+}
+
+// Create or replace the cooldown record for a device, policy and reason. The cooldown expires durationS seconds from now.
+func NewCancelCooldown(db *bolt.DB, deviceId string, policyName string, reason uint, durationS int) error {
+	if deviceId == "" || policyName == "" || durationS <= 0 {
+		return errors.New("Illegal input: one of deviceId, policyName or durationS is empty")
+	}
+
+	now := uint64(time.Now().Unix())
+	cc := &CancelCooldown{
+		DeviceId:   deviceId,
+		PolicyName: policyName,
+		Reason:     reason,
+		StartTime:  now,
+		ExpiryTime: now + uint64(durationS),
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if b, err := tx.CreateBucketIfNotExists([]byte(CANCEL_COOLDOWN)); err != nil {
+			return err
+		} else if bytes, err := json.Marshal(cc); err != nil {
+			return fmt.Errorf("Unable to serialize cancel cooldown record %v. Error: %v", cc, err)
+		} else if err := b.Put([]byte(cooldownKey(deviceId, policyName, reason)), bytes); err != nil {
+			return fmt.Errorf("Unable to write cancel cooldown record %v to bucket %v", cc, CANCEL_COOLDOWN)
+		} else {
+			glog.V(3).Infof("Succeeded writing cancel cooldown record %v", cc)
+			return nil
+		}
+	})
+}
+
+// Returns the unexpired cooldown with the latest expiry time for the device and policy, or nil if there are no active cooldowns.
+// Expired cooldown records are removed as a side effect.
+func FindActiveCancelCooldown(db *bolt.DB, deviceId string, policyName string) (*CancelCooldown, error) {
+
+	var active *CancelCooldown
+	expired := make([]string, 0, 5)
+
+	readErr := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(CANCEL_COOLDOWN)); b != nil {
+			b.ForEach(func(k, v []byte) error {
+				var c CancelCooldown
+				if err := json.Unmarshal(v, &c); err != nil {
+					glog.Errorf("Unable to deserialize cancel cooldown db record: %v", v)
+				} else if c.DeviceId != deviceId || c.PolicyName != policyName {
+					// not interested in this record
+				} else if c.Expired() {
+					expired = append(expired, string(k))
+				} else if active == nil || active.ExpiryTime < c.ExpiryTime {
+					active = &c
+				}
+				return nil
+			})
+		}
+		return nil // end the transaction
+	})
+
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	if len(expired) != 0 {
+		if err := deleteCancelCooldowns(db, expired); err != nil {
+			glog.Warningf("Unable to delete expired cancel cooldown records %v, error: %v", expired, err)
+		}
+	}
+
+	return active, nil
+}
+
+func deleteCancelCooldowns(db *bolt.DB, keys []string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(CANCEL_COOLDOWN)); b != nil {
+			for _, k := range keys {
+				if err := b.Delete([]byte(k)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func cooldownKey(deviceId string, policyName string, reason uint) string {
+	return fmt.Sprintf("%v/%v/%v", deviceId, policyName, reason)
+}
@@ -0,0 +1,53 @@
+// +build integration
+
+package agreementbot
+
+import (
+	"testing"
+)
+
+func Test_CancelCooldown_lifecycle(t *testing.T) {
+
+	deviceid := "myorg/an12345"
+	pName := "cooldown policy"
+
+	if cc, err := FindActiveCancelCooldown(testDb, deviceid, pName); err != nil {
+		t.Errorf("Received error finding cooldown: %v", err)
+	} else if cc != nil {
+		t.Errorf("Received cooldown %v that should not exist.", cc)
+	}
+
+	if err := NewCancelCooldown(testDb, deviceid, pName, 102, 60); err != nil {
+		t.Errorf("Received error creating new cooldown: %v", err)
+	} else if cc, err := FindActiveCancelCooldown(testDb, deviceid, pName); err != nil {
+		t.Errorf("Received error finding cooldown: %v", err)
+	} else if cc == nil {
+		t.Errorf("Should have found an active cooldown.")
+	} else if cc.Reason != 102 || cc.ExpiryTime != cc.StartTime+60 {
+		t.Errorf("Cooldown has the wrong content: %v", cc)
+	}
+
+	// A different policy on the same device is not affected.
+	if cc, err := FindActiveCancelCooldown(testDb, deviceid, "other policy"); err != nil {
+		t.Errorf("Received error finding cooldown: %v", err)
+	} else if cc != nil {
+		t.Errorf("Received cooldown %v that should not exist.", cc)
+	}
+
+}
+
+func Test_CancelCooldown_expired(t *testing.T) {
+
+	deviceid := "myorg/an54321"
+	pName := "cooldown policy"
+
+	cc := &CancelCooldown{DeviceId: deviceid, PolicyName: pName, Reason: 102, StartTime: 1, ExpiryTime: 2}
+	if !cc.Expired() {
+		t.Errorf("Cooldown %v should be expired.", cc)
+	}
+
+	if err := NewCancelCooldown(testDb, deviceid, pName, 0, 0); err == nil {
+		t.Errorf("Should have received error creating a cooldown with zero duration.")
+	}
+
+}
@@ -0,0 +1,99 @@
+package agreementbot
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/exchange"
+	"sync"
+	"time"
+)
+
+// ExchangeCredentialState tracks whether the exchange is accepting the agbot's credentials. When the exchange rejects
+// them (HTTP 401 or 403), the agbot pauses, i.e. it stops initiating new work, until an exchange call with the
+// credentials succeeds again. It is safe for concurrent use by the agbot worker and its subworkers.
+type ExchangeCredentialState struct {
+	lock      sync.Mutex
+	invalid   bool
+	since     time.Time
+	lastError string
+}
+
+// The state of the agbot's exchange credentials, as reported by the health API.
+type ExchangeCredentialStatus struct {
+	Paused    bool   `json:"paused"`               // true while the exchange rejects the agbot's credentials
+	Since     int64  `json:"since,omitempty"`      // the time when the exchange started rejecting the credentials
+	LastError string `json:"last_error,omitempty"` // the last error from an exchange call that rejected the credentials
+}
+
+func NewExchangeCredentialState() *ExchangeCredentialState {
+	return &ExchangeCredentialState{}
+}
+
+// The exchange credential state of this process. The agbot worker, the agreement workers and the protocol handlers all
+// pass the errors of their exchange calls through its Check function.
+var ExchangeCredentials = NewExchangeCredentialState()
+
+func (c *ExchangeCredentialState) String() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return fmt.Sprintf("Invalid: %v, Since: %v, LastError: %v", c.invalid, c.since, c.lastError)
+}
+
+// Returns the state of the credentials.
+func (c *ExchangeCredentialState) Status() ExchangeCredentialStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s := ExchangeCredentialStatus{Paused: c.invalid, LastError: c.lastError}
+	if c.invalid {
+		s.Since = c.since.Unix()
+	}
+	return s
+}
+
+// Check the error from an exchange call made with the agbot's credentials. Returns true if the exchange rejected the
+// credentials, in which case the agbot is paused until they are accepted again. The first rejection is logged, so that
+// the problem is reported once instead of on every failing exchange call.
+func (c *ExchangeCredentialState) Check(err error) bool {
+	if !exchange.IsAuthError(err) {
+		return false
+	} else if c.Invalidate(err) {
+		glog.Errorf(AWlogString(fmt.Sprintf("exchange rejected the agbot credentials, pausing until they are accepted again. Check the agbot id and token. Error: %v", err)))
+	}
+	return true
+}
+
+// Returns true if the credentials were rejected by the exchange and have not been accepted since.
+func (c *ExchangeCredentialState) IsInvalid() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.invalid
+}
+
+// Record that the exchange rejected the credentials. Returns true when this changes the state from valid to invalid,
+// so that the caller can alert exactly once.
+func (c *ExchangeCredentialState) Invalidate(err error) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lastError = err.Error()
+	if c.invalid {
+		return false
+	}
+	c.invalid = true
+	c.since = time.Now()
+	return true
+}
+
+// Record that the exchange accepted the credentials. Returns true when this changes the state from invalid to valid.
+func (c *ExchangeCredentialState) Validate() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.invalid {
+		return false
+	}
+	c.invalid = false
+	c.lastError = ""
+	return true
+}
@@ -0,0 +1,97 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/exchange"
+	"github.com/open-horizon/anax/worker"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_ExchangeCredentialState(t *testing.T) {
+
+	c := NewExchangeCredentialState()
+	if c.IsInvalid() {
+		t.Errorf("expected credentials to start out valid")
+	} else if c.Validate() {
+		t.Errorf("expected no state change when validating valid credentials")
+	}
+
+	// Only the first rejection changes the state, so that it is reported once.
+	if !c.Invalidate(errors.New("status: 401")) {
+		t.Errorf("expected the first rejection to change the state")
+	} else if c.Invalidate(errors.New("status: 403")) {
+		t.Errorf("expected a second rejection not to change the state")
+	} else if !c.IsInvalid() {
+		t.Errorf("expected credentials to be invalid")
+	}
+
+	if !c.Validate() {
+		t.Errorf("expected accepted credentials to change the state")
+	} else if c.IsInvalid() {
+		t.Errorf("expected credentials to be valid again")
+	} else if !c.Invalidate(errors.New("status: 401")) {
+		t.Errorf("expected a new rejection to change the state again")
+	}
+}
+
+func Test_ExchangeCredentialState_Check(t *testing.T) {
+
+	c := NewExchangeCredentialState()
+	if c.Check(nil) || c.Check(errors.New("status: 500")) || c.IsInvalid() {
+		t.Errorf("expected other errors not to pause the agbot: %v", c)
+	} else if !c.Check(errors.New("status: 401")) || !c.IsInvalid() {
+		t.Errorf("expected a rejection to pause the agbot: %v", c)
+	} else if s := c.Status(); !s.Paused || s.Since == 0 || s.LastError != "status: 401" {
+		t.Errorf("expected a paused status, got %v", s)
+	}
+}
+
+func Test_AgreementBotWorker_pause_and_resume(t *testing.T) {
+
+	// The exchange rejects the agbot's credentials until they are fixed.
+	var rejecting int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&rejecting) == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(exchange.GetAgbotMessageResponse{Messages: []exchange.AgbotMessage{}})
+	}))
+	defer server.Close()
+
+	cfg := &config.HorizonConfig{AgreementBot: config.AGConfig{ExchangeURL: server.URL + "/"}}
+	w := &AgreementBotWorker{
+		BaseWorker:  worker.BaseWorker{Manager: worker.Manager{Config: cfg}},
+		httpClient:  &http.Client{Timeout: 5 * time.Second},
+		agbotId:     "myorg/agbot",
+		token:       "token",
+		credentials: NewExchangeCredentialState(),
+	}
+
+	if w.paused() {
+		t.Fatalf("expected the agbot to start out unpaused")
+	}
+
+	// An exchange call is rejected, so the agbot pauses, and stays paused while the exchange keeps rejecting it.
+	if _, err := w.getMessages(); !w.credentials.Check(err) {
+		t.Fatalf("expected the exchange to reject the credentials, error: %v", err)
+	} else if !w.paused() || !w.paused() {
+		t.Errorf("expected the agbot to stay paused while the credentials are rejected: %v", w.credentials)
+	}
+
+	// Once the exchange accepts the credentials again, the agbot resumes.
+	atomic.StoreInt32(&rejecting, 0)
+	if w.paused() {
+		t.Errorf("expected the agbot to resume once the credentials are accepted: %v", w.credentials)
+	} else if s := w.credentials.Status(); s.Paused || s.LastError != "" {
+		t.Errorf("expected an unpaused status, got %v", s)
+	}
+}
@@ -22,12 +22,14 @@ func NewCSAgreementWorker(c *CSProtocolHandler, cfg *config.HorizonConfig, db *b
 
 	p := &CSAgreementWorker{
 		BaseAgreementWorker: &BaseAgreementWorker{
-			pm:         pm,
-			db:         db,
-			config:     cfg,
-			alm:        alm,
-			workerID:   uuid.NewV4().String(),
-			httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+			pm:              pm,
+			db:              db,
+			config:          cfg,
+			alm:             alm,
+			workerID:        uuid.NewV4().String(),
+			httpClient:      cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+			ignoreAttribs:   newListSet(cfg.AgreementBot.IgnoreContractWithAttribs),
+			cancelCooldowns: newCancelCooldowns(cfg),
 		},
 		protocolHandler: c,
 	}
@@ -122,9 +124,16 @@ func (c CSConsumerUpdateAck) String() string {
 // to actually work through the agreement protocol.
 func (a *CSAgreementWorker) start(work chan AgreementWork, random *rand.Rand) {
 
+	WQMetrics.WorkerStarted(a.protocolHandler.Name())
+	defer WQMetrics.WorkerStopped(a.protocolHandler.Name())
+
 	for {
 		glog.V(5).Infof(logstring(a.workerID, fmt.Sprintf("blocking for work")))
-		workItem := <-work // block waiting for work
+		workItem, ok := a.waitForWork(a.protocolHandler.Name(), work) // block waiting for work
+		if !ok {
+			glog.V(3).Infof(logstring(a.workerID, fmt.Sprintf("exiting, worker pool is shrinking")))
+			return
+		}
 		glog.V(2).Infof(logstring(a.workerID, fmt.Sprintf("received work: %v", workItem)))
 
 		if workItem.Type() == INITIATE {
@@ -141,7 +150,7 @@ func (a *CSAgreementWorker) start(work chan AgreementWork, random *rand.Rand) {
 
 		} else if workItem.Type() == CANCEL {
 			wi := workItem.(CancelAgreement)
-			a.CancelAgreementWithLock(a.protocolHandler, wi.AgreementId, wi.Reason, a.workerID)
+			a.CancelAgreementWithLock(a.protocolHandler, wi.AgreementId, wi.Reason, wi.OperatorReason, a.workerID)
 
 		} else if workItem.Type() == BC_RECORDED {
 			// the agreement is recorded on the blockchain
@@ -180,7 +189,7 @@ func (a *CSAgreementWorker) start(work chan AgreementWork, random *rand.Rand) {
 		} else if workItem.Type() == BC_TERMINATED {
 			// the agreement is terminated on the blockchain
 			wi := workItem.(CSHandleBCTerminated)
-			a.CancelAgreementWithLock(a.protocolHandler, wi.AgreementId, a.protocolHandler.GetTerminationCode(TERM_REASON_CANCEL_DISCOVERED), a.workerID)
+			a.CancelAgreementWithLock(a.protocolHandler, wi.AgreementId, a.protocolHandler.GetTerminationCode(TERM_REASON_CANCEL_DISCOVERED), "", a.workerID)
 
 		} else if workItem.Type() == WORKLOAD_UPGRADE {
 			// upgrade a workload on a device
@@ -189,7 +198,15 @@ func (a *CSAgreementWorker) start(work chan AgreementWork, random *rand.Rand) {
 
 		} else if workItem.Type() == ASYNC_CANCEL {
 			wi := workItem.(AsyncCancelAgreement)
-			a.ExternalCancel(a.protocolHandler, wi.AgreementId, wi.Reason, a.workerID)
+			a.ExternalCancel(a.protocolHandler, wi, a.workerID)
+
+		} else if workItem.Type() == ASYNC_ARCHIVE {
+			wi := workItem.(AsyncArchiveAgreement)
+			a.ExternalArchive(a.protocolHandler, wi.AgreementId, wi.Reason, wi.OperatorReason, a.workerID)
+
+		} else if workItem.Type() == REEVALUATE_PROPOSAL {
+			wi := workItem.(ReevaluateProposal)
+			a.ReevaluateProposalWithLock(a.protocolHandler, wi.AgreementId, a.workerID)
 
 		} else if workItem.Type() == ASYNC_WRITE {
 			wi := workItem.(AsyncWriteAgreement)
@@ -253,7 +270,7 @@ func (a *CSAgreementWorker) DoAsyncWrite(cph ConsumerProtocolHandler, ag *Agreem
 		glog.Errorf(logstring(workerID, fmt.Sprintf("error demarshalling tsandcs policy from pending agreement %v, error: %v", ag.CurrentAgreementId, err)))
 	} else if err := cph.AgreementProtocolHandler(ag.BlockchainType, ag.BlockchainName, ag.BlockchainOrg).RecordAgreement(proposal, nil, ag.CounterPartyAddress, ag.ProposalSig, pol, ag.Org); err != nil {
 		glog.Errorf(logstring(workerID, fmt.Sprintf("error trying to record agreement in blockchain, %v", err)))
-		a.CancelAgreementWithLock(cph, ag.CurrentAgreementId, cph.GetTerminationCode(TERM_REASON_CANCEL_BC_WRITE_FAILED), workerID)
+		a.CancelAgreementWithLock(cph, ag.CurrentAgreementId, cph.GetTerminationCode(TERM_REASON_CANCEL_BC_WRITE_FAILED), "", workerID)
 	} else {
 		glog.V(3).Infof(logstring(workerID, fmt.Sprintf("recorded agreement %v", ag.CurrentAgreementId)))
 	}
@@ -1,6 +1,7 @@
 package agreementbot
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
@@ -38,20 +39,25 @@ type CSProtocolHandler struct {
 
 func NewCSProtocolHandler(name string, cfg *config.HorizonConfig, db *bolt.DB, pm *policy.PolicyManager, messages chan events.Message) *CSProtocolHandler {
 	if name == citizenscientist.PROTOCOL_NAME {
+		ctx, cancel := context.WithCancel(context.Background())
+		httpClient := cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil)
 		return &CSProtocolHandler{
 			BaseConsumerProtocolHandler: &BaseConsumerProtocolHandler{
 				name:             name,
 				pm:               pm,
 				db:               db,
 				config:           cfg,
-				httpClient:       cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+				httpClient:       httpClient,
 				agbotId:          cfg.AgreementBot.ExchangeId,
 				token:            cfg.AgreementBot.ExchangeToken,
+				alm:              NewAgreementLockManager(),
 				deferredCommands: make([]AgreementWork, 0, 10),
 				messages:         messages,
+				ctx:              ctx,
+				cancel:           cancel,
 			},
-			genericAgreementPH: citizenscientist.NewProtocolHandler(cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil), pm),
-			Work:               make(chan AgreementWork),
+			genericAgreementPH: citizenscientist.NewProtocolHandler(httpClient, pm),
+			Work:               NewAgreementWorkQueue(cfg),
 			bcState:            make(map[string]map[string]map[string]*BlockchainState),
 			bcStateLock:        sync.Mutex{},
 		}
@@ -74,13 +80,32 @@ func (c *CSProtocolHandler) Initialize() {
 	// Set up random number gen. This is used to generate agreement id strings.
 	random := rand.New(rand.NewSource(int64(time.Now().Nanosecond())))
 
-	// Setup a lock to protect concurrent agreement processing
-	agreementLockMgr := NewAgreementLockManager()
-
-	// Set up agreement worker pool based on the current technical config.
-	for ix := 0; ix < c.config.AgreementBot.AgreementWorkers; ix++ {
-		agw := NewCSAgreementWorker(c, c.config, c.db, c.pm, agreementLockMgr)
-		go agw.start(c.Work, random)
+	// Report the agreement locks in use with the state of the work queue, and let the API list and flush the deferred cancels.
+	WQMetrics.TrackLocks(c.Name(), c.alm)
+	DeferredCancelQueues.Track(c.Name(), c)
+
+	// All the workers of this protocol share one webhook for agreement lifecycle notifications, if one is configured.
+	webhook := NewAgreementWebhook(c.config)
+
+	// Set up agreement worker pool based on the current technical config. All the workers share the agreement lock manager
+	// of the protocol handler, so that agreement locking is unaffected by workers coming and going, and by governance.
+	if DynamicAgreementWorkers(c.config) {
+		var pool *AgreementWorkerPool
+		pool = NewAgreementWorkerPool(c.Name(), c.config.AgreementBot.AgreementWorkers, c.config.AgreementBot.MaxAgreementWorkers, c.Work, func() {
+			agw := NewCSAgreementWorker(c, c.config, c.db, c.pm, c.alm)
+			agw.pool = pool
+			agw.webhook = webhook
+			agw.ctx = c.ctx
+			go agw.start(c.Work, random)
+		})
+		pool.Start(c.ctx.Done())
+	} else {
+		for ix := 0; ix < c.config.AgreementBot.AgreementWorkers; ix++ {
+			agw := NewCSAgreementWorker(c, c.config, c.db, c.pm, c.alm)
+			agw.webhook = webhook
+			agw.ctx = c.ctx
+			go agw.start(c.Work, random)
+		}
 	}
 
 }
@@ -189,7 +214,7 @@ func (c *CSProtocolHandler) HandleBlockchainEvent(cmd *BlockchainEventCommand) {
 				AgreementId: agreementId,
 				Protocol:    c.Name(),
 			}
-			c.Work <- agreementWork
+			queueWork(c, agreementWork)
 			glog.V(5).Infof(CPHlogString(fmt.Sprintf("queued blockchain agreement recorded event: %v", agreementWork)))
 
 			// If the event is a agreement terminated event
@@ -199,7 +224,7 @@ func (c *CSProtocolHandler) HandleBlockchainEvent(cmd *BlockchainEventCommand) {
 				AgreementId: agreementId,
 				Protocol:    c.Name(),
 			}
-			c.Work <- agreementWork
+			queueWork(c, agreementWork)
 			glog.V(5).Infof(CPHlogString(fmt.Sprintf("queued agreement cancellation due to blockchain termination event: %v", agreementWork)))
 		}
 	}
@@ -251,8 +276,10 @@ func (c *CSProtocolHandler) GetTerminationCode(reason string) uint {
 		return citizenscientist.AB_CANCEL_NODE_HEARTBEAT
 	case TERM_REASON_AG_MISSING:
 		return citizenscientist.AB_CANCEL_AG_MISSING
+	case TERM_REASON_PROPOSAL_TIMEOUT:
+		return citizenscientist.AB_CANCEL_PROPOSAL_TIMEOUT
 	default:
-		return 999
+		return TERM_CODE_UNMAPPED
 	}
 }
 
@@ -452,11 +479,22 @@ func (c *CSProtocolHandler) getBCNameMap(org string, typeName string) map[string
 func (c *CSProtocolHandler) HandleDeferredCommands() {
 	cmds := c.BaseConsumerProtocolHandler.GetDeferredCommands()
 	for _, aw := range cmds {
-		c.Work <- aw
+		queueWork(c, aw)
 		glog.V(5).Infof(CPHlogString(fmt.Sprintf("queued deferred agreement work %v for a CS worker", aw)))
 	}
 }
 
+// Queue the deferred blockchain cancels for the workers now, without waiting for the blockchains of the agreements to
+// become writable, e.g. to clear a backlog after a blockchain recovers. Returns the number of cancels queued.
+func (c *CSProtocolHandler) FlushDeferredCancels() int {
+	cancels := c.BaseConsumerProtocolHandler.takeDeferredCancels()
+	for _, cancel := range cancels {
+		queueWork(c, cancel)
+		glog.V(3).Infof(CPHlogString(fmt.Sprintf("queued forced deferred cancel of %v for a CS worker", cancel.AgreementId)))
+	}
+	return len(cancels)
+}
+
 func (c *CSProtocolHandler) PostReply(agreementId string, proposal abstractprotocol.Proposal, reply abstractprotocol.ProposalReply, consumerPolicy *policy.Policy, org string, workerId string) error {
 
 	agreement, err := FindSingleAgreementByAgreementId(c.db, agreementId, c.Name(), []AFilter{UnarchivedAFilter()})
@@ -491,7 +529,7 @@ func (c *CSProtocolHandler) PostReply(agreementId string, proposal abstractproto
 			})
 
 		} else {
-			c.messages <- events.NewNewBCContainerMessage(events.NEW_BC_CLIENT, agreement.BlockchainType, agreement.BlockchainName, agreement.BlockchainOrg, c.config.AgreementBot.ExchangeURL, c.agbotId, c.token)
+			c.messages <- events.NewNewBCContainerMessage(events.NEW_BC_CLIENT, agreement.BlockchainType, agreement.BlockchainName, agreement.BlockchainOrg, c.config.AgreementBot.GetExchangeURL(agreement.BlockchainOrg), c.agbotId, c.token)
 		}
 	}
 	return nil
@@ -510,7 +548,7 @@ func (c *CSProtocolHandler) HandleExtensionMessage(cmd *NewProtocolMessageComman
 			SenderPubKey: cmd.PubKey,
 			MessageId:    cmd.MessageId,
 		}
-		c.WorkQueue() <- agreementWork
+		queueWork(c, agreementWork)
 		glog.V(5).Infof(CPHlogString(fmt.Sprintf("queued producer update message")))
 
 	} else if updateAck, aerr := c.genericAgreementPH.ValidateBlockchainConsumerUpdateAck(string(cmd.Message)); aerr == nil {
@@ -521,7 +559,7 @@ func (c *CSProtocolHandler) HandleExtensionMessage(cmd *NewProtocolMessageComman
 			SenderPubKey: cmd.PubKey,
 			MessageId:    cmd.MessageId,
 		}
-		c.WorkQueue() <- agreementWork
+		queueWork(c, agreementWork)
 		glog.V(5).Infof(CPHlogString(fmt.Sprintf("queued consumer update ack message")))
 
 	} else {
@@ -547,6 +585,12 @@ func (c *CSProtocolHandler) CanSendMeterRecord(ag *Agreement) bool {
 	return ag.ProposalSig != "" && ag.ConsumerProposalSig != ""
 }
 
+// The protocol version is the lowest version supported by both the device and the agbot, the same way the proposal
+// chooses it.
+func (c *CSProtocolHandler) NegotiatedProtocolVersion(producerPolicy *policy.Policy, consumerPolicy *policy.Policy) int {
+	return producerPolicy.MinimumProtocolVersion(c.Name(), consumerPolicy, citizenscientist.PROTOCOL_CURRENT_VERSION)
+}
+
 // ==========================================================================================================
 // Utility functions
 
@@ -27,6 +27,40 @@ func Test_agreement_success1(t *testing.T) {
 
 }
 
+func Test_FlushDeferredCancels(t *testing.T) {
+
+	ph := createEmptyPH()
+	ph.Work = make(chan AgreementWork, 10)
+
+	ph.DeferCommand(AsyncCancelAgreement{workType: ASYNC_CANCEL, AgreementId: "ag1", Protocol: "test", Reason: 1, DeferredTime: 100})
+	ph.DeferCommand(AsyncWriteAgreement{workType: ASYNC_WRITE, AgreementId: "ag2", Protocol: "test"})
+	ph.DeferCommand(AsyncCancelAgreement{workType: ASYNC_CANCEL, AgreementId: "ag3", Protocol: "test", Reason: 2})
+
+	// The cancels are listed, with the time they were first deferred kept and the time of a new one set.
+	if dc := ph.DeferredCancels(); len(dc) != 2 {
+		t.Fatalf("Expected 2 deferred cancels, got %v", dc)
+	} else if dc[0].AgreementId != "ag1" || dc[0].Reason != 1 || dc[0].AgeS < 100 {
+		t.Errorf("Unexpected first deferred cancel %v", dc[0])
+	} else if dc[1].AgreementId != "ag3" || dc[1].Reason != 2 || dc[1].AgeS > 5 {
+		t.Errorf("Unexpected second deferred cancel %v", dc[1])
+	}
+
+	// Flushing queues only the cancels, forced, and leaves the other deferred commands in place.
+	if n := ph.FlushDeferredCancels(); n != 2 {
+		t.Errorf("Expected 2 cancels to be flushed, got %v", n)
+	}
+	for _, id := range []string{"ag1", "ag3"} {
+		if cancel, ok := (<-ph.Work).(AsyncCancelAgreement); !ok || cancel.AgreementId != id || !cancel.Force {
+			t.Errorf("Expected forced cancel of %v to be queued, got %v", id, cancel)
+		}
+	}
+	if dc := ph.DeferredCancels(); len(dc) != 0 {
+		t.Errorf("Expected no deferred cancels after the flush, got %v", dc)
+	} else if cmds := ph.GetDeferredCommands(); len(cmds) != 1 || cmds[0].Type() != ASYNC_WRITE {
+		t.Errorf("Expected the deferred write to be kept, got %v", cmds)
+	}
+}
+
 // Utility to help create the testing context
 func createEmptyPH() *CSProtocolHandler {
 	return &CSProtocolHandler{
@@ -49,7 +83,7 @@ func createEmptyPH() *CSProtocolHandler {
 }
 
 func createAgreement(proposal string, pol string, agpVersion int, bcType string, bcName string, bcOrg string) (*Agreement, error) {
-	if ag, err := agreement("testagid", "testorg", "deviceid", "testpolicy", bcType, bcName, bcOrg, "Citizen Scientist", "apattern", policy.NodeHealth{}); err != nil {
+	if ag, err := agreement("testagid", "testorg", "deviceid", "testpolicy", bcType, bcName, bcOrg, "Citizen Scientist", "apattern", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
 		return nil, err
 	} else {
 		prop := new(citizenscientist.CSProposal)
@@ -67,3 +101,49 @@ func createAgreement(proposal string, pol string, agpVersion int, bcType string,
 		}
 	}
 }
+
+func Test_NegotiatedProtocolVersion(t *testing.T) {
+
+	ph := createEmptyPH()
+	ph.name = citizenscientist.PROTOCOL_NAME
+
+	consumer := &policy.Policy{AgreementProtocols: policy.AgreementProtocolList{{Name: citizenscientist.PROTOCOL_NAME}}}
+	for producerVersion, expected := range map[int]int{0: 1, 1: 1, 2: 2, 3: citizenscientist.PROTOCOL_CURRENT_VERSION} {
+		producer := &policy.Policy{AgreementProtocols: policy.AgreementProtocolList{{Name: citizenscientist.PROTOCOL_NAME, ProtocolVersion: producerVersion}}}
+		if v := ph.NegotiatedProtocolVersion(producer, consumer); v != expected {
+			t.Errorf("expected version %v for a device supporting version %v, got %v", expected, producerVersion, v)
+		}
+	}
+
+	// A consumer policy can hold the version down.
+	consumer = &policy.Policy{AgreementProtocols: policy.AgreementProtocolList{{Name: citizenscientist.PROTOCOL_NAME, ProtocolVersion: 1}}}
+	producer := &policy.Policy{AgreementProtocols: policy.AgreementProtocolList{{Name: citizenscientist.PROTOCOL_NAME, ProtocolVersion: 2}}}
+	if v := ph.NegotiatedProtocolVersion(producer, consumer); v != 1 {
+		t.Errorf("expected version 1, got %v", v)
+	}
+}
+
+func Test_retryCause(t *testing.T) {
+
+	ph := createEmptyPH()
+
+	if c := retryCause(ph, ph.GetTerminationCode(TERM_REASON_CANCEL_BC_WRITE_FAILED)); c != WU_RETRY_AGBOT {
+		t.Errorf("expected a blockchain write failure to be charged to the agbot, got %v", c)
+	} else if c := retryCause(ph, ph.GetTerminationCode(TERM_REASON_NEGATIVE_REPLY)); c != WU_RETRY_DEVICE {
+		t.Errorf("expected a negative reply to be charged to the device, got %v", c)
+	} else if c := retryCause(ph, ph.GetTerminationCode(TERM_REASON_NO_DATA_RECEIVED)); c != WU_RETRY_DEVICE {
+		t.Errorf("expected missing data to be charged to the device, got %v", c)
+	}
+
+	// The basic protocol has no code for a blockchain write failure, so its unmapped code must not be taken for one.
+	bph := &BasicProtocolHandler{}
+	if c := retryCause(bph, bph.GetTerminationCode(TERM_REASON_CANCEL_BC_WRITE_FAILED)); c != WU_RETRY_UNKNOWN {
+		t.Errorf("expected an unmapped reason to have an unknown cause, got %v", c)
+	} else if c := retryCause(bph, bph.GetTerminationCode("SomeNewReason")); c != WU_RETRY_UNKNOWN {
+		t.Errorf("expected an unmapped reason to have an unknown cause, got %v", c)
+	} else if c := retryCause(bph, bph.GetTerminationCode(TERM_REASON_USER_REQUESTED)); c != WU_RETRY_AGBOT {
+		t.Errorf("expected a user request to be charged to the agbot, got %v", c)
+	} else if c := retryCause(bph, bph.GetTerminationCode(TERM_REASON_NEGATIVE_REPLY)); c != WU_RETRY_DEVICE {
+		t.Errorf("expected a negative reply to be charged to the device, got %v", c)
+	}
+}
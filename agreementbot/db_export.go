@@ -0,0 +1,115 @@
+package agreementbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/policy"
+	"io"
+	"time"
+)
+
+// The version of the export format written by ExportDB. ImportDB reads exports up to and including this version, newer
+// versions are rejected because they might contain records this agbot does not understand.
+const DB_EXPORT_VERSION = 1
+
+// The serialized form of an agbot database export.
+type DBExport struct {
+	Version        int             `json:"version"`         // the version of the export format
+	ExportTime     uint64          `json:"export_time"`     // time when the export was taken
+	Agreements     []Agreement     `json:"agreements"`      // the unarchived agreements of all agreement protocols
+	WorkloadUsages []WorkloadUsage `json:"workload_usages"` // all workload usage records
+}
+
+// The outcome of an import.
+type DBImportResult struct {
+	Agreements            int `json:"agreements"`              // the number of agreements imported
+	SkippedAgreements     int `json:"skipped_agreements"`      // the number of agreements skipped because they already exist
+	WorkloadUsages        int `json:"workload_usages"`         // the number of workload usage records imported
+	SkippedWorkloadUsages int `json:"skipped_workload_usages"` // the number of workload usage records skipped because they already exist
+}
+
+func (r DBImportResult) String() string {
+	return fmt.Sprintf("Agreements: %v, SkippedAgreements: %v, WorkloadUsages: %v, SkippedWorkloadUsages: %v",
+		r.Agreements, r.SkippedAgreements, r.WorkloadUsages, r.SkippedWorkloadUsages)
+}
+
+// Write all unarchived agreements and all workload usage records in the database to the writer as JSON, so that they can
+// be backed up or loaded into another agbot with ImportDB.
+func ExportDB(db *bolt.DB, w io.Writer) error {
+
+	export := DBExport{
+		Version:        DB_EXPORT_VERSION,
+		ExportTime:     uint64(time.Now().Unix()),
+		Agreements:     make([]Agreement, 0, 10),
+		WorkloadUsages: make([]WorkloadUsage, 0, 10),
+	}
+
+	for _, agp := range policy.AllAgreementProtocols() {
+		if ags, err := FindAgreements(db, []AFilter{UnarchivedAFilter()}, agp); err != nil {
+			return errors.New(fmt.Sprintf("unable to read %v agreements for export, error: %v", agp, err))
+		} else {
+			export.Agreements = append(export.Agreements, ags...)
+		}
+	}
+
+	if wlUsages, err := FindWorkloadUsages(db, []WUFilter{}); err != nil {
+		return errors.New(fmt.Sprintf("unable to read workload usages for export, error: %v", err))
+	} else {
+		export.WorkloadUsages = append(export.WorkloadUsages, wlUsages...)
+	}
+
+	if err := json.NewEncoder(w).Encode(export); err != nil {
+		return errors.New(fmt.Sprintf("unable to write export, error: %v", err))
+	}
+
+	glog.V(3).Infof("Exported %v agreements and %v workload usages", len(export.Agreements), len(export.WorkloadUsages))
+	return nil
+}
+
+// Load an export written by ExportDB into the database. Agreements that already exist, and workload usages that already
+// exist for the same device and policy, are skipped. Workload usage records are given new record ids from the database.
+func ImportDB(db *bolt.DB, r io.Reader) (*DBImportResult, error) {
+
+	var export DBExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to read export, error: %v", err))
+	} else if export.Version < 1 || export.Version > DB_EXPORT_VERSION {
+		return nil, errors.New(fmt.Sprintf("unsupported export version %v, this agbot supports versions 1 through %v", export.Version, DB_EXPORT_VERSION))
+	}
+
+	result := &DBImportResult{}
+
+	for _, ag := range export.Agreements {
+		if !policy.SupportedAgreementProtocol(ag.AgreementProtocol) {
+			return result, errors.New(fmt.Sprintf("agreement %v has unsupported agreement protocol %v", ag.CurrentAgreementId, ag.AgreementProtocol))
+		} else if existing, err := FindSingleAgreementByAgreementId(db, ag.CurrentAgreementId, ag.AgreementProtocol, []AFilter{}); err != nil {
+			return result, errors.New(fmt.Sprintf("unable to search for agreement %v, error: %v", ag.CurrentAgreementId, err))
+		} else if existing != nil {
+			glog.V(3).Infof("Skipping import of agreement %v, it already exists", ag.CurrentAgreementId)
+			result.SkippedAgreements++
+		} else if err := PersistNew(db, ag.CurrentAgreementId, bucketName(ag.AgreementProtocol), &ag); err != nil {
+			return result, errors.New(fmt.Sprintf("unable to import agreement %v, error: %v", ag.CurrentAgreementId, err))
+		} else {
+			result.Agreements++
+		}
+	}
+
+	for _, wlUsage := range export.WorkloadUsages {
+		if existing, err := FindSingleWorkloadUsageByDeviceAndPolicyName(db, wlUsage.DeviceId, wlUsage.PolicyName); err != nil {
+			return result, errors.New(fmt.Sprintf("unable to search for workload usage for device %v and policy %v, error: %v", wlUsage.DeviceId, wlUsage.PolicyName, err))
+		} else if existing != nil {
+			glog.V(3).Infof("Skipping import of workload usage for device %v and policy %v, it already exists", wlUsage.DeviceId, wlUsage.PolicyName)
+			result.SkippedWorkloadUsages++
+		} else if err := WUPersistNew(db, wuBucketName(), &wlUsage); err != nil {
+			return result, errors.New(fmt.Sprintf("unable to import workload usage for device %v and policy %v, error: %v", wlUsage.DeviceId, wlUsage.PolicyName, err))
+		} else {
+			result.WorkloadUsages++
+		}
+	}
+
+	glog.V(3).Infof("Imported database export taken at %v: %v", export.ExportTime, result)
+	return result, nil
+}
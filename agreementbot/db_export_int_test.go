@@ -0,0 +1,72 @@
+// +build integration
+
+package agreementbot
+
+import (
+	"bytes"
+	"github.com/boltdb/bolt"
+	"github.com/open-horizon/anax/policy"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ExportImportDB(t *testing.T) {
+
+	if err := AgreementAttempt(testDb, "export1", "myorg", "myorg/exportdev1", "export policy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+		t.Errorf("Received error creating agreement: %v", err)
+	} else if err := AgreementAttempt(testDb, "export2", "myorg", "myorg/exportdev2", "export policy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+		t.Errorf("Received error creating agreement: %v", err)
+	} else if _, err := ArchiveAgreement(testDb, "export2", "Basic", 0, "", ""); err != nil {
+		t.Errorf("Received error archiving agreement: %v", err)
+	} else if err := NewWorkloadUsage(testDb, "myorg/exportdev1", []string{}, "", "export policy", 1, 30, 180, false, "export1"); err != nil {
+		t.Errorf("Received error creating new workload usage: %v", err)
+	}
+
+	var export bytes.Buffer
+	if err := ExportDB(testDb, &export); err != nil {
+		t.Fatalf("Received error exporting database: %v", err)
+	}
+
+	dbFile, err := ioutil.TempFile("", "agreementbot_import_test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dbFile.Name())
+
+	db, err := bolt.Open(dbFile.Name(), 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Seed the fresh database with one of the exported workload usages so that it is skipped.
+	if err := NewWorkloadUsage(db, "myorg/exportdev1", []string{}, "", "export policy", 2, 30, 180, false, "export1"); err != nil {
+		t.Errorf("Received error creating new workload usage: %v", err)
+	}
+
+	if result, err := ImportDB(db, bytes.NewReader(export.Bytes())); err != nil {
+		t.Errorf("Received error importing database: %v", err)
+	} else if result.SkippedWorkloadUsages != 1 || result.Agreements == 0 {
+		t.Errorf("Expected agreements to be imported and the existing workload usage to be skipped, got %v", result)
+	} else if ag, err := FindSingleAgreementByAgreementId(db, "export1", "Basic", []AFilter{}); err != nil || ag == nil || ag.DeviceId != "myorg/exportdev1" {
+		t.Errorf("Expected agreement export1 to be imported, got %v, error %v", ag, err)
+	} else if ag, err := FindSingleAgreementByAgreementId(db, "export2", "Basic", []AFilter{}); err != nil || ag != nil {
+		t.Errorf("Expected archived agreement export2 not to be imported, got %v, error %v", ag, err)
+	} else if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(db, "myorg/exportdev1", "export policy"); err != nil || wlu.Priority != 2 {
+		t.Errorf("Expected the existing workload usage to be kept, got %v, error %v", wlu, err)
+	}
+
+	// Importing the same export again skips everything.
+	if result, err := ImportDB(db, bytes.NewReader(export.Bytes())); err != nil {
+		t.Errorf("Received error importing database: %v", err)
+	} else if result.Agreements != 0 || result.WorkloadUsages != 0 {
+		t.Errorf("Expected all records to be skipped, got %v", result)
+	}
+
+	if _, err := ImportDB(db, strings.NewReader(`{"version":99}`)); err == nil {
+		t.Errorf("Expected an export with a newer version to be rejected")
+	}
+}
@@ -0,0 +1,114 @@
+package agreementbot
+
+import (
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/policy"
+)
+
+// The kinds of inconsistency found by CheckDBIntegrity.
+const DBI_WLU_ARCHIVED_AGREEMENT = "workload usage references an archived agreement" // safe to repair by clearing the agreement id
+const DBI_WLU_MISSING_AGREEMENT = "workload usage references a missing agreement"    // might be an agreement that is still being initiated
+const DBI_AGREEMENT_MISSING_WLU = "agreement has no workload usage"                  // the agreement's workload has a priority but there is no usage record
+
+// An inconsistency between the agreement and workload usage records.
+type DBIntegrityProblem struct {
+	Kind        string `json:"kind"`         // one of the DBI_ constants
+	DeviceId    string `json:"device_id"`    // the device of the inconsistent records
+	PolicyName  string `json:"policy_name"`  // the policy of the inconsistent records
+	AgreementId string `json:"agreement_id"` // the agreement id involved in the inconsistency
+	Repaired    bool   `json:"repaired"`     // the inconsistency was repaired
+}
+
+func (p DBIntegrityProblem) String() string {
+	return fmt.Sprintf("Kind: %v, DeviceId: %v, PolicyName: %v, AgreementId: %v, Repaired: %v", p.Kind, p.DeviceId, p.PolicyName, p.AgreementId, p.Repaired)
+}
+
+// Scan the agreement and workload usage records for inconsistencies. When repair is true, the inconsistencies that are safe
+// to repair are repaired, the others are only reported.
+func CheckDBIntegrity(db *bolt.DB, repair bool) ([]DBIntegrityProblem, error) {
+
+	problems := make([]DBIntegrityProblem, 0, 5)
+
+	agreements := make(map[string]Agreement)
+	for _, agp := range policy.AllAgreementProtocols() {
+		if ags, err := FindAgreements(db, []AFilter{}, agp); err != nil {
+			return nil, errors.New(fmt.Sprintf("unable to read %v agreements, error: %v", agp, err))
+		} else {
+			for _, ag := range ags {
+				agreements[ag.CurrentAgreementId] = ag
+			}
+		}
+	}
+
+	wlUsages, err := FindWorkloadUsages(db, []WUFilter{})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to read workload usages, error: %v", err))
+	}
+
+	// Look for workload usages whose agreement has ended without the usage record being told.
+	hasUsage := make(map[string]bool)
+	for _, wlu := range wlUsages {
+		hasUsage[wlu.DeviceId+"/"+wlu.PolicyName] = true
+		if wlu.CurrentAgreementId == "" {
+			continue
+		}
+
+		problem := DBIntegrityProblem{DeviceId: wlu.DeviceId, PolicyName: wlu.PolicyName, AgreementId: wlu.CurrentAgreementId}
+		if ag, ok := agreements[wlu.CurrentAgreementId]; !ok {
+			problem.Kind = DBI_WLU_MISSING_AGREEMENT
+		} else if ag.Archived {
+			problem.Kind = DBI_WLU_ARCHIVED_AGREEMENT
+			if repair {
+				if err := clearWUAgreementId(db, wlu.DeviceId, wlu.PolicyName, wlu.CurrentAgreementId); err != nil {
+					glog.Errorf(logString(fmt.Sprintf("unable to clear agreement id %v from workload usage for %v with policy %v, error: %v", wlu.CurrentAgreementId, wlu.DeviceId, wlu.PolicyName, err)))
+				} else {
+					problem.Repaired = true
+				}
+			}
+		} else {
+			continue
+		}
+		problems = append(problems, problem)
+	}
+
+	// Look for finalized agreements whose workload has a priority, but have no workload usage to track the priority.
+	for _, ag := range agreements {
+		if ag.Archived || ag.AgreementFinalizedTime == 0 || hasUsage[ag.DeviceId+"/"+ag.PolicyName] || !agreementWorkloadHasPriority(&ag) {
+			continue
+		}
+		problems = append(problems, DBIntegrityProblem{Kind: DBI_AGREEMENT_MISSING_WLU, DeviceId: ag.DeviceId, PolicyName: ag.PolicyName, AgreementId: ag.CurrentAgreementId})
+	}
+
+	return problems, nil
+}
+
+// Returns true if the workload chosen for the agreement has a priority in the agreement's policy. Agreements made before the
+// chosen workload was recorded are assumed to have no priority.
+func agreementWorkloadHasPriority(ag *Agreement) bool {
+	if ag.WorkloadURL == "" || ag.Policy == "" {
+		return false
+	} else if pol, err := policy.DemarshalPolicy(ag.Policy); err != nil {
+		return false
+	} else {
+		for _, wl := range pol.Workloads {
+			if wl.WorkloadURL == ag.WorkloadURL && wl.Version == ag.WorkloadVersion && wl.Arch == ag.WorkloadArch {
+				return !wl.HasEmptyPriority()
+			}
+		}
+		return false
+	}
+}
+
+// Clear the agreement id of the workload usage, unless the usage has moved on to another agreement since it was checked.
+func clearWUAgreementId(db *bolt.DB, deviceid string, policyName string, agid string) error {
+	_, err := singleWorkloadUsageUpdate(db, deviceid, policyName, WU_REASON_INTEGRITY_REPAIR, func(w WorkloadUsage) *WorkloadUsage {
+		if w.CurrentAgreementId == agid {
+			w.CurrentAgreementId = ""
+		}
+		return &w
+	})
+	return err
+}
@@ -0,0 +1,82 @@
+// +build integration
+
+package agreementbot
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/open-horizon/anax/policy"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_CheckDBIntegrity(t *testing.T) {
+
+	dbFile, err := ioutil.TempFile("", "agreementbot_integrity_test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dbFile.Name())
+
+	db, err := bolt.Open(dbFile.Name(), 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// dev1 has a workload usage for an archived agreement, dev2 for an agreement that doesnt exist, and dev3 has a finalized
+	// agreement for a workload with a priority but no workload usage.
+	wl := &policy.Workload{WorkloadURL: "cpu", Version: "1.0.0", Arch: "amd64"}
+	pol := `{"header":{"name":"p3"},"workloads":[{"workloadUrl":"cpu","version":"1.0.0","arch":"amd64","priority":{"priority_value":1}}]}`
+	if err := AgreementAttempt(db, "ag1", "myorg", "myorg/dev1", "p1", "", "", "", "Basic", "", policy.NodeHealth{}, wl, nil); err != nil {
+		t.Fatalf("Received error creating agreement: %v", err)
+	} else if _, err := ArchiveAgreement(db, "ag1", "Basic", 0, "", ""); err != nil {
+		t.Fatalf("Received error archiving agreement: %v", err)
+	} else if err := NewWorkloadUsage(db, "myorg/dev1", []string{}, "", "p1", 1, 30, 180, false, "ag1"); err != nil {
+		t.Fatalf("Received error creating workload usage: %v", err)
+	} else if err := NewWorkloadUsage(db, "myorg/dev2", []string{}, "", "p2", 1, 30, 180, false, "ag2"); err != nil {
+		t.Fatalf("Received error creating workload usage: %v", err)
+	} else if err := AgreementAttempt(db, "ag3", "myorg", "myorg/dev3", "p3", "", "", "", "Basic", "", policy.NodeHealth{}, wl, nil); err != nil {
+		t.Fatalf("Received error creating agreement: %v", err)
+	} else if _, err := AgreementUpdate(db, "ag3", "", pol, policy.DataVerification{}, 0, "", "", "Basic", 1); err != nil {
+		t.Fatalf("Received error updating agreement: %v", err)
+	} else if _, err := AgreementFinalized(db, "ag3", "Basic"); err != nil {
+		t.Fatalf("Received error finalizing agreement: %v", err)
+	}
+
+	// Detect only.
+	expected := map[string]string{"ag1": DBI_WLU_ARCHIVED_AGREEMENT, "ag2": DBI_WLU_MISSING_AGREEMENT, "ag3": DBI_AGREEMENT_MISSING_WLU}
+	if problems, err := CheckDBIntegrity(db, false); err != nil {
+		t.Errorf("Received error checking integrity: %v", err)
+	} else if len(problems) != len(expected) {
+		t.Errorf("Expected %v problems, got %v", len(expected), problems)
+	} else {
+		for _, p := range problems {
+			if expected[p.AgreementId] != p.Kind || p.Repaired {
+				t.Errorf("Unexpected problem %v", p)
+			}
+		}
+	}
+
+	// Only the archived agreement is repaired, and the repair sticks.
+	if problems, err := CheckDBIntegrity(db, true); err != nil {
+		t.Errorf("Received error checking integrity: %v", err)
+	} else {
+		for _, p := range problems {
+			if p.Repaired != (p.AgreementId == "ag1") {
+				t.Errorf("Unexpected repair of problem %v", p)
+			}
+		}
+	}
+
+	if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(db, "myorg/dev1", "p1"); err != nil {
+		t.Errorf("Received error finding workload usage: %v", err)
+	} else if wlu == nil || wlu.CurrentAgreementId != "" {
+		t.Errorf("Expected the agreement id to be cleared, got %v", wlu)
+	} else if problems, err := CheckDBIntegrity(db, true); err != nil {
+		t.Errorf("Received error checking integrity: %v", err)
+	} else if len(problems) != 2 {
+		t.Errorf("Expected 2 unrepaired problems, got %v", problems)
+	}
+}
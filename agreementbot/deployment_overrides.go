@@ -0,0 +1,82 @@
+package agreementbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/open-horizon/anax/exchange"
+	"github.com/open-horizon/anax/policy"
+	"io/ioutil"
+	"strings"
+)
+
+// A DeploymentOverride is a set of workload deployment overrides that applies to a group of devices. A device is in
+// the group when it is in the Org (if set) and advertises the Property (if set, of the form name=value). The overrides
+// use the same format as the deployment overrides in a pattern, and must be signed by a key the devices trust,
+// because the device verifies them before using them.
+type DeploymentOverride struct {
+	Org                          string `json:"org,omitempty"`
+	Property                     string `json:"property,omitempty"`
+	DeploymentOverrides          string `json:"deployment_overrides"`           // env var overrides for the workload
+	DeploymentOverridesSignature string `json:"deployment_overrides_signature"` // signature of env var overrides
+}
+
+func (d DeploymentOverride) String() string {
+	return fmt.Sprintf("Org: %v, Property: %v", d.Org, d.Property)
+}
+
+// The name of the device group the overrides apply to, as recorded on the agreement.
+func (d DeploymentOverride) Group() string {
+	if d.Org != "" && d.Property != "" {
+		return d.Org + "," + d.Property
+	}
+	return d.Org + d.Property
+}
+
+// Returns true if the device with the input id and producer policy is in the group of this override.
+func (d DeploymentOverride) Matches(deviceId string, producerPolicy *policy.Policy) bool {
+	if d.Org != "" && exchange.GetOrg(deviceId) != d.Org {
+		return false
+	}
+	if d.Property != "" {
+		pieces := strings.SplitN(d.Property, "=", 2)
+		for _, prop := range producerPolicy.Properties {
+			if prop.Name == pieces[0] && fmt.Sprintf("%v", prop.Value) == pieces[1] {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Read the deployment overrides file. The file contains a JSON array of DeploymentOverride objects.
+func LoadDeploymentOverrides(path string) ([]DeploymentOverride, error) {
+	overrides := make([]DeploymentOverride, 0, 5)
+	if fileBytes, err := ioutil.ReadFile(path); err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to read deployment overrides file %v, error: %v", path, err))
+	} else if err := json.Unmarshal(fileBytes, &overrides); err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to demarshal deployment overrides file %v, error: %v", path, err))
+	}
+
+	for ix, o := range overrides {
+		if o.Org == "" && o.Property == "" {
+			return nil, errors.New(fmt.Sprintf("deployment override %v in %v must specify an org or a property", ix, path))
+		} else if o.Property != "" && !strings.Contains(o.Property, "=") {
+			return nil, errors.New(fmt.Sprintf("deployment override %v in %v has property %v, it must be of the form name=value", ix, path, o.Property))
+		} else if o.DeploymentOverrides == "" || o.DeploymentOverridesSignature == "" {
+			return nil, errors.New(fmt.Sprintf("deployment override %v in %v must specify deployment_overrides and deployment_overrides_signature", ix, path))
+		}
+	}
+	return overrides, nil
+}
+
+// Returns the first override in the list whose device group contains the device, or nil if there is none.
+func MatchDeploymentOverride(overrides []DeploymentOverride, deviceId string, producerPolicy *policy.Policy) *DeploymentOverride {
+	for ix := range overrides {
+		if overrides[ix].Matches(deviceId, producerPolicy) {
+			return &overrides[ix]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"github.com/open-horizon/anax/policy"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_LoadDeploymentOverrides(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "overrides-")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "overrides.json")
+	if err := ioutil.WriteFile(path, []byte(`[{"property":"tier=gold","deployment_overrides":"{\"services\":{\"cpu\":{\"environment\":[\"MODE=fast\"]}}}","deployment_overrides_signature":"sig1"},{"org":"myorg","deployment_overrides":"{}","deployment_overrides_signature":"sig2"}]`), 0660); err != nil {
+		t.Error(err)
+	}
+
+	if overrides, err := LoadDeploymentOverrides(path); err != nil {
+		t.Errorf("unexpected error %v", err)
+	} else if len(overrides) != 2 || overrides[0].Property != "tier=gold" || overrides[1].Org != "myorg" {
+		t.Errorf("unexpected overrides %v", overrides)
+	}
+
+	// An entry without a device group is an error.
+	if err := ioutil.WriteFile(path, []byte(`[{"deployment_overrides":"{}","deployment_overrides_signature":"sig"}]`), 0660); err != nil {
+		t.Error(err)
+	}
+	if _, err := LoadDeploymentOverrides(path); err == nil || !strings.Contains(err.Error(), "must specify an org or a property") {
+		t.Errorf("expected device group error, got %v", err)
+	}
+
+	// Unsigned overrides are an error.
+	if err := ioutil.WriteFile(path, []byte(`[{"property":"tier=gold","deployment_overrides":"{}"}]`), 0660); err != nil {
+		t.Error(err)
+	}
+	if _, err := LoadDeploymentOverrides(path); err == nil || !strings.Contains(err.Error(), "deployment_overrides_signature") {
+		t.Errorf("expected signature error, got %v", err)
+	}
+}
+
+func Test_MatchDeploymentOverride(t *testing.T) {
+
+	overrides := []DeploymentOverride{
+		{Org: "org1", Property: "tier=gold", DeploymentOverrides: "a", DeploymentOverridesSignature: "sa"},
+		{Property: "tier=gold", DeploymentOverrides: "b", DeploymentOverridesSignature: "sb"},
+		{Org: "org2", DeploymentOverrides: "c", DeploymentOverridesSignature: "sc"},
+	}
+
+	gold := &policy.Policy{Properties: policy.PropertyList{{Name: "tier", Value: "gold"}}}
+	silver := &policy.Policy{Properties: policy.PropertyList{{Name: "tier", Value: "silver"}}}
+
+	if o := MatchDeploymentOverride(overrides, "org1/dev1", gold); o == nil || o.DeploymentOverrides != "a" || o.Group() != "org1,tier=gold" {
+		t.Errorf("expected the org and property override, got %v", o)
+	} else if o := MatchDeploymentOverride(overrides, "org3/dev1", gold); o == nil || o.DeploymentOverrides != "b" || o.Group() != "tier=gold" {
+		t.Errorf("expected the property override, got %v", o)
+	} else if o := MatchDeploymentOverride(overrides, "org2/dev1", silver); o == nil || o.DeploymentOverrides != "c" || o.Group() != "org2" {
+		t.Errorf("expected the org override, got %v", o)
+	} else if o := MatchDeploymentOverride(overrides, "org3/dev1", silver); o != nil {
+		t.Errorf("expected no override, got %v", o)
+	}
+}
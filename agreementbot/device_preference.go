@@ -0,0 +1,78 @@
+package agreementbot
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/exchange"
+	"sort"
+	"strings"
+)
+
+// Order the devices returned by an exchange search so that the devices the agbot is configured to prefer are
+// processed first. A device scores one point for being in one of the PreferDeviceOrgs and one point for each of the
+// PreferDeviceProps that it advertises on any of its microservices. Devices are ordered by descending score. Ties are
+// broken by keeping the order in which the exchange returned the devices, so when no preferences are configured the
+// search result is returned unchanged. If PreferredDevicesOnly is set, devices with a score of zero are removed.
+//
+// Note that devices found by a pattern search do not carry microservices, so only the org preference applies to them.
+func preferDevices(devices []exchange.SearchResultDevice, cfg *config.AGConfig) []exchange.SearchResultDevice {
+
+	if cfg.PreferDeviceOrgs == "" && cfg.PreferDeviceProps == "" {
+		return devices
+	}
+
+	scores := make(map[string]int)
+	res := make([]exchange.SearchResultDevice, 0, len(devices))
+	for _, dev := range devices {
+		score := deviceScore(&dev, cfg)
+		if score == 0 && cfg.PreferredDevicesOnly {
+			glog.V(5).Infof(AWlogString(fmt.Sprintf("skipping device %v, it does not match any device preferences", dev.Id)))
+			continue
+		}
+		scores[dev.Id] = score
+		res = append(res, dev)
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return scores[res[i].Id] > scores[res[j].Id]
+	})
+
+	return res
+}
+
+// Compute the preference score of a device, see preferDevices.
+func deviceScore(dev *exchange.SearchResultDevice, cfg *config.AGConfig) int {
+
+	score := 0
+	if cfg.PreferDeviceOrgs != "" && listContains(cfg.PreferDeviceOrgs, exchange.GetOrg(dev.Id)) {
+		score += 1
+	}
+
+	if cfg.PreferDeviceProps == "" {
+		return score
+	}
+
+	for _, pref := range strings.Split(cfg.PreferDeviceProps, ",") {
+		pieces := strings.SplitN(pref, "=", 2)
+		if len(pieces) != 2 {
+			glog.Warningf(AWlogString(fmt.Sprintf("ignoring device property preference %v, it must be of the form name=value", pref)))
+			continue
+		}
+		if deviceHasProperty(dev, pieces[0], pieces[1]) {
+			score += 1
+		}
+	}
+	return score
+}
+
+func deviceHasProperty(dev *exchange.SearchResultDevice, name string, value string) bool {
+	for _, ms := range dev.Microservices {
+		for _, prop := range ms.Properties {
+			if prop.Name == name && prop.Value == value {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/exchange"
+	"testing"
+)
+
+func Test_preferDevices_none(t *testing.T) {
+
+	devs := testPreferenceDevices()
+	cfg := &config.AGConfig{}
+
+	res := preferDevices(devs, cfg)
+	if len(res) != 3 || res[0].Id != "org1/d1" || res[1].Id != "org2/d2" || res[2].Id != "org2/d3" {
+		t.Errorf("device order should be unchanged, got %v", res)
+	}
+}
+
+func Test_preferDevices_order(t *testing.T) {
+
+	devs := testPreferenceDevices()
+	cfg := &config.AGConfig{PreferDeviceOrgs: "org2", PreferDeviceProps: "tier=gold"}
+
+	// d3 matches org and property, d2 matches org only, d1 matches nothing.
+	res := preferDevices(devs, cfg)
+	if len(res) != 3 || res[0].Id != "org2/d3" || res[1].Id != "org2/d2" || res[2].Id != "org1/d1" {
+		t.Errorf("wrong device order, got %v", res)
+	}
+
+	// Ties keep the search order.
+	cfg = &config.AGConfig{PreferDeviceOrgs: "org2"}
+	res = preferDevices(devs, cfg)
+	if len(res) != 3 || res[0].Id != "org2/d2" || res[1].Id != "org2/d3" || res[2].Id != "org1/d1" {
+		t.Errorf("wrong device order, got %v", res)
+	}
+}
+
+func Test_preferDevices_only(t *testing.T) {
+
+	devs := testPreferenceDevices()
+	cfg := &config.AGConfig{PreferDeviceProps: "tier=gold", PreferredDevicesOnly: true}
+
+	res := preferDevices(devs, cfg)
+	if len(res) != 1 || res[0].Id != "org2/d3" {
+		t.Errorf("only the preferred device should be returned, got %v", res)
+	}
+}
+
+func testPreferenceDevices() []exchange.SearchResultDevice {
+	gold := []exchange.Microservice{{Url: "ms1", Properties: []exchange.MSProp{{Name: "tier", Value: "gold"}}}}
+	silver := []exchange.Microservice{{Url: "ms1", Properties: []exchange.MSProp{{Name: "tier", Value: "silver"}}}}
+	return []exchange.SearchResultDevice{
+		{Id: "org1/d1", Microservices: silver},
+		{Id: "org2/d2"},
+		{Id: "org2/d3", Microservices: gold},
+	}
+}
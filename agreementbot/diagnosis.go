@@ -0,0 +1,120 @@
+package agreementbot
+
+import (
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/policy"
+)
+
+// An explanation of why a device has no active agreement for a policy, assembled from the agbot's records of the device.
+type DeviceDiagnosis struct {
+	DeviceId          string              `json:"device_id"`                    // the diagnosed device
+	PolicyName        string              `json:"policy_name"`                  // the diagnosed policy
+	Agreements        []Agreement         `json:"agreements"`                   // the unarchived agreements with the device for the policy
+	WorkloadUsage     *WorkloadUsage      `json:"workload_usage,omitempty"`     // the workload usage record of the device and policy
+	Blacklist         *DeviceBlacklist    `json:"blacklist,omitempty"`          // the active blacklist of the device
+	Cooldown          *CancelCooldown     `json:"cooldown,omitempty"`           // the active cancel cooldown of the device and policy
+	ExcludedWorkloads []WorkloadRejection `json:"excluded_workloads,omitempty"` // the workloads of the policy that WorkloadArches, WorkloadOrgs or DeniedWorkloadVersions exclude
+	LastSelection     *WorkloadSelection  `json:"last_selection,omitempty"`     // the outcome of the most recent attempt to choose a workload
+	Reasons           []string            `json:"reasons"`                      // the reasons there is no active agreement, most significant first
+}
+
+func (d DeviceDiagnosis) String() string {
+	return fmt.Sprintf("DeviceId: %v, PolicyName: %v, Reasons: %v", d.DeviceId, d.PolicyName, d.Reasons)
+}
+
+// Explain why the device has no active agreement for the policy. The workloads of the policy are checked against the
+// configured workload arches, orgs and denied versions when the policy is known from the workload usage record or an
+// agreement.
+func DiagnoseDevice(db *bolt.DB, agConfig *config.AGConfig, deviceId string, policyName string) (*DeviceDiagnosis, error) {
+
+	d := &DeviceDiagnosis{DeviceId: deviceId, PolicyName: policyName, Agreements: []Agreement{}, Reasons: []string{}}
+	polString, polOrg := "", ""
+
+	for _, agp := range policy.AllAgreementProtocols() {
+		if ags, err := FindAgreements(db, []AFilter{DevPolAFilter(deviceId, policyName)}, agp); err != nil {
+			return nil, errors.New(fmt.Sprintf("unable to read %v agreements, error: %v", agp, err))
+		} else {
+			for _, ag := range ags {
+				if !ag.Archived {
+					d.Agreements = append(d.Agreements, ag)
+				}
+				if ag.Policy != "" {
+					polString, polOrg = ag.Policy, ag.Org
+				}
+			}
+		}
+	}
+
+	var err error
+	if d.WorkloadUsage, err = FindSingleWorkloadUsageByDeviceAndPolicyName(db, deviceId, policyName); err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to read workload usage, error: %v", err))
+	} else if d.Blacklist, err = FindActiveDeviceBlacklist(db, deviceId); err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to read device blacklist, error: %v", err))
+	} else if d.Cooldown, err = FindActiveCancelCooldown(db, deviceId, policyName); err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to read cancel cooldowns, error: %v", err))
+	} else if d.LastSelection, err = FindWorkloadSelection(db, deviceId, policyName); err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to read workload selection, error: %v", err))
+	}
+
+	if d.WorkloadUsage != nil && d.WorkloadUsage.Policy != "" {
+		polString = d.WorkloadUsage.Policy
+	}
+	if polString != "" {
+		if pol, err := policy.DemarshalPolicy(polString); err == nil {
+			d.ExcludedWorkloads = excludedWorkloads(agConfig, pol, polOrg)
+		}
+	}
+
+	for _, ag := range d.Agreements {
+		if ag.AgreementTimedout != 0 {
+			d.Reasons = append(d.Reasons, fmt.Sprintf("agreement %v is being terminated", ag.CurrentAgreementId))
+		} else if ag.Paused {
+			d.Reasons = append(d.Reasons, fmt.Sprintf("agreement %v is paused since %v", ag.CurrentAgreementId, ag.PausedTime))
+		} else if ag.AgreementFinalizedTime != 0 {
+			d.Reasons = append(d.Reasons, fmt.Sprintf("agreement %v is active", ag.CurrentAgreementId))
+		} else {
+			d.Reasons = append(d.Reasons, fmt.Sprintf("agreement %v was proposed and is not finalized yet", ag.CurrentAgreementId))
+		}
+	}
+	if d.Blacklist != nil {
+		d.Reasons = append(d.Reasons, fmt.Sprintf("the device is blacklisted for invalid replies until %v", d.Blacklist.BlacklistedUntil))
+	}
+	if d.Cooldown != nil {
+		d.Reasons = append(d.Reasons, fmt.Sprintf("the cooldown after an agreement cancelled for reason %v is active until %v", d.Cooldown.Reason, d.Cooldown.ExpiryTime))
+	}
+	if wlu := d.WorkloadUsage; wlu != nil {
+		if wlu.Exhausted {
+			d.Reasons = append(d.Reasons, fmt.Sprintf("%v agreements failed before they were finalized, no more agreements are made until the workload usage is reset", wlu.FailureCount))
+		} else if !wlu.DisableRetry && wlu.RetryCount > 0 {
+			d.Reasons = append(d.Reasons, fmt.Sprintf("the workload at priority %v has been retried %v times since %v", wlu.Priority, wlu.RetryCount, wlu.FirstTryTime))
+		}
+	}
+	if len(d.ExcludedWorkloads) != 0 {
+		d.Reasons = append(d.Reasons, fmt.Sprintf("%v workloads of the policy are excluded by the configured workload arches, orgs or denied versions", len(d.ExcludedWorkloads)))
+	}
+	if s := d.LastSelection; s != nil && s.Outcome != SELECTION_CHOSEN {
+		d.Reasons = append(d.Reasons, fmt.Sprintf("the last attempt to choose a workload at %v ended with: %v", s.Time, s.Outcome))
+	}
+
+	if len(d.Reasons) == 0 {
+		d.Reasons = append(d.Reasons, "no reason found, the device might not have been found by a search for the policy yet")
+	}
+	return d, nil
+}
+
+// Returns the workloads of the policy that the configured workload arches, orgs or denied versions exclude. A workload
+// without an org is in the org of the policy, the org of the policy is empty when it is not known, and then the org of
+// such a workload is not checked.
+func excludedWorkloads(agConfig *config.AGConfig, pol *policy.Policy, polOrg string) []WorkloadRejection {
+	excluded := make([]WorkloadRejection, 0, 5)
+	for i := range pol.Workloads {
+		workload := &pol.Workloads[i]
+		if reason := agConfig.WorkloadExclusion(workload.WorkloadURL, workloadOrg(workload, polOrg), workload.Version, workload.Arch); reason != "" {
+			excluded = append(excluded, NewWorkloadRejection(workload, reason))
+		}
+	}
+	return excluded
+}
@@ -0,0 +1,87 @@
+// +build integration
+
+package agreementbot
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/policy"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_DiagnoseDevice(t *testing.T) {
+
+	deviceid := "myorg/an-diagnosis"
+	pName := "diagnosis policy"
+	agConfig := &config.AGConfig{WorkloadArches: "amd64"}
+
+	if d, err := DiagnoseDevice(testDb, agConfig, deviceid, pName); err != nil {
+		t.Fatalf("Received error diagnosing device: %v", err)
+	} else if len(d.Reasons) != 1 || !strings.Contains(d.Reasons[0], "no reason found") {
+		t.Errorf("Expected no reason for an unknown device, got %v", d.Reasons)
+	}
+
+	// The device exhausted its agreement failures for a policy with an excluded workload, is cooling down, and no workload
+	// was found for it the last time.
+	pol := `{"header":{"name":"diagnosis policy"},"workloads":[{"workloadUrl":"cpu","version":"1.0.0","arch":"amd64"},{"workloadUrl":"cpu","version":"1.0.0","arch":"arm"}]}`
+	wl := &policy.Workload{WorkloadURL: "cpu", Version: "1.0.0", Arch: "arm"}
+	if err := NewWorkloadUsage(testDb, deviceid, []string{}, pol, pName, 1, 30, 180, false, "ag-diag"); err != nil {
+		t.Fatalf("Received error creating workload usage: %v", err)
+	} else if _, err := RecordWUFailure(testDb, deviceid, pName, 1); err != nil {
+		t.Fatalf("Received error recording failure: %v", err)
+	} else if err := NewCancelCooldown(testDb, deviceid, pName, 3, 300); err != nil {
+		t.Fatalf("Received error creating cooldown: %v", err)
+	} else if err := RecordWorkloadSelection(testDb, deviceid, pName, SELECTION_NO_WORKLOAD, []WorkloadRejection{NewWorkloadRejection(wl, "unsupported")}); err != nil {
+		t.Fatalf("Received error recording workload selection: %v", err)
+	}
+
+	d, err := DiagnoseDevice(testDb, agConfig, deviceid, pName)
+	if err != nil {
+		t.Fatalf("Received error diagnosing device: %v", err)
+	}
+
+	expected := []string{"cooldown", "failed before they were finalized", "1 workloads of the policy are excluded", SELECTION_NO_WORKLOAD}
+	if len(d.Reasons) != len(expected) {
+		t.Fatalf("Expected %v reasons, got %v", len(expected), d.Reasons)
+	}
+	for i, e := range expected {
+		if !strings.Contains(d.Reasons[i], e) {
+			t.Errorf("Expected reason %v to contain %v, got %v", i, e, d.Reasons[i])
+		}
+	}
+	if len(d.ExcludedWorkloads) != 1 || d.ExcludedWorkloads[0].Arch != "arm" {
+		t.Errorf("Expected the arm workload to be excluded, got %v", d.ExcludedWorkloads)
+	} else if d.LastSelection == nil || len(d.LastSelection.Rejections) != 1 {
+		t.Errorf("Expected the last selection with its rejection, got %v", d.LastSelection)
+	}
+}
+
+func Test_PurgeWorkloadSelections(t *testing.T) {
+
+	if err := RecordWorkloadSelection(testDb, "myorg/an-selected", "purge policy", SELECTION_CHOSEN, nil); err != nil {
+		t.Fatalf("Received error recording workload selection: %v", err)
+	}
+
+	// A record of a device that is no longer searched for, whose outcome was reached two days ago.
+	old := WorkloadSelection{DeviceId: "myorg/an-gone", PolicyName: "purge policy", Outcome: SELECTION_NO_WORKLOAD, Time: uint64(time.Now().Unix()) - 48*3600}
+	if err := testDb.Update(func(tx *bolt.Tx) error {
+		bytes, _ := json.Marshal(old)
+		return tx.Bucket([]byte(WORKLOAD_SELECTION)).Put([]byte(selectionKey(old.DeviceId, old.PolicyName)), bytes)
+	}); err != nil {
+		t.Fatalf("Received error writing workload selection: %v", err)
+	}
+
+	if purged, err := PurgeWorkloadSelections(testDb, uint64(time.Now().Unix())-uint64(config.DefaultWorkloadSelectionExpiryHours*3600)); err != nil {
+		t.Errorf("Received error purging workload selections: %v", err)
+	} else if purged != 1 {
+		t.Errorf("Expected 1 workload selection to be purged, got %v", purged)
+	}
+	if s, err := FindWorkloadSelection(testDb, "myorg/an-gone", "purge policy"); err != nil || s != nil {
+		t.Errorf("Expected the expired workload selection to be purged, got %v, error: %v", s, err)
+	} else if s, err := FindWorkloadSelection(testDb, "myorg/an-selected", "purge policy"); err != nil || s == nil {
+		t.Errorf("Expected the recent workload selection to be kept, error: %v", err)
+	}
+}
@@ -1,15 +1,19 @@
 package agreementbot
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/open-horizon/anax/config"
 	"github.com/open-horizon/anax/cutil"
 	"github.com/open-horizon/anax/events"
 	"github.com/open-horizon/anax/exchange"
 	"github.com/open-horizon/anax/policy"
 	"math"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,10 +30,9 @@ func (w *AgreementBotWorker) GovernAgreements() int {
 	// This is the amount of time for the routine to wait as discovered through scanning active agreements. Node health
 	// checks and data verification checks might be skipped if they each dont have to occur every time this function
 	// wakes up. The idea is to do one scan of all agreements and do as much checking as necessary, but not more.
-	discoveredDVWaitTime := uint64(0) // Shortest data verification check rate value across all agreements.
-	discoveredNHWaitTime := uint64(0) // Shortest node health check rate value across all agreements.
-	w.GovTiming.dvSkip = uint64(0)    // Number of times to skip data verification checks before actually doing the check.
-	w.GovTiming.nhSkip = uint64(0)    // Number of times to skip node health checks before actually doing the check.
+	sweep := &governanceSweep{}    // Shortest data verification and node health check rate values across all agreements.
+	w.GovTiming.dvSkip = uint64(0) // Number of times to skip data verification checks before actually doing the check.
+	w.GovTiming.nhSkip = uint64(0) // Number of times to skip node health checks before actually doing the check.
 
 	// A filter for limiting the returned set of agreements just to those that are in progress and not yet timed out.
 	notYetFinalFilter := func() AFilter {
@@ -46,144 +49,25 @@ func (w *AgreementBotWorker) GovernAgreements() int {
 		protocolHandler := w.consumerPH[agp]
 
 		// Find all agreements that are in progress. They might be waiting for a reply or not yet finalized on blockchain.
+		// Up to GovernanceConcurrency of them are governed at the same time.
 		if agreements, err := FindAgreements(w.db, []AFilter{notYetFinalFilter(), UnarchivedAFilter()}, agp); err == nil {
-			activeDataVerification := true
-			allActiveAgreements := make(map[string][]string)
-			for _, ag := range agreements {
-
-				// Govern agreements that have seen a reply from the device
-				if protocolHandler.AlreadyReceivedReply(&ag) {
-
-					// For agreements that havent seen a blockchain write yet, check timeout
-					if ag.AgreementFinalizedTime == 0 {
-
-						glog.V(5).Infof("AgreementBot Governance detected agreement %v not yet final.", ag.CurrentAgreementId)
-						now := uint64(time.Now().Unix())
-						if ag.AgreementCreationTime+w.BaseWorker.Manager.Config.AgreementBot.AgreementTimeoutS < now {
-							// Start timing out the agreement
-							w.TerminateAgreement(&ag, protocolHandler.GetTerminationCode(TERM_REASON_NOT_FINALIZED_TIMEOUT))
-						}
-					}
-
-					// Do DV check only if not skipping it this time.
-					if w.GovTiming.dvSkip == 0 {
-
-						// Check for the receipt of data in the data ingest system (if necessary)
-						if !ag.DisableDataVerificationChecks {
-
-							// Capture the data verification check rate for later
-							if discoveredDVWaitTime == 0 || (discoveredDVWaitTime != 0 && uint64(ag.DataVerificationCheckRate) < discoveredDVWaitTime) {
-								discoveredDVWaitTime = uint64(ag.DataVerificationCheckRate)
-							}
-
-							// First check to see if this agreement is just not sending data. If so, terminate the agreement.
-							now := uint64(time.Now().Unix())
-							noDataLimit := w.BaseWorker.Manager.Config.AgreementBot.NoDataIntervalS
-							if ag.DataVerificationNoDataInterval != 0 {
-								noDataLimit = uint64(ag.DataVerificationNoDataInterval)
-							}
-							if now-ag.DataVerifiedTime >= noDataLimit {
-								// No data is being received, terminate the agreement
-								glog.V(3).Infof(logString(fmt.Sprintf("cancelling agreement %v due to lack of data", ag.CurrentAgreementId)))
-								w.TerminateAgreement(&ag, protocolHandler.GetTerminationCode(TERM_REASON_NO_DATA_RECEIVED))
-
-							} else if activeDataVerification {
-								// Otherwise make sure the device is still sending data
-								if ag.DataVerifiedTime+uint64(ag.DataVerificationCheckRate) > now {
-									// It's not time to check again
-									continue
-								} else if activeAgreements, err := GetActiveAgreements(allActiveAgreements, ag, w.BaseWorker.Manager.Config); err != nil {
-									glog.Errorf(logString(fmt.Sprintf("unable to retrieve active agreement list. Terminating data verification loop early, error: %v", err)))
-									activeDataVerification = false
-								} else if ActiveAgreementsContains(activeAgreements, ag, w.Config.AgreementBot.DVPrefix) {
-									if _, err := DataVerified(w.db, ag.CurrentAgreementId, agp); err != nil {
-										glog.Errorf(logString(fmt.Sprintf("unable to record data verification, error: %v", err)))
-									}
-
-									if ag.DataNotificationSent == 0 {
-										// Get message address of the device from the exchange. The device ensures that the exchange is kept current.
-										// If the address happens to be invalid, that should be a temporary condition. We will keep sending until
-										// we get an ack to our verification message.
-										if whisperTo, pubkeyTo, err := protocolHandler.GetDeviceMessageEndpoint(ag.DeviceId, "Governance"); err != nil {
-											glog.Errorf(logString(fmt.Sprintf("error obtaining message target for data notification: %v", err)))
-										} else if mt, err := exchange.CreateMessageTarget(ag.DeviceId, nil, pubkeyTo, whisperTo); err != nil {
-											glog.Errorf(logString(fmt.Sprintf("error creating message target: %v", err)))
-										} else if err := protocolHandler.AgreementProtocolHandler("", "", "").NotifyDataReceipt(ag.CurrentAgreementId, mt, protocolHandler.GetSendMessage()); err != nil {
-											glog.Errorf(logString(fmt.Sprintf("unable to send data notification, error: %v", err)))
-										}
-									}
-
-									// Check to see if it's time to send a metering notification
-									// Create Metering notification. If the policy is empty, there's nothing to do.
-									mp := policy.Meter{Tokens: ag.MeteringTokens, PerTimeUnit: ag.MeteringPerTimeUnit, NotificationIntervalS: ag.MeteringNotificationInterval}
-									if mp.IsEmpty() {
-										continue
-									} else if ag.MeteringNotificationSent == 0 || (ag.MeteringNotificationSent != 0 && (ag.MeteringNotificationSent+uint64(ag.MeteringNotificationInterval)) <= now) {
-										// Grab the blockchain info from the agreement if there is any
-
-										bcType, bcName, bcOrg := protocolHandler.GetKnownBlockchain(&ag)
-										glog.V(5).Info(logString(fmt.Sprintf("metering on %v %v", bcType, bcName)))
-
-										// If we can write to the blockchain then we have all the info we need to do metering.
-										if protocolHandler.IsBlockchainWritable(bcType, bcName, bcOrg) && protocolHandler.CanSendMeterRecord(&ag) {
-											if mn, err := protocolHandler.CreateMeteringNotification(mp, &ag); err != nil {
-												glog.Errorf(logString(fmt.Sprintf("unable to create metering notification, error: %v", err)))
-											} else if whisperTo, pubkeyTo, err := protocolHandler.GetDeviceMessageEndpoint(ag.DeviceId, "Governance"); err != nil {
-												glog.Errorf(logString(fmt.Sprintf("error obtaining message target for metering notification: %v", err)))
-											} else if mt, err := exchange.CreateMessageTarget(ag.DeviceId, nil, pubkeyTo, whisperTo); err != nil {
-												glog.Errorf(logString(fmt.Sprintf("error creating message target: %v", err)))
-											} else if msg, err := protocolHandler.AgreementProtocolHandler(bcType, bcName, bcOrg).NotifyMetering(ag.CurrentAgreementId, mn, mt, protocolHandler.GetSendMessage()); err != nil {
-												glog.Errorf(logString(fmt.Sprintf("unable to send metering notification, error: %v", err)))
-											} else if _, err := MeteringNotification(w.db, ag.CurrentAgreementId, agp, msg); err != nil {
-												glog.Errorf(logString(fmt.Sprintf("unable to record metering notification, error: %v", err)))
-											}
-										}
-									}
-
-									// Data verification has occured. If it has been maintained for the specified duration then we can turn off the
-									// workload rollback retry checking feature.
-									if wlUsage, err := FindSingleWorkloadUsageByDeviceAndPolicyName(w.db, ag.DeviceId, ag.PolicyName); err != nil {
-										glog.Errorf(logString(fmt.Sprintf("unable to find workload usage record, error: %v", err)))
-									} else if wlUsage != nil && !wlUsage.DisableRetry {
-										if wlUsage.VerifiedDurationS == 0 || (wlUsage.VerifiedDurationS != 0 && ag.DataNotificationSent != 0 && ag.DataVerifiedTime != ag.AgreementCreationTime && (ag.DataVerifiedTime > ag.DataNotificationSent) && ((ag.DataVerifiedTime - ag.DataNotificationSent) >= uint64(wlUsage.VerifiedDurationS))) {
-											glog.V(5).Infof(logString(fmt.Sprintf("disabling workload rollback for %v after %v seconds", ag.CurrentAgreementId, (ag.DataVerifiedTime - ag.DataNotificationSent))))
-											if _, err := DisableRollbackChecking(w.db, ag.DeviceId, ag.PolicyName); err != nil {
-												glog.Errorf(logString(fmt.Sprintf("unable to disable workload rollback retries, error: %v", err)))
-											}
-										}
-									}
-
-								} else if _, err := DataNotVerified(w.db, ag.CurrentAgreementId, agp); err != nil {
-									glog.Errorf(logString(fmt.Sprintf("unable to record data not verified, error: %v", err)))
-								}
-							}
-						}
-					}
-
-					// Do node health check only if not skipping it this time.
-					if w.GovTiming.nhSkip == 0 {
-
-						// Check for agreement termination based on node health issues. Checking node health might require an expensive
-						// call to the exchange for batch node status, so only do the health checks if we have to.
-						if checkrate, err := w.VerifyNodeHealth(&ag, protocolHandler); err != nil {
-							glog.Errorf(logString(fmt.Sprintf("unable to verify node health for %v, error: %v", ag.CurrentAgreementId, err)))
-						} else if checkrate != 0 && (discoveredNHWaitTime == 0 || (discoveredNHWaitTime != 0 && uint64(checkrate) < discoveredNHWaitTime)) {
-							discoveredNHWaitTime = uint64(checkrate)
-						}
-					}
+			sweep.beginProtocol()
+			governConcurrently(w.Config.AgreementBot.GovernanceWorkers(), len(agreements), func(i int) {
+				w.governAgreementWithLock(agreements[i], protocolHandler, sweep)
+			})
+		} else {
+			glog.Errorf(logString(fmt.Sprintf("unable to read agreements from database, error: %v", err)))
+		}
 
-					// Govern agreements that havent seen a proposal reply yet
-				} else {
-					// We are waiting for a reply
-					glog.V(5).Infof("AgreementBot Governance waiting for reply to %v.", ag.CurrentAgreementId)
-					now := uint64(time.Now().Unix())
-					if ag.AgreementCreationTime+w.BaseWorker.Manager.Config.AgreementBot.ProtocolTimeoutS < now {
-						w.TerminateAgreement(&ag, protocolHandler.GetTerminationCode(TERM_REASON_NO_REPLY))
-					}
-				}
+		// Find pending agreements whose proposal was never made, and cancel them so that the device can be offered a new agreement.
+		expiry := w.BaseWorker.Manager.Config.AgreementBot.ProposalExpiryS()
+		if agreements, err := FindAgreements(w.db, []AFilter{ExpiredProposalAFilter(uint64(time.Now().Unix()), expiry), UnarchivedAFilter()}, agp); err == nil {
+			for _, ag := range agreements {
+				glog.V(3).Infof(logString(fmt.Sprintf("pending agreement %v with %v expired after %v seconds without its proposal being sent.", ag.CurrentAgreementId, ag.DeviceId, expiry)))
+				w.TerminateAgreement(&ag, protocolHandler.GetTerminationCode(TERM_REASON_PROPOSAL_TIMEOUT))
 			}
 		} else {
-			glog.Errorf(logString(fmt.Sprintf("unable to read agreements from database, error: %v", err)))
+			glog.Errorf(logString(fmt.Sprintf("unable to read pending agreements from database, error: %v", err)))
 		}
 	}
 
@@ -255,7 +139,7 @@ func (w *AgreementBotWorker) GovernAgreements() int {
 					glog.Errorf(logString(fmt.Sprintf("unable to read agreement %v from database, error: %v", wlu.CurrentAgreementId, err)))
 				} else {
 					// Make sure the workload usage record is gone,this will allow the device to pick up the newest workload.
-					if err := DeleteWorkloadUsage(w.db, wlu.DeviceId, wlu.PolicyName); err != nil {
+					if err := DeleteWorkloadUsage(w.db, wlu.DeviceId, wlu.PolicyName, WU_REASON_WORKLOAD_UPGRADE); err != nil {
 						glog.Errorf(logString(fmt.Sprintf("error deleting workload usage for %v using policy %v, error: %v", wlu.DeviceId, wlu.PolicyName, err)))
 					}
 
@@ -277,7 +161,7 @@ func (w *AgreementBotWorker) GovernAgreements() int {
 
 	// Dynamically adjust wait time to account for large differential between DV check rates and NH check rates.
 	if w.GovTiming.dvSkip == 0 && w.GovTiming.nhSkip == 0 {
-		w.GovTiming.dvSkip, w.GovTiming.nhSkip, waitTime = calculateSkipTime(discoveredDVWaitTime, discoveredNHWaitTime, w.BaseWorker.Manager.Config.AgreementBot.ProcessGovernanceIntervalS)
+		w.GovTiming.dvSkip, w.GovTiming.nhSkip, waitTime = calculateSkipTime(sweep.dvWaitTime, sweep.nhWaitTime, w.BaseWorker.Manager.Config.AgreementBot.ProcessGovernanceIntervalS)
 	} else {
 		// Decrement skip counts here to prepare for next iteration
 		if w.GovTiming.dvSkip > 0 {
@@ -292,6 +176,348 @@ func (w *AgreementBotWorker) GovernAgreements() int {
 
 }
 
+// The state that the governance of the in progress agreements shares across agreements, which might be governed at the
+// same time.
+type governanceSweep struct {
+	lock                   sync.Mutex
+	dvWaitTime             uint64                            // Shortest data verification check rate value across all agreements.
+	nhWaitTime             uint64                            // Shortest node health check rate value across all agreements.
+	activeDataVerification bool                              // False after the active agreements of the current protocol could not be retrieved.
+	allActiveAgreements    map[string]*activeAgreementsFetch // The active agreements retrieved for the current protocol, keyed by data verification URL.
+}
+
+// The active agreements retrieved from one data verification URL. The agreements governed at the same time share one
+// retrieval, which is made without holding the sweep lock.
+type activeAgreementsFetch struct {
+	once       sync.Once
+	agreements []string
+	err        error
+}
+
+// Start governing the agreements of another protocol, with a fresh set of active agreements.
+func (s *governanceSweep) beginProtocol() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.activeDataVerification = true
+	s.allActiveAgreements = make(map[string]*activeAgreementsFetch)
+}
+
+func (s *governanceSweep) recordDVCheckRate(checkrate uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.dvWaitTime == 0 || checkrate < s.dvWaitTime {
+		s.dvWaitTime = checkrate
+	}
+}
+
+func (s *governanceSweep) recordNHCheckRate(checkrate uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.nhWaitTime == 0 || checkrate < s.nhWaitTime {
+		s.nhWaitTime = checkrate
+	}
+}
+
+func (s *governanceSweep) dataVerificationActive() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.activeDataVerification
+}
+
+// Returns the active agreements reported by the data verification API of the agreement. An error stops the data
+// verification of the remaining agreements of the protocol.
+func (s *governanceSweep) activeAgreements(w *AgreementBotWorker, ag Agreement) ([]string, error) {
+
+	// Nothing is retrieved for an agreement without data verification, so there is nothing to share.
+	if ag.DisableDataVerificationChecks {
+		return GetActiveAgreements(w.httpClient, make(map[string][]string), ag, w.BaseWorker.Manager.Config)
+	}
+
+	url := activeAgreementsURL(ag, &w.BaseWorker.Manager.Config.AgreementBot)
+	s.lock.Lock()
+	fetch, ok := s.allActiveAgreements[url]
+	if !ok {
+		fetch = new(activeAgreementsFetch)
+		s.allActiveAgreements[url] = fetch
+	}
+	s.lock.Unlock()
+
+	fetch.once.Do(func() {
+		fetch.agreements, fetch.err = GetActiveAgreements(w.httpClient, make(map[string][]string), ag, w.BaseWorker.Manager.Config)
+	})
+
+	if fetch.err != nil {
+		s.lock.Lock()
+		s.activeDataVerification = false
+		s.lock.Unlock()
+	}
+	return fetch.agreements, fetch.err
+}
+
+// Call f with each index from 0 to n-1, making up to concurrency calls at the same time, and return when all the calls
+// have returned. With a concurrency of 1 the calls are made one at a time, in order.
+func governConcurrently(concurrency int, n int, f func(int)) {
+	if concurrency <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+
+	slots := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		slots <- true
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// The outcomes of the data verification check of an agreement.
+const (
+	GOV_DATA_UNCHECKED    = iota // the data verification was not checked
+	GOV_DATA_VERIFIED            // the device is sending data
+	GOV_DATA_NOT_VERIFIED        // the device did not send data since the last check
+)
+
+// The outcome of governing an agreement that is in progress, see governAgreementWithLock.
+type governanceOutcome struct {
+	terminate    bool // the agreement has to be terminated
+	reason       uint // the termination reason, the first one found
+	dataVerified int  // one of the GOV_DATA_ constants
+}
+
+// Govern an agreement that is in progress. The checks that call the exchange are made from the agreement as the sweep
+// found it, without holding its agreement lock. The lock is held only while their outcome is recorded, so that the
+// agreement workers don't change the agreement at the same time. The agreement is read again under the lock because it
+// might have been terminated since the sweep found it. Terminating an agreement queues work for the agreement workers,
+// which might be waiting for this lock, so the notifications to the device are sent and the agreement is terminated after
+// the lock is released.
+func (w *AgreementBotWorker) governAgreementWithLock(found Agreement, protocolHandler ConsumerProtocolHandler, sweep *governanceSweep) {
+
+	outcome := w.governAgreement(found, protocolHandler, sweep)
+	if !outcome.terminate && outcome.dataVerified == GOV_DATA_UNCHECKED {
+		return
+	}
+
+	lock := protocolHandler.AgreementLockManager().getAgreementLock(found.CurrentAgreementId)
+	lock.Lock()
+
+	ag, err := FindSingleAgreementByAgreementId(w.db, found.CurrentAgreementId, protocolHandler.Name(), []AFilter{UnarchivedAFilter()})
+	if err != nil {
+		glog.Errorf(logString(fmt.Sprintf("unable to read agreement %v from database, error: %v", found.CurrentAgreementId, err)))
+		ag = nil
+	} else if ag == nil || ag.AgreementTimedout != 0 || ag.Paused {
+		glog.V(5).Infof(logString(fmt.Sprintf("skipping governance of agreement %v, it is terminated or paused", found.CurrentAgreementId)))
+		ag = nil
+	} else if !outcome.terminate {
+		w.recordDataVerification(ag, outcome.dataVerified, protocolHandler.Name())
+	}
+
+	lock.Unlock()
+
+	if ag == nil {
+		return
+	} else if outcome.terminate {
+		w.TerminateAgreement(ag, outcome.reason)
+	} else if outcome.dataVerified == GOV_DATA_VERIFIED {
+		w.notifyDataVerified(ag, protocolHandler)
+	}
+}
+
+// Record the outcome of the data verification check of the agreement. The caller must hold the agreement lock.
+func (w *AgreementBotWorker) recordDataVerification(ag *Agreement, dataVerified int, agp string) {
+
+	if dataVerified == GOV_DATA_NOT_VERIFIED {
+		if _, err := DataNotVerified(w.db, ag.CurrentAgreementId, agp); err != nil {
+			glog.Errorf(logString(fmt.Sprintf("unable to record data not verified, error: %v", err)))
+		}
+		return
+	} else if dataVerified != GOV_DATA_VERIFIED {
+		return
+	}
+
+	if _, err := DataVerified(w.db, ag.CurrentAgreementId, agp); err != nil {
+		glog.Errorf(logString(fmt.Sprintf("unable to record data verification, error: %v", err)))
+	}
+
+	// Data verification has occured. If it has been maintained for the specified duration then we can turn off the
+	// workload rollback retry checking feature.
+	if wlUsage, err := FindSingleWorkloadUsageByDeviceAndPolicyName(w.db, ag.DeviceId, ag.PolicyName); err != nil {
+		glog.Errorf(logString(fmt.Sprintf("unable to find workload usage record, error: %v", err)))
+	} else if wlUsage != nil && !wlUsage.DisableRetry {
+		if wlUsage.VerifiedDurationS == 0 || (wlUsage.VerifiedDurationS != 0 && ag.DataNotificationSent != 0 && ag.DataVerifiedTime != ag.AgreementCreationTime && (ag.DataVerifiedTime > ag.DataNotificationSent) && ((ag.DataVerifiedTime - ag.DataNotificationSent) >= uint64(wlUsage.VerifiedDurationS))) {
+			glog.V(5).Infof(logString(fmt.Sprintf("disabling workload rollback for %v after %v seconds", ag.CurrentAgreementId, (ag.DataVerifiedTime - ag.DataNotificationSent))))
+			if _, err := DisableRollbackChecking(w.db, ag.DeviceId, ag.PolicyName); err != nil {
+				glog.Errorf(logString(fmt.Sprintf("unable to disable workload rollback retries, error: %v", err)))
+			}
+		}
+	}
+}
+
+// Send the data and metering notifications for an agreement whose data was verified. They call the exchange and the
+// blockchain, so they are sent without holding the agreement lock, which is taken only to record the metering
+// notification.
+func (w *AgreementBotWorker) notifyDataVerified(ag *Agreement, protocolHandler ConsumerProtocolHandler) {
+
+	agp := protocolHandler.Name()
+
+	if ag.DataNotificationSent == 0 {
+		// Get message address of the device from the exchange. The device ensures that the exchange is kept current.
+		// If the address happens to be invalid, that should be a temporary condition. We will keep sending until
+		// we get an ack to our verification message.
+		if whisperTo, pubkeyTo, err := protocolHandler.GetDeviceMessageEndpoint(ag.DeviceId, "Governance"); err != nil {
+			glog.Errorf(logString(fmt.Sprintf("error obtaining message target for data notification: %v", err)))
+		} else if mt, err := exchange.CreateMessageTarget(ag.DeviceId, nil, pubkeyTo, whisperTo); err != nil {
+			glog.Errorf(logString(fmt.Sprintf("error creating message target: %v", err)))
+		} else if err := protocolHandler.AgreementProtocolHandler("", "", "").NotifyDataReceipt(ag.CurrentAgreementId, mt, protocolHandler.GetSendMessage()); err != nil {
+			glog.Errorf(logString(fmt.Sprintf("unable to send data notification, error: %v", err)))
+		}
+	}
+
+	// Check to see if it's time to send a metering notification
+	// Create Metering notification. If the policy is empty, there's nothing to do.
+	now := uint64(time.Now().Unix())
+	mp := policy.Meter{Tokens: ag.MeteringTokens, PerTimeUnit: ag.MeteringPerTimeUnit, NotificationIntervalS: ag.MeteringNotificationInterval}
+	if mp.IsEmpty() {
+		return
+	} else if ag.MeteringNotificationSent == 0 || (ag.MeteringNotificationSent != 0 && (ag.MeteringNotificationSent+uint64(ag.MeteringNotificationInterval)) <= now) {
+		// Grab the blockchain info from the agreement if there is any
+
+		bcType, bcName, bcOrg := protocolHandler.GetKnownBlockchain(ag)
+		glog.V(5).Info(logString(fmt.Sprintf("metering on %v %v", bcType, bcName)))
+
+		// If we can write to the blockchain then we have all the info we need to do metering.
+		if protocolHandler.IsBlockchainWritable(bcType, bcName, bcOrg) && protocolHandler.CanSendMeterRecord(ag) {
+			if mn, err := protocolHandler.CreateMeteringNotification(mp, ag); err != nil {
+				glog.Errorf(logString(fmt.Sprintf("unable to create metering notification, error: %v", err)))
+			} else if whisperTo, pubkeyTo, err := protocolHandler.GetDeviceMessageEndpoint(ag.DeviceId, "Governance"); err != nil {
+				glog.Errorf(logString(fmt.Sprintf("error obtaining message target for metering notification: %v", err)))
+			} else if mt, err := exchange.CreateMessageTarget(ag.DeviceId, nil, pubkeyTo, whisperTo); err != nil {
+				glog.Errorf(logString(fmt.Sprintf("error creating message target: %v", err)))
+			} else if msg, err := protocolHandler.AgreementProtocolHandler(bcType, bcName, bcOrg).NotifyMetering(ag.CurrentAgreementId, mn, mt, protocolHandler.GetSendMessage()); err != nil {
+				glog.Errorf(logString(fmt.Sprintf("unable to send metering notification, error: %v", err)))
+			} else {
+				lock := protocolHandler.AgreementLockManager().getAgreementLock(ag.CurrentAgreementId)
+				lock.Lock()
+				if _, err := MeteringNotification(w.db, ag.CurrentAgreementId, agp, msg); err != nil {
+					glog.Errorf(logString(fmt.Sprintf("unable to record metering notification, error: %v", err)))
+				}
+				lock.Unlock()
+			}
+		}
+	}
+}
+
+// Govern an agreement that is in progress, without changing it. Returns what has to be done with the agreement, see
+// governAgreementWithLock.
+func (w *AgreementBotWorker) governAgreement(ag Agreement, protocolHandler ConsumerProtocolHandler, sweep *governanceSweep) governanceOutcome {
+
+	outcome := governanceOutcome{dataVerified: GOV_DATA_UNCHECKED}
+	terminate := func(ag *Agreement, reason uint) {
+		if !outcome.terminate {
+			outcome.terminate, outcome.reason = true, reason
+		}
+	}
+
+	// Paused agreements are not governed until they are resumed, so they are not cancelled for lack of data or
+	// node health problems during the pause.
+	if ag.Paused {
+		glog.V(5).Infof(logString(fmt.Sprintf("skipping governance of agreement %v, paused since %v", ag.CurrentAgreementId, ag.PausedTime)))
+		return outcome
+	}
+
+	// Govern agreements that have seen a reply from the device
+	if protocolHandler.AlreadyReceivedReply(&ag) {
+
+		// For agreements that havent seen a blockchain write yet, check timeout
+		if ag.AgreementFinalizedTime == 0 {
+
+			glog.V(5).Infof("AgreementBot Governance detected agreement %v not yet final.", ag.CurrentAgreementId)
+			now := uint64(time.Now().Unix())
+			if ag.AgreementCreationTime+w.BaseWorker.Manager.Config.AgreementBot.AgreementTimeoutS < now {
+				// Start timing out the agreement
+				terminate(&ag, protocolHandler.GetTerminationCode(TERM_REASON_NOT_FINALIZED_TIMEOUT))
+			}
+		}
+
+		// Do DV check only if not skipping it this time.
+		if w.GovTiming.dvSkip == 0 {
+
+			// Check for the receipt of data in the data ingest system (if necessary)
+			if !ag.DisableDataVerificationChecks {
+
+				// Capture the data verification check rate for later
+				sweep.recordDVCheckRate(uint64(ag.DataVerificationCheckRate))
+
+				// First check to see if this agreement is just not sending data. If so, terminate the agreement.
+				now := uint64(time.Now().Unix())
+				noDataLimit := w.BaseWorker.Manager.Config.AgreementBot.NoDataIntervalS
+				if ag.DataVerificationNoDataInterval != 0 {
+					noDataLimit = uint64(ag.DataVerificationNoDataInterval)
+				}
+				if now-ag.DataVerifiedTime >= noDataLimit {
+					// No data is being received, terminate the agreement
+					glog.V(3).Infof(logString(fmt.Sprintf("cancelling agreement %v due to lack of data", ag.CurrentAgreementId)))
+					terminate(&ag, protocolHandler.GetTerminationCode(TERM_REASON_NO_DATA_RECEIVED))
+
+				} else if sweep.dataVerificationActive() {
+					// Otherwise make sure the device is still sending data
+					if ag.DataVerifiedTime+uint64(ag.DataVerificationCheckRate) > now {
+						// It's not time to check again
+						return outcome
+					} else if activeAgreements, err := sweep.activeAgreements(w, ag); err != nil {
+						glog.Errorf(logString(fmt.Sprintf("unable to retrieve active agreement list. Terminating data verification loop early, error: %v", err)))
+					} else if ActiveAgreementsContains(activeAgreements, ag, w.Config.AgreementBot.DVPrefix) {
+						outcome.dataVerified = GOV_DATA_VERIFIED
+
+						// The notifications are sent by notifyDataVerified. If there is no metering policy, there's nothing
+						// more to do.
+						mp := policy.Meter{Tokens: ag.MeteringTokens, PerTimeUnit: ag.MeteringPerTimeUnit, NotificationIntervalS: ag.MeteringNotificationInterval}
+						if mp.IsEmpty() {
+							return outcome
+						}
+
+					} else {
+						outcome.dataVerified = GOV_DATA_NOT_VERIFIED
+					}
+				}
+			}
+		}
+
+		// Do node health check only if not skipping it this time.
+		if w.GovTiming.nhSkip == 0 {
+
+			// Check for agreement termination based on node health issues. Checking node health might require an expensive
+			// call to the exchange for batch node status, so only do the health checks if we have to.
+			if checkrate, err := w.VerifyNodeHealth(&ag, protocolHandler, terminate); err != nil {
+				glog.Errorf(logString(fmt.Sprintf("unable to verify node health for %v, error: %v", ag.CurrentAgreementId, err)))
+			} else if checkrate != 0 {
+				sweep.recordNHCheckRate(uint64(checkrate))
+			}
+		}
+
+		// Govern agreements that havent seen a proposal reply yet
+	} else {
+		// We are waiting for a reply
+		glog.V(5).Infof("AgreementBot Governance waiting for reply to %v.", ag.CurrentAgreementId)
+		now := uint64(time.Now().Unix())
+		if ag.AgreementCreationTime+w.BaseWorker.Manager.Config.AgreementBot.ProposalExpiryS() < now {
+			glog.V(3).Infof(logString(fmt.Sprintf("proposal for agreement %v with %v expired after %v seconds without a reply.", ag.CurrentAgreementId, ag.DeviceId, w.BaseWorker.Manager.Config.AgreementBot.ProposalExpiryS())))
+			terminate(&ag, protocolHandler.GetTerminationCode(TERM_REASON_PROPOSAL_TIMEOUT))
+		}
+	}
+
+	return outcome
+}
+
 // Calculate wait time intervals for data verification and node health checks and come up with an aggregate wait time before we run
 // the next agreement iteration(s) again. When all skip counts are zero, this function will get called again to recalculate wait and skips.
 func calculateSkipTime(dvCheckrate uint64, nhCheckrate uint64, pgi uint64) (uint64, uint64, uint64) {
@@ -344,7 +570,7 @@ func (w *AgreementBotWorker) checkWorkloadUsageAgreement(partnerWLU *WorkloadUsa
 		// Check to make sure the partner is heart-beating to the exchange. This should tell us if we can expect this device to
 		// complete an agreement at some time, or not.
 
-		if dev, err := GetDevice(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), partnerWLU.DeviceId, w.Config.AgreementBot.ExchangeURL, w.agbotId, w.token); err != nil {
+		if dev, err := GetDevice(w.httpClient, partnerWLU.DeviceId, w.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(partnerWLU.DeviceId)), w.agbotId, w.token); err != nil {
 			glog.Errorf(logString(fmt.Sprintf("error obtaining device %v heartbeat state: %v", partnerWLU.DeviceId, err)))
 		} else if len(dev.LastHeartbeat) != 0 && (uint64(cutil.TimeInSeconds(dev.LastHeartbeat)+300) > uint64(time.Now().Unix())) {
 			// If the device is still alive (heart beat received in the last 5 mins), then assume this partner is trying to make an
@@ -380,12 +606,12 @@ func (w *AgreementBotWorker) checkWorkloadUsageAgreement(partnerWLU *WorkloadUsa
 }
 
 // This function is used to verify that a node is still functioning correctly
-func (w *AgreementBotWorker) VerifyNodeHealth(ag *Agreement, cph ConsumerProtocolHandler) (int, error) {
+func (w *AgreementBotWorker) VerifyNodeHealth(ag *Agreement, cph ConsumerProtocolHandler, terminate func(*Agreement, uint)) (int, error) {
 
 	finalizedTolerance := uint64(60)
 
 	nodeHealthHandler := func(pattern string, org string, lastCallTime string) (*exchange.NodeHealthStatus, error) {
-		return exchange.GetNodeHealthStatus(w.Config.Collaborators.HTTPClientFactory, pattern, org, lastCallTime, w.Config.Edge.ExchangeURL, w.agbotId, w.token)
+		return exchange.GetNodeHealthStatus(w.Config.Collaborators.HTTPClientFactory, pattern, org, lastCallTime, w.Config.AgreementBot.GetExchangeURL(org), w.agbotId, w.token)
 	}
 
 	// If there is no node health policy configured, return quickly.
@@ -402,12 +628,12 @@ func (w *AgreementBotWorker) VerifyNodeHealth(ag *Agreement, cph ConsumerProtoco
 	// If this agreement's node is out of policy, cancel the agreement and remove the node from the cache.
 	// If the agreement is missing, cancel it.
 	if w.NHManager.NodeOutOfPolicy(ag.Pattern, ag.Org, ag.DeviceId, ag.NHMissingHBInterval) {
-		w.TerminateAgreement(ag, cph.GetTerminationCode(TERM_REASON_NODE_HEARTBEAT))
+		terminate(ag, cph.GetTerminationCode(TERM_REASON_NODE_HEARTBEAT))
 	} else if ag.FinalizedWithinTolerance(finalizedTolerance) {
 		// The agreement might have been recently finalized but the device has not yet recorded the agreement in the exchange.
 		// If this is the case, the agreement gets a pass for now.
 	} else if w.NHManager.AgreementOutOfPolicy(ag.Pattern, ag.Org, ag.DeviceId, ag.CurrentAgreementId) {
-		w.TerminateAgreement(ag, cph.GetTerminationCode(TERM_REASON_AG_MISSING))
+		terminate(ag, cph.GetTerminationCode(TERM_REASON_AG_MISSING))
 	}
 
 	return ag.NHCheckAgreementStatus, nil
@@ -423,10 +649,43 @@ func (w *AgreementBotWorker) TerminateAgreement(ag *Agreement, reason uint) {
 	}
 
 	// Queue up a command for an agreement worker to do the blockchain work
-	w.consumerPH[ag.AgreementProtocol].HandleAgreementTimeout(NewAgreementTimeoutCommand(ag.CurrentAgreementId, ag.AgreementProtocol, reason), w.consumerPH[ag.AgreementProtocol])
+	w.consumerPH[ag.AgreementProtocol].HandleAgreementTimeout(NewAgreementTimeoutCommand(ag.CurrentAgreementId, ag.AgreementProtocol, reason, ""), w.consumerPH[ag.AgreementProtocol])
+}
+
+// Cancel all active agreements with a device, across all the agreement protocols this agbot supports. The cancellations
+// are queued to the agreement workers of each protocol, which take the lock for each agreement individually, so no
+// locks are held here. The generic termination reason is converted to each protocol's own code, the operator reason
+// is recorded on the cancelled agreements. Returns the number of agreements queued for cancellation, keyed by protocol
+// name.
+func (w *AgreementBotWorker) CancelDeviceAgreements(deviceId string, reason string, operatorReason string) (map[string]int, error) {
+
+	cancelled := make(map[string]int)
+	for protocol, cph := range w.consumerPH {
+		if ags, err := FindAgreements(w.db, []AFilter{UnarchivedAFilter(), DeviceAFilter(deviceId)}, protocol); err != nil {
+			return cancelled, errors.New(fmt.Sprintf("unable to read %v agreements for device %v, error: %v", protocol, deviceId, err))
+		} else {
+			for _, ag := range ags {
+				if ag.AgreementTimedout != 0 {
+					// Already being terminated
+					continue
+				}
+				glog.V(3).Infof(logString(fmt.Sprintf("cancelling agreement %v with device %v", ag.CurrentAgreementId, deviceId)))
+				cph.HandleAgreementTimeout(NewAgreementTimeoutCommand(ag.CurrentAgreementId, protocol, cph.GetTerminationCode(reason), operatorReason), cph)
+				cancelled[protocol] += 1
+			}
+		}
+	}
+
+	glog.V(3).Infof(logString(fmt.Sprintf("queued cancellation of agreements with device %v: %v", deviceId, cancelled)))
+	return cancelled, nil
 }
 
 func GetDevice(httpClient *http.Client, deviceId string, url string, agbotId string, token string) (*exchange.Device, error) {
+	return GetDeviceWithContext(context.Background(), httpClient, deviceId, url, agbotId, token)
+}
+
+// Same as GetDevice, except that retrying an unreachable exchange stops when the input context is cancelled.
+func GetDeviceWithContext(ctx context.Context, httpClient *http.Client, deviceId string, url string, agbotId string, token string) (*exchange.Device, error) {
 
 	glog.V(5).Infof(logString(fmt.Sprintf("retrieving device %v from exchange", deviceId)))
 
@@ -434,12 +693,15 @@ func GetDevice(httpClient *http.Client, deviceId string, url string, agbotId str
 	resp = new(exchange.GetDevicesResponse)
 	targetURL := url + "orgs/" + exchange.GetOrg(deviceId) + "/nodes/" + exchange.GetId(deviceId)
 	for {
-		if err, tpErr := exchange.InvokeExchange(httpClient, "GET", targetURL, agbotId, token, nil, &resp); err != nil {
+		if err, tpErr := exchange.InvokeExchangeWithContext(ctx, httpClient, "GET", targetURL, agbotId, token, nil, &resp); err != nil {
 			glog.Errorf(logString(err.Error()))
+			ExchangeCredentials.Check(err)
 			return nil, err
 		} else if tpErr != nil {
 			glog.Warningf(logString(tpErr.Error()))
-			time.Sleep(10 * time.Second)
+			if err := exchange.SleepWithContext(ctx, 10*time.Second); err != nil {
+				return nil, err
+			}
 			continue
 		} else {
 			devs := resp.(*exchange.GetDevicesResponse).Devices
@@ -454,7 +716,8 @@ func GetDevice(httpClient *http.Client, deviceId string, url string, agbotId str
 }
 
 // Govern the archived agreements, periodically deleting them from the database if they are old enough. The
-// age limit is defined by the agbot configuration, PurgeArchivedAgreementHours.
+// age limit is defined by the agbot configuration, PurgeArchivedAgreementHours. The workload selection records
+// older than WorkloadSelectionExpiryHours are deleted too.
 //
 func (w *AgreementBotWorker) GovernArchivedAgreements() int {
 
@@ -480,8 +743,11 @@ func (w *AgreementBotWorker) GovernArchivedAgreements() int {
 		now := time.Now().Unix()
 		if agreements, err := FindAgreements(w.db, []AFilter{ArchivedAFilter(), agedOutFilter(now, ageLimit)}, agp); err == nil {
 			for _, ag := range agreements {
+				dvPrefixWarnings.forget(ag.CurrentAgreementId)
 				if err := DeleteAgreement(w.db, ag.CurrentAgreementId, agp); err != nil {
 					glog.Error(logString(fmt.Sprintf("error deleting archived agreement %v, error: %v", ag.CurrentAgreementId, err)))
+				} else if err := DeleteAgreementTrace(w.db, ag.CurrentAgreementId); err != nil {
+					glog.Error(logString(fmt.Sprintf("error deleting the trace of archived agreement %v, error: %v", ag.CurrentAgreementId, err)))
 				} else {
 					glog.V(3).Infof(logString(fmt.Sprintf("archive purge deleted %v", ag.CurrentAgreementId)))
 				}
@@ -491,6 +757,50 @@ func (w *AgreementBotWorker) GovernArchivedAgreements() int {
 			glog.Errorf(logString(fmt.Sprintf("unable to read archived agreements from database for protocol %v, error: %v", agp, err)))
 		}
 	}
+
+	// The traces of agreements that no longer exist, e.g. because they were deleted when they could not be initiated,
+	// are purged once they are as old as the archived agreements. The traces of the configured agreement ids are kept,
+	// those agreements might not be made yet.
+	keep := make(map[string]bool)
+	for _, id := range strings.Split(w.Config.AgreementBot.TraceAgreementIds, ",") {
+		keep[strings.TrimSpace(id)] = true
+	}
+	if purged, err := PurgeAgreementTraces(w.db, uint64(time.Now().Unix())-uint64(ageLimit*3600), keep); err != nil {
+		glog.Errorf(logString(fmt.Sprintf("unable to purge agreement traces, error: %v", err)))
+	} else if purged != 0 {
+		glog.V(3).Infof(logString(fmt.Sprintf("archive purge deleted %v agreement traces", purged)))
+	}
+
+	selectionLimit := w.Config.AgreementBot.WorkloadSelectionExpiryHours
+	if selectionLimit <= 0 {
+		selectionLimit = config.DefaultWorkloadSelectionExpiryHours
+	}
+	if purged, err := PurgeWorkloadSelections(w.db, uint64(time.Now().Unix())-uint64(selectionLimit*3600)); err != nil {
+		glog.Errorf(logString(fmt.Sprintf("unable to purge workload selection records, error: %v", err)))
+	} else if purged != 0 {
+		glog.V(3).Infof(logString(fmt.Sprintf("archive purge deleted %v workload selection records", purged)))
+	}
+	return 0
+}
+
+// Check the database for inconsistent agreement and workload usage records and log them. The inconsistencies that are safe
+// to repair are repaired if the agbot is configured to do so.
+func (w *AgreementBotWorker) GovernDBIntegrity() int {
+
+	problems, err := CheckDBIntegrity(w.db, w.Config.AgreementBot.DBIntegrityRepair)
+	if err != nil {
+		glog.Errorf(logString(fmt.Sprintf("unable to check database integrity, error: %v", err)))
+		return 0
+	}
+
+	repaired := 0
+	for _, problem := range problems {
+		glog.Warningf(logString(fmt.Sprintf("database integrity check found %v", problem)))
+		if problem.Repaired {
+			repaired += 1
+		}
+	}
+	glog.V(3).Infof(logString(fmt.Sprintf("database integrity check found %v problems, repaired %v", len(problems), repaired)))
 	return 0
 }
 
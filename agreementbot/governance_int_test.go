@@ -0,0 +1,148 @@
+// +build integration
+
+package agreementbot
+
+import (
+	"github.com/open-horizon/anax/events"
+	"github.com/open-horizon/anax/policy"
+	"github.com/open-horizon/anax/worker"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_CancelDeviceAgreements(t *testing.T) {
+
+	deviceid := "myorg/an-evacuate"
+
+	cfg := testInitiateConfig("http://localhost")
+	cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+	cph.Work = make(chan AgreementWork, 10)
+
+	w := &AgreementBotWorker{db: testDb, consumerPH: map[string]ConsumerProtocolHandler{"Basic": cph}}
+
+	// Two active agreements with the device, one being terminated, one archived and one with another device.
+	for agid, dev := range map[string]string{"evac1": deviceid, "evac2": deviceid, "evac3": deviceid, "evac4": deviceid, "evac5": "myorg/an-other"} {
+		if err := AgreementAttempt(testDb, agid, "myorg", dev, "evacuate policy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+			t.Fatalf("Received error creating agreement %v: %v", agid, err)
+		}
+	}
+	if _, err := AgreementTimedout(testDb, "evac3", "Basic"); err != nil {
+		t.Fatalf("Received error timing out agreement: %v", err)
+	} else if _, err := ArchiveAgreement(testDb, "evac4", "Basic", 0, "", ""); err != nil {
+		t.Fatalf("Received error archiving agreement: %v", err)
+	}
+
+	cancelled, err := w.CancelDeviceAgreements(deviceid, TERM_REASON_USER_REQUESTED, "evacuating")
+	if err != nil {
+		t.Fatalf("Received error cancelling device agreements: %v", err)
+	} else if len(cancelled) != 1 || cancelled["Basic"] != 2 {
+		t.Errorf("expected 2 Basic agreements to be cancelled, got %v", cancelled)
+	}
+
+	// Each cancellation is queued for the agreement workers, which take the agreement lock.
+	queued := make(map[string]bool)
+	for len(cph.Work) != 0 {
+		work, ok := (<-cph.Work).(CancelAgreement)
+		if !ok {
+			t.Fatalf("expected only agreement cancellations to be queued, got %v", work)
+		} else if work.Reason != cph.GetTerminationCode(TERM_REASON_USER_REQUESTED) || work.OperatorReason != "evacuating" {
+			t.Errorf("expected a user requested cancellation with the operator reason, got %v", work)
+		}
+		queued[work.AgreementId] = true
+	}
+	if len(queued) != 2 || !queued["evac1"] || !queued["evac2"] {
+		t.Errorf("expected agreements evac1 and evac2 to be queued for cancellation, got %v", queued)
+	}
+
+}
+
+// The active agreements are retrieved without holding the agreement lock, which is taken only to record the outcome of
+// the data verification check. An agreement terminated while the active agreements are retrieved is left alone.
+func Test_governAgreementWithLock(t *testing.T) {
+
+	var cph *BasicProtocolHandler
+	terminateDuringFetch := ""
+	lockedDuringFetch := false
+
+	// The data verification API doesnt report the agreements, so that their data is not verified.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/active" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		lock := cph.AgreementLockManager().getAgreementLock(r.URL.Query().Get("agid"))
+		locked := make(chan bool)
+		go func() {
+			lock.Lock()
+			if terminateDuringFetch != "" {
+				AgreementTimedout(testDb, terminateDuringFetch, "Basic")
+			}
+			lock.Unlock()
+			locked <- true
+		}()
+		select {
+		case <-locked:
+			lockedDuringFetch = true
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte(`[{"id":"1","contracts":[{"id":"other"}]}]`))
+	}))
+	defer server.Close()
+
+	cfg := testInitiateConfig(server.URL)
+	cfg.AgreementBot.AgreementTimeoutS = 3600
+	cfg.AgreementBot.NoDataIntervalS = 3600
+	cph = NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+	cph.Work = make(chan AgreementWork, 10)
+
+	w := &AgreementBotWorker{
+		BaseWorker: worker.BaseWorker{Manager: worker.Manager{Config: cfg}},
+		db:         testDb,
+		httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+		consumerPH: map[string]ConsumerProtocolHandler{"Basic": cph},
+	}
+
+	for _, agid := range []string{"gov-unlocked", "gov-terminated"} {
+		dv := policy.DataVerification{Enabled: true, URL: server.URL + "/active?agid=" + agid}
+		if err := AgreementAttempt(testDb, agid, "myorg", "myorg/an-govern", "govern policy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+			t.Fatalf("Received error creating agreement %v: %v", agid, err)
+		} else if _, err := AgreementUpdate(testDb, agid, "", "", dv, 0, "", "", "Basic", 1); err != nil {
+			t.Fatalf("Received error updating agreement %v: %v", agid, err)
+		} else if _, err := AgreementMade(testDb, agid, "0x1", "", "Basic", nil, "", "", ""); err != nil {
+			t.Fatalf("Received error recording the reply to agreement %v: %v", agid, err)
+		}
+	}
+
+	governed := func(agid string) *Agreement {
+		ag, err := FindSingleAgreementByAgreementId(testDb, agid, "Basic", []AFilter{})
+		if err != nil || ag == nil {
+			t.Fatalf("Received error finding agreement %v: %v", agid, err)
+		}
+		sweep := &governanceSweep{}
+		sweep.beginProtocol()
+		w.governAgreementWithLock(*ag, cph, sweep)
+
+		ag, _ = FindSingleAgreementByAgreementId(testDb, agid, "Basic", []AFilter{})
+		return ag
+	}
+
+	if ag := governed("gov-unlocked"); !lockedDuringFetch {
+		t.Errorf("expected the agreement lock to be free while the active agreements are retrieved")
+	} else if ag.DataVerificationMissedCount != 1 {
+		t.Errorf("expected the missed data verification to be recorded, got %v", ag.DataVerificationMissedCount)
+	}
+
+	lockedDuringFetch = false
+	terminateDuringFetch = "gov-terminated"
+	if ag := governed("gov-terminated"); !lockedDuringFetch {
+		t.Errorf("expected the agreement lock to be free while the active agreements are retrieved")
+	} else if ag.DataVerificationMissedCount != 0 || ag.AgreementTimedout == 0 {
+		t.Errorf("expected the outcome not to be recorded for the terminated agreement, got %v", ag)
+	} else if len(cph.Work) != 0 {
+		t.Errorf("expected nothing to be queued for the terminated agreement, got %v work items", len(cph.Work))
+	}
+
+}
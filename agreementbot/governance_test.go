@@ -2,7 +2,13 @@ package agreementbot
 
 import (
 	"flag"
+	"fmt"
+	"github.com/open-horizon/anax/config"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -252,3 +258,131 @@ func Test_calc_skiptime10(t *testing.T) {
 	}
 
 }
+
+// with a concurrency of 1 the agreements are governed one at a time, in order
+func Test_governConcurrently_serial(t *testing.T) {
+	order := make([]int, 0, 5)
+	governConcurrently(1, 5, func(i int) {
+		order = append(order, i)
+	})
+
+	if fmt.Sprintf("%v", order) != "[0 1 2 3 4]" {
+		t.Errorf("expected the agreements governed in order, was %v", order)
+	}
+}
+
+// every agreement is governed once, and no more than the concurrency at the same time
+func Test_governConcurrently_bounded(t *testing.T) {
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	governed := make(map[int]int)
+
+	governConcurrently(3, 20, func(i int) {
+		lock.Lock()
+		running += 1
+		if running > maxRunning {
+			maxRunning = running
+		}
+		governed[i] += 1
+		lock.Unlock()
+
+		time.Sleep(2 * time.Millisecond)
+
+		lock.Lock()
+		running -= 1
+		lock.Unlock()
+	})
+
+	if len(governed) != 20 {
+		t.Errorf("expected 20 agreements governed, was %v", len(governed))
+	}
+	for i, count := range governed {
+		if count != 1 {
+			t.Errorf("expected agreement %v governed once, was %v", i, count)
+		}
+	}
+	if maxRunning > 3 {
+		t.Errorf("expected at most 3 agreements governed at the same time, was %v", maxRunning)
+	}
+}
+
+// the agreements governed at the same time share one retrieval of the active agreements per data verification URL,
+// and a slow retrieval doesnt hold up the retrieval from another URL
+func Test_governanceSweep_activeAgreements(t *testing.T) {
+	var lock sync.Mutex
+	requests := make(map[string]int)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests[r.URL.Path] += 1
+		lock.Unlock()
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte(`[{"id":"1","contracts":[{"id":"ag1"}]}]`))
+	}))
+	defer server.Close()
+
+	w := &AgreementBotWorker{httpClient: &http.Client{}}
+	w.BaseWorker.Manager.Config = &config.HorizonConfig{AgreementBot: config.AGConfig{ActiveAgreementsURL: server.URL + "/slow"}}
+
+	sweep := &governanceSweep{}
+	sweep.beginProtocol()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ags, err := sweep.activeAgreements(w, Agreement{}); err != nil || len(ags) != 1 || ags[0] != "ag1" {
+				t.Errorf("expected active agreement ag1, was %v, error: %v", ags, err)
+			}
+		}()
+	}
+
+	done := make(chan bool)
+	go func() {
+		sweep.activeAgreements(w, Agreement{DataVerificationURL: server.URL + "/fast"})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the retrieval from another URL waited for the slow retrieval")
+	}
+
+	close(release)
+	wg.Wait()
+
+	if requests["/slow"] != 1 || requests["/fast"] != 1 {
+		t.Errorf("expected one retrieval from each URL, was %v", requests)
+	} else if !sweep.dataVerificationActive() {
+		t.Errorf("expected data verification to still be active")
+	}
+}
+
+func BenchmarkGovernConcurrently_1(b *testing.B) {
+	benchmarkGovernConcurrently(b, 1)
+}
+
+func BenchmarkGovernConcurrently_4(b *testing.B) {
+	benchmarkGovernConcurrently(b, 4)
+}
+
+func BenchmarkGovernConcurrently_16(b *testing.B) {
+	benchmarkGovernConcurrently(b, 16)
+}
+
+// Govern a sweep of 64 agreements, each under its agreement lock and each waiting 1ms for a simulated call to the
+// exchange or the data verification API, which is what dominates the time of a real sweep.
+func benchmarkGovernConcurrently(b *testing.B, concurrency int) {
+	alm := NewAgreementLockManager()
+	for n := 0; n < b.N; n++ {
+		governConcurrently(concurrency, 64, func(i int) {
+			lock := alm.getAgreementLock(fmt.Sprintf("agreement%v", i))
+			lock.Lock()
+			time.Sleep(time.Millisecond)
+			lock.Unlock()
+		})
+	}
+}
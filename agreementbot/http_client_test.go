@@ -0,0 +1,58 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"fmt"
+	"github.com/open-horizon/anax/config"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func BenchmarkDeleteConsumerAgreement_sharedClient(b *testing.B) {
+	benchmarkDeleteConsumerAgreement(b, false)
+}
+
+func BenchmarkDeleteConsumerAgreement_clientPerCall(b *testing.B) {
+	benchmarkDeleteConsumerAgreement(b, true)
+}
+
+// Delete agreements from a fake exchange, either with one client shared by all the calls as the agbot workers do, or with
+// a new client for each call, and report how many connections the exchange saw.
+func benchmarkDeleteConsumerAgreement(b *testing.B, clientPerCall bool) {
+
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	collaborators, err := config.NewCollaborators(config.HorizonConfig{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	sharedClient := collaborators.HTTPClientFactory.NewHTTPClient(nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		httpClient := sharedClient
+		if clientPerCall {
+			httpClient = collaborators.HTTPClientFactory.NewHTTPClient(nil)
+		}
+		if err := DeleteConsumerAgreement(httpClient, server.URL+"/", "myorg/agbot1", "token", fmt.Sprintf("agreement%v", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	b.Logf("%v new connections for %v agreements", atomic.LoadInt32(&conns), b.N)
+}
@@ -1,40 +1,75 @@
 package agreementbot
 
 import (
+	"fmt"
 	"sync"
 )
 
+// An AgreementLock is the lock for a single agreement id. The lock manager counts the callers that have obtained the
+// lock and not yet unlocked it, i.e. the holder and the waiters. When the last one unlocks, the lock is removed from
+// the lock manager, so that the manager only holds the locks that are in use.
+type AgreementLock struct {
+	sync.Mutex
+	agid  string
+	users int
+	alm   *AgreementLockManager
+}
+
+// Unlock the agreement lock, and remove it from the lock manager if nobody else is holding or waiting for it.
+func (self *AgreementLock) Unlock() {
+	self.Mutex.Unlock()
+	self.alm.release(self)
+}
+
 type AgreementLockManager struct {
-	MapLock           sync.Mutex             // The lock that protects the map of agreement locks
-	AgreementMapLocks map[string]*sync.Mutex // A map of locks by agreement id
+	MapLock           sync.Mutex                // The lock that protects the map of agreement locks
+	AgreementMapLocks map[string]*AgreementLock // A map of locks by agreement id
 }
 
 func NewAgreementLockManager() *AgreementLockManager {
 	lm := new(AgreementLockManager)
-	lm.AgreementMapLocks = make(map[string]*sync.Mutex, 10)
+	lm.AgreementMapLocks = make(map[string]*AgreementLock, 10)
 	return lm
 }
 
-func (self *AgreementLockManager) getAgreementLock(agid string) *sync.Mutex {
+func (self *AgreementLockManager) String() string {
+	return fmt.Sprintf("Locks: %v", self.LockCount())
+}
+
+// Returns the number of agreement locks that are currently held or waited for.
+func (self *AgreementLockManager) LockCount() int {
+	self.MapLock.Lock()
+	defer self.MapLock.Unlock()
+	return len(self.AgreementMapLocks)
+}
+
+// Get the lock for an agreement id. The caller must Lock and then Unlock the returned lock exactly once.
+func (self *AgreementLockManager) getAgreementLock(agid string) *AgreementLock {
 	self.MapLock.Lock()
 	defer self.MapLock.Unlock()
 
 	if _, ok := self.AgreementMapLocks[agid]; !ok {
-		self.AgreementMapLocks[agid] = new(sync.Mutex)
+		self.AgreementMapLocks[agid] = &AgreementLock{agid: agid, alm: self}
 	}
 
+	self.AgreementMapLocks[agid].users += 1
 	return self.AgreementMapLocks[agid]
 
 }
 
-func (self *AgreementLockManager) deleteAgreementLock(agid string) {
+// Called when a user of the lock unlocks it. The lock is removed from the map when it has no more users. Because the
+// users are counted under the map lock, a caller that has obtained the lock but not yet locked it keeps it in the
+// map, so a concurrent caller can never be handed a different lock for the same agreement id.
+func (self *AgreementLockManager) release(lock *AgreementLock) {
 	self.MapLock.Lock()
 	defer self.MapLock.Unlock()
 
-	if _, ok := self.AgreementMapLocks[agid]; !ok {
-		return
+	if lock.users > 0 {
+		lock.users -= 1
 	}
 
-	delete(self.AgreementMapLocks, agid)
-
+	// The lock might have already been deleted, and possibly replaced by a new lock for the same agreement.
+	if lock.users == 0 && self.AgreementMapLocks[lock.agid] == lock {
+		delete(self.AgreementMapLocks, lock.agid)
+	}
 }
@@ -18,15 +18,13 @@ func Test_lock_lifecycle1(t *testing.T) {
 		t.Errorf("There should be 1 lock in the map")
 	}
 
-	alm.deleteAgreementLock("abc")
+	alock.Lock()
+	alock.Unlock()
 
 	if len(alm.AgreementMapLocks) != 0 {
 		t.Errorf("There should be 0 locks in the map")
 	}
 
-	alock.Lock()
-	alock.Unlock()
-
 }
 
 func Test_lock_lifecycle2(t *testing.T) {
@@ -71,8 +69,6 @@ func Test_lock_lifecycle3(t *testing.T) {
 			runtime.Gosched()
 			alock := alm.getAgreementLock(id)
 			runtime.Gosched()
-			alm.deleteAgreementLock(id)
-			runtime.Gosched()
 			alock.Lock()
 			runtime.Gosched()
 			alock.Unlock()
@@ -90,4 +86,56 @@ func Test_lock_lifecycle3(t *testing.T) {
 	// Give time to finish
 	time.Sleep(3 * time.Second)
 
+	if alm.LockCount() != 0 {
+		t.Errorf("There should be 0 locks in the map, there are %v", alm.LockCount())
+	}
+
+}
+
+func Test_lock_released_when_unused(t *testing.T) {
+
+	alm := NewAgreementLockManager()
+
+	// A lock that has been obtained but not yet locked stays in the map, and is shared by every caller.
+	alock := alm.getAgreementLock("abc")
+	block := alm.getAgreementLock("abc")
+	if alock != block {
+		t.Errorf("Callers for the same agreement should get the same lock")
+	} else if alm.LockCount() != 1 {
+		t.Errorf("There should be 1 lock in the map, there are %v", alm.LockCount())
+	}
+
+	alock.Lock()
+	alock.Unlock()
+	if alm.LockCount() != 1 {
+		t.Errorf("The lock should stay in the map while another caller is using it, there are %v", alm.LockCount())
+	}
+
+	block.Lock()
+	block.Unlock()
+	if alm.LockCount() != 0 {
+		t.Errorf("The lock should be removed from the map when it is no longer used, there are %v", alm.LockCount())
+	}
+
+	// Many concurrent users leave no locks behind.
+	done := make(chan bool)
+	for _, id := range []string{"abc", "abc", "def", "def", "ghi"} {
+		go func(id string) {
+			for i := 0; i < 100; i++ {
+				lock := alm.getAgreementLock(id)
+				runtime.Gosched()
+				lock.Lock()
+				runtime.Gosched()
+				lock.Unlock()
+			}
+			done <- true
+		}(id)
+	}
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+
+	if alm.LockCount() != 0 {
+		t.Errorf("There should be 0 locks in the map, there are %v", alm.LockCount())
+	}
 }
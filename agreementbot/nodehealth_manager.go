@@ -6,6 +6,7 @@ import (
 	"github.com/golang/glog"
 	"github.com/open-horizon/anax/cutil"
 	"github.com/open-horizon/anax/exchange"
+	"sync"
 	"time"
 )
 
@@ -45,6 +46,7 @@ func NewNHPatternEntry() *NHPatternEntry {
 
 type NodeHealthManager struct {
 	Patterns map[string]*NHPatternEntry // A map of patterns for which this agbot has agreements
+	lock     sync.Mutex                 // protects Patterns, agreements can be governed concurrently
 }
 
 func (n *NodeHealthManager) String() string {
@@ -61,6 +63,8 @@ func NewNodeHealthManager() *NodeHealthManager {
 
 // Make sure the manager has the latest status info from the exchange.
 func (m *NodeHealthManager) SetUpdatedStatus(pattern string, org string, nhHandler NodeHealthHandler) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
 	updatedAsOfNow := cutil.FormattedTime()
 	if lastCallTime, isUpdated := m.hasUpdatedStatus(pattern, org); !isUpdated {
@@ -76,6 +80,8 @@ func (m *NodeHealthManager) SetUpdatedStatus(pattern string, org string, nhHandl
 // Clear the Updated flag in each pattern entry so that future requests for status will first go the
 // exchange to get any updates.
 func (m *NodeHealthManager) ResetUpdateStatus() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	for _, pe := range m.Patterns {
 		pe.Updated = false
 	}
@@ -84,6 +90,8 @@ func (m *NodeHealthManager) ResetUpdateStatus() {
 // Determine if the input node's heartbeat is overdue, i.e. beyond the policy interval. Return false (not
 // out of policy) if the agrement is still present.
 func (m *NodeHealthManager) NodeOutOfPolicy(pattern string, org string, deviceId string, interval int) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
 	key := getKey(pattern, org)
 	if pe, ok := m.Patterns[key]; !ok {
@@ -104,6 +112,8 @@ func (m *NodeHealthManager) NodeOutOfPolicy(pattern string, org string, deviceId
 // Determine if the input agreement id is still present in the exchange. Return false (not out of policy)
 // if the agreement is still present.
 func (m *NodeHealthManager) AgreementOutOfPolicy(pattern string, org string, deviceId string, agreementId string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
 	key := getKey(pattern, org)
 	if pe, ok := m.Patterns[key]; !ok {
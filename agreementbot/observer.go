@@ -0,0 +1,40 @@
+package agreementbot
+
+import (
+	"fmt"
+	"github.com/open-horizon/anax/policy"
+	"sync"
+)
+
+// ObservedAgreements remembers the agreements that an agbot in observer mode would have proposed. Because an observing
+// agbot never makes the agreements, every search for devices finds the same devices again, so an agreement is only
+// reported again when the workload chosen for the device and policy changes. It is safe for concurrent use by the
+// agreement workers.
+type ObservedAgreements struct {
+	lock     sync.Mutex
+	reported map[string]string // the last workload reported, keyed by device id and policy name
+}
+
+func NewObservedAgreements() *ObservedAgreements {
+	return &ObservedAgreements{
+		reported: make(map[string]string),
+	}
+}
+
+// The agreements observed by the agreement workers of this process.
+var Observations = NewObservedAgreements()
+
+// Remember the workload chosen for the device and policy. Returns true if it differs from the workload last reported
+// for them, in which case the observed agreement should be reported.
+func (o *ObservedAgreements) Observe(deviceId string, policyName string, workload *policy.Workload) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	key := deviceId + "|" + policyName
+	chosen := fmt.Sprintf("%v %v %v", workload.WorkloadURL, workload.Version, workload.Arch)
+	if o.reported[key] == chosen {
+		return false
+	}
+	o.reported[key] = chosen
+	return true
+}
@@ -0,0 +1,28 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"github.com/open-horizon/anax/policy"
+	"testing"
+)
+
+func Test_ObservedAgreements(t *testing.T) {
+
+	o := NewObservedAgreements()
+	cpu := &policy.Workload{WorkloadURL: "cpu", Version: "1.0.0", Arch: "amd64"}
+
+	if !o.Observe("myorg/an1", "pol", cpu) {
+		t.Errorf("expected the first observation to be reported")
+	} else if o.Observe("myorg/an1", "pol", cpu) {
+		t.Errorf("expected the same observation not to be reported again")
+	} else if !o.Observe("myorg/an2", "pol", cpu) {
+		t.Errorf("expected the observation of another device to be reported")
+	} else if !o.Observe("myorg/an1", "other pol", cpu) {
+		t.Errorf("expected the observation of another policy to be reported")
+	} else if !o.Observe("myorg/an1", "pol", &policy.Workload{WorkloadURL: "cpu", Version: "1.1.0", Arch: "amd64"}) {
+		t.Errorf("expected a change of workload to be reported")
+	} else if !o.Observe("myorg/an1", "pol", cpu) {
+		t.Errorf("expected a change back to the first workload to be reported")
+	}
+}
@@ -13,52 +13,66 @@ import (
 const AGREEMENTS = "agreements"
 
 type Agreement struct {
-	CurrentAgreementId             string   `json:"current_agreement_id"`              // unique
-	Org                            string   `json:"org"`                               // the org in which the policy exists that was used to make this agreement
-	DeviceId                       string   `json:"device_id"`                         // the device id we are working with, immutable after construction
-	HAPartners                     []string `json:"ha_partners"`                       // list of HA partner device IDs
-	AgreementProtocol              string   `json:"agreement_protocol"`                // immutable after construction - name of protocol in use
-	AgreementProtocolVersion       int      `json:"agreement_protocol_version"`        // version of protocol in use - New in V2 protocol
-	AgreementInceptionTime         uint64   `json:"agreement_inception_time"`          // immutable after construction
-	AgreementCreationTime          uint64   `json:"agreement_creation_time"`           // device responds affirmatively to proposal
-	AgreementFinalizedTime         uint64   `json:"agreement_finalized_time"`          // agreement is seen in the blockchain
-	AgreementTimedout              uint64   `json:"agreement_timeout"`                 // agreement was not finalized before it timed out
-	ProposalSig                    string   `json:"proposal_signature"`                // The signature used to create the agreement - from the producer
-	Proposal                       string   `json:"proposal"`                          // JSON serialization of the proposal
-	ProposalHash                   string   `json:"proposal_hash"`                     // Hash of the proposal
-	ConsumerProposalSig            string   `json:"consumer_proposal_sig"`             // Consumer's signature of the proposal
-	Policy                         string   `json:"policy"`                            // JSON serialization of the policy used to make the proposal
-	PolicyName                     string   `json:"policy_name"`                       // The name of the policy for this agreement, policy names are unique
-	CounterPartyAddress            string   `json:"counter_party_address"`             // The blockchain address of the counterparty in the agreement
-	DataVerificationURL            string   `json:"data_verification_URL"`             // The URL to use to ensure that this agreement is sending data.
-	DataVerificationUser           string   `json:"data_verification_user"`            // The user to use with the DataVerificationURL
-	DataVerificationPW             string   `json:"data_verification_pw"`              // The pw of the data verification user
-	DataVerificationCheckRate      int      `json:"data_verification_check_rate"`      // How often to check for data
-	DataVerificationMissedCount    uint64   `json:"data_verification_missed_count"`    // Number of data verification misses
-	DataVerificationNoDataInterval int      `json:"data_verification_nodata_interval"` // How long to wait before deciding there is no data
-	DisableDataVerificationChecks  bool     `json:"disable_data_verification_checks"`  // disable data verification checks, assume data is being sent.
-	DataVerifiedTime               uint64   `json:"data_verification_time"`            // The last time that data verification was successful
-	DataNotificationSent           uint64   `json:"data_notification_sent"`            // The timestamp for when data notification was sent to the device
-	MeteringTokens                 uint64   `json:"metering_tokens"`                   // Number of metering tokens from proposal
-	MeteringPerTimeUnit            string   `json:"metering_per_time_unit"`            // The time units of tokens per, from the proposal
-	MeteringNotificationInterval   int      `json:"metering_notify_interval"`          // The interval of time between metering notifications (seconds)
-	MeteringNotificationSent       uint64   `json:"metering_notification_sent"`        // The last time a metering notification was sent
-	MeteringNotificationMsgs       []string `json:"metering_notification_msgs"`        // The last metering messages that were sent, oldest at the end
-	Archived                       bool     `json:"archived"`                          // The record is archived
-	TerminatedReason               uint     `json:"terminated_reason"`                 // The reason the agreement was terminated
-	TerminatedDescription          string   `json:"terminated_description"`            // The description of why the agreement was terminated
-	BlockchainType                 string   `json:"blockchain_type"`                   // The name of the blockchain type that is being used (new V2 protocol)
-	BlockchainName                 string   `json:"blockchain_name"`                   // The name of the blockchain being used (new V2 protocol)
-	BlockchainOrg                  string   `json:"blockchain_org"`                    // The name of the blockchain org being used (new V2 protocol)
-	BCUpdateAckTime                uint64   `json:"blockchain_update_ack_time"`        // The time when the producer ACked our update ot him (new V2 protocol)
-	NHMissingHBInterval            int      `json:"missing_heartbeat_interval"`        // How long a heartbeat can be missing until it is considered missing (in seconds)
-	NHCheckAgreementStatus         int      `json:"check_agreement_status"`            // How often to check that the node agreement entry still exists in the exchange (in seconds)
-	Pattern                        string   `json:"pattern"`                           // The pattern used to make the agreement
+	CurrentAgreementId             string            `json:"current_agreement_id"`              // unique
+	Org                            string            `json:"org"`                               // the org in which the policy exists that was used to make this agreement
+	DeviceId                       string            `json:"device_id"`                         // the device id we are working with, immutable after construction
+	HAPartners                     []string          `json:"ha_partners"`                       // list of HA partner device IDs
+	AgreementProtocol              string            `json:"agreement_protocol"`                // immutable after construction - name of protocol in use
+	AgreementProtocolVersion       int               `json:"agreement_protocol_version"`        // version of protocol in use - New in V2 protocol
+	AgreementInceptionTime         uint64            `json:"agreement_inception_time"`          // immutable after construction
+	AgreementCreationTime          uint64            `json:"agreement_creation_time"`           // device responds affirmatively to proposal
+	AgreementFinalizedTime         uint64            `json:"agreement_finalized_time"`          // agreement is seen in the blockchain
+	AgreementTimedout              uint64            `json:"agreement_timeout"`                 // agreement was not finalized before it timed out
+	ProposalSig                    string            `json:"proposal_signature"`                // The signature used to create the agreement - from the producer
+	Proposal                       string            `json:"proposal"`                          // JSON serialization of the proposal
+	ProposalHash                   string            `json:"proposal_hash"`                     // Hash of the proposal
+	ConsumerProposalSig            string            `json:"consumer_proposal_sig"`             // Consumer's signature of the proposal
+	Policy                         string            `json:"policy"`                            // JSON serialization of the policy used to make the proposal
+	PolicyName                     string            `json:"policy_name"`                       // The name of the policy for this agreement, policy names are unique
+	CounterPartyAddress            string            `json:"counter_party_address"`             // The blockchain address of the counterparty in the agreement
+	DataVerificationURL            string            `json:"data_verification_URL"`             // The URL to use to ensure that this agreement is sending data.
+	DataVerificationUser           string            `json:"data_verification_user"`            // The user to use with the DataVerificationURL
+	DataVerificationPW             string            `json:"data_verification_pw"`              // The pw of the data verification user
+	DataVerificationCheckRate      int               `json:"data_verification_check_rate"`      // How often to check for data
+	DataVerificationMissedCount    uint64            `json:"data_verification_missed_count"`    // Number of data verification misses
+	DataVerificationNoDataInterval int               `json:"data_verification_nodata_interval"` // How long to wait before deciding there is no data
+	DisableDataVerificationChecks  bool              `json:"disable_data_verification_checks"`  // disable data verification checks, assume data is being sent.
+	DataVerifiedTime               uint64            `json:"data_verification_time"`            // The last time that data verification was successful
+	DataNotificationSent           uint64            `json:"data_notification_sent"`            // The timestamp for when data notification was sent to the device
+	UnexpectedDataAcks             uint64            `json:"unexpected_data_acks"`              // The number of data received acks from the device that were flagged because the policy disabled data verification
+	MeteringTokens                 uint64            `json:"metering_tokens"`                   // Number of metering tokens from proposal
+	MeteringPerTimeUnit            string            `json:"metering_per_time_unit"`            // The time units of tokens per, from the proposal
+	MeteringNotificationInterval   int               `json:"metering_notify_interval"`          // The interval of time between metering notifications (seconds)
+	MeteringNotificationSent       uint64            `json:"metering_notification_sent"`        // The last time a metering notification was sent
+	MeteringNotificationMsgs       []string          `json:"metering_notification_msgs"`        // The last metering messages that were sent, oldest at the end
+	Archived                       bool              `json:"archived"`                          // The record is archived
+	Paused                         bool              `json:"paused"`                            // Governance of the agreement is suspended, it is not checked or cancelled for lack of data or node health
+	PausedTime                     uint64            `json:"paused_time"`                       // The time when the agreement was paused, zero when it is not paused
+	TerminatedReason               uint              `json:"terminated_reason"`                 // The reason the agreement was terminated
+	TerminatedDescription          string            `json:"terminated_description"`            // The description of why the agreement was terminated
+	OperatorReason                 string            `json:"operator_reason"`                   // The reason given by the operator who cancelled the agreement, empty for automated cancels
+	BlockchainType                 string            `json:"blockchain_type"`                   // The name of the blockchain type that is being used (new V2 protocol)
+	BlockchainName                 string            `json:"blockchain_name"`                   // The name of the blockchain being used (new V2 protocol)
+	BlockchainOrg                  string            `json:"blockchain_org"`                    // The name of the blockchain org being used (new V2 protocol)
+	BCUpdateAckTime                uint64            `json:"blockchain_update_ack_time"`        // The time when the producer ACked our update ot him (new V2 protocol)
+	NHMissingHBInterval            int               `json:"missing_heartbeat_interval"`        // How long a heartbeat can be missing until it is considered missing (in seconds)
+	NHCheckAgreementStatus         int               `json:"check_agreement_status"`            // How often to check that the node agreement entry still exists in the exchange (in seconds)
+	Pattern                        string            `json:"pattern"`                           // The pattern used to make the agreement
+	ProducerPolicy                 string            `json:"producer_policy"`                   // JSON serialization of the merged producer policy, with sensitive fields redacted
+	DeploymentOverridesGroup       string            `json:"deployment_overrides_group"`        // The device group whose configured deployment overrides were applied to the workload, empty if none
+	WorkloadURL                    string            `json:"workload_url"`                      // The URL of the workload chosen for the agreement
+	WorkloadVersion                string            `json:"workload_version"`                  // The version of the workload chosen for the agreement
+	WorkloadArch                   string            `json:"workload_arch"`                     // The arch of the workload chosen for the agreement
+	Metadata                       map[string]string `json:"metadata,omitempty"`                // Operator supplied key/value pairs used to correlate the agreement with external systems
+	metadataChanges                map[string]string // The metadata changes to merge into the record within the update transaction, not persisted
+	pauseChange                    *bool             // The pause or resume to apply to the record within the update transaction, not persisted
 
 }
 
 func (a Agreement) String() string {
 	return fmt.Sprintf("Archived: %v, "+
+		"Paused: %v, "+
+		"PausedTime: %v, "+
 		"CurrentAgreementId: %v, "+
 		"Org: %v, "+
 		"AgreementProtocol: %v, "+
@@ -82,6 +96,7 @@ func (a Agreement) String() string {
 		"DisableDataVerification: %v, "+
 		"DataVerifiedTime: %v, "+
 		"DataNotificationSent: %v, "+
+		"UnexpectedDataAcks: %v, "+
 		"MeteringTokens: %v, "+
 		"MeteringPerTimeUnit: %v, "+
 		"MeteringNotificationInterval: %v, "+
@@ -89,25 +104,32 @@ func (a Agreement) String() string {
 		"MeteringNotificationMsgs: %v, "+
 		"TerminatedReason: %v, "+
 		"TerminatedDescription: %v, "+
+		"OperatorReason: %v, "+
 		"BlockchainType: %v, "+
 		"BlockchainName: %v, "+
 		"BlockchainOrg: %v, "+
 		"BCUpdateAckTime: %v, "+
 		"NHMissingHBInterval: %v, "+
 		"NHCheckAgreementStatus: %v, "+
-		"Pattern: %v",
-		a.Archived, a.CurrentAgreementId, a.Org, a.AgreementProtocol, a.AgreementProtocolVersion, a.DeviceId, a.HAPartners,
+		"Pattern: %v, "+
+		"DeploymentOverridesGroup: %v, "+
+		"WorkloadURL: %v, "+
+		"WorkloadVersion: %v, "+
+		"WorkloadArch: %v, "+
+		"Metadata: %v",
+		a.Archived, a.Paused, a.PausedTime, a.CurrentAgreementId, a.Org, a.AgreementProtocol, a.AgreementProtocolVersion, a.DeviceId, a.HAPartners,
 		a.AgreementInceptionTime, a.AgreementCreationTime, a.AgreementFinalizedTime,
 		a.AgreementTimedout, a.ProposalSig, a.ProposalHash, a.ConsumerProposalSig, a.PolicyName, a.CounterPartyAddress,
 		a.DataVerificationURL, a.DataVerificationUser, a.DataVerificationCheckRate, a.DataVerificationMissedCount, a.DataVerificationNoDataInterval,
-		a.DisableDataVerificationChecks, a.DataVerifiedTime, a.DataNotificationSent,
+		a.DisableDataVerificationChecks, a.DataVerifiedTime, a.DataNotificationSent, a.UnexpectedDataAcks,
 		a.MeteringTokens, a.MeteringPerTimeUnit, a.MeteringNotificationInterval, a.MeteringNotificationSent, a.MeteringNotificationMsgs,
-		a.TerminatedReason, a.TerminatedDescription, a.BlockchainType, a.BlockchainName, a.BlockchainOrg, a.BCUpdateAckTime,
-		a.NHMissingHBInterval, a.NHCheckAgreementStatus, a.Pattern)
+		a.TerminatedReason, a.TerminatedDescription, a.OperatorReason, a.BlockchainType, a.BlockchainName, a.BlockchainOrg, a.BCUpdateAckTime,
+		a.NHMissingHBInterval, a.NHCheckAgreementStatus, a.Pattern, a.DeploymentOverridesGroup,
+		a.WorkloadURL, a.WorkloadVersion, a.WorkloadArch, a.Metadata)
 }
 
 // private factory method for agreement w/out persistence safety:
-func agreement(agreementid string, org string, deviceid string, policyName string, bcType string, bcName string, bcOrg string, agreementProto string, pattern string, nhPolicy policy.NodeHealth) (*Agreement, error) {
+func agreement(agreementid string, org string, deviceid string, policyName string, bcType string, bcName string, bcOrg string, agreementProto string, pattern string, nhPolicy policy.NodeHealth, workload *policy.Workload, metadata map[string]string) (*Agreement, error) {
 	if agreementid == "" || agreementProto == "" {
 		return nil, errors.New("Illegal input: agreement id or agreement protocol is empty")
 	} else {
@@ -145,6 +167,7 @@ func agreement(agreementid string, org string, deviceid string, policyName strin
 			Archived:                       false,
 			TerminatedReason:               0,
 			TerminatedDescription:          "",
+			OperatorReason:                 "",
 			BlockchainType:                 bcType,
 			BlockchainName:                 bcName,
 			BlockchainOrg:                  bcOrg,
@@ -152,12 +175,16 @@ func agreement(agreementid string, org string, deviceid string, policyName strin
 			NHMissingHBInterval:            nhPolicy.MissingHBInterval,
 			NHCheckAgreementStatus:         nhPolicy.CheckAgreementStatus,
 			Pattern:                        pattern,
+			WorkloadURL:                    workload.WorkloadURL,
+			WorkloadVersion:                workload.Version,
+			WorkloadArch:                   workload.Arch,
+			Metadata:                       copyMetadata(metadata),
 		}, nil
 	}
 }
 
-func AgreementAttempt(db *bolt.DB, agreementid string, org string, deviceid string, policyName string, bcType string, bcName string, bcOrg string, agreementProto string, pattern string, nhPolicy policy.NodeHealth) error {
-	if agreement, err := agreement(agreementid, org, deviceid, policyName, bcType, bcName, bcOrg, agreementProto, pattern, nhPolicy); err != nil {
+func AgreementAttempt(db *bolt.DB, agreementid string, org string, deviceid string, policyName string, bcType string, bcName string, bcOrg string, agreementProto string, pattern string, nhPolicy policy.NodeHealth, workload *policy.Workload, metadata map[string]string) error {
+	if agreement, err := agreement(agreementid, org, deviceid, policyName, bcType, bcName, bcOrg, agreementProto, pattern, nhPolicy, workload, metadata); err != nil {
 		return err
 	} else if err := PersistNew(db, agreement.CurrentAgreementId, bucketName(agreementProto), &agreement); err != nil {
 		return err
@@ -197,6 +224,70 @@ func AgreementUpdate(db *bolt.DB, agreementid string, proposal string, policy st
 	}
 }
 
+func AgreementProducerPolicy(db *bolt.DB, agreementid string, producerPolicy string, protocol string) (*Agreement, error) {
+	if agreement, err := singleAgreementUpdate(db, agreementid, protocol, func(a Agreement) *Agreement {
+		a.ProducerPolicy = producerPolicy
+		return &a
+	}); err != nil {
+		return nil, err
+	} else {
+		return agreement, nil
+	}
+}
+
+func AgreementDeploymentOverrides(db *bolt.DB, agreementid string, group string, protocol string) (*Agreement, error) {
+	if agreement, err := singleAgreementUpdate(db, agreementid, protocol, func(a Agreement) *Agreement {
+		a.DeploymentOverridesGroup = group
+		return &a
+	}); err != nil {
+		return nil, err
+	} else {
+		return agreement, nil
+	}
+}
+
+// Add the input metadata to the agreement's metadata, replacing the values of keys it already has. A key with an empty
+// value is removed from the agreement's metadata.
+func AgreementMetadata(db *bolt.DB, agreementid string, metadata map[string]string, protocol string) (*Agreement, error) {
+	if agreement, err := singleAgreementUpdate(db, agreementid, protocol, func(a Agreement) *Agreement {
+		a.Metadata = mergeMetadata(a.Metadata, metadata)
+		a.metadataChanges = metadata
+		return &a
+	}); err != nil {
+		return nil, err
+	} else {
+		return agreement, nil
+	}
+}
+
+// Returns a copy of the metadata with the changes merged in, a key with an empty value is removed.
+func mergeMetadata(metadata map[string]string, changes map[string]string) map[string]string {
+	merged := copyMetadata(metadata)
+	if merged == nil {
+		merged = make(map[string]string)
+	}
+	for k, v := range changes {
+		if v == "" {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+	return copyMetadata(merged)
+}
+
+// Returns a copy of the metadata, or nil if there is none so that empty metadata is not persisted.
+func copyMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		res[k] = v
+	}
+	return res
+}
+
 func AgreementMade(db *bolt.DB, agreementId string, counterParty string, signature string, protocol string, hapartners []string, bcType string, bcName string, bcOrg string) (*Agreement, error) {
 	if agreement, err := singleAgreementUpdate(db, agreementId, protocol, func(a Agreement) *Agreement {
 		a.CounterPartyAddress = counterParty
@@ -271,6 +362,31 @@ func DataVerified(db *bolt.DB, agreementid string, protocol string) (*Agreement,
 	}
 }
 
+// Pause or resume governance of an agreement. Resuming restarts the no data timer, so that the time the agreement was
+// paused does not count against the no data interval.
+func PauseAgreement(db *bolt.DB, agreementid string, protocol string, paused bool) (*Agreement, error) {
+	if agreement, err := singleAgreementUpdate(db, agreementid, protocol, func(a Agreement) *Agreement {
+		setPaused(&a, paused, uint64(time.Now().Unix()))
+		a.pauseChange = &paused
+		return &a
+	}); err != nil {
+		return nil, err
+	} else {
+		return agreement, nil
+	}
+}
+
+// Pause or resume the agreement record at the input time, nothing changes if it is already paused or resumed.
+func setPaused(a *Agreement, paused bool, now uint64) {
+	if paused && !a.Paused {
+		a.PausedTime = now
+	} else if !paused && a.Paused {
+		a.PausedTime = 0
+		a.DataVerifiedTime = now
+	}
+	a.Paused = paused
+}
+
 func DataNotVerified(db *bolt.DB, agreementid string, protocol string) (*Agreement, error) {
 	if agreement, err := singleAgreementUpdate(db, agreementid, protocol, func(a Agreement) *Agreement {
 		a.DataVerificationMissedCount += 1
@@ -293,6 +409,18 @@ func DataNotification(db *bolt.DB, agreementid string, protocol string) (*Agreem
 	}
 }
 
+// Count a data received ack from the device that is flagged because the agreement's policy disabled data verification.
+func UnexpectedDataAck(db *bolt.DB, agreementid string, protocol string) (*Agreement, error) {
+	if agreement, err := singleAgreementUpdate(db, agreementid, protocol, func(a Agreement) *Agreement {
+		a.UnexpectedDataAcks += 1
+		return &a
+	}); err != nil {
+		return nil, err
+	} else {
+		return agreement, nil
+	}
+}
+
 func MeteringNotification(db *bolt.DB, agreementid string, protocol string, mn string) (*Agreement, error) {
 	if agreement, err := singleAgreementUpdate(db, agreementid, protocol, func(a Agreement) *Agreement {
 		a.MeteringNotificationSent = uint64(time.Now().Unix())
@@ -318,11 +446,14 @@ func (a *Agreement) FinalizedWithinTolerance(tolerance uint64) bool {
 	return a.AgreementFinalizedTime > tolerate
 }
 
-func ArchiveAgreement(db *bolt.DB, agreementid string, protocol string, reason uint, desc string) (*Agreement, error) {
+// Archive a terminated agreement, recording why it was terminated. The operatorReason is the free text reason given by an
+// operator who cancelled the agreement, it is empty for automated cancels.
+func ArchiveAgreement(db *bolt.DB, agreementid string, protocol string, reason uint, desc string, operatorReason string) (*Agreement, error) {
 	if agreement, err := singleAgreementUpdate(db, agreementid, protocol, func(a Agreement) *Agreement {
 		a.Archived = true
 		a.TerminatedReason = reason
 		a.TerminatedDescription = desc
+		a.OperatorReason = operatorReason
 		return &a
 	}); err != nil {
 		return nil, err
@@ -447,6 +578,9 @@ func persistUpdatedAgreement(db *bolt.DB, agreementid string, protocol string, u
 				if mod.DataNotificationSent < update.DataNotificationSent { // Valid transitions must move forward
 					mod.DataNotificationSent = update.DataNotificationSent
 				}
+				if mod.UnexpectedDataAcks < update.UnexpectedDataAcks { // Valid transitions must move forward
+					mod.UnexpectedDataAcks = update.UnexpectedDataAcks
+				}
 				if len(mod.HAPartners) == 0 { // 1 transition from empty array to non-empty
 					mod.HAPartners = update.HAPartners
 				}
@@ -468,12 +602,18 @@ func persistUpdatedAgreement(db *bolt.DB, agreementid string, protocol string, u
 				if !mod.Archived { // 1 transition from false to true
 					mod.Archived = update.Archived
 				}
+				if update.pauseChange != nil { // only changed by PauseAgreement, so that a stale update can't undo a pause or resume
+					setPaused(&mod, *update.pauseChange, uint64(time.Now().Unix()))
+				}
 				if mod.TerminatedReason == 0 { // 1 valid transition from zero to non-zero
 					mod.TerminatedReason = update.TerminatedReason
 				}
 				if mod.TerminatedDescription == "" { // 1 transition from empty to non-empty
 					mod.TerminatedDescription = update.TerminatedDescription
 				}
+				if mod.OperatorReason == "" { // 1 transition from empty to non-empty
+					mod.OperatorReason = update.OperatorReason
+				}
 				if mod.BlockchainType == "" { // 1 transition from empty to non-empty
 					mod.BlockchainType = update.BlockchainType
 				}
@@ -489,6 +629,15 @@ func persistUpdatedAgreement(db *bolt.DB, agreementid string, protocol string, u
 				if mod.BCUpdateAckTime == 0 { // 1 transition from zero to non-zero
 					mod.BCUpdateAckTime = update.BCUpdateAckTime
 				}
+				if mod.ProducerPolicy == "" { // 1 transition from empty to non-empty
+					mod.ProducerPolicy = update.ProducerPolicy
+				}
+				if mod.DeploymentOverridesGroup == "" { // 1 transition from empty to non-empty
+					mod.DeploymentOverridesGroup = update.DeploymentOverridesGroup
+				}
+				if update.metadataChanges != nil { // merged into the current metadata so that concurrent changes are not lost
+					mod.Metadata = mergeMetadata(mod.Metadata, update.metadataChanges)
+				}
 				if serialized, err := json.Marshal(mod); err != nil {
 					return fmt.Errorf("Failed to serialize agreement record: %v", mod)
 				} else if err := b.Put([]byte(agreementid), serialized); err != nil {
@@ -537,6 +686,10 @@ func ArchivedAFilter() AFilter {
 	return func(e Agreement) bool { return e.Archived }
 }
 
+func PausedAFilter() AFilter {
+	return func(e Agreement) bool { return e.Paused }
+}
+
 func IdAFilter(id string) AFilter {
 	return func(a Agreement) bool { return a.CurrentAgreementId == id }
 }
@@ -545,8 +698,77 @@ func DevPolAFilter(deviceId string, policyName string) AFilter {
 	return func(a Agreement) bool { return a.DeviceId == deviceId && a.PolicyName == policyName }
 }
 
+func DeviceAFilter(deviceId string) AFilter {
+	return func(a Agreement) bool { return a.DeviceId == deviceId }
+}
+
+// A filter for pending agreements that have been waiting longer than timeoutS for their proposal to be made. The agreement
+// was created by AgreementAttempt but was never updated with a proposal, so it has no creation time and will never see a
+// reply.
+func ExpiredProposalAFilter(now uint64, timeoutS uint64) AFilter {
+	return func(a Agreement) bool {
+		return a.AgreementCreationTime == 0 && a.AgreementTimedout == 0 && a.AgreementInceptionTime+timeoutS < now
+	}
+}
+
+// Matches the agreements for a workload. An empty url, version or arch matches all urls, versions or arches, e.g. an
+// empty url and a version match the agreements for that version of any workload.
+func WorkloadAFilter(url string, version string, arch string) AFilter {
+	return func(a Agreement) bool {
+		return (url == "" || a.WorkloadURL == url) && (version == "" || a.WorkloadVersion == version) && (arch == "" || a.WorkloadArch == arch)
+	}
+}
+
+// Matches the agreements that can still be cancelled, the ones that are neither archived nor being terminated.
+func CancellableAFilter() AFilter {
+	return func(a Agreement) bool { return !a.Archived && a.AgreementTimedout == 0 }
+}
+
+// Matches the agreements with the metadata key. An empty value matches any value of the key.
+func MetadataAFilter(key string, value string) AFilter {
+	return func(a Agreement) bool {
+		v, ok := a.Metadata[key]
+		return ok && (value == "" || v == value)
+	}
+}
+
+// Matches the agreements that every filter matches. With no filters it matches every agreement.
+func AndAFilter(filters ...AFilter) AFilter {
+	return func(a Agreement) bool {
+		for _, f := range filters {
+			if !f(a) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Matches the agreements that any of the filters matches. With no filters it matches no agreement.
+func OrAFilter(filters ...AFilter) AFilter {
+	return func(a Agreement) bool {
+		for _, f := range filters {
+			if f(a) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Matches the agreements that the filter does not match.
+func NotAFilter(filter AFilter) AFilter {
+	return func(a Agreement) bool { return !filter(a) }
+}
+
+// A filter used by FindAgreements to select agreements. Given an agreement, it returns true to keep the agreement in
+// the result and false to drop it. Filters are called with a copy of each agreement, inside the database's read
+// transaction, so they must not modify the database or block. Any function with this signature is a filter, including
+// a method value such as myFilter.Keep, which lets a caller define its own filters alongside the ones in this file.
 type AFilter func(Agreement) bool
 
+// Returns the agreements of the protocol that every filter keeps. The filters are called in order and an agreement is
+// dropped by the first filter that returns false. A nil filter keeps every agreement.
 func FindAgreements(db *bolt.DB, filters []AFilter, protocol string) ([]Agreement, error) {
 	agreements := make([]Agreement, 0)
 
@@ -565,8 +787,9 @@ func FindAgreements(db *bolt.DB, filters []AFilter, protocol string) ([]Agreemen
 					}
 					exclude := false
 					for _, filterFn := range filters {
-						if !filterFn(a) {
+						if filterFn != nil && !filterFn(a) {
 							exclude = true
+							break
 						}
 					}
 					if !exclude {
@@ -587,6 +810,37 @@ func FindAgreements(db *bolt.DB, filters []AFilter, protocol string) ([]Agreemen
 	}
 }
 
+// Cancel all agreements for a workload, regardless of device or policy, e.g. when the workload is being retired. See
+// CancelAgreements.
+func CancelWorkloadAgreements(db *bolt.DB, url string, version string, arch string, cancel func(ag Agreement)) ([]Agreement, error) {
+	cancelled, err := CancelAgreements(db, WorkloadAFilter(url, version, arch), cancel)
+	if err != nil {
+		return cancelled, errors.New(fmt.Sprintf("error cancelling agreements for workload %v version %v arch %v, %v", url, version, arch, err))
+	}
+	return cancelled, nil
+}
+
+// Cancel all active agreements matched by the filter, in every agreement protocol. The agreements are marked as timed out
+// so that they are not cancelled twice, and the cancel function is called for each of them to start the cancellation.
+// Returns the agreements being cancelled.
+func CancelAgreements(db *bolt.DB, filter AFilter, cancel func(ag Agreement)) ([]Agreement, error) {
+	cancelled := make([]Agreement, 0, 10)
+	for _, agp := range policy.AllAgreementProtocols() {
+		if ags, err := FindAgreements(db, []AFilter{CancellableAFilter(), filter}, agp); err != nil {
+			return cancelled, errors.New(fmt.Sprintf("error finding %v agreements, error: %v", agp, err))
+		} else {
+			for _, ag := range ags {
+				if _, err := AgreementTimedout(db, ag.CurrentAgreementId, ag.AgreementProtocol); err != nil {
+					return cancelled, errors.New(fmt.Sprintf("error marking agreement %v terminated, error: %v", ag.CurrentAgreementId, err))
+				}
+				cancel(ag)
+				cancelled = append(cancelled, ag)
+			}
+		}
+	}
+	return cancelled, nil
+}
+
 func PersistNew(db *bolt.DB, pk string, bucket string, record interface{}) error {
 	if pk == "" || bucket == "" {
 		return fmt.Errorf("Missing required args, pk and/or bucket")
@@ -0,0 +1,226 @@
+// +build integration
+
+package agreementbot
+
+import (
+	"github.com/open-horizon/anax/policy"
+	"testing"
+	"time"
+)
+
+func Test_AgreementProducerPolicy_persisted(t *testing.T) {
+
+	agid := "producerpolicy1"
+	if err := AgreementAttempt(testDb, agid, "myorg", "myorg/dev1", "mypolicy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+		t.Errorf("Received error creating agreement: %v", err)
+	} else if _, err := AgreementProducerPolicy(testDb, agid, `{"header":{"name":"producer"}}`, "Basic"); err != nil {
+		t.Errorf("Received error updating producer policy: %v", err)
+	} else if _, err := AgreementDeploymentOverrides(testDb, agid, "myorg", "Basic"); err != nil {
+		t.Errorf("Received error updating deployment overrides group: %v", err)
+	} else if ag, err := FindSingleAgreementByAgreementId(testDb, agid, "Basic", []AFilter{}); err != nil {
+		t.Errorf("Received error finding agreement: %v", err)
+	} else if ag.ProducerPolicy != `{"header":{"name":"producer"}}` || ag.DeploymentOverridesGroup != "myorg" {
+		t.Errorf("Agreement updates were not persisted: %v", ag)
+	}
+}
+
+func Test_ArchiveAgreement_operator_reason(t *testing.T) {
+
+	if err := AgreementAttempt(testDb, "operator1", "myorg", "myorg/opdev1", "mypolicy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+		t.Errorf("Received error creating agreement: %v", err)
+	} else if _, err := ArchiveAgreement(testDb, "operator1", "Basic", 200, "user requested", "device being replaced"); err != nil {
+		t.Errorf("Received error archiving agreement: %v", err)
+	} else if ag, err := FindSingleAgreementByAgreementId(testDb, "operator1", "Basic", []AFilter{}); err != nil {
+		t.Errorf("Received error finding agreement: %v", err)
+	} else if !ag.Archived || ag.TerminatedReason != 200 || ag.OperatorReason != "device being replaced" {
+		t.Errorf("Operator reason was not persisted with the termination reason: %v", ag)
+	}
+}
+
+func Test_AgreementMetadata(t *testing.T) {
+
+	if err := AgreementAttempt(testDb, "metadata1", "myorg", "myorg/mddev1", "mypolicy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, map[string]string{"batch": "b1", "ticket": "t1"}); err != nil {
+		t.Errorf("Received error creating agreement: %v", err)
+	} else if err := AgreementAttempt(testDb, "metadata2", "myorg", "myorg/mddev2", "mypolicy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, map[string]string{}); err != nil {
+		t.Errorf("Received error creating agreement: %v", err)
+	} else if ag, err := FindSingleAgreementByAgreementId(testDb, "metadata2", "Basic", []AFilter{}); err != nil {
+		t.Errorf("Received error finding agreement: %v", err)
+	} else if ag.Metadata != nil {
+		t.Errorf("Empty metadata should not be persisted: %v", ag.Metadata)
+	}
+
+	if ags, err := FindAgreements(testDb, []AFilter{MetadataAFilter("batch", "b1")}, "Basic"); err != nil {
+		t.Errorf("Received error finding agreements: %v", err)
+	} else if len(ags) != 1 || ags[0].CurrentAgreementId != "metadata1" {
+		t.Errorf("Expected only agreement metadata1, got %v", ags)
+	}
+
+	// Replace one key, add another and remove the third.
+	if ag, err := AgreementMetadata(testDb, "metadata1", map[string]string{"batch": "b2", "owner": "ops", "ticket": ""}, "Basic"); err != nil {
+		t.Errorf("Received error updating metadata: %v", err)
+	} else if len(ag.Metadata) != 2 || ag.Metadata["batch"] != "b2" || ag.Metadata["owner"] != "ops" {
+		t.Errorf("Metadata not updated correctly: %v", ag.Metadata)
+	}
+
+	if ags, err := FindAgreements(testDb, []AFilter{MetadataAFilter("batch", "b1")}, "Basic"); err != nil {
+		t.Errorf("Received error finding agreements: %v", err)
+	} else if len(ags) != 0 {
+		t.Errorf("Expected no agreements, got %v", ags)
+	} else if ags, err := FindAgreements(testDb, []AFilter{MetadataAFilter("owner", "")}, "Basic"); err != nil {
+		t.Errorf("Received error finding agreements: %v", err)
+	} else if len(ags) != 1 || ags[0].CurrentAgreementId != "metadata1" {
+		t.Errorf("Expected only agreement metadata1, got %v", ags)
+	}
+}
+
+func Test_CancelWorkloadAgreements(t *testing.T) {
+
+	cpu1 := &policy.Workload{WorkloadURL: "https://bluehorizon.network/workloads/cpu", Version: "1.0.0", Arch: "amd64"}
+	cpu2 := &policy.Workload{WorkloadURL: "https://bluehorizon.network/workloads/cpu", Version: "2.0.0", Arch: "arm"}
+	gps := &policy.Workload{WorkloadURL: "https://bluehorizon.network/workloads/gps", Version: "1.0.0", Arch: "amd64"}
+
+	for agid, wl := range map[string]*policy.Workload{"cpudev1": cpu1, "cpudev2": cpu1, "cpudev3": cpu2, "gpsdev1": gps} {
+		if err := AgreementAttempt(testDb, agid, "myorg", "myorg/"+agid, "policy-"+agid, "", "", "", "Basic", "", policy.NodeHealth{}, wl, nil); err != nil {
+			t.Errorf("Received error creating agreement: %v", err)
+		}
+	}
+
+	// Only the version 1.0.0 agreements are cancelled.
+	cancelled := make(map[string]bool)
+	if ags, err := CancelWorkloadAgreements(testDb, cpu1.WorkloadURL, "1.0.0", "", func(ag Agreement) { cancelled[ag.CurrentAgreementId] = true }); err != nil {
+		t.Errorf("Received error cancelling agreements: %v", err)
+	} else if len(ags) != 2 || len(cancelled) != 2 || !cancelled["cpudev1"] || !cancelled["cpudev2"] {
+		t.Errorf("Expected agreements cpudev1 and cpudev2 to be cancelled, got %v", cancelled)
+	} else if ag, err := FindSingleAgreementByAgreementId(testDb, "cpudev1", "Basic", []AFilter{}); err != nil || ag.AgreementTimedout == 0 {
+		t.Errorf("Expected agreement cpudev1 to be marked terminated, got %v, error %v", ag, err)
+	}
+
+	// All versions of the workload, the agreements already being cancelled are not cancelled again.
+	cancelled = make(map[string]bool)
+	if ags, err := CancelWorkloadAgreements(testDb, cpu1.WorkloadURL, "", "", func(ag Agreement) { cancelled[ag.CurrentAgreementId] = true }); err != nil {
+		t.Errorf("Received error cancelling agreements: %v", err)
+	} else if len(ags) != 1 || !cancelled["cpudev3"] {
+		t.Errorf("Expected agreement cpudev3 to be cancelled, got %v", cancelled)
+	}
+
+	if ag, err := FindSingleAgreementByAgreementId(testDb, "gpsdev1", "Basic", []AFilter{}); err != nil || ag.AgreementTimedout != 0 {
+		t.Errorf("Expected agreement gpsdev1 not to be cancelled, got %v, error %v", ag, err)
+	} else if ag.WorkloadURL != gps.WorkloadURL || ag.WorkloadVersion != "1.0.0" || ag.WorkloadArch != "amd64" {
+		t.Errorf("Expected the workload to be recorded on the agreement, got %v", ag)
+	}
+}
+
+func Test_ExpiredProposalAFilter(t *testing.T) {
+
+	for _, agid := range []string{"expired1", "expired2", "expired3"} {
+		if err := AgreementAttempt(testDb, agid, "myorg", "myorg/"+agid, "mypolicy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+			t.Errorf("Received error creating agreement: %v", err)
+		}
+	}
+
+	// A proposal was made for expired2 and expired3 was already terminated, so only expired1 is still stuck.
+	if _, err := AgreementUpdate(testDb, "expired2", "proposal", "policy", policy.DataVerification{}, 0, "hash", "sig", "Basic", 2); err != nil {
+		t.Errorf("Received error updating agreement: %v", err)
+	} else if _, err := AgreementTimedout(testDb, "expired3", "Basic"); err != nil {
+		t.Errorf("Received error timing out agreement: %v", err)
+	}
+
+	now := uint64(time.Now().Unix())
+	if ags, err := FindAgreements(testDb, []AFilter{ExpiredProposalAFilter(now, 60), IdAFilter("expired1")}, "Basic"); err != nil {
+		t.Errorf("Received error finding agreements: %v", err)
+	} else if len(ags) != 0 {
+		t.Errorf("Agreement should not have expired yet: %v", ags)
+	}
+
+	expired := make(map[string]bool)
+	if ags, err := FindAgreements(testDb, []AFilter{ExpiredProposalAFilter(now+61, 60)}, "Basic"); err != nil {
+		t.Errorf("Received error finding agreements: %v", err)
+	} else {
+		for _, ag := range ags {
+			expired[ag.CurrentAgreementId] = true
+		}
+	}
+	if !expired["expired1"] || expired["expired2"] || expired["expired3"] {
+		t.Errorf("Expected only expired1 to be expired, got %v", expired)
+	}
+}
+
+func Test_PauseAgreement(t *testing.T) {
+
+	if err := AgreementAttempt(testDb, "paused1", "myorg", "myorg/pdev1", "mypolicy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+		t.Errorf("Received error creating agreement: %v", err)
+	} else if ag, err := PauseAgreement(testDb, "paused1", "Basic", true); err != nil {
+		t.Errorf("Received error pausing agreement: %v", err)
+	} else if !ag.Paused || ag.PausedTime == 0 {
+		t.Errorf("Agreement should be paused: %v", ag)
+	}
+
+	if ags, err := FindAgreements(testDb, []AFilter{PausedAFilter(), UnarchivedAFilter()}, "Basic"); err != nil {
+		t.Errorf("Received error finding agreements: %v", err)
+	} else if len(ags) != 1 || ags[0].CurrentAgreementId != "paused1" {
+		t.Errorf("Expected only agreement paused1, got %v", ags)
+	}
+
+	// An update made from a copy of the record read before the pause doesnt resume the agreement.
+	stale, err := FindSingleAgreementByAgreementId(testDb, "paused1", "Basic", []AFilter{})
+	if err != nil {
+		t.Fatalf("Received error finding agreement: %v", err)
+	}
+	stale.Paused, stale.PausedTime = false, 0
+	if err := persistUpdatedAgreement(testDb, "paused1", "Basic", stale); err != nil {
+		t.Errorf("Received error updating agreement: %v", err)
+	} else if ag, err := FindSingleAgreementByAgreementId(testDb, "paused1", "Basic", []AFilter{}); err != nil {
+		t.Errorf("Received error finding agreement: %v", err)
+	} else if !ag.Paused || ag.PausedTime == 0 {
+		t.Errorf("Agreement should still be paused after a stale update: %v", ag)
+	}
+
+	// Resuming clears the pause and restarts the no data timer.
+	if _, err := PauseAgreement(testDb, "paused1", "Basic", false); err != nil {
+		t.Errorf("Received error resuming agreement: %v", err)
+	} else if ag, err := FindSingleAgreementByAgreementId(testDb, "paused1", "Basic", []AFilter{}); err != nil {
+		t.Errorf("Received error finding agreement: %v", err)
+	} else if ag.Paused || ag.PausedTime != 0 || ag.DataVerifiedTime == 0 {
+		t.Errorf("Agreement should be resumed with its data verified time reset: %v", ag)
+	} else if ags, err := FindAgreements(testDb, []AFilter{PausedAFilter()}, "Basic"); err != nil {
+		t.Errorf("Received error finding agreements: %v", err)
+	} else if len(ags) != 0 {
+		t.Errorf("Expected no paused agreements, got %v", ags)
+	}
+}
+
+// An example of a filter defined outside persistence.go. It keeps the agreements with one of the devices and counts
+// the agreements it sees.
+type deviceSetFilter struct {
+	devices map[string]bool
+	seen    int
+}
+
+func (f *deviceSetFilter) Keep(a Agreement) bool {
+	f.seen += 1
+	return f.devices[a.DeviceId]
+}
+
+func Test_FindAgreements_custom_filter(t *testing.T) {
+
+	for _, agid := range []string{"custom1", "custom2", "custom3"} {
+		if err := AgreementAttempt(testDb, agid, "myorg", "myorg/"+agid, "mypolicy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+			t.Errorf("Received error creating agreement: %v", err)
+		}
+	}
+
+	f := &deviceSetFilter{devices: map[string]bool{"myorg/custom1": true, "myorg/custom3": true}}
+	if ags, err := FindAgreements(testDb, []AFilter{f.Keep, nil}, "Basic"); err != nil {
+		t.Errorf("Received error finding agreements: %v", err)
+	} else if len(ags) != 2 || f.seen == 0 {
+		t.Errorf("Expected agreements custom1 and custom3, got %v", ags)
+	}
+
+	// Filters run in order, an agreement dropped by the first filter is not seen by the next.
+	f.seen = 0
+	if ags, err := FindAgreements(testDb, []AFilter{IdAFilter("custom2"), f.Keep}, "Basic"); err != nil {
+		t.Errorf("Received error finding agreements: %v", err)
+	} else if len(ags) != 0 || f.seen != 1 {
+		t.Errorf("Expected only custom2 to reach the custom filter, saw %v, got %v", f.seen, ags)
+	}
+}
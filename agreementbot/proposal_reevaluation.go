@@ -0,0 +1,125 @@
+package agreementbot
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/policy"
+	"time"
+)
+
+// Check a proposal that is not finalized yet against the current version of its policy, and cancel it if the agbot would
+// not propose the same thing anymore. Removing the workload usage record lets the next search for devices make a new
+// proposal that starts from the highest priority workload. This is only done when ReevaluateProposals is configured.
+func (b *BaseAgreementWorker) ReevaluateProposalWithLock(cph ConsumerProtocolHandler, agreementId string, workerId string) {
+	// Get the agreement id lock to prevent any other thread from processing this same agreement.
+	lock := b.AgreementLockManager().getAgreementLock(agreementId)
+	lock.Lock()
+
+	b.reevaluateProposal(cph, agreementId, workerId)
+
+	lock.Unlock()
+}
+
+// Returns true if the proposal was cancelled. The caller must hold the agreement lock.
+func (b *BaseAgreementWorker) reevaluateProposal(cph ConsumerProtocolHandler, agreementId string, workerId string) bool {
+
+	ag, err := FindSingleAgreementByAgreementId(b.db, agreementId, cph.Name(), []AFilter{UnarchivedAFilter()})
+	if err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error querying agreement %v, error: %v", agreementId, err)))
+		return false
+	} else if ag == nil || ag.AgreementTimedout != 0 || ag.AgreementFinalizedTime != 0 {
+		// The proposal was accepted, rejected or cancelled since the policy changed, there is nothing left to re-evaluate.
+		glog.V(5).Infof(BAWlogstring(workerId, fmt.Sprintf("skipping re-evaluation of agreement %v, it is no longer a pending proposal", agreementId)))
+		return false
+	}
+
+	agreementPol, err := policy.DemarshalPolicy(ag.Policy)
+	if err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("unable to demarshal policy for agreement %v, error %v", agreementId, err)))
+		return false
+	}
+
+	var producerPol *policy.Policy
+	if ag.ProducerPolicy != "" {
+		if producerPol, err = policy.DemarshalPolicy(ag.ProducerPolicy); err != nil {
+			glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("unable to demarshal producer policy for agreement %v, error %v", agreementId, err)))
+			return false
+		}
+	}
+
+	wlUsage, err := FindSingleWorkloadUsageByDeviceAndPolicyName(b.db, ag.DeviceId, ag.PolicyName)
+	if err != nil {
+		glog.Errorf(BAWlogstring(workerId, fmt.Sprintf("error searching for persistent workload usage records for device %v with policy %v, error: %v", ag.DeviceId, ag.PolicyName, err)))
+		return false
+	}
+
+	change := ProposalChange(ag, b.pm.GetPolicy(ag.Org, ag.PolicyName), agreementPol, producerPol, wlUsage, &b.config.AgreementBot)
+	if change == "" {
+		glog.V(3).Infof(BAWlogstring(workerId, fmt.Sprintf("proposal %v is still valid under the changed policy %v", agreementId, ag.PolicyName)))
+		b.trace(agreementId, TRACE_REEVALUATED, fmt.Sprintf("still valid under the changed policy %v", ag.PolicyName))
+		return false
+	}
+
+	glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("cancelling proposal %v, %v", agreementId, change)))
+	b.trace(agreementId, TRACE_REEVALUATED, change)
+
+	if err := DeleteWorkloadUsage(b.db, ag.DeviceId, ag.PolicyName, WU_REASON_POLICY_CHANGED); err != nil {
+		glog.Warningf(BAWlogstring(workerId, fmt.Sprintf("error deleting workload usage for %v using policy %v, error: %v", ag.DeviceId, ag.PolicyName, err)))
+	}
+	b.CancelAgreement(cph, agreementId, cph.GetTerminationCode(TERM_REASON_POLICY_CHANGED), "", workerId)
+	return true
+}
+
+// Replay the workload choice and the compatibility check of a pending proposal against the current version of its
+// policy, pol, which is nil if the policy no longer exists. The agreementPol is the consumer policy that was proposed and
+// the producerPol is the merged producer policy of the agreement, nil if it was not recorded. Returns why the agbot would
+// not make the same proposal anymore, or the empty string if it would.
+//
+// The workload is chosen from the priority in the workload usage record, skipping the workloads that the configured
+// workload arches, orgs and denied versions exclude, like a new agreement with the device would. The requirements of a
+// different workload are not looked up in the exchange, choosing a different workload is reason enough to make a new
+// proposal.
+func ProposalChange(ag *Agreement, pol *policy.Policy, agreementPol *policy.Policy, producerPol *policy.Policy, wlUsage *WorkloadUsage, agConfig *config.AGConfig) string {
+
+	if pol == nil {
+		return fmt.Sprintf("policy %v no longer exists", ag.PolicyName)
+	} else if len(pol.Workloads) == 0 {
+		return fmt.Sprintf("policy %v no longer has a workload", ag.PolicyName)
+	}
+
+	var workload, lastWorkload *policy.Workload
+	if wlUsage == nil {
+		workload = pol.NextHighestPriorityWorkload(0, 0, 0)
+	} else {
+		workload = pol.NextHighestPriorityWorkload(wlUsage.Priority, 0, 0)
+	}
+
+	for {
+		if agConfig.WorkloadExclusion(workload.WorkloadURL, workloadOrg(workload, ag.Org), workload.Version, workload.Arch) == "" {
+			break
+		}
+
+		// Move on to the next priority, the same way a worker skips a workload it cannot use.
+		lastWorkload = workload
+		workload = pol.NextHighestPriorityWorkload(workload.Priority.PriorityValue, workload.Priority.Retries+1, uint64(time.Now().Unix()))
+		if workload == lastWorkload {
+			return fmt.Sprintf("no workload of policy %v is allowed by the configured workload arches, orgs and denied versions", ag.PolicyName)
+		}
+	}
+
+	if workload.WorkloadURL != ag.WorkloadURL || workload.Version != ag.WorkloadVersion || workload.Arch != ag.WorkloadArch {
+		return fmt.Sprintf("policy %v now chooses workload %v version %v arch %v instead of %v version %v arch %v", ag.PolicyName, workload.WorkloadURL, workload.Version, workload.Arch, ag.WorkloadURL, ag.WorkloadVersion, ag.WorkloadArch)
+	}
+
+	// The workload is the same, so are the API specs the proposal requires, which came from the workload's definition.
+	if producerPol != nil {
+		consumerPol := *pol
+		consumerPol.APISpecs = agreementPol.APISpecs
+		if err := policy.Are_Compatible(producerPol, &consumerPol); err != nil {
+			return fmt.Sprintf("the device is no longer compatible with policy %v: %v", ag.PolicyName, err)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,102 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/policy"
+	"strings"
+	"testing"
+)
+
+func reevaluationPolicy(workloads ...policy.Workload) *policy.Policy {
+	return &policy.Policy{Header: policy.PolicyHeader{Name: "netspeed", Version: policy.CurrentVersion}, Workloads: workloads}
+}
+
+func Test_ProposalChange_unchanged(t *testing.T) {
+
+	ag := &Agreement{Org: "myorg", PolicyName: "netspeed", WorkloadURL: "https://bluehorizon.network/workloads/netspeed", WorkloadVersion: "1.0.0", WorkloadArch: "amd64"}
+	pol := reevaluationPolicy(
+		policy.Workload{WorkloadURL: "https://bluehorizon.network/workloads/netspeed", Version: "2.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 1}},
+		policy.Workload{WorkloadURL: "https://bluehorizon.network/workloads/netspeed", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 2}},
+	)
+	producer := &policy.Policy{Header: pol.Header}
+
+	// The proposal was made at priority 2, e.g. after priority 1 was rolled back, and stays there.
+	wlUsage := &WorkloadUsage{Priority: 2}
+	if change := ProposalChange(ag, pol, pol, producer, wlUsage, &config.AGConfig{}); change != "" {
+		t.Errorf("expected the proposal to be unchanged, got %v", change)
+	}
+
+	// Without a recorded producer policy, only the workload choice is checked.
+	if change := ProposalChange(ag, pol, pol, nil, wlUsage, &config.AGConfig{}); change != "" {
+		t.Errorf("expected the proposal to be unchanged, got %v", change)
+	}
+}
+
+func Test_ProposalChange_workload(t *testing.T) {
+
+	ag := &Agreement{Org: "myorg", PolicyName: "netspeed", WorkloadURL: "https://bluehorizon.network/workloads/netspeed", WorkloadVersion: "1.0.0", WorkloadArch: "amd64"}
+	pol := reevaluationPolicy(
+		policy.Workload{WorkloadURL: "https://bluehorizon.network/workloads/netspeed", Version: "2.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 1}},
+		policy.Workload{WorkloadURL: "https://bluehorizon.network/workloads/netspeed", Version: "1.0.0", Arch: "arm", Priority: policy.WorkloadPriority{PriorityValue: 2}},
+	)
+
+	// Without a workload usage record, the highest priority workload is chosen, which is a different version.
+	if change := ProposalChange(ag, pol, pol, nil, nil, &config.AGConfig{}); !strings.Contains(change, "version 2.0.0") {
+		t.Errorf("expected a different workload version to be chosen, got %v", change)
+	}
+
+	// The arch of the workload at the proposed priority changed.
+	if change := ProposalChange(ag, pol, pol, nil, &WorkloadUsage{Priority: 2}, &config.AGConfig{}); !strings.Contains(change, "arch arm") {
+		t.Errorf("expected a different workload arch to be chosen, got %v", change)
+	}
+
+	// The configured workload arches exclude every workload.
+	if change := ProposalChange(ag, pol, pol, nil, nil, &config.AGConfig{WorkloadArches: "arm64"}); !strings.Contains(change, "no workload") {
+		t.Errorf("expected no workload to be allowed, got %v", change)
+	}
+
+	// The policy was deleted.
+	if change := ProposalChange(ag, nil, pol, nil, nil, &config.AGConfig{}); !strings.Contains(change, "no longer exists") {
+		t.Errorf("expected the policy to be missing, got %v", change)
+	}
+}
+
+func Test_ProposalChange_denied_version(t *testing.T) {
+
+	ag := &Agreement{Org: "myorg", PolicyName: "netspeed", WorkloadURL: "https://bluehorizon.network/workloads/netspeed", WorkloadVersion: "1.0.0", WorkloadArch: "amd64"}
+	pol := reevaluationPolicy(
+		policy.Workload{WorkloadURL: "https://bluehorizon.network/workloads/netspeed", Version: "2.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 1}},
+		policy.Workload{WorkloadURL: "https://bluehorizon.network/workloads/netspeed", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 2}},
+	)
+
+	// The denied highest priority version is skipped like an unsupportable workload, so the proposed version is chosen.
+	denied := &config.AGConfig{DeniedWorkloadVersions: "https://bluehorizon.network/workloads/netspeed@2.0.0"}
+	if change := ProposalChange(ag, pol, pol, nil, nil, denied); change != "" {
+		t.Errorf("expected the proposal to be unchanged, got %v", change)
+	}
+
+	// Denying the proposed version too leaves no workload.
+	denied.DeniedWorkloadVersions += ",https://bluehorizon.network/workloads/netspeed@1.0.0@amd64"
+	if change := ProposalChange(ag, pol, pol, nil, nil, denied); !strings.Contains(change, "no workload") {
+		t.Errorf("expected no workload to be allowed, got %v", change)
+	}
+}
+
+func Test_ProposalChange_compatibility(t *testing.T) {
+
+	ag := &Agreement{Org: "myorg", PolicyName: "netspeed", WorkloadURL: "https://bluehorizon.network/workloads/netspeed", WorkloadVersion: "1.0.0", WorkloadArch: "amd64"}
+	pol := reevaluationPolicy(policy.Workload{WorkloadURL: "https://bluehorizon.network/workloads/netspeed", Version: "1.0.0", Arch: "amd64"})
+	producer := &policy.Policy{Header: pol.Header, ResourceLimits: policy.ResourceLimit{Memory: 512}}
+
+	if change := ProposalChange(ag, pol, pol, producer, nil, &config.AGConfig{}); change != "" {
+		t.Errorf("expected the proposal to be unchanged, got %v", change)
+	}
+
+	// The changed policy requires more memory than the device offers.
+	pol.ResourceLimits.Memory = 1024
+	if change := ProposalChange(ag, pol, pol, producer, nil, &config.AGConfig{}); !strings.Contains(change, "no longer compatible") {
+		t.Errorf("expected the device to be incompatible, got %v", change)
+	}
+}
@@ -0,0 +1,205 @@
+package agreementbot
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/exchange"
+	"github.com/open-horizon/anax/policy"
+	"github.com/open-horizon/anax/worker"
+)
+
+// The kinds of discrepancy between the agbot's agreements and the exchange's agreement records found by ReconcileAgreements.
+const RECONCILE_EXCHANGE_ORPHAN = "exchange record has no active agreement"            // repaired by deleting the exchange record
+const RECONCILE_EXCHANGE_MISSING = "active agreement has no exchange record"           // repaired by recording the agreement's state in the exchange again
+const RECONCILE_LOCAL_ORPHAN = "active agreement has no exchange record and no policy" // repaired by cancelling the agreement, it cannot be recorded again
+
+// A discrepancy between an agreement in the database and the agbot's agreement records in the exchange.
+type AgreementDiscrepancy struct {
+	Kind        string `json:"kind"`         // one of the RECONCILE_ constants
+	AgreementId string `json:"agreement_id"` // the agreement id involved in the discrepancy
+	Protocol    string `json:"protocol"`     // the agreement protocol of the local agreement, empty if there is none
+	Repaired    bool   `json:"repaired"`     // the discrepancy was repaired
+}
+
+func (d AgreementDiscrepancy) String() string {
+	return fmt.Sprintf("Kind: %v, AgreementId: %v, Protocol: %v, Repaired: %v", d.Kind, d.AgreementId, d.Protocol, d.Repaired)
+}
+
+// Returns true if the agreement should have a record in the exchange. The record is written when the proposal is made and
+// deleted when the agreement is cancelled.
+func expectsExchangeRecord(ag *Agreement) bool {
+	return !ag.Archived && ag.AgreementCreationTime != 0 && ag.AgreementTimedout == 0
+}
+
+// Compare the unarchived agreements in the database, keyed by agreement id, with the agbot's agreement records in the
+// exchange. The policyExists function reports whether the policy of an agreement is still known to the agbot.
+func AgreementDiscrepancies(local map[string]Agreement, exchangeAgs map[string]exchange.AgbotAgreement, policyExists func(org string, name string) bool) []AgreementDiscrepancy {
+
+	discrepancies := make([]AgreementDiscrepancy, 0, 5)
+
+	for id, _ := range exchangeAgs {
+		if ag, ok := local[id]; !ok || !expectsExchangeRecord(&ag) {
+			discrepancies = append(discrepancies, AgreementDiscrepancy{Kind: RECONCILE_EXCHANGE_ORPHAN, AgreementId: id, Protocol: ag.AgreementProtocol})
+		}
+	}
+
+	for id, ag := range local {
+		if _, ok := exchangeAgs[id]; ok || !expectsExchangeRecord(&ag) {
+			continue
+		} else if policyExists(ag.Org, ag.PolicyName) {
+			discrepancies = append(discrepancies, AgreementDiscrepancy{Kind: RECONCILE_EXCHANGE_MISSING, AgreementId: id, Protocol: ag.AgreementProtocol})
+		} else {
+			discrepancies = append(discrepancies, AgreementDiscrepancy{Kind: RECONCILE_LOCAL_ORPHAN, AgreementId: id, Protocol: ag.AgreementProtocol})
+		}
+	}
+
+	return discrepancies
+}
+
+// The state to record in the exchange for the agreement.
+func exchangeAgreementState(ag *Agreement) string {
+	if ag.AgreementFinalizedTime != 0 {
+		return "Finalized Agreement"
+	} else if ag.CounterPartyAddress != "" {
+		return "Producer Agreed"
+	} else if ag.AgreementCreationTime != 0 {
+		return "Formed Proposal"
+	} else {
+		return "unknown"
+	}
+}
+
+// Compare the agbot's unarchived agreements with the agbot's agreement records in the exchange, which can diverge when a
+// write to the exchange fails, e.g. during an outage, and repair the discrepancies. Exchange records without an active
+// agreement are deleted, active agreements without an exchange record are recorded in the exchange again, or cancelled if
+// their policy no longer exists. Every repair is logged. Returns the discrepancies that were found.
+func (w *AgreementBotWorker) ReconcileAgreements() ([]AgreementDiscrepancy, error) {
+
+	w.reconcileLock.Lock()
+	defer w.reconcileLock.Unlock()
+
+	// Read the exchange before the database. The database record of an agreement is written before its exchange record, so
+	// an agreement being made while reconciling is never mistaken for an exchange orphan.
+	var resp interface{}
+	resp = new(exchange.AllAgbotAgreementsResponse)
+	targetURL := w.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(w.agbotId)) + "orgs/" + exchange.GetOrg(w.agbotId) + "/agbots/" + exchange.GetId(w.agbotId) + "/agreements"
+	if err, tpErr := exchange.InvokeExchange(w.httpClient, "GET", targetURL, w.agbotId, w.token, nil, &resp); err != nil || tpErr != nil {
+		return nil, errors.New(fmt.Sprintf("unable to get agreements from the exchange, error %v, transport error %v", err, tpErr))
+	}
+	exchangeAgs := resp.(*exchange.AllAgbotAgreementsResponse).Agreements
+
+	local := make(map[string]Agreement)
+	for _, agp := range policy.AllAgreementProtocols() {
+		if ags, err := FindAgreements(w.db, []AFilter{UnarchivedAFilter()}, agp); err != nil {
+			return nil, errors.New(fmt.Sprintf("unable to read %v agreements, error: %v", agp, err))
+		} else {
+			for _, ag := range ags {
+				local[ag.CurrentAgreementId] = ag
+			}
+		}
+	}
+
+	policyExists := func(org string, name string) bool { return w.pm.GetPolicy(org, name) != nil }
+	discrepancies := AgreementDiscrepancies(local, exchangeAgs, policyExists)
+
+	for i, d := range discrepancies {
+		glog.Warningf(AWlogString(fmt.Sprintf("reconciliation found %v", d)))
+		discrepancies[i].Repaired = w.repairDiscrepancy(d, policyExists)
+	}
+
+	glog.V(3).Infof(AWlogString(fmt.Sprintf("reconciliation with the exchange compared %v agreements and %v exchange records, found %v discrepancies", len(local), len(exchangeAgs), len(discrepancies))))
+	return discrepancies, nil
+}
+
+// Repair a discrepancy found by ReconcileAgreements. Returns true if it was repaired.
+func (w *AgreementBotWorker) repairDiscrepancy(d AgreementDiscrepancy, policyExists func(org string, name string) bool) bool {
+
+	cph, ok := w.consumerPH[d.Protocol]
+	if d.Kind == RECONCILE_EXCHANGE_ORPHAN {
+		if err := DeleteConsumerAgreement(w.httpClient, w.Config.AgreementBot.GetExchangeURL(exchange.GetOrg(w.agbotId)), w.agbotId, w.token, d.AgreementId); err != nil {
+			glog.Errorf(AWlogString(fmt.Sprintf("reconciliation unable to delete agreement %v from the exchange, error: %v", d.AgreementId, err)))
+			return false
+		}
+		glog.Infof(AWlogString(fmt.Sprintf("reconciliation deleted agreement %v from the exchange, it is not active in the agbot", d.AgreementId)))
+		return true
+	} else if !ok {
+		glog.Errorf(AWlogString(fmt.Sprintf("reconciliation unable to repair agreement %v, unknown agreement protocol %v", d.AgreementId, d.Protocol)))
+		return false
+	}
+
+	// Hold the agreement lock so that the agreement does not change while it is repaired, and check that the
+	// discrepancy is still there.
+	lock := cph.AgreementLockManager().getAgreementLock(d.AgreementId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	ag, err := FindSingleAgreementByAgreementId(w.db, d.AgreementId, d.Protocol, []AFilter{UnarchivedAFilter()})
+	if err != nil {
+		glog.Errorf(AWlogString(fmt.Sprintf("reconciliation unable to read agreement %v, error: %v", d.AgreementId, err)))
+		return false
+	} else if ag == nil || !expectsExchangeRecord(ag) {
+		glog.V(3).Infof(AWlogString(fmt.Sprintf("reconciliation skipping agreement %v, it is no longer active", d.AgreementId)))
+		return false
+	}
+
+	if d.Kind == RECONCILE_EXCHANGE_MISSING && policyExists(ag.Org, ag.PolicyName) {
+		state := exchangeAgreementState(ag)
+		if pol, err := policy.DemarshalPolicy(ag.Policy); err != nil {
+			glog.Errorf(AWlogString(fmt.Sprintf("reconciliation unable to demarshal policy for agreement %v, error %v", d.AgreementId, err)))
+			return false
+		} else if err := w.recordConsumerAgreementState(d.AgreementId, pol, ag.Org, state); err != nil {
+			glog.Errorf(AWlogString(fmt.Sprintf("reconciliation unable to record agreement %v in the exchange, error: %v", d.AgreementId, err)))
+			return false
+		}
+		glog.Infof(AWlogString(fmt.Sprintf("reconciliation recorded agreement %v in the exchange again with state %v", d.AgreementId, state)))
+		return true
+	}
+
+	// Without its policy the agreement cannot be recorded again, cancel it. The cancel is done by the protocol's workers,
+	// which also try to delete the exchange record.
+	if _, err := AgreementTimedout(w.db, d.AgreementId, d.Protocol); err != nil {
+		glog.Errorf(AWlogString(fmt.Sprintf("reconciliation unable to mark agreement %v terminated, error: %v", d.AgreementId, err)))
+		return false
+	}
+	cph.HandleAgreementTimeout(NewAgreementTimeoutCommand(d.AgreementId, d.Protocol, cph.GetTerminationCode(TERM_REASON_POLICY_CHANGED), ""), cph)
+	glog.Infof(AWlogString(fmt.Sprintf("reconciliation cancelled agreement %v, it has no exchange record and its policy %v no longer exists", d.AgreementId, ag.PolicyName)))
+	return true
+}
+
+// Reconcile the agreements with the exchange periodically, see ReconcileAgreements.
+func (w *AgreementBotWorker) GovernReconciliation() int {
+	if _, err := w.ReconcileAgreements(); err != nil {
+		glog.Errorf(AWlogString(fmt.Sprintf("unable to reconcile agreements with the exchange, error: %v", err)))
+	}
+	return 0
+}
+
+// Request an on demand reconciliation, see reconcileOnRequest. A request made while another one is pending is covered by
+// the pending one, which has not read the exchange yet.
+func (w *AgreementBotWorker) requestReconciliation() {
+	select {
+	case w.reconcileRequests <- true:
+		glog.V(3).Infof(AWlogString("queued reconciliation of agreements with the exchange"))
+	default:
+		glog.V(3).Infof(AWlogString("reconciliation of agreements with the exchange is already queued"))
+	}
+}
+
+// Run the on demand reconciliations, see ReconcileAgreements. They call the exchange and repair agreements, so they are
+// run here rather than by the command handler.
+func (w *AgreementBotWorker) reconcileOnRequest(name string, quit chan bool) {
+	for {
+		select {
+		case <-quit:
+			w.Commands <- worker.NewSubWorkerTerminationCommand(name)
+			glog.V(3).Infof(AWlogString(fmt.Sprintf("%v exiting the subworker", name)))
+			return
+
+		case <-w.reconcileRequests:
+			if _, err := w.ReconcileAgreements(); err != nil {
+				glog.Errorf(AWlogString(fmt.Sprintf("unable to reconcile agreements with the exchange, error: %v", err)))
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// +build integration
+
+package agreementbot
+
+import (
+	"encoding/json"
+	"github.com/open-horizon/anax/events"
+	"github.com/open-horizon/anax/exchange"
+	"github.com/open-horizon/anax/policy"
+	"github.com/open-horizon/anax/worker"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// An exchange that records the agreement calls of the agbot, and rejects them while fail is set.
+type reconcileExchange struct {
+	lock  sync.Mutex
+	calls []string
+	puts  map[string]exchange.PutAgbotAgreementState
+	fail  bool
+}
+
+func (e *reconcileExchange) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.calls = append(e.calls, r.Method+" "+r.URL.Path)
+	if e.fail {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		var as exchange.PutAgbotAgreementState
+		json.NewDecoder(r.Body).Decode(&as)
+		e.puts[r.URL.Path] = as
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		w.WriteHeader(http.StatusNoContent)
+	}
+	w.Write([]byte(`{"code":"ok","msg":""}`))
+}
+
+// Returns the calls made since the last reset, and fails the calls from now on if fail is true.
+func (e *reconcileExchange) reset(fail bool) []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	calls := e.calls
+	e.calls = nil
+	e.fail = fail
+	return calls
+}
+
+func Test_repairDiscrepancy(t *testing.T) {
+
+	ex := &reconcileExchange{puts: make(map[string]exchange.PutAgbotAgreementState)}
+	server := httptest.NewServer(ex)
+	defer server.Close()
+
+	cfg := testInitiateConfig(server.URL)
+	cph := NewBasicProtocolHandler("Basic", cfg, testDb, nil, make(chan events.Message, 10))
+	cph.Work = make(chan AgreementWork, 10)
+
+	w := &AgreementBotWorker{
+		BaseWorker: worker.BaseWorker{Manager: worker.Manager{Config: cfg}},
+		db:         testDb,
+		httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+		agbotId:    "myorg/agbot",
+		token:      "token",
+		consumerPH: map[string]ConsumerProtocolHandler{"Basic": cph},
+	}
+	policyExists := func(org string, name string) bool { return name == "reconcile policy" }
+
+	pol, _ := policy.MarshalPolicy(&policy.Policy{Header: policy.PolicyHeader{Name: "reconcile policy"}, Workloads: []policy.Workload{policy.Workload{WorkloadURL: "cpu"}}})
+	for agid, polName := range map[string]string{"rec-missing": "reconcile policy", "rec-badpolicy": "reconcile policy", "rec-timedout": "reconcile policy", "rec-nopolicy": "gone"} {
+		if err := AgreementAttempt(testDb, agid, "myorg", "myorg/an-reconcile", polName, "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+			t.Fatalf("Received error creating agreement %v: %v", agid, err)
+		}
+		agPol := pol
+		if agid == "rec-badpolicy" {
+			agPol = "not a policy"
+		}
+		if _, err := AgreementUpdate(testDb, agid, "", agPol, policy.DataVerification{}, 0, "", "", "Basic", 1); err != nil {
+			t.Fatalf("Received error updating agreement %v: %v", agid, err)
+		}
+	}
+	if _, err := AgreementTimedout(testDb, "rec-timedout", "Basic"); err != nil {
+		t.Fatalf("Received error timing out agreement: %v", err)
+	}
+
+	// An exchange record without an active agreement is deleted, unless the exchange rejects the delete.
+	d := AgreementDiscrepancy{Kind: RECONCILE_EXCHANGE_ORPHAN, AgreementId: "rec-orphan"}
+	if !w.repairDiscrepancy(d, policyExists) {
+		t.Errorf("expected the exchange orphan to be repaired")
+	} else if calls := ex.reset(true); len(calls) != 1 || calls[0] != "DELETE /orgs/myorg/agbots/agbot/agreements/rec-orphan" {
+		t.Errorf("expected the exchange record to be deleted, got %v", calls)
+	}
+	if w.repairDiscrepancy(d, policyExists) {
+		t.Errorf("expected the exchange orphan not to be repaired when the exchange rejects the delete")
+	}
+	ex.reset(false)
+
+	// An agreement of an unknown protocol, or that is no longer active, is not repaired.
+	if w.repairDiscrepancy(AgreementDiscrepancy{Kind: RECONCILE_EXCHANGE_MISSING, AgreementId: "rec-missing", Protocol: "Unknown"}, policyExists) {
+		t.Errorf("expected the agreement of an unknown protocol not to be repaired")
+	} else if w.repairDiscrepancy(AgreementDiscrepancy{Kind: RECONCILE_EXCHANGE_MISSING, AgreementId: "rec-timedout", Protocol: "Basic"}, policyExists) {
+		t.Errorf("expected the terminated agreement not to be repaired")
+	} else if w.repairDiscrepancy(AgreementDiscrepancy{Kind: RECONCILE_EXCHANGE_MISSING, AgreementId: "rec-unknown", Protocol: "Basic"}, policyExists) {
+		t.Errorf("expected the agreement that does not exist not to be repaired")
+	} else if calls := ex.reset(false); len(calls) != 0 {
+		t.Errorf("expected no exchange calls, got %v", calls)
+	}
+
+	// An active agreement without an exchange record is recorded again, unless its policy cannot be read or the exchange
+	// rejects the record.
+	d = AgreementDiscrepancy{Kind: RECONCILE_EXCHANGE_MISSING, AgreementId: "rec-missing", Protocol: "Basic"}
+	if !w.repairDiscrepancy(d, policyExists) {
+		t.Errorf("expected the missing exchange record to be repaired")
+	} else if as, ok := ex.puts["/orgs/myorg/agbots/agbot/agreements/rec-missing"]; !ok || as.State != "Formed Proposal" || as.Workload.URL != "cpu" {
+		t.Errorf("expected the agreement to be recorded in the exchange with state Formed Proposal, got %v", ex.puts)
+	}
+	ex.reset(true)
+	if w.repairDiscrepancy(d, policyExists) {
+		t.Errorf("expected the missing exchange record not to be repaired when the exchange rejects it")
+	}
+	ex.reset(false)
+	if w.repairDiscrepancy(AgreementDiscrepancy{Kind: RECONCILE_EXCHANGE_MISSING, AgreementId: "rec-badpolicy", Protocol: "Basic"}, policyExists) {
+		t.Errorf("expected the agreement with an unreadable policy not to be repaired")
+	} else if calls := ex.reset(false); len(calls) != 0 {
+		t.Errorf("expected no exchange calls, got %v", calls)
+	}
+
+	// An active agreement without an exchange record and policy is cancelled by the agreement workers.
+	if !w.repairDiscrepancy(AgreementDiscrepancy{Kind: RECONCILE_LOCAL_ORPHAN, AgreementId: "rec-nopolicy", Protocol: "Basic"}, policyExists) {
+		t.Errorf("expected the local orphan to be repaired")
+	} else if ag, err := FindSingleAgreementByAgreementId(testDb, "rec-nopolicy", "Basic", []AFilter{}); err != nil || ag == nil || ag.AgreementTimedout == 0 {
+		t.Errorf("expected the agreement to be marked terminated, got %v, error: %v", ag, err)
+	} else if len(cph.Work) != 1 {
+		t.Errorf("expected the cancellation to be queued, got %v work items", len(cph.Work))
+	} else if work, ok := (<-cph.Work).(CancelAgreement); !ok || work.AgreementId != "rec-nopolicy" || work.Reason != cph.GetTerminationCode(TERM_REASON_POLICY_CHANGED) {
+		t.Errorf("expected agreement rec-nopolicy to be cancelled for a policy change, got %v", work)
+	}
+
+	// The agreement is not cancelled twice.
+	if w.repairDiscrepancy(AgreementDiscrepancy{Kind: RECONCILE_LOCAL_ORPHAN, AgreementId: "rec-nopolicy", Protocol: "Basic"}, policyExists) {
+		t.Errorf("expected the terminated local orphan not to be repaired again")
+	} else if len(cph.Work) != 0 {
+		t.Errorf("expected no cancellation to be queued, got %v work items", len(cph.Work))
+	}
+
+}
@@ -0,0 +1,83 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"github.com/open-horizon/anax/events"
+	"github.com/open-horizon/anax/exchange"
+	"testing"
+)
+
+func Test_AgreementDiscrepancies(t *testing.T) {
+
+	local := map[string]Agreement{
+		"active":    Agreement{CurrentAgreementId: "active", Org: "myorg", PolicyName: "netspeed", AgreementProtocol: "Basic", AgreementCreationTime: 10},
+		"unwritten": Agreement{CurrentAgreementId: "unwritten", Org: "myorg", PolicyName: "netspeed", AgreementProtocol: "Basic", AgreementCreationTime: 10},
+		"nopolicy":  Agreement{CurrentAgreementId: "nopolicy", Org: "myorg", PolicyName: "gone", AgreementProtocol: "Basic", AgreementCreationTime: 10},
+		"timedout":  Agreement{CurrentAgreementId: "timedout", Org: "myorg", PolicyName: "netspeed", AgreementProtocol: "Basic", AgreementCreationTime: 10, AgreementTimedout: 20},
+		"starting":  Agreement{CurrentAgreementId: "starting", Org: "myorg", PolicyName: "netspeed", AgreementProtocol: "Basic", AgreementInceptionTime: 10},
+	}
+	exchangeAgs := map[string]exchange.AgbotAgreement{
+		"active":   exchange.AgbotAgreement{State: "Finalized Agreement"},
+		"timedout": exchange.AgbotAgreement{State: "Finalized Agreement"},
+		"unknown":  exchange.AgbotAgreement{State: "Formed Proposal"},
+	}
+	policyExists := func(org string, name string) bool { return name == "netspeed" }
+
+	expected := map[string]string{
+		"unwritten": RECONCILE_EXCHANGE_MISSING,
+		"nopolicy":  RECONCILE_LOCAL_ORPHAN,
+		"timedout":  RECONCILE_EXCHANGE_ORPHAN,
+		"unknown":   RECONCILE_EXCHANGE_ORPHAN,
+	}
+
+	discrepancies := AgreementDiscrepancies(local, exchangeAgs, policyExists)
+	if len(discrepancies) != len(expected) {
+		t.Errorf("expected %v discrepancies, got %v", len(expected), discrepancies)
+	}
+	for _, d := range discrepancies {
+		if kind, ok := expected[d.AgreementId]; !ok || d.Kind != kind {
+			t.Errorf("expected discrepancy %v for agreement %v, got %v", kind, d.AgreementId, d)
+		} else if d.AgreementId != "unknown" && d.Protocol != "Basic" {
+			t.Errorf("expected the protocol of the local agreement, got %v", d)
+		}
+	}
+
+	// Nothing to reconcile when the records agree.
+	delete(local, "unwritten")
+	delete(local, "nopolicy")
+	delete(exchangeAgs, "timedout")
+	delete(exchangeAgs, "unknown")
+	if discrepancies := AgreementDiscrepancies(local, exchangeAgs, policyExists); len(discrepancies) != 0 {
+		t.Errorf("expected no discrepancies, got %v", discrepancies)
+	}
+}
+
+func Test_exchangeAgreementState(t *testing.T) {
+
+	for state, ag := range map[string]Agreement{
+		"Finalized Agreement": Agreement{AgreementCreationTime: 10, CounterPartyAddress: "0x1", AgreementFinalizedTime: 20},
+		"Producer Agreed":     Agreement{AgreementCreationTime: 10, CounterPartyAddress: "0x1"},
+		"Formed Proposal":     Agreement{AgreementCreationTime: 10},
+		"unknown":             Agreement{},
+	} {
+		if s := exchangeAgreementState(&ag); s != state {
+			t.Errorf("expected state %v for agreement %v, got %v", state, ag, s)
+		}
+	}
+}
+
+// A reconciliation requested through the API is queued for the reconciliation subworker, so that the command handler
+// does not wait for the exchange. A request made while one is queued is covered by it.
+func Test_ReconcileAgreementsCommand(t *testing.T) {
+
+	w := &AgreementBotWorker{reconcileRequests: make(chan bool, 1)}
+	for i := 0; i < 2; i++ {
+		if !w.CommandHandler(NewReconcileAgreementsCommand(*events.NewABApiReconcileAgreementsMessage(events.RECONCILE_AGREEMENTS))) {
+			t.Errorf("expected the reconcile command to be handled")
+		}
+	}
+	if len(w.reconcileRequests) != 1 {
+		t.Errorf("expected one reconciliation to be queued, got %v", len(w.reconcileRequests))
+	}
+}
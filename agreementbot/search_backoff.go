@@ -0,0 +1,61 @@
+package agreementbot
+
+import (
+	"fmt"
+)
+
+// SearchBackoff decides in which cycles of the agbot worker, which run every NewContractIntervalS, the exchange is searched
+// for devices to make agreements with. Each search that finds no device to make a new agreement with doubles the number of
+// cycles until the next search, up to the number of cycles in NewContractMaxIntervalS, so that an idle agbot does not
+// keep searching the exchange at full speed. A search that does find one resets it to every cycle. The backoff is counted
+// in cycles rather than seconds so that the jitter of the cycles doesn't shift the searches. It is only used by the agbot
+// worker thread.
+type SearchBackoff struct {
+	maxCycles int // the most cycles between two searches
+	cycles    int // the current number of cycles between two searches
+	skipped   int // the cycles skipped since the last search
+}
+
+func NewSearchBackoff(intervalS uint64, maxIntervalS uint64) *SearchBackoff {
+	maxCycles := 1
+	if intervalS != 0 && maxIntervalS > intervalS {
+		maxCycles = int(maxIntervalS / intervalS)
+	}
+	return &SearchBackoff{maxCycles: maxCycles, cycles: 1}
+}
+
+func (b *SearchBackoff) String() string {
+	return fmt.Sprintf("MaxCycles: %v, Cycles: %v, Skipped: %v", b.maxCycles, b.cycles, b.skipped)
+}
+
+// Returns true if the exchange should be searched in this cycle. Otherwise the cycle is counted as skipped.
+func (b *SearchBackoff) SearchDue() bool {
+	if b.skipped+1 >= b.cycles {
+		return true
+	}
+	b.skipped += 1
+	return false
+}
+
+// Search again in the next cycle, e.g. because a policy changed or an agreement ended, so that a device that can make an
+// agreement now is found without waiting for the backed off search.
+func (b *SearchBackoff) Reset() {
+	b.cycles = 1
+}
+
+// Record the number of agreement attempts the search of this cycle started. Returns true if the searches are backed off
+// further.
+func (b *SearchBackoff) Searched(attempts int) bool {
+	b.skipped = 0
+	if attempts != 0 {
+		b.cycles = 1
+		return false
+	} else if b.cycles >= b.maxCycles {
+		return false
+	}
+	b.cycles *= 2
+	if b.cycles > b.maxCycles {
+		b.cycles = b.maxCycles
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"testing"
+)
+
+// Returns the cycles, out of the input number of cycles, in which a search is due, recording the input attempts for each
+// search.
+func searchCycles(b *SearchBackoff, cycles int, attempts int) []int {
+	searched := []int{}
+	for c := 1; c <= cycles; c++ {
+		if b.SearchDue() {
+			searched = append(searched, c)
+			b.Searched(attempts)
+		}
+	}
+	return searched
+}
+
+func Test_SearchBackoff(t *testing.T) {
+
+	// Searches that find nothing back off to every 2, 4 and then at most 5 cycles.
+	b := NewSearchBackoff(10, 50)
+	if searched := searchCycles(b, 20, 0); len(searched) != 5 || searched[1] != 3 || searched[2] != 7 || searched[3] != 12 || searched[4] != 17 {
+		t.Errorf("expected searches in cycles 1, 3, 7, 12 and 17, got %v", searched)
+	}
+
+	// A search that starts an agreement attempt resets the backoff.
+	for !b.SearchDue() {
+	}
+	if b.Searched(1) {
+		t.Errorf("expected a search with an attempt not to back off")
+	} else if searched := searchCycles(b, 3, 1); len(searched) != 3 {
+		t.Errorf("expected a search in every cycle after an attempt, got %v", searched)
+	}
+
+	// Resetting searches in the next cycle.
+	searchCycles(b, 10, 0)
+	b.Reset()
+	if !b.SearchDue() {
+		t.Errorf("expected a search to be due after a reset")
+	}
+
+	// A cap equal to the interval, or no cap, keeps searching in every cycle.
+	for _, maxIntervalS := range []uint64{0, 10} {
+		if searched := searchCycles(NewSearchBackoff(10, maxIntervalS), 5, 0); len(searched) != 5 {
+			t.Errorf("expected a search in every cycle with cap %v, got %v", maxIntervalS, searched)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package agreementbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+	"time"
+)
+
+const WORKLOAD_SELECTION = "workload_selection"
+
+// The outcomes of choosing a workload for a new agreement with a device.
+const SELECTION_CHOSEN = "workload chosen"                                    // a workload was chosen and an agreement proposed
+const SELECTION_NO_WORKLOAD = "no supported workload"                         // every workload of the policy was rejected
+const SELECTION_MAX_PRIORITIES = "maximum workload priorities tried"          // MaxWorkloadPrioritiesTried workloads were rejected
+const SELECTION_MISSING_MICROSERVICE = "required microservice not registered" // MissingMicroserviceAction is fail and a required microservice is missing
+const SELECTION_IGNORED = "device advertises an ignored property"             // the device advertises one of the IgnoreContractWithAttribs properties
+
+// A workload selection record remembers the outcome of the most recent attempt to choose a workload for an agreement
+// with a device and policy, and the workloads rejected along the way, so that the outcome can be diagnosed later.
+type WorkloadSelection struct {
+	DeviceId   string              `json:"device_id"`   // the device id the workload was chosen for
+	PolicyName string              `json:"policy_name"` // the name of the policy the workload was chosen from
+	Outcome    string              `json:"outcome"`     // one of the SELECTION_ constants
+	Rejections []WorkloadRejection `json:"rejections"`  // the workloads that were rejected before the outcome was reached
+	Time       uint64              `json:"time"`        // time when the outcome was reached
+}
+
+func (s WorkloadSelection) String() string {
+	return fmt.Sprintf("DeviceId: %v, "+
+		"PolicyName: %v, "+
+		"Outcome: %v, "+
+		"Rejections: %v, "+
+		"Time: %v",
+		s.DeviceId, s.PolicyName, s.Outcome, s.Rejections, s.Time)
+}
+
+// Create or replace the workload selection record for a device and policy.
+func RecordWorkloadSelection(db *bolt.DB, deviceId string, policyName string, outcome string, rejections []WorkloadRejection) error {
+	if deviceId == "" || policyName == "" || outcome == "" {
+		return errors.New("Illegal input: one of deviceId, policyName or outcome is empty")
+	}
+
+	ws := &WorkloadSelection{
+		DeviceId:   deviceId,
+		PolicyName: policyName,
+		Outcome:    outcome,
+		Rejections: rejections,
+		Time:       uint64(time.Now().Unix()),
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if b, err := tx.CreateBucketIfNotExists([]byte(WORKLOAD_SELECTION)); err != nil {
+			return err
+		} else if bytes, err := json.Marshal(ws); err != nil {
+			return fmt.Errorf("Unable to serialize workload selection record %v. Error: %v", ws, err)
+		} else if err := b.Put([]byte(selectionKey(deviceId, policyName)), bytes); err != nil {
+			return fmt.Errorf("Unable to write workload selection record %v to bucket %v", ws, WORKLOAD_SELECTION)
+		} else {
+			glog.V(5).Infof("Succeeded writing workload selection record %v", ws)
+			return nil
+		}
+	})
+}
+
+// Returns the workload selection record for the device and policy, or nil if no workload has been chosen for them.
+func FindWorkloadSelection(db *bolt.DB, deviceId string, policyName string) (*WorkloadSelection, error) {
+	var found *WorkloadSelection
+	readErr := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(WORKLOAD_SELECTION)); b != nil {
+			if v := b.Get([]byte(selectionKey(deviceId, policyName))); v != nil {
+				var s WorkloadSelection
+				if err := json.Unmarshal(v, &s); err != nil {
+					glog.Errorf("Unable to deserialize workload selection db record: %v", v)
+				} else {
+					found = &s
+				}
+			}
+		}
+		return nil // end the transaction
+	})
+	return found, readErr
+}
+
+// Delete the workload selection records whose outcome was reached before the input time. Returns the number of records
+// deleted.
+func PurgeWorkloadSelections(db *bolt.DB, before uint64) (int, error) {
+	purged := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(WORKLOAD_SELECTION))
+		if b == nil {
+			return nil
+		}
+
+		// Keys cannot be deleted while iterating over the bucket, so the expired keys are collected first.
+		expired := make([][]byte, 0, 10)
+		b.ForEach(func(k, v []byte) error {
+			var s WorkloadSelection
+			if err := json.Unmarshal(v, &s); err != nil {
+				glog.Errorf("Unable to deserialize workload selection db record: %v", v)
+			} else if s.Time < before {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			purged += 1
+		}
+		return nil
+	})
+	return purged, err
+}
+
+func selectionKey(deviceId string, policyName string) string {
+	return fmt.Sprintf("%v/%v", deviceId, policyName)
+}
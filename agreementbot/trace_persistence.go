@@ -0,0 +1,209 @@
+package agreementbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/policy"
+	"time"
+)
+
+const AGREEMENT_TRACE = "agreement_trace"
+
+// The maximum number of entries kept in an agreement trace. The oldest entries are dropped first.
+const MAX_TRACE_ENTRIES = 200
+
+// The steps recorded in an agreement trace.
+const (
+	TRACE_STARTED         = "trace_started"
+	TRACE_WORKLOAD_CHOSEN = "workload_chosen"
+	TRACE_REPLY           = "reply"
+	TRACE_COMPATIBILITY   = "compatibility"
+	TRACE_DATA_RECEIVED   = "data_received"
+	TRACE_CANCELLED       = "cancelled"
+	TRACE_REEVALUATED     = "reevaluated"
+)
+
+// An agreement trace is a step by step record of the decisions the agbot made for a single agreement. Decisions are
+// only recorded for agreements that have a trace, so that one agreement can be troubleshot in detail without turning up
+// the log verbosity of the whole agbot.
+type AgreementTrace struct {
+	AgreementId string       `json:"agreement_id"`
+	StartTime   uint64       `json:"start_time"` // time when tracing of the agreement started
+	Entries     []TraceEntry `json:"entries"`
+}
+
+type TraceEntry struct {
+	Time   uint64 `json:"time"`
+	Step   string `json:"step"`
+	Detail string `json:"detail"`
+}
+
+func (t AgreementTrace) String() string {
+	return fmt.Sprintf("AgreementId: %v, "+
+		"StartTime: %v, "+
+		"Entries: %v",
+		t.AgreementId, t.StartTime, t.Entries)
+}
+
+// Start tracing the agreement. Nothing is changed if the agreement is already being traced.
+func StartAgreementTrace(db *bolt.DB, agreementId string) error {
+	return startAgreementTrace(db, agreementId, nil)
+}
+
+// Start tracing the agreement with the input steps, which happened before tracing started, ahead of the trace_started step.
+func startAgreementTrace(db *bolt.DB, agreementId string, earlier []TraceEntry) error {
+	if agreementId == "" {
+		return errors.New("Illegal input: agreementId is empty")
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if b, err := tx.CreateBucketIfNotExists([]byte(AGREEMENT_TRACE)); err != nil {
+			return err
+		} else if b.Get([]byte(agreementId)) != nil {
+			return nil
+		} else {
+			now := uint64(time.Now().Unix())
+			t := &AgreementTrace{
+				AgreementId: agreementId,
+				StartTime:   now,
+				Entries:     append(earlier, TraceEntry{Time: now, Step: TRACE_STARTED}),
+			}
+			return putAgreementTrace(b, t)
+		}
+	})
+}
+
+// Record a step in the agreement's trace. Nothing is recorded if the agreement is not being traced.
+func RecordAgreementTrace(db *bolt.DB, agreementId string, step string, detail string) error {
+	if traced, err := IsAgreementTraced(db, agreementId); err != nil || !traced {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(AGREEMENT_TRACE)); b == nil {
+			return nil
+		} else if v := b.Get([]byte(agreementId)); v == nil {
+			return nil
+		} else {
+			var t AgreementTrace
+			if err := json.Unmarshal(v, &t); err != nil {
+				return fmt.Errorf("Unable to deserialize agreement trace db record: %v", v)
+			}
+			t.Entries = append(t.Entries, TraceEntry{Time: uint64(time.Now().Unix()), Step: step, Detail: detail})
+			if len(t.Entries) > MAX_TRACE_ENTRIES {
+				t.Entries = t.Entries[len(t.Entries)-MAX_TRACE_ENTRIES:]
+			}
+			return putAgreementTrace(b, &t)
+		}
+	})
+}
+
+// Returns true if the agreement is being traced.
+func IsAgreementTraced(db *bolt.DB, agreementId string) (bool, error) {
+	traced := false
+	readErr := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(AGREEMENT_TRACE)); b != nil {
+			traced = b.Get([]byte(agreementId)) != nil
+		}
+		return nil
+	})
+	return traced, readErr
+}
+
+// Returns the agreement's trace, or nil if the agreement is not being traced.
+func FindAgreementTrace(db *bolt.DB, agreementId string) (*AgreementTrace, error) {
+	var trace *AgreementTrace
+	readErr := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(AGREEMENT_TRACE)); b != nil {
+			if v := b.Get([]byte(agreementId)); v != nil {
+				var t AgreementTrace
+				if err := json.Unmarshal(v, &t); err != nil {
+					return fmt.Errorf("Unable to deserialize agreement trace db record: %v", v)
+				}
+				trace = &t
+			}
+		}
+		return nil
+	})
+	return trace, readErr
+}
+
+// Stop tracing the agreement and discard its trace.
+func DeleteAgreementTrace(db *bolt.DB, agreementId string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(AGREEMENT_TRACE)); b != nil {
+			return b.Delete([]byte(agreementId))
+		}
+		return nil
+	})
+}
+
+// Delete the traces that were started before the input time and whose agreement no longer exists, e.g. because it was
+// purged after it was archived, except the traces of the agreement ids to keep. Returns the number of traces deleted.
+func PurgeAgreementTraces(db *bolt.DB, startedBefore uint64, keep map[string]bool) (int, error) {
+	expired := make([]string, 0, 10)
+	readErr := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(AGREEMENT_TRACE)); b != nil {
+			b.ForEach(func(k, v []byte) error {
+				var t AgreementTrace
+				if err := json.Unmarshal(v, &t); err != nil {
+					glog.Errorf("Unable to deserialize agreement trace db record: %v", v)
+				} else if t.StartTime < startedBefore && !keep[t.AgreementId] {
+					expired = append(expired, t.AgreementId)
+				}
+				return nil
+			})
+		}
+		return nil // end the transaction
+	})
+	if readErr != nil {
+		return 0, readErr
+	}
+
+	purged := 0
+	for _, id := range expired {
+		if ag, err := FindSingleAgreementByAgreementIdAllProtocols(db, id, policy.AllAgreementProtocols(), []AFilter{}); err != nil {
+			return purged, err
+		} else if ag != nil {
+			continue
+		} else if err := DeleteAgreementTrace(db, id); err != nil {
+			return purged, err
+		}
+		purged += 1
+	}
+	return purged, nil
+}
+
+func putAgreementTrace(b *bolt.Bucket, t *AgreementTrace) error {
+	if bytes, err := json.Marshal(t); err != nil {
+		return fmt.Errorf("Unable to serialize agreement trace %v. Error: %v", t, err)
+	} else if err := b.Put([]byte(t.AgreementId), bytes); err != nil {
+		return fmt.Errorf("Unable to write agreement trace %v to bucket %v", t, AGREEMENT_TRACE)
+	} else {
+		glog.V(5).Infof("Succeeded writing agreement trace %v", t)
+		return nil
+	}
+}
+
+// Start tracing an agreement. The workload of an agreement is chosen when the agreement is initiated, which is usually
+// before its id can be traced, so the trace of an existing agreement begins with the workload that was chosen for it,
+// at the time it was chosen.
+func TraceAgreement(db *bolt.DB, agreementId string) error {
+	earlier := make([]TraceEntry, 0, 1)
+	if traced, err := IsAgreementTraced(db, agreementId); err != nil || traced {
+		return err
+	} else if ag, err := FindSingleAgreementByAgreementIdAllProtocols(db, agreementId, policy.AllAgreementProtocols(), []AFilter{}); err != nil {
+		return err
+	} else if ag != nil && ag.WorkloadURL != "" {
+		earlier = append(earlier, TraceEntry{Time: ag.AgreementInceptionTime, Step: TRACE_WORKLOAD_CHOSEN, Detail: workloadChosenDetail(ag.WorkloadURL, ag.WorkloadVersion, ag.WorkloadArch, ag.DeviceId, ag.PolicyName, ag.DeploymentOverridesGroup)})
+	}
+	return startAgreementTrace(db, agreementId, earlier)
+}
+
+// The detail of the workload_chosen step of a trace.
+func workloadChosenDetail(workloadURL string, version string, arch string, deviceId string, policyName string, overridesGroup string) string {
+	return fmt.Sprintf("workload %v version %v arch %v for device %v with policy %v, deployment overrides group %v", workloadURL, version, arch, deviceId, policyName, overridesGroup)
+}
@@ -0,0 +1,111 @@
+// +build integration
+
+package agreementbot
+
+import (
+	"github.com/open-horizon/anax/policy"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_AgreementTrace_lifecycle(t *testing.T) {
+
+	agreementId := "trace1"
+
+	// Nothing is recorded for an agreement that is not traced.
+	if err := RecordAgreementTrace(testDb, agreementId, TRACE_REPLY, "not traced"); err != nil {
+		t.Errorf("Received error recording untraced agreement: %v", err)
+	} else if trace, err := FindAgreementTrace(testDb, agreementId); err != nil {
+		t.Errorf("Received error finding trace: %v", err)
+	} else if trace != nil {
+		t.Errorf("Received trace %v that should not exist.", trace)
+	}
+
+	if err := TraceAgreement(testDb, agreementId); err != nil {
+		t.Errorf("Received error starting trace: %v", err)
+	} else if err := RecordAgreementTrace(testDb, agreementId, TRACE_CANCELLED, "reason 1"); err != nil {
+		t.Errorf("Received error recording trace: %v", err)
+	} else if err := TraceAgreement(testDb, agreementId); err != nil {
+		t.Errorf("Received error restarting trace: %v", err)
+	} else if trace, err := FindAgreementTrace(testDb, agreementId); err != nil {
+		t.Errorf("Received error finding trace: %v", err)
+	} else if trace == nil {
+		t.Errorf("Expected a trace")
+	} else if len(trace.Entries) != 2 || trace.Entries[0].Step != TRACE_STARTED || trace.Entries[1].Step != TRACE_CANCELLED || trace.Entries[1].Detail != "reason 1" {
+		t.Errorf("Unexpected trace entries: %v", trace.Entries)
+	}
+
+	// The oldest entries are dropped when the trace is full.
+	for i := 0; i < MAX_TRACE_ENTRIES; i++ {
+		if err := RecordAgreementTrace(testDb, agreementId, TRACE_REPLY, "filler"); err != nil {
+			t.Errorf("Received error recording trace: %v", err)
+		}
+	}
+	if trace, err := FindAgreementTrace(testDb, agreementId); err != nil {
+		t.Errorf("Received error finding trace: %v", err)
+	} else if len(trace.Entries) != MAX_TRACE_ENTRIES || trace.Entries[0].Step != TRACE_REPLY {
+		t.Errorf("Expected %v entries starting with the latest, got %v starting with %v", MAX_TRACE_ENTRIES, len(trace.Entries), trace.Entries[0])
+	}
+
+	if err := DeleteAgreementTrace(testDb, agreementId); err != nil {
+		t.Errorf("Received error deleting trace: %v", err)
+	} else if traced, err := IsAgreementTraced(testDb, agreementId); err != nil || traced {
+		t.Errorf("Expected the agreement to not be traced, traced %v, error: %v", traced, err)
+	}
+}
+
+func Test_TraceAgreement_existing(t *testing.T) {
+
+	agreementId := "trace2"
+
+	if err := AgreementAttempt(testDb, agreementId, "myorg", "myorg/an-traced", "trace policy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{WorkloadURL: "cpu", Version: "1.0.0", Arch: "amd64"}, nil); err != nil {
+		t.Fatalf("Received error creating agreement: %v", err)
+	}
+	ag, err := FindSingleAgreementByAgreementId(testDb, agreementId, "Basic", []AFilter{})
+	if err != nil || ag == nil {
+		t.Fatalf("Received error finding agreement %v: %v", agreementId, err)
+	}
+
+	// The workload was chosen before tracing started, so it is recorded first, at the time it was chosen.
+	if err := TraceAgreement(testDb, agreementId); err != nil {
+		t.Errorf("Received error starting trace: %v", err)
+	} else if trace, err := FindAgreementTrace(testDb, agreementId); err != nil {
+		t.Errorf("Received error finding trace: %v", err)
+	} else if trace == nil || len(trace.Entries) != 2 {
+		t.Errorf("Expected a trace with 2 entries, got %v", trace)
+	} else if e := trace.Entries[0]; e.Step != TRACE_WORKLOAD_CHOSEN || e.Time != ag.AgreementInceptionTime || !strings.Contains(e.Detail, "workload cpu version 1.0.0 arch amd64") {
+		t.Errorf("Expected the chosen workload first, got %v", e)
+	} else if trace.Entries[1].Step != TRACE_STARTED {
+		t.Errorf("Expected the trace to be started after the workload was chosen, got %v", trace.Entries[1])
+	}
+}
+
+func Test_PurgeAgreementTraces(t *testing.T) {
+
+	if err := AgreementAttempt(testDb, "trace-live", "myorg", "myorg/an-traced", "trace policy", "", "", "", "Basic", "", policy.NodeHealth{}, &policy.Workload{}, nil); err != nil {
+		t.Fatalf("Received error creating agreement: %v", err)
+	}
+	for _, id := range []string{"trace-live", "trace-gone", "trace-configured"} {
+		if err := StartAgreementTrace(testDb, id); err != nil {
+			t.Fatalf("Received error starting trace %v: %v", id, err)
+		}
+	}
+
+	// Traces started after the purge time are kept.
+	if _, err := PurgeAgreementTraces(testDb, 1, map[string]bool{}); err != nil {
+		t.Errorf("Received error purging traces: %v", err)
+	} else if traced, err := IsAgreementTraced(testDb, "trace-gone"); err != nil || !traced {
+		t.Errorf("Expected the recent trace to be kept, traced %v, error: %v", traced, err)
+	}
+
+	// Older traces are purged when their agreement no longer exists, unless they are configured.
+	if _, err := PurgeAgreementTraces(testDb, uint64(time.Now().Unix())+10, map[string]bool{"trace-configured": true}); err != nil {
+		t.Errorf("Received error purging traces: %v", err)
+	}
+	for id, kept := range map[string]bool{"trace-live": true, "trace-gone": false, "trace-configured": true} {
+		if traced, err := IsAgreementTraced(testDb, id); err != nil || traced != kept {
+			t.Errorf("Expected trace %v to be kept %v, traced %v, error: %v", id, kept, traced, err)
+		}
+	}
+}
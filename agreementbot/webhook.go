@@ -0,0 +1,170 @@
+package agreementbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/policy"
+	"net/http"
+	"time"
+)
+
+// The agreement lifecycle and workload selection events that are posted to the webhook.
+const (
+	WEBHOOK_AGREEMENT_INITIATED  = "agreement_initiated"
+	WEBHOOK_AGREEMENT_ACCEPTED   = "agreement_accepted"
+	WEBHOOK_AGREEMENT_CANCELLED  = "agreement_cancelled"
+	WEBHOOK_WORKLOAD_UNSUPPORTED = "workload_unsupported" // the device cannot run any workload in the policy or pattern
+	WEBHOOK_AGREEMENT_OBSERVED   = "agreement_observed"   // the agreement an agbot in observer mode would have proposed
+)
+
+// The number of events that can be waiting for delivery. When the queue is full, new events are dropped.
+const WEBHOOK_QUEUE_SIZE = 100
+
+// The number of times delivery of an event is attempted, and the number of seconds between attempts.
+const WEBHOOK_RETRIES = 3
+const WEBHOOK_RETRY_INTERVAL_S = 2
+
+// The JSON body posted to the webhook for each event.
+type AgreementEvent struct {
+	Event             string              `json:"event"`
+	AgreementId       string              `json:"agreement_id"`
+	Protocol          string              `json:"protocol"`
+	DeviceId          string              `json:"device_id,omitempty"`
+	PolicyName        string              `json:"policy_name,omitempty"`
+	Reason            uint                `json:"reason,omitempty"`
+	ReasonDescription string              `json:"reason_description,omitempty"`
+	OperatorReason    string              `json:"operator_reason,omitempty"`
+	PatternId         string              `json:"pattern_id,omitempty"`
+	Rejections        []WorkloadRejection `json:"rejections,omitempty"`
+	WorkloadURL       string              `json:"workload_url,omitempty"`
+	WorkloadVersion   string              `json:"workload_version,omitempty"`
+	WorkloadArch      string              `json:"workload_arch,omitempty"`
+	Time              uint64              `json:"time"`
+}
+
+// The reason a workload was rejected for a device, reported with WEBHOOK_WORKLOAD_UNSUPPORTED events.
+type WorkloadRejection struct {
+	WorkloadURL string `json:"workload_url"`
+	Org         string `json:"organization"`
+	Version     string `json:"version"`
+	Arch        string `json:"arch"`
+	Priority    int    `json:"priority,omitempty"`
+	Reason      string `json:"reason"`
+}
+
+func (r WorkloadRejection) String() string {
+	return fmt.Sprintf("Workload: %v/%v %v %v, Priority: %v, Reason: %v", r.Org, r.WorkloadURL, r.Version, r.Arch, r.Priority, r.Reason)
+}
+
+func NewWorkloadRejection(workload *policy.Workload, reason string) WorkloadRejection {
+	return WorkloadRejection{
+		WorkloadURL: workload.WorkloadURL,
+		Org:         workload.Org,
+		Version:     workload.Version,
+		Arch:        workload.Arch,
+		Priority:    workload.Priority.PriorityValue,
+		Reason:      reason,
+	}
+}
+
+func (e AgreementEvent) String() string {
+	return fmt.Sprintf("Event: %v, AgreementId: %v, Protocol: %v, DeviceId: %v, PolicyName: %v, Reason: %v, PatternId: %v, Rejections: %v", e.Event, e.AgreementId, e.Protocol, e.DeviceId, e.PolicyName, e.Reason, e.PatternId, e.Rejections)
+}
+
+// An AgreementWebhook delivers agreement lifecycle events to a configured URL. Delivery is best effort: events are
+// queued without blocking the agreement workers and posted by a single goroutine, with a bounded number of retries.
+type AgreementWebhook struct {
+	url        string
+	authHeader string
+	httpClient *http.Client
+	queue      chan AgreementEvent
+}
+
+// Create a webhook from the agbot config and start its delivery goroutine. Returns nil when no webhook URL is
+// configured, in which case events are ignored.
+func NewAgreementWebhook(cfg *config.HorizonConfig) *AgreementWebhook {
+	if cfg.AgreementBot.WebhookURL == "" {
+		return nil
+	}
+
+	w := &AgreementWebhook{
+		url:        cfg.AgreementBot.WebhookURL,
+		authHeader: cfg.AgreementBot.WebhookAuthHeader,
+		httpClient: cfg.Collaborators.HTTPClientFactory.NewHTTPClient(nil),
+		queue:      make(chan AgreementEvent, WEBHOOK_QUEUE_SIZE),
+	}
+
+	go w.deliver()
+	return w
+}
+
+// Queue an event for delivery. This never blocks; if the queue is full the event is dropped. It is safe to call
+// on a nil webhook.
+func (w *AgreementWebhook) Notify(event AgreementEvent) {
+	if w == nil {
+		return
+	}
+
+	event.Time = uint64(time.Now().Unix())
+	select {
+	case w.queue <- event:
+	default:
+		glog.Warningf(AWlogString(fmt.Sprintf("webhook queue is full, dropping event %v", event)))
+	}
+}
+
+func (w *AgreementWebhook) deliver() {
+	for event := range w.queue {
+		if err := w.post(event); err != nil {
+			glog.Errorf(AWlogString(fmt.Sprintf("unable to deliver event %v to webhook %v, error: %v", event, w.url, err)))
+		} else {
+			glog.V(5).Infof(AWlogString(fmt.Sprintf("delivered event %v to webhook %v", event, w.url)))
+		}
+	}
+}
+
+// Post an event to the webhook, retrying transport errors and 5xx responses.
+func (w *AgreementWebhook) post(event AgreementEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to marshal event, error: %v", err))
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= WEBHOOK_RETRIES; attempt++ {
+		if attempt > 1 {
+			time.Sleep(WEBHOOK_RETRY_INTERVAL_S * time.Second)
+		}
+
+		req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+		if err != nil {
+			return errors.New(fmt.Sprintf("unable to create request, error: %v", err))
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if w.authHeader != "" {
+			req.Header.Set("Authorization", w.authHeader)
+		}
+
+		resp, err := w.httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			lastErr = errors.New(fmt.Sprintf("received status %v", resp.Status))
+			continue
+		} else if resp.StatusCode >= 300 {
+			// Client errors will not be fixed by retrying.
+			return errors.New(fmt.Sprintf("received status %v", resp.Status))
+		}
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("giving up after %v attempts, last error: %v", WEBHOOK_RETRIES, lastErr))
+}
@@ -0,0 +1,107 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"encoding/json"
+	"github.com/open-horizon/anax/policy"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_AgreementWebhook_nil(t *testing.T) {
+
+	// A nil webhook ignores events.
+	var w *AgreementWebhook
+	w.Notify(AgreementEvent{Event: WEBHOOK_AGREEMENT_INITIATED, AgreementId: "a1"})
+
+}
+
+func Test_AgreementWebhook_deliver_with_retry(t *testing.T) {
+
+	received := make(chan AgreementEvent, 2)
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		} else if r.Header.Get("Authorization") != "Bearer abc" {
+			t.Errorf("expected authorization header, got %v", r.Header.Get("Authorization"))
+		}
+
+		var event AgreementEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("unable to decode event, error %v", err)
+		}
+		received <- event
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	w := &AgreementWebhook{
+		url:        server.URL,
+		authHeader: "Bearer abc",
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		queue:      make(chan AgreementEvent, WEBHOOK_QUEUE_SIZE),
+	}
+	go w.deliver()
+
+	w.Notify(AgreementEvent{Event: WEBHOOK_AGREEMENT_CANCELLED, AgreementId: "a1", Protocol: "Basic", Reason: 200, ReasonDescription: "node cancelled"})
+
+	select {
+	case event := <-received:
+		if event.Event != WEBHOOK_AGREEMENT_CANCELLED || event.AgreementId != "a1" || event.Reason != 200 || event.Time == 0 {
+			t.Errorf("unexpected event %v", event)
+		}
+	case <-time.After((WEBHOOK_RETRY_INTERVAL_S + 5) * time.Second):
+		t.Errorf("event was not delivered after a retry")
+	}
+
+}
+
+func Test_AgreementWebhook_full_queue(t *testing.T) {
+
+	// Without a delivery goroutine the queue fills up, and further events are dropped without blocking.
+	w := &AgreementWebhook{
+		url:   "http://localhost",
+		queue: make(chan AgreementEvent, 1),
+	}
+
+	w.Notify(AgreementEvent{Event: WEBHOOK_AGREEMENT_INITIATED, AgreementId: "a1"})
+	w.Notify(AgreementEvent{Event: WEBHOOK_AGREEMENT_INITIATED, AgreementId: "a2"})
+
+	if len(w.queue) != 1 {
+		t.Errorf("expected 1 queued event, found %v", len(w.queue))
+	} else if event := <-w.queue; event.AgreementId != "a1" {
+		t.Errorf("expected the first event to be queued, found %v", event)
+	}
+
+}
+
+func Test_AgreementEvent_workload_unsupported(t *testing.T) {
+
+	wl := &policy.Workload{WorkloadURL: "http://mydomain.com/workload/cpu", Org: "myorg", Version: "1.0.0", Arch: "amd64", Priority: policy.WorkloadPriority{PriorityValue: 2}}
+	event := AgreementEvent{
+		Event:      WEBHOOK_WORKLOAD_UNSUPPORTED,
+		DeviceId:   "myorg/dev1",
+		PolicyName: "mypolicy",
+		PatternId:  "myorg/mypattern",
+		Rejections: []WorkloadRejection{NewWorkloadRejection(wl, "missing microservice")},
+	}
+
+	var decoded map[string]interface{}
+	if b, err := json.Marshal(event); err != nil {
+		t.Errorf("unable to marshal event, error %v", err)
+	} else if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Errorf("unable to demarshal event, error %v", err)
+	} else if decoded["pattern_id"] != "myorg/mypattern" {
+		t.Errorf("expected pattern id in %v", decoded)
+	} else if rejections, ok := decoded["rejections"].([]interface{}); !ok || len(rejections) != 1 {
+		t.Errorf("expected 1 rejection in %v", decoded)
+	} else if r := rejections[0].(map[string]interface{}); r["workload_url"] != wl.WorkloadURL || r["reason"] != "missing microservice" || r["priority"] != float64(2) {
+		t.Errorf("unexpected rejection %v", r)
+	}
+}
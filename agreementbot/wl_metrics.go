@@ -0,0 +1,152 @@
+package agreementbot
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The operations on workload usage records.
+const (
+	WU_OP_CREATE = "create"
+	WU_OP_UPDATE = "update"
+	WU_OP_DELETE = "delete"
+)
+
+// The reasons for creating and deleting workload usage records.
+const (
+	WU_REASON_AGREEMENT_REPLY     = "agreement_reply"     // created when a device accepted an agreement
+	WU_REASON_WORKLOAD_REJECTED   = "workload_rejected"   // created or deleted while choosing a workload the device supports
+	WU_REASON_INITIATE_FAILED     = "initiate_failed"     // deleted because an agreement could not be initiated
+	WU_REASON_AGREEMENT_CANCELLED = "agreement_cancelled" // deleted when an agreement was cancelled so that the highest priority workload is tried again
+	WU_REASON_POLICY_CHANGED      = "policy_changed"      // deleted because the policy changed
+	WU_REASON_POLICY_DELETED      = "policy_deleted"      // deleted because the policy no longer exists
+	WU_REASON_WORKLOAD_UPGRADE    = "workload_upgrade"    // deleted so that the device is upgraded to the highest priority workload
+)
+
+// The reasons for updating workload usage records, the kind of update.
+const (
+	WU_REASON_RETRY_COUNT       = "retry_count"       // the retry count changed after a workload failed
+	WU_REASON_PRIORITY          = "priority"          // the device moved to another workload priority
+	WU_REASON_PENDING_UPGRADE   = "pending_upgrade"   // an upgrade to the highest priority workload is pending
+	WU_REASON_AGREEMENT_ID      = "agreement_id"      // a new agreement was made with the device
+	WU_REASON_AGREEMENT_ENDED   = "agreement_ended"   // the current agreement ended
+	WU_REASON_AGREEMENT_FAILED  = "agreement_failed"  // an agreement was cancelled before it was finalized
+	WU_REASON_EXHAUSTED_RESET   = "exhausted_reset"   // the exhausted flag was cleared
+	WU_REASON_ROLLBACK_DISABLED = "rollback_disabled" // rollback checking was disabled
+	WU_REASON_POLICY            = "policy"            // the policy of the record changed
+	WU_REASON_INTEGRITY_REPAIR  = "integrity_repair"  // the agreement id was cleared by the database integrity check
+)
+
+// The maximum number of devices and policies whose counters are kept. When a change is recorded for another device and
+// policy, the counters of the device and policy with the oldest change are dropped. The totals are never dropped.
+const WU_METRICS_MAX_RECORDS = 1000
+
+// The operations on the workload usage record of a device and policy, counted by operation and reason. A device and
+// policy with many deletes for workload_rejected keeps failing to support the workloads of the policy.
+type WorkloadUsageChurnStats struct {
+	DeviceId      string                    `json:"device_id"`
+	PolicyName    string                    `json:"policy_name"`
+	Counts        map[string]map[string]int `json:"counts"`         // operation -> reason -> number of operations
+	LastOperation string                    `json:"last_operation"` // operation of the most recent change
+	LastReason    string                    `json:"last_reason"`    // reason of the most recent change
+	LastTime      int64                     `json:"last_time"`      // time of the most recent change
+}
+
+func (s WorkloadUsageChurnStats) String() string {
+	return fmt.Sprintf("DeviceId: %v, PolicyName: %v, Counts: %v, LastOperation: %v, LastReason: %v, LastTime: %v", s.DeviceId, s.PolicyName, s.Counts, s.LastOperation, s.LastReason, s.LastTime)
+}
+
+// A copy of the workload usage churn counters.
+type WorkloadUsageChurn struct {
+	Totals  map[string]map[string]int          `json:"totals"`  // operation -> reason -> number of operations, across all records
+	Records map[string]WorkloadUsageChurnStats `json:"records"` // the counters of each device and policy, keyed by device id/policy name
+}
+
+// Counts the operations on workload usage records. It is safe for concurrent use.
+type WorkloadUsageMetrics struct {
+	lock    sync.Mutex
+	totals  map[string]map[string]int
+	records map[string]*WorkloadUsageChurnStats
+}
+
+func NewWorkloadUsageMetrics() *WorkloadUsageMetrics {
+	return &WorkloadUsageMetrics{
+		totals:  make(map[string]map[string]int),
+		records: make(map[string]*WorkloadUsageChurnStats),
+	}
+}
+
+// The workload usage metrics of this process. Every successful create, update and delete of a workload usage record
+// is recorded into it.
+var WUMetrics = NewWorkloadUsageMetrics()
+
+// Record an operation on the workload usage record of the device and policy.
+func (m *WorkloadUsageMetrics) Record(deviceId string, policyName string, op string, reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := fmt.Sprintf("%v/%v", deviceId, policyName)
+	s, ok := m.records[key]
+	if !ok {
+		if len(m.records) >= WU_METRICS_MAX_RECORDS {
+			m.dropOldestRecord()
+		}
+		s = &WorkloadUsageChurnStats{DeviceId: deviceId, PolicyName: policyName, Counts: make(map[string]map[string]int)}
+		m.records[key] = s
+	}
+
+	countChurn(m.totals, op, reason)
+	countChurn(s.Counts, op, reason)
+	s.LastOperation = op
+	s.LastReason = reason
+	s.LastTime = time.Now().Unix()
+}
+
+// Drop the counters of the device and policy with the oldest change. The caller must hold the lock.
+func (m *WorkloadUsageMetrics) dropOldestRecord() {
+	oldestKey := ""
+	oldestTime := int64(0)
+	for key, s := range m.records {
+		if oldestKey == "" || s.LastTime < oldestTime {
+			oldestKey = key
+			oldestTime = s.LastTime
+		}
+	}
+	delete(m.records, oldestKey)
+}
+
+// Returns a copy of the counters.
+func (m *WorkloadUsageMetrics) Snapshot() WorkloadUsageChurn {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	snap := WorkloadUsageChurn{
+		Totals:  copyChurnCounts(m.totals),
+		Records: make(map[string]WorkloadUsageChurnStats, len(m.records)),
+	}
+	for key, s := range m.records {
+		c := *s
+		c.Counts = copyChurnCounts(s.Counts)
+		snap.Records[key] = c
+	}
+	return snap
+}
+
+func countChurn(counts map[string]map[string]int, op string, reason string) {
+	if _, ok := counts[op]; !ok {
+		counts[op] = make(map[string]int)
+	}
+	counts[op][reason]++
+}
+
+func copyChurnCounts(counts map[string]map[string]int) map[string]map[string]int {
+	res := make(map[string]map[string]int, len(counts))
+	for op, reasons := range counts {
+		res[op] = make(map[string]int, len(reasons))
+		for reason, n := range reasons {
+			res[op][reason] = n
+		}
+	}
+	return res
+}
@@ -0,0 +1,87 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func Test_WorkloadUsageMetrics_Record(t *testing.T) {
+
+	m := NewWorkloadUsageMetrics()
+	m.Record("myorg/dev1", "p1", WU_OP_CREATE, WU_REASON_WORKLOAD_REJECTED)
+	m.Record("myorg/dev1", "p1", WU_OP_DELETE, WU_REASON_WORKLOAD_REJECTED)
+	m.Record("myorg/dev1", "p1", WU_OP_CREATE, WU_REASON_WORKLOAD_REJECTED)
+	m.Record("myorg/dev2", "p1", WU_OP_UPDATE, WU_REASON_RETRY_COUNT)
+
+	snap := m.Snapshot()
+	if len(snap.Records) != 2 {
+		t.Errorf("expected counters for 2 records, got %v", snap.Records)
+	} else if snap.Totals[WU_OP_CREATE][WU_REASON_WORKLOAD_REJECTED] != 2 || snap.Totals[WU_OP_DELETE][WU_REASON_WORKLOAD_REJECTED] != 1 || snap.Totals[WU_OP_UPDATE][WU_REASON_RETRY_COUNT] != 1 {
+		t.Errorf("wrong totals: %v", snap.Totals)
+	}
+
+	if dev1 := snap.Records["myorg/dev1/p1"]; dev1.Counts[WU_OP_CREATE][WU_REASON_WORKLOAD_REJECTED] != 2 || dev1.Counts[WU_OP_DELETE][WU_REASON_WORKLOAD_REJECTED] != 1 {
+		t.Errorf("wrong counts for dev1: %v", dev1)
+	} else if dev1.LastOperation != WU_OP_CREATE || dev1.LastReason != WU_REASON_WORKLOAD_REJECTED || dev1.LastTime == 0 {
+		t.Errorf("wrong last change for dev1: %v", dev1)
+	}
+
+	// The snapshot is a copy.
+	m.Record("myorg/dev1", "p1", WU_OP_DELETE, WU_REASON_WORKLOAD_REJECTED)
+	if snap.Records["myorg/dev1/p1"].Counts[WU_OP_DELETE][WU_REASON_WORKLOAD_REJECTED] != 1 || snap.Totals[WU_OP_DELETE][WU_REASON_WORKLOAD_REJECTED] != 1 {
+		t.Errorf("snapshot changed after a new operation was recorded: %v", snap)
+	}
+}
+
+// The counters of at most WU_METRICS_MAX_RECORDS devices and policies are kept, the oldest are dropped first.
+func Test_WorkloadUsageMetrics_max_records(t *testing.T) {
+
+	m := NewWorkloadUsageMetrics()
+	m.Record("myorg/old", "p1", WU_OP_CREATE, WU_REASON_AGREEMENT_REPLY)
+	m.records["myorg/old/p1"].LastTime = 1
+	for i := 1; i < WU_METRICS_MAX_RECORDS; i++ {
+		m.Record(fmt.Sprintf("myorg/dev%v", i), "p1", WU_OP_CREATE, WU_REASON_AGREEMENT_REPLY)
+	}
+
+	// A change to a device and policy that is already counted drops nothing.
+	m.Record("myorg/dev1", "p1", WU_OP_DELETE, WU_REASON_AGREEMENT_CANCELLED)
+	if snap := m.Snapshot(); len(snap.Records) != WU_METRICS_MAX_RECORDS {
+		t.Errorf("expected counters for %v records, got %v", WU_METRICS_MAX_RECORDS, len(snap.Records))
+	}
+
+	m.Record("myorg/new", "p1", WU_OP_CREATE, WU_REASON_AGREEMENT_REPLY)
+	snap := m.Snapshot()
+	if len(snap.Records) != WU_METRICS_MAX_RECORDS {
+		t.Errorf("expected counters for %v records, got %v", WU_METRICS_MAX_RECORDS, len(snap.Records))
+	} else if _, ok := snap.Records["myorg/old/p1"]; ok {
+		t.Errorf("expected the counters of the oldest record to be dropped")
+	} else if _, ok := snap.Records["myorg/new/p1"]; !ok {
+		t.Errorf("expected the counters of the new record to be kept")
+	} else if n := snap.Totals[WU_OP_CREATE][WU_REASON_AGREEMENT_REPLY]; n != WU_METRICS_MAX_RECORDS+1 {
+		t.Errorf("expected the totals to keep the dropped counters, got %v creates", n)
+	}
+}
+
+func Test_WorkloadUsageMetrics_concurrent(t *testing.T) {
+
+	m := NewWorkloadUsageMetrics()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.Record("myorg/dev1", "p1", WU_OP_UPDATE, WU_REASON_PRIORITY)
+				m.Snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := m.Snapshot().Totals[WU_OP_UPDATE][WU_REASON_PRIORITY]; n != 1000 {
+		t.Errorf("expected 1000 updates, got %v", n)
+	}
+}
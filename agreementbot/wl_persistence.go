@@ -6,12 +6,19 @@ import (
 	"fmt"
 	"github.com/boltdb/bolt"
 	"github.com/golang/glog"
+	"sort"
 	"strconv"
 	"time"
 )
 
 const WORKLOAD_USAGE = "workload_usage"
 
+// The causes of a workload retry. Only device caused retries count against the retry budget of a workload priority.
+const WU_RETRY_DEVICE = "device"                     // the device rejected or failed the previous agreement
+const WU_RETRY_REQS_NOT_MET = "requirements_not_met" // the device cannot meet the API spec requirements of the workload
+const WU_RETRY_AGBOT = "agbot"                       // the agbot cancelled the previous agreement for its own reasons, e.g. a blockchain write failed
+const WU_RETRY_UNKNOWN = "unknown"                   // the previous agreement was cancelled for a reason the agreement protocol has no code for
+
 type WorkloadUsage struct {
 	Id                 uint64   `json:"record_id"`            // unique primary key for records
 	DeviceId           string   `json:"device_id"`            // the device id we are working with, immutable after construction
@@ -28,6 +35,13 @@ type WorkloadUsage struct {
 	DisableRetry       bool     `json:"disable_retry"`        // when true, retry and retry durations are disbled which effectively disables workload rollback
 	VerifiedDurationS  int      `json:"verified_durations"`   // the number of seconds for successful data verification before disabling workload rollback retries
 	ReqsNotMet         bool     `json:"requirements_not_met"` // this workload usage record is not at the highest priority because the device did not meet the API spec requirements at one of the higher priorities
+	DeviceRetries      int      `json:"device_retries"`       // the number of retries in the current interval caused by the device
+	ReqsNotMetRetries  int      `json:"reqs_not_met_retries"` // the number of retries in the current interval caused by the device not meeting the API spec requirements
+	AgbotRetries       int      `json:"agbot_retries"`        // the number of retries in the current interval caused by the agbot, these are not counted in RetryCount
+	UnknownRetries     int      `json:"unknown_retries"`      // the number of retries in the current interval whose cause is unknown
+	PendingRetryCause  string   `json:"pending_retry_cause"`  // the cause of the most recent agreement cancellation, it is charged to the next retry
+	FailureCount       int      `json:"failure_count"`        // the number of agreements that were cancelled before they were finalized
+	Exhausted          bool     `json:"exhausted"`            // when true, the failure count reached the configured maximum and no more agreements are made until the record is reset
 }
 
 func (w WorkloadUsage) String() string {
@@ -45,9 +59,89 @@ func (w WorkloadUsage) String() string {
 		"DisableRetry: %v, "+
 		"VerifiedDurationS: %v, "+
 		"ReqsNotMet: %v, "+
+		"DeviceRetries: %v, "+
+		"ReqsNotMetRetries: %v, "+
+		"AgbotRetries: %v, "+
+		"UnknownRetries: %v, "+
+		"PendingRetryCause: %v, "+
+		"FailureCount: %v, "+
+		"Exhausted: %v, "+
 		"Policy: %v",
 		w.Id, w.DeviceId, w.HAPartners, w.PendingUpgradeTime, w.PolicyName, w.Priority, w.RetryCount,
-		w.RetryDurationS, w.CurrentAgreementId, w.FirstTryTime, w.LatestRetryTime, w.DisableRetry, w.VerifiedDurationS, w.ReqsNotMet, w.Policy)
+		w.RetryDurationS, w.CurrentAgreementId, w.FirstTryTime, w.LatestRetryTime, w.DisableRetry, w.VerifiedDurationS, w.ReqsNotMet,
+		w.DeviceRetries, w.ReqsNotMetRetries, w.AgbotRetries, w.UnknownRetries, w.PendingRetryCause, w.FailureCount, w.Exhausted, w.Policy)
+}
+
+// Returns the cause of the next retry, which is the cause of the most recent agreement cancellation. Retries of records
+// written before causes were tracked are charged to the device.
+func (w WorkloadUsage) NextRetryCause() string {
+	if w.PendingRetryCause == "" {
+		return WU_RETRY_DEVICE
+	}
+	return w.PendingRetryCause
+}
+
+// Returns the retry count after one more retry with the input cause. Agbot caused retries leave the count unchanged so
+// that they do not use up the device's retry budget. Retries of unknown cause are counted, as all retries were before
+// their causes were tracked.
+func (w WorkloadUsage) NextRetryCount(cause string) int {
+	if cause == WU_RETRY_AGBOT {
+		return w.RetryCount
+	}
+	return w.RetryCount + 1
+}
+
+func (w *WorkloadUsage) countRetry(cause string) {
+	switch cause {
+	case WU_RETRY_AGBOT:
+		w.AgbotRetries++
+	case WU_RETRY_REQS_NOT_MET:
+		w.ReqsNotMetRetries++
+	case WU_RETRY_UNKNOWN:
+		w.UnknownRetries++
+	default:
+		w.DeviceRetries++
+	}
+}
+
+func (w *WorkloadUsage) resetRetries() {
+	w.RetryCount = 0
+	w.DeviceRetries = 0
+	w.ReqsNotMetRetries = 0
+	w.AgbotRetries = 0
+	w.UnknownRetries = 0
+}
+
+// The update made by UpdateRetryCount.
+func (w *WorkloadUsage) setRetryCount(retryCount int, cause string, agid string) {
+	w.CurrentAgreementId = agid
+	w.RetryCount = retryCount
+	w.PendingRetryCause = ""
+	w.countRetry(cause)
+	// Reset the retry interval time. There is a big assumption here, which is that the caller has already made sure
+	// that it's not time to switch the workload usage to a different priority, and therefore the reason for updating
+	// the retry count is because the caller thinks they want to stay with the current workload. Since we know it's ok
+	// to stay with the current workload priority, then we can safely start a new retry interval. It's important to have
+	// an accurate current workload interval in case the workload starts misbehaving.
+	now := uint64(time.Now().Unix())
+	w.LatestRetryTime = now
+	if w.FirstTryTime+uint64(w.RetryDurationS) < now {
+		w.FirstTryTime = uint64(time.Now().Unix())
+		// We used one retry simply because we are here updating retry counts, unless the agbot caused it.
+		w.resetRetries()
+		w.countRetry(cause)
+		w.RetryCount = w.NextRetryCount(cause)
+	}
+}
+
+// The update made by UpdatePriority.
+func (w *WorkloadUsage) setPriority(priority int, retryDurationS int, verifiedDurationS int, agid string) {
+	w.CurrentAgreementId = agid
+	w.Priority = priority
+	w.resetRetries()
+	w.RetryDurationS = retryDurationS
+	w.VerifiedDurationS = verifiedDurationS
+	w.FirstTryTime = uint64(time.Now().Unix())
 }
 
 // private factory method for workloadusage w/out persistence safety:
@@ -75,6 +169,16 @@ func workloadUsage(deviceId string, hapartners []string, policy string, policyNa
 	}
 }
 
+// Returns the verified duration to record in a workload usage, which is the policy's verified duration raised to the
+// configured minimum if it is below it. A zero minimum disables the floor.
+func MinVerifiedDuration(deviceId string, policyName string, verifiedDurationS int, minVerifiedDurationS int) int {
+	if minVerifiedDurationS > 0 && verifiedDurationS < minVerifiedDurationS {
+		glog.V(3).Infof("Raising verified duration for device %v with policy %v from %v to the configured minimum %v", deviceId, policyName, verifiedDurationS, minVerifiedDurationS)
+		return minVerifiedDurationS
+	}
+	return verifiedDurationS
+}
+
 func NewWorkloadUsage(db *bolt.DB, deviceId string, hapartners []string, policy string, policyName string, priority int, retryDurationS int, verifiedDurationS int, reqsNotMet bool, agid string) error {
 	if wlUsage, err := workloadUsage(deviceId, hapartners, policy, policyName, priority, retryDurationS, verifiedDurationS, reqsNotMet, agid); err != nil {
 		return err
@@ -85,25 +189,18 @@ func NewWorkloadUsage(db *bolt.DB, deviceId string, hapartners []string, policy
 	} else if err := WUPersistNew(db, wuBucketName(), wlUsage); err != nil {
 		return err
 	} else {
+		reason := WU_REASON_AGREEMENT_REPLY
+		if reqsNotMet {
+			reason = WU_REASON_WORKLOAD_REJECTED
+		}
+		WUMetrics.Record(deviceId, policyName, WU_OP_CREATE, reason)
 		return nil
 	}
 }
 
-func UpdateRetryCount(db *bolt.DB, deviceid string, policyName string, retryCount int, agid string) (*WorkloadUsage, error) {
-	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, func(w WorkloadUsage) *WorkloadUsage {
-		w.CurrentAgreementId = agid
-		w.RetryCount = retryCount
-		// Reset the retry interval time. There is a big assumption here, which is that the caller has already made sure
-		// that it's not time to switch the workload usage to a different priority, and therefore the reason for updating
-		// the retry count is because the caller thinks they want to stay with the current workload. Since we know it's ok
-		// to stay with the current workload priority, then we can safely start a new retry interval. It's important to have
-		// an accurate current workload interval in case the workload starts misbehaving.
-		now := uint64(time.Now().Unix())
-		w.LatestRetryTime = now
-		if w.FirstTryTime+uint64(w.RetryDurationS) < now {
-			w.FirstTryTime = uint64(time.Now().Unix())
-			w.RetryCount = 1 // We used one retry simply because we are here updating retry counts.
-		}
+func UpdateRetryCount(db *bolt.DB, deviceid string, policyName string, retryCount int, cause string, agid string) (*WorkloadUsage, error) {
+	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, WU_REASON_RETRY_COUNT, func(w WorkloadUsage) *WorkloadUsage {
+		w.setRetryCount(retryCount, cause, agid)
 		return &w
 	}); err != nil {
 		return nil, err
@@ -113,13 +210,8 @@ func UpdateRetryCount(db *bolt.DB, deviceid string, policyName string, retryCoun
 }
 
 func UpdatePriority(db *bolt.DB, deviceid string, policyName string, priority int, retryDurationS int, verifiedDurationS int, agid string) (*WorkloadUsage, error) {
-	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, func(w WorkloadUsage) *WorkloadUsage {
-		w.CurrentAgreementId = agid
-		w.Priority = priority
-		w.RetryCount = 0
-		w.RetryDurationS = retryDurationS
-		w.VerifiedDurationS = verifiedDurationS
-		w.FirstTryTime = uint64(time.Now().Unix())
+	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, WU_REASON_PRIORITY, func(w WorkloadUsage) *WorkloadUsage {
+		w.setPriority(priority, retryDurationS, verifiedDurationS, agid)
 		return &w
 	}); err != nil {
 		return nil, err
@@ -129,7 +221,7 @@ func UpdatePriority(db *bolt.DB, deviceid string, policyName string, priority in
 }
 
 func UpdatePendingUpgrade(db *bolt.DB, deviceid string, policyName string) (*WorkloadUsage, error) {
-	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, func(w WorkloadUsage) *WorkloadUsage {
+	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, WU_REASON_PENDING_UPGRADE, func(w WorkloadUsage) *WorkloadUsage {
 		w.PendingUpgradeTime = uint64(time.Now().Unix())
 		return &w
 	}); err != nil {
@@ -140,7 +232,7 @@ func UpdatePendingUpgrade(db *bolt.DB, deviceid string, policyName string) (*Wor
 }
 
 func UpdateWUAgreementId(db *bolt.DB, deviceid string, policyName string, agid string) (*WorkloadUsage, error) {
-	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, func(w WorkloadUsage) *WorkloadUsage {
+	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, WU_REASON_AGREEMENT_ID, func(w WorkloadUsage) *WorkloadUsage {
 		w.CurrentAgreementId = agid
 		return &w
 	}); err != nil {
@@ -150,10 +242,53 @@ func UpdateWUAgreementId(db *bolt.DB, deviceid string, policyName string, agid s
 	}
 }
 
+// Clear the agreement id of the workload usage and remember why the agreement ended, so that the next retry is charged
+// to the right cause.
+func EndWUAgreement(db *bolt.DB, deviceid string, policyName string, cause string) (*WorkloadUsage, error) {
+	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, WU_REASON_AGREEMENT_ENDED, func(w WorkloadUsage) *WorkloadUsage {
+		w.CurrentAgreementId = ""
+		w.PendingRetryCause = cause
+		return &w
+	}); err != nil {
+		return nil, err
+	} else {
+		return wlUsage, nil
+	}
+}
+
+// Count an agreement that was cancelled before it was finalized. Once maxFailures agreements have failed, the record is
+// marked exhausted so that no more agreements are made for the device and policy. A zero maxFailures means no limit.
+func RecordWUFailure(db *bolt.DB, deviceid string, policyName string, maxFailures int) (*WorkloadUsage, error) {
+	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, WU_REASON_AGREEMENT_FAILED, func(w WorkloadUsage) *WorkloadUsage {
+		w.FailureCount++
+		if maxFailures > 0 && w.FailureCount >= maxFailures {
+			w.Exhausted = true
+		}
+		return &w
+	}); err != nil {
+		return nil, err
+	} else {
+		return wlUsage, nil
+	}
+}
+
+// Clear the exhausted flag and the failure count, so that agreements are made for the device and policy again.
+func ResetWUExhausted(db *bolt.DB, deviceid string, policyName string) (*WorkloadUsage, error) {
+	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, WU_REASON_EXHAUSTED_RESET, func(w WorkloadUsage) *WorkloadUsage {
+		w.FailureCount = 0
+		w.Exhausted = false
+		return &w
+	}); err != nil {
+		return nil, err
+	} else {
+		return wlUsage, nil
+	}
+}
+
 func DisableRollbackChecking(db *bolt.DB, deviceid string, policyName string) (*WorkloadUsage, error) {
-	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, func(w WorkloadUsage) *WorkloadUsage {
+	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, WU_REASON_ROLLBACK_DISABLED, func(w WorkloadUsage) *WorkloadUsage {
 		w.DisableRetry = true
-		w.RetryCount = 0
+		w.resetRetries()
 		return &w
 	}); err != nil {
 		return nil, err
@@ -163,7 +298,7 @@ func DisableRollbackChecking(db *bolt.DB, deviceid string, policyName string) (*
 }
 
 func UpdatePolicy(db *bolt.DB, deviceid string, policyName string, pol string) (*WorkloadUsage, error) {
-	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, func(w WorkloadUsage) *WorkloadUsage {
+	if wlUsage, err := singleWorkloadUsageUpdate(db, deviceid, policyName, WU_REASON_POLICY, func(w WorkloadUsage) *WorkloadUsage {
 		w.Policy = pol
 		return &w
 	}); err != nil {
@@ -188,14 +323,19 @@ func FindSingleWorkloadUsageByDeviceAndPolicyName(db *bolt.DB, deviceid string,
 	}
 }
 
-func singleWorkloadUsageUpdate(db *bolt.DB, deviceid string, policyName string, fn func(WorkloadUsage) *WorkloadUsage) (*WorkloadUsage, error) {
+// The reason is the kind of update, it is recorded in the workload usage metrics when the update succeeds.
+func singleWorkloadUsageUpdate(db *bolt.DB, deviceid string, policyName string, reason string, fn func(WorkloadUsage) *WorkloadUsage) (*WorkloadUsage, error) {
 	if wlUsage, err := FindSingleWorkloadUsageByDeviceAndPolicyName(db, deviceid, policyName); err != nil {
 		return nil, err
 	} else if wlUsage == nil {
 		return nil, fmt.Errorf("Unable to locate workload usage for device: %v, and policy: %v", deviceid, policyName)
 	} else {
 		updated := fn(*wlUsage)
-		return updated, persistUpdatedWorkloadUsage(db, wlUsage.Id, updated)
+		if err := persistUpdatedWorkloadUsage(db, wlUsage.Id, updated); err != nil {
+			return updated, err
+		}
+		WUMetrics.Record(deviceid, policyName, WU_OP_UPDATE, reason)
+		return updated, nil
 	}
 }
 
@@ -218,6 +358,11 @@ func persistUpdatedWorkloadUsage(db *bolt.DB, id uint64, update *WorkloadUsage)
 				// write updates only to the fields we expect should be updateable
 				mod.Priority = update.Priority
 				mod.RetryCount = update.RetryCount
+				mod.DeviceRetries = update.DeviceRetries
+				mod.ReqsNotMetRetries = update.ReqsNotMetRetries
+				mod.AgbotRetries = update.AgbotRetries
+				mod.UnknownRetries = update.UnknownRetries
+				mod.PendingRetryCause = update.PendingRetryCause
 				mod.RetryDurationS = update.RetryDurationS
 				// This field goes from empty to non-empty to empty, ad infinitum
 				if (mod.CurrentAgreementId == "" && update.CurrentAgreementId != "") || (mod.CurrentAgreementId != "" && update.CurrentAgreementId == "") {
@@ -242,6 +387,8 @@ func persistUpdatedWorkloadUsage(db *bolt.DB, id uint64, update *WorkloadUsage)
 					mod.Policy = update.Policy
 				}
 				mod.VerifiedDurationS = update.VerifiedDurationS
+				mod.FailureCount = update.FailureCount
+				mod.Exhausted = update.Exhausted
 
 				if serialized, err := json.Marshal(mod); err != nil {
 					return fmt.Errorf("Failed to serialize workload usage record: %v", mod)
@@ -256,7 +403,9 @@ func persistUpdatedWorkloadUsage(db *bolt.DB, id uint64, update *WorkloadUsage)
 	})
 }
 
-func DeleteWorkloadUsage(db *bolt.DB, deviceid string, policyName string) error {
+// Delete the workload usage record of the device and policy. The reason is one of the WU_REASON_ constants, it is recorded
+// in the workload usage metrics when the record is deleted.
+func DeleteWorkloadUsage(db *bolt.DB, deviceid string, policyName string, reason string) error {
 	if deviceid == "" || policyName == "" {
 		return fmt.Errorf("Missing required arg deviceid or policyName")
 	} else {
@@ -268,7 +417,8 @@ func DeleteWorkloadUsage(db *bolt.DB, deviceid string, policyName string) error
 		} else {
 
 			pk := wlUsage.Id
-			return db.Update(func(tx *bolt.Tx) error {
+			deleted := false
+			err := db.Update(func(tx *bolt.Tx) error {
 				b := tx.Bucket([]byte(wuBucketName()))
 				if b == nil {
 					return fmt.Errorf("Unknown bucket: %v", wuBucketName())
@@ -283,9 +433,14 @@ func DeleteWorkloadUsage(db *bolt.DB, deviceid string, policyName string) error
 					}
 				}
 
-				glog.V(3).Infof("Deleting workload usage record for %v with policy %v", deviceid, policyName)
+				glog.V(3).Infof("Deleting workload usage record for %v with policy %v, reason %v", deviceid, policyName, reason)
+				deleted = true
 				return b.Delete([]byte(strconv.FormatUint(pk, 10)))
 			})
+			if err == nil && deleted {
+				WUMetrics.Record(deviceid, policyName, WU_OP_DELETE, reason)
+			}
+			return err
 		}
 	}
 }
@@ -302,8 +457,28 @@ func PWUFilter(policyName string) WUFilter {
 	return func(a WorkloadUsage) bool { return a.PolicyName == policyName }
 }
 
+func ExhaustedWUFilter() WUFilter {
+	return func(a WorkloadUsage) bool { return a.Exhausted }
+}
+
 type WUFilter func(WorkloadUsage) bool
 
+// Returns all the workload usage records for a device, optionally restricted to a single policy. An empty policyName
+// returns the records for all policies. The records are sorted by policy name.
+func FindWorkloadUsagesForDevice(db *bolt.DB, deviceid string, policyName string) ([]WorkloadUsage, error) {
+	filters := []WUFilter{DWUFilter(deviceid)}
+	if policyName != "" {
+		filters = append(filters, PWUFilter(policyName))
+	}
+
+	if wlUsages, err := FindWorkloadUsages(db, filters); err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to find workload usages for device %v, error: %v", deviceid, err))
+	} else {
+		sort.Slice(wlUsages, func(i, j int) bool { return wlUsages[i].PolicyName < wlUsages[j].PolicyName })
+		return wlUsages, nil
+	}
+}
+
 func FindWorkloadUsages(db *bolt.DB, filters []WUFilter) ([]WorkloadUsage, error) {
 	wlUsages := make([]WorkloadUsage, 0)
 
@@ -67,7 +67,7 @@ func Test_SaveNewRecord2(t *testing.T) {
 		t.Errorf("Record received on read does not have the right priority, expecting 1, was %v", wlu.Priority)
 	}
 
-	if err := DeleteWorkloadUsage(testDb, deviceid, pName); err != nil {
+	if err := DeleteWorkloadUsage(testDb, deviceid, pName, WU_REASON_AGREEMENT_CANCELLED); err != nil {
 		t.Errorf("Received error deleting workload usage: %v", err)
 	} else if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(testDb, deviceid, pName); err != nil {
 		t.Errorf("Received error finding new record: %v", err)
@@ -76,3 +76,88 @@ func Test_SaveNewRecord2(t *testing.T) {
 	}
 
 }
+
+func Test_FindWorkloadUsagesForDevice(t *testing.T) {
+
+	deviceid := "an99999"
+
+	if err := NewWorkloadUsage(testDb, deviceid, []string{}, "{some json serialized policy file}", "policy b", 1, 30, 180, false, "AG3"); err != nil {
+		t.Errorf("Received error creating new workload usage: %v", err)
+	} else if err := NewWorkloadUsage(testDb, deviceid, []string{}, "{some json serialized policy file}", "policy a", 2, 30, 180, true, "AG4"); err != nil {
+		t.Errorf("Received error creating new workload usage: %v", err)
+	}
+
+	if wlus, err := FindWorkloadUsagesForDevice(testDb, deviceid, ""); err != nil {
+		t.Errorf("Received error finding workload usages: %v", err)
+	} else if len(wlus) != 2 || wlus[0].PolicyName != "policy a" || wlus[1].PolicyName != "policy b" {
+		t.Errorf("Expected 2 records sorted by policy name, got %v", wlus)
+	}
+
+	if wlus, err := FindWorkloadUsagesForDevice(testDb, deviceid, "policy b"); err != nil {
+		t.Errorf("Received error finding workload usages: %v", err)
+	} else if len(wlus) != 1 || wlus[0].Priority != 1 {
+		t.Errorf("Expected 1 record for policy b, got %v", wlus)
+	}
+
+	if wlus, err := FindWorkloadUsagesForDevice(testDb, "an00000", ""); err != nil {
+		t.Errorf("Received error finding workload usages: %v", err)
+	} else if len(wlus) != 0 {
+		t.Errorf("Expected no records, got %v", wlus)
+	}
+}
+
+func Test_UpdateRetryCountByCause(t *testing.T) {
+
+	deviceid := "an77777"
+	policyName := "policy c"
+
+	if err := NewWorkloadUsage(testDb, deviceid, []string{}, "{some json serialized policy file}", policyName, 1, 3600, 180, false, "AG5"); err != nil {
+		t.Errorf("Received error creating new workload usage: %v", err)
+	} else if _, err := EndWUAgreement(testDb, deviceid, policyName, WU_RETRY_AGBOT); err != nil {
+		t.Errorf("Received error ending agreement: %v", err)
+	} else if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(testDb, deviceid, policyName); err != nil {
+		t.Errorf("Received error finding workload usage: %v", err)
+	} else if wlu.CurrentAgreementId != "" || wlu.NextRetryCause() != WU_RETRY_AGBOT {
+		t.Errorf("Expected the agreement to be cleared and an agbot retry pending, got %v", wlu)
+	} else if _, err := UpdateRetryCount(testDb, deviceid, policyName, wlu.NextRetryCount(wlu.NextRetryCause()), wlu.NextRetryCause(), "AG6"); err != nil {
+		t.Errorf("Received error updating retry count: %v", err)
+	} else if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(testDb, deviceid, policyName); err != nil {
+		t.Errorf("Received error finding workload usage: %v", err)
+	} else if wlu.RetryCount != 0 || wlu.AgbotRetries != 1 || wlu.DeviceRetries != 0 || wlu.PendingRetryCause != "" {
+		t.Errorf("Expected an agbot retry outside of the retry budget, got %v", wlu)
+	} else if _, err := EndWUAgreement(testDb, deviceid, policyName, WU_RETRY_DEVICE); err != nil {
+		t.Errorf("Received error ending agreement: %v", err)
+	} else if _, err := UpdateRetryCount(testDb, deviceid, policyName, 1, WU_RETRY_DEVICE, "AG7"); err != nil {
+		t.Errorf("Received error updating retry count: %v", err)
+	} else if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(testDb, deviceid, policyName); err != nil {
+		t.Errorf("Received error finding workload usage: %v", err)
+	} else if wlu.RetryCount != 1 || wlu.AgbotRetries != 1 || wlu.DeviceRetries != 1 {
+		t.Errorf("Expected a device retry within the retry budget, got %v", wlu)
+	}
+}
+
+func Test_RecordWUFailure(t *testing.T) {
+
+	deviceid := "an88888"
+	policyName := "policy d"
+
+	if err := NewWorkloadUsage(testDb, deviceid, []string{}, "{some json serialized policy file}", policyName, 1, 3600, 180, false, "AG8"); err != nil {
+		t.Errorf("Received error creating new workload usage: %v", err)
+	} else if wlu, err := RecordWUFailure(testDb, deviceid, policyName, 2); err != nil {
+		t.Errorf("Received error recording failure: %v", err)
+	} else if wlu.FailureCount != 1 || wlu.Exhausted {
+		t.Errorf("Expected 1 failure without exhaustion, got %v", wlu)
+	} else if _, err := RecordWUFailure(testDb, deviceid, policyName, 2); err != nil {
+		t.Errorf("Received error recording failure: %v", err)
+	} else if wlus, err := FindWorkloadUsages(testDb, []WUFilter{DWUFilter(deviceid), ExhaustedWUFilter()}); err != nil {
+		t.Errorf("Received error finding workload usages: %v", err)
+	} else if len(wlus) != 1 || wlus[0].DeviceId != deviceid || wlus[0].FailureCount != 2 {
+		t.Errorf("Expected the record to be exhausted after 2 failures, got %v", wlus)
+	} else if _, err := ResetWUExhausted(testDb, deviceid, policyName); err != nil {
+		t.Errorf("Received error resetting workload usage: %v", err)
+	} else if wlu, err := FindSingleWorkloadUsageByDeviceAndPolicyName(testDb, deviceid, policyName); err != nil {
+		t.Errorf("Received error finding workload usage: %v", err)
+	} else if wlu.FailureCount != 0 || wlu.Exhausted {
+		t.Errorf("Expected the failures to be reset, got %v", wlu)
+	}
+}
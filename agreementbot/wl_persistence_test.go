@@ -0,0 +1,41 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"testing"
+)
+
+func Test_MinVerifiedDuration(t *testing.T) {
+
+	if d := MinVerifiedDuration("myorg/dev1", "mypolicy", 30, 0); d != 30 {
+		t.Errorf("expected the floor to be disabled, got %v", d)
+	} else if d := MinVerifiedDuration("myorg/dev1", "mypolicy", 30, 120); d != 120 {
+		t.Errorf("expected the verified duration to be raised to 120, got %v", d)
+	} else if d := MinVerifiedDuration("myorg/dev1", "mypolicy", 0, 120); d != 120 {
+		t.Errorf("expected an unset verified duration to be raised to 120, got %v", d)
+	} else if d := MinVerifiedDuration("myorg/dev1", "mypolicy", 300, 120); d != 300 {
+		t.Errorf("expected the verified duration to be unchanged, got %v", d)
+	}
+}
+
+func Test_NextRetryCount(t *testing.T) {
+
+	w := WorkloadUsage{RetryCount: 2}
+	if c := w.NextRetryCause(); c != WU_RETRY_DEVICE {
+		t.Errorf("expected a record without a pending cause to be charged to the device, got %v", c)
+	} else if n := w.NextRetryCount(WU_RETRY_DEVICE); n != 3 {
+		t.Errorf("expected a device retry to use up the budget, got %v", n)
+	} else if n := w.NextRetryCount(WU_RETRY_REQS_NOT_MET); n != 3 {
+		t.Errorf("expected a requirements retry to use up the budget, got %v", n)
+	} else if n := w.NextRetryCount(WU_RETRY_AGBOT); n != 2 {
+		t.Errorf("expected an agbot retry to leave the budget alone, got %v", n)
+	} else if n := w.NextRetryCount(WU_RETRY_UNKNOWN); n != 3 {
+		t.Errorf("expected a retry of unknown cause to use up the budget, got %v", n)
+	}
+
+	w.PendingRetryCause = WU_RETRY_AGBOT
+	if c := w.NextRetryCause(); c != WU_RETRY_AGBOT {
+		t.Errorf("expected the pending cause, got %v", c)
+	}
+}
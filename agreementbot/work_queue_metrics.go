@@ -0,0 +1,169 @@
+package agreementbot
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The overall health of the agreement workers.
+const (
+	WORK_HEALTH_OK       = "ok"
+	WORK_HEALTH_DEGRADED = "degraded"
+)
+
+// The state of the work queue of a protocol's agreement workers. An item that is being sent to a full or unbuffered
+// queue counts as queued, so the depth also shows work that is waiting for a worker when the queue has no buffer.
+type WorkQueueStatus struct {
+	Protocol   string   `json:"protocol"`
+	Depth      int      `json:"depth"`             // the work items sent to the queue that no worker has received yet
+	Workers    int      `json:"workers"`           // the running agreement workers
+	Busy       int      `json:"busy"`              // the workers that are working on an item
+	OldestAgeS int64    `json:"oldest_age_s"`      // the number of seconds since the oldest queued item was sent, zero when nothing is queued
+	Locks      int      `json:"locks"`             // the agreement locks that are held or waited for
+	Degraded   bool     `json:"degraded"`          // true if the depth or the age of the oldest item is above its configured threshold
+	Reasons    []string `json:"reasons,omitempty"` // why the queue is degraded
+}
+
+func (s WorkQueueStatus) String() string {
+	return fmt.Sprintf("Protocol: %v, Depth: %v, Workers: %v, Busy: %v, OldestAgeS: %v, Locks: %v, Degraded: %v, Reasons: %v", s.Protocol, s.Depth, s.Workers, s.Busy, s.OldestAgeS, s.Locks, s.Degraded, s.Reasons)
+}
+
+// Whether the agreement workers are keeping up with their work.
+type AgreementWorkHealth struct {
+	Status              string                   `json:"status"`               // WORK_HEALTH_DEGRADED if any queue is degraded or the agbot is paused, otherwise WORK_HEALTH_OK
+	Queues              []WorkQueueStatus        `json:"queues"`               // the work queue of each protocol, sorted by protocol
+	ExchangeCredentials ExchangeCredentialStatus `json:"exchange_credentials"` // whether the agbot is paused because the exchange rejects its credentials
+}
+
+type workQueueState struct {
+	sent    []time.Time // the times the queued items were sent, oldest first
+	workers int
+	busy    int
+	alm     *AgreementLockManager // the agreement lock manager shared by the workers, nil if it is not tracked
+}
+
+// Tracks the work queues of the agreement workers of each protocol. It is safe for concurrent use.
+type WorkQueueMetrics struct {
+	lock   sync.Mutex
+	queues map[string]*workQueueState
+}
+
+func NewWorkQueueMetrics() *WorkQueueMetrics {
+	return &WorkQueueMetrics{queues: make(map[string]*workQueueState)}
+}
+
+// The work queue metrics of this process. Work sent with queueWork and received by the agreement workers is recorded
+// into it.
+var WQMetrics = NewWorkQueueMetrics()
+
+// Send a work item to the agreement workers of the protocol handler, recording it as queued until a worker receives it.
+func queueWork(cph ConsumerProtocolHandler, work AgreementWork) {
+	WQMetrics.Sending(cph.Name(), time.Now())
+	cph.WorkQueue() <- work
+}
+
+// The caller must hold the lock.
+func (m *WorkQueueMetrics) queue(protocol string) *workQueueState {
+	q, ok := m.queues[protocol]
+	if !ok {
+		q = &workQueueState{sent: make([]time.Time, 0, 10)}
+		m.queues[protocol] = q
+	}
+	return q
+}
+
+// Record that a work item is being sent to the work queue of the protocol.
+func (m *WorkQueueMetrics) Sending(protocol string, now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	q := m.queue(protocol)
+	q.sent = append(q.sent, now)
+}
+
+// Record that a worker received a work item from the work queue of the protocol. The queue is FIFO, so the received
+// item is the oldest one.
+func (m *WorkQueueMetrics) Received(protocol string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	q := m.queue(protocol)
+	if len(q.sent) != 0 {
+		q.sent = q.sent[1:]
+	}
+	q.busy += 1
+}
+
+// Record that a worker finished the work item it received.
+func (m *WorkQueueMetrics) Done(protocol string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if q := m.queue(protocol); q.busy > 0 {
+		q.busy -= 1
+	}
+}
+
+// Record that an agreement worker of the protocol started.
+func (m *WorkQueueMetrics) WorkerStarted(protocol string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.queue(protocol).workers += 1
+}
+
+// Record that an agreement worker of the protocol exited.
+func (m *WorkQueueMetrics) WorkerStopped(protocol string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if q := m.queue(protocol); q.workers > 0 {
+		q.workers -= 1
+	}
+}
+
+// Track the agreement locks of the protocol's workers, so that the number of locks in use is part of the queue state.
+func (m *WorkQueueMetrics) TrackLocks(protocol string, alm *AgreementLockManager) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.queue(protocol).alm = alm
+}
+
+// Returns the agreement lock manager tracked for the protocol, nil if none is tracked. Changes to agreements made outside
+// of the agreement workers and governance, e.g. by the API, take the agreement lock from it.
+func (m *WorkQueueMetrics) AgreementLocks(protocol string) *AgreementLockManager {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if q, ok := m.queues[protocol]; ok {
+		return q.alm
+	}
+	return nil
+}
+
+// Returns the state of each work queue. A queue is degraded when more than maxDepth items are queued, or when the
+// oldest item has been queued for more than maxAgeS seconds. A threshold of zero is not checked.
+func (m *WorkQueueMetrics) Health(maxDepth int, maxAgeS int, now time.Time) AgreementWorkHealth {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	health := AgreementWorkHealth{Status: WORK_HEALTH_OK, Queues: make([]WorkQueueStatus, 0, len(m.queues))}
+	for protocol, q := range m.queues {
+		s := WorkQueueStatus{Protocol: protocol, Depth: len(q.sent), Workers: q.workers, Busy: q.busy}
+		if len(q.sent) != 0 {
+			s.OldestAgeS = int64(now.Sub(q.sent[0]) / time.Second)
+		}
+		if q.alm != nil {
+			s.Locks = q.alm.LockCount()
+		}
+		if maxDepth > 0 && s.Depth > maxDepth {
+			s.Reasons = append(s.Reasons, fmt.Sprintf("%v work items are queued, more than %v", s.Depth, maxDepth))
+		}
+		if maxAgeS > 0 && s.OldestAgeS > int64(maxAgeS) {
+			s.Reasons = append(s.Reasons, fmt.Sprintf("the oldest work item has been queued for %v seconds, more than %v", s.OldestAgeS, maxAgeS))
+		}
+		if len(s.Reasons) != 0 {
+			s.Degraded = true
+			health.Status = WORK_HEALTH_DEGRADED
+		}
+		health.Queues = append(health.Queues, s)
+	}
+	sort.Slice(health.Queues, func(i, j int) bool { return health.Queues[i].Protocol < health.Queues[j].Protocol })
+	return health
+}
@@ -0,0 +1,104 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_WorkQueueMetrics_depth(t *testing.T) {
+
+	m := NewWorkQueueMetrics()
+	start := time.Unix(1500000000, 0)
+
+	if h := m.Health(0, 0, start); h.Status != WORK_HEALTH_OK || len(h.Queues) != 0 {
+		t.Errorf("expected an ok status without queues, got %v", h)
+	}
+
+	m.WorkerStarted("Basic")
+	m.WorkerStarted("Citizen Scientist")
+	m.WorkerStarted("Citizen Scientist")
+	m.Sending("Citizen Scientist", start)
+	m.Sending("Citizen Scientist", start.Add(10*time.Second))
+	m.Sending("Citizen Scientist", start.Add(20*time.Second))
+
+	h := m.Health(0, 0, start.Add(30*time.Second))
+	if h.Status != WORK_HEALTH_OK || len(h.Queues) != 2 {
+		t.Fatalf("expected an ok status with 2 queues, got %v", h)
+	} else if b := h.Queues[0]; b.Protocol != "Basic" || b.Depth != 0 || b.Workers != 1 || b.OldestAgeS != 0 {
+		t.Errorf("expected an empty Basic queue with 1 worker, got %v", b)
+	} else if cs := h.Queues[1]; cs.Depth != 3 || cs.Workers != 2 || cs.Busy != 0 || cs.OldestAgeS != 30 || cs.Degraded {
+		t.Errorf("expected 3 queued items, the oldest 30 seconds old, got %v", cs)
+	}
+
+	// Receiving takes the oldest item off the queue and makes a worker busy.
+	m.Received("Citizen Scientist")
+	m.Received("Citizen Scientist")
+	h = m.Health(0, 0, start.Add(30*time.Second))
+	if cs := h.Queues[1]; cs.Depth != 1 || cs.Busy != 2 || cs.OldestAgeS != 10 {
+		t.Errorf("expected 1 queued item, 10 seconds old, and 2 busy workers, got %v", cs)
+	}
+
+	m.Done("Citizen Scientist")
+	m.Received("Citizen Scientist")
+	m.Done("Citizen Scientist")
+	m.WorkerStopped("Citizen Scientist")
+	h = m.Health(0, 0, start.Add(30*time.Second))
+	if cs := h.Queues[1]; cs.Depth != 0 || cs.Busy != 1 || cs.Workers != 1 || cs.OldestAgeS != 0 {
+		t.Errorf("expected an empty queue with 1 busy worker, got %v", cs)
+	}
+}
+
+func Test_WorkQueueMetrics_degraded(t *testing.T) {
+
+	m := NewWorkQueueMetrics()
+	start := time.Unix(1500000000, 0)
+	m.WorkerStarted("Basic")
+	for i := 0; i < 5; i++ {
+		m.Sending("Basic", start)
+	}
+
+	// At the thresholds is not degraded.
+	if h := m.Health(5, 60, start.Add(60*time.Second)); h.Status != WORK_HEALTH_OK || h.Queues[0].Degraded {
+		t.Errorf("expected an ok status at the thresholds, got %v", h)
+	}
+
+	if h := m.Health(4, 0, start); h.Status != WORK_HEALTH_DEGRADED || !h.Queues[0].Degraded || len(h.Queues[0].Reasons) != 1 {
+		t.Errorf("expected the depth to degrade the queue, got %v", h)
+	}
+
+	if h := m.Health(0, 59, start.Add(60*time.Second)); h.Status != WORK_HEALTH_DEGRADED || len(h.Queues[0].Reasons) != 1 {
+		t.Errorf("expected the age to degrade the queue, got %v", h)
+	}
+
+	if h := m.Health(4, 59, start.Add(60*time.Second)); h.Status != WORK_HEALTH_DEGRADED || len(h.Queues[0].Reasons) != 2 {
+		t.Errorf("expected the depth and the age to degrade the queue, got %v", h)
+	}
+
+	// Zero thresholds are not checked.
+	if h := m.Health(0, 0, start.Add(time.Hour)); h.Status != WORK_HEALTH_OK {
+		t.Errorf("expected an ok status without thresholds, got %v", h)
+	}
+}
+
+func Test_WorkQueueMetrics_locks(t *testing.T) {
+
+	m := NewWorkQueueMetrics()
+	alm := NewAgreementLockManager()
+	m.TrackLocks("Basic", alm)
+	if m.AgreementLocks("Basic") != alm || m.AgreementLocks("Citizen Scientist") != nil {
+		t.Errorf("expected only the Basic agreement locks to be tracked")
+	}
+
+	alock := alm.getAgreementLock("abc")
+	alock.Lock()
+	if h := m.Health(0, 0, time.Now()); len(h.Queues) != 1 || h.Queues[0].Locks != 1 {
+		t.Errorf("expected 1 agreement lock in use, got %v", h)
+	}
+
+	alock.Unlock()
+	if h := m.Health(0, 0, time.Now()); h.Queues[0].Locks != 0 {
+		t.Errorf("expected no agreement locks in use, got %v", h)
+	}
+}
@@ -0,0 +1,133 @@
+package agreementbot
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/config"
+	"sync"
+	"time"
+)
+
+// The number of seconds an extra agreement worker waits for work before it retires.
+const AGREEMENT_WORKER_IDLE_S = 60
+
+// The number of seconds between checks of the work queue depth.
+const AGREEMENT_WORKER_POOL_CHECK_S = 1
+
+// The number of queued work items allowed per worker, when the worker pool can grow.
+const AGREEMENT_WORK_QUEUE_PER_WORKER = 10
+
+// An AgreementWorkerPool grows the agreement workers of a protocol between a minimum and a maximum based on the depth
+// of the protocol's work queue. When work is queued, an additional worker is started (up to the maximum). Workers above
+// the minimum retire after being idle for AGREEMENT_WORKER_IDLE_S seconds. Workers only retire between work items, so
+// they never hold an agreement lock when they exit, and all the workers of a protocol share one AgreementLockManager.
+type AgreementWorkerPool struct {
+	name  string
+	min   int
+	max   int
+	work  chan AgreementWork
+	spawn func()
+	check time.Duration // the interval between checks of the work queue depth
+	lock  sync.Mutex
+	size  int
+}
+
+// Returns true if the config asks for a worker pool that can grow beyond AgreementWorkers.
+func DynamicAgreementWorkers(cfg *config.HorizonConfig) bool {
+	return cfg.AgreementBot.MaxAgreementWorkers > cfg.AgreementBot.AgreementWorkers
+}
+
+// Create the work queue for a protocol handler. The queue is unbuffered for a fixed size worker pool. When the pool can
+// grow, the queue is buffered so that its depth can be observed.
+func NewAgreementWorkQueue(cfg *config.HorizonConfig) chan AgreementWork {
+	if DynamicAgreementWorkers(cfg) {
+		return make(chan AgreementWork, cfg.AgreementBot.MaxAgreementWorkers*AGREEMENT_WORK_QUEUE_PER_WORKER)
+	}
+	return make(chan AgreementWork)
+}
+
+// Create a worker pool. The spawn function must start a new worker goroutine that reads from the work queue using
+// the pool's NextWork function.
+func NewAgreementWorkerPool(name string, min int, max int, work chan AgreementWork, spawn func()) *AgreementWorkerPool {
+	return &AgreementWorkerPool{
+		name:  name,
+		min:   min,
+		max:   max,
+		work:  work,
+		spawn: spawn,
+		check: AGREEMENT_WORKER_POOL_CHECK_S * time.Second,
+	}
+}
+
+func (p *AgreementWorkerPool) String() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return fmt.Sprintf("Name: %v, Min: %v, Max: %v, Size: %v, Queued: %v", p.name, p.min, p.max, p.size, len(p.work))
+}
+
+// Start the minimum number of workers and the goroutine that grows the pool when work backs up. The goroutine exits
+// when the done channel is closed, so that no workers are started once the agbot is shutting down.
+func (p *AgreementWorkerPool) Start(done <-chan struct{}) {
+	for ix := 0; ix < p.min; ix++ {
+		p.grow()
+	}
+
+	go func() {
+		ticker := time.NewTicker(p.check)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				glog.V(3).Infof(AWlogString(fmt.Sprintf("stopped growing the agreement worker pool %v", p)))
+				return
+			case <-ticker.C:
+				if len(p.work) > 0 && p.grow() {
+					glog.V(3).Infof(AWlogString(fmt.Sprintf("started an additional agreement worker, pool %v", p)))
+				}
+			}
+		}
+	}()
+}
+
+// Start a new worker if the pool is below its maximum size. Returns true if a worker was started.
+func (p *AgreementWorkerPool) grow() bool {
+	p.lock.Lock()
+	if p.size >= p.max {
+		p.lock.Unlock()
+		return false
+	}
+	p.size += 1
+	p.lock.Unlock()
+
+	p.spawn()
+	return true
+}
+
+// Returns true if the calling worker should exit, i.e. the pool is above its minimum size.
+func (p *AgreementWorkerPool) retire() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.size > p.min {
+		p.size -= 1
+		return true
+	}
+	return false
+}
+
+// Block until there is work for the calling worker. The second return value is false when the worker has been idle
+// long enough to retire and should exit.
+func (p *AgreementWorkerPool) NextWork() (AgreementWork, bool) {
+	for {
+		timer := time.NewTimer(AGREEMENT_WORKER_IDLE_S * time.Second)
+		select {
+		case workItem := <-p.work:
+			timer.Stop()
+			return workItem, true
+		case <-timer.C:
+			if p.retire() {
+				glog.V(3).Infof(AWlogString(fmt.Sprintf("retiring idle agreement worker, pool %v", p)))
+				return nil, false
+			}
+		}
+	}
+}
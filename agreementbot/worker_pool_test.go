@@ -0,0 +1,63 @@
+// +build unit
+
+package agreementbot
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_AgreementWorkerPool_grow_and_retire(t *testing.T) {
+
+	work := make(chan AgreementWork, 10)
+	started := make(chan bool, 10)
+
+	pool := NewAgreementWorkerPool("test", 1, 2, work, func() { started <- true })
+	pool.check = 10 * time.Millisecond
+	done := make(chan struct{})
+	defer close(done)
+	pool.Start(done)
+
+	if len(started) != 1 {
+		t.Errorf("pool should start the minimum number of workers, started %v", len(started))
+	}
+
+	// Queue work so that the pool grows to its maximum.
+	work <- InitiateAgreement{workType: INITIATE}
+	time.Sleep(pool.check * 5)
+	if len(started) != 2 {
+		t.Errorf("pool should have grown to the maximum number of workers, started %v", len(started))
+	}
+
+	// The pool does not grow beyond the maximum.
+	if pool.grow() {
+		t.Errorf("pool should not grow beyond the maximum: %v", pool)
+	}
+
+	// Only workers above the minimum retire.
+	if !pool.retire() {
+		t.Errorf("worker above the minimum should retire: %v", pool)
+	} else if pool.retire() {
+		t.Errorf("worker at the minimum should not retire: %v", pool)
+	}
+}
+
+func Test_AgreementWorkerPool_stop(t *testing.T) {
+
+	work := make(chan AgreementWork, 10)
+	started := make(chan bool, 10)
+
+	pool := NewAgreementWorkerPool("test", 1, 2, work, func() { started <- true })
+	pool.check = 10 * time.Millisecond
+	done := make(chan struct{})
+	pool.Start(done)
+
+	// Once the pool is stopped, queued work does not start additional workers.
+	close(done)
+	time.Sleep(pool.check * 2)
+	work <- InitiateAgreement{workType: INITIATE}
+	time.Sleep(pool.check * 5)
+	if len(started) != 1 {
+		t.Errorf("stopped pool should not grow, started %v", len(started))
+	}
+}
@@ -5,7 +5,11 @@ import (
 	"net/http"
 
 	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/open-horizon/anax/ethblockchain"
+	"github.com/open-horizon/anax/events"
 	"github.com/open-horizon/anax/policy"
+	"github.com/open-horizon/anax/torrent"
 )
 
 func (a *API) status(w http.ResponseWriter, r *http.Request) {
@@ -18,6 +22,18 @@ func (a *API) status(w http.ResponseWriter, r *http.Request) {
 			glog.Errorf(apiLogString(fmt.Sprintf("Unable to get connectivity status: %v", err)))
 		}
 
+		if a.Config.Collaborators.HTTPClientFactory != nil && a.Config.Collaborators.HTTPClientFactory.ExchangeBreaker != nil {
+			info.ExchangeBreaker = a.Config.Collaborators.HTTPClientFactory.ExchangeBreaker.Status()
+		}
+
+		if pulls := torrent.PullMetrics.Snapshot(); len(pulls) != 0 {
+			info.ImagePulls = pulls
+		}
+
+		if bcs := ethblockchain.BCStatus.Snapshot(); len(bcs) != 0 {
+			info.Blockchains = bcs
+		}
+
 		a.bcStateLock.Lock()
 		defer a.bcStateLock.Unlock()
 
@@ -40,3 +56,35 @@ func (a *API) status(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
+
+// Re-trigger the funding of a blockchain client whose account is stuck unfunded. The blockchain worker checks the funding
+// again and restarts the client if it is still unfunded, at most once per BlockchainRefundIntervalS.
+func (a *API) blockchainRefund(w http.ResponseWriter, r *http.Request) {
+
+	resource := "status/blockchain"
+	errorhandler := GetHTTPErrorHandler(w)
+
+	switch r.Method {
+	case "POST":
+		glog.V(5).Infof(apiLogString(fmt.Sprintf("Handling %v on resource %v", r.Method, resource)))
+		name := mux.Vars(r)["name"]
+
+		a.bcStateLock.Lock()
+		_, ok := a.bcState[policy.Ethereum_bc][name]
+		a.bcStateLock.Unlock()
+
+		if !ok {
+			errorhandler(NewNotFoundError(fmt.Sprintf("blockchain %v is not ready", name), "name"))
+			return
+		}
+
+		a.Messages() <- events.NewBlockchainRefundMessage(events.BC_REFUND, policy.Ethereum_bc, name)
+		w.WriteHeader(http.StatusOK)
+
+	case "OPTIONS":
+		w.Header().Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -3,8 +3,45 @@
 package api
 
 import (
+	"github.com/open-horizon/anax/events"
+	"github.com/open-horizon/anax/policy"
+	"github.com/open-horizon/anax/worker"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 )
 
 func Test_service(t *testing.T) {
 }
+
+// A refund is requested from the blockchain worker only for a ready blockchain client.
+func Test_blockchainRefund(t *testing.T) {
+
+	a := &API{
+		Manager:     worker.Manager{Messages: make(chan events.Message, 10)},
+		bcState:     make(map[string]map[string]BlockchainState),
+		bcStateLock: sync.Mutex{},
+	}
+	a.getBCNameMap(policy.Ethereum_bc)["bluehorizon"] = BlockchainState{ready: true}
+
+	router := a.router(false)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/status/blockchain/other/refund", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status %v for an unknown blockchain, was %v", http.StatusNotFound, w.Code)
+	} else if len(a.Messages()) != 0 {
+		t.Errorf("expected no refund request for an unknown blockchain")
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/status/blockchain/bluehorizon/refund", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %v, was %v", http.StatusOK, w.Code)
+	} else if len(a.Messages()) != 1 {
+		t.Errorf("expected a refund request")
+	} else if msg, ok := (<-a.Messages()).(*events.BlockchainRefundMessage); !ok || msg.BlockchainInstance() != "bluehorizon" || msg.BlockchainType() != policy.Ethereum_bc {
+		t.Errorf("expected a refund request for bluehorizon, got %v", msg)
+	}
+}
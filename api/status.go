@@ -11,6 +11,8 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/ethblockchain"
+	"github.com/open-horizon/anax/torrent"
 	"github.com/open-horizon/anax/version"
 )
 
@@ -21,9 +23,12 @@ type Configuration struct {
 }
 
 type Info struct {
-	Geths         []Geth          `json:"geth"`
-	Configuration *Configuration  `json:"configuration"`
-	Connectivity  map[string]bool `json:"connectivity"`
+	Geths           []Geth                                    `json:"geth"`
+	Configuration   *Configuration                            `json:"configuration"`
+	Connectivity    map[string]bool                           `json:"connectivity"`
+	ExchangeBreaker *config.CircuitBreakerStatus              `json:"exchange_circuit_breaker,omitempty"`
+	ImagePulls      map[string]torrent.ImagePullStats         `json:"image_pulls,omitempty"`
+	Blockchains     map[string]ethblockchain.BCInstanceStatus `json:"blockchains,omitempty"`
 }
 
 func NewInfo(config *config.HorizonConfig) *Info {
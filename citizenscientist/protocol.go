@@ -796,6 +796,7 @@ const AB_CANCEL_FORCED_UPGRADE = 207
 const AB_CANCEL_BC_WRITE_FAILED = 208 // xd0
 const AB_CANCEL_NODE_HEARTBEAT = 209
 const AB_CANCEL_AG_MISSING = 210
+const AB_CANCEL_PROPOSAL_TIMEOUT = 211
 
 func DecodeReasonCode(code uint64) string {
 
@@ -828,7 +829,8 @@ func DecodeReasonCode(code uint64) string {
 		AB_CANCEL_FORCED_UPGRADE:        "agreement bot user requested workload upgrade",
 		AB_CANCEL_BC_WRITE_FAILED:       "agreement bot agreement write failed",
 		AB_CANCEL_NODE_HEARTBEAT:        "agreement bot detected node heartbeat stopped",
-		AB_CANCEL_AG_MISSING:            "agreement bot detected agreement missing from node"}
+		AB_CANCEL_AG_MISSING:            "agreement bot detected agreement missing from node",
+		AB_CANCEL_PROPOSAL_TIMEOUT:      "agreement bot proposal expired before a reply was received"}
 
 	if reasonString, ok := codeMeanings[code]; !ok {
 		return "unknown reason code, device might be downlevel"
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	agbot "github.com/open-horizon/anax/agreementbot"
 	"github.com/open-horizon/anax/cli/cliutils"
+	"net/url"
 	"os"
 )
 
@@ -47,6 +48,7 @@ type ArchivedAgreement struct {
 	AgreementTimedout     string `json:"agreement_timeout"`      // agreement was not finalized before it timed out
 	TerminatedReason      uint   `json:"terminated_reason"`      // The reason the agreement was terminated
 	TerminatedDescription string `json:"terminated_description"` // The description of why the agreement was terminated
+	OperatorReason        string `json:"operator_reason"`        // The reason given by the operator who cancelled the agreement
 
 }
 
@@ -58,6 +60,7 @@ func NewArchivedAgreement(agreement agbot.Agreement) *ArchivedAgreement {
 		cliutils.ConvertTime(agreement.AgreementTimedout),
 		agreement.TerminatedReason,
 		agreement.TerminatedDescription,
+		agreement.OperatorReason,
 	}
 
 	return &a
@@ -112,7 +115,7 @@ func AgreementList(archivedAgreements bool, agreement string) {
 	}
 }
 
-func AgreementCancel(agreementId string, allAgreements bool) {
+func AgreementCancel(agreementId string, allAgreements bool, reason string) {
 	// Put the agreement ids in a slice
 	var agrIds []string
 	if allAgreements {
@@ -130,10 +133,35 @@ func AgreementCancel(agreementId string, allAgreements bool) {
 		agrIds = append(agrIds, agreementId)
 	}
 
-	// Cancel the agreements
+	// Cancel the agreements, recording the reason if one was given
+	query := ""
+	if reason != "" {
+		query = "?reason=" + url.QueryEscape(reason)
+	}
 	os.Setenv("HORIZON_URL", cliutils.AGBOT_HZN_API)
 	for _, id := range agrIds {
 		fmt.Printf("Canceling agreement %s ...\n", id)
-		cliutils.HorizonDelete("agreement/"+id, []int{200, 204})
+		cliutils.HorizonDelete("agreement/"+id+query, []int{200, 204})
+	}
+}
+
+// List the blockchain cancels the agbot has deferred until the blockchains of their agreements are writable.
+func DeferredCancelList() {
+	os.Setenv("HORIZON_URL", cliutils.AGBOT_HZN_API)
+
+	apiOutput := make(map[string][]agbot.DeferredCancel, 0)
+	cliutils.HorizonGet("deferredcancels", []int{200}, &apiOutput)
+
+	jsonBytes, err := json.MarshalIndent(apiOutput, "", cliutils.JSON_INDENT)
+	if err != nil {
+		cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "failed to marshal 'agbot deferredcancel list' output: %v", err)
 	}
+	fmt.Printf("%s\n", jsonBytes)
+}
+
+// Have the agbot attempt its deferred blockchain cancels now.
+func DeferredCancelFlush() {
+	os.Setenv("HORIZON_URL", cliutils.AGBOT_HZN_API)
+	fmt.Println("Flushing the deferred cancels ...")
+	cliutils.HorizonPutPost("POST", "deferredcancels/flush", []int{200}, nil)
 }
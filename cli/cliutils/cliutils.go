@@ -33,11 +33,19 @@ const (
 	CLI_GENERAL_ERROR = 7
 	NOT_FOUND         = 8
 	SIGNATURE_INVALID = 9
+	SIGNATURE_MISSING = 10 // a deployment string was published with --unsigned, reported separately from an invalid signature
 	INTERNAL_ERROR    = 99
 
 	// Anax API HTTP Codes
 	ANAX_ALREADY_CONFIGURED = 409
 	ANAX_NOT_CONFIGURED_YET = 424
+
+	// Exchange API HTTP Codes
+	EXCHANGE_ALREADY_EXISTS = 409
+
+	// Retries of exchange PUTs and POSTs that fail with a transient (5xx) error
+	EXCHANGE_RETRIES        = 3
+	EXCHANGE_RETRY_INTERVAL = 2 // seconds
 )
 
 // Holds the cmd line flags that were set so other pkgs can access
@@ -70,9 +78,67 @@ func Fatal(exitCode int, msg string, args ...interface{}) {
 		msg += "\n"
 	}
 	fmt.Fprintf(os.Stderr, "Error: "+msg, args...)
+	if recoveringFatal {
+		panic(FatalError{ExitCode: exitCode, Msg: strings.TrimSuffix(fmt.Sprintf(msg, args...), "\n"), reported: true})
+	}
 	os.Exit(exitCode)
 }
 
+// The error of a Fatal call made by the function run by RecoverFatal, or an error returned with the exit code the CLI should use for it.
+type FatalError struct {
+	ExitCode int
+	Msg      string
+	reported bool // Fatal already wrote the message to stderr
+}
+
+func (e FatalError) Error() string {
+	return e.Msg
+}
+
+// NewFatalError returns a FatalError, for functions that return their errors instead of calling Fatal.
+func NewFatalError(exitCode int, msg string, args ...interface{}) error {
+	return FatalError{ExitCode: exitCode, Msg: fmt.Sprintf(msg, args...)}
+}
+
+// ExitOnError does nothing if err is nil, otherwise it exits like Fatal with the exit code of err if it is a FatalError, or with
+// CLI_GENERAL_ERROR. The message is not written again if Fatal already wrote it.
+func ExitOnError(err error) {
+	if err == nil {
+		return
+	}
+	fErr, ok := err.(FatalError)
+	if !ok {
+		Fatal(CLI_GENERAL_ERROR, "%v", err)
+	} else if !fErr.reported {
+		Fatal(fErr.ExitCode, "%s", fErr.Msg)
+	} else if recoveringFatal {
+		panic(fErr)
+	}
+	os.Exit(fErr.ExitCode)
+}
+
+var recoveringFatal bool
+
+// RecoverFatal runs fn and returns the FatalError of the first Fatal call fn makes, instead of exiting, so that a command working
+// through several inputs can carry on with the next one. Fatal still writes its message to stderr.
+func RecoverFatal(fn func()) (err error) {
+	previous := recoveringFatal
+	recoveringFatal = true
+	defer func() {
+		recoveringFatal = previous
+		if r := recover(); r != nil {
+			if fErr, ok := r.(FatalError); ok {
+				err = fErr
+			} else {
+				panic(r)
+			}
+		}
+	}()
+
+	fn()
+	return nil
+}
+
 func IsDryRun() bool {
 	return *Opts.IsDryRun
 }
@@ -428,8 +494,41 @@ func ExchangeGet(urlBase string, urlSuffix string, credentials string, goodHttpC
 	return
 }
 
+// ExchangeGetStream runs a GET to the exchange api and passes the response body to the input function as it is read,
+// instead of reading it into memory first. This is for responses that can be very large, e.g. all the resources of an org.
+func ExchangeGetStream(urlBase string, urlSuffix string, credentials string, goodHttpCodes []int, bodyHandler func(body io.Reader) error) (httpCode int) {
+	url := urlBase + "/" + urlSuffix
+	apiMsg := http.MethodGet + " " + url
+	Verbose(apiMsg)
+	httpClient := &http.Client{}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		Fatal(HTTP_ERROR, "%s new request failed: %v", apiMsg, err)
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", fmt.Sprintf("Basic %v", base64.StdEncoding.EncodeToString([]byte(credentials))))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		printHorizonExchRestError(apiMsg, err)
+	}
+	defer resp.Body.Close()
+	httpCode = resp.StatusCode
+	Verbose("HTTP code: %d", httpCode)
+	if !isGoodCode(httpCode, goodHttpCodes) {
+		Fatal(HTTP_ERROR, "bad HTTP code %d from %s, output: %s", httpCode, apiMsg, GetRespBodyAsString(resp.Body))
+	}
+
+	if httpCode == 200 {
+		if err := bodyHandler(resp.Body); err != nil {
+			Fatal(JSON_PARSING_ERROR, "failed to process exchange body response from %s: %v", apiMsg, err)
+		}
+	}
+	return
+}
+
 // ExchangePutPost runs a PUT or POST to the exchange api to create of update a resource. If body is a string, it will be given to the exchange
 // as json. Otherwise the struct will be marshaled to json.
+// If the exchange returns a 5xx code that is not in the list of goodHttpCodes, the request is retried up to EXCHANGE_RETRIES times.
 // If the list of goodHttpCodes is not empty and none match the actual http code, it will exit with an error. Otherwise the actual code is returned.
 func ExchangePutPost(method string, urlBase string, urlSuffix string, credentials string, goodHttpCodes []int, body interface{}) (httpCode int) {
 	url := urlBase + "/" + urlSuffix
@@ -450,23 +549,34 @@ func ExchangePutPost(method string, urlBase string, urlSuffix string, credential
 			Fatal(JSON_PARSING_ERROR, "failed to marshal exchange body for %s: %v", apiMsg, err)
 		}
 	}
-	requestBody := bytes.NewBuffer(jsonBytes)
-	req, err := http.NewRequest(method, url, requestBody)
-	if err != nil {
-		Fatal(HTTP_ERROR, "%s new request failed: %v", apiMsg, err)
-	}
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/json")
-	if credentials != "" {
-		req.Header.Add("Authorization", fmt.Sprintf("Basic %v", base64.StdEncoding.EncodeToString([]byte(credentials))))
-	} // else it is an anonymous call
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		printHorizonExchRestError(apiMsg, err)
+
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		requestBody := bytes.NewBuffer(jsonBytes)
+		req, err := http.NewRequest(method, url, requestBody)
+		if err != nil {
+			Fatal(HTTP_ERROR, "%s new request failed: %v", apiMsg, err)
+		}
+		req.Header.Add("Accept", "application/json")
+		req.Header.Add("Content-Type", "application/json")
+		if credentials != "" {
+			req.Header.Add("Authorization", fmt.Sprintf("Basic %v", base64.StdEncoding.EncodeToString([]byte(credentials))))
+		} // else it is an anonymous call
+		resp, err = httpClient.Do(req)
+		if err != nil {
+			printHorizonExchRestError(apiMsg, err)
+		}
+		httpCode = resp.StatusCode
+		Verbose("HTTP code: %d", httpCode)
+		if httpCode < 500 || isGoodCode(httpCode, goodHttpCodes) || attempt > EXCHANGE_RETRIES {
+			break
+		}
+		resp.Body.Close()
+		Verbose("retrying %s in %d seconds", apiMsg, EXCHANGE_RETRY_INTERVAL)
+		time.Sleep(EXCHANGE_RETRY_INTERVAL * time.Second)
 	}
 	defer resp.Body.Close()
-	httpCode = resp.StatusCode
-	Verbose("HTTP code: %d", httpCode)
+
 	if !isGoodCode(httpCode, goodHttpCodes) {
 		bodyBytes, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
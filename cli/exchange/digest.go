@@ -0,0 +1,189 @@
+package exchange
+
+import (
+	"encoding/json"
+	"fmt"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/anax/cutil/dockerutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// The manifest media types accepted when resolving the digest of an image tag. A registry answers with the digest of the
+// first of these that it has for the tag, which is the digest docker uses when it pulls the image by digest, so a manifest
+// list for a multi-arch image is preferred over the manifest of a single arch.
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// Returns the registry domain, the repository path within the registry and the tag of an image that is not pinned to a
+// digest. Following docker, an image name without an org on docker.io is in the library org.
+func imageRepository(image string) (string, string, string) {
+	repo, tag := dockerutil.SplitImageName(image)
+	registry := dockerutil.ImageRegistry(repo)
+	if parts := strings.SplitN(repo, "/", 2); len(parts) == 2 && strings.ToLower(parts[0]) == registry {
+		repo = parts[1]
+	} else if registry == "docker.io" && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	return registry, repo, tag
+}
+
+// Returns true if the image is already pinned to a digest.
+func imagePinned(image string) bool {
+	return strings.Contains(image, "@")
+}
+
+// Returns the image pinned to the digest, without its tag, e.g. myorg/cpu:1.2 becomes myorg/cpu@sha256:...
+func pinnedImage(image string, digest string) string {
+	repo, _ := dockerutil.SplitImageName(image)
+	return repo + "@" + digest
+}
+
+// Returns the base URL of the v2 API of a registry.
+func registryBaseURL(registry string) string {
+	if registry == "docker.io" {
+		return "https://registry-1.docker.io"
+	}
+	return "https://" + registry
+}
+
+// PinImageDigests rewrites the image of every service in the deployments of the workload file to the digest returned by resolve,
+// so that the deployment signature covers the exact image that will run. Images that are already pinned are left as they are.
+// Returns the images that were pinned, keyed by their original name.
+func PinImageDigests(workFile *WorkloadFile, resolve func(image string) (string, error)) (map[string]string, error) {
+	pinned := make(map[string]string)
+	for i := range workFile.Workloads {
+		for name, service := range workFile.Workloads[i].Deployment.Services {
+			if service.Image == "" || imagePinned(service.Image) {
+				continue
+			}
+			if _, ok := pinned[service.Image]; !ok {
+				digest, err := resolve(service.Image)
+				if err != nil {
+					return nil, fmt.Errorf("unable to resolve the digest of image %s of service %s in deployment string %d: %v", service.Image, name, i+1, err)
+				}
+				pinned[service.Image] = pinnedImage(service.Image, digest)
+			}
+			service.Image = pinned[service.Image]
+			workFile.Workloads[i].Deployment.Services[name] = service
+		}
+	}
+	return pinned, nil
+}
+
+// ImageDigestResolver returns a function that resolves the digest of an image from its registry, using the credentials for the
+// registry in the docker config file. An image from a registry without credentials cannot be resolved.
+func ImageDigestResolver(client *http.Client, auths *dockerclient.AuthConfigurations, dockerConfigFile string) func(image string) (string, error) {
+	return func(image string) (string, error) {
+		registry, repo, tag := imageRepository(image)
+		auth, ok := RegistryAuth(auths, registry)
+		if !ok {
+			return "", fmt.Errorf("there are no credentials for registry %s in %s, run 'docker login %s' first", registry, dockerConfigFile, registry)
+		}
+		return resolveImageDigest(client, registryBaseURL(registry), repo, tag, auth)
+	}
+}
+
+// Returns the digest of the manifest of an image tag from the v2 API of the registry at baseURL. A registry that uses token
+// authentication answers the first request with a challenge, in which case a token is requested with the credentials and the
+// request is made again with the token.
+func resolveImageDigest(client *http.Client, baseURL string, repo string, tag string, auth dockerclient.AuthConfiguration) (string, error) {
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/%s", baseURL, repo, tag)
+
+	resp, err := manifestHead(client, manifestURL, func(req *http.Request) { req.SetBasicAuth(auth.Username, auth.Password) })
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			return "", fmt.Errorf("registry rejected the credentials of user %s for %s:%s", auth.Username, repo, tag)
+		}
+		token, err := registryToken(client, challenge, repo, auth)
+		if err != nil {
+			return "", err
+		}
+		if resp, err = manifestHead(client, manifestURL, func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }); err != nil {
+			return "", err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry returned status %d for %s:%s", resp.StatusCode, repo, tag)
+	} else if digest := resp.Header.Get("Docker-Content-Digest"); digest == "" {
+		return "", fmt.Errorf("registry did not return a digest for %s:%s", repo, tag)
+	} else {
+		return digest, nil
+	}
+}
+
+func manifestHead(client *http.Client, manifestURL string, authorize func(req *http.Request)) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request for %s: %v", manifestURL, err)
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	authorize(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach registry at %s: %v", manifestURL, err)
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// Returns a pull token for the repository from the token service named in the bearer challenge of a registry.
+func registryToken(client *http.Client, challenge string, repo string, auth dockerclient.AuthConfiguration) (string, error) {
+	params := make(map[string]string)
+	for _, m := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("registry token challenge %s does not name a realm", challenge)
+	}
+	if params["scope"] == "" {
+		params["scope"] = "repository:" + repo + ":pull"
+	}
+
+	query := url.Values{}
+	query.Set("scope", params["scope"])
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to create token request for %s: %v", params["realm"], err)
+	}
+	req.SetBasicAuth(auth.Username, auth.Password)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to reach registry token service %s: %v", params["realm"], err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token service %s rejected the credentials of user %s with status %d", params["realm"], auth.Username, resp.StatusCode)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("unable to decode the response of registry token service %s: %v", params["realm"], err)
+	} else if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	} else if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+	return "", fmt.Errorf("registry token service %s did not return a token", params["realm"])
+}
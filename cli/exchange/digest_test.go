@@ -0,0 +1,107 @@
+// +build unit
+
+package exchange
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_imageRepository(t *testing.T) {
+
+	for image, expected := range map[string][3]string{
+		"ubuntu":                                {"docker.io", "library/ubuntu", "latest"},
+		"openhorizon/cpu:1.2":                   {"docker.io", "openhorizon/cpu", "1.2"},
+		"registry.example.com:5000/org/cpu:1.0": {"registry.example.com:5000", "org/cpu", "1.0"},
+		"localhost/cpu":                         {"localhost", "cpu", "latest"},
+	} {
+		if registry, repo, tag := imageRepository(image); registry != expected[0] || repo != expected[1] || tag != expected[2] {
+			t.Errorf("expected %v for image %v, got %v %v %v", expected, image, registry, repo, tag)
+		}
+	}
+}
+
+func Test_PinImageDigests(t *testing.T) {
+
+	var workFile WorkloadFile
+	if err := json.Unmarshal([]byte(`{"workloads":[{"deployment":{"services":{"cpu":{"image":"openhorizon/cpu:1.2"},"gps":{"image":"openhorizon/gps@sha256:aaaa"}}}},{"deployment":{"services":{"cpu":{"image":"openhorizon/cpu:1.2"}}}}]}`), &workFile); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved := 0
+	pinned, err := PinImageDigests(&workFile, func(image string) (string, error) {
+		resolved++
+		return "sha256:bbbb", nil
+	})
+	if err != nil {
+		t.Errorf("unexpected error pinning digests: %v", err)
+	} else if resolved != 1 || len(pinned) != 1 || pinned["openhorizon/cpu:1.2"] != "openhorizon/cpu@sha256:bbbb" {
+		t.Errorf("expected one image to be resolved and pinned, got %v after %v resolutions", pinned, resolved)
+	} else if image := workFile.Workloads[1].Deployment.Services["cpu"].Image; image != "openhorizon/cpu@sha256:bbbb" {
+		t.Errorf("expected the image of every deployment to be pinned, got %v", image)
+	} else if image := workFile.Workloads[0].Deployment.Services["gps"].Image; image != "openhorizon/gps@sha256:aaaa" {
+		t.Errorf("expected an already pinned image to be left alone, got %v", image)
+	}
+
+	workFile.Workloads[1].Deployment.Services["new"] = workFile.Workloads[1].Deployment.Services["cpu"]
+	svc := workFile.Workloads[1].Deployment.Services["new"]
+	svc.Image = "openhorizon/new:1.0"
+	workFile.Workloads[1].Deployment.Services["new"] = svc
+	if _, err := PinImageDigests(&workFile, func(image string) (string, error) { return "", errors.New("not found") }); err == nil {
+		t.Errorf("expected an error when a digest cannot be resolved")
+	}
+}
+
+func Test_resolveImageDigest_token(t *testing.T) {
+
+	auth := dockerclient.AuthConfiguration{Username: "user", Password: "pw"}
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if user, pw, ok := r.BasicAuth(); !ok || user != "user" || pw != "pw" || r.URL.Query().Get("scope") != "repository:org/cpu:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"token":"abc"}`)
+		case "/v2/org/cpu/manifests/1.0":
+			if r.Header.Get("Authorization") != "Bearer abc" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry.example.com"`, server.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", "sha256:cccc")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	if digest, err := resolveImageDigest(server.Client(), server.URL, "org/cpu", "1.0", auth); err != nil {
+		t.Errorf("unexpected error resolving digest: %v", err)
+	} else if digest != "sha256:cccc" {
+		t.Errorf("expected digest sha256:cccc, got %v", digest)
+	}
+
+	if _, err := resolveImageDigest(server.Client(), server.URL, "org/cpu", "2.0", auth); err == nil {
+		t.Errorf("expected an error for an unknown tag")
+	}
+
+	if _, err := resolveImageDigest(server.Client(), server.URL, "org/cpu", "1.0", dockerclient.AuthConfiguration{Username: "user", Password: "wrong"}); err == nil {
+		t.Errorf("expected an error for rejected credentials")
+	}
+}
+
+func Test_ImageDigestResolver_no_credentials(t *testing.T) {
+
+	resolve := ImageDigestResolver(http.DefaultClient, &dockerclient.AuthConfigurations{Configs: map[string]dockerclient.AuthConfiguration{}}, "config.json")
+	if _, err := resolve("registry.example.com/org/cpu:1.0"); err == nil {
+		t.Errorf("expected an error for a registry without credentials")
+	}
+}
@@ -109,23 +109,27 @@ func AppendImagesFromDeploymentField(deployment DeploymentConfig, imageList []st
 	return imageList
 }
 
-func CheckTorrentField(torrent string, index int) {
-	// Verify the torrent field is the form necessary for the containers that are stored in a docker registry (because that is all we support from hzn right now)
-	torrentErrorString := `currently the torrent field must either be empty or be like this to indicate the images are stored in a docker registry: {\"url\":\"\",\"signature\":\"\"}`
+// CheckTorrentField verifies the torrent field of a deployment. The torrent field can be empty (or have an empty url and signature)
+// to indicate the images are stored in a docker registry. If the torrent is specified, both the url and signature must be provided.
+func CheckTorrentField(torrent string, index int) error {
 	if torrent == "" {
-		//cliutils.Fatal(cliutils.CLI_INPUT_ERROR, torrentErrorString)
-		return
+		return nil
 	}
 	var torrentMap map[string]string
 	if err := json.Unmarshal([]byte(torrent), &torrentMap); err != nil {
-		cliutils.Fatal(cliutils.CLI_INPUT_ERROR, "failed to unmarshal torrent string number %d: %v", index+1, err)
-	}
-	if url, ok := torrentMap["url"]; !ok || url != "" {
-		cliutils.Fatal(cliutils.CLI_INPUT_ERROR, torrentErrorString)
-	}
-	if signature, ok := torrentMap["signature"]; !ok || signature != "" {
-		cliutils.Fatal(cliutils.CLI_INPUT_ERROR, torrentErrorString)
-	}
+		return fmt.Errorf("failed to unmarshal torrent string number %d: %v", index+1, err)
+	}
+	url := torrentMap["url"]
+	signature := torrentMap["signature"]
+	if url == "" && signature == "" {
+		// Images are stored in a docker registry
+		return nil
+	} else if url == "" {
+		return fmt.Errorf("torrent string number %d is partially specified, it has a signature but is missing the url", index+1)
+	} else if signature == "" {
+		return fmt.Errorf("torrent string number %d is partially specified, it has a url but is missing the signature", index+1)
+	}
+	return nil
 }
 
 // MicroservicePublish signs the MS def and puts it in the exchange
@@ -155,6 +159,8 @@ func MicroservicePublish(org, userPw, jsonFilePath, keyFilePath string) {
 		deployment, err = json.Marshal(microFile.Workloads[i].Deployment)
 		if err != nil {
 			cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "failed to marshal deployment string %d: %v", i+1, err)
+		} else if err := CheckDeploymentRoundTrip(deployment, i); err != nil {
+			cliutils.Fatal(cliutils.INTERNAL_ERROR, "%v", err)
 		}
 		microInput.Workloads[i].Deployment = string(deployment)
 		microInput.Workloads[i].DeploymentSignature, err = sign.Input(keyFilePath, deployment)
@@ -165,7 +171,9 @@ func MicroservicePublish(org, userPw, jsonFilePath, keyFilePath string) {
 		// Gather the docker image paths to instruct to docker push at the end
 		imageList = AppendImagesFromDeploymentField(microFile.Workloads[i].Deployment, imageList)
 
-		CheckTorrentField(microInput.Workloads[i].Torrent, i)
+		if err := CheckTorrentField(microInput.Workloads[i].Torrent, i); err != nil {
+			cliutils.Fatal(cliutils.CLI_INPUT_ERROR, "%v", err)
+		}
 	}
 
 	// Create of update resource in the exchange
@@ -0,0 +1,52 @@
+// +build unit
+
+package exchange
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_CheckTorrentField_empty(t *testing.T) {
+
+	if err := CheckTorrentField("", 0); err != nil {
+		t.Errorf("empty torrent should be allowed, error: %v", err)
+	}
+
+	if err := CheckTorrentField(`{"url":"","signature":""}`, 0); err != nil {
+		t.Errorf("torrent with empty url and signature should be allowed, error: %v", err)
+	}
+
+	if err := CheckTorrentField(`{}`, 0); err != nil {
+		t.Errorf("torrent without url and signature should be allowed, error: %v", err)
+	}
+}
+
+func Test_CheckTorrentField_full(t *testing.T) {
+
+	if err := CheckTorrentField(`{"url":"https://images.example.com/pkg.json","signature":"abcdef"}`, 0); err != nil {
+		t.Errorf("fully specified torrent should be allowed, error: %v", err)
+	}
+}
+
+func Test_CheckTorrentField_partial(t *testing.T) {
+
+	if err := CheckTorrentField(`{"url":"https://images.example.com/pkg.json","signature":""}`, 1); err == nil {
+		t.Errorf("torrent without signature should not be allowed")
+	} else if !strings.Contains(err.Error(), "missing the signature") || !strings.Contains(err.Error(), "number 2") {
+		t.Errorf("wrong error for torrent without signature: %v", err)
+	}
+
+	if err := CheckTorrentField(`{"signature":"abcdef"}`, 0); err == nil {
+		t.Errorf("torrent without url should not be allowed")
+	} else if !strings.Contains(err.Error(), "missing the url") {
+		t.Errorf("wrong error for torrent without url: %v", err)
+	}
+}
+
+func Test_CheckTorrentField_invalid(t *testing.T) {
+
+	if err := CheckTorrentField(`{"url":`, 0); err == nil {
+		t.Errorf("torrent with invalid json should not be allowed")
+	}
+}
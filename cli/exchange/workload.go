@@ -1,15 +1,27 @@
 package exchange
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	dockerclient "github.com/fsouza/go-dockerclient"
 	"github.com/open-horizon/anax/cli/cliutils"
+	"github.com/open-horizon/anax/cutil/dockerutil"
 	"github.com/open-horizon/anax/exchange"
+	"github.com/open-horizon/anax/policy"
 	"github.com/open-horizon/rsapss-tool/sign"
 	"github.com/open-horizon/rsapss-tool/verify"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"text/tabwriter"
 )
 
 // This is used when reading json file the user gives us as input to create the workload struct
@@ -25,6 +37,82 @@ type WorkloadFile struct {
 	APISpecs    []exchange.APISpec            `json:"apiSpec"`
 	UserInputs  []exchange.UserInput          `json:"userInput"`
 	Workloads   []WorkloadDeployment `json:"workloads"`
+	ArchWorkloads []ArchWorkloads    `json:"archWorkloads"` // optional, instead of arch and workloads to publish the workload for several arches
+}
+
+// The deployments of a workload for one arch, used to publish a workload for several arches from one workload file
+type ArchWorkloads struct {
+	Arch      string               `json:"arch"`
+	Workloads []WorkloadDeployment `json:"workloads"`
+}
+
+// The arches that the archWorkloads of a workload file can be published for, unless they are set with a flag or HZN_WORKLOAD_ARCHES.
+var DefaultWorkloadArches = []string{"amd64", "arm", "arm64", "ppc64le"}
+
+// Returns the arches that workloads can be published for. They are the input arches if there are any, otherwise the comma separated
+// arches in HZN_WORKLOAD_ARCHES if it is set, otherwise DefaultWorkloadArches.
+func SupportedWorkloadArches(arches []string) []string {
+	if len(arches) != 0 {
+		return arches
+	} else if env := os.Getenv("HZN_WORKLOAD_ARCHES"); env != "" {
+		supported := []string{}
+		for _, a := range strings.Split(env, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				supported = append(supported, a)
+			}
+		}
+		return supported
+	}
+	return DefaultWorkloadArches
+}
+
+func archSupported(arch string, supported []string) bool {
+	for _, a := range supported {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// Split a workload file into one workload file per arch. A file without archWorkloads is returned as it is. Otherwise the file must
+// not also have arch or workloads, and each arch in archWorkloads must be unique and in the supported list. An API spec without an
+// arch gets the arch of the workload file it is in.
+func (w *WorkloadFile) PerArch(supported []string) ([]WorkloadFile, error) {
+	if len(w.ArchWorkloads) == 0 {
+		return []WorkloadFile{*w}, nil
+	} else if w.Arch != "" || len(w.Workloads) != 0 {
+		return nil, fmt.Errorf("arch and workloads must not be specified when archWorkloads is specified")
+	}
+
+	files := make([]WorkloadFile, 0, len(w.ArchWorkloads))
+	seen := make(map[string]bool)
+	for i, aw := range w.ArchWorkloads {
+		if aw.Arch == "" {
+			return nil, fmt.Errorf("archWorkloads number %d does not specify an arch", i+1)
+		} else if seen[aw.Arch] {
+			return nil, fmt.Errorf("arch %s is specified more than once in archWorkloads", aw.Arch)
+		} else if !archSupported(aw.Arch, supported) {
+			return nil, fmt.Errorf("arch %s in archWorkloads is not one of the supported arches %v", aw.Arch, supported)
+		} else if len(aw.Workloads) == 0 {
+			return nil, fmt.Errorf("archWorkloads for arch %s does not specify any workloads", aw.Arch)
+		}
+		seen[aw.Arch] = true
+
+		archFile := *w
+		archFile.Arch = aw.Arch
+		archFile.Workloads = aw.Workloads
+		archFile.ArchWorkloads = nil
+		archFile.APISpecs = make([]exchange.APISpec, len(w.APISpecs))
+		for j, spec := range w.APISpecs {
+			if spec.Arch == "" {
+				spec.Arch = aw.Arch
+			}
+			archFile.APISpecs[j] = spec
+		}
+		files = append(files, archFile)
+	}
+	return files, nil
 }
 
 // This is used as the input to the exchange to create the workload
@@ -65,58 +153,342 @@ func (w *WorkloadInput) DefinesVariable(name string) string {
 
 func WorkloadList(org, userPw, workload string, namesOnly bool) {
 	cliutils.SetWhetherUsingApiKey(userPw)
-	if workload != "" {
-		workload = "/" + workload
+	if workload == "" {
+		// Display all the workloads of the org as they are read from the exchange, so that large orgs are not held in memory
+		httpCode := cliutils.ExchangeGetStream(cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads", cliutils.OrgAndCreds(org, userPw), []int{200, 404}, func(body io.Reader) error {
+			return StreamWorkloadList(body, os.Stdout, namesOnly)
+		})
+		if httpCode == 404 {
+			// The org has no workloads, display an empty list
+			if err := StreamWorkloadList(strings.NewReader("{}"), os.Stdout, namesOnly); err != nil {
+				cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "failed to write 'hzn exchange workload list' output: %v", err)
+			}
+		}
+		return
 	}
-	if namesOnly && workload == "" {
-		// Only display the names
-		var resp exchange.GetWorkloadsResponse
-		cliutils.ExchangeGet(cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads"+workload, cliutils.OrgAndCreds(org, userPw), []int{200, 404}, &resp)
-		workloads := []string{}
 
-		for k := range resp.Workloads {
-			workloads = append(workloads, k)
+	// Display the full resource
+	var output exchange.GetWorkloadsResponse
+	httpCode := cliutils.ExchangeGet(cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads/"+workload, cliutils.OrgAndCreds(org, userPw), []int{200, 404}, &output)
+	if httpCode == 404 {
+		cliutils.Fatal(cliutils.NOT_FOUND, "workload '%s' not found in org %s", workload, org)
+	}
+	jsonBytes, err := json.MarshalIndent(output, "", cliutils.JSON_INDENT)
+	if err != nil {
+		cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "failed to marshal 'hzn exchange workload list' output: %v", err)
+	}
+	fmt.Println(string(jsonBytes))
+}
+
+// StreamWorkloadList writes the workloads of a GET workloads response to w as each one is decoded, in the order the exchange
+// returned them. When namesOnly is true, a JSON array of the workload ids is written, otherwise a JSON object with the
+// workload definitions keyed by id. The lastIndex field of the response is not written.
+func StreamWorkloadList(r io.Reader, w io.Writer, namesOnly bool) error {
+	indent := cliutils.JSON_INDENT
+	open, close, closeIndent := "{\n"+indent+"\"workloads\": {", "}\n}\n", indent
+	if namesOnly {
+		open, close, closeIndent = "[", "]\n", ""
+	}
+
+	if _, err := io.WriteString(w, open); err != nil {
+		return err
+	}
+	count := 0
+	var writeErr error
+	if err := DecodeWorkloadsStream(r, func(id string, work *exchange.WorkloadDefinition) {
+		if writeErr != nil {
+			return
 		}
-		jsonBytes, err := json.MarshalIndent(workloads, "", cliutils.JSON_INDENT)
-		if err != nil {
-			cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "failed to marshal 'hzn exchange workload list' output: %v", err)
+		sep := ","
+		if count == 0 {
+			sep = ""
 		}
-		fmt.Printf("%s\n", jsonBytes)
-	} else {
-		// Display the full resources
-		//var output string
-		var output exchange.GetWorkloadsResponse
+		count += 1
+		idBytes, _ := json.Marshal(id)
+		if namesOnly {
+			_, writeErr = fmt.Fprintf(w, "%s\n%s%s", sep, indent, idBytes)
+		} else if workBytes, err := json.MarshalIndent(work, indent+indent, indent); err != nil {
+			writeErr = err
+		} else {
+			_, writeErr = fmt.Fprintf(w, "%s\n%s%s: %s", sep, indent+indent, idBytes, workBytes)
+		}
+	}); err != nil {
+		return err
+	} else if writeErr != nil {
+		return writeErr
+	}
+
+	// Put the closing delimiter of a non-empty list on its own line
+	if count > 0 {
+		close = "\n" + closeIndent + close
+	}
+	_, err := io.WriteString(w, close)
+	return err
+}
+
+// WorkloadPublishResult is the result of PublishWorkload. When PublishWorkload fails, it describes the steps completed before the failure.
+type WorkloadPublishResult struct {
+	Workloads    []PublishedWorkload `json:"workloads"`    // the workload resources created or updated in the exchange, one for each arch
+	Images       []string            `json:"images"`       // the docker images referenced by the deployment strings
+	PinnedImages map[string]string   `json:"pinnedImages"` // the image each image tag was pinned to, when image digests are pinned
+	Warnings     []string            `json:"warnings"`     // the API specs that no microservice in the exchange satisfies
+}
+
+// PublishedWorkload is a workload resource that PublishWorkload created or updated in the exchange.
+type PublishedWorkload struct {
+	Arch       string        `json:"arch"`
+	ExchangeId string        `json:"exchangeId"`
+	Action     string        `json:"action"`   // Created or Updated
+	Workload   WorkloadInput `json:"workload"` // the signed workload sent to the exchange
+}
+
+// The warning displayed whenever deployment strings are published without signatures.
+const UnsignedWorkloadWarning = "***** WARNING: publishing UNSIGNED deployment strings. This is for development only, never for production. Edge nodes verify deployment string signatures, so they, and possibly the exchange or agbots, will reject an unsigned workload. *****"
+
+// WorkloadPublish signs the MS def and puts it in the exchange. When unsigned is set, the deployment strings are published without
+// signatures, for development only.
+func WorkloadPublish(org, userPw, jsonFilePath, keyFilePath string, maxDeploymentSize int, requireAPISpecs bool, arches []string, pinDigests bool, dockerConfigFile string, unsigned bool) {
+	if unsigned {
+		fmt.Fprintln(os.Stderr, UnsignedWorkloadWarning)
+	}
+	result, err := PublishWorkload(org, userPw, jsonFilePath, keyFilePath, maxDeploymentSize, requireAPISpecs, arches, pinDigests, dockerConfigFile, unsigned)
+
+	images := make([]string, 0, len(result.PinnedImages))
+	for image := range result.PinnedImages {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	for _, image := range images {
+		fmt.Printf("Pinned image %s to %s\n", image, result.PinnedImages[image])
+	}
+	for _, w := range result.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+	}
+	for _, pw := range result.Workloads {
+		fmt.Printf("%s %s in the exchange.\n", pw.Action, pw.ExchangeId)
+	}
+	cliutils.ExitOnError(err)
+	if unsigned {
+		fmt.Fprintln(os.Stderr, UnsignedWorkloadWarning)
+	}
 
-		httpCode := cliutils.ExchangeGet(cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads"+workload, cliutils.OrgAndCreds(org, userPw), []int{200, 404}, &output)
-		if httpCode == 404 && workload != "" {
-			cliutils.Fatal(cliutils.NOT_FOUND, "workload '%s' not found in org %s", strings.TrimPrefix(workload, "/"), org)
+	// Summarize the result for each arch when more than one was published
+	if len(result.Workloads) > 1 {
+		fmt.Println()
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ARCH\tWORKLOAD\tRESULT")
+		for _, pw := range result.Workloads {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", pw.Arch, pw.ExchangeId, pw.Action)
 		}
-		jsonBytes, err := json.MarshalIndent(output, "", cliutils.JSON_INDENT)
-		if err != nil {
-			cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "failed to marshal 'hzn exchange workload list' output: %v", err)
+		tw.Flush()
+	}
+
+	// Tell the to push the images to the docker registry. Pinned images were resolved from the registry, so they are already there.
+	if len(result.Images) > 0 && !pinDigests {
+		//todo: should we just push the docker images for them?
+		fmt.Println("If you haven't already, push your docker images to the registry:")
+		for _, image := range result.Images {
+			fmt.Printf("  docker push %s\n", image)
 		}
-		fmt.Println(string(jsonBytes))
+		fmt.Println("To check your credentials for a registry before pushing, run 'hzn exchange workload checkregistry <registry>'.")
 	}
 }
 
-// WorkloadPublish signs the MS def and puts it in the exchange
-func WorkloadPublish(org, userPw, jsonFilePath, keyFilePath string) {
+// PublishWorkload signs the workload file and creates or updates a workload resource in the exchange for each arch of the file. It
+// does not exit, a failure is returned as a cliutils.FatalError with the exit code the CLI uses for it. The file and exchange helpers
+// it calls still report their failures with cliutils.Fatal, which writes the message to stderr before cliutils.RecoverFatal turns it
+// into the returned error, and verbose output is written as usual. RecoverFatal is process wide, so it must not be called from
+// several goroutines at once. When unsigned is set, no private key is used and the deployment strings are published without
+// signatures.
+func PublishWorkload(org, userPw, jsonFilePath, keyFilePath string, maxDeploymentSize int, requireAPISpecs bool, arches []string, pinDigests bool, dockerConfigFile string, unsigned bool) (*WorkloadPublishResult, error) {
 	cliutils.SetWhetherUsingApiKey(userPw)
+	result := &WorkloadPublishResult{PinnedImages: map[string]string{}}
+
+	if unsigned && keyFilePath != "" {
+		return result, cliutils.NewFatalError(cliutils.CLI_INPUT_ERROR, "--unsigned and --private-key-file can not be specified together")
+	} else if !unsigned && keyFilePath == "" {
+		return result, cliutils.NewFatalError(cliutils.CLI_INPUT_ERROR, "--private-key-file is required to sign the workload")
+	}
+
 	// Read in the workload metadata
-	newBytes := cliutils.ReadJsonFile(jsonFilePath)
+	var newBytes []byte
+	if err := cliutils.RecoverFatal(func() { newBytes = cliutils.ReadJsonFile(jsonFilePath) }); err != nil {
+		return result, err
+	}
+	newBytes, err := ResolveDeploymentFiles(newBytes, deploymentBaseDir(jsonFilePath))
+	if err != nil {
+		return result, cliutils.NewFatalError(cliutils.CLI_INPUT_ERROR, "failed to resolve the deployment files of json input file %s: %v", jsonFilePath, err)
+	}
 	var workFile WorkloadFile
-	err := json.Unmarshal(newBytes, &workFile)
+	err = json.Unmarshal(newBytes, &workFile)
 	if err != nil {
-		cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "failed to unmarshal json input file %s: %v", jsonFilePath, err)
+		return result, cliutils.NewFatalError(cliutils.JSON_PARSING_ERROR, "failed to unmarshal json input file %s: %v", jsonFilePath, err)
 	}
 	if workFile.Org != "" && workFile.Org != org {
-		cliutils.Fatal(cliutils.CLI_INPUT_ERROR, "the org specified in the input file (%s) must match the org specified on the command line (%s)", workFile.Org, org)
+		return result, cliutils.NewFatalError(cliutils.CLI_INPUT_ERROR, "the org specified in the input file (%s) must match the org specified on the command line (%s)", workFile.Org, org)
+	}
+	archFiles, err := workFile.PerArch(SupportedWorkloadArches(arches))
+	if err != nil {
+		return result, cliutils.NewFatalError(cliutils.CLI_INPUT_ERROR, "invalid json input file %s: %v", jsonFilePath, err)
+	}
+
+	// Pin the images to their current digests before signing, so that the signatures cover the exact images that will run
+	if pinDigests {
+		if dockerConfigFile == "" {
+			dockerConfigFile = os.Getenv("HOME") + "/.docker/config.json"
+		}
+		auths, err := dockerutil.DockerCredsFromConfigFile(dockerConfigFile)
+		if err != nil {
+			return result, cliutils.NewFatalError(cliutils.FILE_IO_ERROR, "pinning image digests requires registry credentials, failed to read docker credentials from %s: %v", dockerConfigFile, err)
+		}
+		resolve := ImageDigestResolver(&http.Client{}, auths, dockerConfigFile)
+		for i := range archFiles {
+			pinned, err := PinImageDigests(&archFiles[i], resolve)
+			if err != nil {
+				return result, cliutils.NewFatalError(cliutils.HTTP_ERROR, "%v", err)
+			}
+			for image, pinnedImage := range pinned {
+				result.PinnedImages[image] = pinnedImage
+			}
+		}
+	}
+
+	// Sign the workload for every arch before publishing any of them, so that a bad deployment does not leave some arches published
+	workInputs := make([]WorkloadInput, len(archFiles))
+	for i := range archFiles {
+		cliutils.Verbose("signing workload for arch %s", archFiles[i].Arch)
+		if workInputs[i], result.Images, err = signWorkload(&archFiles[i], keyFilePath, maxDeploymentSize, result.Images); err != nil {
+			return result, err
+		}
+	}
+
+	// Make sure the microservices the workload requires for every arch exist in the exchange before publishing any of them, for the
+	// same reason
+	for i := range workInputs {
+		var missing []string
+		if err := cliutils.RecoverFatal(func() { missing = CheckAPISpecs(org, userPw, workInputs[i].APISpecs) }); err != nil {
+			return result, err
+		}
+		result.Warnings = append(result.Warnings, missing...)
+	}
+	if len(result.Warnings) != 0 && requireAPISpecs {
+		return result, cliutils.NewFatalError(cliutils.CLI_INPUT_ERROR, "the workload requires microservices that are not in the exchange")
+	}
+
+	for i := range workInputs {
+		workInput := &workInputs[i]
+
+		// Create or update resource in the exchange
+		exchId := cliutils.FormExchangeId(workInput.WorkloadURL, workInput.Version, workInput.Arch)
+		var action string
+		if err := cliutils.RecoverFatal(func() { action = putWorkload(org, userPw, exchId, workInput) }); err != nil {
+			return result, err
+		}
+		result.Workloads = append(result.Workloads, PublishedWorkload{Arch: workInput.Arch, ExchangeId: exchId, Action: action, Workload: *workInput})
+	}
+	return result, nil
+}
+
+// Create the workload resource in the exchange, or update it if it already exists, and return Created or Updated accordingly.
+func putWorkload(org, userPw, exchId string, workInput *WorkloadInput) string {
+	var output string
+	httpCode := cliutils.ExchangeGet(cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads/"+exchId, cliutils.OrgAndCreds(org, userPw), []int{200, 404}, &output)
+	if httpCode == 200 {
+		// Workload exists, update it
+		cliutils.Verbose("updating %s in the exchange", exchId)
+		cliutils.ExchangePutPost(http.MethodPut, cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads/"+exchId, cliutils.OrgAndCreds(org, userPw), []int{201}, workInput)
+		return "Updated"
+	}
+
+	// Workload not there, create it
+	cliutils.Verbose("creating %s in the exchange", exchId)
+	httpCode = cliutils.ExchangePutPost(http.MethodPost, cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads", cliutils.OrgAndCreds(org, userPw), []int{201, cliutils.EXCHANGE_ALREADY_EXISTS}, workInput)
+	if httpCode == cliutils.EXCHANGE_ALREADY_EXISTS {
+		// Someone else created the workload after we checked for it, so update it instead
+		cliutils.Verbose("%s was created by another publisher, updating it instead", exchId)
+		cliutils.ExchangePutPost(http.MethodPut, cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads/"+exchId, cliutils.OrgAndCreds(org, userPw), []int{201}, workInput)
+		return "Updated"
+	}
+	return "Created"
+}
+
+// WorkloadPublishDir publishes every workload file in a directory, as WorkloadPublish does for a single file, and displays a summary of
+// the result for each file. A failed file does not stop the others from being published unless failFast is set. Exits with the exit
+// code of the last failure if any file failed.
+func WorkloadPublishDir(org, userPw, dirPath, keyFilePath string, maxDeploymentSize int, requireAPISpecs bool, arches []string, pinDigests bool, dockerConfigFile string, failFast bool, unsigned bool) {
+	files, err := WorkloadFilesInDir(dirPath)
+	if err != nil {
+		cliutils.Fatal(cliutils.FILE_IO_ERROR, "%v", err)
+	} else if len(files) == 0 {
+		cliutils.Fatal(cliutils.NOT_FOUND, "there are no workload files in %s", dirPath)
+	}
+
+	results := make([]string, 0, len(files))
+	exitCode := 0
+	for _, file := range files {
+		fmt.Printf("Publishing %s...\n", file)
+		if err := cliutils.RecoverFatal(func() {
+			WorkloadPublish(org, userPw, file, keyFilePath, maxDeploymentSize, requireAPISpecs, arches, pinDigests, dockerConfigFile, unsigned)
+		}); err != nil {
+			results = append(results, "failed: "+err.Error())
+			exitCode = err.(cliutils.FatalError).ExitCode
+			if failFast {
+				break
+			}
+		} else {
+			results = append(results, "published")
+		}
+		fmt.Println()
 	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tRESULT")
+	for i := range results {
+		fmt.Fprintf(tw, "%s\t%s\n", filepath.Base(files[i]), results[i])
+	}
+	if len(results) < len(files) {
+		for _, file := range files[len(results):] {
+			fmt.Fprintf(tw, "%s\t%s\n", filepath.Base(file), "skipped")
+		}
+	}
+	tw.Flush()
+
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
+// WorkloadFilesInDir returns the paths of the workload files in a directory, sorted by name. A workload file is a *.json file with
+// a workloadUrl, so deployment files referenced with '@<file>' from the workload files in the directory are not included.
+func WorkloadFilesInDir(dirPath string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dirPath, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the json files in %s: %v", dirPath, err)
+	}
+	sort.Strings(paths)
+
+	files := make([]string, 0, len(paths))
+	for _, path := range paths {
+		fileBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		var workFile map[string]interface{}
+		if err := json.Unmarshal(regexp.MustCompile(`(?s)/\*.*?\*/`).ReplaceAll(fileBytes, nil), &workFile); err != nil || workFile["workloadUrl"] == nil {
+			cliutils.Verbose("skipping %s, it is not a workload file", path)
+			continue
+		}
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// Sign the deployment strings of a workload file and return the exchange input for the workload, along with the input image list
+// extended with the docker images of the deployments. An empty keyFilePath leaves the deployment strings unsigned.
+func signWorkload(workFile *WorkloadFile, keyFilePath string, maxDeploymentSize int, imageList []string) (WorkloadInput, []string, error) {
 	workInput := WorkloadInput{Label: workFile.Label, Description: workFile.Description, Public: workFile.Public, WorkloadURL: workFile.WorkloadURL, Version: workFile.Version, Arch: workFile.Arch, DownloadURL: workFile.DownloadURL, APISpecs: workFile.APISpecs, UserInputs: workFile.UserInputs, Workloads: make([]exchange.WorkloadDeployment, len(workFile.Workloads))}
 
 	// Loop thru the workloads array and sign the deployment strings
-	fmt.Println("Signing workload...")
-	var imageList []string
 	for i := range workFile.Workloads {
 		cliutils.Verbose("signing deployment string %d", i+1)
 		workInput.Workloads[i].Torrent = workFile.Workloads[i].Torrent
@@ -124,87 +496,769 @@ func WorkloadPublish(org, userPw, jsonFilePath, keyFilePath string) {
 		var deployment []byte
 		deployment, err = json.Marshal(workFile.Workloads[i].Deployment)
 		if err != nil {
-			cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "failed to marshal deployment string %d: %v", i+1, err)
+			return workInput, imageList, cliutils.NewFatalError(cliutils.JSON_PARSING_ERROR, "failed to marshal deployment string %d: %v", i+1, err)
+		}
+		if err := CheckDeploymentSize(deployment, i, maxDeploymentSize); err != nil {
+			return workInput, imageList, cliutils.NewFatalError(cliutils.CLI_INPUT_ERROR, "%v", err)
+		} else if err := CheckDeploymentRoundTrip(deployment, i); err != nil {
+			return workInput, imageList, cliutils.NewFatalError(cliutils.INTERNAL_ERROR, "%v", err)
 		}
 		workInput.Workloads[i].Deployment = string(deployment)
-		workInput.Workloads[i].DeploymentSignature, err = sign.Input(keyFilePath, deployment)
-		if err != nil {
-			cliutils.Fatal(cliutils.CLI_GENERAL_ERROR, "problem signing deployment string %d with %s: %v", i+1, keyFilePath, err)
+		if keyFilePath != "" {
+			workInput.Workloads[i].DeploymentSignature, err = sign.Input(keyFilePath, deployment)
+			if err != nil {
+				return workInput, imageList, cliutils.NewFatalError(cliutils.CLI_GENERAL_ERROR, "problem signing deployment string %d with %s: %v", i+1, keyFilePath, err)
+			}
 		}
 
 		// Gather the docker image paths to instruct to docker push at the end
 		imageList = AppendImagesFromDeploymentField(workFile.Workloads[i].Deployment, imageList)
 
-		CheckTorrentField(workInput.Workloads[i].Torrent, i)
+		if err := CheckTorrentField(workInput.Workloads[i].Torrent, i); err != nil {
+			return workInput, imageList, cliutils.NewFatalError(cliutils.CLI_INPUT_ERROR, "%v", err)
+		}
+	}
+	return workInput, imageList, nil
+}
+
+// WorkloadCheckRegistry verifies that the credentials for a docker registry in the docker config file are accepted by the registry,
+// by asking the local docker daemon to log in to the registry with them.
+func WorkloadCheckRegistry(registry, dockerConfigFile string) {
+	if dockerConfigFile == "" {
+		dockerConfigFile = os.Getenv("HOME") + "/.docker/config.json"
+	}
+	auths, err := dockerutil.DockerCredsFromConfigFile(dockerConfigFile)
+	if err != nil {
+		cliutils.Fatal(cliutils.FILE_IO_ERROR, "failed to read docker credentials from %s: %v", dockerConfigFile, err)
+	}
+	auth, ok := RegistryAuth(auths, registry)
+	if !ok {
+		cliutils.Fatal(cliutils.NOT_FOUND, "there are no credentials for registry %s in %s, run 'docker login %s' first", registry, dockerConfigFile, registry)
 	}
 
-	// Create or update resource in the exchange
-	exchId := cliutils.FormExchangeId(workInput.WorkloadURL, workInput.Version, workInput.Arch)
-	var output string
-	httpCode := cliutils.ExchangeGet(cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads/"+exchId, cliutils.OrgAndCreds(org, userPw), []int{200, 404}, &output)
-	if httpCode == 200 {
-		// Workload exists, update it
-		fmt.Printf("Updating %s in the exchange...\n", exchId)
-		cliutils.ExchangePutPost(http.MethodPut, cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads/"+exchId, cliutils.OrgAndCreds(org, userPw), []int{201}, workInput)
+	client, err := dockerclient.NewClientFromEnv()
+	if err != nil {
+		cliutils.Fatal(cliutils.CLI_GENERAL_ERROR, "failed to connect to the docker daemon: %v", err)
+	}
+	cliutils.Verbose("checking the credentials of user %s for registry %s", auth.Username, auth.ServerAddress)
+	if status, err := client.AuthCheck(&auth); err != nil {
+		cliutils.Fatal(cliutils.HTTP_ERROR, "registry %s rejected the credentials of user %s from %s: %v", registry, auth.Username, dockerConfigFile, err)
+	} else if status.Status != "" {
+		fmt.Printf("Credentials of user %s for registry %s are valid: %s\n", auth.Username, registry, status.Status)
 	} else {
-		// Workload not there, create it
-		fmt.Printf("Creating %s in the exchange...\n", exchId)
-		cliutils.ExchangePutPost(http.MethodPost, cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads", cliutils.OrgAndCreds(org, userPw), []int{201}, workInput)
+		fmt.Printf("Credentials of user %s for registry %s are valid.\n", auth.Username, registry)
 	}
+}
 
-	// Tell the to push the images to the docker registry
-	if len(imageList) > 0 {
-		//todo: should we just push the docker images for them?
-		fmt.Println("If you haven't already, push your docker images to the registry:")
-		for _, image := range imageList {
-			fmt.Printf("  docker push %s\n", image)
+// RegistryAuth returns the credentials for a registry domain, e.g. "docker.io" or "registry.example.com:5000". The entries in a
+// docker config file can be keyed by a URL, e.g. "https://index.docker.io/v1/", so the entries are compared by their domain.
+func RegistryAuth(auths *dockerclient.AuthConfigurations, registry string) (dockerclient.AuthConfiguration, bool) {
+	domain := func(s string) string {
+		s = strings.ToLower(s)
+		s = strings.TrimPrefix(strings.TrimPrefix(s, "https://"), "http://")
+		s = strings.SplitN(s, "/", 2)[0]
+		if s == "index.docker.io" || s == "registry-1.docker.io" {
+			return "docker.io"
+		}
+		return s
+	}
+	for key, auth := range auths.Configs {
+		if domain(key) == domain(registry) {
+			return auth, true
+		}
+	}
+	return dockerclient.AuthConfiguration{}, false
+}
+
+// CheckDeploymentSize returns an error if the marshaled deployment string at the given (0-based) index is larger than maxSize bytes.
+// A maxSize of zero or less means there is no limit.
+func CheckDeploymentSize(deployment []byte, index int, maxSize int) error {
+	if maxSize > 0 && len(deployment) > maxSize {
+		return fmt.Errorf("the deployment string in workload number %d is %d bytes, which exceeds the maximum of %d bytes", index+1, len(deployment), maxSize)
+	}
+	return nil
+}
+
+// CheckDeploymentRoundTrip returns an error if the marshaled deployment string at the given (0-based) index changes when it is parsed
+// and marshaled again. The signature covers the deployment string as it is, so a consumer that parses the deployment and marshals it
+// again, e.g. to verify or display it, must get the same bytes back.
+func CheckDeploymentRoundTrip(deployment []byte, index int) error {
+	var parsed DeploymentConfig
+	if err := json.Unmarshal(deployment, &parsed); err != nil {
+		return fmt.Errorf("the deployment string in workload number %d can not be parsed: %v", index+1, err)
+	} else if remarshaled, err := json.Marshal(parsed); err != nil {
+		return fmt.Errorf("the deployment string in workload number %d can not be marshaled again: %v", index+1, err)
+	} else if !bytes.Equal(remarshaled, deployment) {
+		return fmt.Errorf("the deployment string in workload number %d changes when it is parsed and marshaled again, from %s to %s", index+1, deployment, remarshaled)
+	}
+	return nil
+}
+
+// ResolveDeploymentFiles replaces each deployment in the workloads arrays of a workload file that is a "@path/to/deployment.json"
+// reference with the content of the referenced file, and returns the updated workload file. A relative path is relative to
+// baseDir, which is normally the directory of the workload file. Deployments that are not references are left as they are.
+func ResolveDeploymentFiles(fileBytes []byte, baseDir string) ([]byte, error) {
+	var workFile map[string]json.RawMessage
+	if err := json.Unmarshal(fileBytes, &workFile); err != nil {
+		return nil, err
+	}
+
+	resolved := false
+	if rawWorkloads, ok := workFile["workloads"]; ok {
+		if newWorkloads, changed, err := resolveWorkloadsDeploymentFiles(rawWorkloads, baseDir, ""); err != nil {
+			return nil, err
+		} else if changed {
+			workFile["workloads"] = newWorkloads
+			resolved = true
+		}
+	}
+
+	if rawArchWorkloads, ok := workFile["archWorkloads"]; ok {
+		var archWorkloads []map[string]json.RawMessage
+		if err := json.Unmarshal(rawArchWorkloads, &archWorkloads); err != nil {
+			return nil, err
+		}
+		archResolved := false
+		for _, aw := range archWorkloads {
+			var arch string
+			json.Unmarshal(aw["arch"], &arch)
+			if rawWorkloads, ok := aw["workloads"]; ok {
+				if newWorkloads, changed, err := resolveWorkloadsDeploymentFiles(rawWorkloads, baseDir, fmt.Sprintf(" for arch %s", arch)); err != nil {
+					return nil, err
+				} else if changed {
+					aw["workloads"] = newWorkloads
+					archResolved = true
+				}
+			}
+		}
+		if archResolved {
+			var err error
+			if workFile["archWorkloads"], err = json.Marshal(archWorkloads); err != nil {
+				return nil, err
+			}
+			resolved = true
+		}
+	}
+
+	if !resolved {
+		return fileBytes, nil
+	}
+	return json.Marshal(workFile)
+}
+
+// Resolve the deployment file references in a single workloads array. Returns the updated array and true if any reference
+// was resolved. The suffix is added to error messages to identify the array.
+func resolveWorkloadsDeploymentFiles(rawWorkloads json.RawMessage, baseDir string, suffix string) (json.RawMessage, bool, error) {
+	var workloads []map[string]json.RawMessage
+	if err := json.Unmarshal(rawWorkloads, &workloads); err != nil {
+		return nil, false, err
+	}
+
+	resolved := false
+	for i, w := range workloads {
+		var ref string
+		if err := json.Unmarshal(w["deployment"], &ref); err != nil || !strings.HasPrefix(ref, "@") {
+			continue
+		}
+		path := strings.TrimPrefix(ref, "@")
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		deployment, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read the deployment file %s of workload number %d%s: %v", path, i+1, suffix, err)
+		}
+		deployment = regexp.MustCompile(`(?s)/\*.*?\*/`).ReplaceAll(deployment, nil)
+		if !json.Valid(deployment) {
+			return nil, false, fmt.Errorf("the deployment file %s of workload number %d%s is not valid json", path, i+1, suffix)
+		}
+		w["deployment"] = json.RawMessage(deployment)
+		resolved = true
+	}
+	if !resolved {
+		return rawWorkloads, false, nil
+	}
+
+	newWorkloads, err := json.Marshal(workloads)
+	return newWorkloads, true, err
+}
+
+// The directory that relative deployment file references in a workload file are relative to. It is the current directory when
+// the workload file is read from stdin.
+func deploymentBaseDir(jsonFilePath string) string {
+	if jsonFilePath == "-" {
+		return "."
+	}
+	return filepath.Dir(jsonFilePath)
+}
+
+// CheckAPISpecs looks up each API spec of a workload in the exchange, and returns a description of each one that does not match
+// a microservice in the exchange. An API spec without an org refers to a microservice in the workload's org.
+func CheckAPISpecs(org, userPw string, apiSpecs []exchange.APISpec) []string {
+	missing := []string{}
+	for _, spec := range apiSpecs {
+		specOrg := spec.Org
+		if specOrg == "" {
+			specOrg = org
+		}
+		var output exchange.GetMicroservicesResponse
+		cliutils.ExchangeGet(cliutils.GetExchangeUrl(), "orgs/"+specOrg+"/microservices?specRef="+url.QueryEscape(spec.SpecRef)+"&arch="+url.QueryEscape(spec.Arch), cliutils.OrgAndCreds(org, userPw), []int{200, 404}, &output)
+		if found, err := APISpecSatisfied(spec, output.Microservices); err != nil {
+			missing = append(missing, err.Error())
+		} else if !found {
+			missing = append(missing, fmt.Sprintf("no microservice in the exchange matches API spec %s in org %s, version %s, arch %s", spec.SpecRef, specOrg, spec.Version, spec.Arch))
 		}
 	}
+	return missing
+}
+
+// APISpecSatisfied returns true if one of the microservices has the url and arch of the API spec, and a version within the API spec's version range.
+func APISpecSatisfied(spec exchange.APISpec, microservices map[string]exchange.MicroserviceDefinition) (bool, error) {
+	vRange, err := policy.Version_Expression_Factory("0.0.0")
+	if spec.Version != "" {
+		vRange, err = policy.Version_Expression_Factory(spec.Version)
+	}
+	if err != nil {
+		return false, fmt.Errorf("API spec %s has an invalid version %s: %v", spec.SpecRef, spec.Version, err)
+	}
+
+	for _, ms := range microservices {
+		if ms.SpecRef != spec.SpecRef || ms.Arch != spec.Arch {
+			continue
+		}
+		if inRange, err := vRange.Is_within_range(ms.Version); err == nil && inRange {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// WorkloadVerifyResult is the result of VerifyWorkload. Deployment strings are numbered from 1.
+type WorkloadVerifyResult struct {
+	Workload string `json:"workload"` // the workload, prefixed with its org
+	Verified []int  `json:"verified"` // the deployment strings signed with the private key associated with the public key
+	Invalid  []int  `json:"invalid"`  // the deployment strings that were not
+	Unsigned []int  `json:"unsigned"` // the deployment strings without a signature, published with --unsigned
 }
 
 // WorkloadVerify verifies the deployment strings of the specified workload resource in the exchange.
 func WorkloadVerify(org, userPw, workload, keyFilePath string) {
+	result, err := VerifyWorkload(org, userPw, workload, keyFilePath)
+	cliutils.ExitOnError(err)
+
+	for _, i := range result.Invalid {
+		fmt.Printf("Deployment string %d was not signed with the private key associated with this public key.\n", i)
+	}
+	for _, i := range result.Unsigned {
+		fmt.Printf("Deployment string %d is unsigned, it was published with --unsigned for development.\n", i)
+	}
+	if len(result.Invalid) != 0 {
+		os.Exit(cliutils.SIGNATURE_INVALID)
+	} else if len(result.Unsigned) != 0 {
+		os.Exit(cliutils.SIGNATURE_MISSING)
+	} else {
+		fmt.Println("All signatures verified")
+	}
+}
+
+// VerifyWorkload verifies the deployment strings of the specified workload resource in the exchange. Like PublishWorkload, it does not
+// exit, a failure is returned as a cliutils.FatalError, and a failure of the exchange request is also written to stderr. Invalid
+// signatures and unsigned deployment strings are not a failure, they are listed in the result.
+func VerifyWorkload(org, userPw, workload, keyFilePath string) (*WorkloadVerifyResult, error) {
 	cliutils.SetWhetherUsingApiKey(userPw)
 	// Get workload resource from exchange
-	var output exchange.GetWorkloadsResponse
-	httpCode := cliutils.ExchangeGet(cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads/"+workload, cliutils.OrgAndCreds(org, userPw), []int{200, 404}, &output)
-	if httpCode == 404 {
-		cliutils.Fatal(cliutils.NOT_FOUND, "workload '%s' not found in org %s", workload, org)
+	var work *exchange.WorkloadDefinition
+	if err := cliutils.RecoverFatal(func() { work = getWorkloadDefinition(org, userPw, workload) }); err != nil {
+		return nil, err
 	}
 
 	// Loop thru workloads array, checking the deployment string signature
-	work, ok := output.Workloads[org+"/"+workload]
-	if !ok {
-		cliutils.Fatal(cliutils.INTERNAL_ERROR, "key '%s' not found in resources returned from exchange", org+"/"+workload)
-	}
-	someInvalid := false
+	result := &WorkloadVerifyResult{Workload: org + "/" + workload, Verified: []int{}, Invalid: []int{}, Unsigned: []int{}}
 	for i := range work.Workloads {
+		if work.Workloads[i].DeploymentSignature == "" {
+			result.Unsigned = append(result.Unsigned, i+1)
+			continue
+		}
 		cliutils.Verbose("verifying deployment string %d", i+1)
 		verified, err := verify.Input(keyFilePath, work.Workloads[i].DeploymentSignature, []byte(work.Workloads[i].Deployment))
 		if err != nil {
-			cliutils.Fatal(cliutils.CLI_GENERAL_ERROR, "problem verifying deployment string %d with %s: %v", i+1, keyFilePath, err)
-		} else if !verified {
-			fmt.Printf("Deployment string %d was not signed with the private key associated with this public key.\n", i+1)
-			someInvalid = true
+			return nil, cliutils.NewFatalError(cliutils.CLI_GENERAL_ERROR, "problem verifying deployment string %d with %s: %v", i+1, keyFilePath, err)
+		} else if verified {
+			result.Verified = append(result.Verified, i+1)
+		} else {
+			result.Invalid = append(result.Invalid, i+1)
+		}
+	}
+	return result, nil
+}
+
+// WorkloadVerifyLocal verifies the deployment strings of a workload definition stored in a local file, without contacting the exchange.
+// The file can contain the output of 'hzn exchange workload list <workload>', or a single workload resource. Each deployment string
+// is considered verified if it was signed by the private key associated with any of the public keys.
+func WorkloadVerifyLocal(jsonFilePath string, keyFilePaths []string) {
+	newBytes := cliutils.ReadJsonFile(jsonFilePath)
+
+	// First try the format returned by a GET of the workload, then try a single workload resource.
+	works := make(map[string]exchange.WorkloadDefinition)
+	var output exchange.GetWorkloadsResponse
+	if err := json.Unmarshal(newBytes, &output); err == nil && len(output.Workloads) != 0 {
+		works = output.Workloads
+	} else {
+		var work exchange.WorkloadDefinition
+		if err := json.Unmarshal(newBytes, &work); err != nil {
+			cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "failed to unmarshal json input file %s: %v", jsonFilePath, err)
+		} else if len(work.Workloads) == 0 {
+			cliutils.Fatal(cliutils.CLI_INPUT_ERROR, "json input file %s does not contain a workload definition", jsonFilePath)
+		}
+		works[cliutils.FormExchangeId(work.WorkloadURL, work.Version, work.Arch)] = work
+	}
+
+	// Loop thru each workload's deployment strings, checking the signatures
+	someInvalid := false
+	someUnsigned := false
+	for id, work := range works {
+		for i := range work.Workloads {
+			if work.Workloads[i].DeploymentSignature == "" {
+				fmt.Printf("Deployment string %d of %s is unsigned, it was published with --unsigned for development.\n", i+1, id)
+				someUnsigned = true
+				continue
+			}
+			cliutils.Verbose("verifying deployment string %d of %s", i+1, id)
+			if verified, keyFile, failures := verify.InputVerifiedByAnyKey(keyFilePaths, work.Workloads[i].DeploymentSignature, []byte(work.Workloads[i].Deployment)); !verified {
+				cliutils.Verbose("verification failures for deployment string %d of %s: %v", i+1, id, failures)
+				fmt.Printf("Deployment string %d of %s was not signed with the private key associated with any of these public keys.\n", i+1, id)
+				someInvalid = true
+			} else {
+				cliutils.Verbose("deployment string %d of %s verified with %s", i+1, id, keyFile)
+			}
 		}
-		// else if they all turned out to be valid, we will tell them that at the end
 	}
 
 	if someInvalid {
 		os.Exit(cliutils.SIGNATURE_INVALID)
+	} else if someUnsigned {
+		os.Exit(cliutils.SIGNATURE_MISSING)
 	} else {
 		fmt.Println("All signatures verified")
 	}
 }
 
-func WorkloadRemove(org, userPw, workload string, force bool) {
+// WorkloadVerifyAll verifies the deployment strings of every workload resource in the org, and displays a summary of the
+// result for each deployment string. Each deployment string is considered verified if it was signed by the private key
+// associated with any of the public keys. The workloads are verified as they are read from the exchange, so that large
+// orgs are not held in memory.
+func WorkloadVerifyAll(org, userPw string, keyFilePaths []string) {
+	cliutils.SetWhetherUsingApiKey(userPw)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "WORKLOAD\tDEPLOYMENT STRINGS")
+	count := 0
+	someInvalid := false
+	someUnsigned := false
+	httpCode := cliutils.ExchangeGetStream(cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads", cliutils.OrgAndCreds(org, userPw), []int{200, 404}, func(body io.Reader) error {
+		return DecodeWorkloadsStream(body, func(id string, work *exchange.WorkloadDefinition) {
+			count += 1
+			results := make([]string, 0, len(work.Workloads))
+			for i := range work.Workloads {
+				if work.Workloads[i].DeploymentSignature == "" {
+					results = append(results, fmt.Sprintf("%d:unsigned", i+1))
+					someUnsigned = true
+					continue
+				}
+				cliutils.Verbose("verifying deployment string %d of %s", i+1, id)
+				if verified, keyFile, failures := verify.InputVerifiedByAnyKey(keyFilePaths, work.Workloads[i].DeploymentSignature, []byte(work.Workloads[i].Deployment)); !verified {
+					cliutils.Verbose("verification failures for deployment string %d of %s: %v", i+1, id, failures)
+					results = append(results, fmt.Sprintf("%d:unverified", i+1))
+					someInvalid = true
+				} else {
+					cliutils.Verbose("deployment string %d of %s verified with %s", i+1, id, keyFile)
+					results = append(results, fmt.Sprintf("%d:verified", i+1))
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\n", id, strings.Join(results, " "))
+		})
+	})
+	if httpCode == 404 || count == 0 {
+		fmt.Printf("No workloads found in org %s\n", org)
+		return
+	}
+	w.Flush()
+
+	if someInvalid {
+		fmt.Println("Some deployment strings were not signed with the private key associated with any of these public keys.")
+		os.Exit(cliutils.SIGNATURE_INVALID)
+	} else if someUnsigned {
+		fmt.Println("Some deployment strings are unsigned, they were published with --unsigned for development.")
+		os.Exit(cliutils.SIGNATURE_MISSING)
+	} else {
+		fmt.Printf("All signatures of %d workloads verified\n", count)
+	}
+}
+
+// DecodeWorkloadsStream decodes a GET workloads response one workload at a time, calling the input function with each
+// workload's id and definition. Other fields of the response are skipped.
+func DecodeWorkloadsStream(r io.Reader, workloadHandler func(id string, work *exchange.WorkloadDefinition)) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		if field, err := dec.Token(); err != nil {
+			return err
+		} else if field != "workloads" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := expectDelim(dec, '{'); err != nil {
+			return err
+		}
+		for dec.More() {
+			id, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			var work exchange.WorkloadDefinition
+			if err := dec.Decode(&work); err != nil {
+				return fmt.Errorf("unable to decode workload %v: %v", id, err)
+			}
+			workloadHandler(fmt.Sprintf("%v", id), &work)
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// Returns an error if the next token of the decoder is not the input delimiter.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	if t, err := dec.Token(); err != nil {
+		return err
+	} else if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %v but found %v", delim, t)
+	}
+	return nil
+}
+
+// WorkloadResign re-signs the deployment strings of the specified workload resource in the exchange with a new private key,
+// and updates the resource. Nothing but the signatures is changed, which is verified by reading the resource back.
+func WorkloadResign(org, userPw, workload, keyFilePath string) {
+	cliutils.SetWhetherUsingApiKey(userPw)
+	before := getWorkloadDefinition(org, userPw, workload)
+
+	// Re-sign each deployment string exactly as it is stored in the exchange
+	workInput := WorkloadInputFromDefinition(before)
+	for i := range workInput.Workloads {
+		cliutils.Verbose("re-signing deployment string %d", i+1)
+		var err error
+		workInput.Workloads[i].DeploymentSignature, err = sign.Input(keyFilePath, []byte(workInput.Workloads[i].Deployment))
+		if err != nil {
+			cliutils.Fatal(cliutils.CLI_GENERAL_ERROR, "problem signing deployment string %d with %s: %v", i+1, keyFilePath, err)
+		}
+	}
+
+	fmt.Printf("Updating %s in the exchange...\n", workload)
+	cliutils.ExchangePutPost(http.MethodPut, cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads/"+workload, cliutils.OrgAndCreds(org, userPw), []int{201}, workInput)
+
+	// Read the workload back to make sure only the signatures changed
+	after := getWorkloadDefinition(org, userPw, workload)
+	if err := CheckOnlySignaturesChanged(before, after); err != nil {
+		cliutils.Fatal(cliutils.INTERNAL_ERROR, "workload '%s' changed unexpectedly when it was re-signed: %v", workload, err)
+	}
+	for i := range after.Workloads {
+		if after.Workloads[i].DeploymentSignature != workInput.Workloads[i].DeploymentSignature {
+			cliutils.Fatal(cliutils.INTERNAL_ERROR, "the exchange did not store the new signature of deployment string %d", i+1)
+		}
+		fmt.Printf("Deployment string %d new signature: %s\n", i+1, after.Workloads[i].DeploymentSignature)
+	}
+	fmt.Printf("Re-signed %s in the exchange.\n", workload)
+}
+
+// WorkloadCopy copies the specified workload resource in the exchange to a new version, re-signing its deployment strings, and displays
+// the exchange id of the new version. The source workload is left intact.
+func WorkloadCopy(org, userPw, sourceWorkload, newVersion, keyFilePath string, overwrite bool) {
+	pw, err := CopyWorkload(org, userPw, sourceWorkload, newVersion, keyFilePath, overwrite)
+	cliutils.ExitOnError(err)
+	fmt.Printf("%s %s in the exchange.\n", pw.Action, pw.ExchangeId)
+}
+
+// CopyWorkload creates a new version of the specified workload resource in the exchange. Nothing but the version and the deployment
+// string signatures is changed. It is an error if the new version already exists, unless overwrite is set. Like PublishWorkload, it
+// does not exit, a failure is returned as a cliutils.FatalError, and a failure of an exchange request is also written to stderr.
+func CopyWorkload(org, userPw, sourceWorkload, newVersion, keyFilePath string, overwrite bool) (*PublishedWorkload, error) {
+	cliutils.SetWhetherUsingApiKey(userPw)
+	if !policy.IsVersionString(newVersion) {
+		return nil, cliutils.NewFatalError(cliutils.CLI_INPUT_ERROR, "'%s' is not a valid version", newVersion)
+	}
+
+	var source *exchange.WorkloadDefinition
+	if err := cliutils.RecoverFatal(func() { source = getWorkloadDefinition(org, userPw, sourceWorkload) }); err != nil {
+		return nil, err
+	} else if source.Version == newVersion {
+		return nil, cliutils.NewFatalError(cliutils.CLI_INPUT_ERROR, "workload '%s' is already version %s", sourceWorkload, newVersion)
+	}
+
+	// Make sure the new version is not already in the exchange
+	exchId := cliutils.FormExchangeId(source.WorkloadURL, newVersion, source.Arch)
+	var httpCode int
+	if err := cliutils.RecoverFatal(func() {
+		var output string
+		httpCode = cliutils.ExchangeGet(cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads/"+exchId, cliutils.OrgAndCreds(org, userPw), []int{200, 404}, &output)
+	}); err != nil {
+		return nil, err
+	} else if httpCode == 200 && !overwrite {
+		return nil, cliutils.NewFatalError(cliutils.CLI_INPUT_ERROR, "workload '%s' already exists in org %s, specify --overwrite to replace it", exchId, org)
+	}
+
+	// Change the version and re-sign each deployment string exactly as it is stored in the exchange
+	workInput := WorkloadInputFromDefinition(source)
+	workInput.Version = newVersion
+	for i := range workInput.Workloads {
+		cliutils.Verbose("signing deployment string %d", i+1)
+		var err error
+		workInput.Workloads[i].DeploymentSignature, err = sign.Input(keyFilePath, []byte(workInput.Workloads[i].Deployment))
+		if err != nil {
+			return nil, cliutils.NewFatalError(cliutils.CLI_GENERAL_ERROR, "problem signing deployment string %d with %s: %v", i+1, keyFilePath, err)
+		}
+	}
+
+	var action string
+	if err := cliutils.RecoverFatal(func() { action = putWorkload(org, userPw, exchId, &workInput) }); err != nil {
+		return nil, err
+	}
+	return &PublishedWorkload{Arch: workInput.Arch, ExchangeId: exchId, Action: action, Workload: workInput}, nil
+}
+
+// Get the specified workload resource from the exchange, exiting if it does not exist.
+func getWorkloadDefinition(org, userPw, workload string) *exchange.WorkloadDefinition {
+	var output exchange.GetWorkloadsResponse
+	httpCode := cliutils.ExchangeGet(cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads/"+workload, cliutils.OrgAndCreds(org, userPw), []int{200, 404}, &output)
+	if httpCode == 404 {
+		cliutils.Fatal(cliutils.NOT_FOUND, "workload '%s' not found in org %s", workload, org)
+	}
+	work, ok := output.Workloads[org+"/"+workload]
+	if !ok {
+		cliutils.Fatal(cliutils.INTERNAL_ERROR, "key '%s' not found in resources returned from exchange", org+"/"+workload)
+	}
+	return &work
+}
+
+// WorkloadInputFromDefinition returns the input needed to update a workload resource so that it is identical to the input definition.
+func WorkloadInputFromDefinition(def *exchange.WorkloadDefinition) WorkloadInput {
+	workInput := WorkloadInput{Label: def.Label, Description: def.Description, Public: def.Public, WorkloadURL: def.WorkloadURL, Version: def.Version, Arch: def.Arch, DownloadURL: def.DownloadURL, APISpecs: def.APISpecs, UserInputs: def.UserInputs, Workloads: make([]exchange.WorkloadDeployment, len(def.Workloads))}
+	copy(workInput.Workloads, def.Workloads)
+	return workInput
+}
+
+// CheckOnlySignaturesChanged returns an error if the 2 versions of a workload resource differ in anything other than their
+// deployment string signatures. The deployment strings must be byte-identical.
+func CheckOnlySignaturesChanged(before, after *exchange.WorkloadDefinition) error {
+	if len(before.Workloads) != len(after.Workloads) {
+		return fmt.Errorf("the number of deployment strings changed from %d to %d", len(before.Workloads), len(after.Workloads))
+	}
+	for i := range before.Workloads {
+		if before.Workloads[i].Deployment != after.Workloads[i].Deployment {
+			return fmt.Errorf("deployment string %d changed", i+1)
+		} else if before.Workloads[i].Torrent != after.Workloads[i].Torrent {
+			return fmt.Errorf("torrent %d changed", i+1)
+		}
+	}
+
+	// Compare all the other fields, ignoring the signatures and the fields the exchange maintains
+	beforeInput := WorkloadInputFromDefinition(before)
+	afterInput := WorkloadInputFromDefinition(after)
+	for i := range beforeInput.Workloads {
+		beforeInput.Workloads[i].DeploymentSignature = ""
+		afterInput.Workloads[i].DeploymentSignature = ""
+	}
+	if beforeBytes, err := json.Marshal(beforeInput); err != nil {
+		return fmt.Errorf("failed to marshal workload: %v", err)
+	} else if afterBytes, err := json.Marshal(afterInput); err != nil {
+		return fmt.Errorf("failed to marshal workload: %v", err)
+	} else if string(beforeBytes) != string(afterBytes) {
+		return fmt.Errorf("workload metadata changed from %s to %s", beforeBytes, afterBytes)
+	}
+	return nil
+}
+
+// WorkloadImages displays the de-duplicated, sorted list of docker images referenced by the deployment strings of the specified
+// workload resource in the exchange, e.g. to mirror them for an offline installation.
+func WorkloadImages(org, userPw, workload string, jsonOutput bool) {
 	cliutils.SetWhetherUsingApiKey(userPw)
+	work := getWorkloadDefinition(org, userPw, workload)
+
+	imageList, err := WorkloadImageList(work)
+	if err != nil {
+		cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "%v", err)
+	}
+
+	if jsonOutput {
+		jsonBytes, err := json.MarshalIndent(imageList, "", cliutils.JSON_INDENT)
+		if err != nil {
+			cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "failed to marshal 'hzn exchange workload images' output: %v", err)
+		}
+		fmt.Printf("%s\n", jsonBytes)
+	} else {
+		for _, image := range imageList {
+			fmt.Println(image)
+		}
+	}
+}
+
+// WorkloadImageList returns the de-duplicated, sorted list of docker images referenced by the deployment strings of a workload.
+func WorkloadImageList(work *exchange.WorkloadDefinition) ([]string, error) {
+	var imageList []string
+	for i := range work.Workloads {
+		if work.Workloads[i].Deployment == "" {
+			continue
+		}
+		var deployment DeploymentConfig
+		if err := json.Unmarshal([]byte(work.Workloads[i].Deployment), &deployment); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal deployment string %d: %v", i+1, err)
+		}
+		imageList = AppendImagesFromDeploymentField(deployment, imageList)
+	}
+
+	// Remove duplicates, e.g. when several deployment strings use the same image
+	sort.Strings(imageList)
+	uniqueList := make([]string, 0, len(imageList))
+	for _, image := range imageList {
+		if len(uniqueList) == 0 || uniqueList[len(uniqueList)-1] != image {
+			uniqueList = append(uniqueList, image)
+		}
+	}
+	return uniqueList, nil
+}
+
+func WorkloadRemove(org, userPw, workload string, force bool) {
 	if !force {
 		cliutils.ConfirmRemove("Are you sure you want to remove workload '" + org + "/" + workload + "' from the Horizon Exchange?")
 	}
+	cliutils.ExitOnError(RemoveWorkload(org, userPw, workload))
+}
+
+// RemoveWorkload removes the specified workload resource from the exchange, without asking for confirmation. Like PublishWorkload, it
+// does not exit, a failure is returned as a cliutils.FatalError, and a failure of the exchange request is also written to stderr.
+func RemoveWorkload(org, userPw, workload string) error {
+	cliutils.SetWhetherUsingApiKey(userPw)
+	var httpCode int
+	if err := cliutils.RecoverFatal(func() {
+		httpCode = cliutils.ExchangeDelete(cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads/"+workload, cliutils.OrgAndCreds(org, userPw), []int{204, 404})
+	}); err != nil {
+		return err
+	} else if httpCode == 404 {
+		return cliutils.NewFatalError(cliutils.NOT_FOUND, "workload '%s' not found in org %s", workload, org)
+	}
+	return nil
+}
 
-	httpCode := cliutils.ExchangeDelete(cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads/"+workload, cliutils.OrgAndCreds(org, userPw), []int{204, 404})
+// WorkloadFieldDiff is one difference between a local workload file and the copy of the workload in the exchange
+type WorkloadFieldDiff struct {
+	Field    string      `json:"field"`
+	Exchange interface{} `json:"exchange"`
+	Local    interface{} `json:"local"`
+}
+
+// WorkloadDiff compares a local workload file with the workload of the same url, version and arch in the exchange, and displays the
+// fields that a publish of the local file would change.
+func WorkloadDiff(org, userPw, jsonFilePath string, jsonOutput bool) {
+	cliutils.SetWhetherUsingApiKey(userPw)
+	newBytes, err := ResolveDeploymentFiles(cliutils.ReadJsonFile(jsonFilePath), deploymentBaseDir(jsonFilePath))
+	if err != nil {
+		cliutils.Fatal(cliutils.CLI_INPUT_ERROR, "failed to resolve the deployment files of json input file %s: %v", jsonFilePath, err)
+	}
+	var workFile WorkloadFile
+	if err := json.Unmarshal(newBytes, &workFile); err != nil {
+		cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "failed to unmarshal json input file %s: %v", jsonFilePath, err)
+	}
+	if len(workFile.ArchWorkloads) != 0 {
+		cliutils.Fatal(cliutils.CLI_INPUT_ERROR, "json input file %s specifies archWorkloads, which diff does not support. Specify arch and workloads instead.", jsonFilePath)
+	}
+
+	exchId := cliutils.FormExchangeId(workFile.WorkloadURL, workFile.Version, workFile.Arch)
+	var output exchange.GetWorkloadsResponse
+	httpCode := cliutils.ExchangeGet(cliutils.GetExchangeUrl(), "orgs/"+org+"/workloads/"+exchId, cliutils.OrgAndCreds(org, userPw), []int{200, 404}, &output)
 	if httpCode == 404 {
-		cliutils.Fatal(cliutils.NOT_FOUND, "workload '%s' not found in org %s", workload, org)
+		cliutils.Fatal(cliutils.NOT_FOUND, "workload '%s' not found in org %s, publishing it would create it", exchId, org)
+	}
+	work, ok := output.Workloads[org+"/"+exchId]
+	if !ok {
+		cliutils.Fatal(cliutils.INTERNAL_ERROR, "key '%s' not found in resources returned from exchange", org+"/"+exchId)
+	}
+
+	diffs, err := DiffWorkload(&workFile, &work)
+	if err != nil {
+		cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "%v", err)
+	}
+
+	if jsonOutput {
+		jsonBytes, err := json.MarshalIndent(diffs, "", cliutils.JSON_INDENT)
+		if err != nil {
+			cliutils.Fatal(cliutils.JSON_PARSING_ERROR, "failed to marshal 'hzn exchange workload diff' output: %v", err)
+		}
+		fmt.Println(string(jsonBytes))
+		return
+	}
+
+	if len(diffs) == 0 {
+		fmt.Printf("No differences between %s and %s in the exchange.\n", jsonFilePath, exchId)
+		return
+	}
+	for _, d := range diffs {
+		exchBytes, _ := json.Marshal(d.Exchange)
+		localBytes, _ := json.Marshal(d.Local)
+		fmt.Printf("%s:\n  exchange: %s\n  local:    %s\n", d.Field, exchBytes, localBytes)
+	}
+}
+
+// DiffWorkload returns the fields of the local workload file that differ from the exchange workload definition. The deployment strings
+// are compared as json documents. A deployment that differs will be re-signed on publish, so its signature will also change.
+func DiffWorkload(local *WorkloadFile, exch *exchange.WorkloadDefinition) ([]WorkloadFieldDiff, error) {
+	diffs := []WorkloadFieldDiff{}
+	add := func(field string, exchVal, localVal interface{}) {
+		if !reflect.DeepEqual(exchVal, localVal) {
+			diffs = append(diffs, WorkloadFieldDiff{Field: field, Exchange: exchVal, Local: localVal})
+		}
+	}
+
+	add("label", exch.Label, local.Label)
+	add("description", exch.Description, local.Description)
+	add("public", exch.Public, local.Public)
+	add("downloadUrl", exch.DownloadURL, local.DownloadURL)
+	add("apiSpec", normalizeEmpty(exch.APISpecs), normalizeEmpty(local.APISpecs))
+	add("userInput", normalizeEmpty(exch.UserInputs), normalizeEmpty(local.UserInputs))
+	add("workloads (count)", len(exch.Workloads), len(local.Workloads))
+
+	for i := 0; i < len(local.Workloads) && i < len(exch.Workloads); i++ {
+		localDep, err := json.Marshal(local.Workloads[i].Deployment)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal local deployment string %d: %v", i+1, err)
+		}
+		var localDoc, exchDoc interface{}
+		if err := json.Unmarshal(localDep, &localDoc); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal local deployment string %d: %v", i+1, err)
+		}
+		if exch.Workloads[i].Deployment != "" {
+			if err := json.Unmarshal([]byte(exch.Workloads[i].Deployment), &exchDoc); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal exchange deployment string %d: %v", i+1, err)
+			}
+		}
+		if !reflect.DeepEqual(localDoc, exchDoc) {
+			diffs = append(diffs, WorkloadFieldDiff{Field: fmt.Sprintf("workloads[%d].deployment (signature will change)", i), Exchange: exchDoc, Local: localDoc})
+		}
+		add(fmt.Sprintf("workloads[%d].torrent", i), exch.Workloads[i].Torrent, local.Workloads[i].Torrent)
+	}
+	return diffs, nil
+}
+
+// normalizeEmpty converts nil and empty slices to nil so that a missing list and an empty list compare as equal
+func normalizeEmpty(list interface{}) interface{} {
+	if v := reflect.ValueOf(list); v.Kind() == reflect.Slice && v.Len() == 0 {
+		return nil
 	}
+	return list
 }
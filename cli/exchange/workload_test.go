@@ -0,0 +1,692 @@
+// +build unit
+
+package exchange
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	dockerclient "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/anax/cli/cliutils"
+	"github.com/open-horizon/anax/exchange"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_CheckDeploymentSize(t *testing.T) {
+
+	deployment := []byte(`{"services":{"svc":{"image":"example/svc:1.0"}}}`)
+
+	if err := CheckDeploymentSize(deployment, 0, len(deployment)); err != nil {
+		t.Errorf("deployment at the limit should be allowed, error: %v", err)
+	}
+
+	if err := CheckDeploymentSize(deployment, 0, 0); err != nil {
+		t.Errorf("zero limit should mean no limit, error: %v", err)
+	}
+
+	if err := CheckDeploymentSize(deployment, 2, len(deployment)-1); err == nil {
+		t.Errorf("deployment over the limit should not be allowed")
+	} else if !strings.Contains(err.Error(), "number 3") || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Errorf("wrong error for oversized deployment: %v", err)
+	}
+}
+
+func Test_CheckDeploymentRoundTrip(t *testing.T) {
+
+	// A deployment with nested ports, network isolation with both kinds of outbound permits, docker port bindings, and
+	// strings that the json encoder escapes.
+	var dc DeploymentConfig
+	if err := json.Unmarshal([]byte(`{"services":{
+		"gps":{"image":"example/gps:1.0","privileged":true,"environment":["A=<b>&c","B=é "],"command":["/bin/sh","-c","echo \"hi\""],
+			"ports":[{"localhost_only":true,"port_and_protocol":"8080/tcp"}],
+			"network_isolation":{"outbound_permit_only_ignore":"ETH_ACCT_SPECIFIED","outbound_permit_only":["10.0.0.1",{"dd_key":"k","encoding":"JSON","path":"a.b"}]}},
+		"bc":{"image":"example/bc:1.0","binds":["/tmp:/tmp:ro"],"specific_ports":[{"HostIp":"0.0.0.0","HostPort":"30303"}]}}}`), &dc); err != nil {
+		t.Fatalf("unable to parse deployment, error: %v", err)
+	}
+	deployment, err := json.Marshal(dc)
+	if err != nil {
+		t.Fatalf("unable to marshal deployment, error: %v", err)
+	}
+	if err := CheckDeploymentRoundTrip(deployment, 0); err != nil {
+		t.Errorf("marshaled deployment should round trip, error: %v", err)
+	}
+
+	// Bytes that parse to the same deployment but are not what it marshals to are rejected.
+	if err := CheckDeploymentRoundTrip([]byte(`{"services":{"b":{"image":"b","privileged":false},"a":{"image":"a","privileged":false}}}`), 1); err == nil {
+		t.Errorf("deployment with unsorted services should not round trip")
+	} else if !strings.Contains(err.Error(), "number 2") {
+		t.Errorf("wrong error for deployment that does not round trip: %v", err)
+	}
+
+	if err := CheckDeploymentRoundTrip([]byte(`{"services":`), 0); err == nil {
+		t.Errorf("deployment that can not be parsed should not round trip")
+	}
+}
+
+func Test_DiffWorkload(t *testing.T) {
+
+	local := &WorkloadFile{Label: "new label", Description: "desc", Workloads: []WorkloadDeployment{{Torrent: "{}"}}}
+	exch := &exchange.WorkloadDefinition{Label: "old label", Description: "desc", UserInputs: []exchange.UserInput{}, Workloads: []exchange.WorkloadDeployment{{Deployment: `{"services":null}`, Torrent: "{}"}}}
+
+	if diffs, err := DiffWorkload(local, exch); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if len(diffs) != 1 || diffs[0].Field != "label" || diffs[0].Exchange != "old label" || diffs[0].Local != "new label" {
+		t.Errorf("expected only the label to differ, got %v", diffs)
+	}
+
+	exch.Label = "new label"
+	exch.Workloads[0].Deployment = `{"services":{"svc":{"image":"example/svc:1.0"}}}`
+	if diffs, err := DiffWorkload(local, exch); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if len(diffs) != 1 || !strings.Contains(diffs[0].Field, "signature will change") {
+		t.Errorf("expected only the deployment to differ, got %v", diffs)
+	}
+}
+
+func Test_APISpecSatisfied(t *testing.T) {
+
+	microservices := map[string]exchange.MicroserviceDefinition{
+		"myorg/ms1": {SpecRef: "https://example.com/ms1", Version: "1.2.0", Arch: "amd64"},
+	}
+
+	if found, err := APISpecSatisfied(exchange.APISpec{SpecRef: "https://example.com/ms1", Version: "1.0.0", Arch: "amd64"}, microservices); err != nil || !found {
+		t.Errorf("API spec should be satisfied, found %v, error %v", found, err)
+	}
+
+	if found, err := APISpecSatisfied(exchange.APISpec{SpecRef: "https://example.com/ms1", Version: "2.0.0", Arch: "amd64"}, microservices); err != nil || found {
+		t.Errorf("API spec with a higher version should not be satisfied, found %v, error %v", found, err)
+	}
+
+	if found, err := APISpecSatisfied(exchange.APISpec{SpecRef: "https://example.com/ms1", Version: "1.0.0", Arch: "arm"}, microservices); err != nil || found {
+		t.Errorf("API spec with a different arch should not be satisfied, found %v, error %v", found, err)
+	}
+
+	if found, err := APISpecSatisfied(exchange.APISpec{SpecRef: "https://example.com/ms2", Arch: "amd64"}, microservices); err != nil || found {
+		t.Errorf("API spec with a different url should not be satisfied, found %v, error %v", found, err)
+	}
+
+	if _, err := APISpecSatisfied(exchange.APISpec{SpecRef: "https://example.com/ms1", Version: "x.y", Arch: "amd64"}, microservices); err == nil {
+		t.Errorf("API spec with an invalid version should return an error")
+	}
+}
+
+func Test_CheckOnlySignaturesChanged(t *testing.T) {
+
+	before := &exchange.WorkloadDefinition{
+		Owner:       "myorg/me",
+		Label:       "cpu",
+		WorkloadURL: "https://mydomain.com/workload/cpu",
+		Version:     "1.0.0",
+		Arch:        "amd64",
+		APISpecs:    []exchange.APISpec{{SpecRef: "https://mydomain.com/ms/gps", Org: "myorg", Version: "1.0.0", Arch: "amd64"}},
+		Workloads:   []exchange.WorkloadDeployment{{Deployment: `{"services":{"cpu":{"image":"example/cpu:1.0"}}}`, DeploymentSignature: "oldsig"}},
+		LastUpdated: "yesterday",
+	}
+
+	after := *before
+	after.Workloads = []exchange.WorkloadDeployment{{Deployment: before.Workloads[0].Deployment, DeploymentSignature: "newsig"}}
+	after.LastUpdated = "today"
+	if err := CheckOnlySignaturesChanged(before, &after); err != nil {
+		t.Errorf("a new signature should be the only change, error: %v", err)
+	}
+
+	// Whitespace changes in a deployment string are changes, the strings must be byte-identical.
+	after.Workloads = []exchange.WorkloadDeployment{{Deployment: `{"services": {"cpu":{"image":"example/cpu:1.0"}}}`, DeploymentSignature: "newsig"}}
+	if err := CheckOnlySignaturesChanged(before, &after); err == nil || !strings.Contains(err.Error(), "deployment string 1 changed") {
+		t.Errorf("expected deployment string change error, got %v", err)
+	}
+
+	after.Workloads = before.Workloads
+	after.Label = "new label"
+	if err := CheckOnlySignaturesChanged(before, &after); err == nil || !strings.Contains(err.Error(), "metadata changed") {
+		t.Errorf("expected metadata change error, got %v", err)
+	}
+
+	after.Label = before.Label
+	after.Workloads = append(after.Workloads, before.Workloads[0])
+	if err := CheckOnlySignaturesChanged(before, &after); err == nil || !strings.Contains(err.Error(), "number of deployment strings") {
+		t.Errorf("expected deployment count error, got %v", err)
+	}
+}
+
+func Test_WorkloadImageList(t *testing.T) {
+
+	work := &exchange.WorkloadDefinition{
+		Workloads: []exchange.WorkloadDeployment{
+			{Deployment: `{"services":{"cpu":{"image":"example/cpu:1.0"},"gps":{"image":"example/gps:2.0"}}}`},
+			{Deployment: `{"services":{"cpu":{"image":"example/cpu:1.0"},"net":{"image":"registry.example.com/net:1.0"}}}`},
+			{Deployment: ""},
+		},
+	}
+
+	if images, err := WorkloadImageList(work); err != nil {
+		t.Errorf("unexpected error %v", err)
+	} else if strings.Join(images, ",") != "example/cpu:1.0,example/gps:2.0,registry.example.com/net:1.0" {
+		t.Errorf("expected sorted unique images, got %v", images)
+	}
+
+	work.Workloads = append(work.Workloads, exchange.WorkloadDeployment{Deployment: "not json"})
+	if _, err := WorkloadImageList(work); err == nil || !strings.Contains(err.Error(), "deployment string 4") {
+		t.Errorf("expected deployment string error, got %v", err)
+	}
+}
+
+func Test_RegistryAuth(t *testing.T) {
+
+	auths := &dockerclient.AuthConfigurations{Configs: map[string]dockerclient.AuthConfiguration{
+		"https://index.docker.io/v1/": {Username: "hubuser", ServerAddress: "https://index.docker.io/v1/"},
+		"registry.example.com:5000":   {Username: "reguser", ServerAddress: "registry.example.com:5000"},
+	}}
+
+	if auth, ok := RegistryAuth(auths, "docker.io"); !ok || auth.Username != "hubuser" {
+		t.Errorf("expected docker.io credentials, got %v %v", auth, ok)
+	} else if auth, ok := RegistryAuth(auths, "Registry.Example.com:5000"); !ok || auth.Username != "reguser" {
+		t.Errorf("expected registry.example.com:5000 credentials, got %v %v", auth, ok)
+	} else if _, ok := RegistryAuth(auths, "registry.example.com"); ok {
+		t.Errorf("expected no credentials for registry.example.com")
+	}
+}
+
+func Test_DecodeWorkloadsStream(t *testing.T) {
+
+	resp := `{"workloads":{"myorg/wl1":{"workloadUrl":"https://wl1","workloads":[{"deployment":"d1","deployment_signature":"s1"}]},"myorg/wl2":{"workloadUrl":"https://wl2","workloads":[]}},"lastIndex":0}`
+
+	ids := make([]string, 0, 2)
+	if err := DecodeWorkloadsStream(strings.NewReader(resp), func(id string, work *exchange.WorkloadDefinition) {
+		ids = append(ids, id)
+		if id == "myorg/wl1" && (work.WorkloadURL != "https://wl1" || len(work.Workloads) != 1 || work.Workloads[0].Deployment != "d1") {
+			t.Errorf("workload %v not decoded correctly: %v", id, work)
+		}
+	}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if len(ids) != 2 || ids[0] != "myorg/wl1" || ids[1] != "myorg/wl2" {
+		t.Errorf("expected both workloads in order, got %v", ids)
+	}
+
+	if err := DecodeWorkloadsStream(strings.NewReader(`{"workloads":[]}`), func(id string, work *exchange.WorkloadDefinition) {}); err == nil {
+		t.Errorf("expected error for a malformed response")
+	}
+}
+
+func Test_StreamWorkloadList(t *testing.T) {
+
+	resp := `{"workloads":{"myorg/wl1":{"workloadUrl":"https://wl1","workloads":[{"deployment":"d1","deployment_signature":"s1"}]},"myorg/wl2":{"workloadUrl":"https://wl2","workloads":[]}},"lastIndex":0}`
+
+	var names bytes.Buffer
+	if err := StreamWorkloadList(strings.NewReader(resp), &names, true); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if expected := "[\n  \"myorg/wl1\",\n  \"myorg/wl2\"\n]\n"; names.String() != expected {
+		t.Errorf("expected names %q, got %q", expected, names.String())
+	}
+
+	// The streamed workloads are displayed exactly as if the whole response had been marshaled at once.
+	var full bytes.Buffer
+	var whole struct {
+		Workloads map[string]exchange.WorkloadDefinition `json:"workloads"`
+	}
+	if err := StreamWorkloadList(strings.NewReader(resp), &full, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if err := json.Unmarshal([]byte(resp), &whole); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if expected, err := json.MarshalIndent(whole, "", cliutils.JSON_INDENT); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if full.String() != string(expected)+"\n" {
+		t.Errorf("expected %s, got %s", expected, full.String())
+	}
+
+	var empty bytes.Buffer
+	if err := StreamWorkloadList(strings.NewReader("{}"), &empty, true); err != nil || empty.String() != "[]\n" {
+		t.Errorf("expected an empty list, got %q, error %v", empty.String(), err)
+	}
+}
+
+func Test_ResolveDeploymentFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "deployment")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "good.json"), []byte(`/* comment */ {"services":{"svc":{"image":"example/svc:1.0"}}}`), 0600); err != nil {
+		t.Fatalf("unable to write deployment file: %v", err)
+	} else if err := ioutil.WriteFile(filepath.Join(dir, "bad.json"), []byte(`{"services":`), 0600); err != nil {
+		t.Fatalf("unable to write deployment file: %v", err)
+	}
+
+	// A relative reference is read from the base dir, and an inline deployment is left alone.
+	input := []byte(`{"label":"wl","workloads":[{"deployment":"@good.json","torrent":""},{"deployment":{"services":{"other":{"image":"example/other:1.0"}}}}]}`)
+	var workFile WorkloadFile
+	if resolved, err := ResolveDeploymentFiles(input, dir); err != nil {
+		t.Errorf("unexpected error resolving deployment files: %v", err)
+	} else if err := json.Unmarshal(resolved, &workFile); err != nil {
+		t.Errorf("resolved workload file does not unmarshal: %v", err)
+	} else if workFile.Label != "wl" || len(workFile.Workloads) != 2 {
+		t.Errorf("resolved workload file lost fields: %v", workFile)
+	} else if workFile.Workloads[0].Deployment.Services["svc"].Image != "example/svc:1.0" {
+		t.Errorf("deployment file was not inlined: %v", workFile.Workloads[0].Deployment)
+	} else if workFile.Workloads[1].Deployment.Services["other"].Image != "example/other:1.0" {
+		t.Errorf("inline deployment was changed: %v", workFile.Workloads[1].Deployment)
+	}
+
+	// References in archWorkloads are resolved too.
+	input = []byte(`{"archWorkloads":[{"arch":"arm","workloads":[{"deployment":"@good.json"}]}]}`)
+	workFile = WorkloadFile{}
+	if resolved, err := ResolveDeploymentFiles(input, dir); err != nil {
+		t.Errorf("unexpected error resolving deployment files: %v", err)
+	} else if err := json.Unmarshal(resolved, &workFile); err != nil {
+		t.Errorf("resolved workload file does not unmarshal: %v", err)
+	} else if len(workFile.ArchWorkloads) != 1 || workFile.ArchWorkloads[0].Arch != "arm" || workFile.ArchWorkloads[0].Workloads[0].Deployment.Services["svc"].Image != "example/svc:1.0" {
+		t.Errorf("arch deployment file was not inlined: %v", workFile.ArchWorkloads)
+	}
+
+	// Without references the input is returned unchanged.
+	input = []byte(`{"label":"wl","workloads":[{"deployment":{"services":{}}}]}`)
+	if resolved, err := ResolveDeploymentFiles(input, dir); err != nil {
+		t.Errorf("unexpected error resolving deployment files: %v", err)
+	} else if string(resolved) != string(input) {
+		t.Errorf("input without references was changed: %s", resolved)
+	}
+
+	// Missing and invalid files are errors that name the file.
+	for _, name := range []string{"missing.json", "bad.json"} {
+		input = []byte(`{"workloads":[{"deployment":"@` + name + `"}]}`)
+		if _, err := ResolveDeploymentFiles(input, dir); err == nil {
+			t.Errorf("expected an error for deployment file %v", name)
+		} else if !strings.Contains(err.Error(), filepath.Join(dir, name)) {
+			t.Errorf("error for deployment file %v does not name the file: %v", name, err)
+		}
+	}
+}
+
+func Test_WorkloadFile_PerArch(t *testing.T) {
+
+	supported := []string{"amd64", "arm"}
+
+	// A single arch file is returned as it is.
+	single := &WorkloadFile{WorkloadURL: "https://example/wl", Arch: "amd64", Workloads: []WorkloadDeployment{{Torrent: "{}"}}}
+	if files, err := single.PerArch(supported); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if len(files) != 1 || files[0].Arch != "amd64" {
+		t.Errorf("single arch file was changed: %v", files)
+	}
+
+	multi := &WorkloadFile{
+		WorkloadURL: "https://example/wl",
+		APISpecs:    []exchange.APISpec{{SpecRef: "https://example/ms"}, {SpecRef: "https://example/other", Arch: "amd64"}},
+		ArchWorkloads: []ArchWorkloads{
+			{Arch: "amd64", Workloads: []WorkloadDeployment{{Torrent: "amd64"}}},
+			{Arch: "arm", Workloads: []WorkloadDeployment{{Torrent: "arm"}}},
+		},
+	}
+	if files, err := multi.PerArch(supported); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if len(files) != 2 {
+		t.Errorf("expected 2 arch files, got %v", files)
+	} else {
+		for _, f := range files {
+			if f.WorkloadURL != "https://example/wl" || len(f.ArchWorkloads) != 0 || len(f.Workloads) != 1 || f.Workloads[0].Torrent != f.Arch {
+				t.Errorf("wrong arch file for %v: %v", f.Arch, f)
+			} else if f.APISpecs[0].Arch != f.Arch || f.APISpecs[1].Arch != "amd64" {
+				t.Errorf("wrong api spec arches for %v: %v", f.Arch, f.APISpecs)
+			}
+		}
+		if multi.APISpecs[0].Arch != "" {
+			t.Errorf("the api specs of the input file were changed: %v", multi.APISpecs)
+		}
+	}
+
+	for _, bad := range []*WorkloadFile{
+		{Arch: "amd64", ArchWorkloads: []ArchWorkloads{{Arch: "arm", Workloads: []WorkloadDeployment{{}}}}},
+		{ArchWorkloads: []ArchWorkloads{{Arch: "arm", Workloads: []WorkloadDeployment{{}}}, {Arch: "arm", Workloads: []WorkloadDeployment{{}}}}},
+		{ArchWorkloads: []ArchWorkloads{{Arch: "ppc64le", Workloads: []WorkloadDeployment{{}}}}},
+		{ArchWorkloads: []ArchWorkloads{{Arch: "arm"}}},
+		{ArchWorkloads: []ArchWorkloads{{Workloads: []WorkloadDeployment{{}}}}},
+	} {
+		if _, err := bad.PerArch(supported); err == nil {
+			t.Errorf("expected an error for %v", bad.ArchWorkloads)
+		}
+	}
+}
+
+func Test_SupportedWorkloadArches(t *testing.T) {
+
+	defer os.Unsetenv("HZN_WORKLOAD_ARCHES")
+	os.Unsetenv("HZN_WORKLOAD_ARCHES")
+
+	if arches := SupportedWorkloadArches(nil); len(arches) != len(DefaultWorkloadArches) {
+		t.Errorf("expected the default arches, got %v", arches)
+	}
+
+	os.Setenv("HZN_WORKLOAD_ARCHES", "amd64, s390x")
+	if arches := SupportedWorkloadArches(nil); len(arches) != 2 || arches[1] != "s390x" {
+		t.Errorf("expected the arches in HZN_WORKLOAD_ARCHES, got %v", arches)
+	} else if arches := SupportedWorkloadArches([]string{"arm"}); len(arches) != 1 || arches[0] != "arm" {
+		t.Errorf("expected the input arches, got %v", arches)
+	}
+}
+
+func Test_WorkloadFilesInDir(t *testing.T) {
+
+	verbose := false
+	cliutils.Opts.Verbose = &verbose
+
+	dir, err := ioutil.TempDir("", "workload-files-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"b-gps.json":           `{"workloadUrl":"https://example.com/gps","workloads":[{"deployment":"@gps-deployment.json"}]}`,
+		"a-cpu.json":           `/* the cpu workload */ {"workloadUrl":"https://example.com/cpu"}`,
+		"gps-deployment.json":  `{"services":{"gps":{"image":"example/gps:1.0"}}}`,
+		"notes.txt":            `{"workloadUrl":"https://example.com/notes"}`,
+		"not-json-at-all.json": `workloadUrl`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if files, err := WorkloadFilesInDir(dir); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if len(files) != 2 || files[0] != filepath.Join(dir, "a-cpu.json") || files[1] != filepath.Join(dir, "b-gps.json") {
+		t.Errorf("expected the 2 workload files sorted by name, got %v", files)
+	}
+}
+
+func Test_RecoverFatal(t *testing.T) {
+
+	if err := cliutils.RecoverFatal(func() { cliutils.Fatal(cliutils.HTTP_ERROR, "publishing %s failed", "cpu") }); err == nil {
+		t.Errorf("expected the fatal error to be returned")
+	} else if fErr, ok := err.(cliutils.FatalError); !ok || fErr.ExitCode != cliutils.HTTP_ERROR || fErr.Msg != "publishing cpu failed" {
+		t.Errorf("expected a fatal error with the exit code and message, got %v", err)
+	}
+
+	if err := cliutils.RecoverFatal(func() {}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func Test_PublishWorkload_org_mismatch(t *testing.T) {
+
+	verbose := false
+	cliutils.Opts.Verbose = &verbose
+
+	dir, err := ioutil.TempDir("", "workload-publish-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonFile := filepath.Join(dir, "cpu.json")
+	if err := ioutil.WriteFile(jsonFile, []byte(`{"org":"otherorg","workloadUrl":"https://example.com/cpu","version":"1.0.0","arch":"amd64"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The error is returned instead of exiting, and nothing is published.
+	if result, err := PublishWorkload("myorg", "user:pw", jsonFile, "key.pem", 0, false, nil, false, "", false); err == nil {
+		t.Errorf("expected an error for the mismatched org")
+	} else if fErr, ok := err.(cliutils.FatalError); !ok || fErr.ExitCode != cliutils.CLI_INPUT_ERROR {
+		t.Errorf("expected a fatal error with exit code %v, got %v", cliutils.CLI_INPUT_ERROR, err)
+	} else if result == nil || len(result.Workloads) != 0 {
+		t.Errorf("expected an empty result, got %v", result)
+	}
+}
+
+func Test_PublishWorkload_unsigned(t *testing.T) {
+
+	verbose := false
+	dryRun := false
+	cliutils.Opts.Verbose = &verbose
+	cliutils.Opts.IsDryRun = &dryRun
+
+	dir, err := ioutil.TempDir("", "workload-publish-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonFile := filepath.Join(dir, "cpu.json")
+	if err := ioutil.WriteFile(jsonFile, []byte(`{"workloadUrl":"https://example.com/cpu","version":"1.0.0","arch":"amd64","workloads":[{"deployment":{"services":{"cpu":{"image":"cpu:1.0.0"}}}}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The exchange stores the published workload, and returns it when it is verified.
+	var written *WorkloadInput
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			written = &WorkloadInput{}
+			json.NewDecoder(r.Body).Decode(written)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		case written != nil:
+			def := exchange.WorkloadDefinition{WorkloadURL: written.WorkloadURL, Version: written.Version, Arch: written.Arch, Workloads: written.Workloads}
+			json.NewEncoder(w).Encode(exchange.GetWorkloadsResponse{Workloads: map[string]exchange.WorkloadDefinition{"myorg/cpu": def}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("HZN_EXCHANGE_URL", server.URL)
+	defer os.Unsetenv("HZN_EXCHANGE_URL")
+
+	// A private key is required unless the workload is published unsigned, and can not be used with it.
+	for keyFile, unsigned := range map[string]bool{"": false, "key.pem": true} {
+		if _, err := PublishWorkload("myorg", "user:pw", jsonFile, keyFile, 0, false, nil, false, "", unsigned); err == nil {
+			t.Errorf("expected an error publishing with key file %v and unsigned %v", keyFile, unsigned)
+		} else if fErr, ok := err.(cliutils.FatalError); !ok || fErr.ExitCode != cliutils.CLI_INPUT_ERROR {
+			t.Errorf("expected a fatal error with exit code %v, got %v", cliutils.CLI_INPUT_ERROR, err)
+		}
+	}
+	if written != nil {
+		t.Errorf("expected nothing to be published, got %v", written)
+	}
+
+	if result, err := PublishWorkload("myorg", "user:pw", jsonFile, "", 0, false, nil, false, "", true); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if len(result.Workloads) != 1 || result.Workloads[0].Action != "Created" {
+		t.Errorf("expected the workload to be created, got %v", result)
+	} else if written == nil || len(written.Workloads) != 1 || written.Workloads[0].Deployment == "" || written.Workloads[0].DeploymentSignature != "" {
+		t.Errorf("expected an unsigned deployment to be published, got %v", written)
+	}
+
+	// The unsigned deployment is reported as unsigned, not as invalid, without needing the public key.
+	if result, err := VerifyWorkload("myorg", "user:pw", "cpu", "key.pem"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if len(result.Unsigned) != 1 || result.Unsigned[0] != 1 || len(result.Invalid) != 0 || len(result.Verified) != 0 {
+		t.Errorf("expected deployment string 1 to be unsigned, got %v", result)
+	}
+}
+
+// The API specs of every arch are checked before any arch is published, so that a missing microservice of one arch does not leave
+// the others published.
+func Test_PublishWorkload_multiarch_apispecs(t *testing.T) {
+
+	verbose := false
+	dryRun := false
+	cliutils.Opts.Verbose = &verbose
+	cliutils.Opts.IsDryRun = &dryRun
+
+	dir, err := ioutil.TempDir("", "workload-publish-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jsonFile := filepath.Join(dir, "cpu.json")
+	if err := ioutil.WriteFile(jsonFile, []byte(`{"workloadUrl":"https://example.com/cpu","version":"1.0.0","apiSpec":[{"specRef":"https://example.com/ms"}],"archWorkloads":[{"arch":"amd64","workloads":[{"deployment":{"services":{"cpu":{"image":"cpu:1.0.0"}}}}]},{"arch":"arm","workloads":[{"deployment":{"services":{"cpu":{"image":"cpu-arm:1.0.0"}}}}]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The exchange has the required microservice for amd64 only, and records the workloads published.
+	published := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			var written WorkloadInput
+			json.NewDecoder(r.Body).Decode(&written)
+			published = append(published, written.Arch)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		case strings.HasSuffix(r.URL.Path, "/microservices") && r.URL.Query().Get("arch") == "amd64":
+			ms := exchange.MicroserviceDefinition{SpecRef: "https://example.com/ms", Version: "1.0.0", Arch: "amd64"}
+			json.NewEncoder(w).Encode(exchange.GetMicroservicesResponse{Microservices: map[string]exchange.MicroserviceDefinition{"myorg/ms": ms}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("HZN_EXCHANGE_URL", server.URL)
+	defer os.Unsetenv("HZN_EXCHANGE_URL")
+
+	if result, err := PublishWorkload("myorg", "user:pw", jsonFile, "", 0, true, []string{"amd64", "arm"}, false, "", true); err == nil {
+		t.Errorf("expected an error for the missing arm microservice")
+	} else if fErr, ok := err.(cliutils.FatalError); !ok || fErr.ExitCode != cliutils.CLI_INPUT_ERROR {
+		t.Errorf("expected a fatal error with exit code %v, got %v", cliutils.CLI_INPUT_ERROR, err)
+	} else if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "arch arm") {
+		t.Errorf("expected a warning for the arm API spec, got %v", result.Warnings)
+	} else if len(published) != 0 || len(result.Workloads) != 0 {
+		t.Errorf("expected no arch to be published, got %v", published)
+	}
+
+	// Without requiring the API specs, every arch is published with the warning.
+	if result, err := PublishWorkload("myorg", "user:pw", jsonFile, "", 0, false, []string{"amd64", "arm"}, false, "", true); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if len(result.Warnings) != 1 || len(result.Workloads) != 2 || len(published) != 2 {
+		t.Errorf("expected both arches to be published with one warning, got %v, published %v", result, published)
+	}
+}
+
+func Test_RemoveWorkload_VerifyWorkload(t *testing.T) {
+
+	verbose := false
+	dryRun := false
+	cliutils.Opts.Verbose = &verbose
+	cliutils.Opts.IsDryRun = &dryRun
+
+	deleted := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/workloads/cpu") {
+			deleted = r.URL.Path
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	os.Setenv("HZN_EXCHANGE_URL", server.URL)
+	defer os.Unsetenv("HZN_EXCHANGE_URL")
+
+	if err := RemoveWorkload("myorg", "user:pw", "cpu"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if deleted != "/orgs/myorg/workloads/cpu" {
+		t.Errorf("expected the workload to be deleted, got %v", deleted)
+	}
+
+	if err := RemoveWorkload("myorg", "user:pw", "gps"); err == nil {
+		t.Errorf("expected an error removing a workload that does not exist")
+	} else if fErr, ok := err.(cliutils.FatalError); !ok || fErr.ExitCode != cliutils.NOT_FOUND {
+		t.Errorf("expected a fatal error with exit code %v, got %v", cliutils.NOT_FOUND, err)
+	}
+
+	if result, err := VerifyWorkload("myorg", "user:pw", "gps", "key.pem"); err == nil {
+		t.Errorf("expected an error verifying a workload that does not exist, got %v", result)
+	} else if fErr, ok := err.(cliutils.FatalError); !ok || fErr.ExitCode != cliutils.NOT_FOUND {
+		t.Errorf("expected a fatal error with exit code %v, got %v", cliutils.NOT_FOUND, err)
+	}
+}
+
+func Test_CopyWorkload(t *testing.T) {
+
+	verbose := false
+	dryRun := false
+	cliutils.Opts.Verbose = &verbose
+	cliutils.Opts.IsDryRun = &dryRun
+
+	dir, err := ioutil.TempDir("", "workload-copy-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "private.pem")
+	if privateKey, err := rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The exchange has versions 1.0.0 and 1.0.1 of the workload.
+	deployment := `{"services":{"cpu":{"image":"cpu:1.0.0"}}}`
+	existing := map[string]exchange.WorkloadDefinition{}
+	for _, v := range []string{"1.0.0", "1.0.1"} {
+		existing["myorg/example.com-cpu_"+v+"_amd64"] = exchange.WorkloadDefinition{WorkloadURL: "https://example.com/cpu", Version: v, Arch: "amd64", Workloads: []exchange.WorkloadDeployment{exchange.WorkloadDeployment{Deployment: deployment, DeploymentSignature: "oldsig"}}}
+	}
+	var written []WorkloadInput
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			id := strings.TrimPrefix(r.URL.Path, "/orgs/myorg/workloads/")
+			if work, ok := existing["myorg/"+id]; ok {
+				json.NewEncoder(w).Encode(exchange.GetWorkloadsResponse{Workloads: map[string]exchange.WorkloadDefinition{"myorg/" + id: work}})
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{}`))
+		default:
+			var input WorkloadInput
+			json.NewDecoder(r.Body).Decode(&input)
+			written = append(written, input)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("HZN_EXCHANGE_URL", server.URL)
+	defer os.Unsetenv("HZN_EXCHANGE_URL")
+
+	if _, err := CopyWorkload("myorg", "user:pw", "example.com-cpu_1.0.0_amd64", "not-a-version", keyFile, false); err == nil {
+		t.Errorf("expected an error for an invalid version")
+	} else if fErr, ok := err.(cliutils.FatalError); !ok || fErr.ExitCode != cliutils.CLI_INPUT_ERROR {
+		t.Errorf("expected a fatal error with exit code %v, got %v", cliutils.CLI_INPUT_ERROR, err)
+	}
+
+	if _, err := CopyWorkload("myorg", "user:pw", "example.com-cpu_1.0.0_amd64", "1.0.1", keyFile, false); err == nil {
+		t.Errorf("expected an error copying to a version that already exists")
+	} else if fErr, ok := err.(cliutils.FatalError); !ok || fErr.ExitCode != cliutils.CLI_INPUT_ERROR {
+		t.Errorf("expected a fatal error with exit code %v, got %v", cliutils.CLI_INPUT_ERROR, err)
+	} else if len(written) != 0 {
+		t.Errorf("expected nothing to be written to the exchange, got %v", written)
+	}
+
+	if pw, err := CopyWorkload("myorg", "user:pw", "example.com-cpu_1.0.0_amd64", "2.0.0", keyFile, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if pw.ExchangeId != "example.com-cpu_2.0.0_amd64" || pw.Action != "Created" {
+		t.Errorf("expected example.com-cpu_2.0.0_amd64 to be created, got %v", pw)
+	} else if len(written) != 1 {
+		t.Errorf("expected only the new version to be written to the exchange, got %v", written)
+	} else if w := written[0]; w.Version != "2.0.0" || w.WorkloadURL != "https://example.com/cpu" || len(w.Workloads) != 1 || w.Workloads[0].Deployment != deployment {
+		t.Errorf("expected only the version to change, got %v", w)
+	} else if sig := w.Workloads[0].DeploymentSignature; sig == "" || sig == "oldsig" {
+		t.Errorf("expected the deployment to be re-signed, got signature %v", sig)
+	}
+}
@@ -36,6 +36,7 @@ Environment Variables:
   HZN_ORG_ID:  default value for the 'hzn exchange -o' or 'hzn wiotp -o' flag, to specify the organization ID'.
   HZN_EXCHANGE_USER_AUTH:  default value for the 'hzn exchange -u' or 'hzn register -u' flag, in the form '[org/]user:pw'.
   HZN_EXCHANGE_API_AUTH:  default value for the 'hzn wiotp -A' flag, in the form 'apikey:apitoken'.
+  HZN_WORKLOAD_ARCHES:  default value for the 'hzn exchange workload publish --arch' flag, as a comma separated list of arches.
   USING_API_KEY:  Set this to "0" to indicate that even though the credential passed into the 'hzn exchange -u' flag looks like an WIoTP API key/token, it is not so Horizon should not interpret as such.
 `)
 	app.HelpFlag.Short('h')
@@ -112,11 +113,49 @@ Environment Variables:
 	exWorkload := exWorkloadListCmd.Arg("workload", "List just this one workload.").String()
 	exWorkloadLong := exWorkloadListCmd.Flag("long", "When listing all of the workloads, show the entire resource of each workloads, instead of just the name.").Short('l').Bool()
 	exWorkloadPublishCmd := exWorkloadCmd.Command("publish", "Sign and create/update the workload resource in the Horizon Exchange.")
-	exWorkJsonFile := exWorkloadPublishCmd.Flag("json-file", "The path of a JSON file containing the metadata necessary to create/update the workload in the Horizon exchange. See /usr/horizon/samples/workload.json. Specify -f- to read from stdin.").Short('f').Required().String()
-	exWorkPrivKeyFile := exWorkloadPublishCmd.Flag("private-key-file", "The path of a private key file to be used to sign the workload. ").Short('k').Required().ExistingFile()
+	exWorkJsonFile := exWorkloadPublishCmd.Flag("json-file", "The path of a JSON file containing the metadata necessary to create/update the workload in the Horizon exchange. See /usr/horizon/samples/workload.json. A deployment can be given as '@<file>' to read it from a JSON file, relative to the directory of this file. Specify -f- to read from stdin.").Short('f').Required().String()
+	exWorkPrivKeyFile := exWorkloadPublishCmd.Flag("private-key-file", "The path of a private key file to be used to sign the workload. Required unless --unsigned is specified.").Short('k').ExistingFile()
+	exWorkMaxDeploymentSize := exWorkloadPublishCmd.Flag("max-deployment-size", "The maximum size, in bytes, of each deployment string. Publishing fails if any deployment string is larger than this.").Default("1048576").Int()
+	exWorkRequireAPISpecs := exWorkloadPublishCmd.Flag("require-api-specs", "Fail instead of warning when a microservice required by the workload is not in the Horizon Exchange. The microservices of every arch are checked before any arch is published.").Bool()
+	exWorkPinDigests := exWorkloadPublishCmd.Flag("pin-digests", "Resolve the current digest of each docker image from its registry and rewrite the deployments to use image@digest before signing them, so that the signatures cover the exact images. Requires credentials for every registry in the docker config file.").Bool()
+	exWorkDockerConfigFile := exWorkloadPublishCmd.Flag("docker-config-file", "The path of the docker config file containing the registry credentials used with --pin-digests. Defaults to ~/.docker/config.json.").String()
+	exWorkUnsigned := exWorkloadPublishCmd.Flag("unsigned", "FOR DEVELOPMENT ONLY: publish the deployment strings without signatures, so that no private key is needed. Edge nodes verify the signatures of deployment strings, so they, and possibly the exchange or agbots, will reject an unsigned workload. Sign it with 'hzn exchange workload resign' before using it for anything but development.").Bool()
+	exWorkArches := exWorkloadPublishCmd.Flag("arch", "An arch that the archWorkloads in the json file can be published for. Can be specified multiple times. Defaults to the comma separated arches in HZN_WORKLOAD_ARCHES, or amd64, arm, arm64 and ppc64le.").Strings()
+	exWorkloadPublishDirCmd := exWorkloadCmd.Command("publishdir", "Sign and create/update a workload resource in the Horizon Exchange for each workload file in a directory, and display a summary of the results.")
+	exWorkPubDir := exWorkloadPublishDirCmd.Arg("directory", "The directory containing the workload files. Every *.json file with a workloadUrl is published, other json files, e.g. deployment files, are ignored.").Required().ExistingDir()
+	exWorkPubDirPrivKeyFile := exWorkloadPublishDirCmd.Flag("private-key-file", "The path of a private key file to be used to sign the workloads. Required unless --unsigned is specified.").Short('k').ExistingFile()
+	exWorkPubDirMaxDeploymentSize := exWorkloadPublishDirCmd.Flag("max-deployment-size", "The maximum size, in bytes, of each deployment string. Publishing a workload fails if any of its deployment strings is larger than this.").Default("1048576").Int()
+	exWorkPubDirRequireAPISpecs := exWorkloadPublishDirCmd.Flag("require-api-specs", "Fail instead of warning when a microservice required by a workload is not in the Horizon Exchange.").Bool()
+	exWorkPubDirPinDigests := exWorkloadPublishDirCmd.Flag("pin-digests", "Resolve the current digest of each docker image from its registry and rewrite the deployments to use image@digest before signing them.").Bool()
+	exWorkPubDirDockerConfigFile := exWorkloadPublishDirCmd.Flag("docker-config-file", "The path of the docker config file containing the registry credentials used with --pin-digests. Defaults to ~/.docker/config.json.").String()
+	exWorkPubDirArches := exWorkloadPublishDirCmd.Flag("arch", "An arch that the archWorkloads in the json files can be published for. Can be specified multiple times. Defaults to the comma separated arches in HZN_WORKLOAD_ARCHES, or amd64, arm, arm64 and ppc64le.").Strings()
+	exWorkPubDirUnsigned := exWorkloadPublishDirCmd.Flag("unsigned", "FOR DEVELOPMENT ONLY: publish the deployment strings without signatures, see 'hzn exchange workload publish --unsigned'.").Bool()
+	exWorkPubDirFailFast := exWorkloadPublishDirCmd.Flag("fail-fast", "Stop at the first workload file that fails to publish, instead of publishing the rest.").Bool()
+	exWorkloadDiffCmd := exWorkloadCmd.Command("diff", "Show the differences between a local workload file and the copy of the workload in the Horizon Exchange.")
+	exWorkDiffJsonFile := exWorkloadDiffCmd.Flag("json-file", "The path of a JSON file containing the workload metadata, in the same format used by 'hzn exchange workload publish'. Specify -f- to read from stdin.").Short('f').Required().String()
+	exWorkDiffJson := exWorkloadDiffCmd.Flag("json", "Display the differences in json format.").Bool()
 	exWorkloadVerifyCmd := exWorkloadCmd.Command("verify", "Verify the signatures of a workload resource in the Horizon Exchange.")
 	exVerWorkload := exWorkloadVerifyCmd.Arg("workload", "The workload to verify.").Required().String()
 	exWorkPubKeyFile := exWorkloadVerifyCmd.Flag("public-key-file", "The path of a pem public key file to be used to verify the workload. ").Short('k').Required().ExistingFile()
+	exWorkloadVerifyLocalCmd := exWorkloadCmd.Command("verifylocal", "Verify the signatures of a workload definition in a local file, without contacting the Horizon Exchange.")
+	exVerLocalWorkJsonFile := exWorkloadVerifyLocalCmd.Flag("json-file", "The path of a JSON file containing the workload definition, as displayed by 'hzn exchange workload list <workload>'. Specify -f- to read from stdin.").Short('f').Required().String()
+	exVerLocalWorkPubKeyFiles := exWorkloadVerifyLocalCmd.Flag("public-key-file", "The path of a pem public key file to be used to verify the workload. Can be specified multiple times, the signatures are valid if they verify with any of the keys.").Short('k').Required().ExistingFiles()
+	exWorkloadVerifyAllCmd := exWorkloadCmd.Command("verifyall", "Verify the signatures of all of the workload resources in the org in the Horizon Exchange, and display a summary.")
+	exVerAllWorkPubKeyFiles := exWorkloadVerifyAllCmd.Flag("public-key-file", "The path of a pem public key file to be used to verify the workloads. Can be specified multiple times, the signatures are valid if they verify with any of the keys.").Short('k').Required().ExistingFiles()
+	exWorkloadResignCmd := exWorkloadCmd.Command("resign", "Re-sign the deployment strings of a workload resource in the Horizon Exchange with a new private key. Nothing but the signatures is changed.")
+	exResignWorkload := exWorkloadResignCmd.Arg("workload", "The workload to re-sign.").Required().String()
+	exResignWorkPrivKeyFile := exWorkloadResignCmd.Flag("private-key-file", "The path of the new private key file to be used to sign the workload. ").Short('k').Required().ExistingFile()
+	exWorkloadCopyCmd := exWorkloadCmd.Command("copy", "Copy a workload resource in the Horizon Exchange to a new version, re-signing its deployment strings. Nothing but the version and the signatures is changed, and the source workload is left intact.")
+	exCopyWorkload := exWorkloadCopyCmd.Arg("workload", "The workload to copy.").Required().String()
+	exCopyVersion := exWorkloadCopyCmd.Arg("version", "The version of the new workload resource.").Required().String()
+	exCopyWorkPrivKeyFile := exWorkloadCopyCmd.Flag("private-key-file", "The path of a private key file to be used to sign the new workload. ").Short('k').Required().ExistingFile()
+	exCopyOverwrite := exWorkloadCopyCmd.Flag("overwrite", "Replace the new version of the workload if it already exists in the Horizon Exchange.").Bool()
+	exWorkloadImagesCmd := exWorkloadCmd.Command("images", "List the docker images referenced by a workload resource in the Horizon Exchange, e.g. to mirror them for an offline installation.")
+	exImagesWorkload := exWorkloadImagesCmd.Arg("workload", "The workload whose images should be listed.").Required().String()
+	exImagesJson := exWorkloadImagesCmd.Flag("json", "Display the images as a json array.").Bool()
+	exWorkloadCheckRegistryCmd := exWorkloadCmd.Command("checkregistry", "Check that the docker registry accepts your credentials for it, before pushing the workload's docker images. The credentials are read from your docker config file.")
+	exCheckRegistry := exWorkloadCheckRegistryCmd.Arg("registry", "The registry domain to check, e.g. docker.io or registry.example.com:5000.").Required().String()
+	exCheckRegistryConfigFile := exWorkloadCheckRegistryCmd.Flag("docker-config-file", "The path of the docker config file containing the registry credentials. Defaults to ~/.docker/config.json.").String()
 	exWorkDelCmd := exWorkloadCmd.Command("remove", "Remove a workload resource from the Horizon Exchange.")
 	exDelWork := exWorkDelCmd.Arg("workload", "The workload to remove.").Required().String()
 	exWorkDelForce := exWorkDelCmd.Flag("force", "Skip the 'are you sure?' prompt.").Short('f').Bool()
@@ -241,6 +280,11 @@ Environment Variables:
 	agbotAgreementCancelCmd := agbotAgreementCmd.Command("cancel", "Cancel 1 or all of the active agreements this Horizon agreement bot has with edge nodes. Usually an agbot will immediately negotiated a new agreement. ")
 	agbotCancelAllAgreements := agbotAgreementCancelCmd.Flag("all", "Cancel all of the current agreements.").Short('a').Bool()
 	agbotCancelAgreementId := agbotAgreementCancelCmd.Arg("agreement", "The active agreement to cancel.").String()
+	agbotCancelReason := agbotAgreementCancelCmd.Flag("reason", "The reason for cancelling, recorded on the archived agreements to tell them apart from automated cancels.").String()
+
+	agbotDeferredCancelCmd := agbotCmd.Command("deferredcancel", "List or flush the blockchain cancels this Horizon agreement bot has deferred until the blockchains of their agreements are writable.")
+	agbotDeferredCancelListCmd := agbotDeferredCancelCmd.Command("list", "List the deferred blockchain cancels of each agreement protocol.")
+	agbotDeferredCancelFlushCmd := agbotDeferredCancelCmd.Command("flush", "Attempt the deferred blockchain cancels now, even if the blockchains of their agreements are not known to be writable.")
 
 	app.Version("Run 'hzn version' to see the Horizon version.")
 	/* trying to override the base --version behavior does not work....
@@ -254,7 +298,7 @@ Environment Variables:
 	// Parse cmd and apply env var defaults
 	fullCmd := kingpin.MustParse(app.Parse(os.Args[1:]))
 	cliutils.Verbose("Full command: %s", fullCmd)
-	if strings.HasPrefix(fullCmd, "exchange") {
+	if strings.HasPrefix(fullCmd, "exchange") && fullCmd != exWorkloadVerifyLocalCmd.FullCommand() {
 		exOrg = cliutils.RequiredWithDefaultEnvVar(exOrg, "HZN_ORG_ID", "organization ID must be specified with either the -o flag or HZN_ORG_ID")
 		exUserPw = cliutils.RequiredWithDefaultEnvVar(exUserPw, "HZN_EXCHANGE_USER_AUTH", "exchange user authenication must be specified with either the -u flag or HZN_EXCHANGE_USER_AUTH")
 	}
@@ -305,9 +349,25 @@ Environment Variables:
 	case exWorkloadListCmd.FullCommand():
 		exchange.WorkloadList(*exOrg, *exUserPw, *exWorkload, !*exWorkloadLong)
 	case exWorkloadPublishCmd.FullCommand():
-		exchange.WorkloadPublish(*exOrg, *exUserPw, *exWorkJsonFile, *exWorkPrivKeyFile)
+		exchange.WorkloadPublish(*exOrg, *exUserPw, *exWorkJsonFile, *exWorkPrivKeyFile, *exWorkMaxDeploymentSize, *exWorkRequireAPISpecs, *exWorkArches, *exWorkPinDigests, *exWorkDockerConfigFile, *exWorkUnsigned)
+	case exWorkloadPublishDirCmd.FullCommand():
+		exchange.WorkloadPublishDir(*exOrg, *exUserPw, *exWorkPubDir, *exWorkPubDirPrivKeyFile, *exWorkPubDirMaxDeploymentSize, *exWorkPubDirRequireAPISpecs, *exWorkPubDirArches, *exWorkPubDirPinDigests, *exWorkPubDirDockerConfigFile, *exWorkPubDirFailFast, *exWorkPubDirUnsigned)
+	case exWorkloadDiffCmd.FullCommand():
+		exchange.WorkloadDiff(*exOrg, *exUserPw, *exWorkDiffJsonFile, *exWorkDiffJson)
+	case exWorkloadImagesCmd.FullCommand():
+		exchange.WorkloadImages(*exOrg, *exUserPw, *exImagesWorkload, *exImagesJson)
+	case exWorkloadCheckRegistryCmd.FullCommand():
+		exchange.WorkloadCheckRegistry(*exCheckRegistry, *exCheckRegistryConfigFile)
+	case exWorkloadResignCmd.FullCommand():
+		exchange.WorkloadResign(*exOrg, *exUserPw, *exResignWorkload, *exResignWorkPrivKeyFile)
+	case exWorkloadCopyCmd.FullCommand():
+		exchange.WorkloadCopy(*exOrg, *exUserPw, *exCopyWorkload, *exCopyVersion, *exCopyWorkPrivKeyFile, *exCopyOverwrite)
 	case exWorkloadVerifyCmd.FullCommand():
 		exchange.WorkloadVerify(*exOrg, *exUserPw, *exVerWorkload, *exWorkPubKeyFile)
+	case exWorkloadVerifyAllCmd.FullCommand():
+		exchange.WorkloadVerifyAll(*exOrg, *exUserPw, *exVerAllWorkPubKeyFiles)
+	case exWorkloadVerifyLocalCmd.FullCommand():
+		exchange.WorkloadVerifyLocal(*exVerLocalWorkJsonFile, *exVerLocalWorkPubKeyFiles)
 	case exWorkDelCmd.FullCommand():
 		exchange.WorkloadRemove(*exOrg, *exUserPw, *exDelWork, *exWorkDelForce)
 	case exMicroserviceListCmd.FullCommand():
@@ -381,6 +441,10 @@ Environment Variables:
 	case agbotAgreementListCmd.FullCommand():
 		agreementbot.AgreementList(*agbotlistArchivedAgreements, *agbotAgreement)
 	case agbotAgreementCancelCmd.FullCommand():
-		agreementbot.AgreementCancel(*agbotCancelAgreementId, *agbotCancelAllAgreements)
+		agreementbot.AgreementCancel(*agbotCancelAgreementId, *agbotCancelAllAgreements, *agbotCancelReason)
+	case agbotDeferredCancelListCmd.FullCommand():
+		agreementbot.DeferredCancelList()
+	case agbotDeferredCancelFlushCmd.FullCommand():
+		agreementbot.DeferredCancelFlush()
 	}
 }
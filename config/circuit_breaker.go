@@ -0,0 +1,156 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The states of a circuit breaker.
+const (
+	BREAKER_CLOSED    = "closed"    // calls flow normally
+	BREAKER_OPEN      = "open"      // calls are rejected until the cooldown expires
+	BREAKER_HALF_OPEN = "half_open" // the cooldown has expired, a single probe call is allowed through
+)
+
+// The longest the breaker will back off between probes, no matter how many probes have failed.
+const MaxBreakerCooldownS = 600
+
+// A CircuitBreaker tracks consecutive failures of calls to a remote system. After threshold consecutive failures the
+// breaker opens and rejects calls for a cooldown period. When the cooldown expires, one probe call is allowed through.
+// If the probe succeeds the breaker closes, otherwise it re-opens with double the previous cooldown (exponential
+// backoff), up to MaxBreakerCooldownS.
+type CircuitBreaker struct {
+	lock             sync.Mutex
+	threshold        int
+	initialCooldownS int
+	cooldownS        int
+	failures         int
+	state            string
+	openedAt         time.Time
+}
+
+// The externally visible state of a circuit breaker, suitable for the status API.
+type CircuitBreakerStatus struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	CooldownS           int    `json:"cooldown_seconds"`
+	OpenedAt            int64  `json:"opened_at,omitempty"`
+}
+
+func NewCircuitBreaker(threshold int, cooldownS int) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold:        threshold,
+		initialCooldownS: cooldownS,
+		cooldownS:        cooldownS,
+		state:            BREAKER_CLOSED,
+	}
+}
+
+func (c *CircuitBreaker) String() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return fmt.Sprintf("State: %v, Failures: %v, Threshold: %v, CooldownS: %v", c.state, c.failures, c.threshold, c.cooldownS)
+}
+
+// Returns true if a call should be attempted. An open breaker whose cooldown has expired moves to half open and
+// allows exactly one probe call through.
+func (c *CircuitBreaker) Allow() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch c.state {
+	case BREAKER_OPEN:
+		if time.Since(c.openedAt) < time.Duration(c.cooldownS)*time.Second {
+			return false
+		}
+		glog.V(3).Infof("Circuit breaker cooldown of %v seconds expired, allowing a probe call", c.cooldownS)
+		c.state = BREAKER_HALF_OPEN
+		return true
+	case BREAKER_HALF_OPEN:
+		// A probe is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// Record a successful call, closing the breaker.
+func (c *CircuitBreaker) Success() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state != BREAKER_CLOSED {
+		glog.Infof("Circuit breaker closing after a successful call")
+	}
+	c.state = BREAKER_CLOSED
+	c.failures = 0
+	c.cooldownS = c.initialCooldownS
+}
+
+// Record a failed call, opening the breaker when the threshold is reached or when a probe fails.
+func (c *CircuitBreaker) Failure() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.failures += 1
+	if c.state == BREAKER_HALF_OPEN {
+		c.cooldownS *= 2
+		if c.cooldownS > MaxBreakerCooldownS {
+			c.cooldownS = MaxBreakerCooldownS
+		}
+		c.open()
+	} else if c.state == BREAKER_CLOSED && c.failures >= c.threshold {
+		c.open()
+	}
+}
+
+func (c *CircuitBreaker) open() {
+	glog.Warningf("Circuit breaker opening after %v consecutive failures, rejecting calls for %v seconds", c.failures, c.cooldownS)
+	c.state = BREAKER_OPEN
+	c.openedAt = time.Now()
+}
+
+func (c *CircuitBreaker) Status() *CircuitBreakerStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s := &CircuitBreakerStatus{
+		State:               c.state,
+		ConsecutiveFailures: c.failures,
+		CooldownS:           c.cooldownS,
+	}
+	if c.state != BREAKER_CLOSED {
+		s.OpenedAt = c.openedAt.Unix()
+	}
+	return s
+}
+
+// An http.RoundTripper that routes calls to the given host through a circuit breaker. Calls to other hosts are
+// passed straight through. Transport errors and 5xx responses count as failures.
+type breakerTransport struct {
+	base    http.RoundTripper
+	host    string
+	breaker *CircuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		return t.base.RoundTrip(req)
+	}
+
+	if !t.breaker.Allow() {
+		return nil, errors.New(fmt.Sprintf("circuit breaker for %v is open, call to %v rejected", t.host, req.URL))
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode >= 500 {
+		t.breaker.Failure()
+	} else {
+		t.breaker.Success()
+	}
+	return resp, err
+}
@@ -0,0 +1,67 @@
+// +build unit
+
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_CircuitBreaker_opens_at_threshold(t *testing.T) {
+
+	cb := NewCircuitBreaker(2, 60)
+
+	cb.Failure()
+	if !cb.Allow() {
+		t.Errorf("breaker should still be closed after 1 failure: %v", cb)
+	}
+
+	cb.Failure()
+	if cb.Allow() {
+		t.Errorf("breaker should be open after 2 failures: %v", cb)
+	} else if s := cb.Status(); s.State != BREAKER_OPEN || s.ConsecutiveFailures != 2 || s.OpenedAt == 0 {
+		t.Errorf("wrong breaker status: %v", s)
+	}
+}
+
+func Test_CircuitBreaker_probe(t *testing.T) {
+
+	cb := NewCircuitBreaker(1, 60)
+	cb.Failure()
+
+	// Pretend the cooldown has expired.
+	cb.openedAt = time.Now().Add(-61 * time.Second)
+	if !cb.Allow() {
+		t.Errorf("breaker should allow a probe after the cooldown: %v", cb)
+	} else if cb.Allow() {
+		t.Errorf("breaker should allow only one probe: %v", cb)
+	}
+
+	// A failed probe re-opens the breaker with a longer cooldown.
+	cb.Failure()
+	if s := cb.Status(); s.State != BREAKER_OPEN || s.CooldownS != 120 {
+		t.Errorf("wrong breaker status after failed probe: %v", s)
+	}
+
+	// A successful probe closes the breaker and resets the cooldown.
+	cb.openedAt = time.Now().Add(-121 * time.Second)
+	if !cb.Allow() {
+		t.Errorf("breaker should allow a probe after the cooldown: %v", cb)
+	}
+	cb.Success()
+	if s := cb.Status(); s.State != BREAKER_CLOSED || s.ConsecutiveFailures != 0 || s.CooldownS != 60 {
+		t.Errorf("wrong breaker status after successful probe: %v", s)
+	}
+}
+
+func Test_CircuitBreaker_max_cooldown(t *testing.T) {
+
+	cb := NewCircuitBreaker(1, MaxBreakerCooldownS)
+	cb.Failure()
+	cb.openedAt = time.Now().Add(-time.Duration(MaxBreakerCooldownS+1) * time.Second)
+	cb.Allow()
+	cb.Failure()
+	if s := cb.Status(); s.CooldownS != MaxBreakerCooldownS {
+		t.Errorf("cooldown should not exceed the maximum: %v", s)
+	}
+}
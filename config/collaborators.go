@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -46,7 +47,8 @@ func (c *Collaborators) String() string {
 }
 
 type HTTPClientFactory struct {
-	NewHTTPClient func(overrideTimeoutS *uint) *http.Client
+	NewHTTPClient   func(overrideTimeoutS *uint) *http.Client
+	ExchangeBreaker *CircuitBreaker // nil unless the exchange circuit breaker is enabled in the config
 }
 
 type KeyFileNamesFetcher struct {
@@ -100,8 +102,24 @@ func newHTTPClientFactory(hConfig HorizonConfig) (*HTTPClientFactory, error) {
 	certPool.AppendCertsFromPEM(caBytes)
 	tlsConf.RootCAs = certPool
 
+	// present a client cert to servers that require mutual TLS
+	if hConfig.Edge.ClientCertPath != "" {
+		clientCert, err := tls.LoadX509KeyPair(hConfig.Edge.ClientCertPath, hConfig.Edge.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client cert %v and key %v: %v", hConfig.Edge.ClientCertPath, hConfig.Edge.ClientKeyPath, err)
+		}
+		tlsConf.Certificates = []tls.Certificate{clientCert}
+		glog.V(4).Infof("Loaded client cert from provided file %v", hConfig.Edge.ClientCertPath)
+	}
+
 	tlsConf.BuildNameToCertificate()
 
+	// Optionally short-circuit calls to the exchange when it is failing.
+	breaker, exchangeHost, err := newExchangeBreaker(hConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	clientFunc := func(overrideTimeoutS *uint) *http.Client {
 		var timeoutS uint
 
@@ -111,31 +129,99 @@ func newHTTPClientFactory(hConfig HorizonConfig) (*HTTPClientFactory, error) {
 			timeoutS = hConfig.Edge.DefaultHTTPClientTimeoutS
 		}
 
+		var transport http.RoundTripper = newHTTPTransport(hConfig.Edge, &tlsConf)
+
+		if breaker != nil {
+			transport = &breakerTransport{base: transport, host: exchangeHost, breaker: breaker}
+		}
+
 		return &http.Client{
 			// remember that this timouet is for the whole request, including
 			// body reading. This means that you must set the timeout according
 			// to the total payload size you expect
-			Timeout: time.Second * time.Duration(timeoutS),
-			Transport: &http.Transport{
-				Dial: (&net.Dialer{
-					Timeout:   60 * time.Second,
-					KeepAlive: 120 * time.Second,
-				}).Dial,
-				TLSHandshakeTimeout:   20 * time.Second,
-				ResponseHeaderTimeout: 20 * time.Second,
-				ExpectContinueTimeout: 8 * time.Second,
-				MaxIdleConns:          MaxHTTPIdleConnections,
-				IdleConnTimeout:       HTTPIdleConnectionTimeoutS * time.Second,
-				TLSClientConfig:       &tlsConf,
-			},
+			Timeout:   time.Second * time.Duration(timeoutS),
+			Transport: transport,
 		}
 	}
 
 	return &HTTPClientFactory{
-		NewHTTPClient: clientFunc,
+		NewHTTPClient:   clientFunc,
+		ExchangeBreaker: breaker,
 	}, nil
 }
 
+// Returns a transport tuned by the connection pool and keep-alive settings in the config. Unset settings keep their
+// defaults.
+func newHTTPTransport(cfg Config, tlsConf *tls.Config) *http.Transport {
+	maxIdle := MaxHTTPIdleConnections
+	if cfg.HTTPMaxIdleConns > 0 {
+		maxIdle = cfg.HTTPMaxIdleConns
+	}
+
+	maxIdlePerHost := http.DefaultMaxIdleConnsPerHost
+	if cfg.HTTPMaxIdleConnsPerHost > 0 {
+		maxIdlePerHost = cfg.HTTPMaxIdleConnsPerHost
+	}
+
+	idleTimeoutS := HTTPIdleConnectionTimeoutS
+	if cfg.HTTPIdleConnTimeoutS > 0 {
+		idleTimeoutS = cfg.HTTPIdleConnTimeoutS
+	}
+
+	return &http.Transport{
+		Dial:                  newHTTPDialer(cfg).Dial,
+		TLSHandshakeTimeout:   20 * time.Second,
+		ResponseHeaderTimeout: 20 * time.Second,
+		ExpectContinueTimeout: 8 * time.Second,
+		MaxIdleConns:          maxIdle,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		IdleConnTimeout:       time.Duration(idleTimeoutS) * time.Second,
+		DisableKeepAlives:     cfg.HTTPDisableConnectionReuse,
+		TLSClientConfig:       tlsConf,
+	}
+}
+
+// Returns the dialer used by HTTP transports. A negative HTTPKeepAliveS disables TCP keep-alives.
+func newHTTPDialer(cfg Config) *net.Dialer {
+	keepAliveS := HTTPKeepAliveS
+	if cfg.HTTPKeepAliveS > 0 {
+		keepAliveS = cfg.HTTPKeepAliveS
+	} else if cfg.HTTPKeepAliveS < 0 {
+		keepAliveS = -1
+	}
+
+	return &net.Dialer{
+		Timeout:   60 * time.Second,
+		KeepAlive: time.Duration(keepAliveS) * time.Second,
+	}
+}
+
+// Returns the circuit breaker shared by all clients calling the exchange, and the exchange host it applies to. The
+// breaker is nil when it is not enabled in the config or there is no exchange URL configured.
+func newExchangeBreaker(hConfig HorizonConfig) (*CircuitBreaker, string, error) {
+	if hConfig.Edge.ExchangeBreakerThreshold <= 0 {
+		return nil, "", nil
+	}
+
+	exchURL := hConfig.Edge.ExchangeURL
+	if exchURL == "" {
+		exchURL = hConfig.AgreementBot.ExchangeURL
+	}
+	if exchURL == "" {
+		glog.Warningf("Exchange circuit breaker is configured but there is no exchange URL, the breaker is not enabled")
+		return nil, "", nil
+	}
+
+	if parsed, err := url.Parse(exchURL); err != nil {
+		return nil, "", fmt.Errorf("Unable to parse exchange URL %v for the circuit breaker: %v", exchURL, err)
+	} else if hConfig.Edge.ExchangeBreakerCooldownS <= 0 {
+		return nil, "", fmt.Errorf("ExchangeBreakerCooldownS must be greater than zero when ExchangeBreakerThreshold is set")
+	} else {
+		glog.V(3).Infof("Enabling exchange circuit breaker for %v, threshold %v, cooldown %v seconds", parsed.Host, hConfig.Edge.ExchangeBreakerThreshold, hConfig.Edge.ExchangeBreakerCooldownS)
+		return NewCircuitBreaker(hConfig.Edge.ExchangeBreakerThreshold, hConfig.Edge.ExchangeBreakerCooldownS), parsed.Host, nil
+	}
+}
+
 func newKeyFileNamesFetcher(hConfig HorizonConfig) (*KeyFileNamesFetcher, error) {
 
 	// get all the *.pem files under the given directory
@@ -158,6 +244,8 @@ func newKeyFileNamesFetcher(hConfig HorizonConfig) (*KeyFileNamesFetcher, error)
 
 	// get the pem file names from the pulic key path and user key path.
 	// if the publicKeyPath is a file name all the *.pem files within the same directory will be returned.
+	// if the publicKeyPath is a directory all the *.pem files within it will be returned, so that several
+	// platform keys can be trusted at once while a key is being rotated.
 	// userkeyPath is always a directory.
 	getKeyFilesFunc := func(publicKeyPath, userKeyPath string) ([]string, error) {
 		keyFileNames := make([]string, 0)
@@ -166,6 +254,9 @@ func newKeyFileNamesFetcher(hConfig HorizonConfig) (*KeyFileNamesFetcher, error)
 		if publicKeyPath != "" {
 			// Compute the public key directory based on the configured platform public key file location.
 			pubKeyDir := publicKeyPath[:strings.LastIndex(publicKeyPath, "/")]
+			if fileInfo, err := os.Stat(publicKeyPath); err == nil && fileInfo.IsDir() {
+				pubKeyDir = strings.TrimSuffix(publicKeyPath, "/")
+			}
 
 			// Grab all PEM files from that location and try to verify the signature against each one.
 			if pemFiles, err := getPemFiles(pubKeyDir); err != nil {
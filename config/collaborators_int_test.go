@@ -4,6 +4,7 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -261,6 +262,86 @@ func Test_HTTPClientFactory_Suite(t *testing.T) {
 	})
 }
 
+func Test_HTTPClientFactory_ClientCert(t *testing.T) {
+	timeoutS := uint(2)
+
+	dir, err := ioutil.TempDir("", "config-collaborators-")
+	if err != nil {
+		t.Error(err)
+	}
+	defer cleanup(dir, t)
+
+	files := map[string]string{
+		"ca-cert.pem":     collaboratorsTestCert,
+		"client-cert.pem": collaboratorsOtherTestCert,
+		"client-key.pem":  collaboratorsOtherTestKey,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0660); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the server requires a client cert and replies with the common name of the cert the client presented
+	serverCert, err := tls.X509KeyPair([]byte(collaboratorsTestCert), []byte(collaboratorsTestKey))
+	if err != nil {
+		t.Error(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/boosh", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	})
+
+	listener, err := tls.Listen("tcp", fmt.Sprintf("%s:0", listenOn), &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	go http.Serve(listener, mux)
+	port := strings.Split(listener.Addr().String(), ":")[1]
+
+	config := &HorizonConfig{
+		Edge: Config{
+			CACertsPath:    filepath.Join(dir, "ca-cert.pem"),
+			ClientCertPath: filepath.Join(dir, "client-cert.pem"),
+			ClientKeyPath:  filepath.Join(dir, "client-key.pem"),
+		},
+	}
+
+	t.Run("HTTP client presents client cert", func(t *testing.T) {
+		factory, err := newHTTPClientFactory(*config)
+		if err != nil {
+			t.Error(err)
+		}
+
+		resp, err := factory.NewHTTPClient(&timeoutS).Get(fmt.Sprintf("https://%s:%s/boosh", listenOn, port))
+		if err != nil {
+			t.Error("Unexpected error sending request to server requiring client cert", err)
+		} else if content, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Error("Unexpected error reading response from HTTP server", err)
+		} else if string(content) != "testo" {
+			t.Errorf("Server saw the wrong client cert: %v", string(content))
+		}
+	})
+
+	t.Run("HTTP client without client cert is rejected", func(t *testing.T) {
+		config.Edge.ClientCertPath = ""
+		config.Edge.ClientKeyPath = ""
+		factory, err := newHTTPClientFactory(*config)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if _, err := factory.NewHTTPClient(&timeoutS).Get(fmt.Sprintf("https://%s:%s/boosh", listenOn, port)); err == nil {
+			t.Error("Expected TLS error for sending request without a client cert")
+		}
+	})
+}
+
 func Test_KeyFileNamesFetcher_Suite(t *testing.T) {
 	setupForTest := func(listenerCert, listenerKey string, trustSystemCerts bool) (string, *HorizonConfig) {
 		dir, _ := setupTesting(listenerCert, listenerKey, trustSystemCerts, t)
@@ -356,6 +437,19 @@ func Test_KeyFileNamesFetcher_Suite(t *testing.T) {
 		}
 	})
 
+	t.Run("Test getting pem files from a public key directory", func(t *testing.T) {
+		userKeyPath := cfg.UserPublicKeyPath()
+
+		for _, pubKeyDir := range []string{filepath.Join(dir, "/trusted"), filepath.Join(dir, "/trusted") + "/"} {
+			fnames, err := cfg.Collaborators.KeyFileNamesFetcher.GetKeyFileNames(pubKeyDir, userKeyPath)
+			if err != nil {
+				t.Errorf("Got error but should not: %v", err)
+			} else if len(fnames) != 4 {
+				t.Errorf("Number of files for %v should be 4 but got %v.", pubKeyDir, len(fnames))
+			}
+		}
+	})
+
 	t.Run("Cleaning up", func(t *testing.T) {
 		cleanup(dir, t)
 	})
@@ -0,0 +1,59 @@
+// +build unit
+
+package config
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_newHTTPTransport_defaults(t *testing.T) {
+
+	tlsConf := &tls.Config{}
+	transport := newHTTPTransport(Config{}, tlsConf)
+
+	if transport.MaxIdleConns != MaxHTTPIdleConnections {
+		t.Errorf("expected default MaxIdleConns %v, got %v", MaxHTTPIdleConnections, transport.MaxIdleConns)
+	} else if transport.MaxIdleConnsPerHost != http.DefaultMaxIdleConnsPerHost {
+		t.Errorf("expected default MaxIdleConnsPerHost %v, got %v", http.DefaultMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	} else if transport.IdleConnTimeout != HTTPIdleConnectionTimeoutS*time.Second {
+		t.Errorf("expected default IdleConnTimeout, got %v", transport.IdleConnTimeout)
+	} else if transport.TLSClientConfig != tlsConf {
+		t.Errorf("expected transport to use the TLS config")
+	} else if transport.DisableKeepAlives {
+		t.Errorf("expected connections to be reused by default")
+	} else if dialer := newHTTPDialer(Config{}); dialer.KeepAlive != HTTPKeepAliveS*time.Second {
+		t.Errorf("expected default KeepAlive, got %v", dialer.KeepAlive)
+	}
+}
+
+func Test_newHTTPTransport_configured(t *testing.T) {
+
+	cfg := Config{
+		HTTPMaxIdleConns:           200,
+		HTTPMaxIdleConnsPerHost:    50,
+		HTTPIdleConnTimeoutS:       30,
+		HTTPKeepAliveS:             15,
+		HTTPDisableConnectionReuse: true,
+	}
+	transport := newHTTPTransport(cfg, &tls.Config{})
+
+	if transport.MaxIdleConns != 200 {
+		t.Errorf("expected MaxIdleConns 200, got %v", transport.MaxIdleConns)
+	} else if transport.MaxIdleConnsPerHost != 50 {
+		t.Errorf("expected MaxIdleConnsPerHost 50, got %v", transport.MaxIdleConnsPerHost)
+	} else if transport.IdleConnTimeout != 30*time.Second {
+		t.Errorf("expected IdleConnTimeout 30s, got %v", transport.IdleConnTimeout)
+	} else if !transport.DisableKeepAlives {
+		t.Errorf("expected connections not to be reused")
+	} else if dialer := newHTTPDialer(cfg); dialer.KeepAlive != 15*time.Second {
+		t.Errorf("expected KeepAlive 15s, got %v", dialer.KeepAlive)
+	}
+
+	cfg.HTTPKeepAliveS = -1
+	if dialer := newHTTPDialer(cfg); dialer.KeepAlive >= 0 {
+		t.Errorf("expected keep-alives to be disabled, got %v", dialer.KeepAlive)
+	}
+}
@@ -3,9 +3,16 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/cutil"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const ExchangeURLEnvvarName = "HZN_EXCHANGE_URL"
@@ -24,23 +31,53 @@ type Config struct {
 	DBPath                        string
 	DockerEndpoint                string
 	DockerCredFilePath            string
+	DockerMinAPIVersion           string // The minimum API version of the docker daemon at DockerEndpoint, e.g. "1.24". Anax refuses to start when the daemon is older. Empty means DefaultDockerMinAPIVersion.
 	DefaultCPUSet                 string
-	DefaultServiceRegistrationRAM int64
+	DefaultServiceRegistrationRAM int64 // The RAM in MB that a service registered without compute attributes advertises.
 	StaticWebContent              string
 	PublicKeyPath                 string
 	TrustSystemCACerts            bool   // If equal to true, the HTTP client factory will set up clients that trust CA certs provided by a Linux distribution (see https://golang.org/pkg/crypto/x509/#SystemCertPool and https://golang.org/src/crypto/x509/root_linux.go)
 	CACertsPath                   string // Path to a file containing PEM-encoded x509 certs HTTP clients in Anax will trust (additive to the configuration option "TrustSystemCACerts")
+	ClientCertPath                string // Path to a file containing the PEM-encoded x509 cert HTTP clients in Anax present to servers that require mutual TLS. Must be set together with ClientKeyPath.
+	ClientKeyPath                 string // Path to a file containing the PEM-encoded private key of the ClientCertPath cert
 	ExchangeURL                   string
+	ExchangeOrgURLs               string // A comma separated list of org=url pairs, e.g. "myorg=https://exchange2.example.com/api/v1/", for federations that keep some orgs in another exchange. Calls for the resources of a listed org, e.g. its nodes, workloads and patterns, use its URL. Empty means every org uses ExchangeURL.
 	DefaultHTTPClientTimeoutS     uint
 	PolicyPath                    string
 	ExchangeHeartbeat             int    // Seconds between heartbeats
 	AgreementTimeoutS             uint64 // Number of seconds to wait before declaring agreement not finalized in blockchain
-	DVPrefix                      string // When passing agreement ids into a workload container, add this prefix to the agreement id
+	DVPrefix                      string // When passing agreement ids into a workload container, add this prefix to the agreement id. Must be the same as the DVPrefix of the agbots, or data verification will not find the agreement ids.
 	RegistrationDelayS            uint64 // The number of seconds to wait after blockchain init before registering with the exchange. This is for testing initialization ONLY.
-	ExchangeMessageTTL            int    // The number of seconds the exchange will keep this message before automatically deleting it
+	ExchangeMessageTTL            int    // The number of seconds the exchange will keep this message before automatically deleting it. Omitted means DefaultExchangeMessageTTL, values are clamped into the range MinExchangeMessageTTL to MaxExchangeMessageTTL.
 	TorrentListenAddr             string // Override the torrent listen address just in case there are conflicts, syntax is "host:port"
 	UserPublicKeyPath             string // The location to store user keys uploaded through the REST API
 	ReportDeviceStatus            bool   // whether to report the device status to the exchange or not.
+	ExchangeBreakerThreshold      int    // Number of consecutive failed exchange calls before calls are short-circuited. Zero (the default) disables the circuit breaker.
+	ExchangeBreakerCooldownS      int    // Seconds to short-circuit exchange calls before probing again, doubled after each failed probe. Used only when ExchangeBreakerThreshold is set.
+	AllowedImageRegistries        string // A comma separated list of registry domains, e.g. "docker.io,registry.example.com:5000". If set, images are only pulled from these registries. Empty means all registries are allowed.
+	DeniedImageRegistries         string // A comma separated list of registry domains that images are never pulled from. Takes precedence over AllowedImageRegistries.
+	FallbackImageRegistries       string // A comma separated list of registry=fallback pairs of registry domains, e.g. "docker.io=mirror.example.com:5000". An image whose registry can't be reached is pulled from the fallback registry instead, which is subject to AllowedImageRegistries and DeniedImageRegistries too. Empty means no fallback.
+	DockerMinFreeSpaceMB          int    // The free space, in MB, the file system of DockerStoragePath must have before a workload image that is not in the local docker store is pulled from its registry. The pull is refused when there is less, so that a pull cannot fill the disk of the node. Zero means DefaultDockerMinFreeSpaceMB, a negative value disables the check for nodes whose disk space is managed externally.
+	DockerStoragePath             string // The directory where docker keeps its images, checked for DockerMinFreeSpaceMB. Set it when anax sees the docker storage at another path, e.g. when anax runs in a container. Empty means the root dir reported by the docker daemon, or DefaultDockerStoragePath if it reports none.
+	DockerPullTimeoutS            int    // The maximum number of seconds the pull of a workload image from its registry can take, including retries. It is separate from DefaultHTTPClientTimeoutS so that large images are not held to the timeout of exchange calls. Zero means no timeout.
+	ImagePullPlatform             string // The os/arch platform, e.g. "linux/amd64" or "linux/arm/v7", of the variant pulled from a multi-arch image. Set it when the node runs images of another arch under emulation. Empty means linux and the arch of the node.
+	ImageFetchStrategy            string // How workload images are fetched, ImageFetchTorrentPreferred or ImageFetchRegistryOnly. Empty means ImageFetchTorrentPreferred.
+	BlockchainAPIFailures         int    // The number of consecutive failed blockchain client API calls before the client is considered down and restarted. Zero means DefaultBlockchainAPIFailures.
+	BlockchainIsolationS          int    // The number of seconds a ready blockchain client can have no peers before a BC_CLIENT_ISOLATED event is sent. Zero means no isolation check.
+	BlockchainIsolationRestart    bool   // If true, a blockchain client that still has no peers BlockchainIsolationS seconds after the isolation event is restarted.
+	BlockchainFundingTimeoutS     int    // The number of seconds a ready blockchain client's account can stay unfunded before funding is re-triggered by restarting the client. Zero means funding is never re-triggered automatically.
+	BlockchainRefundIntervalS     int    // The minimum number of seconds between two funding re-triggers for the same blockchain client. Zero means DefaultBlockchainRefundIntervalS.
+	BlockchainRPCTimeoutS         uint   // The number of seconds to wait for a response from a blockchain client's RPC API before the call fails. Zero means the bh_rpc_timeout envvar if it is set, otherwise DefaultHTTPClientTimeoutS.
+	BlockchainNeededGraceS        int    // The number of seconds after startup during which every blockchain is considered needed, so that blockchain clients are restarted rather than torn down before the first needed blockchains report arrives. Zero means DefaultBlockchainNeededGraceS.
+	ShutdownDrainTimeoutS         int    // The maximum number of seconds node shutdown waits for the agreement worker to drain and for agreement terminations to complete before it stops the blockchain clients anyway. Zero means DefaultShutdownDrainTimeoutS.
+	BlockchainEventBatchBlocks    int    // The maximum number of blocks read from a blockchain event log at a time. A larger backlog is read in several batches. Zero means DefaultBlockchainEventBatchBlocks.
+	BlockchainImageURLs           string // A comma separated list of org/name=url entries that override the image URL in the blockchain metadata, e.g. "IBM/bluehorizon=https://mirror.example.com/eth.torrent". The org/ prefix can be omitted to match any org.
+	BlockchainLogDir              string // The directory in the eth container where a blockchain instance writes its geth log, as geth-<name>.log, when the blockchain metadata does not specify GETH_LOG. Empty means DefaultBlockchainLogDir.
+	HTTPMaxIdleConns              int    // The maximum number of idle connections kept by each HTTP client, across all hosts. Zero means MaxHTTPIdleConnections.
+	HTTPMaxIdleConnsPerHost       int    // The maximum number of idle connections kept by each HTTP client for a single host, e.g. the exchange. Zero means http.DefaultMaxIdleConnsPerHost.
+	HTTPIdleConnTimeoutS          int    // The number of seconds an idle HTTP connection is kept before it is closed. Zero means HTTPIdleConnectionTimeoutS.
+	HTTPKeepAliveS                int    // The TCP keep-alive period in seconds for HTTP connections. Zero means HTTPKeepAliveS, a negative value disables keep-alives.
+	HTTPDisableConnectionReuse    bool   // If true, each HTTP request, e.g. to the exchange, opens a new connection. Otherwise connections are kept open and reused by later requests of the same client within the HTTPMaxIdleConns limits.
 
 	// these Ids could be provided in config or discovered after startup by the system
 	BlockchainAccountId        string
@@ -50,30 +87,355 @@ type Config struct {
 // This is the configuration options for Agreement bot flavor of Anax
 type AGConfig struct {
 	TxLostDelayTolerationSeconds int
-	AgreementWorkers             int
+	AgreementWorkers             int // The number of agreement workers per agreement protocol. This is the minimum when MaxAgreementWorkers is larger.
+	MaxAgreementWorkers          int // If larger than AgreementWorkers, workers are added up to this number while work is queued, and retired when idle. Otherwise the number of workers is fixed.
 	DBPath                       string
 	ProtocolTimeoutS             uint64 // Number of seconds to wait before declaring proposal response is lost
+	ProposalTimeoutS             uint64 // Number of seconds a proposal can go without a reply before it expires and its pending agreement is cancelled. Zero means ProtocolTimeoutS.
 	AgreementTimeoutS            uint64 // Number of seconds to wait before declaring agreement not finalized in blockchain
 	NoDataIntervalS              uint64 // default should be 15 mins == 15*60 == 900. Ignored if the policy has data verification disabled.
 	ActiveAgreementsURL          string // This field is used when policy files indicate they want data verification but they dont specify a URL
 	ActiveAgreementsUser         string // This is the userid the agbot uses to authenticate to the data verifivcation API
 	ActiveAgreementsPW           string // This is the password for the ActiveAgreementsUser
+	ActiveAgreementsToken        string // A token the agbot uses to authenticate to the data verification API instead of ActiveAgreementsUser and ActiveAgreementsPW. Takes precedence over them when both are configured, but a user and password in the policy take precedence over the token.
+	ActiveAgreementsTokenHeader  string // The header the ActiveAgreementsToken is sent in, e.g. "X-API-Key". Empty means the token is sent as "Authorization: Bearer <token>".
 	PolicyPath                   string // The directory where policy files are kept, default /etc/provider-tremor/policy/
 	NewContractIntervalS         uint64 // default should be 1
+	NewContractMaxIntervalS      uint64 // The maximum number of seconds between searches for devices to make agreements with. Each search that finds no device to make a new agreement with doubles the time to the next search, up to this cap, and a search that does find one resets it to NewContractIntervalS. Exchange messages are still processed every NewContractIntervalS. Zero or NewContractIntervalS means a fixed interval.
 	ProcessGovernanceIntervalS   uint64 // How long the gov sleeps before general gov checks (new payloads, interval payments, etc).
+	GovernanceConcurrency        int    // The number of in progress agreements of a protocol that each governance check works on at the same time. Zero means 1, the agreements are governed one at a time.
 	IgnoreContractWithAttribs    string // A comma seperated list of contract attributes. If set, the contracts that contain one or more of the attributes will be ignored. The default is "ethereum_account".
 	ExchangeURL                  string // The URL of the Horizon exchange. If not configured, the exchange will not be used.
+	ExchangeOrgURLs              string // A comma separated list of org=url pairs, e.g. "myorg=https://exchange2.example.com/api/v1/", for federations that keep some orgs in another exchange. Calls for the resources of a listed org, e.g. its nodes, workloads and patterns, use its URL. Empty means every org uses ExchangeURL.
 	ExchangeHeartbeat            int    // Seconds between heartbeats to the exchange
 	ExchangeId                   string // The id of the agbot, not the userid of the exchange user. Must be org qualified.
 	ExchangeToken                string // The agbot's authentication token
-	DVPrefix                     string // When looking for agreement ids in the data verification API response, look for agreement ids with this prefix.
+	DVPrefix                     string // When looking for agreement ids in the data verification API response, look for agreement ids with this prefix. Must be the same as the DVPrefix of the edge nodes, which add it to the agreement ids they pass to workloads. A mismatch is logged once for each agreement the data verification API reports.
 	ActiveDeviceTimeoutS         int    // The amount of time a device can go without heartbeating and still be considered active for the purposes of search
-	ExchangeMessageTTL           int    // The number of seconds the exchange will keep this message before automatically deleting it
+	ExchangeMessageTTL           int    // The number of seconds the exchange will keep this message before automatically deleting it. Omitted means DefaultExchangeMessageTTL, values are clamped into the range MinExchangeMessageTTL to MaxExchangeMessageTTL.
 	MessageKeyPath               string // The path to the location of messaging keys
 	DefaultWorkloadPW            string // The default workload password if none is specified in the policy file
 	APIListen                    string // Host and port for the API to listen on
 	PurgeArchivedAgreementHours  int    // Number of hours to leave an archived agreement in the database before automatically deleting it
+	WorkloadSelectionExpiryHours int    // The number of hours the outcome of the most recent attempt to choose a workload for a device and policy is kept for GET /diagnosis before it is deleted. Zero means DefaultWorkloadSelectionExpiryHours.
+	DBIntegrityCheckS            int    // The number of seconds between checks of the database for inconsistent agreement and workload usage records, which are logged. Zero disables the check.
+	DBIntegrityRepair            bool   // If true, the database integrity check also repairs the inconsistencies that are safe to repair, e.g. it clears the agreement id of a workload usage whose agreement is archived.
+	ReconcileAgreementsS         int    // The number of seconds between reconciliations of the agbot's agreements with its agreement records in the exchange. Every repair is logged. Zero disables the periodic reconciliation, it can still be run with POST /agreement/reconcile.
 	CheckUpdatedPolicyS          int    // The number of seconds to wait between checks for an updated policy file. Zero means auto checking is turned off.
+	IntervalJitterPercent        int    // Randomly lengthen or shorten each wait of the periodic agbot intervals (NewContractIntervalS, ProcessGovernanceIntervalS, ExchangeHeartbeat, CheckUpdatedPolicyS) by up to this percentage, so that agbots started together don't call the exchange in lockstep. Must be less than 100, zero means no jitter.
+	CancelCooldownS              string // A comma separated list of reason:seconds pairs, e.g. "NegativeReply:300". After a cancel for one of these reasons, the device is not offered a new agreement for the same policy until the cooldown expires. Empty means no cooldown.
+	PreferDeviceOrgs             string // A comma separated list of orgs. Devices in these orgs are offered agreements before other devices found by the same search. Empty means no org preference.
+	PreferDeviceProps            string // A comma separated list of name=value pairs, e.g. "tier=gold". Devices advertising more of these properties are offered agreements first. Empty means no property preference.
+	PreferredDevicesOnly         bool   // If true, devices that match none of the PreferDeviceOrgs or PreferDeviceProps are skipped instead of just ordered last.
+	InitiateDeadlineS            int    // The maximum number of seconds a worker spends choosing a workload for a new agreement before giving up. Zero means no deadline.
+	MaxWorkloadPrioritiesTried   int    // The maximum number of workload priorities a worker tries when choosing a workload for a new agreement before giving up. Zero means no limit.
+	WorkloadArches               string // A comma separated list of workload architectures this agbot will make agreements for, e.g. "amd64,arm64". Empty means all architectures.
+	WorkloadOrgs                 string // A comma separated list of orgs whose workloads this agbot will make agreements for. Empty means all orgs.
+	DeniedWorkloadVersions       string // A comma separated list of url@version or url@version@arch entries, e.g. "https://bluehorizon.network/workloads/netspeed@2.3.1", of workload versions that this agbot never proposes, e.g. a known bad build. The next workload of the policy is tried instead. Empty means no workload version is denied.
+	UnexpectedDataAckAction      string // What to do with a data received ack for an agreement whose policy disabled data verification, UnexpectedDataAckIgnore or UnexpectedDataAckFlag. Empty means the ack is recorded as a data notification like any other.
+	MissingMicroserviceAction    string // What to do when a workload of a pattern requires a microservice that the device has not registered, MissingMicroserviceSkip or MissingMicroserviceFail. Empty means the workload is checked against the device's policy as is.
+	PreferCachedImages           bool   // If true, among workloads of the same priority, prefer the ones whose images the device advertises as already cached. Advisory only, the priority order is unchanged.
+	WebhookURL                   string // If set, agreement lifecycle events (initiated, accepted, cancelled) are posted to this URL as JSON. Empty means no notifications.
+	WebhookAuthHeader            string // The value of the Authorization header sent with each webhook post, e.g. "Bearer <token>". Optional.
+	MaxAgreementFailures         int    // The number of agreements for a device and policy that can fail before being finalized, after which the device's workload usage record is marked exhausted and no more agreements are made for that device and policy until the record is reset with POST /workloadusage/reset. Zero means no limit.
+	MinVerifiedDurationS         int    // A floor for the verified duration in workload priorities. A policy's VerifiedDurationS below the floor is raised to it, so that a misconfigured policy cannot stop rollback retries too early. Zero disables the floor.
+	InvalidReplyThreshold        int    // The number of consecutive invalid agreement replies from a device after which the device is blacklisted from new agreements. Only replies that are invalid because of the device count, e.g. a reply for an agreement the agbot doesn't have. Zero disables blacklisting.
+	InvalidReplyBlacklistS       int    // The number of seconds a device is blacklisted after reaching InvalidReplyThreshold. Zero means DefaultInvalidReplyBlacklistS.
+	TraceAgreementIds            string // A comma separated list of agreement ids. The decisions the agbot makes for these agreements are recorded in a trace that is retrieved with GET /agreement/{id}/trace. Tracing can also be started with POST /agreement/{id}/trace.
+	ObserverMode                 bool   // If true, the agbot searches for devices and chooses workloads as usual, but only logs and posts to the WebhookURL the agreements it would have proposed. An agreement is reported again only when the chosen workload changes. No agreements are made and nothing is written to the agbot database.
+	MinAgreementProtocolVersion  int    // The lowest agreement protocol version the agbot will make agreements with. Devices that would negotiate a lower version are skipped. Zero means no floor.
+	AgreementMetadata            string // A comma separated list of key=value pairs, e.g. "batch=2017-11,ticket=OPS-42", recorded on every agreement this agbot makes so that agreements can be correlated with external systems. Empty means no metadata.
+	DeploymentOverridesFile      string // The path of a JSON file of signed workload deployment overrides keyed by device org and/or property. The overrides of the first matching entry replace the workload's deployment overrides. The file is read for each new agreement. Empty means no overrides.
+	HAPartnerQuorumPercent       int    // The percentage of a device's HA partners that must be registered in the exchange before an agreement is made with the device, e.g. 50 for half of them. Zero means 100, all the partners must be registered.
+	ReevaluateProposals          bool   // If true, when a policy changes, the workload choice and compatibility of a proposal that is not finalized yet are checked against the changed policy, and the proposal is only cancelled and remade if the outcome differs. Proposals of HA devices are always cancelled.
+	WorkQueueDegradedDepth       int    // The number of work items waiting in a protocol's agreement work queue above which GET /health reports the agreement workers as degraded. Zero means the depth is not checked.
+	WorkQueueDegradedAgeS        int    // The number of seconds the oldest item in a protocol's agreement work queue can wait for a worker before GET /health reports the agreement workers as degraded. Zero means the age is not checked.
+}
+
+// Returns how many of the input number of HA partners of a device must be registered in the exchange before an agreement
+// is made with the device. A partial partner counts as a whole one, so that the quorum is never rounded down.
+func (c *AGConfig) HAPartnersRequired(partners int) int {
+	quorum := c.HAPartnerQuorumPercent
+	if quorum == 0 {
+		quorum = 100
+	}
+	return (partners*quorum + 99) / 100
+}
+
+// Returns true if the agbot is configured to make agreements for workloads of the input architecture.
+func (c *AGConfig) AllowsWorkloadArch(arch string) bool {
+	if c.WorkloadArches == "" {
+		return true
+	}
+	for _, a := range strings.Split(c.WorkloadArches, ",") {
+		if strings.TrimSpace(a) == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the agbot is configured to make agreements for workloads defined in the input org.
+func (c *AGConfig) AllowsWorkloadOrg(org string) bool {
+	if c.WorkloadOrgs == "" {
+		return true
+	}
+	for _, o := range strings.Split(c.WorkloadOrgs, ",") {
+		if strings.TrimSpace(o) == org {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the workload version is in DeniedWorkloadVersions. An entry without an arch denies the version for all
+// arches.
+func (c *AGConfig) DeniesWorkloadVersion(url string, version string, arch string) bool {
+	if c.DeniedWorkloadVersions == "" {
+		return false
+	}
+	for _, entry := range strings.Split(c.DeniedWorkloadVersions, ",") {
+		pieces := strings.Split(strings.TrimSpace(entry), "@")
+		if len(pieces) >= 2 && pieces[0] == url && pieces[1] == version && (len(pieces) == 2 || pieces[2] == arch) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the reason the agbot is configured not to make agreements for the workload, because of WorkloadArches,
+// WorkloadOrgs or DeniedWorkloadVersions, or the empty string if it is not excluded. The org is the org in which the
+// workload is defined, the org is not checked when it is empty.
+func (c *AGConfig) WorkloadExclusion(url string, org string, version string, arch string) string {
+	if !c.AllowsWorkloadArch(arch) {
+		return fmt.Sprintf("arch %v is not in the configured workload arches %v", arch, c.WorkloadArches)
+	} else if org != "" && !c.AllowsWorkloadOrg(org) {
+		return fmt.Sprintf("org %v is not in the configured workload orgs %v", org, c.WorkloadOrgs)
+	} else if c.DeniesWorkloadVersion(url, version, arch) {
+		return fmt.Sprintf("version %v is in the configured denied workload versions", version)
+	}
+	return ""
+}
+
+// Returns the number of seconds to wait for a reply to a proposal before the proposal expires.
+func (c *AGConfig) ProposalExpiryS() uint64 {
+	if c.ProposalTimeoutS == 0 {
+		return c.ProtocolTimeoutS
+	}
+	return c.ProposalTimeoutS
+}
+
+// Returns the number of agreements to govern at the same time.
+func (c *AGConfig) GovernanceWorkers() int {
+	if c.GovernanceConcurrency == 0 {
+		return 1
+	}
+	return c.GovernanceConcurrency
+}
+
+// Returns the metadata configured in AgreementMetadata, or nil if there is none.
+func (c *AGConfig) AgreementMetadataMap() (map[string]string, error) {
+	if c.AgreementMetadata == "" {
+		return nil, nil
+	}
+
+	res := make(map[string]string)
+	for _, pair := range strings.Split(c.AgreementMetadata, ",") {
+		pieces := strings.SplitN(pair, "=", 2)
+		if len(pieces) != 2 || strings.TrimSpace(pieces[0]) == "" {
+			return nil, fmt.Errorf("AgreementMetadata entry %v must be of the form key=value", pair)
+		}
+		res[strings.TrimSpace(pieces[0])] = strings.TrimSpace(pieces[1])
+	}
+	return res, nil
+}
+
+// Returns the cancel cooldowns configured in CancelCooldownS, keyed by termination reason.
+func (c *AGConfig) CancelCooldowns() (map[string]int, error) {
+	res := make(map[string]int)
+	if c.CancelCooldownS == "" {
+		return res, nil
+	}
+
+	for _, pair := range strings.Split(c.CancelCooldownS, ",") {
+		pieces := strings.Split(strings.TrimSpace(pair), ":")
+		if len(pieces) != 2 || pieces[0] == "" {
+			return nil, fmt.Errorf("CancelCooldownS entry %v must be of the form reason:seconds", pair)
+		} else if secs, err := strconv.Atoi(pieces[1]); err != nil || secs < 0 {
+			return nil, fmt.Errorf("CancelCooldownS entry %v must have a non-negative number of seconds", pair)
+		} else {
+			res[pieces[0]] = secs
+		}
+	}
+	return res, nil
+}
+
+// Returns the exchange URLs configured in ExchangeOrgURLs, keyed by org. The map is shared and must not be modified.
+func (c *AGConfig) ExchangeOrgURLMap() (map[string]string, error) {
+	return parsedExchangeOrgURLMap(c.ExchangeOrgURLs)
+}
+
+// Returns the URL of the exchange that holds the resources of the org, see ExchangeOrgURLs.
+func (c *AGConfig) GetExchangeURL(org string) string {
+	return exchangeURLForOrg(c.ExchangeURL, c.ExchangeOrgURLs, org)
+}
+
+// Returns the exchange URLs configured in ExchangeOrgURLs, keyed by org. The map is shared and must not be modified.
+func (c *Config) ExchangeOrgURLMap() (map[string]string, error) {
+	return parsedExchangeOrgURLMap(c.ExchangeOrgURLs)
+}
+
+// Returns the URL of the exchange that holds the resources of the org, see ExchangeOrgURLs.
+func (c *Config) GetExchangeURL(org string) string {
+	return exchangeURLForOrg(c.ExchangeURL, c.ExchangeOrgURLs, org)
+}
+
+// Parse a list of org=url pairs. The exchange API paths are appended to the URLs, so a URL without a trailing slash is
+// given one, like ExchangeURL is expected to have.
+func exchangeOrgURLMap(orgURLs string) (map[string]string, error) {
+	res := make(map[string]string)
+	if orgURLs == "" {
+		return res, nil
+	}
+
+	for _, entry := range strings.Split(orgURLs, ",") {
+		pieces := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(pieces) != 2 || strings.TrimSpace(pieces[0]) == "" || strings.TrimSpace(pieces[1]) == "" {
+			return nil, fmt.Errorf("ExchangeOrgURLs entry %v must be of the form org=url", entry)
+		} else if u, err := url.Parse(strings.TrimSpace(pieces[1])); err != nil {
+			return nil, fmt.Errorf("ExchangeOrgURLs entry %v has an ill-formed URL, error %v", entry, err)
+		} else if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("ExchangeOrgURLs entry %v must have an absolute URL", entry)
+		} else {
+			exURL := u.String()
+			if !strings.HasSuffix(exURL, "/") {
+				exURL += "/"
+			}
+			res[strings.TrimSpace(pieces[0])] = exURL
+		}
+	}
+	return res, nil
+}
+
+// The ExchangeOrgURLs settings that have been parsed, keyed by the setting. A setting is parsed when the config is read,
+// so that looking up the exchange URL of an org for each exchange call does not parse it again.
+var exchangeOrgURLMaps = struct {
+	lock sync.Mutex
+	maps map[string]map[string]string
+}{maps: make(map[string]map[string]string)}
+
+// Returns the parsed orgURLs, parsing them if they were not parsed before. A setting that does not parse is not kept.
+func parsedExchangeOrgURLMap(orgURLs string) (map[string]string, error) {
+	exchangeOrgURLMaps.lock.Lock()
+	defer exchangeOrgURLMaps.lock.Unlock()
+
+	if urls, ok := exchangeOrgURLMaps.maps[orgURLs]; ok {
+		return urls, nil
+	} else if urls, err := exchangeOrgURLMap(orgURLs); err != nil {
+		return nil, err
+	} else {
+		exchangeOrgURLMaps.maps[orgURLs] = urls
+		return urls, nil
+	}
+}
+
+// Returns the URL the org is mapped to in orgURLs, or exchangeURL when it is not mapped. The mapping is validated when
+// the config is read, a mapping that does not parse is ignored here.
+func exchangeURLForOrg(exchangeURL string, orgURLs string, org string) string {
+	if orgURLs == "" {
+		return exchangeURL
+	} else if urls, err := parsedExchangeOrgURLMap(orgURLs); err != nil {
+		return exchangeURL
+	} else if u, ok := urls[org]; ok {
+		return u
+	}
+	return exchangeURL
+}
+
+// Returns the blockchain image URL overrides configured in BlockchainImageURLs, keyed by org/name or by name alone.
+func (c *Config) BlockchainImageOverrides() (map[string]string, error) {
+	res := make(map[string]string)
+	if c.BlockchainImageURLs == "" {
+		return res, nil
+	}
+
+	for _, entry := range strings.Split(c.BlockchainImageURLs, ",") {
+		pieces := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(pieces) != 2 || pieces[0] == "" || pieces[1] == "" {
+			return nil, fmt.Errorf("BlockchainImageURLs entry %v must be of the form org/name=url", entry)
+		} else if _, err := url.Parse(pieces[1]); err != nil {
+			return nil, fmt.Errorf("BlockchainImageURLs entry %v has an ill-formed URL, error %v", entry, err)
+		} else {
+			res[pieces[0]] = pieces[1]
+		}
+	}
+	return res, nil
+}
+
+// Returns the fallback registries configured in FallbackImageRegistries, keyed by the lower case registry domain.
+func (c *Config) FallbackImageRegistryMap() (map[string]string, error) {
+	res := make(map[string]string)
+	if c.FallbackImageRegistries == "" {
+		return res, nil
+	}
+
+	for _, entry := range strings.Split(c.FallbackImageRegistries, ",") {
+		pieces := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(pieces) != 2 || strings.TrimSpace(pieces[0]) == "" || strings.TrimSpace(pieces[1]) == "" || strings.Contains(pieces[1], "/") {
+			return nil, fmt.Errorf("FallbackImageRegistries entry %v must be of the form registry=fallback", entry)
+		}
+		res[strings.ToLower(strings.TrimSpace(pieces[0]))] = strings.TrimSpace(pieces[1])
+	}
+	return res, nil
+}
+
+// Returns how long node shutdown waits for agreement work to drain before it continues without it.
+func (c *Config) ShutdownDrainTimeout() time.Duration {
+	if c.ShutdownDrainTimeoutS <= 0 {
+		return DefaultShutdownDrainTimeoutS * time.Second
+	}
+	return time.Duration(c.ShutdownDrainTimeoutS) * time.Second
+}
+
+// Returns the free space, in MB, needed before a workload image is pulled, or zero when the check is disabled.
+func (c *Config) MinFreeSpaceMB() int64 {
+	if c.DockerMinFreeSpaceMB < 0 {
+		return 0
+	} else if c.DockerMinFreeSpaceMB == 0 {
+		return DefaultDockerMinFreeSpaceMB
+	}
+	return int64(c.DockerMinFreeSpaceMB)
+}
+
+// Returns the directory checked for DockerMinFreeSpaceMB, the configured DockerStoragePath or else the input root dir
+// reported by the docker daemon, which is empty when it reports none.
+func (c *Config) DockerStorage(rootDir string) string {
+	if c.DockerStoragePath != "" {
+		return c.DockerStoragePath
+	} else if rootDir != "" {
+		return rootDir
+	}
+	return DefaultDockerStoragePath
+}
+
+// Returns the platform to pull workload images for, the configured ImagePullPlatform or else linux and the arch of the node.
+func (c *Config) PullPlatform() string {
+	if c.ImagePullPlatform != "" {
+		return c.ImagePullPlatform
+	}
+	return "linux/" + cutil.ArchString()
+}
+
+// Returns the image URL override for the blockchain instance, or the empty string if there is none. An org/name
+// entry takes precedence over a name only entry.
+func (c *Config) BlockchainImageOverride(org string, name string) (string, error) {
+	if overrides, err := c.BlockchainImageOverrides(); err != nil {
+		return "", err
+	} else if u, ok := overrides[org+"/"+name]; ok {
+		return u, nil
+	} else {
+		return overrides[name], nil
+	}
 }
 
 func (c *HorizonConfig) UserPublicKeyPath() string {
@@ -102,44 +464,217 @@ func enrichFromEnvvars(config *HorizonConfig) error {
 	return nil
 }
 
+// Checks the configured DefaultServiceRegistrationRAM, in MB. Negative values are rejected, other values outside the range
+// MinServiceRegistrationRAM to MaxServiceRegistrationRAM are accepted with a warning. Zero is accepted without a warning.
+func validServiceRegistrationRAM(ram int64) error {
+	if ram < 0 {
+		return fmt.Errorf("DefaultServiceRegistrationRAM %v must not be negative", ram)
+	} else if ram > MaxServiceRegistrationRAM || (ram != 0 && ram < MinServiceRegistrationRAM) {
+		glog.Warningf("DefaultServiceRegistrationRAM %v MB is outside the expected range of %v to %v MB", ram, MinServiceRegistrationRAM, MaxServiceRegistrationRAM)
+	}
+	return nil
+}
+
+// Returns the ExchangeMessageTTL to use for the configured value, which is clamped into the range MinExchangeMessageTTL
+// to MaxExchangeMessageTTL.
+func validExchangeMessageTTL(section string, ttl int) int {
+	if ttl < MinExchangeMessageTTL {
+		glog.Warningf("%v.ExchangeMessageTTL %v is too small, using %v", section, ttl, MinExchangeMessageTTL)
+		return MinExchangeMessageTTL
+	} else if ttl > MaxExchangeMessageTTL {
+		glog.Warningf("%v.ExchangeMessageTTL %v is too large, using %v", section, ttl, MaxExchangeMessageTTL)
+		return MaxExchangeMessageTTL
+	}
+	return ttl
+}
+
 func Read(file string) (*HorizonConfig, error) {
+	return ReadMultiple([]string{file})
+}
 
-	if _, err := os.Stat(file); err != nil {
-		return nil, fmt.Errorf("Config file not found: %s. Error: %v", file, err)
+// Read a config made of several files, e.g. a base config followed by an environment specific override file. The
+// files are decoded in order onto the same HorizonConfig, so a field set in a later file overrides the value from an
+// earlier file, and fields a later file does not mention keep their earlier value. Following encoding/json, a map
+// in a later file is merged key by key into the earlier map, while a slice (array) in a later file replaces the
+// earlier slice. The envvar enrichment, validation and collaborator setup is done once, after all files are decoded.
+func ReadMultiple(files []string) (*HorizonConfig, error) {
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No config files specified")
 	}
 
-	// attempt to parse config file
-	path, err := os.Open(filepath.Clean(file))
-	if err != nil {
-		return nil, fmt.Errorf("Unable to read config file: %s. Error: %v", file, err)
-	} else {
-		// instantiate mostly empty which will be filled. Values here are defaults that can be overridden by the user
-		config := HorizonConfig{
-			Edge: Config{
-				DefaultHTTPClientTimeoutS: 20,
-			},
+	// instantiate mostly empty which will be filled. Values here are defaults that can be overridden by the user
+	config := HorizonConfig{
+		Edge: Config{
+			DefaultHTTPClientTimeoutS: 20,
+			ExchangeMessageTTL:        DefaultExchangeMessageTTL,
+		},
+		AgreementBot: AGConfig{
+			ExchangeMessageTTL: DefaultExchangeMessageTTL,
+		},
+	}
+
+	for _, file := range files {
+		if err := decodeConfigFile(file, &config); err != nil {
+			return nil, err
 		}
+	}
+
+	err := enrichFromEnvvars(&config)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to enrich content of config file with envvars: %v", err)
+	}
+
+	config.Edge.ExchangeMessageTTL = validExchangeMessageTTL("Edge", config.Edge.ExchangeMessageTTL)
+	config.AgreementBot.ExchangeMessageTTL = validExchangeMessageTTL("AgreementBot", config.AgreementBot.ExchangeMessageTTL)
+
+	if err := validServiceRegistrationRAM(config.Edge.DefaultServiceRegistrationRAM); err != nil {
+		return nil, fmt.Errorf("%v, config files: %v", err, files)
+	}
+
+	if s := config.Edge.ImageFetchStrategy; s != "" && s != ImageFetchTorrentPreferred && s != ImageFetchRegistryOnly {
+		return nil, fmt.Errorf("ImageFetchStrategy %v is not supported, it must be %v or %v, config files: %v", s, ImageFetchTorrentPreferred, ImageFetchRegistryOnly, files)
+	}
+
+	if p := config.AgreementBot.IntervalJitterPercent; p < 0 || p >= 100 {
+		return nil, fmt.Errorf("IntervalJitterPercent %v must be at least 0 and less than 100, config files: %v", p, files)
+	}
+
+	if q := config.AgreementBot.HAPartnerQuorumPercent; q < 0 || q > 100 {
+		return nil, fmt.Errorf("HAPartnerQuorumPercent %v must be between 0 and 100, config files: %v", q, files)
+	}
+
+	if c := config.AgreementBot.NewContractMaxIntervalS; c != 0 && c < config.AgreementBot.NewContractIntervalS {
+		return nil, fmt.Errorf("NewContractMaxIntervalS %v must be zero or at least NewContractIntervalS %v, config files: %v", c, config.AgreementBot.NewContractIntervalS, files)
+	}
+
+	if r := config.AgreementBot.ReconcileAgreementsS; r < 0 {
+		return nil, fmt.Errorf("ReconcileAgreementsS %v must not be negative, config files: %v", r, files)
+	}
+
+	if c := config.AgreementBot.GovernanceConcurrency; c < 0 {
+		return nil, fmt.Errorf("GovernanceConcurrency %v must not be negative, config files: %v", c, files)
+	}
+
+	if v := config.AgreementBot.MinAgreementProtocolVersion; v < 0 {
+		return nil, fmt.Errorf("MinAgreementProtocolVersion %v must not be negative, config files: %v", v, files)
+	}
+
+	if d := config.AgreementBot.WorkQueueDegradedDepth; d < 0 {
+		return nil, fmt.Errorf("WorkQueueDegradedDepth %v must not be negative, config files: %v", d, files)
+	}
+
+	if a := config.AgreementBot.WorkQueueDegradedAgeS; a < 0 {
+		return nil, fmt.Errorf("WorkQueueDegradedAgeS %v must not be negative, config files: %v", a, files)
+	}
+
+	config.Edge.DVPrefix = cutil.NormalizeDVPrefix(config.Edge.DVPrefix)
+	config.AgreementBot.DVPrefix = cutil.NormalizeDVPrefix(config.AgreementBot.DVPrefix)
+	if config.Edge.DVPrefix != "" && config.AgreementBot.DVPrefix != "" && config.Edge.DVPrefix != config.AgreementBot.DVPrefix {
+		glog.Warningf("Edge DVPrefix %v and AgreementBot DVPrefix %v differ, data verification will not find the agreement ids of workloads on this node", config.Edge.DVPrefix, config.AgreementBot.DVPrefix)
+	}
+
+	if id := config.AgreementBot.ExchangeId; id != "" && !orgQualified(id) {
+		return nil, fmt.Errorf("AgreementBot ExchangeId %v must be org qualified, e.g. myorg/%v, config files: %v", id, id, files)
+	}
+
+	if _, err := config.AgreementBot.CancelCooldowns(); err != nil {
+		return nil, fmt.Errorf("%v, config files: %v", err, files)
+	}
 
-		err := json.NewDecoder(path).Decode(&config)
-		if err != nil {
-			return nil, fmt.Errorf("Unable to decode content of config file: %v", err)
+	if denied := config.AgreementBot.DeniedWorkloadVersions; denied != "" {
+		for _, entry := range strings.Split(denied, ",") {
+			if pieces := strings.Split(strings.TrimSpace(entry), "@"); len(pieces) < 2 || len(pieces) > 3 || pieces[0] == "" || pieces[1] == "" || pieces[len(pieces)-1] == "" {
+				return nil, fmt.Errorf("DeniedWorkloadVersions entry %v must be of the form url@version or url@version@arch, config files: %v", entry, files)
+			}
 		}
+	}
+
+	if a := config.AgreementBot.MissingMicroserviceAction; a != "" && a != MissingMicroserviceSkip && a != MissingMicroserviceFail {
+		return nil, fmt.Errorf("MissingMicroserviceAction %v is not supported, it must be %v or %v, config files: %v", a, MissingMicroserviceSkip, MissingMicroserviceFail, files)
+	}
 
-		err = enrichFromEnvvars(&config)
+	if a := config.AgreementBot.UnexpectedDataAckAction; a != "" && a != UnexpectedDataAckIgnore && a != UnexpectedDataAckFlag {
+		return nil, fmt.Errorf("UnexpectedDataAckAction %v is not supported, it must be %v or %v, config files: %v", a, UnexpectedDataAckIgnore, UnexpectedDataAckFlag, files)
+	}
 
-		if err != nil {
-			return nil, fmt.Errorf("Unable to enrich content of config file with envvars: %v", err)
+	if _, err := config.AgreementBot.ExchangeOrgURLMap(); err != nil {
+		return nil, fmt.Errorf("AgreementBot %v, config files: %v", err, files)
+	}
+
+	if _, err := config.AgreementBot.AgreementMetadataMap(); err != nil {
+		return nil, fmt.Errorf("%v, config files: %v", err, files)
+	}
+
+	if props := config.AgreementBot.PreferDeviceProps; props != "" {
+		for _, pref := range strings.Split(props, ",") {
+			if pieces := strings.SplitN(pref, "=", 2); len(pieces) != 2 || strings.TrimSpace(pieces[0]) == "" {
+				return nil, fmt.Errorf("PreferDeviceProps entry %v must be of the form name=value, config files: %v", pref, files)
+			}
 		}
+	}
 
-		// now make collaborators instance and assign it to member in this config
-		collaborators, err := NewCollaborators(config)
-		if err != nil {
-			return nil, err
+	if _, err := config.Edge.ExchangeOrgURLMap(); err != nil {
+		return nil, fmt.Errorf("Edge %v, config files: %v", err, files)
+	}
+
+	if _, err := config.Edge.BlockchainImageOverrides(); err != nil {
+		return nil, fmt.Errorf("%v, config files: %v", err, files)
+	}
+
+	if _, err := config.Edge.FallbackImageRegistryMap(); err != nil {
+		return nil, fmt.Errorf("%v, config files: %v", err, files)
+	}
+
+	if t := config.Edge.DockerPullTimeoutS; t < 0 {
+		return nil, fmt.Errorf("DockerPullTimeoutS %v must not be negative, config files: %v", t, files)
+	}
+
+	if p := config.Edge.ImagePullPlatform; p != "" {
+		if pieces := strings.Split(p, "/"); len(pieces) < 2 || len(pieces) > 3 || pieces[0] == "" || pieces[1] == "" || pieces[len(pieces)-1] == "" {
+			return nil, fmt.Errorf("ImagePullPlatform %v must be of the form os/arch or os/arch/variant, config files: %v", p, files)
 		}
+	}
+
+	if (config.Edge.ClientCertPath == "") != (config.Edge.ClientKeyPath == "") {
+		return nil, fmt.Errorf("ClientCertPath and ClientKeyPath must be specified together, config files: %v", files)
+	}
+
+	// now make collaborators instance and assign it to member in this config
+	collaborators, err := NewCollaborators(config)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Collaborators = *collaborators
+
+	// success at last!
+	return &config, nil
+}
 
-		config.Collaborators = *collaborators
+// Returns true if the id is of the form org/id, with both parts present.
+func orgQualified(id string) bool {
+	pieces := strings.SplitN(id, "/", 2)
+	return len(pieces) == 2 && pieces[0] != "" && pieces[1] != ""
+}
+
+// Decode a config file onto the input config, overriding the fields that the file sets.
+func decodeConfigFile(file string, config *HorizonConfig) error {
 
-		// success at last!
-		return &config, nil
+	if _, err := os.Stat(file); err != nil {
+		return fmt.Errorf("Config file not found: %s. Error: %v", file, err)
 	}
+
+	// attempt to parse config file
+	path, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return fmt.Errorf("Unable to read config file: %s. Error: %v", file, err)
+	}
+	defer path.Close()
+
+	if err := json.NewDecoder(path).Decode(config); err != nil {
+		return fmt.Errorf("Unable to decode content of config file %s: %v", file, err)
+	}
+	return nil
 }
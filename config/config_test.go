@@ -3,7 +3,10 @@
 package config
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -37,3 +40,486 @@ func Test_enrichFromEnvvars_success(t *testing.T) {
 		t.Errorf("Config enrichment did not set exchange URL from envvar as expected")
 	}
 }
+
+func Test_CancelCooldowns(t *testing.T) {
+
+	ag := AGConfig{}
+	if cc, err := ag.CancelCooldowns(); err != nil || len(cc) != 0 {
+		t.Errorf("Expected empty cooldowns, got %v, error %v", cc, err)
+	}
+
+	ag.CancelCooldownS = "NegativeReply:300, WriteFailed:60"
+	if cc, err := ag.CancelCooldowns(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if cc["NegativeReply"] != 300 || cc["WriteFailed"] != 60 {
+		t.Errorf("Cooldowns not parsed correctly: %v", cc)
+	}
+
+	ag.CancelCooldownS = "NegativeReply"
+	if _, err := ag.CancelCooldowns(); err == nil {
+		t.Errorf("Expected error for entry without seconds")
+	}
+
+	ag.CancelCooldownS = "NegativeReply:abc"
+	if _, err := ag.CancelCooldowns(); err == nil {
+		t.Errorf("Expected error for entry with non-numeric seconds")
+	}
+}
+
+func Test_AgreementMetadataMap(t *testing.T) {
+
+	ag := AGConfig{}
+	if md, err := ag.AgreementMetadataMap(); err != nil || md != nil {
+		t.Errorf("Expected no metadata, got %v, error %v", md, err)
+	}
+
+	ag.AgreementMetadata = "batch=2017-11, ticket=OPS-42=b"
+	if md, err := ag.AgreementMetadataMap(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if len(md) != 2 || md["batch"] != "2017-11" || md["ticket"] != "OPS-42=b" {
+		t.Errorf("Metadata not parsed correctly: %v", md)
+	}
+
+	ag.AgreementMetadata = "batch"
+	if _, err := ag.AgreementMetadataMap(); err == nil {
+		t.Errorf("Expected error for entry without a value")
+	}
+}
+
+func Test_BlockchainImageOverride(t *testing.T) {
+
+	c := Config{}
+	if u, err := c.BlockchainImageOverride("IBM", "bluehorizon"); err != nil || u != "" {
+		t.Errorf("Expected no override, got %v, error %v", u, err)
+	}
+
+	c.BlockchainImageURLs = "IBM/bluehorizon=https://mirror.example.com/org.torrent, bluehorizon=https://mirror.example.com/any.torrent?a=b"
+	if u, err := c.BlockchainImageOverride("IBM", "bluehorizon"); err != nil || u != "https://mirror.example.com/org.torrent" {
+		t.Errorf("Expected org override, got %v, error %v", u, err)
+	} else if u, err := c.BlockchainImageOverride("other", "bluehorizon"); err != nil || u != "https://mirror.example.com/any.torrent?a=b" {
+		t.Errorf("Expected name override, got %v, error %v", u, err)
+	} else if u, err := c.BlockchainImageOverride("IBM", "other"); err != nil || u != "" {
+		t.Errorf("Expected no override, got %v, error %v", u, err)
+	}
+
+	c.BlockchainImageURLs = "IBM/bluehorizon"
+	if _, err := c.BlockchainImageOverride("IBM", "bluehorizon"); err == nil {
+		t.Errorf("Expected error for entry without a URL")
+	}
+}
+
+func Test_GetExchangeURL(t *testing.T) {
+
+	c := Config{ExchangeURL: "https://exchange.example.com/api/v1/"}
+	if u := c.GetExchangeURL("myorg"); u != c.ExchangeURL {
+		t.Errorf("Expected the global exchange URL without a mapping, got %v", u)
+	}
+
+	c.ExchangeOrgURLs = "myorg=https://exchange2.example.com/api/v1/, otherorg=https://exchange3.example.com:8443/api/v1"
+	if u := c.GetExchangeURL("myorg"); u != "https://exchange2.example.com/api/v1/" {
+		t.Errorf("Expected the mapped exchange URL, got %v", u)
+	} else if u := c.GetExchangeURL("otherorg"); u != "https://exchange3.example.com:8443/api/v1/" {
+		t.Errorf("Expected the mapped exchange URL with a trailing slash, got %v", u)
+	} else if u := c.GetExchangeURL("unmapped"); u != c.ExchangeURL {
+		t.Errorf("Expected the global exchange URL for an unmapped org, got %v", u)
+	}
+
+	ag := AGConfig{ExchangeURL: "https://exchange.example.com/api/v1/", ExchangeOrgURLs: "myorg=https://exchange2.example.com/api/v1/"}
+	if u := ag.GetExchangeURL("myorg"); u != "https://exchange2.example.com/api/v1/" {
+		t.Errorf("Expected the mapped exchange URL, got %v", u)
+	} else if u := ag.GetExchangeURL("unmapped"); u != ag.ExchangeURL {
+		t.Errorf("Expected the global exchange URL for an unmapped org, got %v", u)
+	}
+
+	for _, bad := range []string{"myorg", "myorg=", "=https://exchange2.example.com/", "myorg=exchange2.example.com/api/v1/"} {
+		c.ExchangeOrgURLs = bad
+		if _, err := c.ExchangeOrgURLMap(); err == nil {
+			t.Errorf("Expected error for entry %v", bad)
+		} else if u := c.GetExchangeURL("myorg"); u != c.ExchangeURL {
+			t.Errorf("Expected the global exchange URL for an invalid mapping, got %v", u)
+		}
+	}
+}
+
+func Test_MinFreeSpaceMB(t *testing.T) {
+
+	if mb := (&Config{}).MinFreeSpaceMB(); mb != DefaultDockerMinFreeSpaceMB {
+		t.Errorf("Expected the default minimum, got %v", mb)
+	} else if mb := (&Config{DockerMinFreeSpaceMB: 500}).MinFreeSpaceMB(); mb != 500 {
+		t.Errorf("Expected the configured minimum, got %v", mb)
+	} else if mb := (&Config{DockerMinFreeSpaceMB: -1}).MinFreeSpaceMB(); mb != 0 {
+		t.Errorf("Expected the check to be disabled, got %v", mb)
+	}
+
+	if p := (&Config{}).DockerStorage(""); p != DefaultDockerStoragePath {
+		t.Errorf("Expected the default storage path, got %v", p)
+	} else if p := (&Config{}).DockerStorage("/data/docker"); p != "/data/docker" {
+		t.Errorf("Expected the daemon's root dir, got %v", p)
+	} else if p := (&Config{DockerStoragePath: "/host/docker"}).DockerStorage("/data/docker"); p != "/host/docker" {
+		t.Errorf("Expected the configured storage path, got %v", p)
+	}
+}
+
+func Test_AllowsWorkloadArch(t *testing.T) {
+
+	ag := AGConfig{}
+	if !ag.AllowsWorkloadArch("arm") || !ag.AllowsWorkloadArch("amd64") {
+		t.Errorf("All arches should be allowed when WorkloadArches is empty")
+	}
+
+	ag.WorkloadArches = "amd64"
+	if ag.AllowsWorkloadArch("arm") {
+		t.Errorf("arm workload should be skipped when only amd64 is allowed")
+	} else if !ag.AllowsWorkloadArch("amd64") {
+		t.Errorf("amd64 workload should be allowed")
+	}
+
+	ag.WorkloadArches = "amd64, arm64"
+	if !ag.AllowsWorkloadArch("arm64") {
+		t.Errorf("arm64 workload should be allowed")
+	}
+}
+
+func Test_DeniesWorkloadVersion(t *testing.T) {
+
+	ag := AGConfig{}
+	if ag.DeniesWorkloadVersion("https://bluehorizon.network/workloads/netspeed", "2.3.1", "amd64") {
+		t.Errorf("No workload version should be denied when DeniedWorkloadVersions is empty")
+	}
+
+	ag.DeniedWorkloadVersions = "https://bluehorizon.network/workloads/netspeed@2.3.1, https://bluehorizon.network/workloads/cpu@1.0.0@arm"
+	if !ag.DeniesWorkloadVersion("https://bluehorizon.network/workloads/netspeed", "2.3.1", "amd64") || !ag.DeniesWorkloadVersion("https://bluehorizon.network/workloads/netspeed", "2.3.1", "arm") {
+		t.Errorf("netspeed 2.3.1 should be denied for all arches")
+	} else if ag.DeniesWorkloadVersion("https://bluehorizon.network/workloads/netspeed", "2.3.2", "amd64") {
+		t.Errorf("netspeed 2.3.2 should be allowed")
+	} else if !ag.DeniesWorkloadVersion("https://bluehorizon.network/workloads/cpu", "1.0.0", "arm") {
+		t.Errorf("cpu 1.0.0 should be denied for arm")
+	} else if ag.DeniesWorkloadVersion("https://bluehorizon.network/workloads/cpu", "1.0.0", "amd64") {
+		t.Errorf("cpu 1.0.0 should be allowed for amd64")
+	}
+}
+
+func Test_AllowsWorkloadOrg(t *testing.T) {
+
+	ag := AGConfig{}
+	if !ag.AllowsWorkloadOrg("orgA") || !ag.AllowsWorkloadOrg("orgB") {
+		t.Errorf("All orgs should be allowed when WorkloadOrgs is empty")
+	}
+
+	ag.WorkloadOrgs = "orgA, orgC"
+	if ag.AllowsWorkloadOrg("orgB") {
+		t.Errorf("orgB workload should be skipped when only orgA and orgC are allowed")
+	} else if !ag.AllowsWorkloadOrg("orgA") || !ag.AllowsWorkloadOrg("orgC") {
+		t.Errorf("orgA and orgC workloads should be allowed")
+	}
+}
+
+func Test_WorkloadExclusion(t *testing.T) {
+
+	ag := AGConfig{WorkloadArches: "amd64", WorkloadOrgs: "orgA", DeniedWorkloadVersions: "cpu@1.0.0"}
+	if r := ag.WorkloadExclusion("cpu", "orgA", "1.0.1", "amd64"); r != "" {
+		t.Errorf("expected the workload not to be excluded, got %v", r)
+	} else if r := ag.WorkloadExclusion("cpu", "orgA", "1.0.1", "arm"); !strings.Contains(r, "arch arm") {
+		t.Errorf("expected the workload to be excluded by its arch, got %v", r)
+	} else if r := ag.WorkloadExclusion("cpu", "orgB", "1.0.1", "amd64"); !strings.Contains(r, "org orgB") {
+		t.Errorf("expected the workload to be excluded by its org, got %v", r)
+	} else if r := ag.WorkloadExclusion("cpu", "", "1.0.1", "amd64"); r != "" {
+		t.Errorf("expected a workload without an org not to be excluded, got %v", r)
+	} else if r := ag.WorkloadExclusion("cpu", "orgA", "1.0.0", "amd64"); !strings.Contains(r, "version 1.0.0") {
+		t.Errorf("expected the workload to be excluded by its version, got %v", r)
+	}
+}
+
+func Test_Read_client_cert_pair(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "config-read-")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(`{"Edge":{"ClientCertPath":"/tmp/cert.pem"}}`), 0660); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Read(configPath); err == nil || !strings.Contains(err.Error(), "ClientCertPath and ClientKeyPath") {
+		t.Errorf("Expected error for client cert without key, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(configPath, []byte(`{"Edge":{"ClientKeyPath":"/tmp/key.pem"}}`), 0660); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Read(configPath); err == nil || !strings.Contains(err.Error(), "ClientCertPath and ClientKeyPath") {
+		t.Errorf("Expected error for client key without cert, got %v", err)
+	}
+}
+
+func Test_Read_image_fetch_strategy(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "config-read-")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(`{"Edge":{"ImageFetchStrategy":"ftp"}}`), 0660); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Read(configPath); err == nil || !strings.Contains(err.Error(), "ImageFetchStrategy ftp is not supported") {
+		t.Errorf("Expected error for unsupported image fetch strategy, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(configPath, []byte(`{"Edge":{"ImageFetchStrategy":"registry"}}`), 0660); err != nil {
+		t.Error(err)
+	}
+
+	if cfg, err := Read(configPath); err != nil {
+		t.Errorf("Unexpected error reading config file: %v", err)
+	} else if cfg.Edge.ImageFetchStrategy != ImageFetchRegistryOnly {
+		t.Errorf("Expected registry only image fetch strategy, got %v", cfg.Edge.ImageFetchStrategy)
+	}
+}
+
+func Test_validExchangeMessageTTL(t *testing.T) {
+
+	if ttl := validExchangeMessageTTL("Edge", 0); ttl != MinExchangeMessageTTL {
+		t.Errorf("Expected minimum TTL for zero, got %v", ttl)
+	} else if ttl := validExchangeMessageTTL("Edge", -5); ttl != MinExchangeMessageTTL {
+		t.Errorf("Expected minimum TTL for negative value, got %v", ttl)
+	} else if ttl := validExchangeMessageTTL("Edge", MaxExchangeMessageTTL+1); ttl != MaxExchangeMessageTTL {
+		t.Errorf("Expected maximum TTL for large value, got %v", ttl)
+	} else if ttl := validExchangeMessageTTL("Edge", 300); ttl != 300 {
+		t.Errorf("Expected TTL in range to be unchanged, got %v", ttl)
+	}
+}
+
+func Test_ReadMultiple_ExchangeMessageTTL(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "config-ttl-")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The default is used when the TTL is omitted, an explicit zero is clamped like any other value.
+	path := filepath.Join(dir, "ttl.json")
+	if err := ioutil.WriteFile(path, []byte(`{"Edge":{"DBPath":"/var/base"},"AgreementBot":{"ExchangeMessageTTL":0}}`), 0660); err != nil {
+		t.Error(err)
+	}
+
+	if cfg, err := ReadMultiple([]string{path}); err != nil {
+		t.Fatalf("Unexpected error reading config file: %v", err)
+	} else if cfg.Edge.ExchangeMessageTTL != DefaultExchangeMessageTTL {
+		t.Errorf("Expected default TTL when omitted, got %v", cfg.Edge.ExchangeMessageTTL)
+	} else if cfg.AgreementBot.ExchangeMessageTTL != MinExchangeMessageTTL {
+		t.Errorf("Expected minimum TTL when explicitly zero, got %v", cfg.AgreementBot.ExchangeMessageTTL)
+	}
+}
+
+func Test_validServiceRegistrationRAM(t *testing.T) {
+
+	if err := validServiceRegistrationRAM(-1); err == nil || !strings.Contains(err.Error(), "must not be negative") {
+		t.Errorf("Expected error for negative RAM, got %v", err)
+	}
+
+	// Values in range, too small or too large ones are accepted, the too small or too large ones with a warning.
+	for _, ram := range []int64{0, 256, 1, MaxServiceRegistrationRAM + 1, 256 * 1024 * 1024} {
+		if err := validServiceRegistrationRAM(ram); err != nil {
+			t.Errorf("Unexpected error for RAM %v: %v", ram, err)
+		}
+	}
+}
+
+func Test_ReadMultiple_override(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "config-read-")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+
+	basePath := filepath.Join(dir, "base.json")
+	if err := ioutil.WriteFile(basePath, []byte(`{"Edge":{"DBPath":"/var/base","APIListen":"127.0.0.1:8510","ReportDeviceStatus":true},"AgreementBot":{"AgreementWorkers":5,"ExchangeMessageTTL":300}}`), 0660); err != nil {
+		t.Error(err)
+	}
+
+	overridePath := filepath.Join(dir, "override.json")
+	if err := ioutil.WriteFile(overridePath, []byte(`{"Edge":{"DBPath":"/var/prod","ReportDeviceStatus":false},"AgreementBot":{"AgreementWorkers":10}}`), 0660); err != nil {
+		t.Error(err)
+	}
+
+	cfg, err := ReadMultiple([]string{basePath, overridePath})
+	if err != nil {
+		t.Fatalf("Unexpected error reading config files: %v", err)
+	}
+
+	// Fields set in the override file replace the base values, including zero values that are explicitly set.
+	if cfg.Edge.DBPath != "/var/prod" {
+		t.Errorf("Expected DBPath from the override file, got %v", cfg.Edge.DBPath)
+	} else if cfg.Edge.ReportDeviceStatus {
+		t.Errorf("Expected ReportDeviceStatus to be overridden to false")
+	} else if cfg.AgreementBot.AgreementWorkers != 10 {
+		t.Errorf("Expected AgreementWorkers from the override file, got %v", cfg.AgreementBot.AgreementWorkers)
+	}
+
+	// Fields not in the override file keep the base values, and defaults are kept when neither file sets them.
+	if cfg.Edge.APIListen != "127.0.0.1:8510" {
+		t.Errorf("Expected APIListen from the base file, got %v", cfg.Edge.APIListen)
+	} else if cfg.AgreementBot.ExchangeMessageTTL != 300 {
+		t.Errorf("Expected ExchangeMessageTTL from the base file, got %v", cfg.AgreementBot.ExchangeMessageTTL)
+	} else if cfg.Edge.DefaultHTTPClientTimeoutS != 20 {
+		t.Errorf("Expected default DefaultHTTPClientTimeoutS, got %v", cfg.Edge.DefaultHTTPClientTimeoutS)
+	}
+
+	// The order of the files matters.
+	if cfg, err := ReadMultiple([]string{overridePath, basePath}); err != nil {
+		t.Errorf("Unexpected error reading config files: %v", err)
+	} else if cfg.Edge.DBPath != "/var/base" || cfg.AgreementBot.AgreementWorkers != 5 {
+		t.Errorf("Expected the base file to win when read last, got %v and %v", cfg.Edge.DBPath, cfg.AgreementBot.AgreementWorkers)
+	}
+
+	// A missing file is an error.
+	if _, err := ReadMultiple([]string{basePath, filepath.Join(dir, "missing.json")}); err == nil || !strings.Contains(err.Error(), "Config file not found") {
+		t.Errorf("Expected error for missing config file, got %v", err)
+	}
+}
+
+func Test_Read_formats(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "config-read-")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.json")
+	for content, expected := range map[string]string{
+		`{"AgreementBot":{"ExchangeId":"agbot1"}}`:                     "ExchangeId agbot1 must be org qualified",
+		`{"AgreementBot":{"ExchangeId":"/agbot1"}}`:                    "ExchangeId /agbot1 must be org qualified",
+		`{"AgreementBot":{"CancelCooldownS":"NegativeReply"}}`:         "CancelCooldownS entry NegativeReply must be of the form",
+		`{"AgreementBot":{"PreferDeviceProps":"tier=gold,premium"}}`:   "PreferDeviceProps entry premium must be of the form",
+		`{"AgreementBot":{"DeniedWorkloadVersions":"netspeed"}}`:       "DeniedWorkloadVersions entry netspeed must be of the form",
+		`{"AgreementBot":{"ExchangeId":"myorg/agbot1"}}`:               "",
+		`{"AgreementBot":{"PreferDeviceProps":"tier=gold,zone=east"}}`: "",
+		`{"AgreementBot":{"CancelCooldownS":"NegativeReply:300"}}`:     "",
+		`{"AgreementBot":{"DeniedWorkloadVersions":"netspeed@2.3.1"}}`: "",
+	} {
+		if err := ioutil.WriteFile(configPath, []byte(content), 0660); err != nil {
+			t.Error(err)
+		}
+
+		if _, err := Read(configPath); expected == "" && err != nil {
+			t.Errorf("Unexpected error reading config %v: %v", content, err)
+		} else if expected != "" && (err == nil || !strings.Contains(err.Error(), expected)) {
+			t.Errorf("Expected error containing %v for config %v, got %v", expected, content, err)
+		}
+	}
+}
+
+func Test_Read_DVPrefix_normalized(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "config-read-")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(`{"Edge":{"DVPrefix":" dv- "},"AgreementBot":{"DVPrefix":"dv-"}}`), 0660); err != nil {
+		t.Error(err)
+	}
+
+	if cfg, err := Read(configPath); err != nil {
+		t.Errorf("Unexpected error reading config file: %v", err)
+	} else if cfg.Edge.DVPrefix != "dv-" || cfg.AgreementBot.DVPrefix != "dv-" {
+		t.Errorf("Expected normalized DVPrefix settings, got %v and %v", cfg.Edge.DVPrefix, cfg.AgreementBot.DVPrefix)
+	}
+}
+
+func Test_Read_ExchangeOrgURLs(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "config-read-")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+
+	orgURLs := "readorg=https://exchange2.example.com/api/v1"
+	configPath := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(`{"AgreementBot":{"ExchangeURL":"https://exchange.example.com/api/v1/","ExchangeOrgURLs":"`+orgURLs+`"}}`), 0660); err != nil {
+		t.Error(err)
+	}
+
+	cfg, err := Read(configPath)
+	if err != nil {
+		t.Fatalf("Unexpected error reading config file: %v", err)
+	}
+
+	// The mapping was parsed when the config was read, the URLs are looked up in the parsed mapping.
+	exchangeOrgURLMaps.lock.Lock()
+	parsed, ok := exchangeOrgURLMaps.maps[orgURLs]
+	exchangeOrgURLMaps.lock.Unlock()
+	if !ok || parsed["readorg"] != "https://exchange2.example.com/api/v1/" {
+		t.Errorf("Expected the mapping to be parsed when the config is read, got %v", parsed)
+	} else if u := cfg.AgreementBot.GetExchangeURL("readorg"); u != "https://exchange2.example.com/api/v1/" {
+		t.Errorf("Expected the mapped exchange URL, got %v", u)
+	} else if u := cfg.AgreementBot.GetExchangeURL("unmapped"); u != cfg.AgreementBot.ExchangeURL {
+		t.Errorf("Expected the global exchange URL for an unmapped org, got %v", u)
+	}
+}
+
+func Test_ReadEffective(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "config-read-")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(dir)
+
+	basePath := filepath.Join(dir, "base.json")
+	if err := ioutil.WriteFile(basePath, []byte(`{"Edge":{"DBPath":"/var/base","APIListen":"127.0.0.1:8510"},"AgreementBot":{"ExchangeToken":"secret","ActiveAgreementsTokenHeader":"X-API-Key"}}`), 0660); err != nil {
+		t.Error(err)
+	}
+
+	overridePath := filepath.Join(dir, "override.json")
+	if err := ioutil.WriteFile(overridePath, []byte(`{"edge":{"dbpath":"/var/prod"}}`), 0660); err != nil {
+		t.Error(err)
+	}
+
+	if err := os.Setenv(ExchangeURLEnvvarName, "http://exchange/"); err != nil {
+		t.Errorf("Failed to set envvar in test environment. Error: %v", err)
+	}
+	defer os.Unsetenv(ExchangeURLEnvvarName)
+
+	ec, err := ReadEffective([]string{basePath, overridePath})
+	if err != nil {
+		t.Fatalf("Unexpected error reading config files: %v", err)
+	}
+
+	for name, expected := range map[string]EffectiveConfigField{
+		"DBPath":                    EffectiveConfigField{Value: "/var/prod", Source: ConfigSourceFile, Origin: overridePath},
+		"APIListen":                 EffectiveConfigField{Value: "127.0.0.1:8510", Source: ConfigSourceFile, Origin: basePath},
+		"ExchangeURL":               EffectiveConfigField{Value: "http://exchange/", Source: ConfigSourceEnvvar, Origin: ExchangeURLEnvvarName},
+		"DefaultHTTPClientTimeoutS": EffectiveConfigField{Value: uint(20), Source: ConfigSourceDefault},
+	} {
+		if f := ec.Edge[name]; f != expected {
+			t.Errorf("Expected Edge %v to be %v, got %v", name, expected, f)
+		}
+	}
+
+	// Secrets that are set are redacted, other fields and secrets that are not set are shown.
+	for name, expected := range map[string]EffectiveConfigField{
+		"ExchangeToken":               EffectiveConfigField{Value: RedactedConfigValue, Source: ConfigSourceFile, Origin: basePath},
+		"ActiveAgreementsTokenHeader": EffectiveConfigField{Value: "X-API-Key", Source: ConfigSourceFile, Origin: basePath},
+		"ActiveAgreementsPW":          EffectiveConfigField{Value: "", Source: ConfigSourceDefault},
+		"ExchangeMessageTTL":          EffectiveConfigField{Value: DefaultExchangeMessageTTL, Source: ConfigSourceDefault},
+	} {
+		if f := ec.AgreementBot[name]; f != expected {
+			t.Errorf("Expected AgreementBot %v to be %v, got %v", name, expected, f)
+		}
+	}
+}
@@ -13,3 +13,71 @@ const MaxHTTPIdleConnections = 20
 
 // HTTPIdleConnectionTimeoutS see https://golang.org/pkg/net/http/
 const HTTPIdleConnectionTimeoutS = 120
+
+// HTTPKeepAliveS see https://golang.org/pkg/net/#Dialer
+const HTTPKeepAliveS = 120
+
+// ExchangeMessageTTL bounds, in seconds. The default is used when the config does not set a TTL, values outside the
+// bounds are clamped to the nearest bound.
+const DefaultExchangeMessageTTL = 180
+const MinExchangeMessageTTL = 30
+const MaxExchangeMessageTTL = 86400
+
+// The range of DefaultServiceRegistrationRAM values, in MB, that are accepted without a warning.
+const MinServiceRegistrationRAM = 16
+const MaxServiceRegistrationRAM = 1024 * 1024
+
+// The default number of consecutive failed blockchain client API calls before the client is considered down and restarted.
+const DefaultBlockchainAPIFailures = 3
+
+// The default minimum number of seconds between two re-triggers of the funding of the same unfunded blockchain account.
+const DefaultBlockchainRefundIntervalS = 3600
+
+// The default number of seconds after startup during which every blockchain is assumed to be needed, unless the first
+// needed blockchains report arrives sooner.
+const DefaultBlockchainNeededGraceS = 300
+
+// The default maximum number of seconds node shutdown waits for agreement work to drain before it stops the blockchain
+// clients anyway.
+const DefaultShutdownDrainTimeoutS = 300
+
+// The default maximum number of blocks read from a blockchain event log at a time.
+const DefaultBlockchainEventBatchBlocks = 1000
+
+// The default directory of the geth log of each blockchain instance whose metadata does not specify GETH_LOG.
+const DefaultBlockchainLogDir = "/tmp"
+
+// The values of ImageFetchStrategy. The torrent preferred strategy (the default) fetches the images with the torrent
+// when the workload specifies one, and pulls them from their registries otherwise. The registry only strategy always
+// pulls the images from their registries and ignores any torrent in the workload.
+const ImageFetchTorrentPreferred = "torrent"
+const ImageFetchRegistryOnly = "registry"
+
+// The values of MissingMicroserviceAction. When a workload of a pattern requires a microservice that the device has not
+// registered, the skip action skips the workload and tries the next one, and the fail action gives up on making an
+// agreement with the device.
+const MissingMicroserviceSkip = "skip"
+const MissingMicroserviceFail = "fail"
+
+// The values of UnexpectedDataAckAction. A data received ack is unexpected when the agreement's policy disabled data
+// verification, because the agbot only notifies the device that data was received when it verifies the data. The ignore
+// action drops the ack, and the flag action drops it and counts it in the agreement's UnexpectedDataAcks.
+const UnexpectedDataAckIgnore = "ignore"
+const UnexpectedDataAckFlag = "flag"
+
+// The default number of seconds a device is blacklisted from new agreements after sending InvalidReplyThreshold
+// consecutive invalid agreement replies.
+const DefaultInvalidReplyBlacklistS = 3600
+
+// The default number of hours the outcome of the most recent attempt to choose a workload for a device and policy is
+// kept. The outcome of a device that is no longer searched for would otherwise be kept forever.
+const DefaultWorkloadSelectionExpiryHours = 24
+
+// The default minimum API version of the docker daemon, checked at startup. API version 1.24 is docker 1.12.
+const DefaultDockerMinAPIVersion = "1.24"
+
+// The default amount of free space, in MB, that the docker storage path must have before a workload image is pulled.
+const DefaultDockerMinFreeSpaceMB = 1024
+
+// The directory where docker keeps its images when the docker daemon does not report its root dir.
+const DefaultDockerStoragePath = "/var/lib/docker"
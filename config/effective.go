@@ -0,0 +1,141 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// The sources of the value of a field in the effective config.
+const ConfigSourceDefault = "default" // no config file or envvar sets the field, the value is the default, which is often zero
+const ConfigSourceFile = "file"       // the last config file that sets the field is in the field's Origin
+const ConfigSourceEnvvar = "envvar"   // the envvar that sets the field is in the field's Origin
+
+// The value shown instead of a secret that is set.
+const RedactedConfigValue = "********"
+
+// The config fields that enrichFromEnvvars sets, keyed by envvar name. Keep this in sync with enrichFromEnvvars.
+var envvarConfigFields = map[string][]string{
+	ExchangeURLEnvvarName: []string{"Edge.ExchangeURL", "AgreementBot.ExchangeURL"},
+}
+
+// A field of the effective config, with where its value came from.
+type EffectiveConfigField struct {
+	Value  interface{} `json:"value"`            // the value after defaults, envvars and validation are applied, redacted if the field is a secret
+	Source string      `json:"source"`           // one of the ConfigSource constants
+	Origin string      `json:"origin,omitempty"` // the config file or envvar that set the value
+}
+
+// The config that anax runs with, as ReadMultiple produces it, for operators to see why a value is used. The fields of
+// each section are keyed by field name.
+type EffectiveConfig struct {
+	Files        []string                        `json:"files"`
+	Edge         map[string]EffectiveConfigField `json:"Edge"`
+	AgreementBot map[string]EffectiveConfigField `json:"AgreementBot"`
+}
+
+// Read the config files the same way the daemon does and return the resulting config, annotated with the source of
+// each field. The values of secrets, e.g. tokens and passwords, are redacted.
+func ReadEffective(files []string) (*EffectiveConfig, error) {
+
+	cfg, err := ReadMultiple(files)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the fields set by each file, later files override earlier ones just as they do when the files are decoded.
+	origins := make(map[string]EffectiveConfigField)
+	for _, file := range files {
+		if sections, err := configFileFields(file); err != nil {
+			return nil, err
+		} else {
+			for section, fields := range sections {
+				for _, field := range fields {
+					origins[section+"."+field] = EffectiveConfigField{Source: ConfigSourceFile, Origin: file}
+				}
+			}
+		}
+	}
+
+	// The envvars are applied after the files.
+	for envvar, fields := range envvarConfigFields {
+		if os.Getenv(envvar) != "" {
+			for _, field := range fields {
+				origins[field] = EffectiveConfigField{Source: ConfigSourceEnvvar, Origin: envvar}
+			}
+		}
+	}
+
+	return &EffectiveConfig{
+		Files:        files,
+		Edge:         effectiveSection("Edge", cfg.Edge, origins),
+		AgreementBot: effectiveSection("AgreementBot", cfg.AgreementBot, origins),
+	}, nil
+}
+
+// Returns the fields of the input config section struct, annotated with the origins of the fields that a file or envvar
+// sets. The other fields have their default value.
+func effectiveSection(section string, value interface{}, origins map[string]EffectiveConfigField) map[string]EffectiveConfigField {
+	fields := make(map[string]EffectiveConfigField)
+	v := reflect.ValueOf(value)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		f, ok := origins[section+"."+name]
+		if !ok {
+			f = EffectiveConfigField{Source: ConfigSourceDefault}
+		}
+		f.Value = v.Field(i).Interface()
+		if secretConfigField(name) && !reflect.DeepEqual(f.Value, reflect.Zero(v.Field(i).Type()).Interface()) {
+			f.Value = RedactedConfigValue
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+// Returns true if the config field holds a secret. A secret that is not set is shown, so that it is clear it is missing.
+func secretConfigField(name string) bool {
+	for _, suffix := range []string{"PW", "Password", "Token", "AuthHeader"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the names of the fields that a config file sets, keyed by section name. The names are matched to the
+// HorizonConfig fields without regard to case, like the json decoder does.
+func configFileFields(file string) (map[string][]string, error) {
+
+	path, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config file: %s. Error: %v", file, err)
+	}
+	defer path.Close()
+
+	var sections map[string]json.RawMessage
+	if err := json.NewDecoder(path).Decode(&sections); err != nil {
+		return nil, fmt.Errorf("Unable to decode content of config file %s: %v", file, err)
+	}
+
+	set := make(map[string][]string)
+	for section, sectionType := range map[string]reflect.Type{"Edge": reflect.TypeOf(Config{}), "AgreementBot": reflect.TypeOf(AGConfig{})} {
+		for key, content := range sections {
+			var fields map[string]json.RawMessage
+			if !strings.EqualFold(key, section) {
+				continue
+			} else if err := json.Unmarshal(content, &fields); err != nil {
+				return nil, fmt.Errorf("Unable to decode %v section of config file %s: %v", key, file, err)
+			}
+			for fieldKey := range fields {
+				if f, ok := sectionType.FieldByNameFunc(func(n string) bool { return strings.EqualFold(n, fieldKey) }); ok {
+					set[section] = append(set[section], f.Name)
+				}
+			}
+		}
+	}
+	return set, nil
+}
@@ -210,3 +210,20 @@ func Test_RemoveEnvVar_nothing3(t *testing.T) {
 	}
 
 }
+
+func Test_dockerAPIVersionSupported(t *testing.T) {
+
+	for apiVersion, expected := range map[string]bool{"1.24": true, "1.30": true, "2.0": true, "1.23": false, "1.9": false} {
+		if ok, err := dockerAPIVersionSupported(apiVersion, "1.24"); err != nil {
+			t.Errorf("unexpected error checking API version %v: %v", apiVersion, err)
+		} else if ok != expected {
+			t.Errorf("expected API version %v supported to be %v", apiVersion, expected)
+		}
+	}
+
+	if _, err := dockerAPIVersionSupported("1.24", "latest"); err == nil {
+		t.Errorf("expected an error for an invalid minimum API version")
+	} else if _, err := dockerAPIVersionSupported("", "1.24"); err == nil {
+		t.Errorf("expected an error for an empty daemon API version")
+	}
+}
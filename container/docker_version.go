@@ -0,0 +1,54 @@
+package container
+
+import (
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/golang/glog"
+	"github.com/open-horizon/anax/config"
+)
+
+// Verify that the docker daemon at the configured endpoint supports at least the configured minimum API version, so that
+// a daemon that is too old is reported at startup instead of failing an image pull or container launch midway. The check
+// is skipped when no docker endpoint is configured or the daemon can't be reached yet.
+func CheckDockerVersion(cfg *config.HorizonConfig) error {
+	if cfg.Edge.DockerEndpoint == "" {
+		glog.V(3).Infof("No docker endpoint configured, skipping the docker version check")
+		return nil
+	}
+
+	minimum := cfg.Edge.DockerMinAPIVersion
+	if minimum == "" {
+		minimum = config.DefaultDockerMinAPIVersion
+	}
+
+	client, err := docker.NewClient(cfg.Edge.DockerEndpoint)
+	if err != nil {
+		return fmt.Errorf("unable to instantiate docker client for %v, error: %v", cfg.Edge.DockerEndpoint, err)
+	}
+
+	env, err := client.Version()
+	if err != nil {
+		glog.Warningf("Unable to get the docker version from %v, skipping the docker version check, error: %v", cfg.Edge.DockerEndpoint, err)
+		return nil
+	}
+
+	if ok, err := dockerAPIVersionSupported(env.Get("ApiVersion"), minimum); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("docker %v at %v supports API version %v, at least API version %v is required. Please upgrade docker.", env.Get("Version"), cfg.Edge.DockerEndpoint, env.Get("ApiVersion"), minimum)
+	}
+
+	glog.V(3).Infof("Docker %v at %v supports API version %v, the minimum is %v", env.Get("Version"), cfg.Edge.DockerEndpoint, env.Get("ApiVersion"), minimum)
+	return nil
+}
+
+// Returns true if the API version reported by the docker daemon is at least the minimum API version.
+func dockerAPIVersionSupported(apiVersion string, minimum string) (bool, error) {
+	if min, err := docker.NewAPIVersion(minimum); err != nil {
+		return false, fmt.Errorf("DockerMinAPIVersion %v is not a valid docker API version, error: %v", minimum, err)
+	} else if actual, err := docker.NewAPIVersion(apiVersion); err != nil {
+		return false, fmt.Errorf("docker daemon API version %v is not a valid docker API version, error: %v", apiVersion, err)
+	} else {
+		return !actual.LessThan(min), nil
+	}
+}
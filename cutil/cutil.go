@@ -210,3 +210,28 @@ func SetSystemEnvvars(envAdds map[string]string, prefix string, lat string, lon
 	}
 
 }
+
+// Returns the data verification prefix with surrounding whitespace removed. The edge adds the prefix to the agreement id
+// it passes to workloads, and the agbot expects the prefixed id in the data verification API, so both sides must be
+// configured with the same DVPrefix.
+func NormalizeDVPrefix(prefix string) string {
+	return strings.TrimSpace(prefix)
+}
+
+// Returns the agreement id with the data verification prefix added. An id that already has the prefix is returned as is.
+func AddDVPrefix(prefix string, agreementId string) string {
+	prefix = NormalizeDVPrefix(prefix)
+	if strings.HasPrefix(agreementId, prefix) {
+		return agreementId
+	}
+	return prefix + agreementId
+}
+
+// Returns the agreement id with the data verification prefix removed, and whether the id had the prefix.
+func StripDVPrefix(prefix string, id string) (string, bool) {
+	prefix = NormalizeDVPrefix(prefix)
+	if prefix == "" || !strings.HasPrefix(id, prefix) {
+		return id, false
+	}
+	return strings.TrimPrefix(id, prefix), true
+}
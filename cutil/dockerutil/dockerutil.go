@@ -0,0 +1,58 @@
+package dockerutil
+
+import (
+	docker "github.com/fsouza/go-dockerclient"
+	"os"
+	"strings"
+)
+
+// The registry docker pulls an image from when the image name does not start with a registry domain.
+const DefaultImageRegistry = "docker.io"
+
+// Returns the registry domain of a docker image name. Following docker, the first component of the name is a registry
+// only if it contains a "." or a ":", or is "localhost". Otherwise the image comes from the default registry.
+func ImageRegistry(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return strings.ToLower(parts[0])
+	}
+	return DefaultImageRegistry
+}
+
+// Splits a docker image name into the repository and the tag or digest to pull it with. A digest, as in
+// myorg/cpu@sha256:..., takes precedence over a tag, and a name with neither is pulled with the latest tag. The colon
+// of a registry port is not mistaken for a tag.
+func SplitImageName(image string) (string, string) {
+	trimTag := func(name string) (string, string) {
+		if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+			return name[:i], name[i+1:]
+		}
+		return name, ""
+	}
+
+	if parts := strings.SplitN(image, "@", 2); len(parts) == 2 {
+		repo, _ := trimTag(parts[0])
+		return repo, parts[1]
+	} else if repo, tag := trimTag(image); tag != "" {
+		return repo, tag
+	}
+	return image, "latest"
+}
+
+// Read the registry credentials from a docker config file, e.g. ~/.docker/config.json. It is shared by the torrent
+// worker and the hzn CLI, so that the CLI does not depend on the torrent worker.
+func DockerCredsFromConfigFile(configFilePath string) (*docker.AuthConfigurations, error) {
+
+	f, err := os.Open(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	auths, err := docker.NewAuthConfigurations(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return auths, nil
+}
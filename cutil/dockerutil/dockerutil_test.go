@@ -0,0 +1,40 @@
+// +build unit
+
+package dockerutil
+
+import (
+	"testing"
+)
+
+func Test_ImageRegistry(t *testing.T) {
+
+	for image, registry := range map[string]string{
+		"ubuntu:16.04":                           "docker.io",
+		"openhorizon/amd64_cpu:1.0":              "docker.io",
+		"registry.example.com/org/cpu:1.0":       "registry.example.com",
+		"Registry.Example.com:5000/org/cpu:1.0":  "registry.example.com:5000",
+		"localhost/cpu:1.0":                      "localhost",
+		"summit.hovitos.engineering/x86/cpu:1.0": "summit.hovitos.engineering",
+	} {
+		if r := ImageRegistry(image); r != registry {
+			t.Errorf("expected registry %v for image %v, got %v", registry, image, r)
+		}
+	}
+}
+
+func Test_SplitImageName(t *testing.T) {
+
+	for image, expected := range map[string][2]string{
+		"ubuntu":                                      {"ubuntu", "latest"},
+		"ubuntu:16.04":                                {"ubuntu", "16.04"},
+		"registry.example.com:5000/org/cpu":           {"registry.example.com:5000/org/cpu", "latest"},
+		"registry.example.com:5000/org/cpu:1.0":       {"registry.example.com:5000/org/cpu", "1.0"},
+		"openhorizon/cpu@sha256:0123abcd":             {"openhorizon/cpu", "sha256:0123abcd"},
+		"openhorizon/cpu:1.0@sha256:0123abcd":         {"openhorizon/cpu", "sha256:0123abcd"},
+		"registry.example.com:5000/cpu@sha256:0123ab": {"registry.example.com:5000/cpu", "sha256:0123ab"},
+	} {
+		if repo, tag := SplitImageName(image); repo != expected[0] || tag != expected[1] {
+			t.Errorf("expected %v for image %v, got %v and %v", expected, image, repo, tag)
+		}
+	}
+}
@@ -15,9 +15,11 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,18 +29,25 @@ const CHAIN_TYPE = "ethereum"
 // all blockchain instances of type 'ethereum'. Each of the fields in this object are
 // specific to a given instance of a blockchain.
 type BCInstanceState struct {
-	bc             *BaseContracts
-	el             *Event_Log
-	started        bool // remains true when needsRestart is true so that messages to start the container are ignored until we are ready to start it
-	needsRestart   bool
-	notifiedReady  bool
-	notifiedFunded bool
-	name           string
-	org            string
-	serviceName    string
-	servicePort    string
-	colonusDir     string
-	metadataHash   []byte
+	bc               *BaseContracts
+	el               *Event_Log
+	started          bool // remains true when needsRestart is true so that messages to start the container are ignored until we are ready to start it
+	needsRestart     bool
+	notifiedReady    bool
+	notifiedFunded   bool
+	apiFailures      int    // consecutive failed API calls since the client was last ready
+	peerCount        uint64 // the number of peers at the last check
+	syncing          bool   // true if the client was syncing blocks at the last check
+	isolatedSince    uint64 // the time since which the ready client has had no peers, zero if it has peers
+	notifiedIsolated bool
+	readySince       uint64 // the time when the client was reported ready, used to detect an account that never gets funded
+	name             string
+	org              string
+	serviceName      string
+	servicePort      string
+	colonusDir       string
+	gethLog          string
+	metadataHash     []byte
 }
 
 // The worker is single threaded so there are no multi-thread concerns. Events that cause changes to instance state
@@ -52,6 +61,26 @@ type EthBlockchainWorker struct {
 	horizonPubKeyFile string
 	instances         map[string]*BCInstanceState
 	neededBCs         map[string]map[string]uint64 // time stamp last time this BC was reported as needed
+	startTime         uint64                       // the time the worker was created, the start of the needed blockchains grace period
+	neededReported    bool                         // true once the first needed blockchains report has arrived
+	neededGraceEnded  bool                         // true once the grace period has expired without a needed blockchains report
+	refundTimes       map[string]uint64            // time of the last funding re-trigger of each instance, kept across client restarts
+}
+
+// The externally visible state of a blockchain instance, suitable for status APIs.
+type BCInstanceStatus struct {
+	Name          string `json:"name"`
+	Org           string `json:"org"`
+	Ready         bool   `json:"ready"`
+	Funded        bool   `json:"funded"`
+	APIFailures   int    `json:"api_failures"`
+	PeerCount     uint64 `json:"peer_count"`
+	Syncing       bool   `json:"syncing"`
+	IsolatedSince uint64 `json:"isolated_since,omitempty"`
+}
+
+func (s BCInstanceStatus) String() string {
+	return fmt.Sprintf("Name: %v, Org: %v, Ready: %v, Funded: %v, APIFailures: %v, PeerCount: %v, Syncing: %v, IsolatedSince: %v", s.Name, s.Org, s.Ready, s.Funded, s.APIFailures, s.PeerCount, s.Syncing, s.IsolatedSince)
 }
 
 func NewEthBlockchainWorker(name string, cfg *config.HorizonConfig) *EthBlockchainWorker {
@@ -62,6 +91,8 @@ func NewEthBlockchainWorker(name string, cfg *config.HorizonConfig) *EthBlockcha
 		horizonPubKeyFile: cfg.Edge.PublicKeyPath,
 		instances:         make(map[string]*BCInstanceState),
 		neededBCs:         make(map[string]map[string]uint64),
+		startTime:         uint64(time.Now().Unix()),
+		refundTimes:       make(map[string]uint64),
 	}
 
 	glog.Info(logString("starting worker"))
@@ -91,6 +122,12 @@ func (w *EthBlockchainWorker) NewEvent(incoming events.Message) {
 			w.Commands <- cmd
 		}
 
+	case *events.BlockchainRefundMessage:
+		msg, _ := incoming.(*events.BlockchainRefundMessage)
+		if msg.Event().Id == events.BC_REFUND && msg.BlockchainType() == policy.Ethereum_bc {
+			w.RequestRefund(msg.BlockchainInstance())
+		}
+
 	case *events.ContainerMessage:
 		msg, _ := incoming.(*events.ContainerMessage)
 		switch msg.Event().Id {
@@ -196,6 +233,12 @@ func (w *EthBlockchainWorker) SetColonusDir(name string, dir string) {
 	}
 }
 
+func (w *EthBlockchainWorker) SetGethLog(name string, file string) {
+	if _, ok := w.instances[name]; ok {
+		w.instances[name].gethLog = file
+	}
+}
+
 func (w *EthBlockchainWorker) DeleteBCInstance(name string) {
 	if _, ok := w.instances[name]; ok {
 		delete(w.instances, name)
@@ -203,7 +246,9 @@ func (w *EthBlockchainWorker) DeleteBCInstance(name string) {
 }
 
 func (w *EthBlockchainWorker) NeedContainer(org string, name string) bool {
-	if _, ok := w.neededBCs[org]; !ok {
+	if w.inNeededGrace(uint64(time.Now().Unix())) {
+		return true
+	} else if _, ok := w.neededBCs[org]; !ok {
 		return false
 	} else if ts, ok := w.neededBCs[org][name]; ok {
 		if ts == 0 || (uint64(time.Now().Unix()) <= (ts + uint64(300))) {
@@ -215,6 +260,27 @@ func (w *EthBlockchainWorker) NeedContainer(org string, name string) bool {
 	return true
 }
 
+// The number of seconds after startup to wait for the first needed blockchains report.
+func (w *EthBlockchainWorker) neededGraceS() uint64 {
+	if w.Config.Edge.BlockchainNeededGraceS <= 0 {
+		return config.DefaultBlockchainNeededGraceS
+	}
+	return uint64(w.Config.Edge.BlockchainNeededGraceS)
+}
+
+// Returns true while the worker is waiting for the first needed blockchains report after startup. Until the report
+// arrives the needed blockchains are unknown, so every blockchain is assumed to be needed for up to neededGraceS seconds.
+func (w *EthBlockchainWorker) inNeededGrace(now uint64) bool {
+	if w.neededReported || w.neededGraceEnded {
+		return false
+	} else if now < w.startTime+w.neededGraceS() {
+		return true
+	}
+	w.neededGraceEnded = true
+	glog.Infof(logString(fmt.Sprintf("no needed blockchains reported within %v seconds of startup, blockchains that are not reported as needed will not be restarted", w.neededGraceS())))
+	return false
+}
+
 func (w *EthBlockchainWorker) RestartContainer(cmd *ContainerShutdownCommand) {
 
 	if !w.NeedContainer(cmd.Msg.ContainerName, cmd.Msg.Org) {
@@ -239,6 +305,11 @@ func (w *EthBlockchainWorker) RestartContainer(cmd *ContainerShutdownCommand) {
 
 func (w *EthBlockchainWorker) UpdatedNeededBlockchains(cmd *ReportNeededBlockchainsCommand) {
 
+	if !w.neededReported && !w.neededGraceEnded {
+		glog.V(3).Infof(logString("received the first needed blockchains report, ending the startup grace period"))
+	}
+	w.neededReported = true
+
 	for org, nameMap := range cmd.Msg.NeededBlockchains() {
 		for name, _ := range nameMap {
 			if _, ok := w.neededBCs[org]; !ok {
@@ -294,6 +365,10 @@ func (w *EthBlockchainWorker) CommandHandler(command worker.Command) bool {
 		cmd := command.(*ReportNeededBlockchainsCommand)
 		w.UpdatedNeededBlockchains(cmd)
 
+	case *RefundCommand:
+		cmd := command.(*RefundCommand)
+		w.handleRefund(cmd.Name)
+
 	case *AllBlockchainsShutdownCommand:
 		w.SetWorkerShuttingDown()
 		w.StopAllBlockchains()
@@ -320,10 +395,36 @@ func (w *EthBlockchainWorker) CommandHandler(command worker.Command) bool {
 
 func (w *EthBlockchainWorker) NoWorkHandler() {
 	if !w.IsWorkerShuttingDown() {
+		// Check the grace period here too, so that its expiry is logged even when no container needs a decision.
+		w.inNeededGrace(uint64(time.Now().Unix()))
 		w.CheckStatus()
 	}
 }
 
+// The number of consecutive failed API calls before a blockchain client is considered down.
+func (w *EthBlockchainWorker) apiFailureThreshold() int {
+	if w.Config.Edge.BlockchainAPIFailures <= 0 {
+		return config.DefaultBlockchainAPIFailures
+	}
+	return w.Config.Edge.BlockchainAPIFailures
+}
+
+// Returns an http client for calls to the blockchain clients, with the configured RPC timeout.
+func (w *EthBlockchainWorker) rpcHTTPClient() *http.Client {
+	if t := w.Config.Edge.BlockchainRPCTimeoutS; t != 0 {
+		return w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(&t)
+	}
+	return w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil)
+}
+
+// Returns a note for the log when the error is an RPC timeout. Timeouts count as API failures like any other error.
+func timedOut(err error) string {
+	if IsRPCTimeout(err) {
+		return " (timed out)"
+	}
+	return ""
+}
+
 func (w *EthBlockchainWorker) CheckStatus() {
 
 	glog.V(3).Infof(logString(fmt.Sprintf("checking blockchain status")))
@@ -343,39 +444,47 @@ func (w *EthBlockchainWorker) CheckStatus() {
 				glog.Warningf(logString(fmt.Sprintf("unable to obtain account for %v, error %v", name, err)))
 			} else if bcState.serviceName == "" {
 				glog.Warningf(logString(fmt.Sprintf("eth service not started yet for %v", name)))
-			} else if funded, err := AccountFunded(bcState.colonusDir, fmt.Sprintf("http://%v:%v", bcState.serviceName, bcState.servicePort)); err != nil {
-				// If the blockchain has been up before but this API is now failing, then we need to restart the container.
-				if bcState.notifiedReady {
-
-					glog.V(3).Infof(logString(fmt.Sprintf("detected %v API is down. Error was %v", name, err)))
-					i := new(BCInstanceState)
-					i.name = name
-					saveOrg := w.instances[name].org
-					w.instances[name] = i
-					w.Messages() <- events.NewBlockchainClientStoppingMessage(events.BC_CLIENT_STOPPING, policy.Ethereum_bc, name, saveOrg)
-					// If we dont need this container any more then dont restart it.
-					if w.NeedContainer(name, saveOrg) {
-						newMsg := events.NewNewBCContainerMessage(events.NEW_BC_CLIENT, policy.Ethereum_bc, name, saveOrg, w.exchangeURL, w.exchangeId, w.exchangeToken)
-						ncmd := NewNewClientCommand(*newMsg)
-						w.Commands <- ncmd
-					} else {
-						glog.V(3).Infof(logString(fmt.Sprintf("not restarting, container %v is not needed any more", name)))
-					}
+			} else if funded, err := AccountFunded(w.rpcHTTPClient(), bcState.colonusDir, fmt.Sprintf("http://%v:%v", bcState.serviceName, bcState.servicePort)); err != nil {
+				// If the blockchain has been up before but this API is now failing, then we need to restart the container. A
+				// client that is resyncing after a restart can briefly fail, so only restart after several consecutive failures.
+				if bcState.notifiedReady && bcState.apiFailures+1 < w.apiFailureThreshold() {
+					bcState.apiFailures += 1
+					glog.Warningf(logString(fmt.Sprintf("%v API call failed%v, %v consecutive failures. Error was %v", name, timedOut(err), bcState.apiFailures, err)))
+
+				} else if bcState.notifiedReady {
+
+					glog.V(3).Infof(logString(fmt.Sprintf("detected %v API is down after %v consecutive failures%v. Error was %v", name, bcState.apiFailures+1, timedOut(err), err)))
+					w.restartClient(name)
 
 				} else {
 					glog.V(3).Infof(logString(fmt.Sprintf("error checking %v for account funding: %v", name, err)))
 				}
 			} else {
+				if bcState.apiFailures != 0 {
+					glog.V(3).Infof(logString(fmt.Sprintf("%v API recovered after %v consecutive failures", name, bcState.apiFailures)))
+					bcState.apiFailures = 0
+				}
+
 				glog.V(3).Infof(logString(fmt.Sprintf("%v using directory address: %v", name, dirAddr)))
 				if !bcState.notifiedReady {
 					// geth initialzed
 					bcState.notifiedReady = true
+					bcState.readySince = uint64(time.Now().Unix())
 					glog.V(3).Infof(logString(fmt.Sprintf("sending blockchain %v client initialized event", name)))
 					w.Messages() <- events.NewBlockchainClientInitializedMessage(events.BC_CLIENT_INITIALIZED, policy.Ethereum_bc, name, w.instances[name].org, bcState.serviceName, bcState.servicePort, bcState.colonusDir)
 				}
 
+				// A ready client without peers cannot see new blocks, so agreement state on the blockchain would be stale.
+				if restart := w.checkPeers(name, bcState); restart {
+					w.restartClient(name)
+					continue
+				}
+
 				if !funded {
 					glog.V(3).Infof(logString(fmt.Sprintf("account %v for %v not funded yet", acct, name)))
+					if now := uint64(time.Now().Unix()); w.fundingOverdue(bcState, now) && w.refund(name, now) {
+						continue
+					}
 				} else if funded && !bcState.notifiedFunded {
 					bcState.notifiedFunded = true
 					glog.V(3).Infof(logString(fmt.Sprintf("sending acct %v funded event for %v", acct, name)))
@@ -407,13 +516,188 @@ func (w *EthBlockchainWorker) CheckStatus() {
 
 		// Get new blockchain events and publish them to the rest of anax.
 		if w.instances[name].el != nil {
-			if events, _, err := bcState.el.Get_Next_Raw_Event_Batch(getFilter(), 0); err != nil {
-				glog.Errorf(logString(fmt.Sprintf("unable to get event batch for %v, error %v", err, name)))
-			} else {
-				w.handleEvents(events, name, w.instances[name].org)
-			}
+			w.readEvents(name, w.instances[name])
+		}
+	}
+
+	w.updateStatus()
+}
+
+// Replace the state of a blockchain instance whose client is not working, and start a new client if the blockchain
+// is still needed.
+func (w *EthBlockchainWorker) restartClient(name string) {
+	i := new(BCInstanceState)
+	i.name = name
+	saveOrg := w.instances[name].org
+	w.instances[name] = i
+	w.Messages() <- events.NewBlockchainClientStoppingMessage(events.BC_CLIENT_STOPPING, policy.Ethereum_bc, name, saveOrg)
+	// If we dont need this container any more then dont restart it.
+	if w.NeedContainer(name, saveOrg) {
+		newMsg := events.NewNewBCContainerMessage(events.NEW_BC_CLIENT, policy.Ethereum_bc, name, saveOrg, w.exchangeURL, w.exchangeId, w.exchangeToken)
+		ncmd := NewNewClientCommand(*newMsg)
+		w.Commands <- ncmd
+	} else {
+		glog.V(3).Infof(logString(fmt.Sprintf("not restarting, container %v is not needed any more", name)))
+	}
+}
+
+// Returns true if the account of a ready client has stayed unfunded for longer than BlockchainFundingTimeoutS.
+func (w *EthBlockchainWorker) fundingOverdue(bcState *BCInstanceState, now uint64) bool {
+	timeoutS := uint64(w.Config.Edge.BlockchainFundingTimeoutS)
+	return timeoutS != 0 && bcState.readySince != 0 && !bcState.notifiedFunded && now-bcState.readySince >= timeoutS
+}
+
+// The minimum number of seconds between two funding re-triggers for the same instance.
+func (w *EthBlockchainWorker) refundIntervalS() uint64 {
+	if w.Config.Edge.BlockchainRefundIntervalS <= 0 {
+		return config.DefaultBlockchainRefundIntervalS
+	}
+	return uint64(w.Config.Edge.BlockchainRefundIntervalS)
+}
+
+// Re-trigger the funding of an instance's account by restarting its client, which asks for funding again as it starts.
+// Returns false without doing anything if the funding of the instance was re-triggered too recently.
+func (w *EthBlockchainWorker) refund(name string, now uint64) bool {
+	if last, ok := w.refundTimes[name]; ok && now-last < w.refundIntervalS() {
+		glog.V(3).Infof(logString(fmt.Sprintf("not re-triggering funding for %v, it was last re-triggered %v seconds ago", name, now-last)))
+		return false
+	}
+	w.refundTimes[name] = now
+	glog.Warningf(logString(fmt.Sprintf("re-triggering funding for %v by restarting it, the account has not been funded since the client was ready at %v", name, w.instances[name].readySince)))
+	w.restartClient(name)
+	return true
+}
+
+// Handle an operator request to re-trigger the funding of an instance. The funding is checked again first, and nothing is done
+// if the account has been funded in the meantime.
+func (w *EthBlockchainWorker) handleRefund(name string) {
+	bcState, ok := w.instances[name]
+	if !ok {
+		glog.Warningf(logString(fmt.Sprintf("unable to re-trigger funding for %v, there is no such blockchain instance", name)))
+	} else if !bcState.notifiedReady {
+		glog.Warningf(logString(fmt.Sprintf("unable to re-trigger funding for %v, the client is not ready yet", name)))
+	} else if funded, err := AccountFunded(w.rpcHTTPClient(), bcState.colonusDir, fmt.Sprintf("http://%v:%v", bcState.serviceName, bcState.servicePort)); err != nil {
+		glog.Errorf(logString(fmt.Sprintf("unable to check funding for %v, error %v", name, err)))
+	} else if funded {
+		glog.V(3).Infof(logString(fmt.Sprintf("not re-triggering funding for %v, the account is funded", name)))
+	} else {
+		w.refund(name, uint64(time.Now().Unix()))
+	}
+}
+
+// Ask the worker to re-trigger the funding of an instance whose account is stuck unfunded, as an operator does through the
+// refund API. The request is handled on the worker thread.
+func (w *EthBlockchainWorker) RequestRefund(name string) {
+	w.Commands <- NewRefundCommand(name)
+}
+
+// Check the peer count and sync status of a ready blockchain client. Returns true if the client should be restarted
+// because it has been isolated for too long.
+func (w *EthBlockchainWorker) checkPeers(name string, bcState *BCInstanceState) bool {
+
+	client := RPC_Client_Factory(w.Config.Collaborators.HTTPClientFactory, RPC_Connection_Factory("", 0, fmt.Sprintf("http://%v:%v", bcState.serviceName, bcState.servicePort)), w.Config.Edge.BlockchainRPCTimeoutS)
+	if client == nil {
+		return false
+	}
+
+	peers, err := client.Get_peer_count()
+	if err != nil {
+		glog.Warningf(logString(fmt.Sprintf("unable to get peer count for %v, error %v", name, err)))
+		return false
+	}
+	if syncing, err := client.Get_syncing(); err != nil {
+		glog.Warningf(logString(fmt.Sprintf("unable to get sync status for %v, error %v", name, err)))
+	} else {
+		bcState.syncing = syncing
+	}
+	glog.V(3).Infof(logString(fmt.Sprintf("%v has %v peers, syncing: %v", name, peers, bcState.syncing)))
+
+	isolatedS := bcState.recordPeers(peers, uint64(time.Now().Unix()))
+	windowS := uint64(w.Config.Edge.BlockchainIsolationS)
+	if windowS == 0 || isolatedS < windowS {
+		return false
+	}
+
+	if !bcState.notifiedIsolated {
+		bcState.notifiedIsolated = true
+		glog.Warningf(logString(fmt.Sprintf("%v has had no peers for %v seconds", name, isolatedS)))
+		w.Messages() <- events.NewBlockchainClientIsolatedMessage(events.BC_CLIENT_ISOLATED, policy.Ethereum_bc, name, bcState.org, isolatedS)
+	}
+
+	if w.Config.Edge.BlockchainIsolationRestart && isolatedS >= 2*windowS {
+		glog.Warningf(logString(fmt.Sprintf("restarting %v, it has had no peers for %v seconds", name, isolatedS)))
+		return true
+	}
+	return false
+}
+
+// Record the peer count of the client at the input time. Returns the number of seconds the client has had no peers,
+// zero if it has peers.
+func (b *BCInstanceState) recordPeers(peers uint64, now uint64) uint64 {
+	b.peerCount = peers
+	if peers != 0 {
+		if b.isolatedSince != 0 {
+			glog.V(3).Infof(logString(fmt.Sprintf("%v has %v peers again after %v seconds without peers", b.name, peers, now-b.isolatedSince)))
 		}
+		b.isolatedSince = 0
+		b.notifiedIsolated = false
+		return 0
+	} else if b.isolatedSince == 0 {
+		b.isolatedSince = now
 	}
+	return now - b.isolatedSince
+}
+
+// Save a snapshot of the instance states in BCStatus.
+func (w *EthBlockchainWorker) updateStatus() {
+	status := make(map[string]BCInstanceStatus, len(w.instances))
+	for name, bcState := range w.instances {
+		status[name] = BCInstanceStatus{
+			Name:          name,
+			Org:           bcState.org,
+			Ready:         bcState.notifiedReady,
+			Funded:        bcState.notifiedFunded,
+			APIFailures:   bcState.apiFailures,
+			PeerCount:     bcState.peerCount,
+			Syncing:       bcState.syncing,
+			IsolatedSince: bcState.isolatedSince,
+		}
+	}
+	BCStatus.set(status)
+}
+
+// The state of the blockchain instances as of the last status check of the blockchain worker. It is read by the status
+// API, outside the worker thread, so it is safe for concurrent use.
+type BCStatusSnapshot struct {
+	lock   sync.Mutex
+	status map[string]BCInstanceStatus
+}
+
+func NewBCStatusSnapshot() *BCStatusSnapshot {
+	return &BCStatusSnapshot{
+		status: make(map[string]BCInstanceStatus),
+	}
+}
+
+// The blockchain instance states of this process. Every status check of the blockchain worker saves into it.
+var BCStatus = NewBCStatusSnapshot()
+
+func (s *BCStatusSnapshot) set(status map[string]BCInstanceStatus) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status = status
+}
+
+// Returns a copy of the instance states, keyed by instance name.
+func (s *BCStatusSnapshot) Snapshot() map[string]BCInstanceStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status := make(map[string]BCInstanceStatus, len(s.status))
+	for name, is := range s.status {
+		status[name] = is
+	}
+	return status
 }
 
 func (w *EthBlockchainWorker) handleNewClient(cmd *NewClientCommand) {
@@ -448,33 +732,24 @@ func (w *EthBlockchainWorker) handleNewClient(cmd *NewClientCommand) {
 // This function is used to start the process of starting the ethereum container
 func (w *EthBlockchainWorker) getEthContainer(name string) error {
 
+	// Search for the architecture we're running on
+	arch := runtime.GOARCH
+	if strings.Contains(arch, "arm") {
+		arch = "armhf"
+	}
+
 	if bcMetadata, detailsObj, err := w.getBCMetadata(name, w.instances[name].org); err != nil {
 		return err
+	} else if chain, err := selectChain(detailsObj, arch); err != nil {
+		return errors.New(logString(fmt.Sprintf("invalid metadata for blockchain %v/%v, error: %v", w.instances[name].org, name, err)))
+	} else if chain == nil {
+		return errors.New(logString(fmt.Sprintf("could not locate eth metadata for %v", runtime.GOARCH)))
+	} else if err := w.fireStartEvent(chain, name); err != nil {
+		return err
 	} else {
-		// Search for the architecture we're running on
-		fired := false
-
-		arch := runtime.GOARCH
-		if strings.Contains(arch, "arm") {
-			arch = "armhf"
-		}
-
-		for _, chain := range detailsObj.Chains {
-			if chain.Arch == arch {
-				if err := w.fireStartEvent(&chain, name); err != nil {
-					return err
-				}
-				fired = true
-				break
-			}
-		}
-		if !fired {
-			return errors.New(logString(fmt.Sprintf("could not locate eth metadata for %v", runtime.GOARCH)))
-		} else {
-			// Hash the metadata and save it.
-			hash := sha3.Sum256([]byte(bcMetadata))
-			w.instances[name].metadataHash = hash[:]
-		}
+		// Hash the metadata and save it.
+		hash := sha3.Sum256([]byte(bcMetadata))
+		w.instances[name].metadataHash = hash[:]
 	}
 	return nil
 
@@ -500,22 +775,114 @@ func (w *EthBlockchainWorker) getBCMetadata(name string, org string) (string, *e
 	}
 }
 
+// Returns the chain of the blockchain metadata for the arch, or nil if there is none. The chains for the other arches
+// are checked too, but a problem with one of them is only logged, it does not keep the chain for this arch from being
+// launched. The chain for this arch is checked by fireStartEvent, once its image URL is known.
+func selectChain(details *exchange.BlockchainDetails, arch string) (*exchange.ChainDetails, error) {
+	if len(details.Chains) == 0 {
+		return nil, errors.New("there are no chains")
+	}
+
+	var selected *exchange.ChainDetails
+	for ix := range details.Chains {
+		chain := &details.Chains[ix]
+		if chain.Arch == arch {
+			if selected != nil {
+				return nil, fmt.Errorf("chain %v has arch %v, which another chain has too", ix, arch)
+			}
+			selected = chain
+		} else if err := validateChain(chain, chain.DeploymentDesc.Torrent.Url); err != nil {
+			glog.Warningf(logString(fmt.Sprintf("chain %v of the blockchain metadata can't be launched, error: %v", ix, err)))
+		}
+	}
+	return selected, nil
+}
+
+// Check that the chain is complete enough to launch a container from, so that a launch that is bound to fail is not
+// attempted. The torrent URL is the one the image is fetched from. The deployment signature is verified later, when the
+// chain is launched.
+func validateChain(chain *exchange.ChainDetails, torrentURL string) error {
+	desc := chain.DeploymentDesc
+	if chain.Arch == "" {
+		return errors.New("chain has no arch")
+	} else if torrentURL == "" {
+		return fmt.Errorf("chain for %v has no torrent url", chain.Arch)
+	} else if u, err := url.Parse(torrentURL); err != nil || u.Scheme == "" {
+		return fmt.Errorf("chain for %v has ill-formed torrent url %v", chain.Arch, torrentURL)
+	} else if desc.Torrent.Signature == "" {
+		return fmt.Errorf("chain for %v has no torrent signature", chain.Arch)
+	} else if desc.Deployment == "" {
+		return fmt.Errorf("chain for %v has no deployment", chain.Arch)
+	} else if desc.DeploymentSignature == "" {
+		return fmt.Errorf("chain for %v has no deployment signature", chain.Arch)
+	}
+
+	deployment := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(desc.Deployment), &deployment); err != nil {
+		return fmt.Errorf("chain for %v has a deployment that is not a JSON object, error %v", chain.Arch, err)
+	}
+
+	// The instance values are optional, the ones that are set are passed to the container as they are.
+	instance := chain.Instance
+	if instance.Port != "" {
+		if port, err := strconv.Atoi(instance.Port); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("chain for %v has port %v, which is not a port number", chain.Arch, instance.Port)
+		}
+	}
+	if instance.MaxPeers != "" {
+		if peers, err := strconv.Atoi(instance.MaxPeers); err != nil || peers < 1 {
+			return fmt.Errorf("chain for %v has maxPeers %v, which is not a positive number", chain.Arch, instance.MaxPeers)
+		}
+	}
+	return nil
+}
+
 func (w *EthBlockchainWorker) fireStartEvent(details *exchange.ChainDetails, name string) error {
-	if url, err := url.Parse(details.DeploymentDesc.Torrent.Url); err != nil {
-		return errors.New(logString(fmt.Sprintf("ill-formed URL: %v, error %v", details.DeploymentDesc.Torrent.Url, err)))
+
+	// The image can be fetched from somewhere other than the metadata's URL, e.g. a local mirror. The image is still
+	// verified against the torrent signature in the metadata.
+	torrentURL := details.DeploymentDesc.Torrent.Url
+	if override, err := w.Config.Edge.BlockchainImageOverride(w.instances[name].org, name); err != nil {
+		return errors.New(logString(fmt.Sprintf("unable to read blockchain image overrides, error %v", err)))
+	} else if override != "" {
+		if overrideURL, err := url.Parse(override); err != nil {
+			return errors.New(logString(fmt.Sprintf("ill-formed override URL: %v, error %v", override, err)))
+		} else if overrideURL.Scheme == "" || overrideURL.Host == "" {
+			return errors.New(logString(fmt.Sprintf("override URL %v for %v/%v must be an absolute URL with a scheme and host", override, w.instances[name].org, name)))
+		} else {
+			glog.V(3).Infof(logString(fmt.Sprintf("overriding eth container image URL %v with %v for %v/%v", details.DeploymentDesc.Torrent.Url, override, w.instances[name].org, name)))
+			torrentURL = override
+		}
+	}
+
+	// The chain is checked with the URL the image is actually fetched from.
+	if err := validateChain(details, torrentURL); err != nil {
+		return errors.New(logString(fmt.Sprintf("invalid metadata for blockchain %v/%v, error: %v", w.instances[name].org, name, err)))
+	} else if imageURL, err := url.Parse(torrentURL); err != nil {
+		return errors.New(logString(fmt.Sprintf("ill-formed URL: %v, error %v", torrentURL, err)))
 	} else {
 
-		// Verify the deployment signature
+		// Verify the deployment signature. The deployment is accepted if any of the trusted keys verifies it, so that
+		// the horizon signing key can be rotated without downtime.
 		if pemFiles, err := w.Config.Collaborators.KeyFileNamesFetcher.GetKeyFileNames(w.horizonPubKeyFile, w.Config.UserPublicKeyPath()); err != nil {
 			return errors.New(logString(fmt.Sprintf("received error getting pem key files: %v", err)))
+		} else if len(pemFiles) == 0 {
+			return errors.New(logString(fmt.Sprintf("no pem key files found for %v to verify the eth container deployment signature", w.horizonPubKeyFile)))
 		} else if err := details.DeploymentDesc.HasValidSignature(pemFiles); err != nil {
-			return errors.New(logString(fmt.Sprintf("eth container has invalid deployment signature %v for %v", details.DeploymentDesc.DeploymentSignature, details.DeploymentDesc.Deployment)))
+			return errors.New(logString(fmt.Sprintf("eth container has invalid deployment signature %v for %v, none of the keys %v verified it, error %v", details.DeploymentDesc.DeploymentSignature, details.DeploymentDesc.Deployment, pemFiles, err)))
 		}
 
 		// Fire an event to the torrent worker so that it will download the container
-		cc := events.NewContainerConfig(*url, details.DeploymentDesc.Torrent.Signature, details.DeploymentDesc.Deployment, details.DeploymentDesc.DeploymentSignature, details.DeploymentDesc.DeploymentUserInfo, "")
-		envAdds := w.computeEnvVarsForContainer(details)
+		cc := events.NewContainerConfig(*imageURL, details.DeploymentDesc.Torrent.Signature, details.DeploymentDesc.Deployment, details.DeploymentDesc.DeploymentSignature, details.DeploymentDesc.DeploymentUserInfo, "")
+		envAdds := w.computeEnvVarsForContainer(details, name)
+		if other := w.colonusDirOwner(name, envAdds["COLONUS_DIR"]); other != "" {
+			return errors.New(logString(fmt.Sprintf("eth container %v cannot use COLONUS_DIR %v, it is already used by %v", name, envAdds["COLONUS_DIR"], other)))
+		}
+		if other := w.gethLogOwner(name, envAdds["GETH_LOG"]); other != "" {
+			return errors.New(logString(fmt.Sprintf("eth container %v cannot use GETH_LOG %v, it is already used by %v", name, envAdds["GETH_LOG"], other)))
+		}
 		w.SetColonusDir(name, envAdds["COLONUS_DIR"])
+		w.SetGethLog(name, envAdds["GETH_LOG"])
 		lc := events.NewContainerLaunchContext(cc, &envAdds, events.BlockchainConfig{Type: CHAIN_TYPE, Name: name}, name)
 		w.BaseWorker.Manager.Messages <- events.NewLoadContainerMessage(events.LOAD_CONTAINER, lc)
 
@@ -523,7 +890,39 @@ func (w *EthBlockchainWorker) fireStartEvent(details *exchange.ChainDetails, nam
 	}
 }
 
-func (w *EthBlockchainWorker) computeEnvVarsForContainer(details *exchange.ChainDetails) map[string]string {
+// Returns the name of another managed instance that uses the input COLONUS_DIR, or the empty string if there is none.
+// Instances that share a COLONUS_DIR would overwrite each other's on-disk state.
+func (w *EthBlockchainWorker) colonusDirOwner(name string, dir string) string {
+	for otherName, bcState := range w.instances {
+		if otherName != name && bcState.colonusDir != "" && path.Clean(bcState.colonusDir) == path.Clean(dir) {
+			return otherName
+		}
+	}
+	return ""
+}
+
+// Returns the name of another managed instance that writes its geth log to the input file, or the empty string if there
+// is none. Instances that share a log file would overwrite each other's logs.
+func (w *EthBlockchainWorker) gethLogOwner(name string, file string) string {
+	for otherName, bcState := range w.instances {
+		if otherName != name && file != "" && bcState.gethLog != "" && path.Clean(bcState.gethLog) == path.Clean(file) {
+			return otherName
+		}
+	}
+	return ""
+}
+
+// The geth log file of an instance whose metadata does not specify GETH_LOG, named after the instance so that the logs
+// of the instances are kept apart.
+func (w *EthBlockchainWorker) defaultGethLog(name string) string {
+	dir := w.Config.Edge.BlockchainLogDir
+	if dir == "" {
+		dir = config.DefaultBlockchainLogDir
+	}
+	return path.Join(dir, "geth-"+name+".log")
+}
+
+func (w *EthBlockchainWorker) computeEnvVarsForContainer(details *exchange.ChainDetails, name string) map[string]string {
 	envAdds := make(map[string]string)
 
 	// Make sure the vars that MUST be set are set.
@@ -533,7 +932,12 @@ func (w *EthBlockchainWorker) computeEnvVarsForContainer(details *exchange.Chain
 		envAdds["HZN_RAM"] = ram
 	}
 
+	// When the metadata doesnt specify a COLONUS_DIR, each instance gets its own so that their on-disk state is kept apart.
+	// The default chain keeps the dir it has always used, so that existing nodes don't lose their chain state.
 	envAdds["COLONUS_DIR"] = getInstanceValue("COLONUS_DIR", details.Instance.ColonusDir)
+	if details.Instance.ColonusDir == "" && name != policy.Default_Blockchain_name {
+		envAdds["COLONUS_DIR"] += "-" + name
+	}
 
 	// If there are no instance details, then dont set any of these envvars.
 	if details.Instance == (exchange.ChainInstance{}) {
@@ -551,7 +955,10 @@ func (w *EthBlockchainWorker) computeEnvVarsForContainer(details *exchange.Chain
 	envAdds["PING_HOST"] = details.Instance.PingHost
 	envAdds["ETHEREUM_DIR"] = getInstanceValue("ETHEREUM_DIR", details.Instance.EthDir)
 	envAdds["MAXPEERS"] = getInstanceValue("MAXPEERS", details.Instance.MaxPeers)
-	envAdds["GETH_LOG"] = getInstanceValue("GETH_LOG", details.Instance.GethLog)
+	envAdds["GETH_LOG"] = details.Instance.GethLog
+	if envAdds["GETH_LOG"] == "" {
+		envAdds["GETH_LOG"] = w.defaultGethLog(name)
+	}
 
 	return envAdds
 }
@@ -578,8 +985,6 @@ func getInstanceValue(name string, value string) string {
 		res = os.Getenv("HOME") + "/.ethereum"
 	case "MAXPEERS":
 		res = "12"
-	case "GETH_LOG":
-		res = "/tmp/geth.log"
 	}
 	return res
 }
@@ -622,7 +1027,7 @@ func (w *EthBlockchainWorker) initBlockchainEventListener(name string) {
 	if conn := RPC_Connection_Factory("", 0, gethURL); conn == nil {
 		glog.Errorf(logString(fmt.Sprintf("unable to create connection")))
 		return
-	} else if rpc := RPC_Client_Factory(w.Config.Collaborators.HTTPClientFactory, conn); rpc == nil {
+	} else if rpc := RPC_Client_Factory(w.Config.Collaborators.HTTPClientFactory, conn, w.Config.Edge.BlockchainRPCTimeoutS); rpc == nil {
 		glog.Errorf(logString(fmt.Sprintf("unable to create RPC client")))
 		return
 	} else if el := Event_Log_Factory(w.Config.Collaborators.HTTPClientFactory, rpc, bcState.bc.Agreements.Get_contract_address()); el == nil {
@@ -646,14 +1051,40 @@ func (w *EthBlockchainWorker) initBlockchainEventListener(name string) {
 			return
 		}
 
-		// Grab the first bunch of events and process them. Put no limit on the batch size.
-		if events, err := bcState.el.Get_Raw_Event_Batch(getFilter(), 0); err != nil {
+		// Grab the first bunch of events and process them, followed by the rest of the backlog in bounded batches.
+		if events, err := bcState.el.Get_Raw_Event_Batch(getFilter(), w.eventBatchBlocks()); err != nil {
 			glog.Errorf(logString(fmt.Sprintf("unable to get initial event batch, error %v", err)))
 			return
 		} else {
 			w.handleEvents(events, name, bcState.org)
 		}
+		w.readEvents(name, bcState)
+
+	}
+}
 
+// The maximum number of blocks read from an event log at a time.
+func (w *EthBlockchainWorker) eventBatchBlocks() uint64 {
+	if w.Config.Edge.BlockchainEventBatchBlocks <= 0 {
+		return config.DefaultBlockchainEventBatchBlocks
+	}
+	return uint64(w.Config.Edge.BlockchainEventBatchBlocks)
+}
+
+// Read the new events of an instance in batches of at most eventBatchBlocks blocks until the latest readable block is
+// reached. Each batch is handled before the next one is read, so that a large backlog is never held in memory at once and
+// the events are handled in block order. A failed read is retried from the same block at the next status check.
+func (w *EthBlockchainWorker) readEvents(name string, bcState *BCInstanceState) {
+	for {
+		events, reachedEnd, err := bcState.el.Get_Next_Raw_Event_Batch(getFilter(), w.eventBatchBlocks())
+		if err != nil {
+			glog.Errorf(logString(fmt.Sprintf("unable to get event batch for %v, error %v", name, err)))
+			return
+		}
+		w.handleEvents(events, name, bcState.org)
+		if reachedEnd {
+			return
+		}
 	}
 }
 
@@ -676,6 +1107,20 @@ func getFilter() []interface{} {
 }
 
 // ==========================================================================================================
+type RefundCommand struct {
+	Name string
+}
+
+func (c RefundCommand) ShortString() string {
+	return fmt.Sprintf("Refund %v", c.Name)
+}
+
+func NewRefundCommand(name string) *RefundCommand {
+	return &RefundCommand{
+		Name: name,
+	}
+}
+
 type NewClientCommand struct {
 	Msg events.NewBCContainerMessage
 }
@@ -0,0 +1,413 @@
+// +build unit
+
+package ethblockchain
+
+import (
+	"crypto"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/events"
+	"github.com/open-horizon/anax/exchange"
+	"github.com/open-horizon/anax/policy"
+	"github.com/open-horizon/anax/worker"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_apiFailureThreshold(t *testing.T) {
+
+	cfg := &config.HorizonConfig{}
+	w := &EthBlockchainWorker{BaseWorker: worker.BaseWorker{Manager: worker.Manager{Config: cfg}}}
+
+	if th := w.apiFailureThreshold(); th != config.DefaultBlockchainAPIFailures {
+		t.Errorf("expected default threshold %v, got %v", config.DefaultBlockchainAPIFailures, th)
+	}
+
+	cfg.Edge.BlockchainAPIFailures = 1
+	if th := w.apiFailureThreshold(); th != 1 {
+		t.Errorf("expected configured threshold 1, got %v", th)
+	}
+}
+
+func Test_recordPeers(t *testing.T) {
+
+	bcState := &BCInstanceState{name: "bluehorizon"}
+
+	if isolated := bcState.recordPeers(0, 1000); isolated != 0 || bcState.isolatedSince != 1000 {
+		t.Errorf("expected isolation to start at 1000, got %v since %v", isolated, bcState.isolatedSince)
+	} else if isolated := bcState.recordPeers(0, 1300); isolated != 300 {
+		t.Errorf("expected 300 seconds isolated, got %v", isolated)
+	}
+
+	bcState.notifiedIsolated = true
+	if isolated := bcState.recordPeers(3, 1400); isolated != 0 || bcState.isolatedSince != 0 || bcState.notifiedIsolated || bcState.peerCount != 3 {
+		t.Errorf("expected isolation to be cleared, got %v since %v notified %v", isolated, bcState.isolatedSince, bcState.notifiedIsolated)
+	}
+}
+
+// The status check saves the instance states, including the peer count, in BCStatus for the status API.
+func Test_updateStatus(t *testing.T) {
+
+	saved := BCStatus
+	defer func() { BCStatus = saved }()
+	BCStatus = NewBCStatusSnapshot()
+
+	w := &EthBlockchainWorker{instances: make(map[string]*BCInstanceState)}
+	bcState := w.NewBCInstanceState("bluehorizon", "IBM")
+	bcState.notifiedReady = true
+	bcState.recordPeers(0, 1000)
+	w.updateStatus()
+
+	status := BCStatus.Snapshot()
+	if s, ok := status["bluehorizon"]; !ok || !s.Ready || s.Org != "IBM" || s.PeerCount != 0 || s.IsolatedSince != 1000 {
+		t.Errorf("expected the isolated bluehorizon instance, got %v", status)
+	}
+
+	// The snapshot is a copy.
+	bcState.recordPeers(4, 1100)
+	w.updateStatus()
+	if status["bluehorizon"].PeerCount != 0 || BCStatus.Snapshot()["bluehorizon"].PeerCount != 4 {
+		t.Errorf("expected the new peer count only in a new snapshot, got %v and %v", status, BCStatus.Snapshot())
+	}
+}
+
+func Test_colonusDir_default_instances(t *testing.T) {
+
+	cfg := &config.HorizonConfig{}
+	w := &EthBlockchainWorker{BaseWorker: worker.BaseWorker{Manager: worker.Manager{Config: cfg}}, instances: make(map[string]*BCInstanceState)}
+	w.NewBCInstanceState("bluehorizon", "IBM")
+	w.NewBCInstanceState("other", "IBM")
+
+	// Two instances without a COLONUS_DIR in their metadata get different directories. The default chain keeps /root/eth.
+	details := &exchange.ChainDetails{}
+	dir1 := w.computeEnvVarsForContainer(details, "bluehorizon")["COLONUS_DIR"]
+	dir2 := w.computeEnvVarsForContainer(details, "other")["COLONUS_DIR"]
+	if dir1 != "/root/eth" || dir2 != "/root/eth-other" {
+		t.Errorf("expected unique default dirs, got %v and %v", dir1, dir2)
+	}
+
+	w.SetColonusDir("bluehorizon", dir1)
+	if other := w.colonusDirOwner("other", dir2); other != "" {
+		t.Errorf("expected %v to be unused, used by %v", dir2, other)
+	} else if other := w.colonusDirOwner("bluehorizon", dir1); other != "" {
+		t.Errorf("expected an instance to be able to reuse its own dir, used by %v", other)
+	}
+
+	// A COLONUS_DIR from the metadata is used as is, and is rejected when another instance already uses it.
+	details.Instance.ColonusDir = "/root/eth/"
+	if dir := w.computeEnvVarsForContainer(details, "other")["COLONUS_DIR"]; dir != "/root/eth/" {
+		t.Errorf("expected the metadata dir, got %v", dir)
+	} else if other := w.colonusDirOwner("other", dir); other != "bluehorizon" {
+		t.Errorf("expected %v to be used by bluehorizon, got %v", dir, other)
+	}
+}
+
+func Test_gethLog_default_instances(t *testing.T) {
+
+	cfg := &config.HorizonConfig{}
+	w := &EthBlockchainWorker{BaseWorker: worker.BaseWorker{Manager: worker.Manager{Config: cfg}}, instances: make(map[string]*BCInstanceState)}
+	w.NewBCInstanceState("bluehorizon", "IBM")
+	w.NewBCInstanceState("other", "IBM")
+
+	// Two instances without a GETH_LOG in their metadata log to different files.
+	details := &exchange.ChainDetails{Instance: exchange.ChainInstance{Port: "33303"}}
+	log1 := w.computeEnvVarsForContainer(details, "bluehorizon")["GETH_LOG"]
+	log2 := w.computeEnvVarsForContainer(details, "other")["GETH_LOG"]
+	if log1 != "/tmp/geth-bluehorizon.log" || log2 != "/tmp/geth-other.log" {
+		t.Errorf("expected unique default logs, got %v and %v", log1, log2)
+	}
+
+	w.SetGethLog("bluehorizon", log1)
+	if other := w.gethLogOwner("other", log2); other != "" {
+		t.Errorf("expected %v to be unused, used by %v", log2, other)
+	} else if other := w.gethLogOwner("bluehorizon", log1); other != "" {
+		t.Errorf("expected an instance to be able to reuse its own log, used by %v", other)
+	}
+
+	// The configured log dir is used for the default logs.
+	cfg.Edge.BlockchainLogDir = "/var/log/horizon/"
+	if log := w.computeEnvVarsForContainer(details, "other")["GETH_LOG"]; log != "/var/log/horizon/geth-other.log" {
+		t.Errorf("expected the log in the configured dir, got %v", log)
+	}
+
+	// A GETH_LOG from the metadata is used as is, and is rejected when another instance already uses it.
+	details.Instance.GethLog = "/tmp/./geth-bluehorizon.log"
+	if log := w.computeEnvVarsForContainer(details, "other")["GETH_LOG"]; log != "/tmp/./geth-bluehorizon.log" {
+		t.Errorf("expected the metadata log, got %v", log)
+	} else if other := w.gethLogOwner("other", log); other != "bluehorizon" {
+		t.Errorf("expected %v to be used by bluehorizon, got %v", log, other)
+	}
+}
+
+func Test_refund_bounded(t *testing.T) {
+
+	cfg := &config.HorizonConfig{}
+	w := &EthBlockchainWorker{
+		BaseWorker:  worker.BaseWorker{Manager: worker.Manager{Config: cfg, Messages: make(chan events.Message, 10)}, Commands: make(chan worker.Command, 10)},
+		instances:   make(map[string]*BCInstanceState),
+		refundTimes: make(map[string]uint64),
+	}
+	bcState := w.NewBCInstanceState("bluehorizon", "IBM")
+	bcState.notifiedReady = true
+	bcState.readySince = 1000
+
+	// Funding is not re-triggered automatically unless a timeout is configured.
+	if w.fundingOverdue(bcState, 100000) {
+		t.Errorf("funding should not be overdue without a timeout")
+	}
+
+	cfg.Edge.BlockchainFundingTimeoutS = 600
+	if w.fundingOverdue(bcState, 1599) {
+		t.Errorf("funding should not be overdue before the timeout")
+	} else if !w.fundingOverdue(bcState, 1600) {
+		t.Errorf("funding should be overdue after the timeout")
+	}
+
+	// The first re-trigger restarts the client, which resets the instance state.
+	if !w.refund("bluehorizon", 1600) {
+		t.Errorf("expected the first re-trigger to happen")
+	} else if w.instances["bluehorizon"].notifiedReady || len(w.Messages()) != 1 {
+		t.Errorf("expected the client to be restarted")
+	}
+
+	// Another re-trigger within the interval is refused.
+	if w.refund("bluehorizon", 1600+config.DefaultBlockchainRefundIntervalS-1) {
+		t.Errorf("expected a re-trigger within the interval to be refused")
+	} else if !w.refund("bluehorizon", 1600+config.DefaultBlockchainRefundIntervalS) {
+		t.Errorf("expected a re-trigger after the interval to happen")
+	}
+
+	cfg.Edge.BlockchainRefundIntervalS = 60
+	if w.refundIntervalS() != 60 {
+		t.Errorf("expected the configured interval, got %v", w.refundIntervalS())
+	}
+}
+
+// An operator refund request for an ethereum instance is queued as a refund command for the worker thread.
+func Test_NewEvent_refund(t *testing.T) {
+
+	w := &EthBlockchainWorker{
+		BaseWorker: worker.BaseWorker{Manager: worker.Manager{Config: &config.HorizonConfig{}, Messages: make(chan events.Message, 10)}, Commands: make(chan worker.Command, 10)},
+	}
+
+	w.NewEvent(events.NewBlockchainRefundMessage(events.BC_REFUND, "other", "bluehorizon"))
+	if len(w.Commands) != 0 {
+		t.Errorf("expected a refund request for another blockchain type to be ignored")
+	}
+
+	w.NewEvent(events.NewBlockchainRefundMessage(events.BC_REFUND, policy.Ethereum_bc, "bluehorizon"))
+	if len(w.Commands) != 1 {
+		t.Errorf("expected a refund command to be queued")
+	} else if cmd, ok := (<-w.Commands).(*RefundCommand); !ok || cmd.Name != "bluehorizon" {
+		t.Errorf("expected a refund command for bluehorizon, got %v", cmd)
+	}
+}
+
+func Test_NeedContainer_startup_grace(t *testing.T) {
+
+	cfg := &config.HorizonConfig{}
+	cfg.Edge.BlockchainNeededGraceS = 60
+	w := &EthBlockchainWorker{BaseWorker: worker.BaseWorker{Manager: worker.Manager{Config: cfg}}, neededBCs: make(map[string]map[string]uint64), startTime: 1000}
+
+	// Nothing has been reported yet, so blockchains are needed until the grace period expires.
+	if !w.inNeededGrace(1059) {
+		t.Errorf("expected to be in the grace period")
+	} else if w.inNeededGrace(1060) || !w.neededGraceEnded {
+		t.Errorf("expected the grace period to have expired")
+	} else if w.inNeededGrace(1000) {
+		t.Errorf("expected the grace period to stay expired")
+	}
+
+	// A report ends the grace period early.
+	w = &EthBlockchainWorker{BaseWorker: worker.BaseWorker{Manager: worker.Manager{Config: cfg}}, neededBCs: make(map[string]map[string]uint64), startTime: uint64(time.Now().Unix())}
+	if !w.NeedContainer("IBM", "bluehorizon") {
+		t.Errorf("expected the container to be needed during the grace period")
+	}
+	w.UpdatedNeededBlockchains(NewReportNeededBlockchainsCommand(events.NewReportNeededBlockchainsMessage(events.BC_NEEDED, "ethereum", map[string]map[string]bool{"myorg": map[string]bool{"other": true}})))
+	if w.NeedContainer("IBM", "bluehorizon") {
+		t.Errorf("expected the container not to be needed after the report")
+	}
+}
+
+func Test_selectChain(t *testing.T) {
+
+	valid := `{"chains":[{"arch":"amd64","deployment_description":{"deployment":"{\"services\":{\"geth\":{\"image\":\"summit.hovitos.engineering/x86/geth:1.5.7\"}}}","deployment_signature":"c2ln","torrent":{"url":"https://images.bluehorizon.network/geth.torrent","signature":"c2ln"}},"instance":{"port":"33303","maxPeers":"25"}},` +
+		`{"arch":"armhf","deployment_description":{"deployment":"{\"services\":{}}","deployment_signature":"c2ln","torrent":{"url":"https://images.bluehorizon.network/geth-arm.torrent","signature":"c2ln"}}}]}`
+
+	details := new(exchange.BlockchainDetails)
+	if err := json.Unmarshal([]byte(valid), details); err != nil {
+		t.Fatalf("unable to unmarshal metadata, error %v", err)
+	} else if chain, err := selectChain(details, "armhf"); err != nil || chain == nil || chain.Arch != "armhf" {
+		t.Errorf("expected the armhf chain, got %v, error %v", chain, err)
+	} else if chain, err := selectChain(details, "s390x"); err != nil || chain != nil {
+		t.Errorf("expected no chain for s390x, got %v, error %v", chain, err)
+	}
+
+	// A malformed chain for another arch doesn't keep the chain for this arch from being selected.
+	details.Chains[1].DeploymentDesc.Deployment = ""
+	if chain, err := selectChain(details, "amd64"); err != nil || chain == nil || chain.Arch != "amd64" {
+		t.Errorf("expected the amd64 chain, got %v, error %v", chain, err)
+	}
+
+	// The chain for this arch must be unambiguous.
+	details.Chains[1].Arch = "amd64"
+	if _, err := selectChain(details, "amd64"); err == nil || !strings.Contains(err.Error(), "which another chain has too") {
+		t.Errorf("expected a duplicate arch error, got %v", err)
+	} else if _, err := selectChain(&exchange.BlockchainDetails{}, "amd64"); err == nil || !strings.Contains(err.Error(), "no chains") {
+		t.Errorf("expected a no chains error, got %v", err)
+	}
+}
+
+func Test_validateChain(t *testing.T) {
+
+	valid := `{"arch":"amd64","deployment_description":{"deployment":"{\"services\":{\"geth\":{\"image\":\"summit.hovitos.engineering/x86/geth:1.5.7\"}}}","deployment_signature":"c2ln","torrent":{"url":"https://images.bluehorizon.network/geth.torrent","signature":"c2ln"}},"instance":{"port":"33303","maxPeers":"25"}}`
+
+	chain := new(exchange.ChainDetails)
+	if err := json.Unmarshal([]byte(valid), chain); err != nil {
+		t.Fatalf("unable to unmarshal chain, error %v", err)
+	} else if err := validateChain(chain, chain.DeploymentDesc.Torrent.Url); err != nil {
+		t.Errorf("expected a valid chain, got %v", err)
+	}
+
+	for expected, malform := range map[string]func(c *exchange.ChainDetails){
+		"chain has no arch":       func(c *exchange.ChainDetails) { c.Arch = "" },
+		"has no torrent url":      func(c *exchange.ChainDetails) { c.DeploymentDesc.Torrent.Url = "" },
+		"ill-formed torrent url":  func(c *exchange.ChainDetails) { c.DeploymentDesc.Torrent.Url = "geth.torrent" },
+		"no torrent signature":    func(c *exchange.ChainDetails) { c.DeploymentDesc.Torrent.Signature = "" },
+		"has no deployment":       func(c *exchange.ChainDetails) { c.DeploymentDesc.Deployment = "" },
+		"no deployment signature": func(c *exchange.ChainDetails) { c.DeploymentDesc.DeploymentSignature = "" },
+		"not a JSON object":       func(c *exchange.ChainDetails) { c.DeploymentDesc.Deployment = `{"services":` },
+		"not a port number":       func(c *exchange.ChainDetails) { c.Instance.Port = "70000" },
+		"not a positive number":   func(c *exchange.ChainDetails) { c.Instance.MaxPeers = "many" },
+	} {
+		chain := new(exchange.ChainDetails)
+		json.Unmarshal([]byte(valid), chain)
+		malform(chain)
+		if err := validateChain(chain, chain.DeploymentDesc.Torrent.Url); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected an error containing %v, got %v", expected, err)
+		}
+	}
+
+	// The torrent URL that is checked is the one the image is fetched from, which can differ from the metadata.
+	chain.DeploymentDesc.Torrent.Url = ""
+	if err := validateChain(chain, "https://mirror.example.com/geth.torrent"); err != nil {
+		t.Errorf("expected the overridden torrent url to be valid, got %v", err)
+	}
+}
+
+func Test_fireStartEvent(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "fire-start-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Sign the eth container deployment with a key that the worker trusts.
+	deployment := `{"services":{"geth":{"image":"summit.hovitos.engineering/private-eth:v1.5.7","command":["start.sh"]}}}`
+	keyFile := filepath.Join(dir, "horizon.pem")
+	privateKey, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	} else if pubKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKeyBytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hashed := sha256.Sum256([]byte(deployment))
+	sig, err := rsa.SignPSS(crand.Reader, privateKey, crypto.SHA256, hashed[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.HorizonConfig{
+		Collaborators: config.Collaborators{
+			KeyFileNamesFetcher: &config.KeyFileNamesFetcher{
+				GetKeyFileNames: func(publicKeyPath, userKeyPath string) ([]string, error) { return []string{keyFile}, nil },
+			},
+		},
+	}
+	w := &EthBlockchainWorker{
+		BaseWorker: worker.BaseWorker{Manager: worker.Manager{Config: cfg, Messages: make(chan events.Message, 10)}},
+		instances:  make(map[string]*BCInstanceState),
+	}
+	w.NewBCInstanceState("bluehorizon", "IBM")
+
+	details := &exchange.ChainDetails{
+		Arch: "amd64",
+		DeploymentDesc: policy.Workload{
+			Deployment:          deployment,
+			DeploymentSignature: base64.StdEncoding.EncodeToString(sig),
+			Torrent:             policy.Torrent{Url: "https://images.bluehorizon.network/eth.torrent", Signature: "torrentsig"},
+		},
+	}
+
+	// The torrent worker is asked to load the eth container with the torrent in the metadata. Whether the torrent or a
+	// registry pull is used is up to the torrent worker's ImageFetchStrategy.
+	launched := func() *events.ContainerLaunchContext {
+		if len(w.Messages()) != 1 {
+			t.Fatalf("expected 1 message, got %v", len(w.Messages()))
+		} else if msg, ok := (<-w.Messages()).(*events.LoadContainerMessage); !ok || msg.Event().Id != events.LOAD_CONTAINER {
+			t.Fatalf("expected a load container message, got %v", msg)
+		} else {
+			return msg.LaunchContext()
+		}
+		return nil
+	}
+
+	if err := w.fireStartEvent(details, "bluehorizon"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	} else if lc := launched(); lc.Configure.TorrentURL.String() != details.DeploymentDesc.Torrent.Url || lc.Configure.TorrentSignature != "torrentsig" || lc.Configure.Deployment != deployment || lc.Blockchain.Name != "bluehorizon" {
+		t.Errorf("unexpected launch context %v", lc)
+	}
+
+	// An image URL override replaces the URL, the image is still verified with the torrent signature in the metadata.
+	cfg.Edge.BlockchainImageURLs = "IBM/bluehorizon=https://mirror.example.com/eth.torrent"
+	if err := w.fireStartEvent(details, "bluehorizon"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	} else if lc := launched(); lc.Configure.TorrentURL.String() != "https://mirror.example.com/eth.torrent" || lc.Configure.TorrentSignature != "torrentsig" {
+		t.Errorf("expected the overridden image URL, got %v", lc)
+	}
+
+	// An override without a scheme and host is rejected rather than resolved relative to the metadata's URL.
+	cfg.Edge.BlockchainImageURLs = "IBM/bluehorizon=mirror/eth.torrent"
+	if err := w.fireStartEvent(details, "bluehorizon"); err == nil || !strings.Contains(err.Error(), "must be an absolute URL") {
+		t.Errorf("expected an override URL error, got %v", err)
+	} else if len(w.Messages()) != 0 {
+		t.Errorf("expected no messages, got %v", len(w.Messages()))
+	}
+
+	// The metadata's URL is not needed when it is overridden, without the override the chain is invalid.
+	cfg.Edge.BlockchainImageURLs = "IBM/bluehorizon=https://mirror.example.com/eth.torrent"
+	details.DeploymentDesc.Torrent.Url = ""
+	if err := w.fireStartEvent(details, "bluehorizon"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	} else if lc := launched(); lc.Configure.TorrentURL.String() != "https://mirror.example.com/eth.torrent" {
+		t.Errorf("expected the overridden image URL, got %v", lc)
+	}
+	cfg.Edge.BlockchainImageURLs = ""
+	if err := w.fireStartEvent(details, "bluehorizon"); err == nil || !strings.Contains(err.Error(), "has no torrent url") {
+		t.Errorf("expected a missing torrent url error, got %v", err)
+	} else if len(w.Messages()) != 0 {
+		t.Errorf("expected no messages, got %v", len(w.Messages()))
+	}
+	details.DeploymentDesc.Torrent.Url = "https://images.bluehorizon.network/eth.torrent"
+
+	// A deployment that isn't signed by a trusted key is not started.
+	details.DeploymentDesc.Deployment = strings.Replace(deployment, "v1.5.7", "v1.5.8", 1)
+	if err := w.fireStartEvent(details, "bluehorizon"); err == nil || !strings.Contains(err.Error(), "invalid deployment signature") {
+		t.Errorf("expected a signature error, got %v", err)
+	} else if len(w.Messages()) != 0 {
+		t.Errorf("expected no messages, got %v", len(w.Messages()))
+	}
+}
@@ -150,9 +150,25 @@ func (self *Event_Log) Get_Raw_Event_Batch(topics []interface{}, size uint64) ([
 	return self.get_raw_events_in_range(topics, self.batchStart, self.batchEnd)
 }
 
-func (self *Event_Log) Get_Next_Raw_Event_Batch(topics []interface{}, size uint64) ([]Raw_Event, bool, error) {
+// Returns the block range of the batch that follows a batch ending at batchEnd, given the last block that can be read and
+// the maximum number of blocks in a batch, zero meaning no limit. The third return value is true if the range reaches
+// lastBlock, so there is nothing more to read after it. The last return value is false if there are no new blocks to read.
+func nextBatchRange(batchEnd uint64, lastBlock uint64, size uint64) (uint64, uint64, bool, bool) {
+	start := batchEnd + 1
+	if lastBlock <= start {
+		return 0, 0, true, false
+	}
+
+	end := start + size - 1
 	reachedEnd := false
+	if size == 0 || lastBlock <= end {
+		end = lastBlock
+		reachedEnd = true
+	}
+	return start, end, reachedEnd, true
+}
 
+func (self *Event_Log) Get_Next_Raw_Event_Batch(topics []interface{}, size uint64) ([]Raw_Event, bool, error) {
 	events := make([]Raw_Event, 0, 10)
 	if self.batchEnd == 0 {
 		glog.Warningf("For %v previous batch included the latest blocks.", self.contractAddress)
@@ -165,21 +181,9 @@ func (self *Event_Log) Get_Next_Raw_Event_Batch(topics []interface{}, size uint6
 
 	lastBlock := self.get_stable_block()
 
-	start := self.batchEnd + 1
-	end := start + size - 1
-	if lastBlock <= start {
+	start, end, reachedEnd, ok := nextBatchRange(self.batchEnd, lastBlock, size)
+	if !ok {
 		return events, true, nil
-	} else if size == 0 {
-		end = lastBlock
-		reachedEnd = true
-	} else if lastBlock < (start + size - 1) {
-		end = lastBlock
-		reachedEnd = true
-	}
-
-	if end < start {
-		end = start
-		reachedEnd = true
 	}
 
 	if events, err := self.get_raw_events_in_range(topics, start, end); err != nil {
@@ -207,7 +211,7 @@ func (self *Event_Log) get_raw_events_in_range(topics []interface{}, start uint6
 	glog.V(5).Infof("Filter %v for %v using client %v ", self.filterId, self.contractAddress, self.client)
 	if out, err := self.client.Invoke("eth_getFilterLogs", self.filterId); err != nil {
 		glog.Errorf("Error occurred getting events for contract %v, error: %v", self.contractAddress, err)
-		return events, errors.New(err.Msg)
+		return events, err.Err()
 	} else if err := json.Unmarshal([]byte(out), &rpcEventResp); err != nil {
 		glog.Errorf("Error occurred umarshalling getFilterLogs for %v, response: %v", self.contractAddress, err)
 		return events, err
@@ -261,7 +265,7 @@ func (self *Event_Log) establish_Filter(startBlock uint64, endBlock uint64, topi
 		glog.V(5).Infof("For %v creating event filter with params: %v", self.contractAddress, params)
 
 		if out, err := self.client.Invoke("eth_newFilter", params); err != nil {
-			return errors.New(err.Msg)
+			return err.Err()
 		} else if err := json.Unmarshal([]byte(out), &rpcResp); err != nil {
 			return err
 		} else if rpcResp.Error.Message != "" {
@@ -277,7 +281,7 @@ func (self *Event_Log) remove_Filter() error {
 	if self.filterId != "" {
 		rpcResp := RPC_Response{}
 		if out, err := self.client.Invoke("eth_uninstallFilter", self.filterId); err != nil {
-			return errors.New(err.Msg)
+			return err.Err()
 		} else if err := json.Unmarshal([]byte(out), &rpcResp); err != nil {
 			return err
 		} else if rpcResp.Error.Message != "" {
@@ -297,7 +301,7 @@ func getRPCClient(httpClientFactory *config.HTTPClientFactory) *RPC_Client {
 	if con := RPC_Connection_Factory("", 0, "http://localhost:8545"); con == nil {
 		glog.Errorf("RPC Connection not created")
 		return nil
-	} else if rpcc = RPC_Client_Factory(httpClientFactory, con); rpcc == nil {
+	} else if rpcc = RPC_Client_Factory(httpClientFactory, con, 0); rpcc == nil {
 		glog.Errorf("RPC Client not created")
 		return nil
 	}
@@ -21,3 +21,45 @@ func TestClientConstructor(t *testing.T) {
 		t.Errorf("Factory returned nil, but should not.\n")
 	}
 }
+
+func Test_nextBatchRange(t *testing.T) {
+
+	type result struct {
+		start, end       uint64
+		reachedEnd, read bool
+	}
+
+	for _, tc := range []struct {
+		batchEnd, lastBlock, size uint64
+		expected                  result
+	}{
+		{100, 100, 10, result{0, 0, true, false}},     // nothing new
+		{100, 101, 10, result{0, 0, true, false}},     // the next block is the last block, wait for another one
+		{100, 500, 0, result{101, 500, true, true}},   // no limit reads everything
+		{100, 500, 10, result{101, 110, false, true}}, // a bounded batch leaves the rest of the backlog
+		{100, 105, 10, result{101, 105, true, true}},  // a bounded batch that reaches the last block
+		{100, 110, 10, result{101, 110, true, true}},  // exactly one batch
+		{100, 111, 10, result{101, 110, false, true}},
+	} {
+		start, end, reachedEnd, read := nextBatchRange(tc.batchEnd, tc.lastBlock, tc.size)
+		if r := (result{start, end, reachedEnd, read}); r != tc.expected {
+			t.Errorf("for batch end %v, last block %v and size %v expected %v, got %v", tc.batchEnd, tc.lastBlock, tc.size, tc.expected, r)
+		}
+	}
+
+	// Batches drain a backlog in order without gaps or overlaps.
+	batchEnd, next := uint64(100), uint64(101)
+	for i := 0; ; i++ {
+		start, end, reachedEnd, read := nextBatchRange(batchEnd, 1234, 100)
+		if !read || start != next || end < start || end-start+1 > 100 {
+			t.Fatalf("bad batch %v: %v to %v, read %v", i, start, end, read)
+		}
+		batchEnd, next = end, end+1
+		if reachedEnd {
+			break
+		}
+	}
+	if batchEnd != 1234 {
+		t.Errorf("expected the backlog to be drained to block 1234, stopped at %v", batchEnd)
+	}
+}
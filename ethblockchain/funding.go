@@ -36,7 +36,7 @@ func NewRPCRequest(method string, params []string) *RPCRequest {
 	}
 }
 
-func AccountFunded(colonusDir string, gethURL string) (bool, error) {
+func AccountFunded(httpClient *http.Client, colonusDir string, gethURL string) (bool, error) {
 
 	if account, err := AccountId(colonusDir); err != nil {
 		return false, err
@@ -51,7 +51,9 @@ func AccountFunded(colonusDir string, gethURL string) (bool, error) {
 			return false, err
 		} else {
 
-			if response, err := http.Post(gethURL, "application/json", strings.NewReader(string(req[:]))); err != nil {
+			if response, err := httpClient.Post(gethURL, "application/json", strings.NewReader(string(req[:]))); err != nil && isTimeout(err) {
+				return false, &RPCTimeoutError{Msg: fmt.Sprintf("Post to determine if account is funded timed out: %v", err)}
+			} else if err != nil {
 				return false, err
 			} else if response.StatusCode != 200 {
 				return false, fmt.Errorf("Got non-200 response code from Post to determine if account is funded: %v", response.StatusCode)
@@ -9,6 +9,7 @@ import (
 	"github.com/open-horizon/anax/config"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -20,7 +21,9 @@ type RPC_Client struct {
 	httpClient *http.Client
 }
 
-func RPC_Client_Factory(httpClientFactory *config.HTTPClientFactory, connection *RPC_Connection) *RPC_Client {
+// Create an RPC client for the connection. The timeoutS is the number of seconds to wait for a response to each call, zero
+// means the bh_rpc_timeout envvar if it is set, otherwise the default timeout of the http client factory.
+func RPC_Client_Factory(httpClientFactory *config.HTTPClientFactory, connection *RPC_Connection, timeoutS uint) *RPC_Client {
 	if connection == nil {
 		glog.Errorf("Input connection is nil")
 		return nil
@@ -33,8 +36,9 @@ func RPC_Client_Factory(httpClientFactory *config.HTTPClientFactory, connection
 		rpcc.body["id"] = "1"
 
 		var rpc_timeoutS *uint
-		// TODO: can we use the configurable, general timeout instead of this?
-		if rpc_t, err := strconv.Atoi(os.Getenv("bh_rpc_timeout")); err != nil || rpc_t == 0 {
+		if timeoutS != 0 {
+			rpc_timeoutS = &timeoutS
+		} else if rpc_t, err := strconv.Atoi(os.Getenv("bh_rpc_timeout")); err != nil || rpc_t == 0 {
 			rpc_timeoutS = nil
 		} else {
 			t := uint(rpc_t)
@@ -53,7 +57,7 @@ func (self *RPC_Client) Get_connection() *RPC_Connection {
 func (self *RPC_Client) Get_block_number() (uint64, error) {
 
 	if out, err := self.Invoke("eth_blockNumber", nil); err != nil {
-		return 0, errors.New(err.Msg)
+		return 0, err.Err()
 	} else if rpcResp, err := self.decodeResponse([]byte(out)); err != nil {
 		return 0, err
 	} else if block, err := strconv.ParseUint(rpcResp.Result.(string)[2:], 16, 64); err != nil {
@@ -63,6 +67,37 @@ func (self *RPC_Client) Get_block_number() (uint64, error) {
 	}
 }
 
+// Returns the number of peers the client is connected to.
+func (self *RPC_Client) Get_peer_count() (uint64, error) {
+
+	if out, err := self.Invoke("net_peerCount", []interface{}{}); err != nil {
+		return 0, err.Err()
+	} else if rpcResp, err := self.decodeResponse([]byte(out)); err != nil {
+		return 0, err
+	} else if count, ok := rpcResp.Result.(string); !ok || len(count) < 2 {
+		return 0, errors.New(fmt.Sprintf("unexpected peer count %v", rpcResp.Result))
+	} else if peers, err := strconv.ParseUint(count[2:], 16, 64); err != nil {
+		return 0, err
+	} else {
+		return peers, nil
+	}
+}
+
+// Returns true if the client is syncing blocks from its peers. The client returns false when it is not syncing, and an
+// object describing the sync progress when it is.
+func (self *RPC_Client) Get_syncing() (bool, error) {
+
+	if out, err := self.Invoke("eth_syncing", []interface{}{}); err != nil {
+		return false, err.Err()
+	} else if rpcResp, err := self.decodeResponse([]byte(out)); err != nil {
+		return false, err
+	} else if syncing, ok := rpcResp.Result.(bool); ok {
+		return syncing, nil
+	} else {
+		return rpcResp.Result != nil, nil
+	}
+}
+
 func (self *RPC_Client) Get_balance(address string) (*big.Int, error) {
 
 	bal := big.NewInt(0)
@@ -71,7 +106,7 @@ func (self *RPC_Client) Get_balance(address string) (*big.Int, error) {
 	p = append(p, "latest")
 
 	if out, err := self.Invoke("eth_getBalance", p); err != nil {
-		return bal, errors.New(err.Msg)
+		return bal, err.Err()
 	} else if rpcResp, err := self.decodeResponse([]byte(out)); err != nil {
 		return bal, err
 	} else {
@@ -86,7 +121,7 @@ func (self *RPC_Client) Get_balance(address string) (*big.Int, error) {
 func (self *RPC_Client) Get_first_account() (string, error) {
 
 	if out, err := self.Invoke("eth_accounts", nil); err != nil {
-		return "", errors.New(err.Msg)
+		return "", err.Err()
 	} else if rpcResp, err := self.decodeResponse([]byte(out)); err != nil {
 		return "", err
 	} else {
@@ -107,7 +142,7 @@ func (self *RPC_Client) Invoke(method string, params interface{}) (string, *RPCE
 	var err *RPCError
 
 	if len(method) == 0 {
-		err = &RPCError{fmt.Sprintf("RPC method name must be non-empty")}
+		err = &RPCError{Msg: fmt.Sprintf("RPC method name must be non-empty")}
 		glog.Errorf("Error: %v", err.Msg)
 		return out, err
 	}
@@ -125,17 +160,17 @@ func (self *RPC_Client) Invoke(method string, params interface{}) (string, *RPCE
 	glog.V(5).Infof("Invoking %v with %v", method, self.body)
 
 	if jsonBytes, e := json.Marshal(self.body); e != nil {
-		err = &RPCError{fmt.Sprintf("RPC invocation of %v failed creating JSON body %v, error: %v", method, self.body, e.Error())}
+		err = &RPCError{Msg: fmt.Sprintf("RPC invocation of %v failed creating JSON body %v, error: %v", method, self.body, e.Error())}
 	} else if req, e := http.NewRequest("POST", self.connection.Get_fullURL(), bytes.NewBuffer(jsonBytes)); e != nil {
-		err = &RPCError{fmt.Sprintf("RPC invocation of %v failed creating http request, error: %v", method, e.Error())}
+		err = &RPCError{Msg: fmt.Sprintf("RPC invocation of %v failed creating http request, error: %v", method, e.Error())}
 	} else {
 		req.Close = true // work around to ensure that Go doesn't get connections confused. Supposed to be fixed in Go 1.6.
 		if resp, e := self.httpClient.Do(req); e != nil {
-			err = &RPCError{fmt.Sprintf("RPC http invocation of %v with %v returned error: %v", method, self.body, e.Error())}
+			err = &RPCError{Msg: fmt.Sprintf("RPC http invocation of %v with %v returned error: %v", method, self.body, e.Error()), Timeout: isTimeout(e)}
 		} else {
 			defer resp.Body.Close()
 			if outBytes, e := ioutil.ReadAll(resp.Body); e != nil {
-				err = &RPCError{fmt.Sprintf("RPC invocation of %v failed reading response message %v, error: %v", method, outBytes, e.Error())}
+				err = &RPCError{Msg: fmt.Sprintf("RPC invocation of %v failed reading response message %v, error: %v", method, outBytes, e.Error()), Timeout: isTimeout(e)}
 			} else {
 				out = string(outBytes)
 				glog.V(5).Infof("Response to %v is %v", self.body, out)
@@ -172,5 +207,38 @@ type RPC_Response struct {
 }
 
 type RPCError struct {
+	Msg     string
+	Timeout bool // the blockchain client did not respond within the RPC timeout
+}
+
+// Returns the RPC error as an error, which is an RPCTimeoutError if the call timed out.
+func (e *RPCError) Err() error {
+	if e.Timeout {
+		return &RPCTimeoutError{Msg: e.Msg}
+	}
+	return errors.New(e.Msg)
+}
+
+// The error of a call to the blockchain client that did not get a response within the RPC timeout. A timeout usually means
+// the client is hung, so callers should treat it like any other failure of the client's API.
+type RPCTimeoutError struct {
 	Msg string
 }
+
+func (e *RPCTimeoutError) Error() string {
+	return e.Msg
+}
+
+// Returns true if the error is an RPCTimeoutError.
+func IsRPCTimeout(err error) bool {
+	_, ok := err.(*RPCTimeoutError)
+	return ok
+}
+
+// Returns true if the error of an http call is a timeout.
+func isTimeout(err error) bool {
+	if nErr, ok := err.(net.Error); ok {
+		return nErr.Timeout()
+	}
+	return false
+}
@@ -3,13 +3,18 @@
 package ethblockchain
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestClient_Constructor(t *testing.T) {
 	rpcClient := RPC_Connection_Factory("localhost", 8545, "")
 
-	if c := RPC_Client_Factory(httpClientFactory(t), rpcClient); c == nil {
+	if c := RPC_Client_Factory(httpClientFactory(t), rpcClient, 0); c == nil {
 		t.Errorf("Factory returned nil, but should not.\n")
 	} else if c.Get_connection().Get_fullURL() != "http://localhost:8545" {
 		t.Errorf("Factory returned a client that does not point to the right connection URL: %v\n", c.Get_connection().Get_fullURL())
@@ -18,7 +23,70 @@ func TestClient_Constructor(t *testing.T) {
 
 func TestBadClientConstructor(t *testing.T) {
 
-	if c := RPC_Client_Factory(httpClientFactory(t), nil); c != nil {
+	if c := RPC_Client_Factory(httpClientFactory(t), nil, 0); c != nil {
 		t.Errorf("Factory did not return nil, but should have.\n")
 	}
 }
+
+func TestClient_peers_and_syncing(t *testing.T) {
+
+	results := map[string]string{
+		"net_peerCount": `"0x1a"`,
+		"eth_syncing":   `{"startingBlock":"0x0","currentBlock":"0x10","highestBlock":"0x20"}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":"1","result":%v}`, results[body["method"].(string)])
+	}))
+	defer server.Close()
+
+	c := RPC_Client_Factory(httpClientFactory(t), RPC_Connection_Factory("", 0, server.URL), 0)
+
+	if peers, err := c.Get_peer_count(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	} else if peers != 26 {
+		t.Errorf("expected 26 peers, got %v", peers)
+	}
+
+	if syncing, err := c.Get_syncing(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	} else if !syncing {
+		t.Errorf("expected client to be syncing")
+	}
+
+	results["eth_syncing"] = "false"
+	if syncing, err := c.Get_syncing(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	} else if syncing {
+		t.Errorf("expected client not to be syncing")
+	}
+}
+
+func TestClient_timeout(t *testing.T) {
+
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":"1","result":"0x10"}`)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	c := RPC_Client_Factory(httpClientFactory(t), RPC_Connection_Factory("", 0, server.URL), 1)
+
+	start := time.Now()
+	if _, err := c.Get_block_number(); err == nil {
+		t.Errorf("expected the call to a hung client to fail")
+	} else if !IsRPCTimeout(err) {
+		t.Errorf("expected a timeout error, got %T %v", err, err)
+	} else if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the call to fail after the 1 second timeout, it took %v", elapsed)
+	}
+
+	if _, err := RPC_Client_Factory(httpClientFactory(t), RPC_Connection_Factory("", 0, "http://localhost:1"), 1).Get_block_number(); err == nil {
+		t.Errorf("expected the call to fail")
+	} else if IsRPCTimeout(err) {
+		t.Errorf("expected a refused connection not to be a timeout, got %v", err)
+	}
+}
@@ -29,6 +29,8 @@ const (
 	ACCOUNT_FUNDED        EventId = "ACCOUNT_FUNDED"
 	BC_CLIENT_INITIALIZED EventId = "BC_CLIENT_INITIALIZED"
 	BC_CLIENT_STOPPING    EventId = "BC_CLIENT_STOPPING"
+	BC_CLIENT_ISOLATED    EventId = "BC_CLIENT_ISOLATED"
+	BC_REFUND             EventId = "BC_REFUND"
 	BC_EVENT              EventId = "BC_EVENT"
 	BC_NEEDED             EventId = "BC_NEEDED"
 	ALL_STOP              EventId = "ALL_STOP"
@@ -71,11 +73,14 @@ const (
 	DEVICE_AGREEMENTS_SYNCED EventId = "DEVICE_AGREEMENTS_SYNCED"
 	DEVICE_CONTAINERS_SYNCED EventId = "DEVICE_CONTAINERS_SYNCED"
 	WORKLOAD_UPGRADE         EventId = "WORKLOAD_UPGRADE"
+	RECONCILE_AGREEMENTS     EventId = "RECONCILE_AGREEMENTS"
+	DEVICE_AGREEMENTS_CANCEL EventId = "DEVICE_AGREEMENTS_CANCEL"
 
 	// Node related
 	START_UNCONFIGURE    EventId = "UNCONFIGURE_NODE"
 	UNCONFIGURE_COMPLETE EventId = "UNCONFIGURE_COMPLETE"
 	WORKER_STOP          EventId = "WORKER_STOP"
+	WORKER_DRAINED       EventId = "WORKER_DRAINED"
 )
 
 type EndContractCause string
@@ -709,6 +714,7 @@ type ABApiAgreementCancelationMessage struct {
 	event             Event
 	AgreementProtocol string
 	AgreementId       string
+	OperatorReason    string // the reason given by the operator, if any
 }
 
 func (m *ABApiAgreementCancelationMessage) Event() Event {
@@ -716,20 +722,21 @@ func (m *ABApiAgreementCancelationMessage) Event() Event {
 }
 
 func (m ABApiAgreementCancelationMessage) String() string {
-	return fmt.Sprintf("Event: %v, AgreementProtocol: %v, AgreementId: %v", m.event, m.AgreementProtocol, m.AgreementId)
+	return fmt.Sprintf("Event: %v, AgreementProtocol: %v, AgreementId: %v, OperatorReason: %v", m.event, m.AgreementProtocol, m.AgreementId, m.OperatorReason)
 }
 
 func (m ABApiAgreementCancelationMessage) ShortString() string {
 	return m.String()
 }
 
-func NewABApiAgreementCancelationMessage(id EventId, protocol string, agreementId string) *ABApiAgreementCancelationMessage {
+func NewABApiAgreementCancelationMessage(id EventId, protocol string, agreementId string, operatorReason string) *ABApiAgreementCancelationMessage {
 	return &ABApiAgreementCancelationMessage{
 		event: Event{
 			Id: id,
 		},
 		AgreementProtocol: protocol,
 		AgreementId:       agreementId,
+		OperatorReason:    operatorReason,
 	}
 }
 
@@ -765,6 +772,58 @@ func NewABApiWorkloadUpgradeMessage(id EventId, protocol string, agreementId str
 	}
 }
 
+type ABApiReconcileAgreementsMessage struct {
+	event Event
+}
+
+func (m *ABApiReconcileAgreementsMessage) Event() Event {
+	return m.event
+}
+
+func (m ABApiReconcileAgreementsMessage) String() string {
+	return fmt.Sprintf("Event: %v", m.event)
+}
+
+func (m ABApiReconcileAgreementsMessage) ShortString() string {
+	return m.String()
+}
+
+func NewABApiReconcileAgreementsMessage(id EventId) *ABApiReconcileAgreementsMessage {
+	return &ABApiReconcileAgreementsMessage{
+		event: Event{
+			Id: id,
+		},
+	}
+}
+
+type ABApiDeviceCancelationMessage struct {
+	event          Event
+	DeviceId       string
+	OperatorReason string // the reason given by the operator, if any
+}
+
+func (m *ABApiDeviceCancelationMessage) Event() Event {
+	return m.event
+}
+
+func (m ABApiDeviceCancelationMessage) String() string {
+	return fmt.Sprintf("Event: %v, DeviceId: %v, OperatorReason: %v", m.event, m.DeviceId, m.OperatorReason)
+}
+
+func (m ABApiDeviceCancelationMessage) ShortString() string {
+	return m.String()
+}
+
+func NewABApiDeviceCancelationMessage(id EventId, deviceId string, operatorReason string) *ABApiDeviceCancelationMessage {
+	return &ABApiDeviceCancelationMessage{
+		event: Event{
+			Id: id,
+		},
+		DeviceId:       deviceId,
+		OperatorReason: operatorReason,
+	}
+}
+
 // Initialization and restart messages
 type InitAgreementCancelationMessage struct {
 	event             Event
@@ -971,6 +1030,92 @@ func NewBlockchainClientStoppingMessage(id EventId, bcType string, bcName string
 	}
 }
 
+// Blockchain client isolated message, sent when a ready client has had no peers for too long
+type BlockchainClientIsolatedMessage struct {
+	event      Event
+	Time       uint64
+	bcType     string
+	bcInstance string
+	bcOrg      string
+	IsolatedS  uint64 // the number of seconds the client has had no peers
+}
+
+func (m *BlockchainClientIsolatedMessage) Event() Event {
+	return m.event
+}
+
+func (m BlockchainClientIsolatedMessage) String() string {
+	return fmt.Sprintf("Event: %v, Time: %v, Type: %v, Instance: %v, Org: %v, IsolatedS: %v", m.event, m.Time, m.bcType, m.bcInstance, m.bcOrg, m.IsolatedS)
+}
+
+func (m BlockchainClientIsolatedMessage) ShortString() string {
+	return m.String()
+}
+
+func (m BlockchainClientIsolatedMessage) BlockchainType() string {
+	return m.bcType
+}
+
+func (m BlockchainClientIsolatedMessage) BlockchainInstance() string {
+	return m.bcInstance
+}
+
+func (m BlockchainClientIsolatedMessage) BlockchainOrg() string {
+	return m.bcOrg
+}
+
+func NewBlockchainClientIsolatedMessage(id EventId, bcType string, bcName string, org string, isolatedS uint64) *BlockchainClientIsolatedMessage {
+	return &BlockchainClientIsolatedMessage{
+		event: Event{
+			Id: id,
+		},
+		Time:       uint64(time.Now().Unix()),
+		bcType:     bcType,
+		bcInstance: bcName,
+		bcOrg:      org,
+		IsolatedS:  isolatedS,
+	}
+}
+
+// Blockchain refund message, sent when an operator asks to re-trigger the funding of a client whose account is stuck unfunded
+type BlockchainRefundMessage struct {
+	event      Event
+	Time       uint64
+	bcType     string
+	bcInstance string
+}
+
+func (m *BlockchainRefundMessage) Event() Event {
+	return m.event
+}
+
+func (m BlockchainRefundMessage) String() string {
+	return fmt.Sprintf("Event: %v, Time: %v, Type: %v, Instance: %v", m.event, m.Time, m.bcType, m.bcInstance)
+}
+
+func (m BlockchainRefundMessage) ShortString() string {
+	return m.String()
+}
+
+func (m BlockchainRefundMessage) BlockchainType() string {
+	return m.bcType
+}
+
+func (m BlockchainRefundMessage) BlockchainInstance() string {
+	return m.bcInstance
+}
+
+func NewBlockchainRefundMessage(id EventId, bcType string, bcName string) *BlockchainRefundMessage {
+	return &BlockchainRefundMessage{
+		event: Event{
+			Id: id,
+		},
+		Time:       uint64(time.Now().Unix()),
+		bcType:     bcType,
+		bcInstance: bcName,
+	}
+}
+
 // Report of blockchains that are needed
 type ReportNeededBlockchainsMessage struct {
 	event     Event
@@ -1409,6 +1554,37 @@ func NewWorkerStopMessage(id EventId, name string) *WorkerStopMessage {
 	}
 }
 
+// Sent by a worker during node shutdown once it has finished all the work queued before the shutdown began.
+type WorkerDrainedMessage struct {
+	event Event
+	name  string
+}
+
+func (w *WorkerDrainedMessage) Event() Event {
+	return w.event
+}
+
+func (w *WorkerDrainedMessage) String() string {
+	return w.ShortString()
+}
+
+func (w *WorkerDrainedMessage) ShortString() string {
+	return fmt.Sprintf("Event: %v, Worker Name: %v", w.event, w.name)
+}
+
+func (w *WorkerDrainedMessage) Name() string {
+	return w.name
+}
+
+func NewWorkerDrainedMessage(id EventId, name string) *WorkerDrainedMessage {
+	return &WorkerDrainedMessage{
+		event: Event{
+			Id: id,
+		},
+		name: name,
+	}
+}
+
 type AllBlockchainShutdownMessage struct {
 	event Event
 }
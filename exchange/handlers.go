@@ -23,7 +23,7 @@ type OrgHandler func(org string, id string, token string) (*Organization, error)
 
 func (e *ExchangeApiHandlers) GetHTTPExchangeOrgHandler() OrgHandler {
 	return func(org string, id string, token string) (*Organization, error) {
-		return GetOrganization(e.Config.Collaborators.HTTPClientFactory, org, e.Config.Edge.ExchangeURL, id, token)
+		return GetOrganization(e.Config.Collaborators.HTTPClientFactory, org, e.Config.Edge.GetExchangeURL(org), id, token)
 	}
 }
 
@@ -32,7 +32,7 @@ type PatternHandler func(org string, pattern string, id string, token string) (m
 
 func (e *ExchangeApiHandlers) GetHTTPExchangePatternHandler() PatternHandler {
 	return func(org string, pattern string, id string, token string) (map[string]Pattern, error) {
-		return GetPatterns(e.Config.Collaborators.HTTPClientFactory, org, pattern, e.Config.Edge.ExchangeURL, id, token)
+		return GetPatterns(e.Config.Collaborators.HTTPClientFactory, org, pattern, e.Config.Edge.GetExchangeURL(org), id, token)
 	}
 }
 
@@ -41,7 +41,7 @@ type MicroserviceHandler func(mUrl string, mOrg string, mVersion string, mArch s
 
 func (e *ExchangeApiHandlers) GetHTTPMicroserviceHandler() MicroserviceHandler {
 	return func(mUrl string, mOrg string, mVersion string, mArch string, id string, token string) (*MicroserviceDefinition, error) {
-		return GetMicroservice(e.Config.Collaborators.HTTPClientFactory, mUrl, mOrg, mVersion, mArch, e.Config.Edge.ExchangeURL, id, token)
+		return GetMicroservice(e.Config.Collaborators.HTTPClientFactory, mUrl, mOrg, mVersion, mArch, e.Config.Edge.GetExchangeURL(mOrg), id, token)
 	}
 }
 
@@ -50,7 +50,7 @@ type WorkloadResolverHandler func(wUrl string, wOrg string, wVersion string, wAr
 
 func (e *ExchangeApiHandlers) GetHTTPWorkloadResolverHandler() WorkloadResolverHandler {
 	return func(wUrl string, wOrg string, wVersion string, wArch string, id string, token string) (*policy.APISpecList, *WorkloadDefinition, error) {
-		return WorkloadResolver(e.Config.Collaborators.HTTPClientFactory, wUrl, wOrg, wVersion, wArch, e.Config.Edge.ExchangeURL, id, token)
+		return WorkloadResolver(e.Config.Collaborators.HTTPClientFactory, wUrl, wOrg, wVersion, wArch, e.Config.Edge.GetExchangeURL(wOrg), id, token)
 	}
 }
 
@@ -59,7 +59,7 @@ type WorkloadHandler func(wUrl string, wOrg string, wVersion string, wArch strin
 
 func (e *ExchangeApiHandlers) GetHTTPWorkloadHandler() WorkloadHandler {
 	return func(wUrl string, wOrg string, wVersion string, wArch string, id string, token string) (*WorkloadDefinition, error) {
-		return GetWorkload(e.Config.Collaborators.HTTPClientFactory, wUrl, wOrg, wVersion, wArch, e.Config.Edge.ExchangeURL, id, token)
+		return GetWorkload(e.Config.Collaborators.HTTPClientFactory, wUrl, wOrg, wVersion, wArch, e.Config.Edge.GetExchangeURL(wOrg), id, token)
 	}
 }
 
@@ -68,7 +68,7 @@ type DeviceHandler func(deviceId string, deviceToken string) (*Device, error)
 
 func (e *ExchangeApiHandlers) GetHTTPDeviceHandler() DeviceHandler {
 	return func(id string, token string) (*Device, error) {
-		return GetExchangeDevice(e.Config.Collaborators.HTTPClientFactory, id, token, e.Config.Edge.ExchangeURL)
+		return GetExchangeDevice(e.Config.Collaborators.HTTPClientFactory, id, token, e.Config.Edge.GetExchangeURL(GetOrg(id)))
 	}
 }
 
@@ -77,6 +77,6 @@ type PutDeviceHandler func(deviceId string, deviceToken string, pdr *PutDeviceRe
 
 func (e *ExchangeApiHandlers) GetHTTPPutDeviceHandler() PutDeviceHandler {
 	return func(id string, token string, pdr *PutDeviceRequest) (*PutDeviceResponse, error) {
-		return PutExchangeDevice(e.Config.Collaborators.HTTPClientFactory, id, token, e.Config.Edge.ExchangeURL, pdr)
+		return PutExchangeDevice(e.Config.Collaborators.HTTPClientFactory, id, token, e.Config.Edge.GetExchangeURL(GetOrg(id)), pdr)
 	}
 }
@@ -0,0 +1,87 @@
+package exchange
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The number of heartbeat intervals that can pass without a successful heartbeat before the heartbeat is unhealthy.
+const HEARTBEAT_UNHEALTHY_INTERVALS = 3
+
+// HeartbeatState records the outcome of the heartbeats a worker sends to the exchange, so that a silent loss of
+// exchange connectivity can be detected. It is safe for concurrent use by the heartbeat subworker and status callers.
+type HeartbeatState struct {
+	lock         sync.Mutex
+	intervalS    int
+	firstAttempt time.Time
+	lastAttempt  time.Time
+	lastSuccess  time.Time
+	lastError    string
+}
+
+// The externally visible heartbeat state, suitable for status APIs. Times are unix seconds, zero means never.
+type HeartbeatStatus struct {
+	IntervalS   int    `json:"interval_seconds"`
+	LastAttempt int64  `json:"last_attempt"`
+	LastSuccess int64  `json:"last_success"`
+	LastError   string `json:"last_error,omitempty"`
+	Healthy     bool   `json:"healthy"`
+}
+
+func (s HeartbeatStatus) String() string {
+	return fmt.Sprintf("IntervalS: %v, LastAttempt: %v, LastSuccess: %v, LastError: %v, Healthy: %v", s.IntervalS, s.LastAttempt, s.LastSuccess, s.LastError, s.Healthy)
+}
+
+func NewHeartbeatState(intervalS int) *HeartbeatState {
+	return &HeartbeatState{
+		intervalS: intervalS,
+	}
+}
+
+// Record the outcome of a heartbeat. A nil error is a successful heartbeat.
+func (h *HeartbeatState) Record(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+	if h.firstAttempt.IsZero() {
+		h.firstAttempt = now
+	}
+	h.lastAttempt = now
+	if err == nil {
+		h.lastSuccess = now
+		h.lastError = ""
+	} else {
+		h.lastError = err.Error()
+	}
+}
+
+// Returns the current heartbeat state. The heartbeat is unhealthy when there has been no successful heartbeat for more
+// than HEARTBEAT_UNHEALTHY_INTERVALS heartbeat intervals since the last success, or since the first attempt when no
+// heartbeat has ever succeeded. Before the first heartbeat, the state is healthy.
+func (h *HeartbeatState) Status() *HeartbeatStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := &HeartbeatStatus{
+		IntervalS: h.intervalS,
+		LastError: h.lastError,
+		Healthy:   true,
+	}
+	if !h.lastAttempt.IsZero() {
+		s.LastAttempt = h.lastAttempt.Unix()
+	}
+	if !h.lastSuccess.IsZero() {
+		s.LastSuccess = h.lastSuccess.Unix()
+	}
+
+	since := h.lastSuccess
+	if since.IsZero() {
+		since = h.firstAttempt
+	}
+	if !since.IsZero() && time.Since(since) > time.Duration(HEARTBEAT_UNHEALTHY_INTERVALS*h.intervalS)*time.Second {
+		s.Healthy = false
+	}
+	return s
+}
@@ -0,0 +1,57 @@
+// +build unit
+
+package exchange
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_HeartbeatState_healthy(t *testing.T) {
+
+	h := NewHeartbeatState(60)
+
+	// No heartbeats yet.
+	if s := h.Status(); !s.Healthy || s.LastAttempt != 0 || s.LastSuccess != 0 {
+		t.Errorf("expected healthy status before the first heartbeat, got %v", s)
+	}
+
+	h.Record(nil)
+	if s := h.Status(); !s.Healthy || s.LastSuccess == 0 || s.LastAttempt != s.LastSuccess || s.LastError != "" {
+		t.Errorf("expected healthy status after a successful heartbeat, got %v", s)
+	}
+
+	// A single failure within the interval is still healthy, and the error is reported.
+	h.Record(errors.New("connection refused"))
+	if s := h.Status(); !s.Healthy || s.LastError != "connection refused" {
+		t.Errorf("expected healthy status with the last error, got %v", s)
+	}
+
+	// A success clears the error.
+	h.Record(nil)
+	if s := h.Status(); s.LastError != "" {
+		t.Errorf("expected the error to be cleared, got %v", s)
+	}
+}
+
+func Test_HeartbeatState_unhealthy(t *testing.T) {
+
+	h := NewHeartbeatState(60)
+	h.Record(nil)
+
+	// Move the last success back beyond the unhealthy threshold.
+	h.lastSuccess = time.Now().Add(-time.Duration(HEARTBEAT_UNHEALTHY_INTERVALS*60+1) * time.Second)
+	h.Record(errors.New("status: 503"))
+	if s := h.Status(); s.Healthy {
+		t.Errorf("expected unhealthy status, got %v", s)
+	}
+
+	// A heartbeat that has never succeeded becomes unhealthy based on the first attempt.
+	h = NewHeartbeatState(60)
+	h.Record(errors.New("connection refused"))
+	h.firstAttempt = time.Now().Add(-time.Duration(HEARTBEAT_UNHEALTHY_INTERVALS*60+1) * time.Second)
+	if s := h.Status(); s.Healthy || s.LastSuccess != 0 {
+		t.Errorf("expected unhealthy status without any success, got %v", s)
+	}
+}
@@ -122,7 +122,7 @@ func (w *ExchangeMessageWorker) NoWorkHandler() {
 func (w *ExchangeMessageWorker) getMessages() ([]DeviceMessage, error) {
 	var resp interface{}
 	resp = new(GetDeviceMessageResponse)
-	targetURL := w.Manager.Config.Edge.ExchangeURL + "orgs/" + GetOrg(w.id) + "/nodes/" + GetId(w.id) + "/msgs"
+	targetURL := w.Manager.Config.Edge.GetExchangeURL(GetOrg(w.id)) + "orgs/" + GetOrg(w.id) + "/nodes/" + GetId(w.id) + "/msgs"
 	for {
 		if err, tpErr := InvokeExchange(w.httpClient, "GET", targetURL, w.id, w.token, nil, &resp); err != nil {
 			glog.Errorf(err.Error())
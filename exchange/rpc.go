@@ -2,6 +2,7 @@ package exchange
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
@@ -774,6 +775,12 @@ func getSearchVersion(version string) (string, error) {
 }
 
 func GetWorkload(httpClientFactory *config.HTTPClientFactory, wURL string, wOrg string, wVersion string, wArch string, exURL string, id string, token string) (*WorkloadDefinition, error) {
+	return GetWorkloadWithContext(context.Background(), httpClientFactory, wURL, wOrg, wVersion, wArch, exURL, id, token)
+}
+
+// Same as GetWorkload, except that the search is abandoned and the context's error is returned when the input context is
+// cancelled, even if the exchange is unreachable and the search would otherwise keep retrying.
+func GetWorkloadWithContext(ctx context.Context, httpClientFactory *config.HTTPClientFactory, wURL string, wOrg string, wVersion string, wArch string, exURL string, id string, token string) (*WorkloadDefinition, error) {
 
 	glog.V(3).Infof(rpclogString(fmt.Sprintf("getting workload definition %v %v %v %v", wURL, wOrg, wVersion, wArch)))
 
@@ -793,12 +800,14 @@ func GetWorkload(httpClientFactory *config.HTTPClientFactory, wURL string, wOrg
 	}
 
 	for {
-		if err, tpErr := InvokeExchange(httpClientFactory.NewHTTPClient(nil), "GET", targetURL, id, token, nil, &resp); err != nil {
+		if err, tpErr := InvokeExchangeWithContext(ctx, httpClientFactory.NewHTTPClient(nil), "GET", targetURL, id, token, nil, &resp); err != nil {
 			glog.Errorf(rpclogString(fmt.Sprintf(err.Error())))
 			return nil, err
 		} else if tpErr != nil {
 			glog.Warningf(rpclogString(fmt.Sprintf(tpErr.Error())))
-			time.Sleep(10 * time.Second)
+			if err := SleepWithContext(ctx, 10*time.Second); err != nil {
+				return nil, err
+			}
 			continue
 		} else {
 			workloadMetadata := resp.(*GetWorkloadsResponse).Workloads
@@ -965,7 +974,8 @@ func GetMicroservice(httpClientFactory *config.HTTPClientFactory, mURL string, m
 
 // The purpose of this function is to verify that a given workload URL, version and architecture, is defined in the exchange
 // as well as all of its API spec dependencies. This function also returns the API dependencies converted into
-// policy types so that the caller can use those types to do policy compatibility checks if they want to.
+// policy types so that the caller can use those types to do policy compatibility checks if they want to. The API spec
+// dependencies are looked up in the same exchange as the workload, the one at exURL.
 func WorkloadResolver(httpClientFactory *config.HTTPClientFactory, wURL string, wOrg string, wVersion string, wArch string, exURL string, id string, token string) (*policy.APISpecList, *WorkloadDefinition, error) {
 	resolveMicroservices := true
 
@@ -1331,8 +1341,16 @@ func GetNodeHealthStatus(httpClientFactory *config.HTTPClientFactory, pattern st
 
 // This function is used to invoke an exchange API
 func InvokeExchange(httpClient *http.Client, method string, url string, user string, pw string, params interface{}, resp *interface{}) (error, error) {
+	return InvokeExchangeWithContext(context.Background(), httpClient, method, url, user, pw, params, resp)
+}
+
+// Same as InvokeExchange, except that the HTTP request is abandoned when the input context is cancelled. A cancelled
+// invocation is returned as a non-transport error so that callers do not retry it.
+func InvokeExchangeWithContext(ctx context.Context, httpClient *http.Client, method string, url string, user string, pw string, params interface{}, resp *interface{}) (error, error) {
 
-	if len(method) == 0 {
+	if err := ctx.Err(); err != nil {
+		return errors.New(fmt.Sprintf("Invocation of %v at %v abandoned, error: %v", method, url, err)), nil
+	} else if len(method) == 0 {
 		return errors.New(fmt.Sprintf("Error invoking exchange, method name must be specified")), nil
 	} else if len(url) == 0 {
 		return errors.New(fmt.Sprintf("Error invoking exchange, no URL to invoke")), nil
@@ -1358,7 +1376,7 @@ func InvokeExchange(httpClient *http.Client, method string, url string, user str
 	if req, err := http.NewRequest(method, url, requestBody); err != nil {
 		return errors.New(fmt.Sprintf("Invocation of %v at %v with %v failed creating HTTP request, error: %v", method, url, requestBody, err)), nil
 	} else {
-		req.Close = true // work around to ensure that Go doesn't get connections confused. Supposed to be fixed in Go 1.6.
+		req = req.WithContext(ctx)
 		req.Header.Add("Accept", "application/json")
 		if method != "GET" {
 			req.Header.Add("Content-Type", "application/json")
@@ -1370,7 +1388,9 @@ func InvokeExchange(httpClient *http.Client, method string, url string, user str
 		// If the exchange is down, this call will return an error.
 
 		if httpResp, err := httpClient.Do(req); err != nil {
-			if isTransportError(err) {
+			if ctx.Err() != nil {
+				return errors.New(fmt.Sprintf("Invocation of %v at %v abandoned, error: %v", method, url, ctx.Err())), nil
+			} else if isTransportError(err) {
 				return nil, errors.New(fmt.Sprintf("Invocation of %v at %v with %v failed invoking HTTP request, error: %v", method, url, requestBody, err))
 			} else {
 				return errors.New(fmt.Sprintf("Invocation of %v at %v with %v failed invoking HTTP request, error: %v", method, url, requestBody, err)), nil
@@ -1475,6 +1495,16 @@ func InvokeExchange(httpClient *http.Client, method string, url string, user str
 	}
 }
 
+// Sleep for the input duration, returning early with the context's error if the input context is cancelled first.
+func SleepWithContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
 func isTransportError(err error) bool {
 	l_error_string := strings.ToLower(err.Error())
 	if strings.Contains(l_error_string, "time") && strings.Contains(l_error_string, "out") {
@@ -1485,6 +1515,16 @@ func isTransportError(err error) bool {
 	return false
 }
 
+// Returns true if the error is from an exchange call that was rejected because the caller's credentials are
+// invalid, i.e. the exchange returned HTTP status 401 or 403. Retrying such a call will not help until the credentials
+// are fixed.
+func IsAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), fmt.Sprintf("status: %v", http.StatusUnauthorized)) || strings.Contains(err.Error(), fmt.Sprintf("status: %v", http.StatusForbidden))
+}
+
 var rpclogString = func(v interface{}) string {
 	return fmt.Sprintf("Exchange RPC %v", v)
 }
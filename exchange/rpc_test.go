@@ -4,6 +4,7 @@ package exchange
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -297,3 +298,21 @@ func create_Pattern(jsonString string, t *testing.T) *Pattern {
 		return wl
 	}
 }
+
+func Test_IsAuthError(t *testing.T) {
+
+	for _, status := range []int{401, 403} {
+		err := errors.New(fmt.Sprintf("Invocation of GET at http://exchange/v1/orgs/myorg/agbots/ag1/msgs failed invoking HTTP request, status: %v, response: {}", status))
+		if !IsAuthError(err) {
+			t.Errorf("expected status %v to be an auth error", status)
+		} else if !IsAuthError(errors.New(fmt.Sprintf("AgreementBotWorker received error retrieving workload definition, error: %v", err))) {
+			t.Errorf("expected a wrapped status %v to be an auth error", status)
+		}
+	}
+
+	if IsAuthError(nil) {
+		t.Errorf("expected nil not to be an auth error")
+	} else if IsAuthError(errors.New("Invocation of GET at http://exchange/v1/orgs/myorg/patterns failed invoking HTTP request, status: 404, response: {}")) {
+		t.Errorf("expected status 404 not to be an auth error")
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"net/url"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -57,6 +58,9 @@ type GovernanceWorker struct {
 	deviceStatus      *DeviceStatus
 	ShuttingDownCmd   *NodeShutdownCommand
 	exchHandlers      *exchange.ExchangeApiHandlers
+	drainLock         sync.Mutex // Protects the fields below, which are read by the node shutdown go routine.
+	agreementsDrained bool       // True when the agreement worker has drained its work during node shutdown.
+	terminations      int        // The number of agreement terminations still running in their own go routines.
 }
 
 func NewGovernanceWorker(name string, cfg *config.HorizonConfig, db *bolt.DB, pm *policy.PolicyManager) *GovernanceWorker {
@@ -248,6 +252,13 @@ func (w *GovernanceWorker) NewEvent(incoming events.Message) {
 			w.Commands <- worker.NewTerminateCommand("shutdown")
 		}
 
+	case *events.WorkerDrainedMessage:
+		msg, _ := incoming.(*events.WorkerDrainedMessage)
+		switch msg.Event().Id {
+		case events.WORKER_DRAINED:
+			w.setAgreementsDrained()
+		}
+
 	default: //nothing
 	}
 
@@ -424,7 +435,7 @@ func (w *GovernanceWorker) cancelAgreement(agreementId string, agreementProtocol
 
 	// Delete from the exchange
 	if ag != nil && ag.AgreementAcceptedTime != 0 {
-		if err := deleteProducerAgreement(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), w.Config.Edge.ExchangeURL, w.deviceId, w.deviceToken, agreementId); err != nil {
+		if err := deleteProducerAgreement(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), w.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)), w.deviceId, w.deviceToken, agreementId); err != nil {
 			glog.Errorf(logString(fmt.Sprintf("error deleting agreement %v in exchange: %v", agreementId, err)))
 		}
 	}
@@ -443,8 +454,11 @@ func (w *GovernanceWorker) externalTermination(ag *persistence.EstablishedAgreem
 	// routine will be waiting for a blockchain cancel to run. In general it will take around 30 seconds, but could be
 	// double or triple that time. This will free up the governance thread to handle other protocol messages.
 
-	// This routine does not need to be a subworker because it will terminate on its own.
+	// This routine does not need to be a subworker because it will terminate on its own. Node shutdown waits for it
+	// to finish before stopping the blockchain clients that it might be using.
+	w.startTermination()
 	go func() {
+		defer w.endTermination()
 
 		// Get the policy we used in the agreement and then cancel, just in case.
 		glog.V(3).Infof(logString(fmt.Sprintf("terminating agreement %v", agreementId)))
@@ -929,7 +943,7 @@ func (w *GovernanceWorker) finalizeAgreement(agreement persistence.EstablishedAg
 		return errors.New(logString(fmt.Sprintf("could not hydrate proposal, error: %v", err)))
 	} else if tcPolicy, err := policy.DemarshalPolicy(proposal.TsAndCs()); err != nil {
 		return errors.New(logString(fmt.Sprintf("error demarshalling TsAndCs policy for agreement %v, error %v", agreement.CurrentAgreementId, err)))
-	} else if err := recordProducerAgreementState(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), w.Config.Edge.ExchangeURL, w.deviceId, w.deviceToken, w.devicePattern, agreement.CurrentAgreementId, tcPolicy, "Finalized Agreement"); err != nil {
+	} else if err := recordProducerAgreementState(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), w.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)), w.deviceId, w.deviceToken, w.devicePattern, agreement.CurrentAgreementId, tcPolicy, "Finalized Agreement"); err != nil {
 		return errors.New(logString(fmt.Sprintf("error setting agreement %v finalized state in exchange: %v", agreement.CurrentAgreementId, err)))
 	}
 
@@ -945,7 +959,7 @@ func (w *GovernanceWorker) RecordReply(proposal abstractprotocol.Proposal, proto
 		// Update the state in the exchange
 	} else if tcPolicy, err := policy.DemarshalPolicy(proposal.TsAndCs()); err != nil {
 		return errors.New(logString(fmt.Sprintf("received error demarshalling TsAndCs, %v", err)))
-	} else if err := recordProducerAgreementState(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), w.Config.Edge.ExchangeURL, w.deviceId, w.deviceToken, w.devicePattern, proposal.AgreementId(), tcPolicy, "Agree to proposal"); err != nil {
+	} else if err := recordProducerAgreementState(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), w.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)), w.deviceId, w.deviceToken, w.devicePattern, proposal.AgreementId(), tcPolicy, "Agree to proposal"); err != nil {
 		return errors.New(logString(fmt.Sprintf("received error setting state for agreement %v", err)))
 	} else {
 		// Publish the "agreement reached" event to the message bus so that torrent can start downloading the workload
@@ -978,7 +992,7 @@ func (w *GovernanceWorker) RecordReply(proposal abstractprotocol.Proposal, proto
 				}
 				// The workload config we have might be from a lower version of the workload. Go to the exchange and
 				// get the metadata for the version we are running and then add in any unset default user inputs.
-				if exWkld, err := exchange.GetWorkload(w.Config.Collaborators.HTTPClientFactory, workload.WorkloadURL, workload.Org, workload.Version, workload.Arch, w.Config.Edge.ExchangeURL, w.deviceId, w.deviceToken); err != nil {
+				if exWkld, err := exchange.GetWorkload(w.Config.Collaborators.HTTPClientFactory, workload.WorkloadURL, workload.Org, workload.Version, workload.Arch, w.Config.Edge.GetExchangeURL(workload.Org), w.deviceId, w.deviceToken); err != nil {
 					return errors.New(logString(fmt.Sprintf("received error querying excahnge for workload metadata, error %v", err)))
 				} else if exWkld == nil {
 					return errors.New(logString(fmt.Sprintf("cound not find workload metadata for %v.", workload)))
@@ -993,7 +1007,7 @@ func (w *GovernanceWorker) RecordReply(proposal abstractprotocol.Proposal, proto
 				}
 			}
 
-			cutil.SetPlatformEnvvars(envAdds, config.ENVVAR_PREFIX, proposal.AgreementId(), exchange.GetId(w.deviceId), exchange.GetOrg(w.deviceId), workload.WorkloadPassword, w.Config.Edge.ExchangeURL)
+			cutil.SetPlatformEnvvars(envAdds, config.ENVVAR_PREFIX, cutil.AddDVPrefix(w.Config.Edge.DVPrefix, proposal.AgreementId()), exchange.GetId(w.deviceId), exchange.GetOrg(w.deviceId), workload.WorkloadPassword, w.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)))
 
 			lc.EnvironmentAdditions = &envAdds
 			lc.AgreementProtocol = protocol
@@ -1036,7 +1050,7 @@ func (w *GovernanceWorker) RecordReply(proposal abstractprotocol.Proposal, proto
 
 		// Tell the BC worker to start the BC client container(s) if we need to.
 		if ag.BlockchainType != "" && ag.BlockchainName != "" && ag.BlockchainOrg != "" {
-			w.BaseWorker.Manager.Messages <- events.NewNewBCContainerMessage(events.NEW_BC_CLIENT, ag.BlockchainType, ag.BlockchainName, ag.BlockchainOrg, w.Config.Edge.ExchangeURL, w.deviceId, w.deviceToken)
+			w.BaseWorker.Manager.Messages <- events.NewNewBCContainerMessage(events.NEW_BC_CLIENT, ag.BlockchainType, ag.BlockchainName, ag.BlockchainOrg, w.Config.Edge.GetExchangeURL(ag.BlockchainOrg), w.deviceId, w.deviceToken)
 		}
 	}
 
@@ -1192,7 +1206,7 @@ func deleteProducerAgreement(httpClient *http.Client, url string, deviceId strin
 func (w *GovernanceWorker) deleteMessage(msg *exchange.DeviceMessage) error {
 	var resp interface{}
 	resp = new(exchange.PostDeviceResponse)
-	targetURL := w.Manager.Config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/msgs/" + strconv.Itoa(msg.MsgId)
+	targetURL := w.Manager.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)) + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/msgs/" + strconv.Itoa(msg.MsgId)
 	for {
 		if err, tpErr := exchange.InvokeExchange(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), "DELETE", targetURL, w.deviceId, w.deviceToken, nil, &resp); err != nil {
 			glog.Errorf(logString(err.Error()))
@@ -1211,7 +1225,7 @@ func (w *GovernanceWorker) deleteMessage(msg *exchange.DeviceMessage) error {
 func (w *GovernanceWorker) messageInExchange(msgId int) (bool, error) {
 	var resp interface{}
 	resp = new(exchange.GetDeviceMessageResponse)
-	targetURL := w.Manager.Config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/msgs"
+	targetURL := w.Manager.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)) + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/msgs"
 	for {
 		if err, tpErr := exchange.InvokeExchange(w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), "GET", targetURL, w.deviceId, w.deviceToken, nil, &resp); err != nil {
 			glog.Errorf(logString(err.Error()))
@@ -114,7 +114,7 @@ func (w *GovernanceWorker) StartMicroservice(ms_key string) (*persistence.Micros
 					} else {
 						envAdds[config.ENVVAR_PREFIX+"DEVICE_ID"] = exchange.GetId(w.deviceId)
 						envAdds[config.ENVVAR_PREFIX+"ORGANIZATION"] = exchange.GetOrg(w.deviceId)
-						envAdds[config.ENVVAR_PREFIX+"EXCHANGE_URL"] = w.Config.Edge.ExchangeURL
+						envAdds[config.ENVVAR_PREFIX+"EXCHANGE_URL"] = w.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId))
 						// Add in any default variables from the microservice userInputs that havent been overridden
 						for _, ui := range msdef.UserInputs {
 							if ui.DefaultValue != "" {
@@ -20,7 +20,9 @@ import (
 // function ends in an error, the error will be in the shutdown complete message.
 //
 // There are other workers responsible for other functions, which will also so some cleanup when the Node Shutdown Message
-// arrives. For example, the node heartbeat function is stopped by the Agreement worker.
+// arrives. For example, the node heartbeat function is stopped by the Agreement worker. The Agreement worker also sends
+// a worker drained message once it has handled the commands queued before the shutdown, which this function waits for
+// before the blockchain clients are stopped.
 func (w *GovernanceWorker) nodeShutdown(cmd *NodeShutdownCommand) {
 	glog.V(3).Infof(logString(fmt.Sprintf("begin node shutdown process.")))
 
@@ -54,6 +56,10 @@ func (w *GovernanceWorker) nodeShutdown(cmd *NodeShutdownCommand) {
 		return
 	}
 
+	// Wait for the agreement worker to drain and for agreement terminations running in their own go routines to
+	// complete, so that no agreement state is lost when the blockchain clients they use stop.
+	w.waitForDrain(w.Config.Edge.ShutdownDrainTimeout())
+
 	// Tell the blockchain workers to terminate blockchain containers. We will do this by telling the producer protocol handlers to shutdown.
 	// Any protocol handlers that are using a blockchain will tell the blockchain worker to terminate.
 	w.Messages() <- events.NewAllBlockchainShutdownMessage(events.ALL_STOP)
@@ -107,7 +113,7 @@ func (w *GovernanceWorker) nodeShutdown(cmd *NodeShutdownCommand) {
 func (w *GovernanceWorker) clearNodePatternAndMS() error {
 
 	// If the node entry has already been removed form the exchange, skip this step.
-	exDev, err := exchange.GetExchangeDevice(w.Config.Collaborators.HTTPClientFactory, w.deviceId, w.deviceToken, w.Config.Edge.ExchangeURL)
+	exDev, err := exchange.GetExchangeDevice(w.Config.Collaborators.HTTPClientFactory, w.deviceId, w.deviceToken, w.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)))
 	if err != nil && strings.Contains(err.Error(), "status: 401") {
 		return nil
 	} else if err != nil {
@@ -123,7 +129,7 @@ func (w *GovernanceWorker) clearNodePatternAndMS() error {
 
 	var resp interface{}
 	resp = new(exchange.PutDeviceResponse)
-	targetURL := w.Manager.Config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId)
+	targetURL := w.Manager.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)) + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId)
 
 	glog.V(3).Infof(logString(fmt.Sprintf("clearing node entry in exchange: %v", pdr.ShortString())))
 
@@ -187,6 +193,56 @@ func (w *GovernanceWorker) terminateAllAgreements() error {
 	return nil
 }
 
+// Wait until the agreement worker has drained and there are no agreement terminations running in their own go routines.
+// Shutdown has to make progress, so after the timeout the wait is abandoned. Returns true if the agreement work drained.
+func (w *GovernanceWorker) waitForDrain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		drained, terminations := w.drainState()
+		if drained && terminations == 0 {
+			glog.V(3).Infof(logString(fmt.Sprintf("agreement work drained")))
+			return true
+		} else if time.Now().After(deadline) {
+			glog.Warningf(logString(fmt.Sprintf("timed out after %v waiting for agreement work to drain, worker drained: %v, agreement terminations running: %v, continuing shutdown", timeout, drained, terminations)))
+			return false
+		} else if !drained {
+			glog.V(3).Infof(logString(fmt.Sprintf("waiting for the agreement worker to drain")))
+		} else {
+			glog.V(3).Infof(logString(fmt.Sprintf("waiting for agreement terminations to complete, have %v", terminations)))
+		}
+
+		wait := 5 * time.Second
+		if remaining := deadline.Sub(time.Now()); remaining < wait {
+			wait = remaining
+		}
+		time.Sleep(wait)
+	}
+}
+
+func (w *GovernanceWorker) drainState() (bool, int) {
+	w.drainLock.Lock()
+	defer w.drainLock.Unlock()
+	return w.agreementsDrained, w.terminations
+}
+
+func (w *GovernanceWorker) setAgreementsDrained() {
+	w.drainLock.Lock()
+	defer w.drainLock.Unlock()
+	w.agreementsDrained = true
+}
+
+func (w *GovernanceWorker) startTermination() {
+	w.drainLock.Lock()
+	defer w.drainLock.Unlock()
+	w.terminations += 1
+}
+
+func (w *GovernanceWorker) endTermination() {
+	w.drainLock.Lock()
+	defer w.drainLock.Unlock()
+	w.terminations -= 1
+}
+
 // Terminate any remaining microservice containers. All ms(es) associated with an agreement should be gone. The
 // remaining containers are the shared singleton containers.
 func (w *GovernanceWorker) terminateMicroservices() error {
@@ -242,7 +298,7 @@ func (w *GovernanceWorker) patchNodeKey() error {
 
 	var resp interface{}
 	resp = new(exchange.PutDeviceResponse)
-	targetURL := w.Manager.Config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId)
+	targetURL := w.Manager.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)) + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId)
 
 	glog.V(3).Infof(logString(fmt.Sprintf("clearing messaging key in node entry: %v at %v", pdr, targetURL)))
 
@@ -338,7 +394,7 @@ func (w *GovernanceWorker) deleteNode() error {
 
 	var resp interface{}
 	resp = new(exchange.PutDeviceResponse)
-	targetURL := w.Manager.Config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId)
+	targetURL := w.Manager.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)) + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId)
 
 	glog.V(3).Infof(logString(fmt.Sprintf("deleting node %v from exchange", w.deviceId)))
 
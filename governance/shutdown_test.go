@@ -0,0 +1,44 @@
+// +build unit
+
+package governance
+
+import (
+	"github.com/open-horizon/anax/events"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_drainState(t *testing.T) {
+	w := &GovernanceWorker{}
+
+	drained, terminations := w.drainState()
+	assert.False(t, drained, "should not be drained before the agreement worker drains")
+	assert.Equal(t, 0, terminations, "should have no terminations")
+
+	w.startTermination()
+	w.startTermination()
+	w.endTermination()
+	w.NewEvent(events.NewWorkerDrainedMessage(events.WORKER_DRAINED, "Agreement"))
+
+	drained, terminations = w.drainState()
+	assert.True(t, drained, "should be drained after the worker drained message")
+	assert.Equal(t, 1, terminations, "should have one termination still running")
+
+	w.endTermination()
+	assert.True(t, w.waitForDrain(time.Second), "should be drained when the terminations complete")
+}
+
+func Test_waitForDrain_timeout(t *testing.T) {
+	w := &GovernanceWorker{}
+
+	// The agreement worker never drains, shutdown gives up waiting after the timeout.
+	start := time.Now()
+	assert.False(t, w.waitForDrain(100*time.Millisecond), "should time out when the agreement worker does not drain")
+	assert.True(t, time.Since(start) < 5*time.Second, "should not wait longer than the timeout")
+
+	// A termination that never completes times out too.
+	w.NewEvent(events.NewWorkerDrainedMessage(events.WORKER_DRAINED, "Agreement"))
+	w.startTermination()
+	assert.False(t, w.waitForDrain(100*time.Millisecond), "should time out when a termination does not complete")
+}
@@ -287,7 +287,7 @@ func (w *GovernanceWorker) writeStatusToExchange(device_status *DeviceStatus) er
 	resp = new(exchange.PostDeviceResponse)
 
 	httpClient := w.Config.Collaborators.HTTPClientFactory.NewHTTPClient(nil)
-	targetURL := w.Config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/status"
+	targetURL := w.Config.Edge.GetExchangeURL(exchange.GetOrg(w.deviceId)) + "orgs/" + exchange.GetOrg(w.deviceId) + "/nodes/" + exchange.GetId(w.deviceId) + "/status"
 
 	for {
 		if err, tpErr := exchange.InvokeExchange(httpClient, "PUT", targetURL, w.deviceId, w.deviceToken, device_status, &resp); err != nil {
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/boltdb/bolt"
 	"github.com/golang/glog"
 	"github.com/open-horizon/anax/agreement"
@@ -20,6 +22,7 @@ import (
 	"path"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -30,11 +33,23 @@ import (
 // and the workers can be fired up.
 //
 func main() {
-	configFile := flag.String("config", "/etc/colonus/anax.config", "Config file location")
+	configFile := flag.String("config", "/etc/colonus/anax.config", "Config file location. A comma separated list of files is read in order, later files override earlier ones.")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
+	showConfig := flag.Bool("showconfig", false, "Print the effective config as JSON, with the source of each value and secrets redacted, and exit.")
 
 	flag.Parse()
 
+	if *showConfig {
+		effective, err := config.ReadEffective(strings.Split(*configFile, ","))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		out, _ := json.MarshalIndent(effective, "", "  ")
+		fmt.Println(string(out))
+		os.Exit(0)
+	}
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -44,7 +59,7 @@ func main() {
 		glog.V(2).Infof("Started CPU profiling. Writing to: %v", f.Name())
 	}
 
-	cfg, err := config.Read(*configFile)
+	cfg, err := config.ReadMultiple(strings.Split(*configFile, ","))
 	if err != nil {
 		panic(err)
 	}
@@ -117,6 +132,12 @@ func main() {
 		pm = policyManager
 	}
 
+	// Fail early and clearly when the docker daemon is too old for the image pulls and containers that anax needs.
+	if err := container.CheckDockerVersion(cfg); err != nil {
+		glog.Errorf("Docker version check failed, terminating: %v", err)
+		panic(err)
+	}
+
 	// start workers
 	workers := worker.NewMessageHandlerRegistry()
 
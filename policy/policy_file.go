@@ -418,6 +418,25 @@ func (self *Policy) ObscureWorkloadPWs(agreementId string, defaultPW string) err
 	return nil
 }
 
+// Returns a copy of the policy with sensitive fields (passwords) masked, suitable for logging or persisting as
+// a debugging artifact.
+func (self *Policy) Redact() (*Policy, error) {
+	copy := new(Policy)
+	if bytes, err := json.Marshal(self); err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to marshal policy %v, error: %v", self.Header.Name, err))
+	} else if err := json.Unmarshal(bytes, copy); err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to demarshal policy %v, error: %v", self.Header.Name, err))
+	}
+
+	copy.DataVerify.Obscure()
+	for ix, _ := range copy.Workloads {
+		if copy.Workloads[ix].WorkloadPassword != "" {
+			copy.Workloads[ix].WorkloadPassword = "********"
+		}
+	}
+	return copy, nil
+}
+
 // Returns the next highest priority workload given a starting priority value, the number of retries so far and the
 // starting time of the first try at this priority. If the caller passes in zero for the priority, then this routine will return
 // the absolute highest priority workload. If there is no next highest priority, this function will return the lowest
@@ -848,3 +848,20 @@ func create_WorkloadList(jsonString string, t *testing.T) *WorkloadList {
 		return pl
 	}
 }
+
+func Test_Policy_Redact(t *testing.T) {
+
+	pf := Policy_Factory("redact test")
+	pf.DataVerify = DataVerification{Enabled: true, URL: "http://dv.example.com", URLUser: "user", URLPassword: "secret"}
+	pf.Workloads = append(pf.Workloads, Workload{WorkloadURL: "http://wl.example.com", WorkloadPassword: "wlsecret"})
+
+	if redacted, err := pf.Redact(); err != nil {
+		t.Errorf("Error redacting policy: %v", err)
+	} else if redacted.DataVerify.URLPassword != "********" || redacted.Workloads[0].WorkloadPassword != "********" {
+		t.Errorf("Policy was not redacted: %v", redacted)
+	} else if redacted.DataVerify.URLUser != "user" || redacted.Workloads[0].WorkloadURL != "http://wl.example.com" {
+		t.Errorf("Redacted policy lost non-sensitive fields: %v", redacted)
+	} else if pf.DataVerify.URLPassword != "secret" || pf.Workloads[0].WorkloadPassword != "wlsecret" {
+		t.Errorf("Original policy should not be modified: %v", pf)
+	}
+}
@@ -105,7 +105,7 @@ func (w *BaseProducerProtocolHandler) sendMessage(mt interface{}, pay []byte) er
 		pm := exchange.CreatePostMessage(msgBody, w.config.Edge.ExchangeMessageTTL)
 		var resp interface{}
 		resp = new(exchange.PostDeviceResponse)
-		targetURL := w.config.Edge.ExchangeURL + "orgs/" + exchange.GetOrg(messageTarget.ReceiverExchangeId) + "/agbots/" + exchange.GetId(messageTarget.ReceiverExchangeId) + "/msgs"
+		targetURL := w.config.Edge.GetExchangeURL(exchange.GetOrg(messageTarget.ReceiverExchangeId)) + "orgs/" + exchange.GetOrg(messageTarget.ReceiverExchangeId) + "/agbots/" + exchange.GetId(messageTarget.ReceiverExchangeId) + "/msgs"
 		for {
 			if err, tpErr := exchange.InvokeExchange(w.config.Collaborators.HTTPClientFactory.NewHTTPClient(nil), "POST", targetURL, w.deviceId, w.token, pm, &resp); err != nil {
 				return err
@@ -127,7 +127,7 @@ func (w *BaseProducerProtocolHandler) GetWorkloadResolver() func(wURL string, wO
 
 func (w *BaseProducerProtocolHandler) workloadResolver(wURL string, wOrg string, wVersion string, wArch string) (*policy.APISpecList, error) {
 
-	asl, _, err := exchange.WorkloadResolver(w.config.Collaborators.HTTPClientFactory, wURL, wOrg, wVersion, wArch, w.config.Edge.ExchangeURL, w.deviceId, w.token)
+	asl, _, err := exchange.WorkloadResolver(w.config.Collaborators.HTTPClientFactory, wURL, wOrg, wVersion, wArch, w.config.Edge.GetExchangeURL(wOrg), w.deviceId, w.token)
 	if err != nil {
 		glog.Errorf(BPPHlogString(w.Name(), fmt.Sprintf("unable to resolve workload, error %v", err)))
 	}
@@ -257,7 +257,7 @@ func (w *BaseProducerProtocolHandler) GetAgbotMessageEndpoint(agbotId string) (s
 
 	glog.V(5).Infof(BPPHlogString(w.Name(), fmt.Sprintf("retrieving agbot %v msg endpoint from exchange", agbotId)))
 
-	if ag, err := w.getAgbot(agbotId, w.config.Edge.ExchangeURL, w.deviceId, w.token); err != nil {
+	if ag, err := w.getAgbot(agbotId, w.config.Edge.GetExchangeURL(exchange.GetOrg(agbotId)), w.deviceId, w.token); err != nil {
 		return "", nil, err
 	} else {
 		glog.V(5).Infof(BPPHlogString(w.Name(), fmt.Sprintf("retrieved agbot %v msg endpoint from exchange %v", agbotId, ag.MsgEndPoint)))
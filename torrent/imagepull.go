@@ -1,6 +1,7 @@
 package torrent
 
 import (
+	"context"
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/open-horizon/horizon-pkg-fetch/fetcherrors"
 	"strings"
@@ -9,7 +10,9 @@ import (
 	"github.com/golang/glog"
 	"github.com/open-horizon/anax/config"
 	"github.com/open-horizon/anax/containermessage"
+	"github.com/open-horizon/anax/cutil/dockerutil"
 	"os"
+	"syscall"
 	"time"
 )
 
@@ -19,20 +22,64 @@ const (
 	maxPullAttempts = 3
 )
 
-func dockerCredsFromConfigFile(configFilePath string) (*docker.AuthConfigurations, error) {
+// Returns true if the registry is in the comma separated list of registry domains.
+func registryInList(registry string, list string) bool {
+	for _, r := range strings.Split(list, ",") {
+		if strings.ToLower(strings.TrimSpace(r)) == registry {
+			return true
+		}
+	}
+	return false
+}
 
-	f, err := os.Open(configFilePath)
-	defer f.Close()
-	if err != nil {
-		return nil, err
+// Returns an error if the config does not allow images to be pulled from the registry of the input image.
+func checkImageRegistry(config config.Config, image string) error {
+	registry := dockerutil.ImageRegistry(image)
+	if config.DeniedImageRegistries != "" && registryInList(registry, config.DeniedImageRegistries) {
+		return fmt.Errorf("image %v is from registry %v, which is in the DeniedImageRegistries list %v", image, registry, config.DeniedImageRegistries)
+	} else if config.AllowedImageRegistries != "" && !registryInList(registry, config.AllowedImageRegistries) {
+		return fmt.Errorf("image %v is from registry %v, which is not in the AllowedImageRegistries list %v", image, registry, config.AllowedImageRegistries)
 	}
+	return nil
+}
 
-	auths, err := docker.NewAuthConfigurations(f)
-	if err != nil {
-		return nil, err
+// Returns the directory where docker keeps its images, see DockerStoragePath.
+func dockerStoragePath(config config.Config, client *docker.Client) string {
+	rootDir := ""
+	if config.DockerStoragePath == "" {
+		if info, err := client.Info(); err != nil {
+			glog.Warningf("Unable to get the docker root dir from the docker daemon. Error: %v", err)
+		} else {
+			rootDir = info.DockerRootDir
+		}
 	}
+	return config.DockerStorage(rootDir)
+}
+
+// Returns the space, in MB, available to anax on the file system of the path.
+func freeSpaceMB(path string) (int64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, err
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize) / (1024 * 1024), nil
+}
+
+// Returns an error if the file system of the path has less than minMB free to pull the image. When the free space can't
+// be read the pull is not refused, the check must not leave a node unable to pull at all.
+func checkFreeSpace(image string, path string, minMB int64, freeSpaceFn func(path string) (int64, error)) error {
+	if freeMB, err := freeSpaceFn(path); err != nil {
+		glog.Warningf("Unable to read the free space of the docker storage path %v before pulling image %v, pulling anyway. Error: %v", path, image, err)
+	} else if freeMB < minMB {
+		return fmt.Errorf("refusing to pull image %v, the docker storage path %v has %v MB free, less than the DockerMinFreeSpaceMB %v MB", image, path, freeMB, minMB)
+	}
+	return nil
+}
 
-	return auths, nil
+// Returns true if the image is in the local docker store.
+func imageInStore(client *docker.Client, image string) bool {
+	_, err := client.InspectImage(image)
+	return err == nil
 }
 
 func pullImageFromRepos(config config.Config, authConfigs *docker.AuthConfigurations, client *docker.Client, skipPartFetchFn *func(repotag string) (bool, error), deploymentDesc *containermessage.DeploymentDescription) error {
@@ -51,7 +98,7 @@ func pullImageFromRepos(config config.Config, authConfigs *docker.AuthConfigurat
 
 	if file_name != "" {
 		glog.V(5).Infof("Using auth config file: %v", file_name)
-		authFromFile, err := dockerCredsFromConfigFile(file_name)
+		authFromFile, err := dockerutil.DockerCredsFromConfigFile(file_name)
 		if err != nil {
 			glog.Errorf("Failed to read creds file %v. Error: %v", file_name, err)
 		} else {
@@ -64,61 +111,185 @@ func pullImageFromRepos(config config.Config, authConfigs *docker.AuthConfigurat
 		}
 	}
 
-	// TODO: can we fetch in parallel with the docker client? If so, lift pattern from https://github.com/open-horizon/horizon-pkg-fetch/blob/master/fetch.go#L350
+	// Make sure every image comes from a registry the config allows before pulling any of them.
 	for name, service := range deploymentDesc.Services {
-		var pullAttempts int
+		if err := checkImageRegistry(config, service.Image); err != nil {
+			glog.Errorf("Refusing to pull image %v for service %v. Error: %v", service.Image, name, err)
+			return err
+		}
+	}
 
-		glog.Infof("Pulling image %v for service %v", service.Image, name)
-		imageNameParts := strings.Split(service.Image, ":")
+	// Refuse a pull that could fill the disk of the node and leave it unusable.
+	storagePath := ""
+	if config.MinFreeSpaceMB() != 0 {
+		storagePath = dockerStoragePath(config, client)
+	}
 
-		// TODO: check the on-disk image to make sure it still verifies
-		// N.B. It's possible to specify an outputstream here which means we could fetch a docker image and hash it, check the sig like we used to
-		opts := docker.PullImageOptions{
-			Repository: imageNameParts[0],
-			Tag:        imageNameParts[1],
-		}
+	// TODO: can we fetch in parallel with the docker client? If so, lift pattern from https://github.com/open-horizon/horizon-pkg-fetch/blob/master/fetch.go#L350
+	for name, service := range deploymentDesc.Services {
+		image := service.Image
 
-		var auth docker.AuthConfiguration
-		for domainName, creds := range authConfigs.Configs {
-			repName := strings.Split(imageNameParts[0], "/")
-			if repName[0] == domainName {
-				auth = creds
+		// An image that is already in the local docker store downloads nothing, so a node that is low on space can
+		// still restart the services whose images it has.
+		if storagePath != "" && !imageInStore(client, image) {
+			if err := checkFreeSpace(image, storagePath, config.MinFreeSpaceMB(), freeSpaceMB); err != nil {
+				glog.Errorf("Not pulling image %v for service %v. Error: %v", image, name, err)
+				return err
 			}
 		}
 
-		for pullAttempts <= maxPullAttempts {
-			if err := client.PullImage(opts, auth); err == nil {
-				glog.Infof("Succeeded fetching image %v for service %v", service.Image, name)
-				break
-			} else {
-				glog.Errorf("Docker image pull(s) failed. Waiting %d seconds before retry. Error: %v", pullAttemptDelayS, err)
-				pullAttempts++
+		glog.Infof("Pulling image %v for service %v", image, name)
+		pullStart := time.Now()
+		pullAttempts, err := pullImage(client, authConfigs, image, config.PullPlatform(), config.DockerPullTimeoutS)
 
-				if pullAttempts != maxPullAttempts {
-					time.Sleep(pullAttemptDelayS * time.Second)
+		// When the registry of the image can't be reached, pull the image from the fallback registry instead, and start the
+		// service from the fallback image.
+		if err != nil && pullFailureOutcome(err) == PULL_NETWORK_FAILURE {
+			if fallback, ferr := fallbackImage(config, image); ferr != nil {
+				glog.Errorf("Unable to determine the fallback image for %v. Error: %v", image, ferr)
+			} else if fallback != "" {
+				glog.Warningf("Unable to reach the registry of image %v for service %v, using fallback image %v. Error: %v", image, name, fallback, err)
+				var attempts int
+				if ferr := checkImageRegistry(config, fallback); ferr != nil {
+					glog.Errorf("Refusing to pull fallback image %v for service %v. Error: %v", fallback, name, ferr)
+				} else if attempts, ferr = pullImage(client, authConfigs, fallback, config.PullPlatform(), config.DockerPullTimeoutS); ferr != nil {
+					glog.Errorf("Failed to pull fallback image %v for service %v. Error: %v", fallback, name, ferr)
+					err = ferr
+				} else if ferr := checkImageDigest(client, fallback); ferr != nil {
+					glog.Errorf("Refusing to use fallback image %v for service %v. Error: %v", fallback, name, ferr)
+					err = ferr
 				} else {
-					msg := fmt.Sprintf("Max pull attempts reached (%d). Aborting fetch of Docker image %v", pullAttempts, service.Image)
-
-					switch err.(type) {
-					case *docker.Error:
-						dErr := err.(*docker.Error)
-						if dErr.Status == 500 && strings.Contains(dErr.Message, "cred") {
-							return fetcherrors.PkgSourceFetchAuthError{Msg: msg, InternalError: dErr}
-						} else {
-							glog.Infof("Docker client error occurred %v", err)
-							return err
-						}
-
-					default:
-						glog.Errorf("(Unknown error type, %T) Internal error of unidentifiable type: %v. Original: %v", err, msg, err)
-						return err
-
-					}
+					service.Image = fallback
+					err = nil
 				}
+				pullAttempts += attempts
 			}
 		}
 
+		if err == nil {
+			glog.Infof("Succeeded fetching image %v for service %v", service.Image, name)
+			PullMetrics.Record(image, pullAttempts, time.Since(pullStart), PULL_SUCCESS)
+			continue
+		}
+
+		msg := fmt.Sprintf("Max pull attempts reached (%d). Aborting fetch of Docker image %v", pullAttempts, image)
+		PullMetrics.Record(image, pullAttempts, time.Since(pullStart), pullFailureOutcome(err))
+
+		switch err.(type) {
+		case *docker.Error:
+			dErr := err.(*docker.Error)
+			if dErr.Status == 500 && strings.Contains(dErr.Message, "cred") {
+				return fetcherrors.PkgSourceFetchAuthError{Msg: msg, InternalError: dErr}
+			} else {
+				glog.Infof("Docker client error occurred %v", err)
+				return err
+			}
+
+		default:
+			glog.Errorf("(Unknown error type, %T) Internal error of unidentifiable type: %v. Original: %v", err, msg, err)
+			return err
+
+		}
 	}
 
 	return nil
 }
+
+// Pull the variant of the image for the platform, trying up to maxPullAttempts times. The attempts, and the waits between them, are abandoned when the
+// pull takes longer than timeoutS seconds, zero means no timeout. Returns the number of attempts and the error of the
+// last attempt.
+func pullImage(client *docker.Client, authConfigs *docker.AuthConfigurations, image string, platform string, timeoutS int) (int, error) {
+	ctx, cancel := pullContext(timeoutS)
+	defer cancel()
+	opts := pullImageOptions(image)
+
+	var auth docker.AuthConfiguration
+	for domainName, creds := range authConfigs.Configs {
+		repName := strings.Split(opts.Repository, "/")
+		if repName[0] == domainName {
+			auth = creds
+		}
+	}
+
+	for pullAttempts := 1; ; pullAttempts++ {
+		err := pullPlatformImage(ctx, client, opts, platform, auth)
+		if err != nil && ctx.Err() != nil {
+			glog.Errorf("Docker image pull of %v did not complete within DockerPullTimeoutS %d seconds, not retrying. Error: %v", image, timeoutS, err)
+			return pullAttempts, err
+		} else if err == nil || pullAttempts == maxPullAttempts {
+			return pullAttempts, err
+		}
+		glog.Errorf("Docker image pull(s) failed. Waiting %d seconds before retry. Error: %v", pullAttemptDelayS, err)
+		select {
+		case <-time.After(pullAttemptDelayS * time.Second):
+		case <-ctx.Done():
+			glog.Errorf("Docker image pull of %v did not complete within DockerPullTimeoutS %d seconds, not retrying.", image, timeoutS)
+			return pullAttempts, err
+		}
+	}
+}
+
+// Returns the context that bounds the pull of an image to timeoutS seconds. Zero means the pull is not bounded, it can
+// take as long as the registry needs.
+func pullContext(timeoutS int) (context.Context, context.CancelFunc) {
+	if timeoutS == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(timeoutS)*time.Second)
+}
+
+// Returns the options to pull the image with.
+func pullImageOptions(image string) docker.PullImageOptions {
+	repository, tag := dockerutil.SplitImageName(image)
+
+	// TODO: check the on-disk image to make sure it still verifies
+	// N.B. It's possible to specify an outputstream here which means we could fetch a docker image and hash it, check the sig like we used to
+	return docker.PullImageOptions{
+		Repository: repository,
+		Tag:        tag,
+	}
+}
+
+// Returns the name of the image in the fallback registry configured for the image's registry, or the empty string if
+// there is no fallback. Images of the default registry without an org are official images, which are in its library org.
+func fallbackImage(config config.Config, image string) (string, error) {
+	fallbacks, err := config.FallbackImageRegistryMap()
+	if err != nil {
+		return "", err
+	}
+
+	registry := dockerutil.ImageRegistry(image)
+	fallback, ok := fallbacks[registry]
+	if !ok {
+		return "", nil
+	}
+
+	name := image
+	if parts := strings.SplitN(image, "/", 2); len(parts) == 2 && strings.ToLower(parts[0]) == registry {
+		name = parts[1]
+	}
+	if registry == dockerutil.DefaultImageRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return fallback + "/" + name, nil
+}
+
+// Returns an error if the image was named by digest and the pulled image does not have that digest. Images named by
+// tag are not checked.
+func checkImageDigest(client *docker.Client, image string) error {
+	if !strings.Contains(image, "@") {
+		return nil
+	}
+
+	_, digest := dockerutil.SplitImageName(image)
+	img, err := client.InspectImage(image)
+	if err != nil {
+		return err
+	}
+	for _, repoDigest := range img.RepoDigests {
+		if strings.HasSuffix(repoDigest, "@"+digest) {
+			return nil
+		}
+	}
+	return fmt.Errorf("image %v does not have the expected digest %v, its digests are %v", image, digest, img.RepoDigests)
+}
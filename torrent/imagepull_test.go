@@ -0,0 +1,166 @@
+// +build unit
+
+package torrent
+
+import (
+	"errors"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/anax/config"
+	"github.com/open-horizon/anax/containermessage"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_checkImageRegistry_no_policy(t *testing.T) {
+
+	if err := checkImageRegistry(config.Config{}, "registry.example.com/org/cpu:1.0"); err != nil {
+		t.Errorf("expected no error without a registry policy, got %v", err)
+	}
+}
+
+func Test_checkImageRegistry_allow(t *testing.T) {
+
+	cfg := config.Config{AllowedImageRegistries: "docker.io, registry.example.com:5000"}
+
+	if err := checkImageRegistry(cfg, "openhorizon/amd64_cpu:1.0"); err != nil {
+		t.Errorf("expected docker.io image to be allowed, got %v", err)
+	} else if err := checkImageRegistry(cfg, "registry.example.com:5000/org/cpu:1.0"); err != nil {
+		t.Errorf("expected registry.example.com:5000 image to be allowed, got %v", err)
+	} else if err := checkImageRegistry(cfg, "registry.example.com/org/cpu:1.0"); err == nil || !strings.Contains(err.Error(), "not in the AllowedImageRegistries") {
+		t.Errorf("expected registry.example.com image to be rejected, got %v", err)
+	}
+}
+
+func Test_checkImageRegistry_deny(t *testing.T) {
+
+	cfg := config.Config{DeniedImageRegistries: "docker.io"}
+
+	if err := checkImageRegistry(cfg, "ubuntu:16.04"); err == nil || !strings.Contains(err.Error(), "registry docker.io, which is in the DeniedImageRegistries") {
+		t.Errorf("expected docker.io image to be rejected, got %v", err)
+	} else if err := checkImageRegistry(cfg, "registry.example.com/org/cpu:1.0"); err != nil {
+		t.Errorf("expected registry.example.com image to be allowed, got %v", err)
+	}
+
+	// The deny list wins over the allow list.
+	cfg.AllowedImageRegistries = "docker.io"
+	if err := checkImageRegistry(cfg, "ubuntu:16.04"); err == nil || !strings.Contains(err.Error(), "DeniedImageRegistries") {
+		t.Errorf("expected denied registry to be rejected even when allowed, got %v", err)
+	}
+}
+
+func Test_fallbackImage(t *testing.T) {
+
+	cfg := config.Config{FallbackImageRegistries: "docker.io=mirror.example.com:5000, Registry.Example.com=mirror.example.com"}
+
+	for image, expected := range map[string]string{
+		"ubuntu:16.04":                          "mirror.example.com:5000/library/ubuntu:16.04",
+		"docker.io/ubuntu:16.04":                "mirror.example.com:5000/library/ubuntu:16.04",
+		"openhorizon/cpu@sha256:0123abcd":       "mirror.example.com:5000/openhorizon/cpu@sha256:0123abcd",
+		"registry.example.com/org/cpu:1.0":      "mirror.example.com/org/cpu:1.0",
+		"registry.example.com:5000/org/cpu:1.0": "",
+	} {
+		if fallback, err := fallbackImage(cfg, image); err != nil {
+			t.Errorf("unexpected error for image %v: %v", image, err)
+		} else if fallback != expected {
+			t.Errorf("expected fallback %v for image %v, got %v", expected, image, fallback)
+		}
+	}
+
+	if fallback, err := fallbackImage(config.Config{}, "ubuntu:16.04"); err != nil || fallback != "" {
+		t.Errorf("expected no fallback without a config, got %v, error %v", fallback, err)
+	}
+}
+
+func Test_pullImageOptions(t *testing.T) {
+
+	if opts := pullImageOptions("openhorizon/cpu:1.0"); opts.Repository != "openhorizon/cpu" || opts.Tag != "1.0" {
+		t.Errorf("expected repository openhorizon/cpu and tag 1.0, got %v and %v", opts.Repository, opts.Tag)
+	}
+}
+
+func Test_pullContext_timeout(t *testing.T) {
+
+	// No timeout, the pull is not bounded.
+	ctx, cancel := pullContext(0)
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("expected no deadline without a timeout")
+	}
+	cancel()
+
+	ctx, cancel = pullContext(600)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || deadline.After(time.Now().Add(600*time.Second)) || deadline.Before(time.Now().Add(590*time.Second)) {
+		t.Errorf("expected a deadline in 600 seconds, got %v", deadline)
+	}
+}
+
+func Test_checkFreeSpace(t *testing.T) {
+
+	free := func(mb int64, err error) func(string) (int64, error) {
+		return func(path string) (int64, error) { return mb, err }
+	}
+
+	if err := checkFreeSpace("openhorizon/cpu:1.0", "/var/lib/docker", 1024, free(2048, nil)); err != nil {
+		t.Errorf("expected the pull to be allowed, got %v", err)
+	} else if err := checkFreeSpace("openhorizon/cpu:1.0", "/var/lib/docker", 1024, free(1024, nil)); err != nil {
+		t.Errorf("expected the pull to be allowed at the minimum, got %v", err)
+	} else if err := checkFreeSpace("openhorizon/cpu:1.0", "/var/lib/docker", 1024, free(1023, nil)); err == nil || !strings.Contains(err.Error(), "1023 MB free") {
+		t.Errorf("expected the pull to be refused, got %v", err)
+	}
+
+	// A free space that can't be read does not refuse the pull.
+	if err := checkFreeSpace("openhorizon/cpu:1.0", "/var/lib/docker", 1024, free(0, errors.New("no such file or directory"))); err != nil {
+		t.Errorf("expected the pull to be allowed, got %v", err)
+	}
+
+	// The real file system of the current directory can be read.
+	if _, err := freeSpaceMB("."); err != nil {
+		t.Errorf("unable to read the free space of the current directory: %v", err)
+	}
+}
+
+func Test_pullImageFromRepos_free_space(t *testing.T) {
+
+	// A docker daemon that has the cached image in its local store, and records the images pulled.
+	pulled := make([]string, 0, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/images/") && strings.HasSuffix(r.URL.Path, "/json") {
+			if strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/json") == "openhorizon/cached:1.0" {
+				w.Write([]byte(`{"Id":"sha256:0123abcd"}`))
+			} else {
+				http.Error(w, "no such image", http.StatusNotFound)
+			}
+		} else if r.Method == "POST" && r.URL.Path == "/images/create" {
+			pulled = append(pulled, r.URL.Query().Get("fromImage")+":"+r.URL.Query().Get("tag"))
+			w.Write([]byte(`{"status":"Image is up to date"}`))
+		} else {
+			http.Error(w, "unexpected call", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	client, _ := docker.NewClient(server.URL)
+
+	// No file system has this much free space.
+	cfg := config.Config{DockerStoragePath: ".", DockerMinFreeSpaceMB: 1 << 30}
+	deployment := func(image string) *containermessage.DeploymentDescription {
+		return &containermessage.DeploymentDescription{Services: map[string]*containermessage.Service{"svc": &containermessage.Service{Image: image}}}
+	}
+	auths := &docker.AuthConfigurations{Configs: make(map[string]docker.AuthConfiguration)}
+
+	// The image of the restarted service is in the store, so it is pulled regardless of the free space.
+	if err := pullImageFromRepos(cfg, auths, client, nil, deployment("openhorizon/cached:1.0")); err != nil {
+		t.Errorf("expected the cached image to be pulled, got %v", err)
+	} else if len(pulled) != 1 || pulled[0] != "openhorizon/cached:1.0" {
+		t.Errorf("expected openhorizon/cached:1.0 to be pulled, got %v", pulled)
+	}
+
+	// A new image is refused.
+	if err := pullImageFromRepos(cfg, auths, client, nil, deployment("openhorizon/new:1.0")); err == nil || !strings.Contains(err.Error(), "refusing to pull image openhorizon/new:1.0") {
+		t.Errorf("expected the pull of the new image to be refused, got %v", err)
+	} else if len(pulled) != 1 {
+		t.Errorf("expected the new image not to be pulled, got %v", pulled)
+	}
+}
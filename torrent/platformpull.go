@@ -0,0 +1,109 @@
+package torrent
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	docker "github.com/fsouza/go-dockerclient"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The image create call of the docker API takes the platform of the variant of a multi-arch image to pull, but the
+// go-dockerclient revision anax vendors predates it. Images are therefore pulled with a request made directly to the
+// docker endpoint of the client.
+
+// Pull the variant of the image for the platform, e.g. "linux/arm64". An empty platform pulls the variant for the
+// platform of the docker daemon. The errors are those the docker client returns, a *docker.Error when the docker daemon
+// rejects the pull, or the error reported in the progress stream when the pull fails after it started. The pull is
+// abandoned when the context ends.
+func pullPlatformImage(ctx context.Context, client *docker.Client, opts docker.PullImageOptions, platform string, auth docker.AuthConfiguration) error {
+	httpClient, baseURL, err := dockerAPI(client)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("fromImage", opts.Repository)
+	query.Set("tag", opts.Tag)
+	if platform != "" {
+		query.Set("platform", platform)
+	}
+	req, err := http.NewRequest("POST", baseURL+"/images/create?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if serial, err := json.Marshal(auth); err != nil {
+		return err
+	} else {
+		req.Header.Set("X-Registry-Auth", base64.URLEncoding.EncodeToString(serial))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if strings.Contains(err.Error(), "connection refused") {
+			return docker.ErrConnectionRefused
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		if body, err := ioutil.ReadAll(resp.Body); err != nil {
+			return &docker.Error{Status: resp.StatusCode, Message: fmt.Sprintf("cannot read body, err: %v", err)}
+		} else {
+			return &docker.Error{Status: resp.StatusCode, Message: string(body)}
+		}
+	}
+
+	// The docker daemon streams the progress of the pull as json messages, a failure after the pull started is
+	// reported in the stream.
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+	}
+}
+
+// Returns the HTTP client and the base URL to call the docker API at the endpoint of the docker client with.
+func dockerAPI(client *docker.Client) (*http.Client, string, error) {
+	endpoint := client.Endpoint()
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "tcp://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid docker endpoint %v, error: %v", client.Endpoint(), err)
+	}
+
+	switch {
+	case u.Scheme == "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &http.Client{Transport: transport}, "http://docker", nil
+	case u.Scheme == "https" || client.TLSConfig != nil:
+		return client.HTTPClient, "https://" + u.Host, nil
+	default:
+		return client.HTTPClient, "http://" + u.Host, nil
+	}
+}
@@ -0,0 +1,149 @@
+// +build unit
+
+package torrent
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/open-horizon/anax/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A docker API that records the image create calls and answers them with the input status and progress stream.
+func dockerAPIHandler(calls *[]*http.Request, status int, stream string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls = append(*calls, r)
+		w.WriteHeader(status)
+		w.Write([]byte(stream))
+	})
+}
+
+func Test_pullPlatformImage_platform(t *testing.T) {
+
+	calls := make([]*http.Request, 0, 2)
+	server := httptest.NewServer(dockerAPIHandler(&calls, http.StatusOK, `{"status":"Pulling from openhorizon/cpu"}{"status":"Downloaded newer image"}`))
+	defer server.Close()
+
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatalf("unable to create docker client: %v", err)
+	}
+	auth := docker.AuthConfiguration{Username: "user", Password: "pw", ServerAddress: "registry.example.com"}
+
+	// By default the variant for linux and the arch of the node is pulled.
+	cfg := config.Config{}
+	if err := pullPlatformImage(context.Background(), client, pullImageOptions("openhorizon/cpu:1.0"), cfg.PullPlatform(), auth); err != nil {
+		t.Errorf("expected the pull to succeed, got %v", err)
+	} else if q := calls[0].URL.Query(); calls[0].URL.Path != "/images/create" || q.Get("fromImage") != "openhorizon/cpu" || q.Get("tag") != "1.0" || q.Get("platform") != "linux/"+runtime.GOARCH {
+		t.Errorf("expected an image create call for openhorizon/cpu:1.0 on platform linux/%v, got %v", runtime.GOARCH, calls[0].URL)
+	}
+
+	// The registry credentials are passed to the docker daemon.
+	var sent docker.AuthConfiguration
+	if serial, err := base64.URLEncoding.DecodeString(calls[0].Header.Get("X-Registry-Auth")); err != nil {
+		t.Errorf("unable to decode the registry auth header: %v", err)
+	} else if err := json.Unmarshal(serial, &sent); err != nil || sent.Username != "user" || sent.Password != "pw" {
+		t.Errorf("expected the registry credentials to be sent, got %v, error: %v", sent, err)
+	}
+
+	// The configured platform overrides it, e.g. to run amd64 images under emulation.
+	cfg = config.Config{ImagePullPlatform: "linux/amd64"}
+	if err := pullPlatformImage(context.Background(), client, pullImageOptions("openhorizon/cpu:1.0"), cfg.PullPlatform(), auth); err != nil {
+		t.Errorf("expected the pull to succeed, got %v", err)
+	} else if p := calls[1].URL.Query().Get("platform"); p != "linux/amd64" {
+		t.Errorf("expected platform linux/amd64, got %v", p)
+	}
+}
+
+func Test_pullPlatformImage_errors(t *testing.T) {
+
+	// The docker daemon rejects the pull.
+	calls := make([]*http.Request, 0, 1)
+	server := httptest.NewServer(dockerAPIHandler(&calls, http.StatusInternalServerError, "Get https://registry.example.com/v2/: dial tcp: i/o timeout"))
+	client, _ := docker.NewClient(server.URL)
+	err := pullPlatformImage(context.Background(), client, pullImageOptions("registry.example.com/cpu:1.0"), "linux/amd64", docker.AuthConfiguration{})
+	server.Close()
+	if dErr, ok := err.(*docker.Error); !ok || dErr.Status != http.StatusInternalServerError {
+		t.Errorf("expected a docker error with status 500, got %v", err)
+	} else if pullFailureOutcome(err) != PULL_NETWORK_FAILURE {
+		t.Errorf("expected the rejected pull to be a network failure, got %v", pullFailureOutcome(err))
+	}
+
+	// The pull fails after it started.
+	server = httptest.NewServer(dockerAPIHandler(&calls, http.StatusOK, `{"status":"Pulling from cpu"}{"errorDetail":{"message":"no matching manifest for linux/s390x"},"error":"no matching manifest for linux/s390x"}`))
+	client, _ = docker.NewClient(server.URL)
+	err = pullPlatformImage(context.Background(), client, pullImageOptions("cpu:1.0"), "linux/s390x", docker.AuthConfiguration{})
+	server.Close()
+	if err == nil || !strings.Contains(err.Error(), "no matching manifest") {
+		t.Errorf("expected the error in the progress stream, got %v", err)
+	}
+}
+
+func Test_pullPlatformImage_unix(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dockerapi")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unable to listen on %v: %v", socket, err)
+	}
+	calls := make([]*http.Request, 0, 1)
+	go http.Serve(listener, dockerAPIHandler(&calls, http.StatusOK, `{"status":"Downloaded newer image"}`))
+	defer listener.Close()
+
+	// The default docker endpoint of anax is a unix socket.
+	client, err := docker.NewClient("unix://" + socket)
+	if err != nil {
+		t.Fatalf("unable to create docker client: %v", err)
+	} else if err := pullPlatformImage(context.Background(), client, pullImageOptions("cpu:1.0"), "linux/arm64", docker.AuthConfiguration{}); err != nil {
+		t.Errorf("expected the pull to succeed, got %v", err)
+	} else if len(calls) != 1 || calls[0].URL.Query().Get("platform") != "linux/arm64" {
+		t.Errorf("expected one image create call on platform linux/arm64, got %v", calls)
+	}
+}
+
+func Test_pullPlatformImage_context(t *testing.T) {
+
+	// A pull that hangs in the docker daemon.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"Pulling from cpu"}`))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	client, _ := docker.NewClient(server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- pullPlatformImage(ctx, client, pullImageOptions("cpu:1.0"), "linux/amd64", docker.AuthConfiguration{})
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || ctx.Err() == nil {
+			t.Errorf("expected the pull to be abandoned when the context ended, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("the pull was not abandoned when the context ended")
+	}
+}
@@ -0,0 +1,118 @@
+package torrent
+
+import (
+	docker "github.com/fsouza/go-dockerclient"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The terminal outcomes of an image pull.
+const (
+	PULL_SUCCESS         = "success"
+	PULL_AUTH_FAILURE    = "auth_failure"
+	PULL_NETWORK_FAILURE = "network_failure"
+	PULL_FAILURE         = "failure"
+)
+
+// The pull statistics of a single image, suitable for the status API. Durations include the time spent waiting
+// between retries, because that is how long a workload start waits for the image.
+type ImagePullStats struct {
+	Pulls           int    `json:"pulls"`             // number of completed pulls, successful or not
+	Attempts        int    `json:"attempts"`          // number of docker pull attempts across all pulls
+	Successes       int    `json:"successes"`         // number of pulls that succeeded
+	AuthFailures    int    `json:"auth_failures"`     // number of pulls that failed because the registry rejected the credentials
+	NetworkFailures int    `json:"network_failures"`  // number of pulls that failed because the registry could not be reached
+	OtherFailures   int    `json:"other_failures"`    // number of pulls that failed for any other reason
+	LastOutcome     string `json:"last_outcome"`      // outcome of the most recent pull
+	LastDurationMs  int64  `json:"last_duration_ms"`  // duration of the most recent pull
+	MaxDurationMs   int64  `json:"max_duration_ms"`   // duration of the slowest pull
+	TotalDurationMs int64  `json:"total_duration_ms"` // sum of the durations of all pulls, for computing an average
+	LastPullTime    int64  `json:"last_pull_time"`    // time when the most recent pull completed
+}
+
+// Records the outcome of image pulls. It is safe for concurrent use.
+type ImagePullMetrics struct {
+	lock   sync.Mutex
+	images map[string]*ImagePullStats
+}
+
+func NewImagePullMetrics() *ImagePullMetrics {
+	return &ImagePullMetrics{
+		images: make(map[string]*ImagePullStats),
+	}
+}
+
+// The image pull metrics of this process. Every call to pullImageFromRepos records into it.
+var PullMetrics = NewImagePullMetrics()
+
+// Record a completed pull of the image.
+func (m *ImagePullMetrics) Record(image string, attempts int, duration time.Duration, outcome string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, ok := m.images[image]
+	if !ok {
+		s = &ImagePullStats{}
+		m.images[image] = s
+	}
+
+	ms := int64(duration / time.Millisecond)
+	s.Pulls++
+	s.Attempts += attempts
+	switch outcome {
+	case PULL_SUCCESS:
+		s.Successes++
+	case PULL_AUTH_FAILURE:
+		s.AuthFailures++
+	case PULL_NETWORK_FAILURE:
+		s.NetworkFailures++
+	default:
+		s.OtherFailures++
+	}
+	s.LastOutcome = outcome
+	s.LastDurationMs = ms
+	if ms > s.MaxDurationMs {
+		s.MaxDurationMs = ms
+	}
+	s.TotalDurationMs += ms
+	s.LastPullTime = time.Now().Unix()
+}
+
+// Returns a copy of the statistics of every image pulled so far, keyed by image name.
+func (m *ImagePullMetrics) Snapshot() map[string]ImagePullStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	snap := make(map[string]ImagePullStats, len(m.images))
+	for image, s := range m.images {
+		snap[image] = *s
+	}
+	return snap
+}
+
+// Returns the outcome of a pull that failed with the input error.
+func pullFailureOutcome(err error) string {
+	if dErr, ok := err.(*docker.Error); ok {
+		if dErr.Status == 401 || dErr.Status == 403 || (dErr.Status == 500 && strings.Contains(dErr.Message, "cred")) {
+			return PULL_AUTH_FAILURE
+		}
+		for _, s := range []string{"dial tcp", "i/o timeout", "no such host", "connection refused", "connection reset", "TLS handshake timeout"} {
+			if strings.Contains(dErr.Message, s) {
+				return PULL_NETWORK_FAILURE
+			}
+		}
+		return PULL_FAILURE
+	}
+
+	switch err.(type) {
+	case net.Error, *url.Error:
+		return PULL_NETWORK_FAILURE
+	}
+	if err == docker.ErrConnectionRefused {
+		return PULL_NETWORK_FAILURE
+	}
+	return PULL_FAILURE
+}
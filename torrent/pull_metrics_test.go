@@ -0,0 +1,82 @@
+// +build unit
+
+package torrent
+
+import (
+	"errors"
+	docker "github.com/fsouza/go-dockerclient"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_ImagePullMetrics_Record(t *testing.T) {
+
+	m := NewImagePullMetrics()
+	m.Record("example/cpu:1.0", 1, 2*time.Second, PULL_SUCCESS)
+	m.Record("example/cpu:1.0", 3, 5*time.Second, PULL_NETWORK_FAILURE)
+	m.Record("example/gps:1.0", 3, time.Second, PULL_AUTH_FAILURE)
+
+	snap := m.Snapshot()
+	if len(snap) != 2 {
+		t.Errorf("expected stats for 2 images, got %v", snap)
+	}
+
+	cpu := snap["example/cpu:1.0"]
+	if cpu.Pulls != 2 || cpu.Attempts != 4 || cpu.Successes != 1 || cpu.NetworkFailures != 1 {
+		t.Errorf("wrong counts for cpu image: %v", cpu)
+	} else if cpu.LastOutcome != PULL_NETWORK_FAILURE || cpu.LastDurationMs != 5000 || cpu.MaxDurationMs != 5000 || cpu.TotalDurationMs != 7000 {
+		t.Errorf("wrong outcome or durations for cpu image: %v", cpu)
+	}
+
+	if gps := snap["example/gps:1.0"]; gps.AuthFailures != 1 || gps.LastOutcome != PULL_AUTH_FAILURE {
+		t.Errorf("wrong stats for gps image: %v", gps)
+	}
+
+	// The snapshot is a copy.
+	m.Record("example/gps:1.0", 1, time.Second, PULL_SUCCESS)
+	if snap["example/gps:1.0"].Pulls != 1 {
+		t.Errorf("snapshot changed after a new pull was recorded: %v", snap["example/gps:1.0"])
+	}
+}
+
+func Test_ImagePullMetrics_concurrent(t *testing.T) {
+
+	m := NewImagePullMetrics()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Record("example/cpu:1.0", 1, time.Millisecond, PULL_SUCCESS)
+			m.Snapshot()
+		}()
+	}
+	wg.Wait()
+
+	if s := m.Snapshot()["example/cpu:1.0"]; s.Pulls != 50 || s.Successes != 50 {
+		t.Errorf("expected 50 recorded pulls, got %v", s)
+	}
+}
+
+func Test_pullFailureOutcome(t *testing.T) {
+
+	for outcome, err := range map[string]error{
+		PULL_AUTH_FAILURE:    &docker.Error{Status: 500, Message: "Get https://registry/v2/: no basic auth credentials"},
+		PULL_NETWORK_FAILURE: &docker.Error{Status: 500, Message: "Get https://registry/v2/: dial tcp: lookup registry: no such host"},
+		PULL_FAILURE:         &docker.Error{Status: 404, Message: "manifest for example/cpu:9.9 not found"},
+	} {
+		if o := pullFailureOutcome(err); o != outcome {
+			t.Errorf("expected outcome %v for %v, got %v", outcome, err, o)
+		}
+	}
+
+	if o := pullFailureOutcome(&net.OpError{Op: "dial", Err: errors.New("refused")}); o != PULL_NETWORK_FAILURE {
+		t.Errorf("expected a network failure for a net error, got %v", o)
+	} else if o := pullFailureOutcome(docker.ErrConnectionRefused); o != PULL_NETWORK_FAILURE {
+		t.Errorf("expected a network failure for a refused docker connection, got %v", o)
+	} else if o := pullFailureOutcome(errors.New("something else")); o != PULL_FAILURE {
+		t.Errorf("expected a generic failure, got %v", o)
+	}
+}
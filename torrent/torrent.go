@@ -146,10 +146,10 @@ func processFetch(cfg *config.HorizonConfig, client *docker.Client, db *bolt.DB,
 	var fetchErr error
 
 	skipCheckFn := skipCheckFn(client)
-	if torrentUrl.String() == "" && torrentSig == "" {
+	if !useTorrent(cfg.Edge, torrentUrl, torrentSig) {
 		// using Docker pull (newer option, uses docker client to pull images from repos in image names in deployment description)
 		// Note: we don't want to make this a fallback option, it's a potential security vector
-		glog.V(3).Infof("Empty torrent URL '%v' and Signature '%v' provided in LaunchContext, using Docker pull mechanism to retrieve and load Docker images into local registry", torrentUrl.String(), torrentSig)
+		glog.V(3).Infof("Using Docker pull mechanism to retrieve and load Docker images into local registry for services %v, image fetch strategy '%v', torrent URL '%v' and Signature '%v' provided in LaunchContext", deploymentDesc.ServiceNames(), cfg.Edge.ImageFetchStrategy, torrentUrl.String(), torrentSig)
 
 		fetchErr = pullImageFromRepos(cfg.Edge, dockerAuth, client, &skipCheckFn, deploymentDesc)
 
@@ -158,6 +158,8 @@ func processFetch(cfg *config.HorizonConfig, client *docker.Client, db *bolt.DB,
 		// imageFiles is of form {<repotag>: <part abspath> or empty string}
 		var imageFiles map[string]string
 
+		glog.V(3).Infof("Using torrent %v to retrieve and load Docker images into local registry for services %v, image fetch strategy '%v'", torrentUrl.String(), deploymentDesc.ServiceNames(), cfg.Edge.ImageFetchStrategy)
+
 		imageFiles, fetchErr = fetch.PkgFetch(cfg.Collaborators.HTTPClientFactory.WrappedNewHTTPClient(), &skipCheckFn, torrentUrl, torrentSig, cfg.Edge.TorrentDir, pemFiles, httpAuth)
 
 		if fetchErr == nil {
@@ -169,6 +171,16 @@ func processFetch(cfg *config.HorizonConfig, client *docker.Client, db *bolt.DB,
 	return fetchErr
 }
 
+// Returns true if the images should be fetched with the torrent in the launch context, rather than pulled from their
+// registries. A torrent is only used when the launch context has one and the configured strategy does not restrict
+// fetching to registry pulls.
+func useTorrent(cfg config.Config, torrentUrl url.URL, torrentSig string) bool {
+	if cfg.ImageFetchStrategy == config.ImageFetchRegistryOnly {
+		return false
+	}
+	return torrentUrl.String() != "" || torrentSig != ""
+}
+
 func (b *TorrentWorker) CommandHandler(command worker.Command) bool {
 
 	switch command.(type) {
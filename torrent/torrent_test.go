@@ -0,0 +1,28 @@
+// +build unit
+
+package torrent
+
+import (
+	"github.com/open-horizon/anax/config"
+	"net/url"
+	"testing"
+)
+
+func Test_useTorrent(t *testing.T) {
+
+	torrentUrl, _ := url.Parse("https://images.bluehorizon.network/f27f762cef632af1a19cd8a761ac4c3da4f9ef7d.torrent")
+
+	// By default, the torrent is used when the workload has one.
+	if !useTorrent(config.Config{}, *torrentUrl, "abcdef") {
+		t.Errorf("expected the torrent to be used by default")
+	} else if !useTorrent(config.Config{ImageFetchStrategy: config.ImageFetchTorrentPreferred}, *torrentUrl, "abcdef") {
+		t.Errorf("expected the torrent to be used when preferred")
+	} else if useTorrent(config.Config{}, url.URL{}, "") {
+		t.Errorf("expected images to be pulled when there is no torrent")
+	}
+
+	// The registry only strategy ignores the torrent.
+	if useTorrent(config.Config{ImageFetchStrategy: config.ImageFetchRegistryOnly}, *torrentUrl, "abcdef") {
+		t.Errorf("expected the torrent to be ignored for the registry only strategy")
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"github.com/golang/glog"
 	"github.com/open-horizon/anax/config"
 	"github.com/open-horizon/anax/events"
+	"math/rand"
 	"runtime"
+	"sync"
 	"time"
 )
 
@@ -111,6 +113,7 @@ type BaseWorker struct {
 	DeferredDelay    int                   // the number of seconds to delay before retrying
 	SubWorkers       map[string]*SubWorker // workers can have sub go routines that they own
 	ShuttingDown     bool
+	JitterPercent    int // the percentage by which the periodic waits of the worker and its subworkers are randomly varied
 }
 
 func NewBaseWorker(name string, cfg *config.HorizonConfig) BaseWorker {
@@ -219,6 +222,32 @@ func (w *BaseWorker) internalCommandhandler(worker Worker, command Command) bool
 	return false
 }
 
+// Vary the periodic waits of the worker and its subworkers by up to the input percentage, so that the periodic work of
+// many processes started at the same time spreads out. Must be called before Start. Zero (the default) means no jitter.
+func (w *BaseWorker) SetJitter(percent int) {
+	w.JitterPercent = percent
+}
+
+// Returns the input interval in seconds, randomly lengthened or shortened by up to the worker's JitterPercent.
+func (w *BaseWorker) JitteredInterval(seconds int) time.Duration {
+	return Jitter(time.Duration(seconds)*time.Second, w.JitterPercent)
+}
+
+// The random source for jitter, seeded so that processes started together get different jitter.
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var jitterLock sync.Mutex
+
+// Returns the input interval randomly lengthened or shortened by up to the input percentage of the interval.
+func Jitter(interval time.Duration, percent int) time.Duration {
+	if percent <= 0 || interval <= 0 {
+		return interval
+	}
+	jitterLock.Lock()
+	factor := jitterRand.Float64()*2 - 1
+	jitterLock.Unlock()
+	return interval + time.Duration(factor*float64(percent)/100*float64(interval))
+}
+
 // This function kicks off the go routine that the worker's logic runs in.
 func (w *BaseWorker) Start(worker Worker, noWorkInterval int) {
 	go func() {
@@ -244,11 +273,11 @@ func (w *BaseWorker) Start(worker Worker, noWorkInterval int) {
 
 			} else {
 				glog.V(2).Infof(cdLogString(fmt.Sprintf("%v command processor non-blocking for commands", w.GetName())))
-				waitTime := noWorkInterval
+				waitTime := w.JitteredInterval(noWorkInterval)
 
 				// If there are deferred commands, then we need to use the non-blocking recieve with a timeout.
 				if noWorkInterval == 0 {
-					waitTime = 5
+					waitTime = 5 * time.Second
 				}
 
 				// Get commands from the channel and dispatch to the command handler.
@@ -259,7 +288,7 @@ func (w *BaseWorker) Start(worker Worker, noWorkInterval int) {
 						return
 					}
 
-				case <-time.After(time.Duration(waitTime) * time.Second):
+				case <-time.After(waitTime):
 					// Call the no work to do handler if it was requested.
 					if noWorkInterval != 0 {
 						worker.NoWorkHandler()
@@ -354,7 +383,7 @@ func (w *BaseWorker) DispatchSubworker(name string, runSubWorker func() int, int
 				w.Commands <- NewSubWorkerTerminationCommand(name)
 				glog.V(3).Infof(cdLogString(fmt.Sprintf("exiting subworker %v", name)))
 				return
-			case <-time.After(time.Duration(nextWaitTime) * time.Second):
+			case <-time.After(w.JitteredInterval(nextWaitTime)):
 				returnedWait := runSubWorker()
 				if returnedWait > 0 {
 					nextWaitTime = returnedWait
@@ -459,3 +459,22 @@ func getBasicConfig() *config.HorizonConfig {
 var testLogString = func(v interface{}) string {
 	return fmt.Sprintf("TestWorker %v", v)
 }
+
+func Test_Jitter(t *testing.T) {
+
+	interval := 60 * time.Second
+	if j := Jitter(interval, 0); j != interval {
+		t.Errorf("expected no jitter, got %v", j)
+	}
+
+	for i := 0; i < 100; i++ {
+		if j := Jitter(interval, 10); j < 54*time.Second || j > 66*time.Second {
+			t.Errorf("expected jitter within 10 percent of %v, got %v", interval, j)
+		}
+	}
+
+	bw := NewBaseWorker("jitter", &config.HorizonConfig{})
+	if j := bw.JitteredInterval(5); j != 5*time.Second {
+		t.Errorf("expected no jitter by default, got %v", j)
+	}
+}